@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os/user"
+	"sort"
+	"strings"
+
+	"github.com/ratorx/sshca/executor"
+)
+
+// getentNotFound is the exit code of getent when some of the keys weren't
+// found.
+const getentNotFound = 2
+
+// lookupAccounts returns which of names are user accounts according to getent
+// passwd, which asks NSS (so LDAP and SSSD accounts are found too) on host.
+// localhost is checked directly; other hosts are checked with ssh.
+func lookupAccounts(host string, names []string) (map[string]bool, error) {
+	cmd := executor.Command{Path: "getent", Args: append([]string{"passwd"}, names...)}
+	if host != "localhost" {
+		// -- stops ssh from parsing options in the command
+		cmd = executor.Command{Path: "ssh", Args: append([]string{"-o", "BatchMode=yes", host, "--", "getent", "passwd"}, names...)}
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := executor.OrDefault(nil).Run(cmd); err != nil {
+		var exitErr interface{ ExitCode() int }
+		if !errors.As(err, &exitErr) || exitErr.ExitCode() != getentNotFound {
+			return nil, fmt.Errorf("%s failed: %w: %s", cmd, err, strings.TrimSpace(stderr.String()))
+		}
+	}
+
+	accounts := make(map[string]bool, len(names))
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		if i := strings.Index(scanner.Text(), ":"); i > 0 {
+			accounts[scanner.Text()[:i]] = true
+		}
+	}
+	return accounts, nil
+}
+
+// userGroups returns the names of the groups of u, from id -Gn, which asks
+// NSS like getent.
+func userGroups(u *user.User) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := executor.Command{Path: "id", Args: []string{"-Gn", usernameOf(u)}, Stdout: &stdout, Stderr: &stderr}
+	if err := executor.OrDefault(nil).Run(cmd); err != nil {
+		return nil, fmt.Errorf("failed to get the groups of %s: %w: %s", usernameOf(u), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.Fields(stdout.String()), nil
+}
+
+// principalSuggestion is a principal that u is likely to need, and why.
+type principalSuggestion struct {
+	Principal string
+	Source    string
+}
+
+// suggestPrincipals suggests principals for u: the default principals of
+// sign_user, then the groups of u, which sshd can map to principals with
+// AuthorizedPrincipalsFile or AuthorizedPrincipalsCommand.
+func suggestPrincipals(u *user.User) []principalSuggestion {
+	var suggestions []principalSuggestion
+	for i, principal := range defaultPrincipals(u) {
+		source := "username"
+		if i > 0 {
+			source = "principal_domain"
+		}
+		suggestions = append(suggestions, principalSuggestion{principal, source})
+	}
+	groups, err := userGroups(u)
+	if err != nil {
+		out.warning(err.Error())
+	}
+	for _, group := range groups {
+		suggestions = append(suggestions, principalSuggestion{group, "group"})
+	}
+	return suggestions
+}
+
+// accountPrincipals returns the principals that should be accounts on the
+// account hosts. Principals with an @ (server groups and principals with a
+// domain) are mapped to accounts by the hosts, so they aren't checked.
+func accountPrincipals(principals []string) []string {
+	var names []string
+	for _, principal := range principals {
+		if !strings.Contains(principal, "@") {
+			names = append(names, principal)
+		}
+	}
+	return names
+}
+
+// missingAccounts returns the account_hosts from the config that each of
+// principals isn't an account on, and the number of hosts that were checked.
+// Hosts that can't be checked are reported as warnings.
+func missingAccounts(principals []string) (map[string][]string, int) {
+	missing := map[string][]string{}
+	names := accountPrincipals(principals)
+	if len(names) == 0 {
+		return missing, 0
+	}
+	checked := 0
+	for _, host := range config.AccountHosts {
+		accounts, err := lookupAccounts(host, names)
+		if err != nil {
+			out.warning(fmt.Sprintf("couldn't check the accounts on %s: %s", host, err))
+			continue
+		}
+		checked++
+		for _, name := range names {
+			if !accounts[name] {
+				missing[name] = append(missing[name], host)
+			}
+		}
+	}
+	return missing, checked
+}
+
+// warnMissingAccounts warns about the principals that aren't accounts on all
+// the account_hosts from the config, since they probably have a typo.
+func warnMissingAccounts(principals []string) {
+	missing, _ := missingAccounts(principals)
+	names := make([]string, 0, len(missing))
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out.warning(fmt.Sprintf("principal %q isn't an account on %s (run sshca principals for suggestions)", name, strings.Join(missing[name], ", ")))
+	}
+}
+
+// PrincipalsCmd is the command that suggests principals for sign_user.
+type PrincipalsCmd struct {
+	AsUser string             `arg:"--as-user" placeholder:"USER" help:"user to suggest principals for (default: like sign_user)"`
+	Check  CommaSeparatedList `arg:"--check" placeholder:"PRINCIPALS" help:"check these principals against the account_hosts from the config instead of suggesting principals"`
+}
+
+// Validate implementation for Command
+func (p PrincipalsCmd) Validate() error {
+	return validatePrincipals(p.Check.Items)
+}
+
+// Run implementation for Command
+func (p PrincipalsCmd) Run() error {
+	if len(p.Check.Items) != 0 {
+		if len(config.AccountHosts) == 0 {
+			return fmt.Errorf("--check needs account_hosts in the config")
+		}
+		missing, checked := missingAccounts(p.Check.Items)
+		if checked == 0 && len(accountPrincipals(p.Check.Items)) != 0 {
+			return fmt.Errorf("couldn't check any of the account_hosts")
+		}
+		for _, principal := range p.Check.Items {
+			if strings.Contains(principal, "@") {
+				fmt.Printf("%s %s: not an account name\n", out.label(colorYellow, "skipped"), principal)
+			} else if hosts, ok := missing[principal]; ok {
+				fmt.Printf("%s %s: not an account on %s\n", out.label(colorRed, "missing"), principal, strings.Join(hosts, ", "))
+			} else {
+				fmt.Printf("%s %s\n", out.label(colorGreen, "ok"), principal)
+			}
+		}
+		if len(missing) != 0 {
+			return fmt.Errorf("%d principals aren't accounts on all the account hosts", len(missing))
+		}
+		return nil
+	}
+
+	u, err := targetUser(p.AsUser)
+	if err != nil {
+		return err
+	}
+	suggestions := suggestPrincipals(u)
+	// Groups aren't accounts, so only the username is checked
+	var principals []string
+	for _, suggestion := range suggestions {
+		if suggestion.Source != "group" {
+			principals = append(principals, suggestion.Principal)
+		}
+	}
+	missing, _ := missingAccounts(principals)
+	for _, suggestion := range suggestions {
+		line := fmt.Sprintf("%s (%s)", suggestion.Principal, suggestion.Source)
+		if hosts, ok := missing[suggestion.Principal]; ok {
+			line += fmt.Sprintf(" - not an account on %s", strings.Join(hosts, ", "))
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// privateKeyPath returns the path of the private key for a public key
+// (key.pub is the public key for key).
+func privateKeyPath(publicKeyPath string) string {
+	return strings.TrimSuffix(publicKeyPath, ".pub")
+}
+
+// readPrivateKey parses the private key at path, asking for the passphrase on
+// the terminal if the key is encrypted.
+func readPrivateKey(path string) (interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key at %s: %w", path, err)
+	}
+
+	key, err := ssh.ParseRawPrivateKey(data)
+	var missingErr *ssh.PassphraseMissingError
+	if !errors.As(err, &missingErr) {
+		return key, err
+	}
+
+	fmt.Fprintf(os.Stderr, "enter passphrase for %s: ", path)
+	passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+}
+
+// dialAgent connects to the ssh-agent at SSH_AUTH_SOCK. The connection must be
+// closed by the caller.
+func dialAgent() (agent.ExtendedAgent, net.Conn, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, nil, fmt.Errorf("SSH_AUTH_SOCK is not set, is ssh-agent running?")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to ssh-agent: %w", err)
+	}
+	return agent.NewClient(conn), conn, nil
+}
+
+// addToAgent adds the private key for the public key at publicKeyPath to
+// ssh-agent, along with its certificate. The agent removes the key when the
+// certificate expires.
+func addToAgent(publicKeyPath string, certificate *ca.PublicKey) error {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(certificate.Data)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("signed key is not a certificate")
+	}
+
+	var lifetime time.Duration
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		lifetime = time.Until(time.Unix(int64(cert.ValidBefore), 0))
+		if lifetime <= 0 {
+			return fmt.Errorf("certificate has already expired")
+		}
+	}
+
+	privateKey, err := readPrivateKey(privateKeyPath(publicKeyPath))
+	if err != nil {
+		return err
+	}
+
+	agentClient, conn, err := dialAgent()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = agentClient.Add(agent.AddedKey{
+		PrivateKey:   privateKey,
+		Certificate:  cert,
+		Comment:      cert.KeyId,
+		LifetimeSecs: uint32(lifetime / time.Second),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add certificate to ssh-agent: %w", err)
+	}
+	out.success("added certificate to ssh-agent")
+	return nil
+}
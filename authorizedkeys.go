@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/ratorx/sshca/ca"
+	"golang.org/x/crypto/ssh"
+)
+
+// Helpers for trusting a user CA in ~/.ssh/authorized_keys with a
+// cert-authority line, which works without access to sshd_config.
+
+// authorizedCALine returns the cert-authority line for key with the given
+// options (e.g. principals="a,b").
+func authorizedCALine(key *ca.PublicKey, options []string) []byte {
+	options = append([]string{"cert-authority"}, options...)
+	return []byte(strings.Join(options, ",") + " " + strings.TrimSpace(key.String()) + "\n")
+}
+
+// isAuthorizedCA reports whether the authorized_keys line is a cert-authority
+// line for key.
+func isAuthorizedCA(line []byte, key *ca.PublicKey) bool {
+	parsed, _, options, _, err := ssh.ParseAuthorizedKey(line)
+	if err != nil || !key.Matches(parsed) {
+		return false
+	}
+	for _, option := range options {
+		if strings.EqualFold(option, "cert-authority") {
+			return true
+		}
+	}
+	return false
+}
+
+// updateAuthorizedCA replaces the cert-authority lines for key in an
+// authorized_keys file with one with the given options, keeping the position
+// of the first one. It returns the updated contents and whether they changed.
+func updateAuthorizedCA(contents []byte, key *ca.PublicKey, options []string) ([]byte, bool) {
+	want := authorizedCALine(key, options)
+	var updated bytes.Buffer
+	found := false
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := append(scanner.Bytes(), '\n')
+		if !isAuthorizedCA(line, key) {
+			updated.Write(line)
+			continue
+		}
+		if !found {
+			updated.Write(want)
+			found = true
+		}
+	}
+	if !found {
+		updated.Write(want)
+	}
+	return updated.Bytes(), !bytes.Equal(updated.Bytes(), contents)
+}
+
+// authorizedCAOptions returns the authorized_keys options for the trust flags.
+func (t TrustCmd) authorizedCAOptions() []string {
+	var options []string
+	if len(t.AuthorizedPrincipals.Items) != 0 {
+		options = append(options, `principals="`+strings.Join(t.AuthorizedPrincipals.Items, ",")+`"`)
+	}
+	if t.From != "" {
+		options = append(options, `from="`+t.From+`"`)
+	}
+	return options
+}
+
+// trustInAuthorizedKeys trusts publicKey for user authentication as u with a
+// cert-authority line in their authorized_keys.
+func (t TrustCmd) trustInAuthorizedKeys(publicKey *ca.PublicKey, u *user.User) error {
+	sshDir, err := userSSHDir(u)
+	if err != nil {
+		return err
+	}
+	owner := ownerOf(u)
+	if _, err := os.Stat(sshDir); os.IsNotExist(err) {
+		if err := os.Mkdir(sshDir, 0o700); err != nil {
+			return fmt.Errorf("failed to create %s: %w", sshDir, err)
+		}
+		if err := (fileOptions{mode: 0o700, owner: owner}).apply(sshDir); err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(sshDir, "authorized_keys")
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	updated, changed := updateAuthorizedCA(contents, publicKey, t.authorizedCAOptions())
+	if changed {
+		// sshd ignores authorized_keys that others can write to
+		if err := replaceFile(path, updated, fileOptions{mode: 0o600, owner: owner}); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+
+	out.success("trusted public key (fingerprint %s) as authority for user authentication as %s", publicKey.Fingerprint(), usernameOf(u))
+	return nil
+}
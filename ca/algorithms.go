@@ -0,0 +1,158 @@
+package ca
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"github.com/ratorx/sshca/openssh"
+	"golang.org/x/crypto/ssh"
+)
+
+// AlgorithmPolicy restricts the key algorithms that the server will sign, and
+// the algorithms that the CA signs with. The zero value allows everything.
+type AlgorithmPolicy struct {
+	// Name identifies the policy in error messages.
+	Name string
+	// KeyTypes are the allowed key types (e.g. ecdsa-sha2-nistp256) for both
+	// the submitted keys and the CA key. Empty allows all key types.
+	KeyTypes []string
+	// SignatureAlgorithms are the allowed CA signature algorithms (e.g.
+	// rsa-sha2-512). Empty allows all signature algorithms.
+	SignatureAlgorithms []string
+	// MinRSABits is the smallest allowed RSA modulus.
+	MinRSABits int
+}
+
+// FIPSAlgorithmPolicy only allows FIPS 186-4 approved algorithms: RSA with
+// SHA-2 and ECDSA on the NIST curves.
+var FIPSAlgorithmPolicy = AlgorithmPolicy{
+	Name: "FIPS",
+	KeyTypes: []string{
+		ssh.KeyAlgoRSA,
+		ssh.KeyAlgoECDSA256,
+		ssh.KeyAlgoECDSA384,
+		ssh.KeyAlgoECDSA521,
+	},
+	SignatureAlgorithms: []string{
+		ssh.SigAlgoRSASHA2512,
+		ssh.SigAlgoRSASHA2256,
+		ssh.KeyAlgoECDSA256,
+		ssh.KeyAlgoECDSA384,
+		ssh.KeyAlgoECDSA521,
+	},
+	MinRSABits: 2048,
+}
+
+func (p AlgorithmPolicy) describe() string {
+	if p.Name == "" {
+		return "the algorithm policy"
+	}
+	return fmt.Sprintf("the %s algorithm policy", p.Name)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckKey returns an error explaining the policy if key is not allowed. This
+// also validates that the key can be parsed.
+func (p AlgorithmPolicy) CheckKey(key *PublicKey) error {
+	if err := key.parse(); err != nil {
+		return err
+	}
+
+	keyType := key.key.Type()
+	if len(p.KeyTypes) != 0 && !contains(p.KeyTypes, keyType) {
+		return fmt.Errorf("%s keys are not allowed by %s (allowed: %s)", keyType, p.describe(), strings.Join(p.KeyTypes, ", "))
+	}
+
+	if cryptoKey, ok := key.key.(ssh.CryptoPublicKey); ok && p.MinRSABits != 0 {
+		if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < p.MinRSABits {
+			return fmt.Errorf("%d bit RSA keys are not allowed by %s (minimum: %d)", rsaKey.N.BitLen(), p.describe(), p.MinRSABits)
+		}
+	}
+
+	return nil
+}
+
+// signatureAlgorithms returns the signature algorithms that a CA key of the
+// given type can produce, in order of preference.
+func signatureAlgorithms(caKeyType string) []string {
+	if caKeyType == ssh.KeyAlgoRSA {
+		return []string{ssh.SigAlgoRSASHA2512, ssh.SigAlgoRSASHA2256, ssh.SigAlgoRSA}
+	}
+	// Other key types only have one signature algorithm, which has the same
+	// name as the key type
+	return []string{caKeyType}
+}
+
+// KeySignatureAlgorithm returns the signature algorithm of a CA key of the
+// given type, or the empty string for RSA keys, which can sign with several.
+func KeySignatureAlgorithm(caKeyType string) string {
+	algorithms := signatureAlgorithms(caKeyType)
+	if len(algorithms) != 1 {
+		return ""
+	}
+	return algorithms[0]
+}
+
+// CertSignatureAlgorithm returns the algorithm that the CA signed the
+// certificate p with.
+func (p *PublicKey) CertSignatureAlgorithm() (string, error) {
+	cert, err := p.certificate()
+	if err != nil {
+		return "", err
+	}
+	return cert.Signature.Format, nil
+}
+
+// certSignatureAlgorithm returns the algorithm that the server signs
+// certificates with: the one chosen by the policy, or the default of
+// ssh-keygen, which signs with SHA-2 for RSA keys since it could choose.
+func (ca Server) certSignatureAlgorithm() string {
+	if ca.signatureAlgorithm != "" {
+		return ca.signatureAlgorithm
+	}
+	if algorithm := KeySignatureAlgorithm(ca.PublicKey.Type()); algorithm != "" {
+		return algorithm
+	}
+	if ca.SSHKeygen.Version.Supports(openssh.CertSignatureAlgorithm) {
+		return ssh.SigAlgoRSASHA2512
+	}
+	return ssh.SigAlgoRSA
+}
+
+// caSignatureAlgorithm checks that the CA key is allowed by the policy and
+// chooses the signature algorithm to use with it. The empty string means the
+// ssh-keygen default can be used.
+func (p AlgorithmPolicy) caSignatureAlgorithm(caKey *PublicKey, version openssh.Version) (string, error) {
+	if err := p.CheckKey(caKey); err != nil {
+		return "", fmt.Errorf("CA key: %w", err)
+	}
+	if len(p.SignatureAlgorithms) == 0 {
+		return "", nil
+	}
+
+	candidates := signatureAlgorithms(caKey.Type())
+	for _, algorithm := range candidates {
+		if !contains(p.SignatureAlgorithms, algorithm) {
+			continue
+		}
+		if len(candidates) == 1 {
+			// There is no choice to make
+			return "", nil
+		}
+		if !version.Supports(openssh.CertSignatureAlgorithm) {
+			return "", fmt.Errorf("%s can't choose the CA signature algorithm (needs %s)", version, openssh.CertSignatureAlgorithm.Since)
+		}
+		return algorithm, nil
+	}
+
+	return "", fmt.Errorf("a %s CA key can't sign with any of the signature algorithms allowed by %s (allowed: %s)", caKey.Type(), p.describe(), strings.Join(p.SignatureAlgorithms, ", "))
+}
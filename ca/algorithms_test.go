@@ -0,0 +1,134 @@
+package ca
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/ratorx/sshca/openssh"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func mustNewPublicKey(t *testing.T, path string) *PublicKey {
+	t.Helper()
+	key, err := NewPublicKey(path)
+	assert.Nil(t, err)
+	return key
+}
+
+func TestAlgorithmPolicyCheckKeyAllowsEverythingByDefault(t *testing.T) {
+	assert.Nil(t, AlgorithmPolicy{}.CheckKey(testPublicKey))
+	assert.Nil(t, AlgorithmPolicy{}.CheckKey(mustNewPublicKey(t, "./testdata/rsa1024.pub")))
+}
+
+func TestAlgorithmPolicyCheckKeyFIPS(t *testing.T) {
+	assert.Nil(t, FIPSAlgorithmPolicy.CheckKey(mustNewPublicKey(t, "./testdata/ecdsa.pub")))
+	assert.Nil(t, FIPSAlgorithmPolicy.CheckKey(mustNewPublicKey(t, "./testdata/ca.pub")))
+}
+
+func TestAlgorithmPolicyCheckKeyFIPSRejectsEd25519(t *testing.T) {
+	err := FIPSAlgorithmPolicy.CheckKey(testPublicKey)
+	assert.EqualError(t, err, "ssh-ed25519 keys are not allowed by the FIPS algorithm policy (allowed: ssh-rsa, ecdsa-sha2-nistp256, ecdsa-sha2-nistp384, ecdsa-sha2-nistp521)")
+}
+
+func TestAlgorithmPolicyCheckKeyFIPSRejectsSmallRSA(t *testing.T) {
+	err := FIPSAlgorithmPolicy.CheckKey(mustNewPublicKey(t, "./testdata/rsa1024.pub"))
+	assert.EqualError(t, err, "1024 bit RSA keys are not allowed by the FIPS algorithm policy (minimum: 2048)")
+}
+
+func TestAlgorithmPolicyCheckKeyInvalid(t *testing.T) {
+	assert.Error(t, AlgorithmPolicy{}.CheckKey(&PublicKey{Data: []byte("invalid")}))
+}
+
+func TestAlgorithmPolicyCASignatureAlgorithmRSA(t *testing.T) {
+	algorithm, err := FIPSAlgorithmPolicy.caSignatureAlgorithm(mustNewPublicKey(t, "./testdata/ca.pub"), openssh.Version{Major: 8, Minor: 4})
+	assert.Nil(t, err)
+	assert.Equal(t, "rsa-sha2-512", algorithm)
+}
+
+func TestAlgorithmPolicyCASignatureAlgorithmWithOldSSHKeygen(t *testing.T) {
+	_, err := FIPSAlgorithmPolicy.caSignatureAlgorithm(mustNewPublicKey(t, "./testdata/ca.pub"), openssh.Version{Major: 7, Minor: 4})
+	assert.Error(t, err)
+}
+
+func TestAlgorithmPolicyCASignatureAlgorithmWithSingleChoice(t *testing.T) {
+	algorithm, err := FIPSAlgorithmPolicy.caSignatureAlgorithm(mustNewPublicKey(t, "./testdata/ecdsa.pub"), openssh.Version{Major: 7, Minor: 4})
+	assert.Nil(t, err)
+	assert.Equal(t, "", algorithm)
+}
+
+func TestAlgorithmPolicyCASignatureAlgorithmDisallowedCAKey(t *testing.T) {
+	_, err := FIPSAlgorithmPolicy.caSignatureAlgorithm(testPublicKey, openssh.Version{})
+	assert.Error(t, err)
+}
+
+func TestAlgorithmPolicyCASignatureAlgorithmNoneAllowed(t *testing.T) {
+	policy := AlgorithmPolicy{SignatureAlgorithms: []string{"ssh-ed25519"}}
+	_, err := policy.caSignatureAlgorithm(mustNewPublicKey(t, "./testdata/ca.pub"), openssh.Version{})
+	assert.Error(t, err)
+}
+
+func TestServerSetAlgorithmPolicy(t *testing.T) {
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	assert.Nil(t, server.SetAlgorithmPolicy(FIPSAlgorithmPolicy))
+	args := SignArgs{Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}
+	assert.Equal(t, append(args.Args(), "-t", "rsa-sha2-512", "-s", "./testdata/ca", "key"), server.getSSHKeygenArgs(args, "key"))
+}
+
+func TestServerSetAlgorithmPolicyWithDisallowedCAKey(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	assert.Error(t, server.SetAlgorithmPolicy(FIPSAlgorithmPolicy))
+}
+
+func TestKeySignatureAlgorithm(t *testing.T) {
+	assert.Equal(t, "ssh-ed25519", KeySignatureAlgorithm("ssh-ed25519"))
+	assert.Equal(t, "", KeySignatureAlgorithm("ssh-rsa"))
+}
+
+func TestPublicKeyCertSignatureAlgorithm(t *testing.T) {
+	now := time.Now()
+	issued := reportTestCertificate(t, 1, ssh.UserCert, []string{"alice"}, now, now.Add(time.Hour), nil)
+	certificate, err := ParsePublicKey([]byte(issued.Certificate))
+	assert.Nil(t, err)
+	algorithm, err := certificate.CertSignatureAlgorithm()
+	assert.Nil(t, err)
+	assert.Contains(t, []string{"ssh-rsa", "rsa-sha2-256", "rsa-sha2-512"}, algorithm)
+	_, err = testPublicKey.CertSignatureAlgorithm()
+	assert.Error(t, err)
+}
+
+func TestServerCertSignatureAlgorithm(t *testing.T) {
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	server.SSHKeygen.Version = openssh.Version{Major: 7, Minor: 4}
+	assert.Equal(t, "ssh-rsa", server.certSignatureAlgorithm(), "old ssh-keygen signs with SHA-1")
+	server.SSHKeygen.Version = openssh.Version{Major: 8, Minor: 4}
+	assert.Equal(t, "rsa-sha2-512", server.certSignatureAlgorithm())
+	assert.Nil(t, server.SetAlgorithmPolicy(AlgorithmPolicy{SignatureAlgorithms: []string{"rsa-sha2-256"}}))
+	var reply PublicKeyReply
+	assert.Nil(t, server.GetCAPublicKey(struct{}{}, &reply))
+	assert.Equal(t, "rsa-sha2-256", reply.SignatureAlgorithm)
+}
+
+func TestServerSignPublicKeyWithAlgorithmPolicy(t *testing.T) {
+	_, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	assert.Nil(t, server.SetAlgorithmPolicy(FIPSAlgorithmPolicy))
+
+	var reply SignReply
+	err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}, &reply)
+	assert.Error(t, err)
+
+	err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: mustNewPublicKey(t, "./testdata/ecdsa.pub")}, &reply)
+	assert.Nil(t, err)
+	details, err := getCertificateDetails(t, reply.Certificate)
+	assert.Nil(t, err)
+	assert.Contains(t, string(details), "using rsa-sha2-512")
+}
@@ -0,0 +1,253 @@
+package ca
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// approvalQueue lets the operator approve requests by number on the
+// terminal, so that concurrent requests can't be confused with each other.
+// Each request is shown with its number as a single write, and input is only
+// read while no approved request is being signed, because interactive
+// ssh-keygen reads the CA key passphrase from the same terminal.
+type approvalQueue struct {
+	in  *bufio.Reader
+	out io.Writer
+	// approver identifies the operator in approvals.
+	approver string
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// next is the number of the next request.
+	next int
+	// pending maps request numbers to their description and the channel that
+	// receives the decision.
+	pending map[int]pendingApproval
+	// signing counts the approved requests that haven't finished.
+	signing int
+	// err is set once reading input fails, after which every request fails.
+	err     error
+	reading bool
+	// relist is set when the pending requests should be shown again before
+	// reading input, because other output may have scrolled them away.
+	relist bool
+}
+
+// pendingApproval is a request waiting for the operator.
+type pendingApproval struct {
+	description string
+	decision    chan error
+}
+
+func newApprovalQueue(in io.Reader, out io.Writer) *approvalQueue {
+	q := &approvalQueue{in: bufio.NewReader(in), out: out, approver: terminalApprover(), next: 1, pending: map[int]pendingApproval{}}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// terminalApprover identifies the operator on the terminal by the user that
+// runs the server.
+func terminalApprover() string {
+	if u, err := user.Current(); err == nil {
+		return "terminal:" + u.Username
+	}
+	return "terminal"
+}
+
+// Confirm implementation for Interactor. It shows the request to the operator
+// and waits for it to be approved.
+// If it is approved, Done must be called once the request has been signed. A
+// non-zero timeout denies the request if the operator doesn't answer in time.
+func (q *approvalQueue) Confirm(description string, timeout time.Duration) (Approval, error) {
+	q.mu.Lock()
+	if q.err != nil {
+		q.mu.Unlock()
+		return Approval{}, q.err
+	}
+	number := q.next
+	q.next++
+	decision := make(chan error, 1)
+	q.pending[number] = pendingApproval{description, decision}
+	if len(q.pending) > 1 {
+		// Move off the prompt for the other requests
+		fmt.Fprintln(q.out)
+	}
+	fmt.Fprintf(q.out, "[%d] %s\n%s", number, description, q.promptLocked())
+	if !q.reading {
+		q.reading = true
+		go q.read()
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var err error
+	select {
+	case err = <-decision:
+	case <-expired:
+		err = q.expire(number, decision, timeout)
+	}
+	if err != nil {
+		return Approval{}, err
+	}
+	return Approval{Approver: q.approver, Done: q.finish}, nil
+}
+
+// expire denies the request with number because it wasn't answered within
+// timeout, unless it was answered in the meantime.
+func (q *approvalQueue) expire(number int, decision chan error, timeout time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[number]; !ok {
+		// The request was answered just before the timeout
+		return <-decision
+	}
+	delete(q.pending, number)
+	fmt.Fprintf(q.out, "\n[%d] not confirmed within %s\n", number, timeout)
+	if len(q.pending) != 0 {
+		fmt.Fprint(q.out, q.listLocked())
+	}
+	return fmt.Errorf("not confirmed by the operator within %s", timeout)
+}
+
+// finish records that an approved request has been signed.
+func (q *approvalQueue) finish() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.signing--
+	q.cond.Broadcast()
+}
+
+// promptLocked describes how to answer the pending requests. q.mu must be
+// held.
+func (q *approvalQueue) promptLocked() string {
+	if len(q.pending) == 1 {
+		for number := range q.pending {
+			return fmt.Sprintf("enter %d or press Enter to confirm, or n to deny (or Ctrl-C to exit)", number)
+		}
+	}
+	return "enter the number of a request to confirm it, or n and the number to deny it (or Ctrl-C to exit)"
+}
+
+// errDenied is returned for requests that the operator denied.
+var errDenied = errors.New("denied by the operator")
+
+// parseAnswer parses an input line into whether it confirms or denies a
+// request, and the number of the request (if any). Both "3" and "y 3" confirm
+// request 3, and "n 3" or "no 3" deny it.
+func parseAnswer(input string) (confirm bool, number int, ok bool) {
+	fields := strings.Fields(strings.ToLower(input))
+	confirm = true
+	if len(fields) > 0 {
+		switch fields[0] {
+		case "y", "yes":
+			fields = fields[1:]
+		case "n", "no":
+			confirm = false
+			fields = fields[1:]
+		}
+	}
+	switch len(fields) {
+	case 0:
+		return confirm, 0, true
+	case 1:
+		number, err := strconv.Atoi(fields[0])
+		return confirm, number, err == nil && number > 0
+	default:
+		return false, 0, false
+	}
+}
+
+// read handles the operator input for as long as the server runs.
+func (q *approvalQueue) read() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 || q.signing > 0 {
+			q.cond.Wait()
+		}
+		if q.relist {
+			fmt.Fprint(q.out, q.listLocked())
+			q.relist = false
+		}
+		q.mu.Unlock()
+
+		line, err := q.in.ReadString('\n')
+		q.mu.Lock()
+		if err != nil {
+			q.failLocked(fmt.Errorf("failed to read confirmation: %w", err))
+			q.mu.Unlock()
+			return
+		}
+		q.handleLocked(strings.TrimSpace(line))
+		q.mu.Unlock()
+	}
+}
+
+// handleLocked approves the request selected by the input line. q.mu must be
+// held.
+func (q *approvalQueue) handleLocked(input string) {
+	confirm, number, ok := parseAnswer(input)
+	if ok && number == 0 && len(q.pending) == 1 {
+		// The number can be left out if there is only one request
+		for only := range q.pending {
+			number = only
+		}
+	}
+
+	approval, pending := q.pending[number]
+	if !ok || !pending {
+		fmt.Fprintf(q.out, "\nno pending request %q\n%s", input, q.listLocked())
+		return
+	}
+	delete(q.pending, number)
+	if !confirm {
+		fmt.Fprintf(q.out, "denied [%d]\n", number)
+		approval.decision <- errDenied
+		q.relist = len(q.pending) != 0
+		return
+	}
+	q.signing++
+	fmt.Fprintf(q.out, "confirmed [%d]\n", number)
+	approval.decision <- nil
+	q.relist = true
+}
+
+// listLocked lists the pending requests followed by the prompt. q.mu must be
+// held.
+func (q *approvalQueue) listLocked() string {
+	numbers := make([]int, 0, len(q.pending))
+	for number := range q.pending {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	var b strings.Builder
+	b.WriteString("pending requests:\n")
+	for _, number := range numbers {
+		fmt.Fprintf(&b, "[%d] %s\n", number, q.pending[number].description)
+	}
+	b.WriteString(q.promptLocked())
+	return b.String()
+}
+
+// failLocked fails every pending and future request with err. q.mu must be
+// held.
+func (q *approvalQueue) failLocked(err error) {
+	q.err = err
+	for number, approval := range q.pending {
+		approval.decision <- err
+		delete(q.pending, number)
+	}
+}
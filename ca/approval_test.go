@@ -0,0 +1,234 @@
+package ca
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// approvalResult is the outcome of approvalQueue.request.
+type approvalResult struct {
+	done func()
+	err  error
+}
+
+// requestApproval starts a request in the background.
+func requestApproval(q *approvalQueue, description string) chan approvalResult {
+	result := make(chan approvalResult, 1)
+	go func() {
+		approval, err := q.Confirm(description, 0)
+		result <- approvalResult{approval.Done, err}
+	}()
+	return result
+}
+
+// waitForOutput waits until out contains s.
+func waitForOutput(t *testing.T, out *syncBuffer, s string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(out.String(), s) {
+		if time.Now().After(deadline) {
+			t.Fatalf("output %q does not contain %q", out.String(), s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestApprovalQueueEnterConfirmsOnlyRequest(t *testing.T) {
+	in, input := io.Pipe()
+	var out syncBuffer
+	q := newApprovalQueue(in, &out)
+
+	result := requestApproval(q, "sign a")
+	waitForOutput(t, &out, "[1] sign a\n")
+	input.Write([]byte("\n"))
+	r := <-result
+	assert.Nil(t, r.err)
+	r.done()
+}
+
+func TestApprovalQueueConfirmsByNumber(t *testing.T) {
+	in, input := io.Pipe()
+	var out syncBuffer
+	q := newApprovalQueue(in, &out)
+
+	first := requestApproval(q, "sign a")
+	waitForOutput(t, &out, "[1] sign a\n")
+	second := requestApproval(q, "sign b")
+	waitForOutput(t, &out, "[2] sign b\n")
+
+	// Enter is ambiguous with more than one request
+	input.Write([]byte("\n"))
+	waitForOutput(t, &out, `no pending request ""`)
+	input.Write([]byte("2\n"))
+	r := <-second
+	assert.Nil(t, r.err)
+	select {
+	case <-first:
+		t.Fatal("request 1 was confirmed")
+	default:
+	}
+	r.done()
+	// The remaining request is shown again once the other one is signed
+	waitForOutput(t, &out, "confirmed [2]\npending requests:\n[1] sign a\n")
+
+	input.Write([]byte("1\n"))
+	r = <-first
+	assert.Nil(t, r.err)
+	r.done()
+}
+
+func TestApprovalQueueWaitsForSigning(t *testing.T) {
+	in, input := io.Pipe()
+	var out syncBuffer
+	q := newApprovalQueue(in, &out)
+
+	first := requestApproval(q, "sign a")
+	waitForOutput(t, &out, "[1] sign a\n")
+	input.Write([]byte("1\n"))
+	r := <-first
+	assert.Nil(t, r.err)
+
+	// Input belongs to ssh-keygen until the first request is signed
+	second := requestApproval(q, "sign b")
+	waitForOutput(t, &out, "[2] sign b\n")
+	written := make(chan struct{})
+	go func() {
+		input.Write([]byte("2\n"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("input was read while signing")
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.done()
+	r = <-second
+	assert.Nil(t, r.err)
+	r.done()
+}
+
+func TestApprovalQueueFailsOnEOF(t *testing.T) {
+	in, input := io.Pipe()
+	var out syncBuffer
+	q := newApprovalQueue(in, &out)
+
+	result := requestApproval(q, "sign a")
+	waitForOutput(t, &out, "[1] sign a\n")
+	input.Close()
+	assert.Error(t, (<-result).err)
+	_, err := q.Confirm("sign b", 0)
+	assert.Error(t, err)
+}
+
+func TestApprovalQueueTimeout(t *testing.T) {
+	in, input := io.Pipe()
+	var out syncBuffer
+	q := newApprovalQueue(in, &out)
+
+	_, err := q.Confirm("sign a", 10*time.Millisecond)
+	assert.EqualError(t, err, "not confirmed by the operator within 10ms")
+	waitForOutput(t, &out, "[1] not confirmed within 10ms\n")
+
+	// The timed out request can't be confirmed, but later requests can be
+	result := requestApproval(q, "sign b")
+	waitForOutput(t, &out, "[2] sign b\n")
+	input.Write([]byte("1\n"))
+	waitForOutput(t, &out, `no pending request "1"`)
+	input.Write([]byte("2\n"))
+	r := <-result
+	assert.Nil(t, r.err)
+	r.done()
+}
+
+func TestApprovalQueueDeny(t *testing.T) {
+	in, input := io.Pipe()
+	var out syncBuffer
+	q := newApprovalQueue(in, &out)
+
+	result := requestApproval(q, "sign a")
+	waitForOutput(t, &out, "[1] sign a\n")
+	input.Write([]byte("n\n"))
+	assert.Equal(t, errDenied, (<-result).err)
+	waitForOutput(t, &out, "denied [1]\n")
+
+	// The server keeps running after a denial
+	result = requestApproval(q, "sign b")
+	waitForOutput(t, &out, "[2] sign b\n")
+	input.Write([]byte("\n"))
+	r := <-result
+	assert.Nil(t, r.err)
+	r.done()
+}
+
+func TestApprovalQueueDeniesByNumber(t *testing.T) {
+	in, input := io.Pipe()
+	var out syncBuffer
+	q := newApprovalQueue(in, &out)
+
+	first := requestApproval(q, "sign a")
+	waitForOutput(t, &out, "[1] sign a\n")
+	second := requestApproval(q, "sign b")
+	waitForOutput(t, &out, "[2] sign b\n")
+
+	// Without a number, it's ambiguous which request to deny
+	input.Write([]byte("no\n"))
+	waitForOutput(t, &out, `no pending request "no"`)
+	input.Write([]byte("no 2\n"))
+	assert.Equal(t, errDenied, (<-second).err)
+	waitForOutput(t, &out, "denied [2]\npending requests:\n[1] sign a\n")
+	input.Write([]byte("y 1\n"))
+	r := <-first
+	assert.Nil(t, r.err)
+	r.done()
+}
+
+func TestParseAnswer(t *testing.T) {
+	tests := []struct {
+		input   string
+		confirm bool
+		number  int
+		ok      bool
+	}{
+		{"", true, 0, true},
+		{"3", true, 3, true},
+		{" y 3 ", true, 3, true},
+		{"YES", true, 0, true},
+		{"n", false, 0, true},
+		{"No 2", false, 2, true},
+		{"0", true, 0, false},
+		{"maybe", true, 0, false},
+		{"n 1 2", false, 0, false},
+	}
+	for _, test := range tests {
+		confirm, number, ok := parseAnswer(test.input)
+		assert.Equal(t, test.ok, ok, test.input)
+		if test.ok {
+			assert.Equal(t, test.confirm, confirm, test.input)
+			assert.Equal(t, test.number, number, test.input)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package ca
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// AuditEvent records the outcome of a certificate request.
+type AuditEvent struct {
+	Time            time.Time  `json:"time"`
+	RequestUUID     string     `json:"request_uuid,omitempty"`
+	Tenant          string     `json:"tenant,omitempty"`
+	Client          string     `json:"client,omitempty"`
+	Requester       *Requester `json:"requester,omitempty"`
+	CertificateType string     `json:"certificate_type"`
+	Identity        string     `json:"identity"`
+	Principals      []string   `json:"principals"`
+	Fingerprint     string     `json:"fingerprint"`
+	Validity        string     `json:"validity,omitempty"`
+	// BreakGlass is the reason given by a break-glass request, which bypasses
+	// the normal policy. See BreakGlassPolicy.
+	BreakGlass string `json:"break_glass,omitempty"`
+	// Error is empty if the certificate was issued.
+	Error string `json:"error,omitempty"`
+}
+
+// AuditSink receives the audit events of a Server, e.g. to write them to a
+// file or forward them to a SIEM.
+type AuditSink interface {
+	Record(event AuditEvent) error
+}
+
+// AuditSinks records each event in all of the sinks.
+type AuditSinks []AuditSink
+
+// Record implementation for AuditSink
+func (s AuditSinks) Record(event AuditEvent) error {
+	var result *multierror.Error
+	for _, sink := range s {
+		if err := sink.Record(event); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// AuditLog writes one JSON AuditEvent per line.
+type AuditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAuditLog creates an AuditLog that writes to w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// OpenAuditLog opens the file at path for appending audit events, which is
+// rotated by rotation.
+func OpenAuditLog(path string, rotation RotationPolicy) (*AuditLog, error) {
+	f, err := openRotatingFile(path, rotation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return NewAuditLog(f), nil
+}
+
+// Record writes event to the log.
+func (l *AuditLog) Record(event AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %w", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(data, '\n'))
+	return err
+}
+
+// newAuditEvent describes the request and its outcome.
+func newAuditEvent(tenant string, args SignArgs, err error, now time.Time) AuditEvent {
+	event := AuditEvent{
+		Time:            now,
+		RequestUUID:     args.RequestUUID,
+		Tenant:          tenant,
+		CertificateType: args.CertificateType.String(),
+		Identity:        args.Identity,
+		Principals:      args.Principals,
+		Requester:       args.Requester.sanitized(),
+		BreakGlass:      args.loggedBreakGlassReason(),
+	}
+	if args.clientAddr != nil {
+		event.Client = args.clientAddr.String()
+	}
+	if args.PublicKey != nil && args.PublicKey.parse() == nil {
+		event.Fingerprint = args.PublicKey.Fingerprint()
+	}
+	if args.Validity != 0 {
+		event.Validity = args.Validity.String()
+	}
+	if err != nil {
+		event.Error = strings.TrimSpace(err.Error())
+	}
+	return event
+}
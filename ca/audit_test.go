@@ -0,0 +1,54 @@
+package ca
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerSignPublicKeyAudit(t *testing.T) {
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	server.Name = "team-a"
+	server.UserValidity = ValidityPolicy{Max: time.Hour}
+	var log bytes.Buffer
+	server.Audit = NewAuditLog(&log)
+
+	var reply SignReply
+	err = server.SignPublicKey(SignArgs{RequestUUID: testRequestUUID, Identity: "asdf", CertificateType: UserCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey, Validity: 2 * time.Hour, Requester: Requester{Username: "alice", Hostname: "laptop"}}, &reply)
+	assert.Error(t, err)
+
+	var event AuditEvent
+	assert.Nil(t, json.Unmarshal(log.Bytes(), &event))
+	assert.Equal(t, "team-a", event.Tenant)
+	assert.Equal(t, "user", event.CertificateType)
+	assert.Equal(t, "asdf", event.Identity)
+	assert.Equal(t, []string{"asdf"}, event.Principals)
+	assert.Equal(t, testPublicKey.Fingerprint(), event.Fingerprint)
+	assert.Equal(t, "2h0m0s", event.Validity)
+	assert.Equal(t, testRequestUUID, event.RequestUUID)
+	assert.Equal(t, &Requester{Username: "alice", Hostname: "laptop"}, event.Requester)
+	assert.Equal(t, "invalid user certificate validity: requested validity 2h0m0s exceeds the maximum of 1h0m0s", event.Error)
+}
+
+// failingSink is an AuditSink that always fails.
+type failingSink struct{}
+
+func (failingSink) Record(event AuditEvent) error {
+	return errors.New("unreachable")
+}
+
+func TestAuditSinksRecordsInAll(t *testing.T) {
+	var first, second bytes.Buffer
+	sinks := AuditSinks{NewAuditLog(&first), failingSink{}, NewAuditLog(&second)}
+	err := sinks.Record(AuditEvent{Identity: "asdf"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unreachable")
+	// A failing sink doesn't stop the others
+	assert.Contains(t, first.String(), `"identity":"asdf"`)
+	assert.Equal(t, first.String(), second.String())
+}
@@ -0,0 +1,108 @@
+package ca
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+	"unicode"
+)
+
+// BreakGlassApprover is the approver of break-glass requests, which are
+// signed without confirmation.
+const BreakGlassApprover = "none (break-glass)"
+
+// DefaultBreakGlassValidity is the longest validity of break-glass
+// certificates if BreakGlassPolicy.Validity isn't set.
+const DefaultBreakGlassValidity = time.Hour
+
+// MaxBreakGlassReasonLength is the longest reason that a break-glass request
+// can give.
+const MaxBreakGlassReasonLength = 512
+
+// BreakGlassPolicy lets emergency requests bypass the normal policy, e.g. when
+// the approvers or the DNS are unavailable during an outage. Break-glass
+// requests must carry a separate credential and a reason. They are signed
+// without confirmation, TOTP codes, proof of possession or the host DNS
+// check, but their validity is kept short, Server.Alerts are told about them
+// and the reason is recorded with the certificate.
+type BreakGlassPolicy struct {
+	// Token is the credential of break-glass requests. Empty disables
+	// break-glass requests.
+	Token string
+	// Validity is the longest validity of break-glass certificates. Requests
+	// for longer (or forever) are shortened to it. Zero means
+	// DefaultBreakGlassValidity.
+	Validity time.Duration
+}
+
+// breakGlass reports whether args asks to bypass the normal policy.
+func (args SignArgs) breakGlass() bool {
+	return args.BreakGlassReason != "" || args.BreakGlassToken != ""
+}
+
+// loggedBreakGlassReason returns the reason of a break-glass request for the
+// audit log, truncated and with non-printable characters replaced, since it
+// may not have been validated. It is "(none)" for break-glass requests
+// without a reason, and empty for other requests.
+func (args SignArgs) loggedBreakGlassReason() string {
+	if !args.breakGlass() {
+		return ""
+	}
+	if args.BreakGlassReason == "" {
+		return "(none)"
+	}
+	runes := []rune(args.BreakGlassReason)
+	if len(runes) > MaxBreakGlassReasonLength {
+		runes = runes[:MaxBreakGlassReasonLength]
+	}
+	for i, r := range runes {
+		if !unicode.IsPrint(r) {
+			runes[i] = '?'
+		}
+	}
+	return string(runes)
+}
+
+// check authenticates a break-glass request.
+func (p BreakGlassPolicy) check(args SignArgs) error {
+	if p.Token == "" {
+		return fmt.Errorf("break-glass requests are disabled on the server")
+	}
+	if subtle.ConstantTimeCompare([]byte(args.BreakGlassToken), []byte(p.Token)) != 1 {
+		return fmt.Errorf("invalid break-glass token")
+	}
+	return ValidateBreakGlassReason(args.BreakGlassReason)
+}
+
+// ValidateBreakGlassReason checks that the reason of a break-glass request
+// can be recorded in the logs without changing their meaning.
+func ValidateBreakGlassReason(reason string) error {
+	if reason == "" {
+		return fmt.Errorf("break-glass requests need a reason")
+	}
+	if len(reason) > MaxBreakGlassReasonLength {
+		return fmt.Errorf("the break-glass reason is longer than %d bytes", MaxBreakGlassReasonLength)
+	}
+	for _, r := range reason {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return fmt.Errorf("the break-glass reason can't contain control characters")
+		}
+	}
+	return nil
+}
+
+// validity returns the validity of a break-glass certificate for a request
+// for requested.
+func (p BreakGlassPolicy) validity(requested time.Duration) (time.Duration, error) {
+	if requested < 0 {
+		return 0, fmt.Errorf("validity %s must not be negative", requested)
+	}
+	max := p.Validity
+	if max == 0 {
+		max = DefaultBreakGlassValidity
+	}
+	if requested == 0 || requested > max {
+		return max, nil
+	}
+	return requested, nil
+}
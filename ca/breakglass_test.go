@@ -0,0 +1,135 @@
+package ca
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakGlassPolicyCheck(t *testing.T) {
+	policy := BreakGlassPolicy{Token: "secret"}
+	assert.Nil(t, policy.check(SignArgs{BreakGlassToken: "secret", BreakGlassReason: "INC-42: approvers unreachable"}))
+	assert.EqualError(t, policy.check(SignArgs{BreakGlassToken: "wrong", BreakGlassReason: "INC-42"}), "invalid break-glass token")
+	assert.EqualError(t, policy.check(SignArgs{BreakGlassToken: "secret"}), "break-glass requests need a reason")
+	assert.EqualError(t, BreakGlassPolicy{}.check(SignArgs{BreakGlassReason: "INC-42"}), "break-glass requests are disabled on the server")
+}
+
+func TestValidateBreakGlassReason(t *testing.T) {
+	assert.Nil(t, ValidateBreakGlassReason("INC-42: approvers unreachable"))
+	assert.Error(t, ValidateBreakGlassReason(""))
+	assert.Error(t, ValidateBreakGlassReason("INC-42\nFAKE LOG LINE"))
+	assert.Error(t, ValidateBreakGlassReason(strings.Repeat("a", MaxBreakGlassReasonLength+1)))
+}
+
+func TestBreakGlassPolicyValidity(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    BreakGlassPolicy
+		requested time.Duration
+		want      time.Duration
+	}{
+		{name: "default", requested: 0, want: DefaultBreakGlassValidity},
+		{name: "clamped to default", requested: 24 * time.Hour, want: DefaultBreakGlassValidity},
+		{name: "shorter", requested: 10 * time.Minute, want: 10 * time.Minute},
+		{name: "clamped to policy", policy: BreakGlassPolicy{Validity: 15 * time.Minute}, requested: time.Hour, want: 15 * time.Minute},
+	}
+	for _, test := range tests {
+		validity, err := test.policy.validity(test.requested)
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, test.want, validity, test.name)
+	}
+
+	_, err := BreakGlassPolicy{}.validity(-time.Minute)
+	assert.EqualError(t, err, "validity -1m0s must not be negative")
+}
+
+func TestSignArgsLoggedBreakGlassReason(t *testing.T) {
+	assert.Equal(t, "", SignArgs{}.loggedBreakGlassReason())
+	assert.Equal(t, "(none)", SignArgs{BreakGlassToken: "secret"}.loggedBreakGlassReason())
+	assert.Equal(t, "INC-42 ?FAKE", SignArgs{BreakGlassReason: "INC-42 \nFAKE"}.loggedBreakGlassReason())
+}
+
+func newBreakGlassTestServer(t *testing.T) (Server, *bytes.Buffer) {
+	t.Helper()
+	server := newIssuanceTestServer(t)
+	server.Interactor = interactorFunc(func(description string) error {
+		return fmt.Errorf("nobody is available to confirm")
+	})
+	server.BreakGlass = BreakGlassPolicy{Token: "secret", Validity: 30 * time.Minute}
+	server.TOTP = TOTPPolicy{Secrets: map[string][]byte{"laptop": []byte("12345678901234567890")}}
+	var alerts bytes.Buffer
+	server.Alerts = NewAuditLog(&alerts)
+	return server, &alerts
+}
+
+func TestServerSignsBreakGlass(t *testing.T) {
+	server, alerts := newBreakGlassTestServer(t)
+	args := SignArgs{Identity: "alice", CertificateType: UserCertificate, Principals: []string{"root"}, PublicKey: testPublicKey, Validity: 24 * time.Hour, BreakGlassToken: "secret", BreakGlassReason: "INC-42: approvers unreachable"}
+	var reply SignReply
+	assert.Nil(t, server.SignPublicKey(args, &reply))
+
+	cert, err := reply.Certificate.certificate()
+	assert.Nil(t, err)
+	assert.True(t, time.Unix(int64(cert.ValidBefore), 0).Before(time.Now().Add(31*time.Minute)))
+
+	issued, ok := server.Issued.Find(CheckStatusArgs{Serial: 1})
+	assert.True(t, ok)
+	assert.Equal(t, BreakGlassApprover, issued.Issuance.Approver)
+	assert.Equal(t, []string{"break_glass: INC-42: approvers unreachable", "break_glass: validity 30m0s"}, issued.Issuance.PolicyRules)
+
+	var event AuditEvent
+	assert.Nil(t, json.Unmarshal(alerts.Bytes(), &event))
+	assert.Equal(t, "INC-42: approvers unreachable", event.BreakGlass)
+	assert.Empty(t, event.Error)
+	assert.Contains(t, strings.Join(server.Reporter.(*recordingReporter).messages, ""), "BREAK-GLASS")
+}
+
+func TestServerRejectsBreakGlassWithInvalidToken(t *testing.T) {
+	server, alerts := newBreakGlassTestServer(t)
+	args := SignArgs{Identity: "alice", CertificateType: UserCertificate, Principals: []string{"root"}, PublicKey: testPublicKey, BreakGlassToken: "wrong", BreakGlassReason: "INC-42"}
+	var reply SignReply
+	err := server.SignPublicKey(args, &reply)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "break-glass request rejected: invalid break-glass token")
+
+	// Failed attempts are alerted too
+	var event AuditEvent
+	assert.Nil(t, json.Unmarshal(alerts.Bytes(), &event))
+	assert.Equal(t, "INC-42", event.BreakGlass)
+	assert.Contains(t, event.Error, "invalid break-glass token")
+}
+
+func TestServerRejectsBreakGlassWithNegativeValidity(t *testing.T) {
+	server, _ := newBreakGlassTestServer(t)
+	args := SignArgs{Identity: "alice", CertificateType: UserCertificate, Principals: []string{"root"}, PublicKey: testPublicKey, Validity: -time.Hour, BreakGlassToken: "secret", BreakGlassReason: "INC-42"}
+	var reply SignReply
+	err := server.SignPublicKey(args, &reply)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid break-glass certificate validity: validity -1h0m0s must not be negative")
+	assert.Nil(t, reply.Certificate)
+}
+
+func TestServerDoesNotAlertOrdinaryRequests(t *testing.T) {
+	server, alerts := newBreakGlassTestServer(t)
+	server.TOTP = TOTPPolicy{}
+	args := SignArgs{Identity: "alice", CertificateType: UserCertificate, Principals: []string{"alice"}, PublicKey: testPublicKey}
+	var reply SignReply
+	assert.Error(t, server.SignPublicKey(args, &reply))
+	assert.Empty(t, alerts.String())
+}
+
+func TestServerBreakGlassCantIssueDeniedPrincipals(t *testing.T) {
+	server, alerts := newBreakGlassTestServer(t)
+	server.Principals = PrincipalPolicy{Denied: []string{"root"}}
+	args := SignArgs{Identity: "alice", CertificateType: UserCertificate, Principals: []string{"root"}, PublicKey: testPublicKey, BreakGlassToken: "secret", BreakGlassReason: "INC-42"}
+	var reply SignReply
+	err := server.SignPublicKey(args, &reply)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `principal "root" is denied by the server`)
+	assert.Contains(t, alerts.String(), `"break_glass":"INC-42"`)
+}
@@ -0,0 +1,135 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// BundleVersion is the version of the request and response bundle format.
+const BundleVersion = 1
+
+// bundleProofLifetime is how long the proof of a bundled request is valid
+// for, which allows for carrying the bundle to the offline CA.
+const bundleProofLifetime = 7 * 24 * time.Hour
+
+// RequestBundle is a set of signing requests that is carried to an offline
+// (air-gapped) CA, which answers it with a ResponseBundle.
+type RequestBundle struct {
+	Version  int              `json:"version"`
+	Created  time.Time        `json:"created"`
+	Requests []BundledRequest `json:"requests"`
+}
+
+// BundledRequest is a signing request in a RequestBundle.
+type BundledRequest struct {
+	// KeyPath is the path of the public key on the requesting machine, where
+	// the certificate is written next to.
+	KeyPath string   `json:"key_path"`
+	Args    SignArgs `json:"args"`
+}
+
+// ResponseBundle holds the outcome of the requests in a RequestBundle.
+type ResponseBundle struct {
+	Version     int               `json:"version"`
+	Created     time.Time         `json:"created"`
+	CAPublicKey *PublicKey        `json:"ca_public_key"`
+	Responses   []BundledResponse `json:"responses"`
+}
+
+// BundledResponse is the outcome of a BundledRequest: a certificate or an
+// error.
+type BundledResponse struct {
+	KeyPath     string     `json:"key_path"`
+	RequestUUID string     `json:"request_uuid"`
+	Certificate *PublicKey `json:"certificate,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// bundleDigest returns a digest of the request without its proof, which the
+// proof of a bundled request signs, so the signature also protects the
+// principals and options from being changed in the bundle.
+func bundleDigest(args SignArgs) ([]byte, error) {
+	args.Proof = nil
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	return digest[:], nil
+}
+
+// bundleNonce returns the nonce that a bundled request is proven with: the
+// expiry of the proof (in seconds since the epoch), followed by the digest of
+// the request.
+func bundleNonce(digest []byte, expires time.Time) []byte {
+	nonce := make([]byte, 8, 8+len(digest))
+	binary.BigEndian.PutUint64(nonce, uint64(expires.Unix()))
+	return append(nonce, digest...)
+}
+
+// ProveBundledRequest adds a proof of possession of the private key to args
+// for a RequestBundle. There is no challenge from the server offline, so the
+// request itself is signed, with an expiry so that the proof can't be
+// replayed forever.
+func ProveBundledRequest(args SignArgs, signer ssh.Signer) (SignArgs, error) {
+	return proveBundledRequest(args, signer, time.Now().Add(bundleProofLifetime))
+}
+
+func proveBundledRequest(args SignArgs, signer ssh.Signer, expires time.Time) (SignArgs, error) {
+	digest, err := bundleDigest(args)
+	if err != nil {
+		return args, err
+	}
+	args.Proof, err = SignProof(signer, bundleNonce(digest, expires))
+	return args, err
+}
+
+// checkBundleNonce returns an error unless nonce is the nonce of a proof made
+// for the request with digest, which hasn't expired.
+func checkBundleNonce(nonce []byte, digest []byte, now time.Time) error {
+	if len(nonce) < 8 || !bytes.Equal(nonce[8:], digest) {
+		return fmt.Errorf("the proof was made for a different request")
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(nonce)), 0)
+	if now.After(expires) {
+		return fmt.Errorf("the proof expired at %s", expires.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// SignBundle signs the requests of an offline bundle like SignPublicKey, and
+// returns their outcome. Requests can only prove possession of their private
+// key with a proof from ProveBundledRequest.
+func (ca *Server) SignBundle(bundle RequestBundle) (ResponseBundle, error) {
+	if bundle.Version != BundleVersion {
+		return ResponseBundle{}, fmt.Errorf("unsupported bundle version %d (this CA reads version %d)", bundle.Version, BundleVersion)
+	}
+	response := ResponseBundle{Version: BundleVersion, Created: time.Now().UTC(), CAPublicKey: ca.PublicKey}
+	for _, request := range bundle.Requests {
+		args := request.Args
+		outcome := BundledResponse{KeyPath: request.KeyPath, RequestUUID: args.RequestUUID}
+		// The proof signs the request as it is in the bundle, before the
+		// groups in it are expanded
+		digest, err := bundleDigest(args)
+		if err != nil {
+			outcome.Error = err.Error()
+			response.Responses = append(response.Responses, outcome)
+			continue
+		}
+		args.bundleDigest = digest
+		var reply SignReply
+		if err := ca.SignPublicKey(args, &reply); err != nil {
+			outcome.Error = err.Error()
+		} else {
+			outcome.Certificate = reply.Certificate
+		}
+		response.Responses = append(response.Responses, outcome)
+	}
+	return response, nil
+}
@@ -0,0 +1,107 @@
+package ca
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func bundledArgs(t *testing.T) SignArgs {
+	t.Helper()
+	args := SignArgs{RequestUUID: testRequestUUID, Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}
+	args, err := ProveBundledRequest(args, mustSigner(t, "./testdata/test"))
+	assert.Nil(t, err)
+	return args
+}
+
+// submitted marks args as a request read from a bundle, like SignBundle.
+func submitted(t *testing.T, args SignArgs) SignArgs {
+	t.Helper()
+	digest, err := bundleDigest(args)
+	assert.Nil(t, err)
+	args.bundleDigest = digest
+	return args
+}
+
+func TestServerCheckProofBundled(t *testing.T) {
+	server := newProofTestServer(t, ProofPolicy{Hosts: true})
+	args := submitted(t, bundledArgs(t))
+	assert.Nil(t, server.checkProof(args))
+	// Bundled requests aren't answering a challenge, so they can't be sent
+	// over RPC
+	args.bundleDigest = nil
+	assert.EqualError(t, server.checkProof(args), "unknown or expired challenge")
+}
+
+func TestServerCheckProofBundledTampered(t *testing.T) {
+	server := newProofTestServer(t, ProofPolicy{Hosts: true})
+	args := bundledArgs(t)
+	args.Principals = []string{"other"}
+	assert.EqualError(t, server.checkProof(submitted(t, args)), "the proof was made for a different request")
+}
+
+func TestServerCheckProofBundledExpired(t *testing.T) {
+	server := newProofTestServer(t, ProofPolicy{Hosts: true})
+	args := SignArgs{RequestUUID: testRequestUUID, Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}
+	args, err := proveBundledRequest(args, mustSigner(t, "./testdata/test"), time.Unix(1600000000, 0))
+	assert.Nil(t, err)
+	assert.EqualError(t, server.checkProof(submitted(t, args)), "the proof expired at 2020-09-13T12:26:40Z")
+}
+
+func TestServerSignBundle(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server := newProofTestServer(t, ProofPolicy{Hosts: true})
+	unproven := SignArgs{RequestUUID: "1f2e3d4c-5b6a-4978-8a9b-0c1d2e3f4a5b", Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}
+	bundle := RequestBundle{Version: BundleVersion, Requests: []BundledRequest{
+		{KeyPath: "/etc/ssh/ssh_host_ed25519_key.pub", Args: bundledArgs(t)},
+		{KeyPath: "/etc/ssh/ssh_host_rsa_key.pub", Args: unproven},
+	}}
+
+	response, err := server.SignBundle(bundle)
+	assert.Nil(t, err)
+	assert.Equal(t, BundleVersion, response.Version)
+	assert.Equal(t, server.PublicKey.Data, response.CAPublicKey.Data)
+	assert.Len(t, response.Responses, 2)
+
+	signed := response.Responses[0]
+	assert.Equal(t, "/etc/ssh/ssh_host_ed25519_key.pub", signed.KeyPath)
+	assert.Equal(t, testRequestUUID, signed.RequestUUID)
+	assert.Empty(t, signed.Error)
+	assert.NotNil(t, signed.Certificate)
+
+	refused := response.Responses[1]
+	assert.Equal(t, "1f2e3d4c-5b6a-4978-8a9b-0c1d2e3f4a5b", refused.RequestUUID)
+	assert.Nil(t, refused.Certificate)
+	assert.Contains(t, refused.Error, "proof of possession of the private key is required for host certificates")
+}
+
+func TestServerSignBundleGroups(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server := newProofTestServer(t, ProofPolicy{Users: true})
+	server.Groups = Groups{"admins": {"alice", "root"}}
+	args := SignArgs{RequestUUID: testRequestUUID, Identity: "alice", CertificateType: UserCertificate, Principals: []string{"@admins"}, PublicKey: testPublicKey}
+	args, err := ProveBundledRequest(args, mustSigner(t, "./testdata/test"))
+	assert.Nil(t, err)
+
+	response, err := server.SignBundle(RequestBundle{Version: BundleVersion, Requests: []BundledRequest{{KeyPath: "id_ed25519.pub", Args: args}}})
+	assert.Nil(t, err)
+	assert.Len(t, response.Responses, 1)
+	assert.Empty(t, response.Responses[0].Error)
+	if assert.NotNil(t, response.Responses[0].Certificate) {
+		cert, err := response.Responses[0].Certificate.certificate()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"alice", "root"}, cert.ValidPrincipals)
+	}
+}
+
+func TestServerSignBundleWrongVersion(t *testing.T) {
+	server := newProofTestServer(t, ProofPolicy{})
+	_, err := server.SignBundle(RequestBundle{Version: BundleVersion + 1})
+	assert.EqualError(t, err, "unsupported bundle version 2 (this CA reads version 1)")
+}
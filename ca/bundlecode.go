@@ -0,0 +1,274 @@
+package ca
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/base32"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Request and response bundles can be carried to and from an offline CA as
+// text codes instead of files: QR codes to scan with a camera, or words to
+// type. Both are the compressed bundle, and DecodeBundle reads them (or the
+// bundle itself) back.
+
+// qrPrefix starts each part of a bundle in QR codes.
+const qrPrefix = "SSHCA1:"
+
+// wordsHeader starts a bundle in words.
+const wordsHeader = "sshca1 words"
+
+// wordsPerLine is the number of data words on each line of a bundle in words.
+// Each line also has a line number and a check word, so typos are found
+// by line.
+const wordsPerLine = 8
+
+// qrEncoding only uses characters of the QR alphanumeric mode, which stores
+// them more densely than bytes.
+var qrEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// compress deflates data, since bundles are JSON.
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress inflates data from compress.
+func decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt bundle code: %w", err)
+	}
+	return data, nil
+}
+
+// EncodeBundleQR encodes a bundle as the contents of QR codes, each at most
+// partSize characters long, which are SSHCA1:PART/PARTS:DATA.
+func EncodeBundleQR(bundle []byte, partSize int) ([]string, error) {
+	compressed, err := compress(bundle)
+	if err != nil {
+		return nil, err
+	}
+	encoded := qrEncoding.EncodeToString(compressed)
+	// The header of the parts is at most this long
+	dataSize := partSize - len(qrPrefix) - len("999/999:")
+	if dataSize <= 0 {
+		return nil, fmt.Errorf("QR codes of %d characters are too small", partSize)
+	}
+	count := (len(encoded) + dataSize - 1) / dataSize
+	if count > 999 {
+		return nil, fmt.Errorf("the bundle needs more than 999 QR codes")
+	}
+	parts := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * dataSize
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		parts = append(parts, fmt.Sprintf("%s%d/%d:%s", qrPrefix, i+1, count, encoded[i*dataSize:end]))
+	}
+	return parts, nil
+}
+
+// decodeBundleQR decodes the parts from EncodeBundleQR, one per line, which
+// can be in any order.
+func decodeBundleQR(lines []string) ([]byte, error) {
+	var parts []string
+	for _, line := range lines {
+		if !strings.HasPrefix(strings.ToUpper(line), qrPrefix) {
+			return nil, fmt.Errorf("QR code %q isn't part of a bundle", line)
+		}
+		fields := strings.SplitN(line[len(qrPrefix):], ":", 2)
+		numbers := strings.SplitN(fields[0], "/", 2)
+		if len(fields) != 2 || len(numbers) != 2 {
+			return nil, fmt.Errorf("QR code %q has no part number", line)
+		}
+		part, err := strconv.Atoi(numbers[0])
+		if err != nil {
+			return nil, fmt.Errorf("QR code %q has an invalid part number", line)
+		}
+		count, err := strconv.Atoi(numbers[1])
+		if err != nil || part < 1 || part > count {
+			return nil, fmt.Errorf("QR code %q has an invalid part number", line)
+		}
+		if parts == nil {
+			parts = make([]string, count)
+		} else if len(parts) != count {
+			return nil, fmt.Errorf("QR code %q is from another bundle", line)
+		}
+		parts[part-1] = strings.ToUpper(fields[1])
+	}
+	var missing []string
+	for i, part := range parts {
+		if part == "" {
+			missing = append(missing, strconv.Itoa(i+1))
+		}
+	}
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("missing QR codes %s of %d", strings.Join(missing, ", "), len(parts))
+	}
+	compressed, err := qrEncoding.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return nil, fmt.Errorf("corrupt bundle code: %w", err)
+	}
+	return decompress(compressed)
+}
+
+// Words are proquints (https://arxiv.org/html/0901.4016): five letters that
+// alternate between consonants and vowels, for 16 bits each.
+const (
+	quintConsonants = "bdfghjklmnprstvz"
+	quintVowels     = "aiou"
+)
+
+// quint returns the word for a 16 bit value.
+func quint(v uint16) string {
+	return string([]byte{
+		quintConsonants[v>>12&0xf],
+		quintVowels[v>>10&0x3],
+		quintConsonants[v>>6&0xf],
+		quintVowels[v>>4&0x3],
+		quintConsonants[v&0xf],
+	})
+}
+
+// parseQuint returns the value of a word from quint.
+func parseQuint(word string) (uint16, bool) {
+	if len(word) != 5 {
+		return 0, false
+	}
+	var v uint16
+	for i := range word {
+		alphabet, bits := quintConsonants, uint(4)
+		if i%2 == 1 {
+			alphabet, bits = quintVowels, 2
+		}
+		j := strings.IndexByte(alphabet, word[i])
+		if j == -1 {
+			return 0, false
+		}
+		v = v<<bits | uint16(j)
+	}
+	return v, true
+}
+
+// lineCheck returns the check word of a line of words, which also covers the
+// line number so that lines can't be swapped.
+func lineCheck(number int, data []byte) uint16 {
+	return uint16(crc32.ChecksumIEEE(append([]byte(strconv.Itoa(number)+":"), data...)))
+}
+
+// EncodeBundleWords encodes a bundle as lines of words to be typed. The first
+// line is a header with the length of the data, and each other line has its
+// number, up to eight words and a check word.
+func EncodeBundleWords(bundle []byte) (string, error) {
+	data, err := compress(bundle)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %d\n", wordsHeader, len(data))
+	lineSize := 2 * wordsPerLine
+	for number := 1; (number-1)*lineSize < len(data); number++ {
+		line := data[(number-1)*lineSize:]
+		if len(line) > lineSize {
+			line = line[:lineSize]
+		}
+		words := []string{fmt.Sprintf("%02d", number)}
+		for i := 0; i < len(line); i += 2 {
+			v := uint16(line[i]) << 8
+			if i+1 < len(line) {
+				v |= uint16(line[i+1])
+			}
+			words = append(words, quint(v))
+		}
+		words = append(words, quint(lineCheck(number, line)))
+		fmt.Fprintln(&b, strings.Join(words, " "))
+	}
+	return b.String(), nil
+}
+
+// decodeBundleWords decodes the lines from EncodeBundleWords, after the
+// header.
+func decodeBundleWords(header string, lines []string) ([]byte, error) {
+	fields := strings.Fields(header)
+	size, err := strconv.Atoi(fields[len(fields)-1])
+	if len(fields) != 3 || err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid header %q", header)
+	}
+	lineSize := 2 * wordsPerLine
+	count := (size + lineSize - 1) / lineSize
+	if len(lines) != count {
+		return nil, fmt.Errorf("expected %d lines of words after the header, got %d", count, len(lines))
+	}
+	data := make([]byte, 0, size)
+	for i, line := range lines {
+		words := strings.Fields(strings.ToLower(line))
+		if number, err := strconv.Atoi(words[0]); err != nil || number != i+1 {
+			return nil, fmt.Errorf("line %d: expected line number %d, got %q", i+1, i+1, words[0])
+		}
+		lineLen := lineSize
+		if i == count-1 {
+			lineLen = size - i*lineSize
+		}
+		if len(words) != 1+(lineLen+1)/2+1 {
+			return nil, fmt.Errorf("line %d: expected %d words, got %d", i+1, (lineLen+1)/2+1, len(words)-1)
+		}
+		var lineData []byte
+		for _, word := range words[1 : len(words)-1] {
+			v, ok := parseQuint(word)
+			if !ok {
+				return nil, fmt.Errorf("line %d: %q isn't a valid word", i+1, word)
+			}
+			lineData = append(lineData, byte(v>>8), byte(v))
+		}
+		lineData = lineData[:lineLen]
+		if check, ok := parseQuint(words[len(words)-1]); !ok || check != lineCheck(i+1, lineData) {
+			return nil, fmt.Errorf("line %d has a typo (its check word doesn't match)", i+1)
+		}
+		data = append(data, lineData...)
+	}
+	return decompress(data)
+}
+
+// DecodeBundle returns the bundle in text from EncodeBundleQR (the contents
+// of the QR codes, one per line) or EncodeBundleWords. Anything else is
+// returned as is, as a bundle that was carried as a file.
+func DecodeBundle(text []byte) ([]byte, error) {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(lines) == 0:
+		return text, nil
+	case strings.HasPrefix(strings.ToUpper(lines[0]), qrPrefix):
+		return decodeBundleQR(lines)
+	case strings.HasPrefix(strings.Join(strings.Fields(strings.ToLower(lines[0])), " "), wordsHeader):
+		return decodeBundleWords(lines[0], lines[1:])
+	}
+	return text, nil
+}
@@ -0,0 +1,97 @@
+package ca
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testBundle = []byte(`{"version":1,"requests":[{"key_path":"/home/alice/.ssh/id_ed25519.pub","args":{"Principals":["alice"]}}]}`)
+
+func TestQuint(t *testing.T) {
+	// From the proquint paper: 127.0.0.1
+	assert.Equal(t, "lusab", quint(0x7f00))
+	assert.Equal(t, "babad", quint(0x0001))
+	for _, v := range []uint16{0, 1, 0x7f00, 0xffff} {
+		parsed, ok := parseQuint(quint(v))
+		assert.True(t, ok)
+		assert.Equal(t, v, parsed)
+	}
+	_, ok := parseQuint("lusae")
+	assert.False(t, ok)
+	_, ok = parseQuint("lusa")
+	assert.False(t, ok)
+}
+
+func TestBundleQRRoundTrip(t *testing.T) {
+	parts, err := EncodeBundleQR(testBundle, 40)
+	assert.Nil(t, err)
+	assert.True(t, len(parts) > 1)
+	for _, part := range parts {
+		assert.True(t, len(part) <= 40)
+		assert.True(t, strings.HasPrefix(part, "SSHCA1:"))
+	}
+
+	// Parts can be scanned in any order
+	parts[0], parts[1] = parts[1], parts[0]
+	decoded, err := DecodeBundle([]byte(strings.Join(parts, "\n") + "\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, testBundle, decoded)
+}
+
+func TestBundleQRMissingPart(t *testing.T) {
+	parts, err := EncodeBundleQR(testBundle, 40)
+	assert.Nil(t, err)
+	_, err = DecodeBundle([]byte(strings.Join(parts[1:], "\n")))
+	assert.Contains(t, err.Error(), "missing QR codes 1 of")
+}
+
+func TestBundleQRTooSmall(t *testing.T) {
+	_, err := EncodeBundleQR(testBundle, 10)
+	assert.Error(t, err)
+}
+
+func TestBundleWordsRoundTrip(t *testing.T) {
+	words, err := EncodeBundleWords(testBundle)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(words), "\n")
+	assert.True(t, strings.HasPrefix(lines[0], "sshca1 words "))
+	assert.Equal(t, "01", strings.Fields(lines[1])[0])
+	assert.Len(t, strings.Fields(lines[1]), 1+wordsPerLine+1)
+
+	// Case and spacing don't matter when typing
+	typed := strings.ToUpper(strings.Replace(words, " ", "   ", -1))
+	decoded, err := DecodeBundle([]byte(typed))
+	assert.Nil(t, err)
+	assert.Equal(t, testBundle, decoded)
+}
+
+func TestBundleWordsTypo(t *testing.T) {
+	words, err := EncodeBundleWords(testBundle)
+	assert.Nil(t, err)
+	lines := strings.Split(words, "\n")
+	fields := strings.Fields(lines[2])
+	if fields[1] == "babab" {
+		fields[1] = "babad"
+	} else {
+		fields[1] = "babab"
+	}
+	lines[2] = strings.Join(fields, " ")
+	_, err = DecodeBundle([]byte(strings.Join(lines, "\n")))
+	assert.EqualError(t, err, "line 2 has a typo (its check word doesn't match)")
+}
+
+func TestBundleWordsMissingLine(t *testing.T) {
+	words, err := EncodeBundleWords(testBundle)
+	assert.Nil(t, err)
+	lines := strings.Split(words, "\n")
+	_, err = DecodeBundle([]byte(strings.Join(append(lines[:1], lines[2:]...), "\n")))
+	assert.Contains(t, err.Error(), "lines of words after the header")
+}
+
+func TestDecodeBundleJSON(t *testing.T) {
+	decoded, err := DecodeBundle(testBundle)
+	assert.Nil(t, err)
+	assert.Equal(t, testBundle, decoded)
+}
@@ -0,0 +1,180 @@
+package ca
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CertificateFormat is an encoding of issued certificates, for systems that
+// don't store them as OpenSSH certificate files.
+type CertificateFormat string
+
+const (
+	// OpenSSHFormat is the authorized_keys line that ssh reads from
+	// key-cert.pub files.
+	OpenSSHFormat CertificateFormat = "openssh"
+	// PEMFormat is the wire encoding of the certificate in an OPENSSH
+	// CERTIFICATE PEM block.
+	PEMFormat CertificateFormat = "pem"
+	// Base64Format is the base64 wire encoding of the certificate, which is
+	// the middle field of the OpenSSH line.
+	Base64Format CertificateFormat = "base64"
+	// JSONFormat is a JSON object of the decoded fields of the certificate,
+	// along with the OpenSSH line.
+	JSONFormat CertificateFormat = "json"
+)
+
+// CertificateFormats are all the formats, in the order they are documented.
+var CertificateFormats = []CertificateFormat{OpenSSHFormat, PEMFormat, Base64Format, JSONFormat}
+
+// certificatePEMType is the type of the PEM block of PEMFormat.
+const certificatePEMType = "OPENSSH CERTIFICATE"
+
+// UnmarshalText parses the name of a format. It is used for command line
+// flags.
+func (f *CertificateFormat) UnmarshalText(b []byte) error {
+	for _, format := range CertificateFormats {
+		if string(b) == string(format) {
+			*f = format
+			return nil
+		}
+	}
+	names := make([]string, len(CertificateFormats))
+	for i, format := range CertificateFormats {
+		names[i] = string(format)
+	}
+	return fmt.Errorf("unknown certificate format %q (must be one of %s)", b, strings.Join(names, ", "))
+}
+
+// Extension returns the file extension of certificates in the format, which
+// replaces .pub in the name of key-cert.pub.
+func (f CertificateFormat) Extension() string {
+	switch f {
+	case PEMFormat:
+		return ".pem"
+	case Base64Format:
+		return ".b64"
+	case JSONFormat:
+		return ".json"
+	default:
+		return ".pub"
+	}
+}
+
+// CertificateJSON is the JSONFormat of a certificate.
+type CertificateJSON struct {
+	Type            string            `json:"type"`
+	KeyType         string            `json:"key_type"`
+	KeyID           string            `json:"key_id"`
+	Serial          uint64            `json:"serial"`
+	Principals      []string          `json:"principals"`
+	ValidAfter      *time.Time        `json:"valid_after,omitempty"`
+	ValidBefore     *time.Time        `json:"valid_before,omitempty"`
+	CriticalOptions map[string]string `json:"critical_options"`
+	Extensions      []string          `json:"extensions"`
+	// CustomExtensions are the extensions with values (e.g.
+	// login@github.com), which are also listed in Extensions.
+	CustomExtensions map[string]string `json:"custom_extensions,omitempty"`
+	Fingerprint      string            `json:"fingerprint"`
+	PublicKey        string            `json:"public_key"`
+	SignatureKey     string            `json:"signature_key"`
+	SignatureType    string            `json:"signature_type"`
+	Certificate      string            `json:"certificate"`
+}
+
+// certificate returns the parsed certificate.
+func (p *PublicKey) certificate() (*ssh.Certificate, error) {
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	cert, ok := p.key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", p.key.Type())
+	}
+	return cert, nil
+}
+
+// certificateTime converts a certificate validity time, where the limits
+// mean forever.
+func certificateTime(t uint64) *time.Time {
+	if t == 0 || t == ssh.CertTimeInfinity {
+		return nil
+	}
+	converted := time.Unix(int64(t), 0).UTC()
+	return &converted
+}
+
+// certificateJSON decodes the fields of cert.
+func certificateJSON(cert *ssh.Certificate, line string) CertificateJSON {
+	decoded := CertificateJSON{
+		Type:            UserCertificate.String(),
+		KeyType:         cert.Key.Type(),
+		KeyID:           cert.KeyId,
+		Serial:          cert.Serial,
+		Principals:      cert.ValidPrincipals,
+		ValidAfter:      certificateTime(cert.ValidAfter),
+		ValidBefore:     certificateTime(cert.ValidBefore),
+		CriticalOptions: cert.CriticalOptions,
+		Extensions:      []string{},
+		Fingerprint:     ssh.FingerprintSHA256(cert.Key),
+		PublicKey:       strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert.Key))),
+		SignatureKey:    ssh.FingerprintSHA256(cert.SignatureKey),
+		Certificate:     line,
+	}
+	if cert.CertType == ssh.HostCert {
+		decoded.Type = HostCertificate.String()
+	}
+	if decoded.Principals == nil {
+		decoded.Principals = []string{}
+	}
+	if decoded.CriticalOptions == nil {
+		decoded.CriticalOptions = map[string]string{}
+	}
+	if cert.Signature != nil {
+		decoded.SignatureType = cert.Signature.Format
+	}
+	for name, value := range cert.Extensions {
+		decoded.Extensions = append(decoded.Extensions, name)
+		if value != "" {
+			if decoded.CustomExtensions == nil {
+				decoded.CustomExtensions = map[string]string{}
+			}
+			decoded.CustomExtensions[name] = value
+		}
+	}
+	sort.Strings(decoded.Extensions)
+	return decoded
+}
+
+// Encode encodes the certificate in format. OpenSSHFormat is the data of the
+// PublicKey as it is. The other formats can't be read by ssh.
+func (p *PublicKey) Encode(format CertificateFormat) ([]byte, error) {
+	if format == OpenSSHFormat || format == "" {
+		return p.Data, nil
+	}
+	cert, err := p.certificate()
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case PEMFormat:
+		var buf bytes.Buffer
+		err := pem.Encode(&buf, &pem.Block{Type: certificatePEMType, Bytes: cert.Marshal()})
+		return buf.Bytes(), err
+	case Base64Format:
+		return []byte(base64.StdEncoding.EncodeToString(cert.Marshal()) + "\n"), nil
+	case JSONFormat:
+		data, err := json.MarshalIndent(certificateJSON(cert, strings.TrimSpace(string(p.Data))), "", "  ")
+		return append(data, '\n'), err
+	default:
+		return nil, fmt.Errorf("unknown certificate format %q", format)
+	}
+}
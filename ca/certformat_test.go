@@ -0,0 +1,58 @@
+package ca
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestCertificateFormatUnmarshalText(t *testing.T) {
+	var format CertificateFormat
+	assert.Nil(t, format.UnmarshalText([]byte("pem")))
+	assert.Equal(t, PEMFormat, format)
+	assert.Error(t, format.UnmarshalText([]byte("der")))
+	assert.Equal(t, ".pub", OpenSSHFormat.Extension())
+	assert.Equal(t, ".json", JSONFormat.Extension())
+}
+
+func TestPublicKeyEncode(t *testing.T) {
+	now := time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)
+	issued := reportTestCertificate(t, 7, ssh.UserCert, []string{"alice"}, now, now.Add(time.Hour), nil)
+	certificate, err := ParsePublicKey([]byte(issued.Certificate + "\n"))
+	assert.Nil(t, err)
+	wire, err := base64.StdEncoding.DecodeString(strings.Fields(issued.Certificate)[1])
+	assert.Nil(t, err)
+
+	data, err := certificate.Encode(OpenSSHFormat)
+	assert.Nil(t, err)
+	assert.Equal(t, issued.Certificate+"\n", string(data))
+
+	data, err = certificate.Encode(PEMFormat)
+	assert.Nil(t, err)
+	block, _ := pem.Decode(data)
+	assert.Equal(t, certificatePEMType, block.Type)
+	assert.Equal(t, wire, block.Bytes)
+
+	data, err = certificate.Encode(Base64Format)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Fields(issued.Certificate)[1]+"\n", string(data))
+
+	data, err = certificate.Encode(JSONFormat)
+	assert.Nil(t, err)
+	var decoded CertificateJSON
+	assert.Nil(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, "user", decoded.Type)
+	assert.Equal(t, uint64(7), decoded.Serial)
+	assert.Equal(t, []string{"alice"}, decoded.Principals)
+	assert.Equal(t, now, *decoded.ValidAfter)
+	assert.Equal(t, issued.Certificate, decoded.Certificate)
+
+	_, err = testPublicKey.Encode(PEMFormat)
+	assert.Error(t, err, "plain public keys aren't certificates")
+}
@@ -1,31 +1,155 @@
 package ca
 
 import (
-	"net/rpc"
+	"errors"
+	"fmt"
+	"time"
 )
 
 const (
 	// ServerName is the name that the CA client expects to find the server at.
 	ServerName             = "CA"
-	getCAPublicKeyEndpoint = ServerName + "." + "GetCAPublicKey"
-	signPublicKeyEndpoint  = ServerName + "." + "SignPublicKey"
+	getCAPublicKeyEndpoint = "GetCAPublicKey"
+	signPublicKeyEndpoint  = "SignPublicKey"
+	submitSignEndpoint     = "SubmitSignRequest"
+	getSignResultEndpoint  = "GetSignResult"
+	getChallengeEndpoint   = "GetChallenge"
+	crossCertifyEndpoint   = "CrossCertify"
+	getTrustBundleEndpoint = "GetTrustBundle"
+	getKRLEndpoint         = "GetKRL"
+	checkStatusEndpoint    = "CheckStatus"
+	versionEndpoint        = "Version"
 )
 
-// Client wraps rpc.Client and provides functions to call the SSH CA RPCs.
+// TenantService is the name that the server for a tenant is registered at.
+func TenantService(tenant string) string {
+	return ServerName + "/" + tenant
+}
+
+// Caller makes the RPC calls of a Client. *rpc.Client is a Caller for a
+// server over a connection, and NewInProcessClient calls a Server directly.
+type Caller interface {
+	Call(serviceMethod string, args interface{}, reply interface{}) error
+	Close() error
+}
+
+// Client wraps a Caller and provides functions to call the SSH CA RPCs.
 type Client struct {
-	*rpc.Client
+	Caller
+	// Addr is the address of the server, if the client is remote.
+	Addr string
+	// Service is the name of the server to call (see TenantService). Empty
+	// means ServerName.
+	Service string
+	// Recorder optionally records the calls, e.g. to attach to a bug report.
+	Recorder *Recorder
+}
+
+// service returns the name of the selected service.
+func (c Client) service() string {
+	if c.Service == "" {
+		return ServerName
+	}
+	return c.Service
+}
+
+// call calls the endpoint on the selected service.
+func (c Client) call(endpoint string, args interface{}, reply interface{}) error {
+	err := c.Call(c.service()+"."+endpoint, args, reply)
+	if c.Recorder != nil {
+		// The error of the call is more useful than the error recording it
+		if recordErr := c.Recorder.record(c.service(), endpoint, args, reply, err); recordErr != nil && err == nil {
+			return fmt.Errorf("failed to record call: %w", recordErr)
+		}
+	}
+	return err
 }
 
 // GetCAPublicKey represents the GetCAPublicKey RPC call
 func (c Client) GetCAPublicKey() (*PublicKeyReply, error) {
 	publicKey := new(PublicKeyReply)
-	err := c.Call(getCAPublicKeyEndpoint, struct{}{}, publicKey)
+	err := c.call(getCAPublicKeyEndpoint, struct{}{}, publicKey)
 	return publicKey, err
 }
 
 // SignPublicKey represents the SignPublicKey RPC call
 func (c Client) SignPublicKey(args SignArgs) (*SignReply, error) {
 	signReply := new(SignReply)
-	err := c.Call(signPublicKeyEndpoint, args, signReply)
+	err := c.call(signPublicKeyEndpoint, args, signReply)
 	return signReply, err
 }
+
+// SubmitSignRequest represents the SubmitSignRequest RPC call
+func (c Client) SubmitSignRequest(args SignArgs) (*SubmitReply, error) {
+	submitReply := new(SubmitReply)
+	err := c.call(submitSignEndpoint, args, submitReply)
+	return submitReply, err
+}
+
+// GetSignResult represents the GetSignResult RPC call
+func (c Client) GetSignResult(requestID string) (*SignResultReply, error) {
+	resultReply := new(SignResultReply)
+	err := c.call(getSignResultEndpoint, SignResultArgs{requestID}, resultReply)
+	return resultReply, err
+}
+
+// GetChallenge represents the GetChallenge RPC call
+func (c Client) GetChallenge() (*ChallengeReply, error) {
+	challengeReply := new(ChallengeReply)
+	err := c.call(getChallengeEndpoint, struct{}{}, challengeReply)
+	return challengeReply, err
+}
+
+// CrossCertify represents the CrossCertify RPC call
+func (c Client) CrossCertify(args CrossCertifyArgs) (*CrossCertifyReply, error) {
+	crossCertifyReply := new(CrossCertifyReply)
+	err := c.call(crossCertifyEndpoint, args, crossCertifyReply)
+	return crossCertifyReply, err
+}
+
+// GetTrustBundle represents the GetTrustBundle RPC call
+func (c Client) GetTrustBundle() (*TrustBundleReply, error) {
+	trustBundleReply := new(TrustBundleReply)
+	err := c.call(getTrustBundleEndpoint, struct{}{}, trustBundleReply)
+	return trustBundleReply, err
+}
+
+// GetKRL represents the GetKRL RPC call
+func (c Client) GetKRL(etag string) (*KRLReply, error) {
+	krlReply := new(KRLReply)
+	err := c.call(getKRLEndpoint, KRLArgs{etag}, krlReply)
+	return krlReply, err
+}
+
+// CheckStatus represents the CheckStatus RPC call
+func (c Client) CheckStatus(args CheckStatusArgs) (*StatusReply, error) {
+	statusReply := new(StatusReply)
+	err := c.call(checkStatusEndpoint, args, statusReply)
+	return statusReply, err
+}
+
+// Version represents the Version RPC call
+func (c Client) Version() (*VersionReply, error) {
+	versionReply := new(VersionReply)
+	err := c.call(versionEndpoint, struct{}{}, versionReply)
+	return versionReply, err
+}
+
+// WaitForSignResult polls GetSignResult every interval until the request is no
+// longer pending. A failed request is returned as an error.
+func (c Client) WaitForSignResult(requestID string, interval time.Duration) (*SignReply, error) {
+	for {
+		result, err := c.GetSignResult(requestID)
+		if err != nil {
+			return nil, err
+		}
+
+		switch result.Status {
+		case RequestSigned:
+			return &SignReply{Certificate: result.Certificate}, nil
+		case RequestFailed:
+			return nil, errors.New(result.Error)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,251 @@
+package ca
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// DefaultMaxRequestSize is the largest request that NewServer accepts. Signing
+// requests are a public key and a few short strings, so this leaves plenty of
+// room for large RSA keys.
+const DefaultMaxRequestSize = 64 << 10
+
+// DefaultRequestTimeout is how long NewServer waits for the rest of a request
+// once it has started to arrive.
+const DefaultRequestTimeout = 30 * time.Second
+
+// DefaultIdleTimeout is how long NewServer keeps connections open without
+// requests.
+const DefaultIdleTimeout = 5 * time.Minute
+
+// DefaultMaxConcurrentRequests is how many requests NewServer handles at once
+// on each connection. Clients make one request at a time, apart from
+// concurrent signing requests that wait for confirmation.
+const DefaultMaxConcurrentRequests = 16
+
+// DefaultWriteTimeout is how long NewServer waits for a client to accept a
+// response.
+const DefaultWriteTimeout = 30 * time.Second
+
+// requestReader counts the bytes read for the current request and fails once
+// there are more than limit, so that gob stops decoding oversized requests
+// instead of allocating for them. It is a io.ByteReader, so that gob reads
+// from it directly and the count doesn't include buffered bytes of the next
+// request.
+type requestReader struct {
+	r     *bufio.Reader
+	limit int64
+	read  int64
+}
+
+func (r *requestReader) errTooLarge() error {
+	return fmt.Errorf("request is larger than %d bytes", r.limit)
+}
+
+func (r *requestReader) Read(p []byte) (int, error) {
+	if r.limit > 0 {
+		if r.read >= r.limit {
+			return 0, r.errTooLarge()
+		}
+		if remaining := r.limit - r.read; int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *requestReader) ReadByte() (byte, error) {
+	if r.limit > 0 && r.read >= r.limit {
+		return 0, r.errTooLarge()
+	}
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.read++
+	}
+	return b, err
+}
+
+// connLimits are the limits on a client connection. Zero disables a limit.
+type connLimits struct {
+	// maxRequestSize is the largest request in bytes.
+	maxRequestSize int64
+	// requestTimeout is how long a request can take to arrive once it has
+	// started.
+	requestTimeout time.Duration
+	// idleTimeout is how long the connection can wait for a request while
+	// none are being handled.
+	idleTimeout time.Duration
+	// writeTimeout is how long writing a response can take.
+	writeTimeout time.Duration
+	// maxConcurrentRequests is how many requests can be handled at once. The
+	// next request isn't read until one of them is responded to.
+	maxConcurrentRequests int
+}
+
+// serverCodec is the gob codec of net/rpc, with limits on the size of each
+// request, the time taken to send it, the time between requests and the
+// number of requests handled at once.
+type serverCodec struct {
+	conn   net.Conn
+	reader *requestReader
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	limits connLimits
+	closed bool
+	// slots has a value for each request that is being handled, if the number
+	// of concurrent requests is limited. net/rpc handles each request in a new
+	// goroutine, so without it a client could start any number of them.
+	slots chan struct{}
+	// err is the error that failed the last request. The decoder can't
+	// continue after it, so the connection is closed instead of reading the
+	// next request.
+	err error
+
+	// mu protects the fields below, which decide the read deadline. Responses
+	// are written while the next request is read.
+	mu sync.Mutex
+	// pending is the number of requests that haven't been responded to. The
+	// connection isn't idle while the client waits for a response (e.g. for
+	// the operator to confirm a request).
+	pending int
+	// reading is set while a request is arriving.
+	reading bool
+}
+
+func newServerCodec(conn net.Conn, limits connLimits) *serverCodec {
+	reader := &requestReader{r: bufio.NewReader(conn), limit: limits.maxRequestSize}
+	encBuf := bufio.NewWriter(conn)
+	var slots chan struct{}
+	if limits.maxConcurrentRequests > 0 {
+		slots = make(chan struct{}, limits.maxConcurrentRequests)
+	}
+	return &serverCodec{
+		conn:   conn,
+		reader: reader,
+		dec:    gob.NewDecoder(reader),
+		enc:    gob.NewEncoder(encBuf),
+		encBuf: encBuf,
+		limits: limits,
+		slots:  slots,
+	}
+}
+
+// setIdleDeadline sets the read deadline for waiting for the next request. It
+// must be called with c.mu held.
+func (c *serverCodec) setIdleDeadline() {
+	if c.pending == 0 && c.limits.idleTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.limits.idleTimeout))
+	} else {
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// ReadRequestHeader waits until another request can be handled and for the
+// next request, and then starts the limits for it.
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.slots != nil {
+		// Released by WriteResponse, or below if there is no request
+		c.slots <- struct{}{}
+	}
+	c.mu.Lock()
+	c.setIdleDeadline()
+	c.mu.Unlock()
+	if _, err := c.reader.r.Peek(1); err != nil {
+		c.release()
+		return err
+	}
+
+	c.mu.Lock()
+	c.reading = true
+	c.reader.read = 0
+	if c.limits.requestTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.limits.requestTimeout))
+	} else {
+		c.conn.SetReadDeadline(time.Time{})
+	}
+	c.mu.Unlock()
+	c.err = c.dec.Decode(r)
+	if c.err == nil {
+		// net/rpc responds to every request with a header, even if its body
+		// can't be read
+		c.mu.Lock()
+		c.pending++
+		c.mu.Unlock()
+	} else {
+		c.release()
+	}
+	return c.err
+}
+
+// release lets another request be handled.
+func (c *serverCodec) release() {
+	if c.slots != nil {
+		<-c.slots
+	}
+}
+
+// ReadRequestBody reads the rest of the request, and then lifts the deadline
+// until the next one.
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	c.err = c.dec.Decode(body)
+	c.mu.Lock()
+	c.reading = false
+	c.conn.SetReadDeadline(time.Time{})
+	c.mu.Unlock()
+	return c.err
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	defer func() {
+		c.mu.Lock()
+		c.pending--
+		if !c.reading {
+			// The idle time starts again once the last response is sent
+			c.setIdleDeadline()
+		}
+		c.mu.Unlock()
+		c.release()
+	}()
+	if c.limits.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.limits.writeTimeout))
+	}
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// The response couldn't be encoded, which is a programming
+			// error, so the connection is in an unknown state
+			c.Close()
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *serverCodec) Close() error {
+	if c.closed {
+		// Only call c.conn.Close once; otherwise the semantics are undefined.
+		return nil
+	}
+	c.closed = true
+	return c.conn.Close()
+}
+
+var _ rpc.ServerCodec = (*serverCodec)(nil)
+var _ io.ByteReader = (*requestReader)(nil)
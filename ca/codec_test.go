@@ -0,0 +1,164 @@
+package ca
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeConnRejectsOversizedRequest(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	reporter := &recordingReporter{}
+	server.Reporter = reporter
+	server.MaxRequestSize = 1024
+	addr := serveTestServer(t, &server)
+
+	client, err := Dial([]string{addr}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+	_, err = client.SignPublicKey(SignArgs{
+		Identity:        "test",
+		CertificateType: UserCertificate,
+		Principals:      []string{strings.Repeat("a", 2048)},
+		PublicKey:       testPublicKey,
+	})
+	assert.Error(t, err)
+
+	// Requests within the limit are still served on other connections
+	client, err = Dial([]string{addr}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+	reply, err := client.GetCAPublicKey()
+	assert.Nil(t, err)
+	assert.Equal(t, testPublicKey.Data, reply.CAPublicKey.Data)
+	assert.True(t, waitForReport(reporter, "request is larger than 1024 bytes"))
+}
+
+// waitForReport waits for the server to report a message containing substr,
+// which happens after the connection is closed.
+func waitForReport(reporter *recordingReporter, substr string) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		reporter.mu.Lock()
+		messages := strings.Join(reporter.messages, "")
+		reporter.mu.Unlock()
+		if strings.Contains(messages, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServeConnServesSeveralRequests(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	server.Reporter = NewWriterReporter(ioutil.Discard)
+	server.MaxRequestSize = 1024
+	client, err := Dial([]string{serveTestServer(t, &server)}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	// The limit applies to each request, not to the whole connection
+	for i := 0; i < 20; i++ {
+		_, err := client.GetCAPublicKey()
+		assert.Nil(t, err)
+	}
+}
+
+func TestServeConnClosesTrickledRequest(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	server.Reporter = NewWriterReporter(ioutil.Discard)
+	server.RequestTimeout = 50 * time.Millisecond
+	conn, err := net.Dial("tcp", serveTestServer(t, &server))
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// The start of a request, and then nothing
+	_, err = conn.Write([]byte{0x10})
+	assert.Nil(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServeConnClosesIdleConnection(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	server.Reporter = NewWriterReporter(ioutil.Discard)
+	server.IdleTimeout = 50 * time.Millisecond
+	conn, err := net.Dial("tcp", serveTestServer(t, &server))
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestServeConnKeepsConnectionWithPendingRequest(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", false)
+	assert.Nil(t, err)
+	server.Reporter = NewWriterReporter(ioutil.Discard)
+	server.IdleTimeout = 50 * time.Millisecond
+	server.Interactor = interactorFunc(func(description string) error {
+		time.Sleep(200 * time.Millisecond)
+		return errors.New("operator is slow")
+	})
+	client, err := Dial([]string{serveTestServer(t, &server)}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	// The reply arrives after the idle timeout
+	_, err = client.SignPublicKey(SignArgs{Identity: "test", CertificateType: UserCertificate, Principals: []string{"test"}, PublicKey: testPublicKey})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "operator is slow")
+
+	// Once nothing is pending, the idle timeout applies again
+	time.Sleep(200 * time.Millisecond)
+	_, err = client.GetCAPublicKey()
+	assert.Error(t, err)
+}
+
+func TestServeConnLimitsConcurrentRequests(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", false)
+	assert.Nil(t, err)
+	server.Reporter = NewWriterReporter(ioutil.Discard)
+	server.MaxConcurrentRequests = 1
+	confirm := make(chan struct{})
+	server.Interactor = interactorFunc(func(description string) error {
+		<-confirm
+		return errors.New("denied")
+	})
+	client, err := Dial([]string{serveTestServer(t, &server)}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	signed := make(chan error, 1)
+	go func() {
+		_, err := client.SignPublicKey(SignArgs{Identity: "test", CertificateType: UserCertificate, Principals: []string{"test"}, PublicKey: testPublicKey})
+		signed <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	fetched := make(chan error, 1)
+	go func() {
+		_, err := client.GetCAPublicKey()
+		fetched <- err
+	}()
+
+	// The second request isn't read while the first waits for confirmation
+	select {
+	case <-fetched:
+		t.Fatal("the second request was handled while the first was in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(confirm)
+	assert.Error(t, <-signed)
+	assert.Nil(t, <-fetched)
+}
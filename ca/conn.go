@@ -0,0 +1,86 @@
+package ca
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"sync/atomic"
+)
+
+// lastConnectionID is the ID of the last connection, which are numbered from
+// 1.
+var lastConnectionID uint64
+
+// nextConnectionID returns a new connection ID.
+func nextConnectionID() uint64 {
+	return atomic.AddUint64(&lastConnectionID, 1)
+}
+
+// connection serves the RPCs for a single client connection, so that requests
+// can be checked against the address that they came from. The methods of
+// Server are promoted, and the ones that need the address are overridden.
+type connection struct {
+	*Server
+	remoteAddr net.Addr
+	// id identifies the connection, whichever tenant it calls.
+	id uint64
+	// inProcess is set for calls from the same process (e.g. --local), which
+	// has the CA key anyway.
+	inProcess bool
+}
+
+// SignPublicKey records the client address before signing.
+func (c connection) SignPublicKey(args SignArgs, reply *SignReply) error {
+	args.clientAddr = c.remoteAddr
+	args.connection = c.id
+	return c.Server.SignPublicKey(args, reply)
+}
+
+// SubmitSignRequest records the client address before queueing the request.
+func (c connection) SubmitSignRequest(args SignArgs, reply *SubmitReply) error {
+	args.clientAddr = c.remoteAddr
+	args.connection = c.id
+	return c.Server.SubmitSignRequest(args, reply)
+}
+
+// CrossCertify records where the request came from before endorsing the key.
+func (c connection) CrossCertify(args CrossCertifyArgs, reply *CrossCertifyReply) error {
+	args.clientAddr = c.remoteAddr
+	args.connection = c.id
+	args.remote = !c.inProcess
+	return c.Server.CrossCertify(args, reply)
+}
+
+// ServeConn serves the CA RPCs on a single connection until the client hangs
+// up.
+func (ca *Server) ServeConn(conn net.Conn) {
+	server := rpc.NewServer()
+	id := nextConnectionID()
+	// Registration only fails if there are no RPC methods, which is a
+	// programming error
+	if err := server.RegisterName(ServerName, connection{Server: ca, remoteAddr: conn.RemoteAddr(), id: id}); err != nil {
+		panic(err)
+	}
+	for name, tenant := range ca.Tenants {
+		if err := server.RegisterName(TenantService(name), connection{Server: tenant, remoteAddr: conn.RemoteAddr(), id: id}); err != nil {
+			panic(err)
+		}
+	}
+	codec := newServerCodec(conn, connLimits{ca.MaxRequestSize, ca.RequestTimeout, ca.IdleTimeout, ca.WriteTimeout, ca.MaxConcurrentRequests})
+	server.ServeCodec(codec)
+	if codec.err != nil && codec.err != io.EOF {
+		ca.Reporter.Report(fmt.Sprintf("closed connection from %s: %s\n", conn.RemoteAddr(), codec.err))
+	}
+}
+
+// Accept serves the CA RPCs on connections from listener until it fails.
+func (ca *Server) Accept(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		go ca.ServeConn(conn)
+	}
+}
@@ -0,0 +1,67 @@
+package ca
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Dial connects to the first reachable server in addrs, trying them in order.
+// Each address is a remote for a Transport (see SplitRemote).
+func Dial(addrs []string, timeout time.Duration) (*Client, error) {
+	var err error
+	for _, addr := range addrs {
+		conn, dialErr := dialRemote(addr, timeout)
+		if dialErr == nil {
+			return &Client{Caller: rpc.NewClient(conn), Addr: addr}, nil
+		}
+		err = multierror.Append(err, fmt.Errorf("failed to connect to server at %s: %w", addr, dialErr))
+	}
+	if err == nil {
+		return nil, fmt.Errorf("no servers to connect to")
+	}
+	return nil, err
+}
+
+// DialFastest connects to all of addrs concurrently and uses the server that
+// accepts the connection first. The other connections are closed.
+func DialFastest(addrs []string, timeout time.Duration) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no servers to connect to")
+	}
+
+	type dialResult struct {
+		addr string
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			conn, err := dialRemote(addr, timeout)
+			results <- dialResult{addr, conn, err}
+		}(addr)
+	}
+
+	var client *Client
+	var err error
+	for range addrs {
+		result := <-results
+		switch {
+		case result.err != nil:
+			err = multierror.Append(err, fmt.Errorf("failed to connect to server at %s: %w", result.addr, result.err))
+		case client == nil:
+			client = &Client{Caller: rpc.NewClient(result.conn), Addr: result.addr}
+		default:
+			result.conn.Close()
+		}
+	}
+
+	if client == nil {
+		return nil, err
+	}
+	return client, nil
+}
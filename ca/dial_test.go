@@ -0,0 +1,72 @@
+package ca
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestServer serves a CA server on a random local port and returns its
+// address.
+func startTestServer(t *testing.T) string {
+	t.Helper()
+	caServer, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	return serveTestServer(t, &caServer)
+}
+
+// serveTestServer serves caServer on a local TCP address until the test ends.
+func serveTestServer(t *testing.T, caServer *Server) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go caServer.Accept(listener)
+	return listener.Addr().String()
+}
+
+// unreachableAddr returns a local address that refuses connections.
+func unreachableAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestDialFailsOver(t *testing.T) {
+	addr := startTestServer(t)
+	client, err := Dial([]string{unreachableAddr(t), addr}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, addr, client.Addr)
+	reply, err := client.GetCAPublicKey()
+	assert.Nil(t, err)
+	assert.Equal(t, testPublicKey.Data, reply.CAPublicKey.Data)
+}
+
+func TestDialAllUnreachable(t *testing.T) {
+	_, err := Dial([]string{unreachableAddr(t), unreachableAddr(t)}, time.Second)
+	assert.Error(t, err)
+}
+
+func TestDialNoAddresses(t *testing.T) {
+	_, err := Dial(nil, time.Second)
+	assert.Error(t, err)
+}
+
+func TestDialFastest(t *testing.T) {
+	addr := startTestServer(t)
+	client, err := DialFastest([]string{unreachableAddr(t), addr}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, addr, client.Addr)
+}
+
+func TestDialFastestAllUnreachable(t *testing.T) {
+	_, err := DialFastest([]string{unreachableAddr(t)}, time.Second)
+	assert.Error(t, err)
+}
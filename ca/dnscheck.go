@@ -0,0 +1,79 @@
+package ca
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+)
+
+// lookupHost is net.LookupHost, replaced in tests.
+var lookupHost = net.LookupHost
+
+// HostDNSPolicy optionally checks that the principals of host certificate
+// requests belong to the host that made the request.
+type HostDNSPolicy struct {
+	// Verify rejects host certificate requests unless every principal resolves
+	// to the IP address that the request came from. Principals that are IP
+	// addresses must be that address.
+	Verify bool
+	// OverrideToken lets a request skip the check (e.g. for a host behind NAT
+	// or a request tunnelled over SSH) if it carries the same token. Empty
+	// disables overrides.
+	OverrideToken string
+}
+
+// clientIP returns the IP address of a TCP client, or nil if the request
+// didn't come over TCP (e.g. the in-process client used by --local).
+func clientIP(addr net.Addr) net.IP {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return tcpAddr.IP
+}
+
+// resolvesTo reports whether the principal is, or resolves to, ip.
+func resolvesTo(principal string, ip net.IP) (bool, error) {
+	if principalIP := net.ParseIP(principal); principalIP != nil {
+		return principalIP.Equal(ip), nil
+	}
+	addrs, err := lookupHost(principal)
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if net.ParseIP(addr).Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// check returns an error if the request is a host certificate request that
+// fails the policy. It returns true if the check was overridden.
+func (p HostDNSPolicy) check(args SignArgs) (bool, error) {
+	if !p.Verify || args.CertificateType != HostCertificate {
+		return false, nil
+	}
+	if args.OverrideToken != "" {
+		if p.OverrideToken == "" || subtle.ConstantTimeCompare([]byte(args.OverrideToken), []byte(p.OverrideToken)) != 1 {
+			return false, fmt.Errorf("invalid DNS check override token")
+		}
+		return true, nil
+	}
+
+	ip := clientIP(args.clientAddr)
+	if ip == nil {
+		return false, nil
+	}
+	for _, principal := range args.Principals {
+		ok, err := resolvesTo(principal, ip)
+		if err != nil {
+			return false, fmt.Errorf("failed to resolve host principal %s: %w", principal, err)
+		}
+		if !ok {
+			return false, fmt.Errorf("host principal %s does not resolve to the requesting address %s", principal, ip)
+		}
+	}
+	return false, nil
+}
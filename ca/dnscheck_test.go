@@ -0,0 +1,114 @@
+package ca
+
+import (
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeLookupHost(t *testing.T, hosts map[string][]string) {
+	t.Helper()
+	original := lookupHost
+	t.Cleanup(func() { lookupHost = original })
+	lookupHost = func(host string) ([]string, error) {
+		addrs, ok := hosts[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return addrs, nil
+	}
+}
+
+var testClientAddr = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+func hostArgs(principals ...string) SignArgs {
+	return SignArgs{CertificateType: HostCertificate, Principals: principals, PublicKey: testPublicKey, clientAddr: testClientAddr}
+}
+
+func TestHostDNSPolicyCheck(t *testing.T) {
+	fakeLookupHost(t, map[string][]string{"host.example.com": {"2001:db8::1", "192.0.2.1"}})
+	overridden, err := HostDNSPolicy{Verify: true}.check(hostArgs("host.example.com", "192.0.2.1"))
+	assert.Nil(t, err)
+	assert.False(t, overridden)
+}
+
+func TestHostDNSPolicyCheckMismatch(t *testing.T) {
+	fakeLookupHost(t, map[string][]string{"other.example.com": {"192.0.2.2"}})
+	_, err := HostDNSPolicy{Verify: true}.check(hostArgs("other.example.com"))
+	assert.EqualError(t, err, "host principal other.example.com does not resolve to the requesting address 192.0.2.1")
+}
+
+func TestHostDNSPolicyCheckIPMismatch(t *testing.T) {
+	fakeLookupHost(t, nil)
+	_, err := HostDNSPolicy{Verify: true}.check(hostArgs("192.0.2.2"))
+	assert.Error(t, err)
+}
+
+func TestHostDNSPolicyCheckUnresolvable(t *testing.T) {
+	fakeLookupHost(t, nil)
+	_, err := HostDNSPolicy{Verify: true}.check(hostArgs("missing.example.com"))
+	assert.Error(t, err)
+}
+
+func TestHostDNSPolicyCheckDisabled(t *testing.T) {
+	fakeLookupHost(t, nil)
+	_, err := HostDNSPolicy{}.check(hostArgs("missing.example.com"))
+	assert.Nil(t, err)
+}
+
+func TestHostDNSPolicyCheckIgnoresUserCertificates(t *testing.T) {
+	fakeLookupHost(t, nil)
+	args := hostArgs("missing.example.com")
+	args.CertificateType = UserCertificate
+	_, err := HostDNSPolicy{Verify: true}.check(args)
+	assert.Nil(t, err)
+}
+
+func TestHostDNSPolicyCheckWithoutTCPClient(t *testing.T) {
+	fakeLookupHost(t, nil)
+	args := hostArgs("missing.example.com")
+	args.clientAddr = nil
+	_, err := HostDNSPolicy{Verify: true}.check(args)
+	assert.Nil(t, err)
+}
+
+func TestHostDNSPolicyCheckOverride(t *testing.T) {
+	fakeLookupHost(t, nil)
+	args := hostArgs("missing.example.com")
+	args.OverrideToken = "secret"
+	overridden, err := HostDNSPolicy{Verify: true, OverrideToken: "secret"}.check(args)
+	assert.Nil(t, err)
+	assert.True(t, overridden)
+}
+
+func TestHostDNSPolicyCheckInvalidOverride(t *testing.T) {
+	fakeLookupHost(t, nil)
+	args := hostArgs("missing.example.com")
+	args.OverrideToken = "guess"
+	_, err := HostDNSPolicy{Verify: true, OverrideToken: "secret"}.check(args)
+	assert.EqualError(t, err, "invalid DNS check override token")
+
+	_, err = HostDNSPolicy{Verify: true}.check(args)
+	assert.EqualError(t, err, "invalid DNS check override token")
+}
+
+func TestServerChecksHostDNSAgainstConnection(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	fakeLookupHost(t, map[string][]string{"localhost.test": {"127.0.0.1"}, "remote.test": {"192.0.2.1"}})
+	caServer, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	caServer.HostDNS = HostDNSPolicy{Verify: true}
+	client, err := Dial([]string{serveTestServer(t, &caServer)}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"localhost.test"}, PublicKey: testPublicKey})
+	assert.Nil(t, err)
+	_, err = client.SignPublicKey(SignArgs{RequestUUID: testRequestUUID, Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"remote.test"}, PublicKey: testPublicKey})
+	assert.EqualError(t, err, "request "+testRequestUUID+": host principals rejected: host principal remote.test does not resolve to the requesting address 127.0.0.1")
+}
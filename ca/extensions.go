@@ -0,0 +1,170 @@
+package ca
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ExtensionPolicy controls the critical options and extensions of the
+// certificates that the server issues, on top of the options that clients
+// request.
+type ExtensionPolicy struct {
+	// UserOptions and HostOptions are added to every user or host certificate,
+	// as ssh-keygen -O options. They can be custom critical options or
+	// extensions (e.g. extension:team@example.com=infra or
+	// critical:tier@example.com=prod), and for user certificates, any option
+	// that clients can request (e.g. source-address=10.0.0.0/8). Adding them
+	// to host certificates needs a version of ssh-keygen that supports it,
+	// which is checked in the issued certificate.
+	UserOptions []string
+	HostOptions []string
+	// AllowedUserExtensions limits the extensions of user certificates (e.g.
+	// permit-pty or login@github.com) to these. Extensions that aren't listed
+	// are stripped, whether the client requested them or would get them by
+	// default. Restrictions (e.g. force-command) are always kept. Nil allows
+	// all extensions.
+	AllowedUserExtensions []string
+}
+
+// Validate checks that the options of the policy can be added to
+// certificates, and that the allowed extensions are known.
+func (p ExtensionPolicy) Validate() error {
+	for _, option := range p.UserOptions {
+		if _, _, ok := customOption(option); ok {
+			continue
+		}
+		if err := checkOption(option); err != nil || option == "clear" {
+			return fmt.Errorf("invalid user certificate option %q (must be extension:NAME[=VALUE], critical:NAME[=VALUE] or a restriction such as source-address=CIDRS)", option)
+		}
+	}
+	for _, option := range p.HostOptions {
+		if _, _, ok := customOption(option); !ok {
+			return fmt.Errorf("invalid host certificate option %q (must be extension:NAME[=VALUE] or critical:NAME[=VALUE])", option)
+		}
+	}
+	for _, extension := range p.AllowedUserExtensions {
+		if !isUserExtension(extension) && extension != GitHubLoginExtension {
+			return fmt.Errorf("unknown extension %q (must be one of %s or %s)", extension, strings.Join(userExtensions, ", "), GitHubLoginExtension)
+		}
+	}
+	return nil
+}
+
+// customOption parses a custom ssh-keygen -O option (extension:NAME[=VALUE]
+// or critical:NAME[=VALUE]) into whether it is critical and its name.
+func customOption(option string) (critical bool, name string, ok bool) {
+	switch {
+	case strings.HasPrefix(option, "extension:"):
+		name = strings.TrimPrefix(option, "extension:")
+	case strings.HasPrefix(option, "critical:"):
+		critical, name = true, strings.TrimPrefix(option, "critical:")
+	default:
+		return false, "", false
+	}
+	if i := strings.IndexByte(name, '='); i != -1 {
+		name = name[:i]
+	}
+	if name == "" || strings.ContainsAny(name, " \t\n\x00") {
+		return false, "", false
+	}
+	return critical, name, true
+}
+
+// isUserExtension reports whether extension is one of the standard user
+// certificate extensions.
+func isUserExtension(extension string) bool {
+	for _, name := range userExtensions {
+		if extension == name {
+			return true
+		}
+	}
+	return false
+}
+
+// serverOptions returns the options that the policy adds to certificates of
+// certType.
+func (p ExtensionPolicy) serverOptions(certType CertificateType) []string {
+	if certType == HostCertificate {
+		return p.HostOptions
+	}
+	return p.UserOptions
+}
+
+// apply returns the options of a request once the policy is applied, and the
+// client-requested extensions that were stripped. The options must already
+// have been checked by checkOptions.
+func (p ExtensionPolicy) apply(args SignArgs) (options []string, stripped []string) {
+	if args.CertificateType == HostCertificate || p.AllowedUserExtensions == nil {
+		return append(append([]string(nil), args.Options...), p.serverOptions(args.CertificateType)...), nil
+	}
+	allowed := map[string]bool{}
+	for _, extension := range p.AllowedUserExtensions {
+		allowed[extension] = true
+	}
+
+	// Work out which standard extensions the client would get, which is all
+	// of them unless they were cleared
+	granted := map[string]bool{}
+	for _, extension := range userExtensions {
+		granted[extension] = true
+	}
+	var restrictions []string
+	for _, option := range args.Options {
+		switch {
+		case option == "clear":
+			granted = map[string]bool{}
+		case isUserExtension(option):
+			granted[option] = true
+			if !allowed[option] {
+				stripped = append(stripped, option)
+			}
+		case strings.HasPrefix(option, "no-"):
+			delete(granted, "permit-"+strings.TrimPrefix(option, "no-"))
+		case strings.HasPrefix(option, githubLoginPrefix):
+			if allowed[GitHubLoginExtension] {
+				restrictions = append(restrictions, option)
+			} else {
+				stripped = append(stripped, option)
+			}
+		default:
+			restrictions = append(restrictions, option)
+		}
+	}
+
+	options = []string{"clear"}
+	for _, extension := range userExtensions {
+		if granted[extension] && allowed[extension] {
+			options = append(options, extension)
+		}
+	}
+	options = append(options, restrictions...)
+	return append(options, p.UserOptions...), stripped
+}
+
+// checkCertificate checks that the custom options of the policy made it into
+// an issued certificate, which they don't with versions of ssh-keygen that
+// ignore them (e.g. for host certificates).
+func (p ExtensionPolicy) checkCertificate(certType CertificateType, certificate *PublicKey) error {
+	options := p.serverOptions(certType)
+	if len(options) == 0 {
+		return nil
+	}
+	cert, err := certificate.certificate()
+	if err != nil {
+		return err
+	}
+	for _, option := range options {
+		critical, name, ok := customOption(option)
+		if !ok {
+			continue
+		}
+		present := cert.Extensions
+		if critical {
+			present = cert.CriticalOptions
+		}
+		if _, ok := present[name]; !ok {
+			return fmt.Errorf("ssh-keygen did not add %s to the %s certificate (custom options need a newer version of ssh-keygen)", option, certType)
+		}
+	}
+	return nil
+}
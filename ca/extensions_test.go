@@ -0,0 +1,125 @@
+package ca
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestExtensionPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ExtensionPolicy
+		valid  bool
+	}{
+		{"empty", ExtensionPolicy{}, true},
+		{"custom user options", ExtensionPolicy{UserOptions: []string{"extension:team@example.com=infra", "critical:tier@example.com"}}, true},
+		{"user restriction", ExtensionPolicy{UserOptions: []string{"source-address=10.0.0.0/8", "no-pty"}}, true},
+		{"user clear", ExtensionPolicy{UserOptions: []string{"clear"}}, false},
+		{"unknown user option", ExtensionPolicy{UserOptions: []string{"permit-everything"}}, false},
+		{"custom host option", ExtensionPolicy{HostOptions: []string{"extension:zone@example.com=eu"}}, true},
+		{"host restriction", ExtensionPolicy{HostOptions: []string{"source-address=10.0.0.0/8"}}, false},
+		{"unnamed custom option", ExtensionPolicy{HostOptions: []string{"extension:=eu"}}, false},
+		{"allowed extensions", ExtensionPolicy{AllowedUserExtensions: []string{"permit-pty", GitHubLoginExtension}}, true},
+		{"unknown allowed extension", ExtensionPolicy{AllowedUserExtensions: []string{"permit-everything"}}, false},
+	}
+	for _, test := range tests {
+		err := test.policy.Validate()
+		if test.valid {
+			assert.Nil(t, err, test.name)
+		} else {
+			assert.Error(t, err, test.name)
+		}
+	}
+}
+
+func TestExtensionPolicyApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   ExtensionPolicy
+		args     SignArgs
+		options  []string
+		stripped []string
+	}{
+		{
+			"no policy",
+			ExtensionPolicy{},
+			SignArgs{CertificateType: UserCertificate, Options: []string{"clear", "permit-pty"}},
+			[]string{"clear", "permit-pty"},
+			nil,
+		},
+		{
+			"server options",
+			ExtensionPolicy{UserOptions: []string{"extension:team@example.com=infra"}, HostOptions: []string{"extension:zone@example.com=eu"}},
+			SignArgs{CertificateType: HostCertificate},
+			[]string{"extension:zone@example.com=eu"},
+			nil,
+		},
+		{
+			"default extensions are limited",
+			ExtensionPolicy{AllowedUserExtensions: []string{"permit-pty", "permit-agent-forwarding"}},
+			SignArgs{CertificateType: UserCertificate},
+			[]string{"clear", "permit-agent-forwarding", "permit-pty"},
+			nil,
+		},
+		{
+			"requested extensions are stripped",
+			ExtensionPolicy{AllowedUserExtensions: []string{"permit-pty"}},
+			SignArgs{CertificateType: UserCertificate, Options: []string{"clear", "permit-pty", "permit-port-forwarding", "force-command=/bin/true"}},
+			[]string{"clear", "permit-pty", "force-command=/bin/true"},
+			[]string{"permit-port-forwarding"},
+		},
+		{
+			"denied extensions stay denied",
+			ExtensionPolicy{AllowedUserExtensions: []string{"permit-pty", "permit-user-rc"}},
+			SignArgs{CertificateType: UserCertificate, Options: []string{"no-pty"}},
+			[]string{"clear", "permit-user-rc"},
+			nil,
+		},
+		{
+			"github login",
+			ExtensionPolicy{AllowedUserExtensions: []string{"permit-pty"}, UserOptions: []string{"source-address=10.0.0.0/8"}},
+			SignArgs{CertificateType: UserCertificate, Options: []string{"extension:login@github.com=octocat"}},
+			[]string{"clear", "permit-pty", "source-address=10.0.0.0/8"},
+			[]string{"extension:login@github.com=octocat"},
+		},
+	}
+	for _, test := range tests {
+		options, stripped := test.policy.apply(test.args)
+		assert.Equal(t, test.options, options, test.name)
+		assert.Equal(t, test.stripped, stripped, test.name)
+	}
+}
+
+func TestServerSignPublicKeyWithExtensionPolicy(t *testing.T) {
+	_, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	server.Extensions = ExtensionPolicy{
+		UserOptions:           []string{"extension:team@example.com=infra"},
+		HostOptions:           []string{"critical:zone@example.com=eu"},
+		AllowedUserExtensions: []string{"permit-pty"},
+	}
+
+	var reply SignReply
+	err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: UserCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey, Options: []string{"permit-port-forwarding"}}, &reply)
+	assert.Nil(t, err)
+	assert.Nil(t, reply.Certificate.parse())
+	cert := reply.Certificate.key.(*ssh.Certificate)
+	assert.Equal(t, map[string]string{"permit-pty": "", "team@example.com": "infra"}, cert.Extensions)
+
+	err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}, &reply)
+	if err != nil {
+		// Older versions of ssh-keygen don't add options to host certificates
+		assert.Contains(t, err.Error(), "did not add critical:zone@example.com=eu")
+		return
+	}
+	assert.Nil(t, reply.Certificate.parse())
+	cert = reply.Certificate.key.(*ssh.Certificate)
+	assert.Contains(t, cert.CriticalOptions, "zone@example.com")
+}
@@ -0,0 +1,49 @@
+//go:build go1.18
+// +build go1.18
+
+package ca
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// FuzzPublicKeyParse checks that parsing and validating public keys from
+// clients never panics, and that the keys that parse are consistent.
+func FuzzPublicKeyParse(f *testing.F) {
+	seeds, err := filepath.Glob("testdata/*.pub")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range seeds {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatalf("failed to read seed %s: %s", path, err)
+		}
+		f.Add(contents)
+	}
+	f.Add([]byte("ssh-ed25519-cert-v01@openssh.com AAAA\n"))
+	f.Add([]byte("ssh-rsa AAAAC3NzaC1lZDI1NTE5AAAAIHwXYROIrAfv9RS4LyCPdsPGy6EqM+vncrrZXzVJbNuV\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		key := &PublicKey{Data: data}
+		key.validateSubmitted()
+		if err := key.parse(); err != nil {
+			return
+		}
+		key.Fingerprint()
+		key.Type()
+
+		reparsed, err := ssh.ParsePublicKey(key.key.Marshal())
+		if err != nil {
+			t.Fatalf("failed to parse marshalled key of %q: %s", data, err)
+		}
+		if !bytes.Equal(reparsed.Marshal(), key.key.Marshal()) {
+			t.Fatalf("marshalled key of %q changed when parsed again", data)
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package ca
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GroupPrefix marks a requested principal as the name of a group, which the
+// server expands to the principals of the group.
+const GroupPrefix = "@"
+
+// Groups maps group names (without GroupPrefix) to their principals, so that
+// the principals that clients get can be changed on the server without
+// changing how clients request them.
+type Groups map[string][]string
+
+// Validate checks that the groups can be expanded: groups can't be empty or
+// contain other groups.
+func (g Groups) Validate() error {
+	for name, principals := range g {
+		if name == "" || strings.HasPrefix(name, GroupPrefix) {
+			return fmt.Errorf("invalid group name %q", name)
+		}
+		if len(principals) == 0 {
+			return fmt.Errorf("group %s has no principals", name)
+		}
+		for _, principal := range principals {
+			if principal == "" || strings.HasPrefix(principal, GroupPrefix) {
+				return fmt.Errorf("group %s: invalid principal %q (groups can't contain groups)", name, principal)
+			}
+		}
+	}
+	return nil
+}
+
+// Expand replaces the groups in principals with their principals. Duplicates
+// are removed, keeping the first occurrence. Unknown groups are an error, so
+// that a typo doesn't issue a certificate for a literal "@name" principal.
+func (g Groups) Expand(principals []string) ([]string, error) {
+	expanded := make([]string, 0, len(principals))
+	seen := make(map[string]bool, len(principals))
+	add := func(principal string) {
+		if !seen[principal] {
+			seen[principal] = true
+			expanded = append(expanded, principal)
+		}
+	}
+	for _, principal := range principals {
+		if !strings.HasPrefix(principal, GroupPrefix) {
+			add(principal)
+			continue
+		}
+		members, ok := g[strings.TrimPrefix(principal, GroupPrefix)]
+		if !ok {
+			return nil, fmt.Errorf("unknown principal group %s", principal)
+		}
+		for _, member := range members {
+			add(member)
+		}
+	}
+	return expanded, nil
+}
+
+// requestedGroups returns the groups in the requested principals.
+func requestedGroups(principals []string) []string {
+	var groups []string
+	for _, principal := range principals {
+		if strings.HasPrefix(principal, GroupPrefix) {
+			groups = append(groups, principal)
+		}
+	}
+	return groups
+}
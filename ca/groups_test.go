@@ -0,0 +1,54 @@
+package ca
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGroupsExpand(t *testing.T) {
+	groups := Groups{"developers": {"alice", "bob"}, "ops": {"bob", "root"}}
+
+	expanded, err := groups.Expand([]string{"carol", "@developers", "@ops"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"carol", "alice", "bob", "root"}, expanded)
+
+	_, err = groups.Expand([]string{"@unknown"})
+	assert.EqualError(t, err, "unknown principal group @unknown")
+
+	// Without groups, principals are unchanged
+	expanded, err = Groups(nil).Expand([]string{"alice"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alice"}, expanded)
+}
+
+func TestGroupsValidate(t *testing.T) {
+	assert.Nil(t, Groups{"developers": {"alice"}}.Validate())
+	assert.Error(t, Groups{"developers": {}}.Validate())
+	assert.Error(t, Groups{"all": {"@developers"}}.Validate())
+	assert.Error(t, Groups{"@developers": {"alice"}}.Validate())
+}
+
+func TestSignPublicKeyExpandsGroups(t *testing.T) {
+	_, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	server.Groups = Groups{"developers": {"alice", "bob"}}
+
+	var reply SignReply
+	err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: UserCertificate, Principals: []string{"@developers", "carol"}, PublicKey: testPublicKey}, &reply)
+	assert.Nil(t, err)
+	key, _, _, _, err := ssh.ParseAuthorizedKey(reply.Certificate.Data)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alice", "bob", "carol"}, key.(*ssh.Certificate).ValidPrincipals)
+
+	reply = SignReply{}
+	err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: UserCertificate, Principals: []string{"@nobody"}, PublicKey: testPublicKey}, &reply)
+	assert.Error(t, err)
+	assert.Nil(t, reply.Certificate)
+}
@@ -0,0 +1,55 @@
+package ca
+
+import (
+	"net/rpc"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInProcessClient(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	client := NewInProcessClient(&server)
+
+	reply, err := client.GetCAPublicKey()
+	assert.Nil(t, err)
+	assert.Equal(t, testPublicKey.Data, reply.CAPublicKey.Data)
+	_, err = client.GetSignResult("unknown")
+	assert.Error(t, err)
+
+	assert.Nil(t, client.Close())
+	_, err = client.GetCAPublicKey()
+	assert.Equal(t, rpc.ErrShutdown, err)
+	assert.Equal(t, rpc.ErrShutdown, client.Close())
+}
+
+func TestInProcessClientTenant(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	tenant, err := server.NewTenant("team-a", "./testdata/ca", "")
+	assert.Nil(t, err)
+	client := NewInProcessClient(&server)
+	defer client.Close()
+
+	client.Service = TenantService("team-a")
+	reply, err := client.GetCAPublicKey()
+	assert.Nil(t, err)
+	assert.Equal(t, tenant.PublicKey.Data, reply.CAPublicKey.Data)
+
+	client.Service = TenantService("team-b")
+	_, err = client.GetCAPublicKey()
+	assert.Error(t, err)
+}
+
+func TestInProcessClientUnknownMethod(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	client := NewInProcessClient(&server)
+	defer client.Close()
+
+	err = client.Call(ServerName+".NewTenant", "a", new(Server))
+	assert.Contains(t, err.Error(), "rpc: can't find method")
+	err = client.Call(ServerName+"."+getCAPublicKeyEndpoint, struct{}{}, new(SignReply))
+	assert.Error(t, err)
+}
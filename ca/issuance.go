@@ -0,0 +1,118 @@
+package ca
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/ratorx/sshca/openssh"
+)
+
+// IssuanceNamespace is the ssh-keygen -Y namespace of the signatures of
+// issuance metadata, so they can't be confused with signatures for anything
+// else.
+const IssuanceNamespace = "sshca-issuance@ratorx.github.io"
+
+// SkippedApprover is the approver of requests that were signed without
+// confirmation (see Server.SkipConfirmation).
+const SkippedApprover = "none (confirmation skipped)"
+
+// Issuance is the metadata of how a certificate was issued, which is recorded
+// with it in the CertificateRegistry so that questions such as "who approved
+// this certificate?" can be answered later.
+type Issuance struct {
+	// SignedAt is the exact server time that the certificate was signed at.
+	SignedAt time.Time `json:"signed_at"`
+	// Backend is what signed the certificate, e.g. "ssh-keygen OpenSSH_8.4".
+	Backend string `json:"backend"`
+	// CAKey is the fingerprint of the CA key that signed the certificate.
+	CAKey string `json:"ca_key"`
+	// Tenant is the tenant of the CA, or empty for the default tenant.
+	Tenant string `json:"tenant,omitempty"`
+	// PolicyRules are the rules of the server policy that applied to the
+	// request, e.g. "user_validity: clamped to max 24h0m0s".
+	PolicyRules []string `json:"policy_rules,omitempty"`
+	// Approver is who confirmed the request (see Approval).
+	Approver string `json:"approver"`
+	// Signature is the armored ssh-keygen -Y signature of Message by the CA
+	// key, if the server signs issuance metadata. Without it, the metadata
+	// can be changed by anyone who can write the registry.
+	Signature string `json:"signature,omitempty"`
+}
+
+// Message is the data signed by the CA key for the certificate.
+func (i Issuance) Message(certificate string) []byte {
+	return []byte(fmt.Sprintf("sshca issuance\ncertificate: %s\nsigned-at: %s\nbackend: %s\nca-key: %s\ntenant: %s\npolicy-rules: %s\napprover: %s\n",
+		strings.TrimSpace(certificate), i.SignedAt.UTC().Format(time.RFC3339Nano), i.Backend, i.CAKey, i.Tenant, strings.Join(i.PolicyRules, "; "), i.Approver))
+}
+
+// Verify checks that the metadata of the certificate was signed by caKey.
+func (c IssuedCertificate) Verify(caKey *PublicKey) error {
+	if c.Issuance == nil {
+		return fmt.Errorf("certificate %d has no issuance metadata", c.Serial)
+	}
+	if c.Issuance.Signature == "" {
+		return fmt.Errorf("the issuance metadata of certificate %d is not signed", c.Serial)
+	}
+	if err := verifySSHSig(caKey, IssuanceNamespace, c.Issuance.Message(c.Certificate), []byte(c.Issuance.Signature)); err != nil {
+		return fmt.Errorf("invalid signature of the issuance metadata of certificate %d: %w", c.Serial, err)
+	}
+	return nil
+}
+
+// newIssuance returns the metadata of a certificate signed at now for args.
+func (ca *Server) newIssuance(args SignArgs, approval Approval, now time.Time) Issuance {
+	return Issuance{
+		SignedAt:    now,
+		Backend:     "ssh-keygen " + ca.SSHKeygen.Version.String(),
+		CAKey:       ca.PublicKey.Fingerprint(),
+		Tenant:      ca.Name,
+		PolicyRules: args.policyRules,
+		Approver:    approval.Approver,
+	}
+}
+
+// signIssuance signs the issuance metadata of certificate with the CA key,
+// if SignIssuances is set. ca.sshKeygenLock must be held.
+func (ca *Server) signIssuance(issuance *Issuance, certificate *PublicKey, tempDir *tempDir) error {
+	if !ca.SignIssuances {
+		return nil
+	}
+	if !ca.SSHKeygen.Version.Supports(openssh.SignData) {
+		return fmt.Errorf("%s does not support %s (needs %s)", ca.SSHKeygen.Version, openssh.SignData.Description, openssh.SignData.Since)
+	}
+	messagePath, err := tempDir.writeFile("issuance", issuance.Message(certificate.String()), 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write issuance metadata to disk: %w", err)
+	}
+	err = ca.SSHKeygen.run([]string{"-Y", "sign", "-f", ca.PrivateKeyPath, "-n", IssuanceNamespace, messagePath}, ca.Reporter)
+	if err != nil {
+		return err
+	}
+	ca.Reporter.Report("")
+	signature, err := ioutil.ReadFile(messagePath + ".sig")
+	if err != nil {
+		return fmt.Errorf("failed to read signature from disk: %w", err)
+	}
+	issuance.Signature = string(signature)
+	return nil
+}
+
+// validityRule describes how the validity policy applied to a request for
+// requested that was issued for issued.
+func validityRule(certType CertificateType, policy ValidityPolicy, requested time.Duration, issued time.Duration) string {
+	name := fmt.Sprintf("%s_validity", certType)
+	switch {
+	case requested == 0 && issued == 0:
+		return name + ": default (forever)"
+	case requested == 0:
+		return fmt.Sprintf("%s: default %s", name, issued)
+	case issued < requested:
+		return fmt.Sprintf("%s: clamped to max %s", name, policy.Max)
+	case policy.Max != 0:
+		return fmt.Sprintf("%s: requested %s within max %s", name, requested, policy.Max)
+	default:
+		return fmt.Sprintf("%s: requested %s (no max)", name, requested)
+	}
+}
@@ -0,0 +1,90 @@
+package ca
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newIssuanceTestServer(t *testing.T) Server {
+	t.Helper()
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server, err := NewServer("./testdata/ca", "", false)
+	assert.Nil(t, err)
+	server.SSHKeygen.NonInteractive = true
+	server.Reporter = &recordingReporter{}
+	server.Interactor = interactorFunc(func(description string) error { return nil })
+	server.UserValidity = ValidityPolicy{Max: time.Hour, Clamp: true}
+	server.Issued, err = LoadCertificateRegistry(filepath.Join(t.TempDir(), "certificates.json"))
+	assert.Nil(t, err)
+	return server
+}
+
+func TestServerRecordsIssuance(t *testing.T) {
+	server := newIssuanceTestServer(t)
+	server.Groups = Groups{"admins": {"alice", "root"}}
+	before := time.Now()
+	args := SignArgs{Identity: "alice", CertificateType: UserCertificate, Principals: []string{"@admins"}, PublicKey: testPublicKey, Validity: 2 * time.Hour}
+	var reply SignReply
+	assert.Nil(t, server.SignPublicKey(args, &reply))
+
+	issued, ok := server.Issued.Find(CheckStatusArgs{Serial: 1})
+	assert.True(t, ok)
+	if assert.NotNil(t, issued.Issuance) {
+		assert.Equal(t, "test", issued.Issuance.Approver)
+		assert.Equal(t, server.PublicKey.Fingerprint(), issued.Issuance.CAKey)
+		assert.Contains(t, issued.Issuance.Backend, "ssh-keygen")
+		assert.Equal(t, []string{"groups: expanded @admins", "user_validity: clamped to max 1h0m0s"}, issued.Issuance.PolicyRules)
+		assert.False(t, issued.Issuance.SignedAt.Before(before))
+		assert.Empty(t, issued.Issuance.Signature)
+	}
+	assert.Error(t, issued.Verify(server.PublicKey))
+}
+
+func TestServerRecordsSkippedApprover(t *testing.T) {
+	server := newIssuanceTestServer(t)
+	server.SkipConfirmation = true
+	args := SignArgs{Identity: "alice", CertificateType: UserCertificate, Principals: []string{"alice"}, PublicKey: testPublicKey}
+	var reply SignReply
+	assert.Nil(t, server.SignPublicKey(args, &reply))
+	issued, ok := server.Issued.Find(CheckStatusArgs{Serial: 1})
+	assert.True(t, ok)
+	assert.Equal(t, SkippedApprover, issued.Issuance.Approver)
+}
+
+func TestServerSignsIssuance(t *testing.T) {
+	server := newIssuanceTestServer(t)
+	server.SignIssuances = true
+	args := SignArgs{Identity: "alice", CertificateType: UserCertificate, Principals: []string{"alice"}, PublicKey: testPublicKey}
+	var reply SignReply
+	assert.Nil(t, server.SignPublicKey(args, &reply))
+
+	// The registry is reloaded to check that the signature survives it
+	registry, err := LoadCertificateRegistry(server.Issued.path)
+	assert.Nil(t, err)
+	issued, ok := registry.Find(CheckStatusArgs{Serial: 1})
+	assert.True(t, ok)
+	assert.NotEmpty(t, issued.Issuance.Signature)
+	assert.Nil(t, issued.Verify(server.PublicKey))
+
+	issued.Issuance.Approver = "terminal:mallory"
+	assert.Error(t, issued.Verify(server.PublicKey))
+}
+
+func TestIssuedCertificateVerifyWithoutIssuance(t *testing.T) {
+	assert.Error(t, IssuedCertificate{Serial: 1}.Verify(testPublicKey))
+}
+
+func TestValidityRule(t *testing.T) {
+	policy := ValidityPolicy{Max: time.Hour}
+	assert.Equal(t, "user_validity: default (forever)", validityRule(UserCertificate, ValidityPolicy{}, 0, 0))
+	assert.Equal(t, "host_validity: default 1h0m0s", validityRule(HostCertificate, policy, 0, time.Hour))
+	assert.Equal(t, "user_validity: clamped to max 1h0m0s", validityRule(UserCertificate, policy, 2*time.Hour, time.Hour))
+	assert.Equal(t, "user_validity: requested 30m0s within max 1h0m0s", validityRule(UserCertificate, policy, 30*time.Minute, 30*time.Minute))
+	assert.Equal(t, "user_validity: requested 30m0s (no max)", validityRule(UserCertificate, ValidityPolicy{}, 30*time.Minute, 30*time.Minute))
+}
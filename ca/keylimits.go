@@ -0,0 +1,84 @@
+package ca
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"unicode"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// MaxPublicKeySize is the largest public key (in the file representation) that
+// clients can submit. It fits a 16384 bit RSA key with a long comment.
+const MaxPublicKeySize = 8 * 1024
+
+// acceptedKeyTypes are the key types that clients can submit. Certificates and
+// unknown types are rejected before they reach ssh-keygen. The algorithm
+// policy can restrict them further.
+var acceptedKeyTypes = []string{
+	ssh.KeyAlgoRSA,
+	ssh.KeyAlgoDSA,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoSKECDSA256,
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoSKED25519,
+}
+
+// KeyValidationError is returned for submitted public keys that don't meet the
+// limits on their size and format.
+type KeyValidationError struct {
+	Reason string
+}
+
+func (e *KeyValidationError) Error() string {
+	return "invalid public key: " + e.Reason
+}
+
+func invalidKey(format string, args ...interface{}) error {
+	return &KeyValidationError{fmt.Sprintf(format, args...)}
+}
+
+// validateSubmitted checks a public key sent by a client before it is parsed,
+// written to disk or passed to ssh-keygen. The key must be a single line of
+// "type base64 [comment]" no larger than MaxPublicKeySize, with an accepted
+// type that matches the encoded key.
+func (p *PublicKey) validateSubmitted() error {
+	if p == nil || len(p.Data) == 0 {
+		return invalidKey("no key")
+	}
+	if len(p.Data) > MaxPublicKeySize {
+		return invalidKey("%d bytes exceeds the maximum of %d", len(p.Data), MaxPublicKeySize)
+	}
+
+	line := bytes.TrimSuffix(bytes.TrimSuffix(p.Data, []byte("\n")), []byte("\r"))
+	for _, r := range string(line) {
+		if r == unicode.ReplacementChar || (unicode.IsControl(r) && r != '\t') {
+			return invalidKey("must be a single line of printable text")
+		}
+	}
+
+	fields := bytes.Fields(line)
+	if len(fields) < 2 {
+		return invalidKey("must be a key type followed by the base64 encoded key")
+	}
+	keyType := string(fields[0])
+	if !contains(acceptedKeyTypes, keyType) {
+		return invalidKey("key type %q is not accepted", keyType)
+	}
+	blob, err := base64.StdEncoding.DecodeString(string(fields[1]))
+	if err != nil {
+		return invalidKey("invalid base64: %s", err)
+	}
+	// The encoded key starts with its type as an SSH string
+	if len(blob) < 4 || uint64(binary.BigEndian.Uint32(blob)) > uint64(len(blob)-4) {
+		return invalidKey("encoded key is truncated")
+	}
+	if encodedType := string(blob[4 : 4+binary.BigEndian.Uint32(blob)]); encodedType != keyType {
+		return invalidKey("encoded key is a %q key, not %s", encodedType, keyType)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package ca
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSubmitted(t *testing.T) {
+	// ssh-ed25519 blob of the test key, labelled as an RSA key
+	mislabelled := strings.Replace(testPublicKeyString, "ssh-ed25519", "ssh-rsa", 1)
+
+	tests := []struct {
+		name   string
+		key    *PublicKey
+		reason string
+	}{
+		{"valid", &PublicKey{Data: testPublicKeyContents}, ""},
+		{"valid without newline", &PublicKey{Data: []byte(strings.TrimSpace(testPublicKeyString))}, ""},
+		{"valid with CRLF", &PublicKey{Data: []byte(strings.TrimSpace(testPublicKeyString) + "\r\n")}, ""},
+		{"nil", nil, "no key"},
+		{"empty", &PublicKey{}, "no key"},
+		{"oversized", &PublicKey{Data: []byte(testPublicKeyString + strings.Repeat("a", MaxPublicKeySize))}, "bytes exceeds the maximum"},
+		{"multiple lines", &PublicKey{Data: []byte(testPublicKeyString + testPublicKeyString)}, "single line"},
+		{"control character", &PublicKey{Data: []byte("ssh-ed25519 AAAA \x1b[2K\n")}, "single line"},
+		{"invalid UTF-8", &PublicKey{Data: []byte("ssh-ed25519 AAAA \xff\n")}, "single line"},
+		{"no key data", &PublicKey{Data: []byte("ssh-ed25519\n")}, "key type followed by"},
+		{"certificate", &PublicKey{Data: []byte("ssh-ed25519-cert-v01@openssh.com AAAA\n")}, "is not accepted"},
+		{"unknown type", &PublicKey{Data: []byte("ssh-foo AAAA\n")}, "is not accepted"},
+		{"invalid base64", &PublicKey{Data: []byte("ssh-ed25519 !!!!\n")}, "invalid base64"},
+		{"truncated", &PublicKey{Data: []byte("ssh-ed25519 AAAAC3Nz\n")}, "truncated"},
+		{"mismatched type", &PublicKey{Data: []byte(mislabelled)}, `"ssh-ed25519" key, not ssh-rsa`},
+	}
+
+	for _, test := range tests {
+		err := test.key.validateSubmitted()
+		if test.reason == "" {
+			assert.Nil(t, err, test.name)
+			continue
+		}
+		var validationErr *KeyValidationError
+		if assert.True(t, errors.As(err, &validationErr), test.name) {
+			assert.Contains(t, validationErr.Reason, test.reason, test.name)
+		}
+	}
+}
+
+func TestSignPublicKeyRejectsInvalidKey(t *testing.T) {
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	var reply SignReply
+	err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: UserCertificate, Principals: []string{"asdf"}, PublicKey: &PublicKey{Data: []byte("ssh-ed25519 AAAA\nssh-ed25519 AAAA\n")}}, &reply)
+
+	var validationErr *KeyValidationError
+	assert.True(t, errors.As(err, &validationErr))
+	assert.Nil(t, reply.Certificate)
+}
@@ -0,0 +1,55 @@
+package ca
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// KRLArgs represents the arguments to GetKRL.
+type KRLArgs struct {
+	// ETag is the KRLETag of the KRL that the client already has, if any.
+	ETag string
+}
+
+// KRLReply represents the reply from GetKRL.
+type KRLReply struct {
+	// ETag identifies the current KRL.
+	ETag string
+	// NotModified is true if the client already has the current KRL, in which
+	// case KRL is empty.
+	NotModified bool
+	// KRL is the key revocation list, in a format accepted by the sshd
+	// RevokedKeys option.
+	KRL []byte
+}
+
+// KRLETag identifies the contents of a KRL, so that clients can avoid
+// downloading a KRL that they already have.
+func KRLETag(krl []byte) string {
+	sum := sha256.Sum256(krl)
+	return hex.EncodeToString(sum[:])
+}
+
+// GetKRL returns the key revocation list of the CA. The file at KRLPath is
+// read on every call, so it can be updated (e.g. with ssh-keygen -k) without
+// restarting the server.
+func (ca *Server) GetKRL(args KRLArgs, reply *KRLReply) error {
+	if ca.KRLPath == "" {
+		return errors.New("the server doesn't publish a KRL")
+	}
+	krl, err := ioutil.ReadFile(ca.KRLPath)
+	if err != nil {
+		return fmt.Errorf("failed to read KRL: %w", err)
+	}
+
+	reply.ETag = KRLETag(krl)
+	if args.ETag == reply.ETag {
+		reply.NotModified = true
+		return nil
+	}
+	reply.KRL = krl
+	return nil
+}
@@ -0,0 +1,40 @@
+package ca
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerGetKRL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "krl")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("revoked"), 0o644))
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	server.KRLPath = path
+
+	var reply KRLReply
+	assert.Nil(t, server.GetKRL(KRLArgs{}, &reply))
+	assert.Equal(t, []byte("revoked"), reply.KRL)
+	assert.Equal(t, KRLETag([]byte("revoked")), reply.ETag)
+	assert.False(t, reply.NotModified)
+
+	var notModified KRLReply
+	assert.Nil(t, server.GetKRL(KRLArgs{ETag: reply.ETag}, &notModified))
+	assert.True(t, notModified.NotModified)
+	assert.Empty(t, notModified.KRL)
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("revoked more"), 0o644))
+	var updated KRLReply
+	assert.Nil(t, server.GetKRL(KRLArgs{ETag: reply.ETag}, &updated))
+	assert.Equal(t, []byte("revoked more"), updated.KRL)
+}
+
+func TestServerGetKRLDisabled(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	var reply KRLReply
+	assert.Error(t, server.GetKRL(KRLArgs{}, &reply))
+}
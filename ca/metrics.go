@@ -0,0 +1,141 @@
+package ca
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueueStats describes the signing requests waiting for confirmation or
+// signing.
+type QueueStats struct {
+	// Depth is the number of requests that haven't finished.
+	Depth int
+	// OldestAge is how long the oldest unfinished request has been waiting.
+	OldestAge time.Duration
+	// Signed and Failed count the finished requests since the server started.
+	Signed uint64
+	Failed uint64
+}
+
+// SlowRequest describes a request that has been waiting longer than the
+// alert threshold.
+type SlowRequest struct {
+	Description string
+	Waiting     time.Duration
+}
+
+type trackedRequest struct {
+	description string
+	started     time.Time
+	alerted     bool
+}
+
+// requestTracker records the signing requests that are in progress.
+type requestTracker struct {
+	mu       sync.Mutex
+	next     uint64
+	requests map[uint64]*trackedRequest
+	signed   uint64
+	failed   uint64
+}
+
+func newRequestTracker() *requestTracker {
+	return &requestTracker{requests: make(map[uint64]*trackedRequest)}
+}
+
+// start records a new request and returns an ID to pass to finish. It doesn't
+// use SignArgs.String, because the public key hasn't been validated yet.
+func (t *requestTracker) start(args SignArgs, now time.Time) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := t.next
+	t.next++
+	t.requests[id] = &trackedRequest{
+		description: fmt.Sprintf("%s certificate %q for %s", args.CertificateType, args.Identity, strings.Join(args.Principals, ",")),
+		started:     now,
+	}
+	return id
+}
+
+// finish records the outcome of a request.
+func (t *requestTracker) finish(id uint64, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.requests, id)
+	if err != nil {
+		t.failed++
+	} else {
+		t.signed++
+	}
+}
+
+func (t *requestTracker) stats(now time.Time) QueueStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := QueueStats{Depth: len(t.requests), Signed: t.signed, Failed: t.failed}
+	for _, request := range t.requests {
+		if age := now.Sub(request.started); age > stats.OldestAge {
+			stats.OldestAge = age
+		}
+	}
+	return stats
+}
+
+// slow returns the requests that have been waiting longer than threshold and
+// haven't been returned by a previous call.
+func (t *requestTracker) slow(threshold time.Duration, now time.Time) []SlowRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var ret []SlowRequest
+	for _, request := range t.requests {
+		waiting := now.Sub(request.started)
+		if !request.alerted && waiting > threshold {
+			request.alerted = true
+			ret = append(ret, SlowRequest{request.description, waiting})
+		}
+	}
+	return ret
+}
+
+// QueueStats returns the current state of the signing queue.
+func (ca Server) QueueStats() QueueStats {
+	return ca.tracker.stats(time.Now())
+}
+
+// WatchSlowRequests calls alert once for each request that waits longer than
+// threshold. The queue is checked every interval until stop is closed.
+func (ca Server) WatchSlowRequests(threshold, interval time.Duration, alert func(SlowRequest), stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, request := range ca.tracker.slow(threshold, now) {
+				alert(request)
+			}
+		}
+	}
+}
+
+// MetricsHandler serves the queue stats in the Prometheus text format.
+func (ca Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := ca.QueueStats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintf(w, "# HELP sshca_queue_depth Signing requests waiting for confirmation or signing.\n")
+		fmt.Fprintf(w, "# TYPE sshca_queue_depth gauge\n")
+		fmt.Fprintf(w, "sshca_queue_depth %d\n", stats.Depth)
+		fmt.Fprintf(w, "# HELP sshca_queue_oldest_age_seconds Age of the oldest waiting signing request.\n")
+		fmt.Fprintf(w, "# TYPE sshca_queue_oldest_age_seconds gauge\n")
+		fmt.Fprintf(w, "sshca_queue_oldest_age_seconds %g\n", stats.OldestAge.Seconds())
+		fmt.Fprintf(w, "# HELP sshca_requests_total Finished signing requests by result.\n")
+		fmt.Fprintf(w, "# TYPE sshca_requests_total counter\n")
+		fmt.Fprintf(w, "sshca_requests_total{result=\"signed\"} %d\n", stats.Signed)
+		fmt.Fprintf(w, "sshca_requests_total{result=\"failed\"} %d\n", stats.Failed)
+	})
+}
@@ -0,0 +1,71 @@
+package ca
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testTrackedArgs = SignArgs{Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"a", "b"}}
+
+func TestRequestTrackerStats(t *testing.T) {
+	tracker := newRequestTracker()
+	start := time.Now()
+	first := tracker.start(testTrackedArgs, start)
+	tracker.start(testTrackedArgs, start.Add(time.Minute))
+	stats := tracker.stats(start.Add(2 * time.Minute))
+	assert.Equal(t, QueueStats{Depth: 2, OldestAge: 2 * time.Minute}, stats)
+
+	tracker.finish(first, nil)
+	stats = tracker.stats(start.Add(2 * time.Minute))
+	assert.Equal(t, QueueStats{Depth: 1, OldestAge: time.Minute, Signed: 1}, stats)
+}
+
+func TestRequestTrackerCountsFailures(t *testing.T) {
+	tracker := newRequestTracker()
+	tracker.finish(tracker.start(testTrackedArgs, time.Now()), assert.AnError)
+	assert.Equal(t, QueueStats{Failed: 1}, tracker.stats(time.Now()))
+}
+
+func TestRequestTrackerSlow(t *testing.T) {
+	tracker := newRequestTracker()
+	start := time.Now()
+	tracker.start(testTrackedArgs, start)
+	assert.Empty(t, tracker.slow(time.Minute, start.Add(30*time.Second)))
+
+	slow := tracker.slow(time.Minute, start.Add(2*time.Minute))
+	assert.Equal(t, []SlowRequest{{`host certificate "asdf" for a,b`, 2 * time.Minute}}, slow)
+	// Each request is only reported once
+	assert.Empty(t, tracker.slow(time.Minute, start.Add(3*time.Minute)))
+}
+
+func TestServerMetricsHandler(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	server.tracker.start(testTrackedArgs, time.Now())
+
+	recorder := httptest.NewRecorder()
+	server.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, recorder.Body.String(), "sshca_queue_depth 1\n")
+	assert.Contains(t, recorder.Body.String(), "sshca_requests_total{result=\"signed\"} 0\n")
+}
+
+func TestServerWatchSlowRequests(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	server.tracker.start(testTrackedArgs, time.Now().Add(-time.Hour))
+
+	alerts := make(chan SlowRequest, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go server.WatchSlowRequests(time.Minute, time.Millisecond, func(r SlowRequest) { alerts <- r }, stop)
+
+	select {
+	case alert := <-alerts:
+		assert.Equal(t, `host certificate "asdf" for a,b`, alert.Description)
+	case <-time.After(time.Second):
+		t.Error("expected an alert for the slow request")
+	}
+}
@@ -0,0 +1,97 @@
+package ca
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Certificate options are passed to ssh-keygen -O. Clients can only request
+// options that restrict what a user certificate allows, because the default
+// (without any options) already grants everything.
+
+// userExtensions are the extensions that a user certificate can be limited to
+// with "clear" followed by the ones to keep.
+var userExtensions = []string{
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+// restrictingOptions are the critical options that take a value.
+var restrictingOptions = []string{"force-command", "source-address"}
+
+// GitHubLoginExtension is the extension that GitHub uses to find the account
+// that a user certificate is for.
+const GitHubLoginExtension = "login@github.com"
+
+// githubLoginPrefix is the ssh-keygen -O prefix of the GitHub login extension.
+const githubLoginPrefix = "extension:" + GitHubLoginExtension + "="
+
+var githubUsernameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]{0,38}$`)
+
+// GitHubLoginOption returns the option that sets the GitHub account of a user
+// certificate.
+func GitHubLoginOption(username string) (string, error) {
+	if !githubUsernameRegexp.MatchString(username) {
+		return "", fmt.Errorf("invalid GitHub username %q", username)
+	}
+	return githubLoginPrefix + username, nil
+}
+
+// checkOption checks that option can be requested by a client.
+func checkOption(option string) error {
+	if strings.ContainsAny(option, "\n\x00") {
+		return fmt.Errorf("invalid certificate option %q", option)
+	}
+	if option == "clear" || option == "verify-required" {
+		return nil
+	}
+	for _, extension := range userExtensions {
+		if option == extension || option == "no-"+strings.TrimPrefix(extension, "permit-") {
+			return nil
+		}
+	}
+	if strings.HasPrefix(option, githubLoginPrefix) && githubUsernameRegexp.MatchString(strings.TrimPrefix(option, githubLoginPrefix)) {
+		// The extension identifies the GitHub account, which the operator
+		// sees in the request
+		return nil
+	}
+	for _, name := range restrictingOptions {
+		if strings.HasPrefix(option, name+"=") && len(option) > len(name)+1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate option %q is not allowed", option)
+}
+
+// checkOptions checks the certificate options of a signing request.
+func (args SignArgs) checkOptions() error {
+	if len(args.Options) == 0 {
+		return nil
+	}
+	if args.CertificateType == HostCertificate {
+		return fmt.Errorf("certificate options are only supported for user certificates")
+	}
+	for _, option := range args.Options {
+		if err := checkOption(option); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExtensionOptions converts a list of extensions (e.g. permit-pty) to the
+// options that limit a user certificate to them.
+func ExtensionOptions(extensions []string) ([]string, error) {
+	options := []string{"clear"}
+	for _, extension := range extensions {
+		if !strings.HasPrefix(extension, "permit-") || checkOption(extension) != nil {
+			return nil, fmt.Errorf("unknown extension %q (must be one of %s)", extension, strings.Join(userExtensions, ", "))
+		}
+		options = append(options, extension)
+	}
+	return options, nil
+}
@@ -0,0 +1,56 @@
+package ca
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckOption(t *testing.T) {
+	for _, option := range []string{"clear", "permit-pty", "no-pty", "no-X11-forwarding", "verify-required", "force-command=/bin/true", "source-address=10.0.0.0/8", "extension:login@github.com=octo-cat"} {
+		assert.Nil(t, checkOption(option), option)
+	}
+	for _, option := range []string{"", "no-touch-required", "extension:foo", "critical:foo=bar", "force-command=", "permit-everything", "force-command=a\nb", "extension:login@github.com=", "extension:login@github.com=a b"} {
+		assert.Error(t, checkOption(option), option)
+	}
+}
+
+func TestGitHubLoginOption(t *testing.T) {
+	option, err := GitHubLoginOption("octocat")
+	assert.Nil(t, err)
+	assert.Equal(t, "extension:login@github.com=octocat", option)
+	_, err = GitHubLoginOption("-octocat")
+	assert.Error(t, err)
+}
+
+func TestSignArgsCheckOptions(t *testing.T) {
+	args := SignArgs{CertificateType: UserCertificate, Options: []string{"clear", "permit-pty"}}
+	assert.Nil(t, args.checkOptions())
+	args.CertificateType = HostCertificate
+	assert.Error(t, args.checkOptions())
+	args.Options = nil
+	assert.Nil(t, args.checkOptions())
+}
+
+func TestSignArgsToArgsWithOptions(t *testing.T) {
+	sa := SignArgs{
+		Identity:        "example",
+		CertificateType: UserCertificate,
+		Principals:      []string{"asdf"},
+		PublicKey:       testPublicKey,
+		Options:         []string{"clear", "force-command=/bin/true"},
+	}
+	assert.Equal(t, []string{"-I", "example", "-n", "asdf", "-O", "clear", "-O", "force-command=/bin/true"}, sa.Args())
+	assert.Equal(t, "make user certficate for ssh-ed25519 key (fingerprint SHA256:nbtA2MPjSSVod4bmKFSZ60I2DOnD0AHXXnbsL5TTPt8) for asdf with options clear force-command=/bin/true", sa.String())
+}
+
+func TestExtensionOptions(t *testing.T) {
+	options, err := ExtensionOptions([]string{"permit-pty"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"clear", "permit-pty"}, options)
+	options, err = ExtensionOptions(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"clear"}, options)
+	_, err = ExtensionOptions([]string{"no-pty"})
+	assert.Error(t, err)
+}
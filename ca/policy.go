@@ -0,0 +1,88 @@
+package ca
+
+import "time"
+
+// Policy is the part of the configuration of a Server that decides which
+// requests are signed and what the issued certificates contain.
+type Policy struct {
+	// algorithms restricts the keys that are signed. It is set with
+	// SetAlgorithmPolicy.
+	algorithms AlgorithmPolicy
+	// signatureAlgorithm is passed to ssh-keygen -t if it is set.
+	signatureAlgorithm string
+	// UserValidity and HostValidity control the validity of issued user and
+	// host certificates.
+	UserValidity ValidityPolicy
+	HostValidity ValidityPolicy
+	// Backdate starts the validity of certificates this long before they are
+	// signed, so that machines with slightly slow clocks accept them. It is
+	// capped at MaxBackdate.
+	Backdate time.Duration
+	// HostDNS optionally checks host principals against the DNS.
+	HostDNS HostDNSPolicy
+	// RequireProof controls which requests must prove possession of the
+	// private key.
+	RequireProof ProofPolicy
+	// Principals controls which certificates can have wildcard principals.
+	Principals PrincipalPolicy
+	// Extensions adds critical options and extensions to certificates, and
+	// strips the extensions that clients aren't allowed.
+	Extensions ExtensionPolicy
+	// Groups are expanded in the requested principals. See GroupPrefix.
+	Groups Groups
+	// TOTP optionally requires requests to carry TOTP codes.
+	TOTP TOTPPolicy
+	// Quorum requires several approvals for sensitive requests.
+	Quorum QuorumPolicy
+	// BreakGlass lets emergency requests bypass the policy above.
+	BreakGlass BreakGlassPolicy
+}
+
+// withCurrentPolicy returns a copy of the server with a snapshot of its
+// policy, so that a request is handled under a single policy even if it is
+// reloaded meanwhile.
+func (ca *Server) withCurrentPolicy() *Server {
+	ca.policyLock.RLock()
+	policy := *ca.Policy
+	ca.policyLock.RUnlock()
+
+	snapshot := *ca
+	snapshot.Policy = &policy
+	return &snapshot
+}
+
+// Reload replaces the policy of a running server, restricting the algorithms
+// to algorithms (see SetAlgorithmPolicy). Requests that have already arrived
+// keep the policy they started with, and the policy is left unchanged if the
+// CA key can't be used under algorithms.
+func (ca *Server) Reload(policy Policy, algorithms AlgorithmPolicy) error {
+	prepared, err := ca.PreparePolicy(policy, algorithms)
+	if err != nil {
+		return err
+	}
+	ca.SetPolicy(prepared)
+	return nil
+}
+
+// PreparePolicy returns policy with the algorithms restricted to algorithms,
+// to be passed to SetPolicy, or an error if the CA key can't be used under
+// them. It lets the policies of several servers (e.g. a server and its
+// tenants) be checked before any of them is replaced.
+func (ca *Server) PreparePolicy(policy Policy, algorithms AlgorithmPolicy) (Policy, error) {
+	signatureAlgorithm, err := algorithms.caSignatureAlgorithm(ca.PublicKey, ca.SSHKeygen.Version)
+	if err != nil {
+		return Policy{}, err
+	}
+	policy.algorithms = algorithms
+	policy.signatureAlgorithm = signatureAlgorithm
+	return policy, nil
+}
+
+// SetPolicy replaces the policy of a running server with one returned by
+// PreparePolicy. Requests that have already arrived keep the policy they
+// started with.
+func (ca *Server) SetPolicy(policy Policy) {
+	ca.policyLock.Lock()
+	defer ca.policyLock.Unlock()
+	*ca.Policy = policy
+}
@@ -0,0 +1,49 @@
+package ca
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerReload(t *testing.T) {
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	server.UserValidity = ValidityPolicy{Max: time.Hour}
+	before := server.withCurrentPolicy()
+
+	assert.Nil(t, server.Reload(Policy{UserValidity: ValidityPolicy{Max: 2 * time.Hour}, Groups: Groups{"admins": {"root"}}}, FIPSAlgorithmPolicy))
+	assert.Equal(t, 2*time.Hour, server.UserValidity.Max)
+	assert.Equal(t, Groups{"admins": {"root"}}, server.Groups)
+	assert.Equal(t, "rsa-sha2-512", server.signatureAlgorithm)
+	assert.Equal(t, time.Hour, before.UserValidity.Max, "snapshots keep the policy they were taken with")
+}
+
+func TestServerReloadWithDisallowedCAKey(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	server.UserValidity = ValidityPolicy{Max: time.Hour}
+
+	assert.Error(t, server.Reload(Policy{}, FIPSAlgorithmPolicy))
+	assert.Equal(t, time.Hour, server.UserValidity.Max)
+}
+
+func TestServerPreparePolicy(t *testing.T) {
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	server.UserValidity = ValidityPolicy{Max: time.Hour}
+
+	policy, err := server.PreparePolicy(Policy{UserValidity: ValidityPolicy{Max: 2 * time.Hour}}, FIPSAlgorithmPolicy)
+	assert.Nil(t, err)
+	assert.Equal(t, "rsa-sha2-512", policy.signatureAlgorithm)
+	assert.Equal(t, time.Hour, server.UserValidity.Max, "the policy is only replaced by SetPolicy")
+	server.SetPolicy(policy)
+	assert.Equal(t, 2*time.Hour, server.UserValidity.Max)
+	assert.Equal(t, "rsa-sha2-512", server.signatureAlgorithm)
+
+	tenant, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	_, err = tenant.PreparePolicy(Policy{}, FIPSAlgorithmPolicy)
+	assert.Error(t, err)
+}
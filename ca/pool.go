@@ -0,0 +1,126 @@
+package ca
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHealthCheckInterval is how long a pooled connection can be idle
+// before it is checked again.
+const DefaultHealthCheckInterval = 30 * time.Second
+
+// Pool shares one connection to a server between many requests (e.g. the
+// renewals of a long-running agent), instead of connecting for each of them.
+// The connection is made when it is first needed, checked before it is reused
+// after being idle, and replaced if it breaks.
+type Pool struct {
+	// Dial connects to the server, e.g. with Dial and the version checks of
+	// the command.
+	Dial func() (*Client, error)
+	// HealthCheckInterval is how long the connection can be idle before it
+	// is checked with a Version call. Zero means DefaultHealthCheckInterval.
+	HealthCheckInterval time.Duration
+
+	mu       sync.Mutex
+	client   *Client
+	lastUsed time.Time
+	// now is time.Now, replaced in tests.
+	now func() time.Time
+}
+
+// NewPool creates a pool that connects with dial.
+func NewPool(dial func() (*Client, error)) *Pool {
+	return &Pool{Dial: dial}
+}
+
+// clock returns the current time.
+func (p *Pool) clock() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// healthy checks that the server still answers on the connection. Servers
+// without the Version RPC still answer with an error.
+func healthy(client *Client) bool {
+	_, err := client.Version()
+	return err == nil || strings.Contains(err.Error(), "rpc: can't find method")
+}
+
+// Get returns the shared client, connecting if there is no healthy
+// connection. The client must not be closed; use Release if it breaks.
+func (p *Pool) Get() (*Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	interval := p.HealthCheckInterval
+	if interval == 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	if p.client != nil && p.clock().Sub(p.lastUsed) > interval && !healthy(p.client) {
+		p.client.Close()
+		p.client = nil
+	}
+	if p.client == nil {
+		client, err := p.Dial()
+		if err != nil {
+			return nil, err
+		}
+		p.client = client
+	}
+	p.lastUsed = p.clock()
+	return p.client, nil
+}
+
+// Release closes the shared client if it is client, so the next Get
+// reconnects. It is called when a request fails because of the connection.
+func (p *Pool) Release(client *Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == client && client != nil {
+		p.client.Close()
+		p.client = nil
+	}
+}
+
+// Do calls f with the shared client. If f fails because the connection broke,
+// the connection is replaced for the next call, but f isn't retried, since
+// requests (e.g. signing) aren't idempotent.
+func (p *Pool) Do(f func(client *Client) error) error {
+	client, err := p.Get()
+	if err != nil {
+		return err
+	}
+	err = f(client)
+	if IsConnectionError(err) {
+		p.Release(client)
+	}
+	return err
+}
+
+// Close closes the shared client, if there is one.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == nil {
+		return nil
+	}
+	err := p.client.Close()
+	p.client = nil
+	return err
+}
+
+// IsConnectionError returns whether err is caused by the connection to the
+// server, rather than being an error from the server.
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
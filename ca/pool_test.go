@@ -0,0 +1,88 @@
+package ca
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingDial dials addr and counts the connections.
+func countingDial(addr string, dials *int) func() (*Client, error) {
+	return func() (*Client, error) {
+		*dials++
+		return Dial([]string{addr}, time.Second)
+	}
+}
+
+func TestPoolReusesConnection(t *testing.T) {
+	addr := startTestServer(t)
+	dials := 0
+	pool := NewPool(countingDial(addr, &dials))
+	defer pool.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, pool.Do(func(client *Client) error {
+			_, err := client.GetCAPublicKey()
+			return err
+		}))
+	}
+	assert.Equal(t, 1, dials)
+}
+
+func TestPoolReplacesBrokenConnection(t *testing.T) {
+	addr := startTestServer(t)
+	dials := 0
+	pool := NewPool(countingDial(addr, &dials))
+	defer pool.Close()
+
+	err := pool.Do(func(client *Client) error { return io.ErrUnexpectedEOF })
+	assert.Error(t, err)
+	// Errors from the server keep the connection
+	assert.Error(t, pool.Do(func(client *Client) error {
+		_, err := client.GetSignResult("unknown")
+		return err
+	}))
+	_, err = pool.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, dials)
+}
+
+func TestPoolChecksIdleConnection(t *testing.T) {
+	addr := startTestServer(t)
+	dials := 0
+	now := time.Now()
+	pool := NewPool(countingDial(addr, &dials))
+	pool.now = func() time.Time { return now }
+	defer pool.Close()
+
+	client, err := pool.Get()
+	assert.Nil(t, err)
+	now = now.Add(time.Minute)
+	again, err := pool.Get()
+	assert.Nil(t, err)
+	assert.True(t, client == again)
+
+	// The server closed the connection while it was idle
+	client.Close()
+	now = now.Add(time.Minute)
+	replaced, err := pool.Get()
+	assert.Nil(t, err)
+	assert.False(t, client == replaced)
+	assert.Equal(t, 2, dials)
+}
+
+func TestPoolDialError(t *testing.T) {
+	pool := NewPool(func() (*Client, error) { return nil, errors.New("unreachable") })
+	assert.Error(t, pool.Do(func(client *Client) error { return nil }))
+	assert.Nil(t, pool.Close())
+}
+
+func TestIsConnectionError(t *testing.T) {
+	assert.False(t, IsConnectionError(nil))
+	assert.False(t, IsConnectionError(errors.New("denied")))
+	assert.True(t, IsConnectionError(io.EOF))
+	assert.True(t, IsConnectionError(io.ErrUnexpectedEOF))
+}
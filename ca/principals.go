@@ -0,0 +1,207 @@
+package ca
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// wildcardCharacters make a principal a pattern. OpenSSH matches host
+// certificate principals as patterns, so *.example.com is valid for every host
+// in the domain, while user certificate principals are compared literally.
+const wildcardCharacters = "*?"
+
+// ValidatePrincipal returns an error if principal can't be passed to
+// ssh-keygen -n or would be misread by sshd, whatever the policy of the
+// server. Clients use it to reject such principals before sending them.
+func ValidatePrincipal(principal string) error {
+	if principal == "" {
+		return fmt.Errorf("principals can't be empty")
+	}
+	if strings.Contains(principal, ",") {
+		// ssh-keygen -n takes a comma-separated list
+		return fmt.Errorf("a principal can't contain a comma, which would split it into several principals")
+	}
+	if err := checkArgValue(principal); err != nil {
+		return fmt.Errorf("principals %w", err)
+	}
+	if strings.Contains(principal, "!") {
+		return fmt.Errorf("principals can't contain '!', which negates patterns")
+	}
+	return nil
+}
+
+// MaxIdentityLength is the longest certificate identity (key ID) that the
+// server issues.
+const MaxIdentityLength = 256
+
+// ValidateIdentity returns an error if identity can't be used as the
+// certificate identity (ssh-keygen -I), which sshd logs for every login.
+func ValidateIdentity(identity string) error {
+	if identity == "" {
+		return fmt.Errorf("the certificate identity can't be empty")
+	}
+	if len(identity) > MaxIdentityLength {
+		return fmt.Errorf("the certificate identity is longer than %d bytes", MaxIdentityLength)
+	}
+	if err := checkArgValue(identity); err != nil {
+		return fmt.Errorf("the certificate identity %w", err)
+	}
+	return nil
+}
+
+// checkArgValue returns an error if value could be mistaken for an option or
+// change the meaning of the ssh-keygen arguments or logs it ends up in. The
+// error completes a sentence about the value.
+func checkArgValue(value string) error {
+	if strings.HasPrefix(value, "-") {
+		return fmt.Errorf("can't start with '-'")
+	}
+	for _, r := range value {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return fmt.Errorf("can't contain whitespace or control characters")
+		}
+	}
+	return nil
+}
+
+// PrincipalPolicy controls which certificates can have wildcard principals,
+// and which principals can never be issued. Principals that would corrupt the
+// ssh-keygen arguments or be misread by sshd are always rejected.
+type PrincipalPolicy struct {
+	HostWildcards bool
+	UserWildcards bool
+	// Denied are the principals that are never issued, whatever the rest of
+	// the policy, the approvers or a break-glass request say. They can be
+	// patterns with * and ? (e.g. admin-*), and also deny wildcard principals
+	// that would be valid for them. A wildcard principal and a denied pattern
+	// are only known not to overlap if their fixed starts or ends differ, so
+	// e.g. *-prod is denied by admin-* (because of admin-prod), but so is
+	// *-prod-? by *-prod-1?, which it doesn't overlap.
+	Denied []string
+}
+
+// Validate checks that the denied principals are valid principals or
+// patterns.
+func (p PrincipalPolicy) Validate() error {
+	for _, denied := range p.Denied {
+		if err := ValidatePrincipal(denied); err != nil {
+			return fmt.Errorf("invalid denied principal %q: %w", denied, err)
+		}
+	}
+	return nil
+}
+
+// wildcardsAllowed reports whether certificates of certType can have
+// wildcard principals.
+func (p PrincipalPolicy) wildcardsAllowed(certType CertificateType) bool {
+	if certType == HostCertificate {
+		return p.HostWildcards
+	}
+	return p.UserWildcards
+}
+
+// Check returns an error if principals can't be issued for a certificate of
+// certType.
+func (p PrincipalPolicy) Check(certType CertificateType, principals []string) error {
+	if len(principals) == 0 {
+		// ssh-keygen would issue a certificate that is valid for any principal
+		return fmt.Errorf("no principals")
+	}
+	for _, principal := range principals {
+		if err := p.checkPrincipal(certType, principal); err != nil {
+			return fmt.Errorf("invalid principal %q: %w", principal, err)
+		}
+		if denied := p.denied(certType, principal); denied != "" {
+			return fmt.Errorf("principal %q is denied by the server (%s)", principal, denied)
+		}
+	}
+	return nil
+}
+
+// denied returns the entry of Denied that denies principal, or the empty
+// string if it can be issued. Host names are compared without case, like
+// ssh does. Wildcard principals are denied unless they are provably disjoint
+// from every denied pattern (see disjointPatterns).
+func (p PrincipalPolicy) denied(certType CertificateType, principal string) string {
+	if certType == HostCertificate {
+		principal = strings.ToLower(principal)
+	}
+	for _, denied := range p.Denied {
+		pattern := denied
+		if certType == HostCertificate {
+			pattern = strings.ToLower(pattern)
+		}
+		// A wildcard principal is denied if it is valid for a denied one,
+		// e.g. * for root
+		if matchPattern(pattern, principal) || matchPattern(principal, pattern) {
+			return denied
+		}
+		// Two patterns can overlap without either matching the other, e.g.
+		// *-prod and admin-* in admin-prod
+		if strings.ContainsAny(pattern, wildcardCharacters) && strings.ContainsAny(principal, wildcardCharacters) && !disjointPatterns(pattern, principal) {
+			return denied
+		}
+	}
+	return ""
+}
+
+// disjointPatterns reports whether no string can match both patterns, judging
+// only by the characters before their first and after their last wildcard:
+// if neither start is a prefix of the other, or neither end is a suffix of the
+// other, the patterns are disjoint. Otherwise they may overlap, so false is
+// returned even for some disjoint patterns (e.g. a?c and a*b?c).
+func disjointPatterns(a string, b string) bool {
+	aStart, aEnd := fixedEnds(a)
+	bStart, bEnd := fixedEnds(b)
+	if !strings.HasPrefix(aStart, bStart) && !strings.HasPrefix(bStart, aStart) {
+		return true
+	}
+	return !strings.HasSuffix(aEnd, bEnd) && !strings.HasSuffix(bEnd, aEnd)
+}
+
+// fixedEnds returns the characters of pattern before its first wildcard and
+// after its last one.
+func fixedEnds(pattern string) (string, string) {
+	return pattern[:strings.IndexAny(pattern, wildcardCharacters)], pattern[strings.LastIndexAny(pattern, wildcardCharacters)+1:]
+}
+
+// matchPattern reports whether s matches pattern, where * matches any
+// sequence of characters and ? matches a single character, as in OpenSSH.
+func matchPattern(pattern string, s string) bool {
+	for len(pattern) != 0 {
+		switch pattern[0] {
+		case '*':
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			_, size := utf8.DecodeRuneInString(s)
+			s = s[size:]
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
+
+func (p PrincipalPolicy) checkPrincipal(certType CertificateType, principal string) error {
+	if err := ValidatePrincipal(principal); err != nil {
+		return err
+	}
+	if strings.ContainsAny(principal, wildcardCharacters) && !p.wildcardsAllowed(certType) {
+		return fmt.Errorf("wildcard principals are not allowed in %s certificates", certType)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package ca
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrincipalPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     PrincipalPolicy
+		certType   CertificateType
+		principals []string
+		valid      bool
+	}{
+		{"valid", PrincipalPolicy{}, UserCertificate, []string{"alice", "bob@example.com"}, true},
+		{"no principals", PrincipalPolicy{}, UserCertificate, nil, false},
+		{"empty", PrincipalPolicy{}, UserCertificate, []string{"alice", ""}, false},
+		{"comma", PrincipalPolicy{}, UserCertificate, []string{"alice,root"}, false},
+		{"space", PrincipalPolicy{}, UserCertificate, []string{"alice root"}, false},
+		{"newline", PrincipalPolicy{}, HostCertificate, []string{"host\n"}, false},
+		{"leading dash", PrincipalPolicy{}, UserCertificate, []string{"-alice"}, false},
+		{"negation", PrincipalPolicy{HostWildcards: true}, HostCertificate, []string{"!host"}, false},
+		{"host wildcard denied", PrincipalPolicy{}, HostCertificate, []string{"*.example.com"}, false},
+		{"host wildcard allowed", PrincipalPolicy{HostWildcards: true}, HostCertificate, []string{"*.example.com"}, true},
+		{"user wildcard denied", PrincipalPolicy{HostWildcards: true}, UserCertificate, []string{"dev?"}, false},
+		{"user wildcard allowed", PrincipalPolicy{UserWildcards: true}, UserCertificate, []string{"dev?"}, true},
+		{"denied", PrincipalPolicy{Denied: []string{"root"}}, UserCertificate, []string{"alice", "root"}, false},
+		{"not denied", PrincipalPolicy{Denied: []string{"root"}}, UserCertificate, []string{"alice", "rooted"}, true},
+		{"denied pattern", PrincipalPolicy{Denied: []string{"admin-*"}}, UserCertificate, []string{"admin-alice"}, false},
+		{"denied host without case", PrincipalPolicy{Denied: []string{"db.example.com"}}, HostCertificate, []string{"DB.example.com"}, false},
+		{"wildcard covering denied", PrincipalPolicy{HostWildcards: true, Denied: []string{"db.example.com"}}, HostCertificate, []string{"*.example.com"}, false},
+		{"wildcard not covering denied", PrincipalPolicy{HostWildcards: true, Denied: []string{"db.example.org"}}, HostCertificate, []string{"*.example.com"}, true},
+		{"wildcard overlapping denied pattern", PrincipalPolicy{UserWildcards: true, Denied: []string{"admin-*"}}, UserCertificate, []string{"*-prod"}, false},
+		{"wildcard disjoint from denied pattern by start", PrincipalPolicy{UserWildcards: true, Denied: []string{"admin-*"}}, UserCertificate, []string{"dev-*"}, true},
+		{"wildcard disjoint from denied pattern by end", PrincipalPolicy{HostWildcards: true, Denied: []string{"*.example.org"}}, HostCertificate, []string{"db?.example.com"}, true},
+	}
+
+	for _, test := range tests {
+		err := test.policy.Check(test.certType, test.principals)
+		if test.valid {
+			assert.Nil(t, err, test.name)
+		} else {
+			assert.Error(t, err, test.name)
+		}
+	}
+}
+
+func TestDisjointPatterns(t *testing.T) {
+	assert.False(t, disjointPatterns("*-prod", "admin-*"))
+	assert.False(t, disjointPatterns("*", "admin-?"))
+	assert.False(t, disjointPatterns("db*.example.com", "d?.example.*"))
+	assert.True(t, disjointPatterns("dev-*", "admin-*"))
+	assert.True(t, disjointPatterns("*.example.com", "*.example.org"))
+	assert.True(t, disjointPatterns("web?-prod", "web*-test"))
+	// A limitation: these can't overlap, but their fixed ends don't show it
+	assert.False(t, disjointPatterns("*-prod-?", "*-prod-1?"))
+}
+
+func TestValidateIdentity(t *testing.T) {
+	assert.Nil(t, ValidateIdentity("host_root_ed25519"))
+	assert.Nil(t, ValidateIdentity("alice@example.com"))
+	assert.Error(t, ValidateIdentity(""))
+	assert.Error(t, ValidateIdentity("-O force-command=sh"))
+	assert.Error(t, ValidateIdentity("alice bob"))
+	assert.Error(t, ValidateIdentity("alice\nFAKE LOG LINE"))
+	assert.Error(t, ValidateIdentity(strings.Repeat("a", MaxIdentityLength+1)))
+}
+
+func TestPrincipalPolicyCheckDeniedError(t *testing.T) {
+	err := PrincipalPolicy{Denied: []string{"admin-*"}}.Check(UserCertificate, []string{"admin-bob"})
+	assert.EqualError(t, err, `principal "admin-bob" is denied by the server (admin-*)`)
+}
+
+func TestPrincipalPolicyValidate(t *testing.T) {
+	assert.Nil(t, PrincipalPolicy{Denied: []string{"root", "admin-*", "db?"}}.Validate())
+	assert.Error(t, PrincipalPolicy{Denied: []string{"root,admin"}}.Validate())
+	assert.Error(t, PrincipalPolicy{Denied: []string{""}}.Validate())
+}
+
+func TestMatchPattern(t *testing.T) {
+	assert.True(t, matchPattern("root", "root"))
+	assert.False(t, matchPattern("root", "roots"))
+	assert.True(t, matchPattern("*", ""))
+	assert.True(t, matchPattern("*.example.com", "db.example.com"))
+	assert.False(t, matchPattern("*.example.com", "example.com"))
+	assert.True(t, matchPattern("db?", "db1"))
+	assert.True(t, matchPattern("db?", "dbé"))
+	assert.False(t, matchPattern("db?", "db"))
+	assert.True(t, matchPattern("a*b*c", "axxbyyc"))
+	assert.False(t, matchPattern("a*b*c", "axxbyy"))
+}
@@ -0,0 +1,155 @@
+package ca
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// challengeLifetime is how long a challenge can be used for after it is
+// issued.
+const challengeLifetime = 5 * time.Minute
+
+// maxChallenges is how many challenges can be outstanding at once, so that
+// clients can't fill the server's memory by asking for challenges that they
+// never use.
+const maxChallenges = 10000
+
+// proofContext is prepended to the nonce before it is signed, so that a proof
+// can't be confused with a signature made for any other purpose.
+const proofContext = "sshca-proof-of-possession@ratorx.github.io\x00"
+
+// ChallengeReply represents the reply from GetChallenge.
+type ChallengeReply struct {
+	Nonce []byte
+}
+
+// Proof shows that the requester holds the private key for the public key in a
+// signing request, by signing a nonce issued by the server with it.
+type Proof struct {
+	Nonce     []byte
+	Signature *ssh.Signature
+}
+
+// SignProof answers the challenge nonce with signer.
+func SignProof(signer ssh.Signer, nonce []byte) (*Proof, error) {
+	signature, err := signer.Sign(rand.Reader, proofData(nonce))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign challenge: %w", err)
+	}
+	return &Proof{nonce, signature}, nil
+}
+
+func proofData(nonce []byte) []byte {
+	return append([]byte(proofContext), nonce...)
+}
+
+// ProofPolicy controls which certificate requests must include a Proof.
+// Proofs that are included are always verified.
+type ProofPolicy struct {
+	Hosts bool
+	Users bool
+}
+
+// required reports whether requests for certType must include a Proof.
+func (p ProofPolicy) required(certType CertificateType) bool {
+	if certType == HostCertificate {
+		return p.Hosts
+	}
+	return p.Users
+}
+
+// challengeStore holds the challenges that have been issued and not used yet.
+type challengeStore struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func newChallengeStore() *challengeStore {
+	return &challengeStore{expires: make(map[string]time.Time)}
+}
+
+// issue returns a new nonce, and forgets expired ones. It fails if too many
+// challenges are outstanding.
+func (s *challengeStore) issue(now time.Time) ([]byte, error) {
+	nonce := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate challenge: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, expires := range s.expires {
+		if now.After(expires) {
+			delete(s.expires, key)
+		}
+	}
+	if len(s.expires) >= maxChallenges {
+		return nil, fmt.Errorf("too many outstanding challenges, try again later")
+	}
+	s.expires[string(nonce)] = now.Add(challengeLifetime)
+	return nonce, nil
+}
+
+// redeem reports whether the nonce was issued and has not expired. Each nonce
+// can only be redeemed once.
+func (s *challengeStore) redeem(nonce []byte, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.expires[string(nonce)]
+	delete(s.expires, string(nonce))
+	return ok && !now.After(expires)
+}
+
+// GetChallenge issues a nonce that the client can sign with its private key to
+// include a Proof in a signing request.
+func (ca *Server) GetChallenge(args struct{}, reply *ChallengeReply) error {
+	nonce, err := ca.challenges.issue(time.Now())
+	if err != nil {
+		return err
+	}
+	reply.Nonce = nonce
+	return nil
+}
+
+// checkProof verifies the proof of possession in the request, and returns an
+// error if it is invalid or it is required and missing.
+func (ca *Server) checkProof(args SignArgs) error {
+	if args.Proof == nil {
+		if ca.RequireProof.required(args.CertificateType) {
+			return fmt.Errorf("proof of possession of the private key is required for %s certificates", args.CertificateType)
+		}
+		return nil
+	}
+
+	if args.bundleDigest != nil {
+		if err := checkBundleNonce(args.Proof.Nonce, args.bundleDigest, time.Now()); err != nil {
+			return err
+		}
+	} else if !ca.challenges.redeem(args.Proof.Nonce, time.Now()) {
+		return fmt.Errorf("unknown or expired challenge")
+	}
+	if args.Proof.Signature == nil {
+		return fmt.Errorf("missing signature")
+	}
+	if err := args.PublicKey.parse(); err != nil {
+		return err
+	}
+	if err := args.PublicKey.key.Verify(proofData(args.Proof.Nonce), args.Proof.Signature); err != nil {
+		return fmt.Errorf("signature does not match the public key: %w", err)
+	}
+	return nil
+}
+
+// Matches reports whether key is the same key as p.
+func (p *PublicKey) Matches(key ssh.PublicKey) bool {
+	if err := p.parse(); err != nil {
+		return false
+	}
+	return bytes.Equal(p.key.Marshal(), key.Marshal())
+}
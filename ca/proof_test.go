@@ -0,0 +1,192 @@
+package ca
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func mustSigner(t *testing.T, path string) ssh.Signer {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	signer, err := ssh.ParsePrivateKey(data)
+	assert.Nil(t, err)
+	return signer
+}
+
+func TestChallengeStoreRedeemsOnce(t *testing.T) {
+	store := newChallengeStore()
+	now := time.Now()
+	nonce, err := store.issue(now)
+	assert.Nil(t, err)
+	assert.Len(t, nonce, 32)
+	assert.True(t, store.redeem(nonce, now))
+	assert.False(t, store.redeem(nonce, now))
+}
+
+func TestChallengeStoreExpires(t *testing.T) {
+	store := newChallengeStore()
+	now := time.Now()
+	nonce, err := store.issue(now)
+	assert.Nil(t, err)
+	assert.False(t, store.redeem(nonce, now.Add(challengeLifetime+time.Second)))
+}
+
+func TestChallengeStoreForgetsExpired(t *testing.T) {
+	store := newChallengeStore()
+	now := time.Now()
+	_, err := store.issue(now)
+	assert.Nil(t, err)
+	_, err = store.issue(now.Add(challengeLifetime + time.Second))
+	assert.Nil(t, err)
+	assert.Len(t, store.expires, 1)
+}
+
+func TestChallengeStoreLimitsOutstanding(t *testing.T) {
+	store := newChallengeStore()
+	now := time.Now()
+	var first []byte
+	for i := 0; i < maxChallenges; i++ {
+		nonce, err := store.issue(now)
+		assert.Nil(t, err)
+		if i == 0 {
+			first = nonce
+		}
+	}
+	_, err := store.issue(now)
+	assert.EqualError(t, err, "too many outstanding challenges, try again later")
+	// Redeemed and expired challenges make room
+	assert.True(t, store.redeem(first, now))
+	_, err = store.issue(now)
+	assert.Nil(t, err)
+	_, err = store.issue(now.Add(challengeLifetime + time.Second))
+	assert.Nil(t, err)
+}
+
+func TestChallengeStoreRejectsUnknown(t *testing.T) {
+	assert.False(t, newChallengeStore().redeem([]byte("nonce"), time.Now()))
+}
+
+func newProofTestServer(t *testing.T, policy ProofPolicy) Server {
+	t.Helper()
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	server.RequireProof = policy
+	return server
+}
+
+func proofArgs(t *testing.T, server Server, signer ssh.Signer) SignArgs {
+	t.Helper()
+	var challenge ChallengeReply
+	assert.Nil(t, server.GetChallenge(struct{}{}, &challenge))
+	proof, err := SignProof(signer, challenge.Nonce)
+	assert.Nil(t, err)
+	return SignArgs{CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey, Proof: proof}
+}
+
+func TestServerCheckProof(t *testing.T) {
+	server := newProofTestServer(t, ProofPolicy{Hosts: true})
+	args := proofArgs(t, server, mustSigner(t, "./testdata/test"))
+	assert.Nil(t, server.checkProof(args))
+	// The challenge can't be reused
+	assert.EqualError(t, server.checkProof(args), "unknown or expired challenge")
+}
+
+func TestServerCheckProofWithWrongKey(t *testing.T) {
+	server := newProofTestServer(t, ProofPolicy{})
+	err := server.checkProof(proofArgs(t, server, mustSigner(t, "./testdata/ca")))
+	assert.Error(t, err)
+}
+
+func TestServerCheckProofWithUnknownChallenge(t *testing.T) {
+	server := newProofTestServer(t, ProofPolicy{})
+	proof, err := SignProof(mustSigner(t, "./testdata/test"), []byte("nonce"))
+	assert.Nil(t, err)
+	args := SignArgs{CertificateType: HostCertificate, PublicKey: testPublicKey, Proof: proof}
+	assert.EqualError(t, server.checkProof(args), "unknown or expired challenge")
+}
+
+func TestServerCheckProofRequired(t *testing.T) {
+	server := newProofTestServer(t, ProofPolicy{Hosts: true})
+	err := server.checkProof(SignArgs{CertificateType: HostCertificate, PublicKey: testPublicKey})
+	assert.EqualError(t, err, "proof of possession of the private key is required for host certificates")
+	assert.Nil(t, server.checkProof(SignArgs{CertificateType: UserCertificate, PublicKey: testPublicKey}))
+}
+
+func TestServerCheckProofUsers(t *testing.T) {
+	server := newProofTestServer(t, ProofPolicy{Users: true})
+	args := proofArgs(t, server, mustSigner(t, "./testdata/test"))
+	args.CertificateType = UserCertificate
+	assert.Nil(t, server.checkProof(args))
+
+	err := server.checkProof(SignArgs{CertificateType: UserCertificate, PublicKey: testPublicKey})
+	assert.EqualError(t, err, "proof of possession of the private key is required for user certificates")
+	assert.Nil(t, server.checkProof(SignArgs{CertificateType: HostCertificate, PublicKey: testPublicKey}))
+}
+
+func TestServerCheckProofUsersWithWrongKey(t *testing.T) {
+	server := newProofTestServer(t, ProofPolicy{Users: true})
+	args := proofArgs(t, server, mustSigner(t, "./testdata/ca"))
+	args.CertificateType = UserCertificate
+	err := server.checkProof(args)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "signature does not match the public key")
+}
+
+func TestServerSignPublicKeyWithProofOverRPC(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server := newProofTestServer(t, ProofPolicy{Hosts: true})
+	client, err := Dial([]string{serveTestServer(t, &server)}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	challenge, err := client.GetChallenge()
+	assert.Nil(t, err)
+	proof, err := SignProof(mustSigner(t, "./testdata/test"), challenge.Nonce)
+	assert.Nil(t, err)
+	_, err = client.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey, Proof: proof})
+	assert.Nil(t, err)
+
+	_, err = client.SignPublicKey(SignArgs{RequestUUID: testRequestUUID, Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey})
+	assert.EqualError(t, err, "request "+testRequestUUID+": proof of possession rejected: proof of possession of the private key is required for host certificates")
+}
+
+func TestServerSignUserPublicKeyWithProofOverRPC(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server := newProofTestServer(t, ProofPolicy{Users: true})
+	client, err := Dial([]string{serveTestServer(t, &server)}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	challenge, err := client.GetChallenge()
+	assert.Nil(t, err)
+	proof, err := SignProof(mustSigner(t, "./testdata/test"), challenge.Nonce)
+	assert.Nil(t, err)
+	_, err = client.SignPublicKey(SignArgs{Identity: "alice", CertificateType: UserCertificate, Principals: []string{"alice"}, PublicKey: testPublicKey, Proof: proof})
+	assert.Nil(t, err)
+
+	_, err = client.SignPublicKey(SignArgs{RequestUUID: testRequestUUID, Identity: "alice", CertificateType: UserCertificate, Principals: []string{"alice"}, PublicKey: testPublicKey})
+	assert.EqualError(t, err, "request "+testRequestUUID+": proof of possession rejected: proof of possession of the private key is required for user certificates")
+
+	challenge, err = client.GetChallenge()
+	assert.Nil(t, err)
+	proof, err = SignProof(mustSigner(t, "./testdata/ca"), challenge.Nonce)
+	assert.Nil(t, err)
+	_, err = client.SignPublicKey(SignArgs{Identity: "alice", CertificateType: UserCertificate, Principals: []string{"alice"}, PublicKey: testPublicKey, Proof: proof})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "signature does not match the public key")
+}
+
+func TestPublicKeyMatches(t *testing.T) {
+	assert.True(t, testPublicKey.Matches(mustSigner(t, "./testdata/test").PublicKey()))
+	assert.False(t, testPublicKey.Matches(mustSigner(t, "./testdata/ca").PublicKey()))
+}
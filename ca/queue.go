@@ -0,0 +1,195 @@
+package ca
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RequestStatus represents the state of an asynchronous signing request.
+type RequestStatus int
+
+const (
+	// RequestPending means the request is waiting for confirmation or signing.
+	RequestPending RequestStatus = iota
+	// RequestSigned means the certificate is ready to be fetched.
+	RequestSigned
+	// RequestFailed means the request was not signed.
+	RequestFailed
+)
+
+// String implementation for Stringer.
+func (rs RequestStatus) String() string {
+	switch rs {
+	case RequestPending:
+		return "pending"
+	case RequestSigned:
+		return "signed"
+	default:
+		return "failed"
+	}
+}
+
+// SubmitReply represents the reply from SubmitSignRequest.
+type SubmitReply struct {
+	// RequestID identifies the request in subsequent GetSignResult calls.
+	RequestID string
+}
+
+// SignResultArgs represents the arguments to GetSignResult.
+type SignResultArgs struct {
+	RequestID string
+}
+
+// SignResultReply represents the reply from GetSignResult.
+type SignResultReply struct {
+	Status RequestStatus
+	// Certificate is only set when Status is RequestSigned.
+	Certificate *PublicKey
+	// Error describes why the request failed when Status is RequestFailed. It is
+	// a string because gob can't transmit arbitrary error values.
+	Error string
+}
+
+// signResultLifetime is how long the result of a finished request is kept for
+// the client to fetch.
+const signResultLifetime = time.Hour
+
+// pendingRequestLifetime is how long a request can be pending before it is
+// considered abandoned and forgotten. Its result is then discarded.
+const pendingRequestLifetime = 24 * time.Hour
+
+// maxPendingRequests is how many requests can be pending at once, so that
+// clients can't fill the server's memory with requests that are never
+// confirmed.
+const maxPendingRequests = 1000
+
+// queuedRequest is a request in the signQueue.
+type queuedRequest struct {
+	result  SignResultReply
+	expires time.Time
+	// cancel abandons the request when it is forgotten while still pending,
+	// so that it stops waiting for confirmation.
+	cancel context.CancelFunc
+}
+
+// signQueue holds the results of asynchronous signing requests until they are
+// fetched by the client, or expire.
+type signQueue struct {
+	mu       sync.Mutex
+	requests map[string]*queuedRequest
+}
+
+func newSignQueue() *signQueue {
+	return &signQueue{requests: make(map[string]*queuedRequest)}
+}
+
+// add registers a new pending request, which expires after
+// pendingRequestLifetime, and returns its ID and a context that is cancelled
+// when it expires. It forgets expired requests, and fails if too many are
+// pending.
+func (q *signQueue) add(now time.Time) (string, context.Context, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", nil, fmt.Errorf("failed to generate request ID: %w", err)
+	}
+	id := hex.EncodeToString(idBytes)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := 0
+	for key, request := range q.requests {
+		if now.After(request.expires) {
+			request.cancel()
+			delete(q.requests, key)
+		} else if request.result.Status == RequestPending {
+			pending++
+		}
+	}
+	if pending >= maxPendingRequests {
+		return "", nil, fmt.Errorf("too many pending requests (%d), try again later", pending)
+	}
+	expires := now.Add(pendingRequestLifetime)
+	ctx, cancel := context.WithDeadline(context.Background(), expires)
+	q.requests[id] = &queuedRequest{SignResultReply{Status: RequestPending}, expires, cancel}
+	return id, ctx, nil
+}
+
+// complete records the outcome of the request with the given ID, which is
+// kept until it's fetched or expires.
+func (q *signQueue) complete(id string, certificate *PublicKey, err error, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	request, ok := q.requests[id]
+	if !ok {
+		return
+	}
+	request.cancel()
+	request.expires = now.Add(signResultLifetime)
+	if err != nil {
+		request.result.Status = RequestFailed
+		request.result.Error = err.Error()
+		return
+	}
+	request.result.Status = RequestSigned
+	request.result.Certificate = certificate
+}
+
+// get returns the state of a request. Finished requests are removed from the
+// queue once they have been fetched.
+func (q *signQueue) get(id string, now time.Time) (SignResultReply, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	request, ok := q.requests[id]
+	if ok && now.After(request.expires) {
+		request.cancel()
+		delete(q.requests, id)
+		ok = false
+	}
+	if !ok {
+		return SignResultReply{}, fmt.Errorf("unknown request ID %q", id)
+	}
+	if request.result.Status != RequestPending {
+		delete(q.requests, id)
+	}
+	return request.result, nil
+}
+
+// SubmitSignRequest queues a signing request and returns immediately with an
+// ID that can be passed to GetSignResult. Confirmation and signing happen in
+// the background, so the client does not need to stay connected.
+func (ca *Server) SubmitSignRequest(args SignArgs, reply *SubmitReply) error {
+	// Don't queue requests that would be rejected anyway
+	if err := args.PublicKey.validateSubmitted(); err != nil {
+		return err
+	}
+	id, ctx, err := ca.queue.add(time.Now())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		var signReply SignReply
+		err := ca.signPublicKeyContext(ctx, args, &signReply)
+		ca.queue.complete(id, signReply.Certificate, err, time.Now())
+	}()
+
+	reply.RequestID = id
+	return nil
+}
+
+// GetSignResult returns the status of a request previously made with
+// SubmitSignRequest. Once a signed or failed result has been returned, the
+// request ID is forgotten. Results that aren't fetched within an hour, and
+// requests still pending after a day, are forgotten too.
+func (ca *Server) GetSignResult(args SignResultArgs, reply *SignResultReply) error {
+	result, err := ca.queue.get(args.RequestID, time.Now())
+	if err != nil {
+		return err
+	}
+	*reply = result
+	return nil
+}
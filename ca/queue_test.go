@@ -0,0 +1,193 @@
+package ca
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var queueTime = time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)
+
+func TestRequestStatusString(t *testing.T) {
+	assert.Equal(t, "pending", RequestPending.String())
+	assert.Equal(t, "signed", RequestSigned.String())
+	assert.Equal(t, "failed", RequestFailed.String())
+}
+
+func TestSignQueueAddIsPending(t *testing.T) {
+	q := newSignQueue()
+	id, _, err := q.add(queueTime)
+	assert.Nil(t, err)
+	result, err := q.get(id, queueTime)
+	assert.Nil(t, err)
+	assert.Equal(t, RequestPending, result.Status)
+	// Pending requests are not forgotten
+	_, err = q.get(id, queueTime)
+	assert.Nil(t, err)
+}
+
+func TestSignQueueUniqueIDs(t *testing.T) {
+	q := newSignQueue()
+	first, _, err := q.add(queueTime)
+	assert.Nil(t, err)
+	second, _, err := q.add(queueTime)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+}
+
+func TestSignQueueCompleteWithCertificate(t *testing.T) {
+	q := newSignQueue()
+	id, _, err := q.add(queueTime)
+	assert.Nil(t, err)
+	q.complete(id, testPublicKey, nil, queueTime)
+	result, err := q.get(id, queueTime)
+	assert.Nil(t, err)
+	assert.Equal(t, RequestSigned, result.Status)
+	assert.Equal(t, testPublicKey, result.Certificate)
+	// Finished requests are forgotten after they are fetched
+	_, err = q.get(id, queueTime)
+	assert.Error(t, err)
+}
+
+func TestSignQueueCompleteWithError(t *testing.T) {
+	q := newSignQueue()
+	id, _, err := q.add(queueTime)
+	assert.Nil(t, err)
+	q.complete(id, nil, assert.AnError, queueTime)
+	result, err := q.get(id, queueTime)
+	assert.Nil(t, err)
+	assert.Equal(t, RequestFailed, result.Status)
+	assert.Equal(t, assert.AnError.Error(), result.Error)
+}
+
+func TestSignQueueGetUnknown(t *testing.T) {
+	_, err := newSignQueue().get("nonexistent", queueTime)
+	assert.Error(t, err)
+}
+
+func TestSignQueueExpires(t *testing.T) {
+	q := newSignQueue()
+	abandoned, _, err := q.add(queueTime)
+	assert.Nil(t, err)
+	finished, _, err := q.add(queueTime)
+	assert.Nil(t, err)
+	q.complete(finished, testPublicKey, nil, queueTime)
+
+	_, err = q.get(finished, queueTime.Add(signResultLifetime+time.Second))
+	assert.Error(t, err)
+	_, err = q.get(abandoned, queueTime.Add(pendingRequestLifetime-time.Second))
+	assert.Nil(t, err)
+	_, err = q.get(abandoned, queueTime.Add(pendingRequestLifetime+time.Second))
+	assert.Error(t, err)
+}
+
+func TestSignQueueCancelsForgottenRequests(t *testing.T) {
+	q := newSignQueue()
+	now := time.Now()
+	abandoned, abandonedCtx, err := q.add(now)
+	assert.Nil(t, err)
+	deadline, ok := abandonedCtx.Deadline()
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(pendingRequestLifetime), deadline)
+	finished, finishedCtx, err := q.add(now)
+	assert.Nil(t, err)
+	assert.Nil(t, abandonedCtx.Err())
+
+	q.complete(finished, testPublicKey, nil, now)
+	assert.Equal(t, context.Canceled, finishedCtx.Err())
+	_, err = q.get(abandoned, now.Add(pendingRequestLifetime+time.Second))
+	assert.Error(t, err)
+	assert.NotNil(t, abandonedCtx.Err())
+}
+
+func TestSignQueueSweepsExpired(t *testing.T) {
+	q := newSignQueue()
+	id, _, err := q.add(queueTime)
+	assert.Nil(t, err)
+	q.complete(id, testPublicKey, nil, queueTime)
+	_, _, err = q.add(queueTime.Add(signResultLifetime + time.Second))
+	assert.Nil(t, err)
+	assert.Len(t, q.requests, 1)
+	assert.NotContains(t, q.requests, id)
+}
+
+func TestSignQueueLimitsPending(t *testing.T) {
+	q := newSignQueue()
+	var first string
+	for i := 0; i < maxPendingRequests; i++ {
+		id, _, err := q.add(queueTime)
+		assert.Nil(t, err)
+		if i == 0 {
+			first = id
+		}
+	}
+	_, _, err := q.add(queueTime)
+	assert.EqualError(t, err, fmt.Sprintf("too many pending requests (%d), try again later", maxPendingRequests))
+	// Finished requests don't count
+	q.complete(first, nil, assert.AnError, queueTime)
+	_, _, err = q.add(queueTime)
+	assert.Nil(t, err)
+}
+
+func TestServerSubmitSignRequest(t *testing.T) {
+	_, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+
+	var submitReply SubmitReply
+	err = server.SubmitSignRequest(SignArgs{Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}, &submitReply)
+	assert.Nil(t, err)
+
+	var result SignResultReply
+	for i := 0; i < 100; i++ {
+		err = server.GetSignResult(SignResultArgs{submitReply.RequestID}, &result)
+		assert.Nil(t, err)
+		if result.Status != RequestPending {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, RequestSigned, result.Status)
+	details, err := getCertificateDetails(t, result.Certificate)
+	assert.Nil(t, err)
+	assert.Equal(t, testCertDetails, details)
+}
+
+// timeoutInteractor denies requests, and records the timeouts it is given.
+type timeoutInteractor struct {
+	timeouts []time.Duration
+}
+
+func (i *timeoutInteractor) Confirm(description string, timeout time.Duration) (Approval, error) {
+	i.timeouts = append(i.timeouts, timeout)
+	return Approval{}, fmt.Errorf("denied")
+}
+
+func TestServerConfirmStopsAtDeadline(t *testing.T) {
+	interactor := &timeoutInteractor{}
+	server := Server{Policy: &Policy{}, Interactor: interactor}
+	ctx, cancel := context.WithTimeout(context.Background(), pendingRequestLifetime)
+	defer cancel()
+	_, err := server.confirmRequest(ctx, "request")
+	assert.EqualError(t, err, "denied")
+	// Without a ConfirmationTimeout, queued requests still expire
+	assert.Len(t, interactor.timeouts, 1)
+	assert.True(t, interactor.timeouts[0] > pendingRequestLifetime-time.Minute && interactor.timeouts[0] <= pendingRequestLifetime)
+
+	server.ConfirmationTimeout = time.Minute
+	_, err = server.confirmRequest(ctx, "request")
+	assert.EqualError(t, err, "denied")
+	assert.Equal(t, time.Minute, interactor.timeouts[1])
+
+	cancel()
+	_, err = server.confirmRequest(ctx, "request")
+	assert.Equal(t, context.Canceled, err)
+	assert.Len(t, interactor.timeouts, 2, "abandoned requests aren't shown")
+}
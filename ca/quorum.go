@@ -0,0 +1,106 @@
+package ca
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// QuorumPolicy requires sensitive requests (e.g. for root, or with a long
+// validity) to be approved by several different approvers: Approvals of the
+// Approvers. Other requests still need a single approval.
+type QuorumPolicy struct {
+	// Approvals is how many different approvers must confirm a sensitive
+	// request. Below 2, every request needs a single approval.
+	Approvals int
+	// Approvers are the approvers (see Approval.Approver) whose approvals
+	// count for sensitive requests, e.g. "webhook:alice". Empty counts any
+	// approver.
+	Approvers []string
+	// Principals make requests for any of them sensitive. They are matched
+	// like the denied principals of PrincipalPolicy, so that a wildcard or a
+	// host principal in another case can't avoid the quorum.
+	Principals []string
+	// Validity makes requests valid for longer than it (or forever)
+	// sensitive. Zero doesn't.
+	Validity time.Duration
+}
+
+// Validate checks that the quorum can be reached, and that some requests are
+// sensitive.
+func (p QuorumPolicy) Validate() error {
+	if p.Approvals < 0 {
+		return fmt.Errorf("the number of approvals must not be negative")
+	}
+	if p.Validity < 0 {
+		return fmt.Errorf("the sensitive validity must not be negative")
+	}
+	if p.Approvals < 2 {
+		if len(p.Approvers) != 0 || len(p.Principals) != 0 || p.Validity != 0 {
+			return fmt.Errorf("the sensitive requests and approvers need a quorum of at least 2 approvals")
+		}
+		return nil
+	}
+	if len(p.Principals) == 0 && p.Validity == 0 {
+		return fmt.Errorf("a quorum of %d approvals needs sensitive principals or a sensitive validity", p.Approvals)
+	}
+	if len(p.Approvers) != 0 && len(p.Approvers) < p.Approvals {
+		return fmt.Errorf("a quorum of %d approvals can't be reached by %d approvers", p.Approvals, len(p.Approvers))
+	}
+	return nil
+}
+
+// sensitive returns why a request for args (after the validity policy is
+// applied) needs a quorum, or nil if a single approval is enough.
+func (p QuorumPolicy) sensitive(args SignArgs) []string {
+	if p.Approvals < 2 {
+		return nil
+	}
+	var reasons []string
+	sensitive := PrincipalPolicy{Denied: p.Principals}
+	for _, principal := range args.Principals {
+		if sensitive.denied(args.CertificateType, principal) != "" {
+			reasons = append(reasons, "principal "+principal)
+		}
+	}
+	if p.Validity != 0 && (args.Validity == 0 || args.Validity > p.Validity) {
+		reasons = append(reasons, fmt.Sprintf("validity longer than %s", p.Validity))
+	}
+	return reasons
+}
+
+// confirmQuorum asks for approvals of a sensitive request until the quorum
+// of different approvers has confirmed it. It fails as soon as one approval
+// is denied or doesn't count, rather than asking again. Each approval but the
+// last is released (see Approval.Done) before asking for the next one, since
+// an Interactor may not ask again until then.
+func (ca Server) confirmQuorum(ctx context.Context, description string) (Approval, error) {
+	if ca.SkipConfirmation {
+		return Approval{}, fmt.Errorf("the request needs %d approvals, but confirmation is skipped", ca.Quorum.Approvals)
+	}
+	var approvers []string
+	for {
+		status := fmt.Sprintf("approval %d of %d", len(approvers)+1, ca.Quorum.Approvals)
+		if len(approvers) != 0 {
+			status += fmt.Sprintf(" (approved by %s)", strings.Join(approvers, ", "))
+		}
+		approval, err := ca.confirm(ctx, fmt.Sprintf("%s\n%s", description, status))
+		if err != nil {
+			return Approval{}, err
+		}
+		if contains(approvers, approval.Approver) {
+			approval.Done()
+			return Approval{}, fmt.Errorf("%s approved twice, but the request needs %d different approvers", approval.Approver, ca.Quorum.Approvals)
+		}
+		if len(ca.Quorum.Approvers) != 0 && !contains(ca.Quorum.Approvers, approval.Approver) {
+			approval.Done()
+			return Approval{}, fmt.Errorf("%s is not an approver of sensitive requests", approval.Approver)
+		}
+		approvers = append(approvers, approval.Approver)
+		if len(approvers) == ca.Quorum.Approvals {
+			return Approval{Approver: strings.Join(approvers, ", "), Done: approval.Done}, nil
+		}
+		approval.Done()
+	}
+}
@@ -0,0 +1,173 @@
+package ca
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// approverSequence is an Interactor that approves as each of the approvers in
+// turn, and records the descriptions it is asked to confirm.
+type approverSequence struct {
+	approvers    []string
+	descriptions []string
+	done         int
+}
+
+func (a *approverSequence) Confirm(description string, timeout time.Duration) (Approval, error) {
+	a.descriptions = append(a.descriptions, description)
+	if len(a.approvers) == 0 {
+		return Approval{}, fmt.Errorf("denied")
+	}
+	approver := a.approvers[0]
+	a.approvers = a.approvers[1:]
+	return Approval{Approver: approver, Done: func() { a.done++ }}, nil
+}
+
+var testQuorum = QuorumPolicy{Approvals: 2, Principals: []string{"root"}, Validity: 24 * time.Hour}
+
+func TestQuorumPolicyValidate(t *testing.T) {
+	assert.Nil(t, QuorumPolicy{}.Validate())
+	assert.Nil(t, testQuorum.Validate())
+	assert.Nil(t, QuorumPolicy{Approvals: 2, Approvers: []string{"webhook:alice", "webhook:bob"}, Validity: time.Hour}.Validate())
+	assert.Error(t, QuorumPolicy{Approvals: -1}.Validate())
+	assert.Error(t, QuorumPolicy{Approvals: 1, Principals: []string{"root"}}.Validate())
+	assert.Error(t, QuorumPolicy{Approvals: 2}.Validate())
+	assert.Error(t, QuorumPolicy{Approvals: 3, Approvers: []string{"webhook:alice", "webhook:bob"}, Principals: []string{"root"}}.Validate())
+	assert.Error(t, QuorumPolicy{Approvals: 2, Validity: -time.Hour}.Validate())
+}
+
+func TestQuorumPolicySensitive(t *testing.T) {
+	assert.Nil(t, testQuorum.sensitive(SignArgs{Principals: []string{"alice"}, Validity: time.Hour}))
+	assert.Equal(t, []string{"principal root"}, testQuorum.sensitive(SignArgs{Principals: []string{"alice", "root"}, Validity: time.Hour}))
+	assert.Equal(t, []string{"validity longer than 24h0m0s"}, testQuorum.sensitive(SignArgs{Principals: []string{"alice"}, Validity: 48 * time.Hour}))
+	assert.Equal(t, []string{"principal root", "validity longer than 24h0m0s"}, testQuorum.sensitive(SignArgs{Principals: []string{"root"}}))
+	assert.Nil(t, QuorumPolicy{Principals: []string{"root"}}.sensitive(SignArgs{Principals: []string{"root"}}))
+}
+
+func TestQuorumPolicySensitivePatterns(t *testing.T) {
+	policy := QuorumPolicy{Approvals: 2, Principals: []string{"root", "prod.example.com", "*-prod"}}
+	tests := []struct {
+		name      string
+		certType  CertificateType
+		principal string
+		sensitive bool
+	}{
+		{name: "user wildcard", certType: UserCertificate, principal: "*", sensitive: true},
+		{name: "user prefix wildcard", certType: UserCertificate, principal: "ro*", sensitive: true},
+		{name: "user case variant", certType: UserCertificate, principal: "Root"},
+		{name: "sensitive pattern", certType: UserCertificate, principal: "db-prod", sensitive: true},
+		{name: "overlapping pattern", certType: UserCertificate, principal: "db-*", sensitive: true},
+		{name: "disjoint pattern", certType: UserCertificate, principal: "db-*-dev"},
+		{name: "host wildcard", certType: HostCertificate, principal: "*.example.com", sensitive: true},
+		{name: "host case variant", certType: HostCertificate, principal: "Prod.Example.com", sensitive: true},
+		{name: "host case variant wildcard", certType: HostCertificate, principal: "*.EXAMPLE.COM", sensitive: true},
+		{name: "other host", certType: HostCertificate, principal: "dev.example.com"},
+	}
+	for _, test := range tests {
+		reasons := policy.sensitive(SignArgs{CertificateType: test.certType, Principals: []string{test.principal}})
+		if test.sensitive {
+			assert.Equal(t, []string{"principal " + test.principal}, reasons, test.name)
+		} else {
+			assert.Nil(t, reasons, test.name)
+		}
+	}
+}
+
+func TestServerConfirmQuorum(t *testing.T) {
+	server := Server{Policy: &Policy{Quorum: testQuorum}}
+	interactor := &approverSequence{approvers: []string{"webhook:alice", "webhook:bob"}}
+	server.Interactor = interactor
+	approval, err := server.confirmQuorum(context.Background(), "request")
+	assert.Nil(t, err)
+	assert.Equal(t, "webhook:alice, webhook:bob", approval.Approver)
+	assert.Equal(t, []string{"request\napproval 1 of 2", "request\napproval 2 of 2 (approved by webhook:alice)"}, interactor.descriptions)
+	assert.Equal(t, 1, interactor.done)
+	approval.Done()
+	assert.Equal(t, 2, interactor.done)
+}
+
+func TestServerConfirmQuorumSameApprover(t *testing.T) {
+	server := Server{Policy: &Policy{Quorum: testQuorum}}
+	interactor := &approverSequence{approvers: []string{"webhook:alice", "webhook:alice"}}
+	server.Interactor = interactor
+	_, err := server.confirmQuorum(context.Background(), "request")
+	assert.EqualError(t, err, "webhook:alice approved twice, but the request needs 2 different approvers")
+	assert.Equal(t, 2, interactor.done)
+}
+
+func TestServerConfirmQuorumUnknownApprover(t *testing.T) {
+	quorum := testQuorum
+	quorum.Approvers = []string{"webhook:alice", "webhook:bob"}
+	server := Server{Policy: &Policy{Quorum: quorum}}
+	server.Interactor = &approverSequence{approvers: []string{"webhook:alice", "webhook:mallory"}}
+	_, err := server.confirmQuorum(context.Background(), "request")
+	assert.EqualError(t, err, "webhook:mallory is not an approver of sensitive requests")
+}
+
+func TestServerConfirmQuorumDenied(t *testing.T) {
+	server := Server{Policy: &Policy{Quorum: testQuorum}}
+	interactor := &approverSequence{approvers: []string{"webhook:alice"}}
+	server.Interactor = interactor
+	_, err := server.confirmQuorum(context.Background(), "request")
+	assert.EqualError(t, err, "denied")
+	assert.Equal(t, 1, interactor.done)
+}
+
+func TestServerConfirmQuorumSkipped(t *testing.T) {
+	server := Server{Policy: &Policy{Quorum: testQuorum}, SkipConfirmation: true}
+	_, err := server.confirmQuorum(context.Background(), "request")
+	assert.Error(t, err)
+}
+
+func TestServerRecordsQuorumApprovers(t *testing.T) {
+	server := newIssuanceTestServer(t)
+	server.Quorum = testQuorum
+	server.Interactor = &approverSequence{approvers: []string{"webhook:alice", "webhook:bob"}}
+	args := SignArgs{Identity: "alice", CertificateType: UserCertificate, Principals: []string{"root"}, PublicKey: testPublicKey, Validity: time.Hour}
+	var reply SignReply
+	assert.Nil(t, server.SignPublicKey(args, &reply))
+
+	issued, ok := server.Issued.Find(CheckStatusArgs{Serial: 1})
+	assert.True(t, ok)
+	assert.Equal(t, "webhook:alice, webhook:bob", issued.Issuance.Approver)
+	assert.Contains(t, issued.Issuance.PolicyRules, "quorum: 2 approvals for principal root")
+}
+
+func TestServerSignsOrdinaryRequestWithOneApproval(t *testing.T) {
+	server := newIssuanceTestServer(t)
+	server.Quorum = testQuorum
+	interactor := &approverSequence{approvers: []string{"webhook:alice"}}
+	server.Interactor = interactor
+	args := SignArgs{Identity: "alice", CertificateType: UserCertificate, Principals: []string{"alice"}, PublicKey: testPublicKey, Validity: time.Hour}
+	var reply SignReply
+	assert.Nil(t, server.SignPublicKey(args, &reply))
+	assert.Len(t, interactor.descriptions, 1)
+}
+
+func TestServerConfirmQuorumTerminal(t *testing.T) {
+	in, input := io.Pipe()
+	var out syncBuffer
+	server := Server{Policy: &Policy{Quorum: testQuorum}}
+	server.Interactor = newApprovalQueue(in, &out)
+	result := make(chan error, 1)
+	go func() {
+		_, err := server.confirmQuorum(context.Background(), "request")
+		result <- err
+	}()
+	waitForOutput(t, &out, "approval 1 of 2\n")
+	input.Write([]byte("\n"))
+	// The first approval is released, so the terminal asks again
+	waitForOutput(t, &out, "approval 2 of 2")
+	input.Write([]byte("\n"))
+	select {
+	case err := <-result:
+		assert.Contains(t, fmt.Sprint(err), "approved twice")
+	case <-time.After(time.Second):
+		t.Fatal("the second approval was never read")
+	}
+}
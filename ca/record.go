@@ -0,0 +1,199 @@
+package ca
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SecretFields are the fields of RPC arguments that are always redacted from
+// recordings, since they grant access.
+var SecretFields = []string{"OverrideToken", "TOTPCode", "BreakGlassToken"}
+
+// RecordedCall is an RPC call made by a Client, as recorded by a Recorder.
+type RecordedCall struct {
+	Time    time.Time       `json:"time"`
+	Service string          `json:"service"`
+	Method  string          `json:"method"`
+	Args    json.RawMessage `json:"args"`
+	Reply   json.RawMessage `json:"reply,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	// Redacted are the fields of Args and Reply that were removed, which are
+	// null in the recording.
+	Redacted []string `json:"redacted,omitempty"`
+}
+
+// Recorder writes the RPC calls of a Client to a file, one JSON object per
+// line, so that the requests can be inspected or replayed (see
+// Client.Replay).
+type Recorder struct {
+	mu     sync.Mutex
+	w      io.Writer
+	redact map[string]bool
+}
+
+// NewRecorder creates a Recorder that writes to w. The fields named in redact
+// (e.g. PublicKey or Certificate) are removed from the recorded arguments and
+// replies, in addition to SecretFields.
+func NewRecorder(w io.Writer, redact []string) *Recorder {
+	fields := make(map[string]bool, len(redact)+len(SecretFields))
+	for _, field := range append(append([]string{}, SecretFields...), redact...) {
+		fields[field] = true
+	}
+	return &Recorder{w: w, redact: fields}
+}
+
+// newCall describes a call, with the redacted fields removed.
+func (r *Recorder) newCall(service string, method string, args interface{}, reply interface{}, callErr error) (RecordedCall, error) {
+	call := RecordedCall{Time: time.Now().UTC(), Service: service, Method: method}
+	redacted := map[string]bool{}
+	var err error
+	if call.Args, err = r.redactedJSON(args, redacted); err != nil {
+		return RecordedCall{}, err
+	}
+	if callErr != nil {
+		call.Error = callErr.Error()
+	} else if call.Reply, err = r.redactedJSON(reply, redacted); err != nil {
+		return RecordedCall{}, err
+	}
+	for field := range redacted {
+		call.Redacted = append(call.Redacted, field)
+	}
+	sort.Strings(call.Redacted)
+	return call, nil
+}
+
+// record writes a call to the recording.
+func (r *Recorder) record(service string, method string, args interface{}, reply interface{}, callErr error) error {
+	call, err := r.newCall(service, method, args, reply, callErr)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(call)
+	if err != nil {
+		return fmt.Errorf("failed to record %s: %w", method, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.w.Write(append(line, '\n'))
+	return err
+}
+
+// redactedJSON returns v as JSON with the redacted fields set to null, and
+// adds the fields that were set to redacted.
+func (r *Recorder) redactedJSON(v interface{}, redacted map[string]bool) (json.RawMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record %T: %w", v, err)
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	r.redactValue(generic, redacted)
+	return json.Marshal(generic)
+}
+
+// redactValue sets the redacted fields of the objects in v to null.
+func (r *Recorder) redactValue(v interface{}, redacted map[string]bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if r.redact[key] {
+				if !isEmptyJSON(value) {
+					redacted[key] = true
+				}
+				v[key] = nil
+				continue
+			}
+			r.redactValue(value, redacted)
+		}
+	case []interface{}:
+		for _, value := range v {
+			r.redactValue(value, redacted)
+		}
+	}
+}
+
+// isEmptyJSON returns whether a decoded JSON value is the encoding of a zero
+// value, which doesn't need to be listed as redacted.
+func isEmptyJSON(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case float64:
+		return v == 0
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// ReadRecording reads the calls recorded by a Recorder.
+func ReadRecording(reader io.Reader) ([]RecordedCall, error) {
+	var calls []RecordedCall
+	scanner := bufio.NewScanner(reader)
+	// Replies can contain KRLs and trust bundles
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var call RecordedCall
+		if err := json.Unmarshal(scanner.Bytes(), &call); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		calls = append(calls, call)
+	}
+	return calls, scanner.Err()
+}
+
+// endpointTypes are the argument and reply types of the RPCs.
+var endpointTypes = map[string][2]reflect.Type{
+	getCAPublicKeyEndpoint: {reflect.TypeOf(struct{}{}), reflect.TypeOf(PublicKeyReply{})},
+	signPublicKeyEndpoint:  {reflect.TypeOf(SignArgs{}), reflect.TypeOf(SignReply{})},
+	submitSignEndpoint:     {reflect.TypeOf(SignArgs{}), reflect.TypeOf(SubmitReply{})},
+	getSignResultEndpoint:  {reflect.TypeOf(SignResultArgs{}), reflect.TypeOf(SignResultReply{})},
+	getChallengeEndpoint:   {reflect.TypeOf(struct{}{}), reflect.TypeOf(ChallengeReply{})},
+	crossCertifyEndpoint:   {reflect.TypeOf(CrossCertifyArgs{}), reflect.TypeOf(CrossCertifyReply{})},
+	getTrustBundleEndpoint: {reflect.TypeOf(struct{}{}), reflect.TypeOf(TrustBundleReply{})},
+	getKRLEndpoint:         {reflect.TypeOf(KRLArgs{}), reflect.TypeOf(KRLReply{})},
+	checkStatusEndpoint:    {reflect.TypeOf(CheckStatusArgs{}), reflect.TypeOf(StatusReply{})},
+	versionEndpoint:        {reflect.TypeOf(struct{}{}), reflect.TypeOf(VersionReply{})},
+}
+
+// Replay makes a recorded call again, with the recorded arguments, on the
+// service of the client. fill can set the arguments that were redacted from
+// the recording. It returns the call as it was made this time.
+func (c Client) Replay(call RecordedCall, fill func(args interface{}) error) (RecordedCall, error) {
+	types, ok := endpointTypes[call.Method]
+	if !ok {
+		return RecordedCall{}, fmt.Errorf("can't replay unknown method %s", call.Method)
+	}
+	args := reflect.New(types[0])
+	if err := json.Unmarshal(call.Args, args.Interface()); err != nil {
+		return RecordedCall{}, fmt.Errorf("failed to read arguments of %s: %w", call.Method, err)
+	}
+	if fill != nil {
+		if err := fill(args.Interface()); err != nil {
+			return RecordedCall{}, err
+		}
+	}
+	reply := reflect.New(types[1])
+
+	// The replayed call is redacted like the recorded one, so that the two
+	// can be compared
+	callErr := c.Call(c.service()+"."+call.Method, args.Elem().Interface(), reply.Interface())
+	return NewRecorder(nil, call.Redacted).newCall(c.service(), call.Method, args.Elem().Interface(), reply.Interface(), callErr)
+}
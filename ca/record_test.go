@@ -0,0 +1,74 @@
+package ca
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorderRedactsFields(t *testing.T) {
+	var out bytes.Buffer
+	recorder := NewRecorder(&out, []string{"PublicKey"})
+	args := SignArgs{Identity: "test", Principals: []string{"root"}, PublicKey: testPublicKey, OverrideToken: "secret"}
+	assert.Nil(t, recorder.record(ServerName, signPublicKeyEndpoint, args, &SignReply{}, errors.New("denied")))
+
+	calls, err := ReadRecording(&out)
+	assert.Nil(t, err)
+	assert.Len(t, calls, 1)
+	assert.Equal(t, signPublicKeyEndpoint, calls[0].Method)
+	assert.Equal(t, "denied", calls[0].Error)
+	assert.Nil(t, calls[0].Reply)
+	assert.Equal(t, []string{"OverrideToken", "PublicKey"}, calls[0].Redacted)
+	assert.NotContains(t, string(calls[0].Args), "secret")
+
+	var recorded SignArgs
+	assert.Nil(t, json.Unmarshal(calls[0].Args, &recorded))
+	assert.Nil(t, recorded.PublicKey)
+	assert.Equal(t, "test", recorded.Identity)
+	assert.Equal(t, []string{"root"}, recorded.Principals)
+}
+
+func TestRecorderOnlyListsSetFields(t *testing.T) {
+	var out bytes.Buffer
+	recorder := NewRecorder(&out, nil)
+	assert.Nil(t, recorder.record(ServerName, signPublicKeyEndpoint, SignArgs{Identity: "test"}, &SignReply{Certificate: testPublicKey}, nil))
+	calls, err := ReadRecording(&out)
+	assert.Nil(t, err)
+	assert.Empty(t, calls[0].Redacted)
+	assert.NotNil(t, calls[0].Reply)
+}
+
+func TestClientRecordsAndReplays(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	client, err := Dial([]string{serveTestServer(t, &server)}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+	var out bytes.Buffer
+	client.Recorder = NewRecorder(&out, nil)
+
+	_, err = client.GetCAPublicKey()
+	assert.Nil(t, err)
+	_, err = client.GetSignResult("unknown")
+	assert.Error(t, err)
+
+	calls, err := ReadRecording(&out)
+	assert.Nil(t, err)
+	assert.Len(t, calls, 2)
+	for _, call := range calls {
+		replayed, err := client.Replay(call, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, call.Method, replayed.Method)
+		assert.Equal(t, call.Error, replayed.Error)
+		assert.Equal(t, string(call.Reply), string(replayed.Reply))
+	}
+}
+
+func TestReplayUnknownMethod(t *testing.T) {
+	_, err := Client{}.Replay(RecordedCall{Method: "Unknown"}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,180 @@
+package ca
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ReportCount is the number of certificates issued for a key (e.g. a day or
+// principal) in an IssuanceReport.
+type ReportCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// ReportCertificate is a certificate listed in an IssuanceReport.
+type ReportCertificate struct {
+	Serial      uint64    `json:"serial"`
+	Identity    string    `json:"identity"`
+	Type        string    `json:"type"`
+	Principals  []string  `json:"principals"`
+	IssuedAt    time.Time `json:"issued_at"`
+	ValidBefore time.Time `json:"valid_before,omitempty"`
+	// RevokedAt is when the CA first saw the certificate in its KRL. It is
+	// zero for certificates that were only found to be revoked by the report.
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+}
+
+// IssuanceReport summarises the certificates in a CertificateRegistry, e.g.
+// for compliance reviews.
+type IssuanceReport struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	// Since is the start of the period that the counts and revocations are
+	// for. The zero value is the whole registry.
+	Since         time.Time     `json:"since,omitempty"`
+	Issued        int           `json:"issued"`
+	ByDay         []ReportCount `json:"by_day"`
+	ByType        []ReportCount `json:"by_type"`
+	ByPrincipal   []ReportCount `json:"by_principal"`
+	TopRequesters []ReportCount `json:"top_requesters"`
+	// Expiring are the valid certificates that expire within the
+	// ExpiringWithin of the ReportOptions, soonest first.
+	Expiring []ReportCertificate `json:"expiring"`
+	Revoked  []ReportCertificate `json:"revoked"`
+}
+
+// ReportOptions controls what an IssuanceReport covers.
+type ReportOptions struct {
+	// Now is the time that the report is generated at.
+	Now time.Time
+	// Since only counts the certificates issued (and revocations seen) since
+	// then. The zero value counts the whole registry.
+	Since time.Time
+	// ExpiringWithin lists the certificates that expire this soon.
+	ExpiringWithin time.Duration
+	// TopRequesters is the number of requesters listed. Zero lists all.
+	TopRequesters int
+	// KRLPath is a KRL to check the certificates that aren't known to be
+	// revoked against, with SSHKeygen. Revocations are otherwise only known
+	// once CheckStatus finds them.
+	KRLPath   string
+	SSHKeygen SSHKeygen
+}
+
+// unknownRequester is the requester of certificates whose client didn't say,
+// or that were recorded by older servers.
+const unknownRequester = "unknown"
+
+// counter counts certificates by key.
+type counter map[string]int
+
+// sorted returns the counts with the largest first, or by key if byKey is
+// set, and at most limit of them if limit isn't zero.
+func (c counter) sorted(byKey bool, limit int) []ReportCount {
+	counts := make([]ReportCount, 0, len(c))
+	for key, count := range c {
+		counts = append(counts, ReportCount{key, count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if !byKey && counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
+
+// reportCertificate parses the certificate of a record for a report.
+func reportCertificate(issued IssuedCertificate) (ReportCertificate, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(issued.Certificate))
+	if err != nil {
+		return ReportCertificate{}, fmt.Errorf("invalid certificate with serial %d: %w", issued.Serial, err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return ReportCertificate{}, fmt.Errorf("serial %d is not a certificate", issued.Serial)
+	}
+	certType := UserCertificate
+	if cert.CertType == ssh.HostCert {
+		certType = HostCertificate
+	}
+	return ReportCertificate{
+		Serial:      issued.Serial,
+		Identity:    issued.Identity,
+		Type:        certType.String(),
+		Principals:  cert.ValidPrincipals,
+		IssuedAt:    issued.IssuedAt,
+		ValidBefore: issued.ValidBefore,
+		RevokedAt:   issued.RevokedAt,
+	}, nil
+}
+
+// Report summarises the certificates in the registry. It doesn't change the
+// registry, so it can be run while a server uses it.
+func (r *CertificateRegistry) Report(options ReportOptions) (IssuanceReport, error) {
+	r.mu.Lock()
+	certificates := append([]IssuedCertificate(nil), r.file.Certificates...)
+	r.mu.Unlock()
+
+	report := IssuanceReport{
+		GeneratedAt: options.Now,
+		Since:       options.Since,
+		Expiring:    []ReportCertificate{},
+		Revoked:     []ReportCertificate{},
+	}
+	byDay, byType, byPrincipal, byRequester := counter{}, counter{}, counter{}, counter{}
+	for _, issued := range certificates {
+		certificate, err := reportCertificate(issued)
+		if err != nil {
+			return IssuanceReport{}, err
+		}
+
+		expired := !issued.ValidBefore.IsZero() && !options.Now.Before(issued.ValidBefore)
+		revoked := !issued.RevokedAt.IsZero()
+		// Expired certificates don't need to be revoked
+		if !revoked && !expired && options.KRLPath != "" {
+			if revoked, err = options.SSHKeygen.isRevoked(options.KRLPath, []byte(issued.Certificate+"\n")); err != nil {
+				return IssuanceReport{}, err
+			}
+		}
+		if revoked && (issued.RevokedAt.IsZero() || !issued.RevokedAt.Before(options.Since)) {
+			report.Revoked = append(report.Revoked, certificate)
+		}
+		if !revoked && !expired && !issued.ValidBefore.IsZero() && issued.ValidBefore.Sub(options.Now) <= options.ExpiringWithin {
+			report.Expiring = append(report.Expiring, certificate)
+		}
+
+		if issued.IssuedAt.Before(options.Since) {
+			continue
+		}
+		report.Issued++
+		byDay[issued.IssuedAt.UTC().Format("2006-01-02")]++
+		byType[certificate.Type]++
+		for _, principal := range certificate.Principals {
+			byPrincipal[principal]++
+		}
+		requester := unknownRequester
+		if issued.Requester != nil && issued.Requester.Username != "" {
+			requester = issued.Requester.Username
+			if issued.Requester.Hostname != "" {
+				requester += "@" + issued.Requester.Hostname
+			}
+		}
+		byRequester[requester]++
+	}
+
+	report.ByDay = byDay.sorted(true, 0)
+	report.ByType = byType.sorted(false, 0)
+	report.ByPrincipal = byPrincipal.sorted(false, 0)
+	report.TopRequesters = byRequester.sorted(false, options.TopRequesters)
+	sort.SliceStable(report.Expiring, func(i, j int) bool {
+		return report.Expiring[i].ValidBefore.Before(report.Expiring[j].ValidBefore)
+	})
+	return report, nil
+}
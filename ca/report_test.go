@@ -0,0 +1,107 @@
+package ca
+
+import (
+	"crypto/rand"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// reportTestCertificate records a certificate for testPublicKey signed by the
+// test CA.
+func reportTestCertificate(t *testing.T, serial uint64, certType uint32, principals []string, issuedAt, validBefore time.Time, requester *Requester) IssuedCertificate {
+	t.Helper()
+	assert.Nil(t, testPublicKey.parse())
+	cert := &ssh.Certificate{
+		Key:             testPublicKey.key,
+		Serial:          serial,
+		CertType:        certType,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(issuedAt.Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	assert.Nil(t, cert.SignCert(rand.Reader, mustSigner(t, "./testdata/ca")))
+	return IssuedCertificate{
+		Serial:      serial,
+		Identity:    "test",
+		IssuedAt:    issuedAt,
+		ValidBefore: validBefore,
+		Certificate: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))),
+		Requester:   requester,
+	}
+}
+
+func TestCertificateRegistryReport(t *testing.T) {
+	now := time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)
+	alice := &Requester{Username: "alice", Hostname: "laptop"}
+	revoked := reportTestCertificate(t, 3, ssh.UserCert, []string{"alice", "root"}, now.Add(-24*time.Hour), now.Add(time.Hour), alice)
+	revoked.RevokedAt = now.Add(-time.Hour)
+	registry := &CertificateRegistry{file: registryFile{Certificates: []IssuedCertificate{
+		// Before the report period
+		reportTestCertificate(t, 1, ssh.UserCert, []string{"alice"}, now.Add(-10*24*time.Hour), now.Add(2*time.Hour), alice),
+		reportTestCertificate(t, 2, ssh.HostCert, []string{"web.example.com"}, now.Add(-48*time.Hour), now.Add(30*24*time.Hour), nil),
+		revoked,
+		reportTestCertificate(t, 4, ssh.UserCert, []string{"alice"}, now.Add(-23*time.Hour), now.Add(time.Hour), alice),
+		reportTestCertificate(t, 5, ssh.UserCert, []string{"bob"}, now.Add(-2*time.Hour), now.Add(-time.Hour), &Requester{Username: "bob"}),
+	}}}
+
+	report, err := registry.Report(ReportOptions{Now: now, Since: now.Add(-7 * 24 * time.Hour), ExpiringWithin: 24 * time.Hour, TopRequesters: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, report.Issued)
+	assert.Equal(t, []ReportCount{{"2021-03-08", 1}, {"2021-03-09", 2}, {"2021-03-10", 1}}, report.ByDay)
+	assert.Equal(t, []ReportCount{{"user", 3}, {"host", 1}}, report.ByType)
+	assert.Equal(t, []ReportCount{{"alice", 2}, {"bob", 1}, {"root", 1}, {"web.example.com", 1}}, report.ByPrincipal)
+	assert.Equal(t, []ReportCount{{"alice@laptop", 2}, {"bob", 1}}, report.TopRequesters)
+
+	// The expired and revoked certificates aren't expiring, but the one from
+	// before the period is
+	assert.Len(t, report.Expiring, 2)
+	assert.Equal(t, uint64(4), report.Expiring[0].Serial)
+	assert.Equal(t, uint64(1), report.Expiring[1].Serial)
+	assert.Len(t, report.Revoked, 1)
+	assert.Equal(t, uint64(3), report.Revoked[0].Serial)
+	assert.Equal(t, []string{"alice", "root"}, report.Revoked[0].Principals)
+}
+
+func TestCertificateRegistryReportUnknownRequester(t *testing.T) {
+	now := time.Now()
+	registry := &CertificateRegistry{file: registryFile{Certificates: []IssuedCertificate{
+		reportTestCertificate(t, 1, ssh.UserCert, []string{"alice"}, now, now.Add(time.Hour), nil),
+	}}}
+	report, err := registry.Report(ReportOptions{Now: now})
+	assert.Nil(t, err)
+	assert.Equal(t, []ReportCount{{unknownRequester, 1}}, report.TopRequesters)
+	assert.Empty(t, report.Expiring)
+}
+
+func TestCertificateRegistryReportInvalidCertificate(t *testing.T) {
+	registry := &CertificateRegistry{file: registryFile{Certificates: []IssuedCertificate{{Serial: 1, Certificate: "invalid"}}}}
+	_, err := registry.Report(ReportOptions{Now: time.Now()})
+	assert.Error(t, err)
+}
+
+func TestCertificateRegistryReportWithKRL(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	now := time.Now()
+	issued := reportTestCertificate(t, 1, ssh.UserCert, []string{"alice"}, now, now.Add(time.Hour), nil)
+	registry := &CertificateRegistry{file: registryFile{Certificates: []IssuedCertificate{issued}}}
+
+	dir := t.TempDir()
+	krlPath := filepath.Join(dir, "krl")
+	certificate := &PublicKey{Data: []byte(issued.Certificate + "\n")}
+	assert.Nil(t, certificate.WriteFile(filepath.Join(dir, "cert.pub"), 0o600))
+	assert.Nil(t, exec.Command("ssh-keygen", "-k", "-f", krlPath, filepath.Join(dir, "cert.pub")).Run())
+
+	report, err := registry.Report(ReportOptions{Now: now, KRLPath: krlPath, SSHKeygen: SSHKeygen{Path: "ssh-keygen"}})
+	assert.Nil(t, err)
+	assert.Len(t, report.Revoked, 1)
+	assert.True(t, report.Revoked[0].RevokedAt.IsZero())
+}
@@ -0,0 +1,57 @@
+package ca
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Reporter receives the messages that a Server shows to the operator: the
+// requests that it handles, ssh-keygen output and errors that can't be
+// returned to a client. Messages can be reported concurrently.
+type Reporter interface {
+	Report(message string)
+}
+
+// Interactor asks the operator to confirm requests. Confirm blocks until the
+// request described by description is confirmed, denied or not confirmed
+// within timeout (zero means no timeout). Once it is confirmed, the Done
+// function of the approval must be called after the request has been handled.
+type Interactor interface {
+	Confirm(description string, timeout time.Duration) (Approval, error)
+}
+
+// Approval is the confirmation of a request by an Interactor.
+type Approval struct {
+	// Approver identifies who confirmed the request, and is recorded in the
+	// certificate registry (e.g. "terminal:alice" for the operator on the
+	// terminal, or the user that approved it in a chat).
+	Approver string
+	// Done must be called after the request has been handled.
+	Done func()
+}
+
+// writerReporter reports each message on its own line of w.
+type writerReporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterReporter creates a Reporter that writes each message to w, followed
+// by a newline.
+func NewWriterReporter(w io.Writer) Reporter {
+	return &writerReporter{w: w}
+}
+
+func (r *writerReporter) Report(message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	io.WriteString(r.w, message+"\n")
+}
+
+// NewTerminalInteractor creates an Interactor that shows each request with a
+// number on out, and reads the numbers of the requests to confirm or deny
+// from in.
+func NewTerminalInteractor(in io.Reader, out io.Writer) Interactor {
+	return newApprovalQueue(in, out)
+}
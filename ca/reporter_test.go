@@ -0,0 +1,79 @@
+package ca
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingReporter records the reported messages.
+type recordingReporter struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (r *recordingReporter) Report(message string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, message)
+}
+
+// interactorFunc is an Interactor that answers with a function.
+type interactorFunc func(description string) error
+
+func (f interactorFunc) Confirm(description string, timeout time.Duration) (Approval, error) {
+	return Approval{Approver: "test", Done: func() {}}, f(description)
+}
+
+func TestWriterReporter(t *testing.T) {
+	var out bytes.Buffer
+	reporter := NewWriterReporter(&out)
+	reporter.Report("a")
+	reporter.Report("")
+	reporter.Report("b\n")
+	assert.Equal(t, "a\n\nb\n\n", out.String())
+}
+
+func TestServerSignPublicKeyWithInteractor(t *testing.T) {
+	_, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server, err := NewServer("./testdata/ca", "", false)
+	assert.Nil(t, err)
+	server.SSHKeygen.NonInteractive = true
+	var reporter recordingReporter
+	server.Reporter = &reporter
+	var confirmed []string
+	server.Interactor = interactorFunc(func(description string) error {
+		confirmed = append(confirmed, description)
+		return nil
+	})
+
+	args := SignArgs{RequestUUID: testRequestUUID, Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}
+	var reply SignReply
+	assert.Nil(t, server.SignPublicKey(args, &reply))
+	assert.NotNil(t, reply.Certificate)
+	assert.Equal(t, []string{args.String()}, confirmed)
+	assert.Contains(t, reporter.messages[0], "ssh-keygen output:")
+}
+
+func TestServerSignPublicKeyDeniedByInteractor(t *testing.T) {
+	server, err := NewServer("./testdata/ca", "", false)
+	assert.Nil(t, err)
+	var reporter recordingReporter
+	server.Reporter = &reporter
+	server.Interactor = interactorFunc(func(description string) error {
+		return errors.New("denied")
+	})
+
+	var reply SignReply
+	err = server.SignPublicKey(SignArgs{RequestUUID: testRequestUUID, Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}, &reply)
+	assert.EqualError(t, err, "request "+testRequestUUID+": failed to confirm request: denied")
+	assert.Equal(t, []string{"request " + testRequestUUID + " failed: failed to confirm request: denied\n"}, reporter.messages)
+}
@@ -0,0 +1,77 @@
+package ca
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// maxRequesterField is the maximum length of each Requester field that is
+// shown to the operator.
+const maxRequesterField = 64
+
+// Requester describes who sent a request, so that the operator can tell
+// requests from different people and machines apart. It is reported by the
+// client and not verified, so it is only informational.
+type Requester struct {
+	// Username is the user running the client.
+	Username string `json:"username,omitempty"`
+	// Hostname is the host that the client runs on.
+	Hostname string `json:"hostname,omitempty"`
+	// OS is the operating system of the client (runtime.GOOS).
+	OS string `json:"os,omitempty"`
+	// ClientVersion is the version of sshca on the client.
+	ClientVersion string `json:"client_version,omitempty"`
+}
+
+// String formats the requester as user@host (os, sshca version). Fields that
+// are missing are left out, and characters that could mislead the operator on
+// the terminal are replaced.
+func (r Requester) String() string {
+	description := sanitizeRequesterField(r.Username)
+	if hostname := sanitizeRequesterField(r.Hostname); hostname != "" {
+		description += "@" + hostname
+	}
+
+	details := make([]string, 0, 2)
+	if os := sanitizeRequesterField(r.OS); os != "" {
+		details = append(details, os)
+	}
+	if version := sanitizeRequesterField(r.ClientVersion); version != "" {
+		details = append(details, "sshca "+version)
+	}
+	if len(details) != 0 {
+		description = strings.TrimSpace(fmt.Sprintf("%s (%s)", description, strings.Join(details, ", ")))
+	}
+	return description
+}
+
+// sanitized returns the requester with every field made safe to show to the
+// operator, or nil if nothing is known about the requester.
+func (r Requester) sanitized() *Requester {
+	r = Requester{
+		Username:      sanitizeRequesterField(r.Username),
+		Hostname:      sanitizeRequesterField(r.Hostname),
+		OS:            sanitizeRequesterField(r.OS),
+		ClientVersion: sanitizeRequesterField(r.ClientVersion),
+	}
+	if r == (Requester{}) {
+		return nil
+	}
+	return &r
+}
+
+// sanitizeRequesterField replaces whitespace and non-printable characters, and
+// truncates the field to maxRequesterField characters.
+func sanitizeRequesterField(field string) string {
+	runes := []rune(field)
+	if len(runes) > maxRequesterField {
+		runes = runes[:maxRequesterField]
+	}
+	for i, r := range runes {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) {
+			runes[i] = '?'
+		}
+	}
+	return string(runes)
+}
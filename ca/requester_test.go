@@ -0,0 +1,33 @@
+package ca
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequesterString(t *testing.T) {
+	tests := []struct {
+		requester Requester
+		expected  string
+	}{
+		{Requester{}, ""},
+		{Requester{Username: "alice", Hostname: "laptop", OS: "linux", ClientVersion: "1.2.0"}, "alice@laptop (linux, sshca 1.2.0)"},
+		{Requester{Username: "alice"}, "alice"},
+		{Requester{Hostname: "build", OS: "linux"}, "@build (linux)"},
+		{Requester{ClientVersion: "dev"}, "(sshca dev)"},
+		{Requester{Username: "alice\nconfirmed [1]", Hostname: "\x1b[2Klaptop"}, "alice?confirmed?[1]@?[2Klaptop"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.requester.String())
+	}
+}
+
+func TestRequesterSanitized(t *testing.T) {
+	assert.Nil(t, Requester{}.sanitized())
+
+	requester := Requester{Username: strings.Repeat("a", 100), Hostname: "host\tname"}.sanitized()
+	assert.Equal(t, &Requester{Username: strings.Repeat("a", maxRequesterField), Hostname: "host?name"}, requester)
+}
@@ -0,0 +1,39 @@
+package ca
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// NewRequestUUID generates a random (version 4) UUID to identify a signing
+// request in the output of the client and server.
+func NewRequestUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate request UUID: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// withRequestUUID checks the UUID sent by the client, or generates one for
+// clients that don't send it. The UUID is shown to the operator, so it can't
+// be arbitrary text.
+func (args SignArgs) withRequestUUID() (SignArgs, error) {
+	if args.RequestUUID == "" {
+		uuid, err := NewRequestUUID()
+		if err != nil {
+			return args, err
+		}
+		args.RequestUUID = uuid
+		return args, nil
+	}
+	if !uuidRegexp.MatchString(args.RequestUUID) {
+		return args, fmt.Errorf("invalid request UUID %q", args.RequestUUID)
+	}
+	return args, nil
+}
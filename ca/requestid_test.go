@@ -0,0 +1,42 @@
+package ca
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRequestUUID = "0b7e3d2a-6f1c-4d8e-9a5b-3c2d1e0f4a6b"
+
+func TestNewRequestUUID(t *testing.T) {
+	uuid, err := NewRequestUUID()
+	assert.Nil(t, err)
+	assert.Regexp(t, uuidRegexp, uuid)
+	assert.Equal(t, byte('4'), uuid[14])
+	other, err := NewRequestUUID()
+	assert.Nil(t, err)
+	assert.NotEqual(t, uuid, other)
+}
+
+func TestSignArgsWithRequestUUID(t *testing.T) {
+	args, err := SignArgs{RequestUUID: testRequestUUID}.withRequestUUID()
+	assert.Nil(t, err)
+	assert.Equal(t, testRequestUUID, args.RequestUUID)
+
+	args, err = SignArgs{}.withRequestUUID()
+	assert.Nil(t, err)
+	assert.Regexp(t, uuidRegexp, args.RequestUUID)
+
+	_, err = SignArgs{RequestUUID: "approve\nmake user certificate"}.withRequestUUID()
+	assert.Error(t, err)
+}
+
+func TestSignArgsStringWithRequestUUID(t *testing.T) {
+	sa := SignArgs{
+		RequestUUID:     testRequestUUID,
+		CertificateType: UserCertificate,
+		Principals:      []string{"asdf"},
+		PublicKey:       testPublicKey,
+	}
+	assert.Equal(t, "make user certficate for ssh-ed25519 key (fingerprint SHA256:nbtA2MPjSSVod4bmKFSZ60I2DOnD0AHXXnbsL5TTPt8) for asdf (request "+testRequestUUID+")", sa.String())
+}
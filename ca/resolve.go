@@ -0,0 +1,50 @@
+package ca
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SRVService is the DNS SRV service name used to find the CA server for a
+// domain (_sshca._tcp.example.com).
+const SRVService = "sshca"
+
+// lookupSRV is net.LookupSRV, replaced in tests.
+var lookupSRV = net.LookupSRV
+
+// ResolveAddresses converts a remote server specification into addresses for
+// Dial, in the order they should be tried. Addresses with a port, and remotes
+// with a transport other than TCP, are returned unchanged. Bare names are
+// looked up as a DNS SRV record (_sshca._tcp.name), so the CA server can move
+// without changing the clients.
+func ResolveAddresses(remote string) ([]string, error) {
+	if err := CheckRemote(remote); err != nil {
+		return nil, err
+	}
+	scheme, addr := SplitRemote(remote)
+	if scheme != DefaultScheme {
+		return []string{remote}, nil
+	}
+	remote = addr
+	if _, _, err := net.SplitHostPort(remote); err == nil {
+		return []string{remote}, nil
+	}
+
+	_, records, err := lookupSRV(SRVService, "tcp", remote)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a host:port address and SRV lookup failed: %w", remote, err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no SRV records for _%s._tcp.%s", SRVService, remote)
+	}
+
+	// Records are sorted by priority and randomized by weight
+	addrs := make([]string, 0, len(records))
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+	}
+	return addrs, nil
+}
@@ -0,0 +1,45 @@
+package ca
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeLookupSRV(t *testing.T, records []*net.SRV, err error) {
+	t.Helper()
+	original := lookupSRV
+	t.Cleanup(func() { lookupSRV = original })
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		assert.Equal(t, SRVService, service)
+		assert.Equal(t, "tcp", proto)
+		return "", records, err
+	}
+}
+
+func TestResolveAddressWithPort(t *testing.T) {
+	fakeLookupSRV(t, nil, assert.AnError)
+	addrs, err := ResolveAddresses("localhost:5000")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"localhost:5000"}, addrs)
+}
+
+func TestResolveAddressWithSRV(t *testing.T) {
+	fakeLookupSRV(t, []*net.SRV{{Target: "ca.example.com.", Port: 5000}, {Target: "ca2.example.com.", Port: 5001}}, nil)
+	addrs, err := ResolveAddresses("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ca.example.com:5000", "ca2.example.com:5001"}, addrs)
+}
+
+func TestResolveAddressWithFailedSRV(t *testing.T) {
+	fakeLookupSRV(t, nil, assert.AnError)
+	_, err := ResolveAddresses("example.com")
+	assert.Error(t, err)
+}
+
+func TestResolveAddressWithNoSRVRecords(t *testing.T) {
+	fakeLookupSRV(t, []*net.SRV{}, nil)
+	_, err := ResolveAddresses("example.com")
+	assert.Error(t, err)
+}
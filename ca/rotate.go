@@ -0,0 +1,232 @@
+package ca
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RotationPolicy controls when a log file (e.g. the audit log) is rotated, and
+// how long the rotated segments are kept. The zero value never rotates.
+type RotationPolicy struct {
+	// MaxSize rotates the file before it grows beyond this many bytes. Zero
+	// means no limit.
+	MaxSize int64
+	// MaxAge rotates the file once its first entry is this old. Zero means no
+	// limit.
+	MaxAge time.Duration
+	// Retention deletes rotated segments once they are this old. Zero keeps
+	// them.
+	Retention time.Duration
+	// Compress compresses rotated segments with gzip.
+	Compress bool
+}
+
+// segmentTimeFormat is the format of the rotation time in the names of
+// rotated segments, which sorts them by time.
+const segmentTimeFormat = "20060102T150405Z"
+
+// rotatingFile is a log file of JSON lines that is rotated by a
+// RotationPolicy. Rotated segments are named after the file and the time they
+// were rotated (e.g. audit.log.20210310T120000Z.gz). It isn't safe for
+// concurrent use.
+type rotatingFile struct {
+	path   string
+	policy RotationPolicy
+	file   *os.File
+	size   int64
+	// started is when the first entry of the file was written.
+	started time.Time
+	// now is time.Now, replaced in tests.
+	now func() time.Time
+}
+
+// openRotatingFile opens the file at path for appending.
+func openRotatingFile(path string, policy RotationPolicy) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, policy: policy, now: time.Now}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the file, and finds when its first entry was written.
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size, r.started = file, info.Size(), time.Time{}
+	if r.size != 0 {
+		r.started = firstEntryTime(r.path, info.ModTime())
+	}
+	return nil
+}
+
+// firstEntryTime returns the time field of the first line of the file at
+// path, or fallback if it has none.
+func firstEntryTime(path string, fallback time.Time) time.Time {
+	file, err := os.Open(path)
+	if err != nil {
+		return fallback
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fallback
+	}
+	var entry struct {
+		Time time.Time `json:"time"`
+	}
+	if json.Unmarshal(line, &entry) != nil || entry.Time.IsZero() {
+		return fallback
+	}
+	return entry.Time
+}
+
+// Write appends p to the file, rotating it first if p would break the policy.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	now := r.now()
+	tooBig := r.policy.MaxSize > 0 && r.size+int64(len(p)) > r.policy.MaxSize
+	tooOld := r.policy.MaxAge > 0 && !r.started.IsZero() && now.Sub(r.started) >= r.policy.MaxAge
+	var rotateErr error
+	// A single entry larger than MaxSize is written to an empty file anyway
+	if r.size != 0 && (tooBig || tooOld) {
+		rotateErr = r.rotate(now)
+	}
+	// The entry is written even if rotating failed, so that it isn't lost
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	if r.started.IsZero() {
+		r.started = now
+	}
+	if err == nil && rotateErr != nil {
+		err = fmt.Errorf("failed to rotate %s: %w", r.path, rotateErr)
+	}
+	return n, err
+}
+
+// rotate moves the file to a segment, compresses it if the policy says so,
+// deletes expired segments and opens a new file.
+func (r *rotatingFile) rotate(now time.Time) error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	segment := r.path + "." + now.UTC().Format(segmentTimeFormat)
+	// Segments rotated within the same second get a suffix
+	for i := 1; segmentExists(segment); i++ {
+		segment = fmt.Sprintf("%s.%s-%d", r.path, now.UTC().Format(segmentTimeFormat), i)
+	}
+	if err := os.Rename(r.path, segment); err != nil {
+		// Keep writing to the old file rather than losing entries
+		if openErr := r.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	// Entries are safe in the segment, so the rest only warns
+	var errs []string
+	if r.policy.Compress {
+		if err := compressSegment(segment); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if r.policy.Retention > 0 {
+		if err := r.deleteExpiredSegments(now); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// segmentExists reports whether the segment exists, compressed or not.
+func segmentExists(segment string) bool {
+	for _, name := range []string{segment, segment + ".gz"} {
+		if _, err := os.Stat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// compressSegment replaces the segment at path with a gzipped copy.
+func compressSegment(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return fmt.Errorf("failed to compress %s: %w", path, err)
+	}
+	return os.Remove(path)
+}
+
+// deleteExpiredSegments deletes the segments of the file that were rotated
+// more than the retention ago.
+func (r *rotatingFile) deleteExpiredSegments(now time.Time) error {
+	dir, base := filepath.Split(r.path)
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasPrefix(name, base+".") || info.IsDir() {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, base+".")
+		if len(stamp) < len(segmentTimeFormat) {
+			continue
+		}
+		rotated, err := time.Parse(segmentTimeFormat, stamp[:len(segmentTimeFormat)])
+		if err != nil || now.Sub(rotated) < r.policy.Retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the file.
+func (r *rotatingFile) Close() error {
+	return r.file.Close()
+}
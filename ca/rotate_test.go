@@ -0,0 +1,114 @@
+package ca
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// segments returns the names of the files in dir, sorted.
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotatingFileRotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)
+	f, err := openRotatingFile(filepath.Join(dir, "audit.log"), RotationPolicy{MaxSize: 11})
+	assert.Nil(t, err)
+	defer f.Close()
+	f.now = func() time.Time { return now }
+
+	for _, line := range []string{"12345\n", "6789\n", "abcdef\n"} {
+		_, err = f.Write([]byte(line))
+		assert.Nil(t, err)
+	}
+	// A line that is larger than the limit is written to an empty file
+	_, err = f.Write([]byte("a line longer than the limit\n"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"audit.log", "audit.log.20210310T120000Z", "audit.log.20210310T120000Z-1"}, segments(t, dir))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "audit.log.20210310T120000Z"))
+	assert.Nil(t, err)
+	assert.Equal(t, "12345\n6789\n", string(data))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	assert.Nil(t, err)
+	assert.Equal(t, "a line longer than the limit\n", string(data))
+}
+
+func TestRotatingFileRotatesByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	// The age of an existing file comes from its first entry
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"time":"2021-03-09T11:00:00Z"}`+"\n"), 0o600))
+	f, err := openRotatingFile(path, RotationPolicy{MaxAge: 24 * time.Hour})
+	assert.Nil(t, err)
+	defer f.Close()
+	assert.Equal(t, time.Date(2021, 3, 9, 11, 0, 0, 0, time.UTC), f.started)
+
+	now := time.Date(2021, 3, 10, 10, 0, 0, 0, time.UTC)
+	f.now = func() time.Time { return now }
+	_, err = f.Write([]byte("{}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"audit.log"}, segments(t, dir))
+
+	now = now.Add(time.Hour)
+	_, err = f.Write([]byte("{}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"audit.log", "audit.log.20210310T110000Z"}, segments(t, dir))
+	assert.Equal(t, now, f.started)
+}
+
+func TestRotatingFileCompressesAndDeletesSegments(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	// An old segment, and a file that isn't a segment
+	for _, name := range []string{"audit.log.20210101T000000Z.gz", "audit.log.bak"} {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0o600))
+	}
+	f, err := openRotatingFile(path, RotationPolicy{MaxSize: 1, Retention: 30 * 24 * time.Hour, Compress: true})
+	assert.Nil(t, err)
+	defer f.Close()
+	f.now = func() time.Time { return time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC) }
+
+	for _, line := range []string{"first\n", "second\n"} {
+		_, err = f.Write([]byte(line))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{"audit.log", "audit.log.20210310T120000Z.gz", "audit.log.bak"}, segments(t, dir))
+
+	compressed, err := os.Open(filepath.Join(dir, "audit.log.20210310T120000Z.gz"))
+	assert.Nil(t, err)
+	defer compressed.Close()
+	r, err := gzip.NewReader(compressed)
+	assert.Nil(t, err)
+	data, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "first\n", string(data))
+}
+
+func TestRotatingFileWithoutPolicy(t *testing.T) {
+	dir := t.TempDir()
+	f, err := openRotatingFile(filepath.Join(dir, "audit.log"), RotationPolicy{})
+	assert.Nil(t, err)
+	defer f.Close()
+	for i := 0; i < 3; i++ {
+		_, err = f.Write([]byte("line\n"))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{"audit.log"}, segments(t, dir))
+}
@@ -1,18 +1,25 @@
 package ca
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"net"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/ratorx/sshca/openssh"
 )
 
 // SignArgs represents the options available (or at least an important
 // subset of them) when generating the command line.
 type SignArgs struct {
+	// RequestUUID identifies the request in the output of the client and
+	// server, and in the errors returned for it. The server generates one if
+	// it isn't set.
+	RequestUUID string
 	// Identity is passed as the argument to -I in ssh-keygen.
 	Identity string
 	// CertificateType represents the type of certificate to be generated. If it's a host
@@ -22,27 +29,96 @@ type SignArgs struct {
 	Principals []string
 	// PublicKey contains the regular SSH public key that is being signed.
 	PublicKey *PublicKey
+	// Validity is the requested lifetime of the certificate, starting from when
+	// it is signed. Zero means the server default is used.
+	Validity time.Duration
+	// Options are passed to ssh-keygen -O (e.g. clear, permit-pty or
+	// force-command=CMD). Only options that restrict a user certificate are
+	// allowed.
+	Options []string
+	// OverrideToken skips the host principal DNS check if it matches the token
+	// configured on the server.
+	OverrideToken string
+	// TOTPClient and TOTPCode authenticate the request if the server requires
+	// TOTP codes. See TOTPPolicy.
+	TOTPClient string
+	TOTPCode   string
+	// Proof optionally shows that the requester holds the private key. See
+	// GetChallenge.
+	Proof *Proof
+	// BreakGlassToken and BreakGlassReason make an emergency request that
+	// bypasses the normal policy. See BreakGlassPolicy.
+	BreakGlassToken  string
+	BreakGlassReason string
+	// Requester describes the user and host that sent the request. It is
+	// shown to the operator and recorded in the audit log.
+	Requester Requester
+	// clientAddr is the address that the request came from. It is set by the
+	// server, so it is not sent by the client.
+	clientAddr net.Addr
+	// connection identifies the connection that the request came on, so
+	// that a TOTP code can authorise all the keys signed on it. It is 0 for
+	// requests that weren't made on a connection.
+	connection uint64
+	// bundleDigest is set for requests from a RequestBundle, whose proof
+	// signs the request instead of a challenge. It is the digest of the
+	// request as it was in the bundle.
+	bundleDigest []byte
+	// serial is the serial number assigned by the server's certificate
+	// registry, passed to ssh-keygen -z. Zero leaves the ssh-keygen default.
+	serial uint64
+	// policyRules are the rules of the server policy that applied to the
+	// request, for the certificate registry.
+	policyRules []string
 }
 
 // String identifies a SignPublicKey request. It generates a string version of
 // the request parameters and the key fingerprint. As a side-effect, this also
 // validates the public key.
 func (args SignArgs) String() string {
-	return fmt.Sprintf(
+	description := fmt.Sprintf(
 		"make %s certficate for %s key (fingerprint %s) for %s",
 		args.CertificateType,
 		args.PublicKey.Type(),
 		args.PublicKey.Fingerprint(),
 		strings.Join(args.Principals, ","),
 	)
+	if args.Validity != 0 {
+		description += fmt.Sprintf(" valid for %s", args.Validity)
+	}
+	if len(args.Options) != 0 {
+		description += fmt.Sprintf(" with options %s", strings.Join(args.Options, " "))
+	}
+	if requester := args.Requester.String(); requester != "" {
+		description += fmt.Sprintf(" requested by %s", requester)
+	}
+	if args.RequestUUID != "" {
+		description += fmt.Sprintf(" (request %s)", args.RequestUUID)
+	}
+	return description
 }
 
 // Args converts SignArgs to ssh-keygen args
 func (args SignArgs) Args() []string {
+	return args.argsFor(openssh.Version{}, 0, time.Now())
+}
+
+// argsFor converts SignArgs to args for a particular version of ssh-keygen,
+// avoiding features that it doesn't support. The validity period starts
+// backdate before now, which is used as the current time when relative
+// validity times aren't supported.
+func (args SignArgs) argsFor(version openssh.Version, backdate time.Duration, now time.Time) []string {
 	cmdArgs := []string{
 		"-I", args.Identity,
 		"-n", strings.Join(args.Principals, ","),
 	}
+	if args.serial != 0 {
+		cmdArgs = append(cmdArgs, "-z", strconv.FormatUint(args.serial, 10))
+	}
+	cmdArgs = append(cmdArgs, validityArgs(args.Validity, backdate, version.Supports(openssh.RelativeValidity), now)...)
+	for _, option := range args.Options {
+		cmdArgs = append(cmdArgs, "-O", option)
+	}
 	return append(cmdArgs, args.CertificateType.Args()...)
 }
 
@@ -52,6 +128,12 @@ type SignReply struct {
 	Certificate *PublicKey
 }
 
+// Deliverer sends an issued certificate to its owner out-of-band, in addition
+// to the RPC reply.
+type Deliverer interface {
+	Deliver(args SignArgs, certificate *PublicKey) error
+}
+
 // Server encapsulates a SSH CA and provides a net/rpc compatible type
 // signature. It exposes functions to sign public keys and return the public CA
 // certificate.
@@ -66,9 +148,80 @@ type Server struct {
 	PublicKey *PublicKey
 	// True iff confirmation should be skipped when responding to SignPublicKey.
 	SkipConfirmation bool
+	// ConfirmationTimeout denies requests that the operator doesn't confirm in
+	// time. Zero waits forever.
+	ConfirmationTimeout time.Duration
+	// SSHKeygen is the ssh-keygen binary used for signing.
+	SSHKeygen SSHKeygen
+	// Policy decides which requests are signed and what the certificates
+	// contain. Its fields can be set directly before the server starts, and
+	// replaced with Reload while it runs.
+	*Policy
+	// policyLock protects Policy once the server is running.
+	policyLock *sync.RWMutex
+	// SubCAs stores the sub-CAs endorsed with CrossCertify. Nil disables
+	// CrossCertify.
+	SubCAs *SubCARegistry
+	// Issued optionally records the issued certificates for CheckStatus, and
+	// assigns their serial numbers. Nil disables CheckStatus.
+	Issued *CertificateRegistry
+	// SignIssuances signs the issuance metadata recorded in Issued with the CA
+	// key (ssh-keygen -Y sign), so that it can't be changed without it
+	// showing. Interactive ssh-keygen asks for the passphrase of the CA key
+	// again for the signature.
+	SignIssuances bool
+	// KRLPath is the key revocation list returned by GetKRL. Empty disables
+	// GetKRL.
+	KRLPath string
 	// Signing passes through standard IO to ssh-keygen (for password etc.)
-	// This mutex protects the critical section
+	// unless SSHKeygen.NonInteractive is set. This mutex protects the critical
+	// section
 	sshKeygenLock *sync.Mutex
+	// Delivery optionally sends issued certificates out-of-band. Failure to
+	// deliver is reported on the server, but does not fail the request.
+	Delivery Deliverer
+	// queue tracks requests made with SubmitSignRequest.
+	queue *signQueue
+	// tracker records the requests that are waiting to be signed.
+	tracker *requestTracker
+	// challenges are the nonces issued by GetChallenge.
+	challenges *challengeStore
+	// totpCodes are the TOTP codes that have been accepted.
+	totpCodes *usedTOTPCodes
+	// totpFailures counts the invalid TOTP codes of each client and host.
+	totpFailures *totpFailures
+	// Interactor asks the operator to confirm requests. NewServer uses the
+	// terminal.
+	Interactor Interactor
+	// Reporter shows the requests, ssh-keygen output and errors to the
+	// operator. NewServer uses stdout.
+	Reporter Reporter
+	// Name identifies the tenant that the server belongs to. It is empty for
+	// the default tenant.
+	Name string
+	// Tenants are the other CAs served alongside this one. See NewTenant.
+	Tenants map[string]*Server
+	// Audit optionally records the outcome of every signing request.
+	Audit AuditSink
+	// Alerts are also told about the outcome of break-glass requests, e.g. to
+	// page the people that would have approved them.
+	Alerts AuditSink
+	// MaxRequestSize is the largest request in bytes that ServeConn reads
+	// before closing the connection. Zero disables the limit.
+	MaxRequestSize int64
+	// RequestTimeout is how long ServeConn waits for the rest of a request
+	// once it has started to arrive. Zero waits forever.
+	RequestTimeout time.Duration
+	// IdleTimeout closes connections that haven't sent a request for this
+	// long, while no request of theirs is being handled. Zero keeps them open.
+	IdleTimeout time.Duration
+	// WriteTimeout closes connections that don't accept a response within
+	// this time. Zero waits forever.
+	WriteTimeout time.Duration
+	// MaxConcurrentRequests is how many requests ServeConn handles at once on
+	// a connection. Further requests aren't read until one of them is
+	// responded to. Zero disables the limit.
+	MaxConcurrentRequests int
 }
 
 // NewServer constructs a CAServer using the paths to a SSH CA private key and
@@ -94,83 +247,329 @@ func NewServer(privateKeyPath string, publicKeyPath string, skipConfirmation boo
 		return Server{}, fmt.Errorf("failed to read public key at %s: %w", publicKeyPath, err)
 	}
 
-	return Server{privateKeyPath, publicKey, skipConfirmation, &sync.Mutex{}}, nil
+	return Server{
+		PrivateKeyPath:        privateKeyPath,
+		PublicKey:             publicKey,
+		SkipConfirmation:      skipConfirmation,
+		SSHKeygen:             SSHKeygen{Path: "ssh-keygen"},
+		sshKeygenLock:         &sync.Mutex{},
+		Policy:                &Policy{},
+		policyLock:            &sync.RWMutex{},
+		queue:                 newSignQueue(),
+		tracker:               newRequestTracker(),
+		challenges:            newChallengeStore(),
+		totpCodes:             newUsedTOTPCodes(),
+		totpFailures:          newTOTPFailures(),
+		Interactor:            NewTerminalInteractor(os.Stdin, os.Stdout),
+		Reporter:              NewWriterReporter(os.Stdout),
+		MaxRequestSize:        DefaultMaxRequestSize,
+		RequestTimeout:        DefaultRequestTimeout,
+		IdleTimeout:           DefaultIdleTimeout,
+		WriteTimeout:          DefaultWriteTimeout,
+		MaxConcurrentRequests: DefaultMaxConcurrentRequests,
+	}, nil
+}
+
+// SetAlgorithmPolicy restricts the algorithms of the keys that are signed and
+// of the CA signature. It fails if the CA key can't be used under the policy.
+// It must be called after SSHKeygen is set, because the signature algorithm
+// can only be chosen by newer versions of ssh-keygen.
+func (ca *Server) SetAlgorithmPolicy(policy AlgorithmPolicy) error {
+	signatureAlgorithm, err := policy.caSignatureAlgorithm(ca.PublicKey, ca.SSHKeygen.Version)
+	if err != nil {
+		return err
+	}
+	ca.policyLock.Lock()
+	defer ca.policyLock.Unlock()
+	ca.algorithms = policy
+	ca.signatureAlgorithm = signatureAlgorithm
+	return nil
 }
 
 // SignPublicKey takes a SSH public key and signing options and signs it with
 // ssh-keygen
 func (ca *Server) SignPublicKey(args SignArgs, reply *SignReply) error {
-	// Lock the mutex to prevent confusion when signing multiple requests
-	ca.sshKeygenLock.Lock()
-	defer ca.sshKeygenLock.Unlock()
+	return ca.signPublicKeyContext(context.Background(), args, reply)
+}
+
+// signPublicKeyContext is SignPublicKey for a request that is abandoned when
+// ctx is done (e.g. a queued request that expires), which stops waiting for
+// confirmation.
+func (ca *Server) signPublicKeyContext(ctx context.Context, args SignArgs, reply *SignReply) error {
+	ca = ca.withCurrentPolicy()
+	args, err := args.withRequestUUID()
+	if err != nil {
+		return err
+	}
+	// Expand the groups first, so that the operator, tracker and audit log see
+	// the principals that are issued
+	principals, err := ca.Groups.Expand(args.Principals)
+	if err == nil {
+		if groups := requestedGroups(args.Principals); len(groups) != 0 {
+			args.policyRules = append(args.policyRules, "groups: expanded "+strings.Join(groups, ","))
+		}
+		args.Principals = principals
+	}
+	id := ca.tracker.start(args, time.Now())
+	if err == nil {
+		err = ca.signPublicKey(ctx, args, reply)
+	}
+	ca.tracker.finish(id, err)
+	event := newAuditEvent(ca.Name, args, err, time.Now())
+	if ca.Audit != nil {
+		if auditErr := ca.Audit.Record(event); auditErr != nil {
+			ca.Reporter.Report(fmt.Sprintf("failed to record audit event: %s\n", auditErr))
+		}
+	}
+	if args.breakGlass() && ca.Alerts != nil {
+		if alertErr := ca.Alerts.Record(event); alertErr != nil {
+			ca.Reporter.Report(fmt.Sprintf("failed to send break-glass alert: %s\n", alertErr))
+		}
+	}
+	if err != nil {
+		// Show the operator which request failed, so it can be matched up with
+		// the error reported by the client
+		ca.Reporter.Report(fmt.Sprintf("request %s failed: %s\n", args.RequestUUID, err))
+		return fmt.Errorf("request %s: %w", args.RequestUUID, err)
+	}
+	return nil
+}
+
+func (ca *Server) signPublicKey(ctx context.Context, args SignArgs, reply *SignReply) error {
+	if err := args.PublicKey.validateSubmitted(); err != nil {
+		return err
+	}
+	if err := ValidateIdentity(args.Identity); err != nil {
+		return err
+	}
+	if err := ca.Principals.Check(args.CertificateType, args.Principals); err != nil {
+		return err
+	}
+	breakGlass := args.breakGlass()
+	var totpClient string
+	var overridden bool
+	if breakGlass {
+		// Skip the checks that depend on people or services that may be
+		// unavailable in an emergency
+		if err := ca.BreakGlass.check(args); err != nil {
+			return fmt.Errorf("break-glass request rejected: %w", err)
+		}
+		args.policyRules = append(args.policyRules, "break_glass: "+args.BreakGlassReason)
+	} else {
+		var err error
+		totpClient, err = ca.TOTP.check(args, ca.totpCodes, ca.totpFailures, time.Now())
+		if err != nil {
+			return fmt.Errorf("TOTP code rejected: %w", err)
+		}
+		// DNS lookups can be slow, so check before blocking other requests
+		overridden, err = ca.HostDNS.check(args)
+		if err != nil {
+			return fmt.Errorf("host principals rejected: %w", err)
+		}
+		if err := ca.checkProof(args); err != nil {
+			return fmt.Errorf("proof of possession rejected: %w", err)
+		}
+		if totpClient != "" {
+			args.policyRules = append(args.policyRules, "totp: client "+totpClient)
+		}
+		if overridden {
+			args.policyRules = append(args.policyRules, "host_dns: overridden with token")
+		} else if ca.HostDNS.Verify && args.CertificateType == HostCertificate {
+			args.policyRules = append(args.policyRules, "host_dns: verified")
+		}
+		if args.Proof != nil {
+			args.policyRules = append(args.policyRules, "proof: verified")
+		}
+	}
+
+	if err := ca.algorithms.CheckKey(args.PublicKey); err != nil {
+		return fmt.Errorf("public key rejected: %w", err)
+	}
+	if err := args.checkOptions(); err != nil {
+		return err
+	}
+	options, stripped := ca.Extensions.apply(args)
+	args.Options = options
+	if len(stripped) != 0 {
+		args.policyRules = append(args.policyRules, "extensions: stripped "+strings.Join(stripped, " "))
+	}
+
+	// Apply the server validity policy before showing the request, so the
+	// operator confirms what will actually be issued
+	if breakGlass {
+		validity, err := ca.BreakGlass.validity(args.Validity)
+		if err != nil {
+			return fmt.Errorf("invalid break-glass certificate validity: %w", err)
+		}
+		args.policyRules = append(args.policyRules, fmt.Sprintf("break_glass: validity %s", validity))
+		args.Validity = validity
+	} else {
+		validity, err := ca.validityPolicy(args.CertificateType).Apply(args.Validity)
+		if err != nil {
+			return fmt.Errorf("invalid %s certificate validity: %w", args.CertificateType, err)
+		}
+		args.policyRules = append(args.policyRules, validityRule(args.CertificateType, ca.validityPolicy(args.CertificateType), args.Validity, validity))
+		args.Validity = validity
+	}
 
 	// Verify the signing request
-	fmt.Println(args)
-	if err := ca.confirmRequest(); err != nil {
+	description := args.String()
+	if ca.Name != "" {
+		description = fmt.Sprintf("tenant %s: %s", ca.Name, description)
+	}
+	if overridden {
+		description += "\nhost principal DNS check overridden with token"
+	}
+	if totpClient != "" {
+		description += fmt.Sprintf("\nauthenticated with the TOTP code of %s", totpClient)
+	}
+	if len(stripped) != 0 {
+		description += fmt.Sprintf("\nstripped extensions not allowed by the server: %s", strings.Join(stripped, " "))
+	}
+	var approval Approval
+	var err error
+	if breakGlass {
+		ca.Reporter.Report(fmt.Sprintf("BREAK-GLASS %s\nreason: %s", description, args.BreakGlassReason))
+		approval = Approval{Approver: BreakGlassApprover, Done: func() {}}
+	} else if reasons := ca.Quorum.sensitive(args); len(reasons) != 0 {
+		args.policyRules = append(args.policyRules, fmt.Sprintf("quorum: %d approvals for %s", ca.Quorum.Approvals, strings.Join(reasons, ", ")))
+		description += fmt.Sprintf("\nsensitive (%s): needs %d different approvers", strings.Join(reasons, ", "), ca.Quorum.Approvals)
+		approval, err = ca.confirmQuorum(ctx, description)
+	} else {
+		approval, err = ca.confirmRequest(ctx, description)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to confirm request: %w", err)
 	}
+	defer approval.Done()
+
+	// Lock the mutex to prevent confusion when signing multiple requests
+	ca.sshKeygenLock.Lock()
+	defer ca.sshKeygenLock.Unlock()
 
 	// Prepare key for ssh-keygen, which reads files on disk
 	// It's probably possible to pass in the key to stdin, but that makes passing
 	// user input to ssh-keygen more complex.
-	tempDir, err := ioutil.TempDir("", "sshca.")
+	tempDir, err := newTempDir(ca.SSHKeygen.TempDir)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary directory: %w", err)
+		return err
 	}
-	defer os.RemoveAll(tempDir)
+	defer tempDir.remove()
 
-	keyPath := filepath.Join(tempDir, "key.pub")
-	err = args.PublicKey.WriteFile(keyPath, 0o600)
+	keyPath, err := tempDir.writeFile("key.pub", args.PublicKey.Data, 0o600)
 	if err != nil {
 		return fmt.Errorf("failed write key to disk: %w", err)
 	}
-	sshKeygenArgs := ca.getSSHKeygenArgs(args, keyPath)
-	err = runSSHKeygen(sshKeygenArgs)
+	if ca.Issued != nil {
+		args.serial = ca.Issued.nextSerial()
+	}
+	err = ca.SSHKeygen.run(ca.getSSHKeygenArgs(args, keyPath), ca.Reporter)
 	if err != nil {
 		return err
 	}
 	// Add a newline before next prompt
-	fmt.Println()
+	ca.Reporter.Report("")
 
-	certificate, err := NewPublicKey(filepath.Join(tempDir, "key-cert.pub"))
+	certificate, err := NewPublicKey(tempDir.join("key-cert.pub"))
 	if err != nil {
 		return fmt.Errorf("failed to read certificate from disk: %w", err)
 	}
+	if err := ca.Extensions.checkCertificate(args.CertificateType, certificate); err != nil {
+		return err
+	}
+
+	if ca.Issued != nil {
+		issuance := ca.newIssuance(args, approval, time.Now())
+		if err := ca.signIssuance(&issuance, certificate, tempDir); err != nil {
+			ca.Reporter.Report(fmt.Sprintf("failed to sign issuance metadata: %s\n", err))
+		}
+		if err := ca.Issued.record(certificate, args.Requester, issuance); err != nil {
+			ca.Reporter.Report(fmt.Sprintf("failed to record certificate: %s\n", err))
+		}
+	}
+
+	if ca.Delivery != nil {
+		if err := ca.Delivery.Deliver(args, certificate); err != nil {
+			ca.Reporter.Report(fmt.Sprintf("failed to deliver certificate: %s\n", err))
+		}
+	}
 
 	reply.Certificate = certificate
 	return nil
 }
 
+// validityPolicy returns the validity policy for the certificate type.
+func (ca Server) validityPolicy(certType CertificateType) ValidityPolicy {
+	if certType == HostCertificate {
+		return ca.HostValidity
+	}
+	return ca.UserValidity
+}
+
 // getSSHKeygenArgs builds the command line for sshKeygen by converting the
 // various arguments to their corresponding ssh-keygen flags.
 func (ca Server) getSSHKeygenArgs(args SignArgs, keyPath string) []string {
-	argsSlice := args.Args()
+	backdate := ca.Backdate
+	if backdate > MaxBackdate {
+		backdate = MaxBackdate
+	}
+	argsSlice := args.argsFor(ca.SSHKeygen.Version, backdate, time.Now())
+	if ca.signatureAlgorithm != "" {
+		argsSlice = append(argsSlice, "-t", ca.signatureAlgorithm)
+	}
 	return append(argsSlice, "-s", ca.PrivateKeyPath, keyPath)
 }
 
-// confirmRequest waits for user confirmation for certificate signing. Any input
-// followed by a newline is considered confirmation. Perhaps the error message
-// for the client could be made nicer if it looked at the input. Currently, the
-// client gets an EOF because the Ctrl-C shuts down the server.
-func (ca Server) confirmRequest() error {
+// confirmRequest shows the request to the operator and waits for them to
+// confirm it, unless confirmation is skipped. The Done function of the
+// approval must be called once the request has been signed.
+func (ca Server) confirmRequest(ctx context.Context, description string) (Approval, error) {
 	if ca.SkipConfirmation {
-		return nil
+		ca.Reporter.Report(description)
+		return Approval{Approver: SkippedApprover, Done: func() {}}, nil
+	}
+	return ca.confirm(ctx, description)
+}
+
+// confirm asks the Interactor to confirm the request, for no longer than
+// ConfirmationTimeout or until ctx is done. Interactors can't be interrupted,
+// so the deadline of ctx shortens the timeout.
+func (ca Server) confirm(ctx context.Context, description string) (Approval, error) {
+	timeout := ca.ConfirmationTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return Approval{}, context.DeadlineExceeded
+		}
+		if timeout == 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return Approval{}, err
+	}
+	approval, err := ca.Interactor.Confirm(description, timeout)
+	if err == nil && ctx.Err() != nil {
+		// The request was abandoned while it was being confirmed
+		approval.Done()
+		return Approval{}, ctx.Err()
 	}
-	fmt.Print("press Enter to confirm (or Ctrl-C to exit)")
-	reader := bufio.NewReader(os.Stdin)
-	_, err := reader.ReadString('\n')
-	return err
+	return approval, err
 }
 
 // PublicKeyReply encapsulates the public key of the CA and represents the
 // value of GetCAPublicKey.
 type PublicKeyReply struct {
 	CAPublicKey *PublicKey
+	// SignatureAlgorithm is the algorithm that the CA signs certificates
+	// with. Older servers leave it empty.
+	SignatureAlgorithm string
 }
 
 // GetCAPublicKey returns the public key of the trusted CA
 func (ca Server) GetCAPublicKey(args struct{}, reply *PublicKeyReply) error {
-	fmt.Print("get CA public key\n\n")
+	ca.Reporter.Report("get CA public key\n")
 	reply.CAPublicKey = ca.PublicKey
+	reply.SignatureAlgorithm = ca.withCurrentPolicy().certSignatureAlgorithm()
 	return nil
 }
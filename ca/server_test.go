@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"os/exec"
 	"testing"
+	"time"
 
+	"github.com/ratorx/sshca/executor"
+	"github.com/ratorx/sshca/openssh"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -66,6 +69,30 @@ func TestSignArgsToArgs(t *testing.T) {
 	assert.Equal(t, []string{"-I", "example", "-n", "asdf,qwerty", "-h"}, sa.Args())
 }
 
+func TestSignArgsArgsForVersionWithoutRelativeValidity(t *testing.T) {
+	sa := SignArgs{
+		Identity:        "example",
+		CertificateType: UserCertificate,
+		Principals:      []string{"asdf"},
+		PublicKey:       testPublicKey,
+		Validity:        time.Hour,
+	}
+	now := time.Date(2020, 12, 21, 10, 0, 0, 0, time.Local)
+	assert.Equal(t, []string{"-I", "example", "-n", "asdf", "-V", "20201221100000:20201221110000"}, sa.argsFor(openssh.Version{Major: 5, Minor: 4}, 0, now))
+}
+
+func TestSignArgsArgsForWithSerial(t *testing.T) {
+	sa := SignArgs{
+		Identity:        "example",
+		CertificateType: HostCertificate,
+		Principals:      []string{"asdf"},
+		PublicKey:       testPublicKey,
+		Validity:        time.Hour,
+		serial:          42,
+	}
+	assert.Equal(t, []string{"-I", "example", "-n", "asdf", "-z", "42", "-V", "+3600s", "-h"}, sa.Args())
+}
+
 func TestNewServer(t *testing.T) {
 	s, err := NewServer("./testdata/test", "./testdata/test.pub", false)
 	assert.Nil(t, err)
@@ -108,10 +135,24 @@ func TestServerGetCAPublicKey(t *testing.T) {
 func TestServerGetSSHKeygenArgs(t *testing.T) {
 	server, err := NewServer("./testdata/test", "", false)
 	assert.Nil(t, err)
-	args := SignArgs{"", UserCertificate, []string{""}, testPublicKey}
+	args := SignArgs{Identity: "", CertificateType: UserCertificate, Principals: []string{""}, PublicKey: testPublicKey}
 	assert.Equal(t, append(args.Args(), "-s", "./testdata/test", "asdf"), server.getSSHKeygenArgs(args, "asdf"))
 }
 
+func TestServerGetSSHKeygenArgsBackdate(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", false)
+	assert.Nil(t, err)
+	server.SSHKeygen.Version = openssh.Version{Major: 8, Minor: 0}
+	args := SignArgs{Identity: "example", CertificateType: UserCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey, Validity: time.Hour}
+
+	server.Backdate = 5 * time.Minute
+	assert.Equal(t, []string{"-I", "example", "-n", "asdf", "-V", "-300s:+3600s", "-s", "./testdata/test", "key"}, server.getSSHKeygenArgs(args, "key"))
+
+	// The backdate is capped
+	server.Backdate = 48 * time.Hour
+	assert.Equal(t, []string{"-I", "example", "-n", "asdf", "-V", "-3600s:+3600s", "-s", "./testdata/test", "key"}, server.getSSHKeygenArgs(args, "key"))
+}
+
 func getCertificateDetails(t *testing.T, cert *PublicKey) ([]byte, error) {
 	t.Helper()
 	cmd := exec.Command("ssh-keygen", "-L", "-f", "-")
@@ -129,9 +170,113 @@ func TestServerSignPublicKey(t *testing.T) {
 	server, err := NewServer("./testdata/ca", "", true)
 	assert.Nil(t, err)
 	var reply SignReply
-	err = server.SignPublicKey(SignArgs{"asdf", HostCertificate, []string{"asdf"}, testPublicKey}, &reply)
+	err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}, &reply)
 	assert.Nil(t, err)
 	details, err := getCertificateDetails(t, reply.Certificate)
 	assert.Nil(t, err)
 	assert.Equal(t, testCertDetails, details)
 }
+
+func TestSignArgsStringWithValidity(t *testing.T) {
+	sa := SignArgs{
+		Identity:        "",
+		CertificateType: UserCertificate,
+		Principals:      []string{"asdf"},
+		PublicKey:       testPublicKey,
+		Validity:        time.Hour,
+	}
+	assert.Equal(t, "make user certficate for ssh-ed25519 key (fingerprint SHA256:nbtA2MPjSSVod4bmKFSZ60I2DOnD0AHXXnbsL5TTPt8) for asdf valid for 1h0m0s", sa.String())
+}
+
+func TestSignArgsStringWithRequester(t *testing.T) {
+	sa := SignArgs{
+		CertificateType: UserCertificate,
+		Principals:      []string{"asdf"},
+		PublicKey:       testPublicKey,
+		Requester:       Requester{Username: "alice", Hostname: "laptop", OS: "linux", ClientVersion: "dev"},
+	}
+	assert.Equal(t, "make user certficate for ssh-ed25519 key (fingerprint SHA256:nbtA2MPjSSVod4bmKFSZ60I2DOnD0AHXXnbsL5TTPt8) for asdf requested by alice@laptop (linux, sshca dev)", sa.String())
+}
+
+func TestSignArgsToArgsWithValidity(t *testing.T) {
+	sa := SignArgs{
+		Identity:        "example",
+		CertificateType: UserCertificate,
+		Principals:      []string{"asdf"},
+		PublicKey:       testPublicKey,
+		Validity:        time.Hour,
+	}
+	assert.Equal(t, []string{"-I", "example", "-n", "asdf", "-V", "+3600s"}, sa.Args())
+}
+
+func TestServerSignPublicKeyExceedingMaxValidity(t *testing.T) {
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	server.UserValidity = ValidityPolicy{Max: time.Hour}
+	var reply SignReply
+	err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: UserCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey, Validity: 2 * time.Hour}, &reply)
+	assert.Error(t, err)
+}
+
+func TestServerSignPublicKeyNonInteractive(t *testing.T) {
+	_, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	server.SSHKeygen.NonInteractive = true
+	var reply SignReply
+	err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}, &reply)
+	assert.Nil(t, err)
+	details, err := getCertificateDetails(t, reply.Certificate)
+	assert.Nil(t, err)
+	assert.Equal(t, testCertDetails, details)
+}
+
+func TestServerSignPublicKeyNonInteractiveWithPassphrase(t *testing.T) {
+	_, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server, err := NewServer("./testdata/encrypted", "", true)
+	assert.Nil(t, err)
+	server.SSHKeygen.NonInteractive = true
+	server.SSHKeygen.Passphrase = "hunter2"
+	var reply SignReply
+	err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}, &reply)
+	assert.Nil(t, err)
+	assert.NotNil(t, reply.Certificate)
+}
+
+func TestServerSignPublicKeyNonInteractiveWithoutPassphrase(t *testing.T) {
+	_, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server, err := NewServer("./testdata/encrypted", "", true)
+	assert.Nil(t, err)
+	server.SSHKeygen.NonInteractive = true
+	var reply SignReply
+	err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}, &reply)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "ssh-keygen failed")
+	assert.Contains(t, err.Error(), "./testdata/encrypted")
+}
+
+func TestServerSignPublicKeyWithFailingSSHKeygen(t *testing.T) {
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	var ran executor.Command
+	server.SSHKeygen.NonInteractive = true
+	server.SSHKeygen.Executor = executor.Func(func(cmd executor.Command) error {
+		ran = cmd
+		fmt.Fprint(cmd.Stderr, "Load key failed\n")
+		return executor.ExitError{Code: 255}
+	})
+	var reply SignReply
+	err = server.SignPublicKey(SignArgs{RequestUUID: testRequestUUID, Identity: "asdf", CertificateType: HostCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey}, &reply)
+	assert.EqualError(t, err, "request "+testRequestUUID+": ssh-keygen failed: exit status 255: Load key failed")
+	assert.Equal(t, "ssh-keygen", ran.Path)
+	assert.Contains(t, ran.Args, "./testdata/ca")
+}
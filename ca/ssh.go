@@ -51,6 +51,12 @@ func NewPublicKey(filename string) (*PublicKey, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read public key at %s: %w", filename, err)
 	}
+	return ParsePublicKey(data)
+}
+
+// ParsePublicKey creates a new PublicKey from its file representation (e.g. a
+// line of ssh-add -L).
+func ParsePublicKey(data []byte) (*PublicKey, error) {
 	publicKey := &PublicKey{nil, data}
 	return publicKey, publicKey.parse()
 }
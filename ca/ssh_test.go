@@ -42,6 +42,18 @@ func TestNewPublicKeyBad(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestParsePublicKey(t *testing.T) {
+	key, err := ParsePublicKey(testPublicKeyContents)
+	assert.Nil(t, err)
+	assert.Equal(t, testPublicKeyContents, key.Data)
+	assert.Equal(t, testPublicKeyFingerprint, key.Fingerprint())
+}
+
+func TestParsePublicKeyBad(t *testing.T) {
+	_, err := ParsePublicKey([]byte("ssh-ed25519 invalid"))
+	assert.Error(t, err)
+}
+
 func TestPublicKeyFingerprint(t *testing.T) {
 	key, err := NewPublicKey("./testdata/test.pub")
 	assert.Nil(t, err)
@@ -0,0 +1,93 @@
+package ca
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Verification of signatures made with ssh-keygen -Y sign, in the format
+// described by PROTOCOL.sshsig in the OpenSSH source.
+
+const (
+	sshsigMagic   = "SSHSIG"
+	sshsigPEMType = "SSH SIGNATURE"
+)
+
+// sshsigBlob is the decoded body of an armored signature.
+type sshsigBlob struct {
+	Magic         [6]byte
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshsigSignedData is the data that the key actually signs.
+type sshsigSignedData struct {
+	Magic         [6]byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+func sshsigHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported signature hash algorithm %q", algorithm)
+	}
+}
+
+// verifySSHSig checks that armored is a valid signature of message by key in
+// namespace.
+func verifySSHSig(key *PublicKey, namespace string, message, armored []byte) error {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != sshsigPEMType {
+		return fmt.Errorf("signature is not an armored SSH signature")
+	}
+
+	var blob sshsigBlob
+	if err := ssh.Unmarshal(block.Bytes, &blob); err != nil {
+		return fmt.Errorf("failed to parse signature: %w", err)
+	}
+	if string(blob.Magic[:]) != sshsigMagic || blob.Version != 1 {
+		return fmt.Errorf("unsupported signature format")
+	}
+	if blob.Namespace != namespace {
+		return fmt.Errorf("signature is for namespace %q, not %q", blob.Namespace, namespace)
+	}
+	signingKey, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	if !key.Matches(signingKey) {
+		return fmt.Errorf("signature was made by a different key (fingerprint %s)", ssh.FingerprintSHA256(signingKey))
+	}
+
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &signature); err != nil {
+		return fmt.Errorf("failed to parse signature: %w", err)
+	}
+	h, err := sshsigHash(blob.HashAlgorithm)
+	if err != nil {
+		return err
+	}
+	h.Write(message)
+	signed := sshsigSignedData{Namespace: namespace, HashAlgorithm: blob.HashAlgorithm, Hash: h.Sum(nil)}
+	copy(signed.Magic[:], sshsigMagic)
+	if err := signingKey.Verify(ssh.Marshal(signed), &signature); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package ca
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CertificateStatus is the status of a certificate returned by CheckStatus.
+type CertificateStatus string
+
+const (
+	// StatusValid means the certificate was issued by the CA, and has neither
+	// expired nor been revoked.
+	StatusValid CertificateStatus = "valid"
+	// StatusExpired means the certificate was issued by the CA, but has
+	// expired.
+	StatusExpired CertificateStatus = "expired"
+	// StatusRevoked means the certificate is in the KRL of the CA.
+	StatusRevoked CertificateStatus = "revoked"
+	// StatusUnknown means the CA has no record of issuing the certificate.
+	StatusUnknown CertificateStatus = "unknown"
+)
+
+// CheckStatusArgs represents the arguments to CheckStatus. Exactly one of
+// Serial and Fingerprint must be set.
+type CheckStatusArgs struct {
+	// Serial is the serial number of the certificate.
+	Serial uint64
+	// Fingerprint is the SHA256 fingerprint of the certified key (as printed by
+	// ssh-keygen -l), which finds the most recent certificate for the key.
+	Fingerprint string
+}
+
+// StatusReply represents the reply from CheckStatus. Apart from Status and
+// CheckedAt, the fields are only set if the certificate is known.
+type StatusReply struct {
+	Status   CertificateStatus
+	Serial   uint64
+	Identity string
+	IssuedAt time.Time
+	// ValidBefore is when the certificate expires. The zero value never expires.
+	ValidBefore time.Time
+	// RevokedAt is when the CA first saw the certificate in its KRL.
+	RevokedAt time.Time
+	CheckedAt time.Time
+}
+
+// IssuedCertificate is the record of a certificate in a CertificateRegistry.
+type IssuedCertificate struct {
+	Serial      uint64    `json:"serial"`
+	Fingerprint string    `json:"fingerprint"`
+	Identity    string    `json:"identity"`
+	IssuedAt    time.Time `json:"issued_at"`
+	ValidBefore time.Time `json:"valid_before,omitempty"`
+	RevokedAt   time.Time `json:"revoked_at,omitempty"`
+	Certificate string    `json:"certificate"`
+	// Requester is who requested the certificate, if the client said.
+	Requester *Requester `json:"requester,omitempty"`
+	// Issuance is how the certificate was issued. Certificates recorded by
+	// older servers have none.
+	Issuance *Issuance `json:"issuance,omitempty"`
+}
+
+// registryFile is the format of the CertificateRegistry file.
+type registryFile struct {
+	NextSerial   uint64              `json:"next_serial"`
+	Certificates []IssuedCertificate `json:"certificates"`
+}
+
+// CertificateRegistry stores the certificates issued by the CA in a JSON
+// file, and assigns their serial numbers.
+type CertificateRegistry struct {
+	// PruneExpiredAfter removes certificates from the registry once they
+	// have been expired for this long, so that it doesn't grow forever. Zero
+	// keeps them. Pruned certificates are unknown to CheckStatus, but their
+	// serials aren't reused.
+	PruneExpiredAfter time.Duration
+
+	path string
+	mu   sync.Mutex
+	file registryFile
+}
+
+// LoadCertificateRegistry reads the registry at path. A missing file is an
+// empty registry.
+func LoadCertificateRegistry(path string) (*CertificateRegistry, error) {
+	registry := &CertificateRegistry{path: path, file: registryFile{NextSerial: 1}}
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate registry: %w", err)
+	}
+	if err := json.Unmarshal(data, &registry.file); err != nil {
+		return nil, fmt.Errorf("failed to parse certificate registry %s: %w", path, err)
+	}
+	return registry, nil
+}
+
+// nextSerial reserves a serial number for a certificate. Serials are never
+// reused, even if signing fails.
+func (r *CertificateRegistry) nextSerial() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	serial := r.file.NextSerial
+	r.file.NextSerial++
+	return serial
+}
+
+// record adds an issued certificate with its issuance metadata and saves the
+// registry.
+func (r *CertificateRegistry) record(certificate *PublicKey, requester Requester, issuance Issuance) error {
+	if err := certificate.parse(); err != nil {
+		return err
+	}
+	cert, ok := certificate.key.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("%s is not a certificate", certificate.Type())
+	}
+	issued := IssuedCertificate{
+		Serial:      cert.Serial,
+		Fingerprint: ssh.FingerprintSHA256(cert.Key),
+		Identity:    cert.KeyId,
+		IssuedAt:    issuance.SignedAt.Truncate(time.Second),
+		Certificate: strings.TrimSpace(certificate.String()),
+		Requester:   requester.sanitized(),
+		Issuance:    &issuance,
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		issued.ValidBefore = time.Unix(int64(cert.ValidBefore), 0)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.prune(issuance.SignedAt)
+	r.file.Certificates = append(r.file.Certificates, issued)
+	return r.save()
+}
+
+// prune removes the certificates that have been expired for longer than
+// PruneExpiredAfter, and returns how many were removed. r.mu must be held.
+func (r *CertificateRegistry) prune(now time.Time) int {
+	if r.PruneExpiredAfter == 0 {
+		return 0
+	}
+	kept := r.file.Certificates[:0]
+	for _, issued := range r.file.Certificates {
+		if issued.ValidBefore.IsZero() || now.Sub(issued.ValidBefore) < r.PruneExpiredAfter {
+			kept = append(kept, issued)
+		}
+	}
+	pruned := len(r.file.Certificates) - len(kept)
+	r.file.Certificates = kept
+	return pruned
+}
+
+// Prune removes the certificates that have been expired for longer than
+// PruneExpiredAfter, and saves the registry if any were removed. It returns
+// how many were removed. Certificates are also pruned whenever one is
+// recorded.
+func (r *CertificateRegistry) Prune(now time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pruned := r.prune(now)
+	if pruned == 0 {
+		return 0, nil
+	}
+	return pruned, r.save()
+}
+
+// Find returns the record of the certificate matching args, like CheckStatus.
+func (r *CertificateRegistry) Find(args CheckStatusArgs) (IssuedCertificate, bool) {
+	return r.find(args)
+}
+
+// find returns the certificate matching args. Later certificates take
+// precedence, so a fingerprint finds the most recent certificate for the key.
+func (r *CertificateRegistry) find(args CheckStatusArgs) (IssuedCertificate, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.file.Certificates) - 1; i >= 0; i-- {
+		issued := r.file.Certificates[i]
+		if (args.Serial != 0 && issued.Serial == args.Serial) || (args.Fingerprint != "" && issued.Fingerprint == args.Fingerprint) {
+			return issued, true
+		}
+	}
+	return IssuedCertificate{}, false
+}
+
+// markRevoked records when the certificate with serial was found to be
+// revoked.
+func (r *CertificateRegistry) markRevoked(serial uint64, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.file.Certificates {
+		if r.file.Certificates[i].Serial == serial && r.file.Certificates[i].RevokedAt.IsZero() {
+			r.file.Certificates[i].RevokedAt = now.Truncate(time.Second)
+		}
+	}
+	return r.save()
+}
+
+// save writes the registry, replacing the old file atomically. r.mu must be
+// held.
+func (r *CertificateRegistry) save() error {
+	data, err := json.MarshalIndent(r.file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode certificate registry: %w", err)
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(r.path), ".sshca-certificates.")
+	if err != nil {
+		return fmt.Errorf("failed to write certificate registry: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), r.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write certificate registry: %w", err)
+	}
+	return nil
+}
+
+// CheckStatus returns the status of a certificate issued by the CA, so that
+// it can be checked without downloading the whole KRL. Revocation is checked
+// against the KRL at KRLPath.
+func (ca *Server) CheckStatus(args CheckStatusArgs, reply *StatusReply) error {
+	if ca.Issued == nil {
+		return errors.New("certificate status is not enabled on this server")
+	}
+	if (args.Serial == 0) == (args.Fingerprint == "") {
+		return errors.New("exactly one of the serial or fingerprint must be set")
+	}
+
+	now := time.Now()
+	reply.CheckedAt = now
+	issued, ok := ca.Issued.find(args)
+	if !ok {
+		reply.Status = StatusUnknown
+		return nil
+	}
+
+	if issued.RevokedAt.IsZero() && ca.KRLPath != "" {
+		revoked, err := ca.SSHKeygen.isRevoked(ca.KRLPath, []byte(issued.Certificate+"\n"))
+		if err != nil {
+			return err
+		}
+		if revoked {
+			issued.RevokedAt = now.Truncate(time.Second)
+			if err := ca.Issued.markRevoked(issued.Serial, now); err != nil {
+				return err
+			}
+		}
+	}
+
+	*reply = StatusReply{
+		Status:      StatusValid,
+		Serial:      issued.Serial,
+		Identity:    issued.Identity,
+		IssuedAt:    issued.IssuedAt,
+		ValidBefore: issued.ValidBefore,
+		RevokedAt:   issued.RevokedAt,
+		CheckedAt:   now,
+	}
+	switch {
+	case !issued.RevokedAt.IsZero():
+		reply.Status = StatusRevoked
+	case !issued.ValidBefore.IsZero() && now.After(issued.ValidBefore):
+		reply.Status = StatusExpired
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package ca
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestServerCheckStatus(t *testing.T) {
+	_, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	dir := t.TempDir()
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	server.Issued, err = LoadCertificateRegistry(filepath.Join(dir, "certificates.json"))
+	assert.Nil(t, err)
+
+	var reply SignReply
+	for i := 0; i < 2; i++ {
+		err = server.SignPublicKey(SignArgs{Identity: "asdf", CertificateType: UserCertificate, Principals: []string{"asdf"}, PublicKey: testPublicKey, Validity: time.Hour}, &reply)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, reply.Certificate.parse())
+	assert.Equal(t, uint64(2), reply.Certificate.key.(*ssh.Certificate).Serial)
+
+	var status StatusReply
+	assert.Nil(t, server.CheckStatus(CheckStatusArgs{Serial: 1}, &status))
+	assert.Equal(t, StatusValid, status.Status)
+	assert.Equal(t, "asdf", status.Identity)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), status.ValidBefore, time.Minute)
+
+	assert.Nil(t, server.CheckStatus(CheckStatusArgs{Fingerprint: testPublicKey.Fingerprint()}, &status))
+	assert.Equal(t, uint64(2), status.Serial)
+
+	assert.Nil(t, server.CheckStatus(CheckStatusArgs{Serial: 3}, &status))
+	assert.Equal(t, StatusUnknown, status.Status)
+
+	// Revoke the second certificate
+	certPath := filepath.Join(dir, "cert.pub")
+	assert.Nil(t, reply.Certificate.WriteFile(certPath, 0o600))
+	server.KRLPath = filepath.Join(dir, "krl")
+	assert.Nil(t, exec.Command("ssh-keygen", "-k", "-f", server.KRLPath, certPath).Run())
+	assert.Nil(t, server.CheckStatus(CheckStatusArgs{Serial: 2}, &status))
+	assert.Equal(t, StatusRevoked, status.Status)
+	assert.False(t, status.RevokedAt.IsZero())
+	assert.Nil(t, server.CheckStatus(CheckStatusArgs{Serial: 1}, &status))
+	assert.Equal(t, StatusValid, status.Status)
+
+	// The revocation and serials are persisted
+	server.Issued, err = LoadCertificateRegistry(filepath.Join(dir, "certificates.json"))
+	assert.Nil(t, err)
+	server.KRLPath = ""
+	assert.Nil(t, server.CheckStatus(CheckStatusArgs{Serial: 2}, &status))
+	assert.Equal(t, StatusRevoked, status.Status)
+	assert.Equal(t, uint64(3), server.Issued.nextSerial())
+}
+
+func TestServerCheckStatusExpired(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	server.Issued = &CertificateRegistry{file: registryFile{Certificates: []IssuedCertificate{
+		{Serial: 1, ValidBefore: time.Now().Add(-time.Minute)},
+	}}}
+	var status StatusReply
+	assert.Nil(t, server.CheckStatus(CheckStatusArgs{Serial: 1}, &status))
+	assert.Equal(t, StatusExpired, status.Status)
+}
+
+func TestServerCheckStatusInvalidArgs(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	var status StatusReply
+	assert.Error(t, server.CheckStatus(CheckStatusArgs{Serial: 1}, &status))
+
+	server.Issued, err = LoadCertificateRegistry(filepath.Join(t.TempDir(), "certificates.json"))
+	assert.Nil(t, err)
+	assert.Error(t, server.CheckStatus(CheckStatusArgs{}, &status))
+	assert.Error(t, server.CheckStatus(CheckStatusArgs{Serial: 1, Fingerprint: "SHA256:x"}, &status))
+}
+
+func TestLoadCertificateRegistryInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certificates.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("{"), 0o600))
+	_, err := LoadCertificateRegistry(path)
+	assert.Error(t, err)
+}
+
+func TestCertificateRegistryPrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certificates.json")
+	registry, err := LoadCertificateRegistry(path)
+	assert.Nil(t, err)
+	now := time.Now()
+	registry.file = registryFile{NextSerial: 4, Certificates: []IssuedCertificate{
+		{Serial: 1, ValidBefore: now.Add(-48 * time.Hour)},
+		{Serial: 2, ValidBefore: now.Add(-time.Hour)},
+		{Serial: 3},
+	}}
+
+	pruned, err := registry.Prune(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pruned)
+
+	registry.PruneExpiredAfter = 24 * time.Hour
+	pruned, err = registry.Prune(now)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pruned)
+	_, ok := registry.find(CheckStatusArgs{Serial: 1})
+	assert.False(t, ok)
+
+	// The pruning is saved, and serials aren't reused
+	registry, err = LoadCertificateRegistry(path)
+	assert.Nil(t, err)
+	assert.Len(t, registry.file.Certificates, 2)
+	assert.Equal(t, uint64(4), registry.nextSerial())
+}
@@ -0,0 +1,273 @@
+package ca
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ratorx/sshca/openssh"
+)
+
+// OpenSSH doesn't support certificate chains, so sub-CAs are emulated: the
+// root CA signs a statement (an Endorsement) that another CA key belongs to a
+// named sub-CA. Clients that trust the root verify the endorsements and trust
+// the sub-CA keys directly, alongside the root.
+
+// EndorsementNamespace is the ssh-keygen -Y namespace of endorsement
+// signatures, so they can't be confused with signatures for anything else.
+const EndorsementNamespace = "sshca-sub-ca@ratorx.github.io"
+
+// Endorsement is a sub-CA key cross-certified by the root CA.
+type Endorsement struct {
+	// Name identifies the sub-CA (e.g. a team). Endorsing a new key with the
+	// same name replaces the old one, so sub-CAs can be rotated independently.
+	Name      string
+	PublicKey *PublicKey
+	// NotAfter is when the endorsement expires. The zero value never expires.
+	NotAfter time.Time
+	// Signature is the armored ssh-keygen -Y signature of Message by the root
+	// CA.
+	Signature []byte
+}
+
+// Message is the data signed by the root CA.
+func (e Endorsement) Message() []byte {
+	var notAfter int64
+	if !e.NotAfter.IsZero() {
+		notAfter = e.NotAfter.Unix()
+	}
+	return []byte(fmt.Sprintf("sshca sub-CA endorsement\nname: %s\nkey: %s\nnot-after: %d\n", e.Name, strings.TrimSpace(e.PublicKey.String()), notAfter))
+}
+
+// Verify checks that the endorsement was signed by root and has not expired.
+func (e Endorsement) Verify(root *PublicKey, now time.Time) error {
+	if !e.NotAfter.IsZero() && now.After(e.NotAfter) {
+		return fmt.Errorf("endorsement of sub-CA %s expired at %s", e.Name, e.NotAfter.Format(time.RFC3339))
+	}
+	if err := verifySSHSig(root, EndorsementNamespace, e.Message(), e.Signature); err != nil {
+		return fmt.Errorf("invalid endorsement of sub-CA %s: %w", e.Name, err)
+	}
+	return nil
+}
+
+// CrossCertifyArgs represents the arguments to CrossCertify.
+type CrossCertifyArgs struct {
+	Name      string
+	PublicKey *PublicKey
+	// Validity is how long the endorsement is valid for. Zero means forever.
+	Validity time.Duration
+	// TOTPClient and TOTPCode authenticate the request if the server requires
+	// TOTP codes.
+	TOTPClient string
+	TOTPCode   string
+
+	// clientAddr is the address that the request came from, connection
+	// identifies the connection and remote is set unless it came from the
+	// same process. They are set by the connection.
+	clientAddr net.Addr
+	connection uint64
+	remote     bool
+}
+
+// String describes the request for confirmation.
+func (args CrossCertifyArgs) String() string {
+	description := fmt.Sprintf("cross-certify %s key (fingerprint %s) as sub-CA %s", args.PublicKey.Type(), args.PublicKey.Fingerprint(), args.Name)
+	if args.Validity != 0 {
+		description += fmt.Sprintf(" valid for %s", args.Validity)
+	}
+	return description
+}
+
+// CrossCertifyReply represents the reply from CrossCertify.
+type CrossCertifyReply struct {
+	Endorsement Endorsement
+}
+
+// TrustBundleReply represents the reply from GetTrustBundle.
+type TrustBundleReply struct {
+	CAPublicKey *PublicKey
+	// SubCAs are the current endorsements, which must be verified against
+	// CAPublicKey before they are trusted.
+	SubCAs []Endorsement
+}
+
+// SubCARegistry stores the endorsed sub-CAs in a JSON file.
+type SubCARegistry struct {
+	path         string
+	mu           sync.Mutex
+	endorsements map[string]Endorsement
+}
+
+// LoadSubCARegistry reads the registry at path. A missing file is an empty
+// registry.
+func LoadSubCARegistry(path string) (*SubCARegistry, error) {
+	registry := &SubCARegistry{path: path, endorsements: make(map[string]Endorsement)}
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return registry, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sub-CA registry: %w", err)
+	}
+
+	var endorsements []Endorsement
+	if err := json.Unmarshal(data, &endorsements); err != nil {
+		return nil, fmt.Errorf("failed to parse sub-CA registry %s: %w", path, err)
+	}
+	for _, endorsement := range endorsements {
+		if err := endorsement.PublicKey.parse(); err != nil {
+			return nil, fmt.Errorf("invalid key for sub-CA %s in %s: %w", endorsement.Name, path, err)
+		}
+		registry.endorsements[endorsement.Name] = endorsement
+	}
+	return registry, nil
+}
+
+// list returns the endorsements, sorted by name.
+func (r *SubCARegistry) list() []Endorsement {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	endorsements := make([]Endorsement, 0, len(r.endorsements))
+	for _, endorsement := range r.endorsements {
+		endorsements = append(endorsements, endorsement)
+	}
+	sort.Slice(endorsements, func(i, j int) bool { return endorsements[i].Name < endorsements[j].Name })
+	return endorsements
+}
+
+// put adds or replaces the endorsement and saves the registry.
+func (r *SubCARegistry) put(endorsement Endorsement) error {
+	r.mu.Lock()
+	r.endorsements[endorsement.Name] = endorsement
+	r.mu.Unlock()
+	return r.save()
+}
+
+// save writes the registry, replacing the old file atomically.
+func (r *SubCARegistry) save() error {
+	data, err := json.MarshalIndent(r.list(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sub-CA registry: %w", err)
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(r.path), ".sshca-sub-cas.")
+	if err != nil {
+		return fmt.Errorf("failed to write sub-CA registry: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile.Name(), r.path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write sub-CA registry: %w", err)
+	}
+	return nil
+}
+
+// CrossCertify endorses another CA key as a sub-CA of this one, after
+// confirmation. The endorsement is stored in the registry, so it is included in
+// the trust bundle. Relying parties trust sub-CAs like the CA itself, so
+// requests from other processes always need a TOTP code (if the server
+// requires them) and confirmation, by the quorum if there is one, even if
+// confirmation of signing requests is skipped.
+func (ca *Server) CrossCertify(args CrossCertifyArgs, reply *CrossCertifyReply) error {
+	ca = ca.withCurrentPolicy()
+	if ca.SubCAs == nil {
+		return fmt.Errorf("sub-CAs are not enabled on this server")
+	}
+	if args.Name == "" || strings.ContainsAny(args.Name, "\n") {
+		return fmt.Errorf("invalid sub-CA name %q", args.Name)
+	}
+	if args.Validity < 0 {
+		return fmt.Errorf("validity must not be negative")
+	}
+	if err := args.PublicKey.validateSubmitted(); err != nil {
+		return fmt.Errorf("sub-CA key rejected: %w", err)
+	}
+	if err := ca.algorithms.CheckKey(args.PublicKey); err != nil {
+		return fmt.Errorf("sub-CA key rejected: %w", err)
+	}
+	if !ca.SSHKeygen.Version.Supports(openssh.SignData) {
+		return fmt.Errorf("%s does not support %s (needs %s)", ca.SSHKeygen.Version, openssh.SignData.Description, openssh.SignData.Since)
+	}
+
+	if args.remote && ca.SkipConfirmation {
+		return fmt.Errorf("cross-certifying needs confirmation, which this server skips")
+	}
+	description := args.String()
+	totpClient, err := ca.TOTP.check(SignArgs{TOTPClient: args.TOTPClient, TOTPCode: args.TOTPCode, clientAddr: args.clientAddr, connection: args.connection}, ca.totpCodes, ca.totpFailures, time.Now())
+	if err != nil {
+		return fmt.Errorf("TOTP code rejected: %w", err)
+	}
+	if totpClient != "" {
+		description += fmt.Sprintf("\nauthenticated with the TOTP code of %s", totpClient)
+	}
+	var approval Approval
+	if ca.Quorum.Approvals >= 2 {
+		description += fmt.Sprintf("\nsensitive (sub-CA): needs %d different approvers", ca.Quorum.Approvals)
+		approval, err = ca.confirmQuorum(context.Background(), description)
+	} else {
+		approval, err = ca.confirmRequest(context.Background(), description)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to confirm request: %w", err)
+	}
+	defer approval.Done()
+
+	ca.sshKeygenLock.Lock()
+	defer ca.sshKeygenLock.Unlock()
+
+	endorsement := Endorsement{Name: args.Name, PublicKey: args.PublicKey}
+	if args.Validity != 0 {
+		endorsement.NotAfter = time.Now().Add(args.Validity).Truncate(time.Second)
+	}
+
+	tempDir, err := newTempDir(ca.SSHKeygen.TempDir)
+	if err != nil {
+		return err
+	}
+	defer tempDir.remove()
+	messagePath, err := tempDir.writeFile("endorsement", endorsement.Message(), 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write endorsement to disk: %w", err)
+	}
+	err = ca.SSHKeygen.run([]string{"-Y", "sign", "-f", ca.PrivateKeyPath, "-n", EndorsementNamespace, messagePath}, ca.Reporter)
+	if err != nil {
+		return err
+	}
+	ca.Reporter.Report("")
+	endorsement.Signature, err = ioutil.ReadFile(messagePath + ".sig")
+	if err != nil {
+		return fmt.Errorf("failed to read signature from disk: %w", err)
+	}
+	if err := endorsement.Verify(ca.PublicKey, time.Now()); err != nil {
+		return err
+	}
+
+	if err := ca.SubCAs.put(endorsement); err != nil {
+		return err
+	}
+	reply.Endorsement = endorsement
+	return nil
+}
+
+// GetTrustBundle returns the CA public key and the endorsed sub-CAs.
+func (ca Server) GetTrustBundle(args struct{}, reply *TrustBundleReply) error {
+	reply.CAPublicKey = ca.PublicKey
+	if ca.SubCAs != nil {
+		reply.SubCAs = ca.SubCAs.list()
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package ca
+
+import (
+	"net"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSubCATestServer(t *testing.T) (Server, string) {
+	t.Helper()
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	registryPath := filepath.Join(t.TempDir(), "sub-cas.json")
+	server.SubCAs, err = LoadSubCARegistry(registryPath)
+	assert.Nil(t, err)
+	return server, registryPath
+}
+
+func crossCertify(t *testing.T, server *Server, args CrossCertifyArgs) Endorsement {
+	t.Helper()
+	var reply CrossCertifyReply
+	assert.Nil(t, server.CrossCertify(args, &reply))
+	return reply.Endorsement
+}
+
+func TestServerCrossCertify(t *testing.T) {
+	server, registryPath := newSubCATestServer(t)
+	endorsement := crossCertify(t, &server, CrossCertifyArgs{Name: "team", PublicKey: testPublicKey})
+	assert.Nil(t, endorsement.Verify(server.PublicKey, time.Now()))
+	assert.True(t, endorsement.NotAfter.IsZero())
+
+	registry, err := LoadSubCARegistry(registryPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"team"}, endorsementNames(registry.list()))
+	assert.Nil(t, registry.list()[0].Verify(server.PublicKey, time.Now()))
+}
+
+func endorsementNames(endorsements []Endorsement) []string {
+	names := make([]string, 0, len(endorsements))
+	for _, endorsement := range endorsements {
+		names = append(names, endorsement.Name)
+	}
+	return names
+}
+
+func TestServerCrossCertifyRotates(t *testing.T) {
+	server, _ := newSubCATestServer(t)
+	crossCertify(t, &server, CrossCertifyArgs{Name: "team", PublicKey: testPublicKey})
+	crossCertify(t, &server, CrossCertifyArgs{Name: "other", PublicKey: testPublicKey})
+	rotated := mustNewPublicKey(t, "./testdata/ecdsa.pub")
+	crossCertify(t, &server, CrossCertifyArgs{Name: "team", PublicKey: rotated})
+
+	var bundle TrustBundleReply
+	assert.Nil(t, server.GetTrustBundle(struct{}{}, &bundle))
+	assert.Equal(t, server.PublicKey, bundle.CAPublicKey)
+	assert.Equal(t, []string{"other", "team"}, endorsementNames(bundle.SubCAs))
+	assert.Equal(t, rotated.String(), bundle.SubCAs[1].PublicKey.String())
+}
+
+func TestEndorsementVerifyRejectsTampering(t *testing.T) {
+	server, _ := newSubCATestServer(t)
+	endorsement := crossCertify(t, &server, CrossCertifyArgs{Name: "team", PublicKey: testPublicKey})
+
+	renamed := endorsement
+	renamed.Name = "admin"
+	assert.Error(t, renamed.Verify(server.PublicKey, time.Now()))
+
+	rekeyed := endorsement
+	rekeyed.PublicKey = mustNewPublicKey(t, "./testdata/ecdsa.pub")
+	assert.Error(t, rekeyed.Verify(server.PublicKey, time.Now()))
+
+	assert.Error(t, endorsement.Verify(testPublicKey, time.Now()))
+}
+
+func TestEndorsementVerifyExpiry(t *testing.T) {
+	server, _ := newSubCATestServer(t)
+	endorsement := crossCertify(t, &server, CrossCertifyArgs{Name: "team", PublicKey: testPublicKey, Validity: time.Hour})
+	assert.Nil(t, endorsement.Verify(server.PublicKey, time.Now()))
+	assert.Error(t, endorsement.Verify(server.PublicKey, time.Now().Add(2*time.Hour)))
+}
+
+func TestServerCrossCertifyDisabled(t *testing.T) {
+	server, err := NewServer("./testdata/ca", "", true)
+	assert.Nil(t, err)
+	var reply CrossCertifyReply
+	err = server.CrossCertify(CrossCertifyArgs{Name: "team", PublicKey: testPublicKey}, &reply)
+	assert.EqualError(t, err, "sub-CAs are not enabled on this server")
+
+	var bundle TrustBundleReply
+	assert.Nil(t, server.GetTrustBundle(struct{}{}, &bundle))
+	assert.Empty(t, bundle.SubCAs)
+}
+
+func TestServerCrossCertifyRemoteNeedsConfirmation(t *testing.T) {
+	server, registryPath := newSubCATestServer(t)
+	remote := connection{Server: &server, remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}}
+	var reply CrossCertifyReply
+	err := remote.CrossCertify(CrossCertifyArgs{Name: "team", PublicKey: testPublicKey}, &reply)
+	assert.EqualError(t, err, "cross-certifying needs confirmation, which this server skips")
+	registry, err := LoadSubCARegistry(registryPath)
+	assert.Nil(t, err)
+	assert.Empty(t, registry.list())
+
+	// The in-process server of --local has the CA key anyway
+	local := connection{Server: &server, inProcess: true}
+	assert.Nil(t, local.CrossCertify(CrossCertifyArgs{Name: "team", PublicKey: testPublicKey}, &reply))
+}
+
+func TestServerCrossCertifyQuorum(t *testing.T) {
+	server, _ := newSubCATestServer(t)
+	server.SkipConfirmation = false
+	server.Quorum = testQuorum
+	interactor := &approverSequence{approvers: []string{"webhook:alice", "webhook:bob"}}
+	server.Interactor = interactor
+	remote := connection{Server: &server, remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}}
+	var reply CrossCertifyReply
+	assert.Nil(t, remote.CrossCertify(CrossCertifyArgs{Name: "team", PublicKey: testPublicKey}, &reply))
+	assert.Len(t, interactor.descriptions, 2)
+	assert.Contains(t, interactor.descriptions[0], "sensitive (sub-CA): needs 2 different approvers")
+
+	interactor.approvers = []string{"webhook:alice"}
+	assert.Error(t, remote.CrossCertify(CrossCertifyArgs{Name: "other", PublicKey: testPublicKey}, &reply))
+}
+
+func TestServerCrossCertifyTOTP(t *testing.T) {
+	server, _ := newSubCATestServer(t)
+	server.SkipConfirmation = false
+	server.Interactor = interactorFunc(func(description string) error { return nil })
+	server.TOTP = TOTPPolicy{Secrets: map[string][]byte{"alice": rfc6238Secret}}
+	remote := connection{Server: &server, remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}}
+	var reply CrossCertifyReply
+	err := remote.CrossCertify(CrossCertifyArgs{Name: "team", PublicKey: testPublicKey}, &reply)
+	assert.Contains(t, err.Error(), "TOTP code rejected")
+
+	code := GenerateTOTP(rfc6238Secret, time.Now())
+	assert.Nil(t, remote.CrossCertify(CrossCertifyArgs{Name: "team", PublicKey: testPublicKey, TOTPClient: "alice", TOTPCode: code}, &reply))
+}
+
+func TestServerCrossCertifyInvalidName(t *testing.T) {
+	server, _ := newSubCATestServer(t)
+	var reply CrossCertifyReply
+	assert.Error(t, server.CrossCertify(CrossCertifyArgs{PublicKey: testPublicKey}, &reply))
+}
+
+func TestVerifySSHSigRejectsGarbage(t *testing.T) {
+	assert.Error(t, verifySSHSig(testPublicKey, EndorsementNamespace, []byte("message"), []byte("not a signature")))
+}
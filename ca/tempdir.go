@@ -0,0 +1,119 @@
+package ca
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The files passed to ssh-keygen are tied to issued certificates, and ssh-keygen
+// runs the askpass script to get the CA key passphrase, so they are written to
+// a private directory that is overwritten and removed as soon as the request
+// is done, including when the server is stopped by a signal.
+
+// liveTempDirs are the paths of the temporary directories that haven't been
+// removed yet.
+var liveTempDirs = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// tempDir is a private directory for the files of one ssh-keygen run.
+type tempDir struct {
+	path string
+}
+
+// newTempDir creates a directory that only the current user can access in
+// root (or the default temporary directory if root is empty).
+func newTempDir(root string) (*tempDir, error) {
+	path, err := ioutil.TempDir(root, "sshca.")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	// TempDir already uses 0700, but don't depend on it
+	if err := os.Chmod(path, 0o700); err != nil {
+		os.RemoveAll(path)
+		return nil, fmt.Errorf("failed to restrict temporary directory: %w", err)
+	}
+	liveTempDirs.Lock()
+	liveTempDirs.paths[path] = true
+	liveTempDirs.Unlock()
+	return &tempDir{path}, nil
+}
+
+// join returns the path of name in the directory.
+func (d *tempDir) join(name string) string {
+	return filepath.Join(d.path, name)
+}
+
+// writeFile creates the file name in the directory with the contents. It fails
+// if the file already exists, so that a file planted in the directory can't be
+// used instead.
+func (d *tempDir) writeFile(name string, contents []byte, perm os.FileMode) (string, error) {
+	path := d.join(name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(contents)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return path, err
+}
+
+// remove overwrites the files in the directory with zeros and removes it.
+// Overwriting is best-effort: it is only effective on filesystems that write
+// in place, such as tmpfs.
+func (d *tempDir) remove() error {
+	liveTempDirs.Lock()
+	delete(liveTempDirs.paths, d.path)
+	liveTempDirs.Unlock()
+	return removeTempDir(d.path)
+}
+
+// removeTempDir overwrites and removes the directory at path.
+func removeTempDir(path string) error {
+	filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			overwriteFile(file, info.Size())
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
+
+// overwriteFile replaces the contents of the file at path with size zeros.
+func overwriteFile(path string, size int64) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	zeros := make([]byte, 4096)
+	for size > 0 {
+		n := int64(len(zeros))
+		if size < n {
+			n = size
+		}
+		if _, err := f.Write(zeros[:n]); err != nil {
+			return
+		}
+		size -= n
+	}
+	f.Sync()
+}
+
+// RemoveTempDirs removes the temporary directories of the requests that are in
+// progress. It is called when the server is stopped by a signal, where the
+// requests don't get to clean up.
+func RemoveTempDirs() {
+	liveTempDirs.Lock()
+	defer liveTempDirs.Unlock()
+	for path := range liveTempDirs.paths {
+		removeTempDir(path)
+		delete(liveTempDirs.paths, path)
+	}
+}
@@ -0,0 +1,66 @@
+package ca
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTempDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "sshca-test.")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	dir, err := newTempDir(root)
+	assert.Nil(t, err)
+	info, err := os.Stat(dir.path)
+	assert.Nil(t, err)
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+	}
+
+	path, err := dir.writeFile("key.pub", []byte("key"), 0o600)
+	assert.Nil(t, err)
+	assert.Equal(t, dir.join("key.pub"), path)
+	// Existing files aren't reused
+	_, err = dir.writeFile("key.pub", []byte("other"), 0o600)
+	assert.Error(t, err)
+
+	assert.Nil(t, dir.remove())
+	_, err = os.Stat(dir.path)
+	assert.True(t, os.IsNotExist(err))
+	assert.False(t, liveTempDirs.paths[dir.path])
+}
+
+func TestOverwriteFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "sshca-test.")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("secret")
+	f.Close()
+
+	overwriteFile(f.Name(), 6)
+	contents, err := ioutil.ReadFile(f.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 6), contents)
+}
+
+func TestRemoveTempDirs(t *testing.T) {
+	root, err := ioutil.TempDir("", "sshca-test.")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	dir, err := newTempDir(root)
+	assert.Nil(t, err)
+	_, err = dir.writeFile("key.pub", []byte("key"), 0o600)
+	assert.Nil(t, err)
+
+	RemoveTempDirs()
+	_, err = os.Stat(dir.path)
+	assert.True(t, os.IsNotExist(err))
+	// Removing it again after the signal is harmless
+	assert.Nil(t, dir.remove())
+}
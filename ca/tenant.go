@@ -0,0 +1,58 @@
+package ca
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var tenantNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// NewTenant creates a CA with its own key that is served alongside ca under
+// TenantService(name). The tenant starts with the same ssh-keygen, approval
+// and request checks as ca, which can then be changed independently. Signing
+// for all tenants is serialised, since they share the operator terminal.
+func (ca *Server) NewTenant(name string, privateKeyPath string, publicKeyPath string) (*Server, error) {
+	if !tenantNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("invalid tenant name %q: must be lowercase letters, digits, '-' or '_'", name)
+	}
+	if _, ok := ca.Tenants[name]; ok {
+		return nil, fmt.Errorf("duplicate tenant %q", name)
+	}
+
+	tenant, err := NewServer(privateKeyPath, publicKeyPath, ca.SkipConfirmation)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %s: %w", name, err)
+	}
+	tenant.Name = name
+	tenant.SSHKeygen = ca.SSHKeygen
+	tenant.sshKeygenLock = ca.sshKeygenLock
+	tenant.Interactor = ca.Interactor
+	tenant.Reporter = ca.Reporter
+	tenant.ConfirmationTimeout = ca.ConfirmationTimeout
+	tenant.UserValidity = ca.UserValidity
+	tenant.HostValidity = ca.HostValidity
+	tenant.Backdate = ca.Backdate
+	tenant.HostDNS = ca.HostDNS
+	tenant.RequireProof = ca.RequireProof
+	tenant.Principals = ca.Principals
+	tenant.Extensions = ca.Extensions
+	tenant.Delivery = ca.Delivery
+	tenant.Groups = ca.Groups
+	tenant.TOTP = ca.TOTP
+	// A code can only be used once, whichever tenant it is sent to
+	tenant.totpCodes = ca.totpCodes
+	tenant.totpFailures = ca.totpFailures
+	tenant.Quorum = ca.Quorum
+	tenant.BreakGlass = ca.BreakGlass
+	tenant.Alerts = ca.Alerts
+	tenant.SignIssuances = ca.SignIssuances
+	if err := tenant.SetAlgorithmPolicy(ca.algorithms); err != nil {
+		return nil, fmt.Errorf("tenant %s: %w", name, err)
+	}
+
+	if ca.Tenants == nil {
+		ca.Tenants = map[string]*Server{}
+	}
+	ca.Tenants[name] = &tenant
+	return &tenant, nil
+}
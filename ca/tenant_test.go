@@ -0,0 +1,64 @@
+package ca
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTenant(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	server.UserValidity = ValidityPolicy{Max: time.Hour}
+	tenant, err := server.NewTenant("team-a", "./testdata/ca", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "team-a", tenant.Name)
+	assert.Equal(t, server.UserValidity, tenant.UserValidity)
+	assert.True(t, server.sshKeygenLock == tenant.sshKeygenLock)
+	assert.True(t, server.totpCodes == tenant.totpCodes, "TOTP codes are single-use across tenants")
+	assert.True(t, tenant == server.Tenants["team-a"])
+}
+
+func TestNewTenantInvalidName(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	for _, name := range []string{"", "Team", "a.b", "a/b", "-a"} {
+		_, err := server.NewTenant(name, "./testdata/ca", "")
+		assert.Error(t, err, name)
+	}
+}
+
+func TestNewTenantDuplicate(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	_, err = server.NewTenant("a", "./testdata/ca", "")
+	assert.Nil(t, err)
+	_, err = server.NewTenant("a", "./testdata/ca", "")
+	assert.Error(t, err)
+}
+
+func TestClientSelectsTenant(t *testing.T) {
+	server, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	_, err = server.NewTenant("a", "./testdata/ca", "")
+	assert.Nil(t, err)
+	client, err := Dial([]string{serveTestServer(t, &server)}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+
+	reply, err := client.GetCAPublicKey()
+	assert.Nil(t, err)
+	assert.Equal(t, testPublicKey.Data, reply.CAPublicKey.Data)
+
+	client.Service = TenantService("a")
+	caPublicKey, err := NewPublicKey("./testdata/ca.pub")
+	assert.Nil(t, err)
+	reply, err = client.GetCAPublicKey()
+	assert.Nil(t, err)
+	assert.Equal(t, caPublicKey.Data, reply.CAPublicKey.Data)
+
+	client.Service = TenantService("b")
+	_, err = client.GetCAPublicKey()
+	assert.Error(t, err)
+}
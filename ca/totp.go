@@ -0,0 +1,229 @@
+package ca
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTPStep is the time step of TOTP codes, which are valid for one step on
+// either side of the current one to allow for clock skew.
+const TOTPStep = 30 * time.Second
+
+// totpDigits is the length of TOTP codes.
+const totpDigits = 6
+
+// maxTOTPFailures is how many invalid codes a client, or a remote host, can
+// send within totpFailureWindow before its requests are rejected without
+// checking the code, so that the 3 codes accepted at any time can't be
+// guessed.
+const maxTOTPFailures = 10
+
+// totpFailureWindow is how long invalid codes count towards maxTOTPFailures.
+const totpFailureWindow = 10 * time.Minute
+
+// TOTPPolicy requires signing requests to carry a TOTP code (RFC 6238) of the
+// client that sent them, so that a server that skips confirmation doesn't
+// sign for anyone who can reach it.
+type TOTPPolicy struct {
+	// Secrets maps the names of clients to their shared secrets. Empty
+	// doesn't require codes.
+	Secrets map[string][]byte
+}
+
+// NewTOTPSecret generates a random shared secret for a client.
+func NewTOTPSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate TOTP secret: %w", err)
+	}
+	return secret, nil
+}
+
+// EncodeTOTPSecret encodes secret as unpadded base32, the format used by
+// authenticator apps.
+func EncodeTOTPSecret(secret []byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+}
+
+// DecodeTOTPSecret decodes a base32 secret, ignoring case, spaces and
+// padding.
+func DecodeTOTPSecret(encoded string) ([]byte, error) {
+	encoded = strings.TrimRight(strings.ToUpper(strings.Join(strings.Fields(encoded), "")), "=")
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TOTP secret: %w", err)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("invalid TOTP secret: empty")
+	}
+	return secret, nil
+}
+
+// totpStep returns the time step that t is in.
+func totpStep(t time.Time) uint64 {
+	return uint64(t.Unix()) / uint64(TOTPStep/time.Second)
+}
+
+// totpCode returns the code for secret in a time step.
+func totpCode(secret []byte, step uint64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], step)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// GenerateTOTP returns the TOTP code for secret at t.
+func GenerateTOTP(secret []byte, t time.Time) string {
+	return totpCode(secret, totpStep(t))
+}
+
+// check returns an error unless the request carries a valid code for its
+// client, which hasn't been used before on another connection. It returns the
+// client that sent the request, or the empty string if codes aren't
+// required. Invalid codes are counted in failures, and clients or remote
+// hosts with too many of them are rejected.
+func (p TOTPPolicy) check(args SignArgs, used *usedTOTPCodes, failures *totpFailures, now time.Time) (string, error) {
+	if len(p.Secrets) == 0 {
+		return "", nil
+	}
+	if args.TOTPClient == "" || args.TOTPCode == "" {
+		return "", fmt.Errorf("a TOTP code is required (sign_user --totp-client and --totp-code)")
+	}
+	sources := failureSources(args)
+	if failures.locked(sources, now) {
+		return "", fmt.Errorf("too many invalid TOTP codes for %s, try again later", args.TOTPClient)
+	}
+	secret, ok := p.Secrets[args.TOTPClient]
+	if !ok {
+		failures.add(sources, now)
+		return "", fmt.Errorf("invalid TOTP code for %s", args.TOTPClient)
+	}
+	current := totpStep(now)
+	for step := current - 1; step <= current+1; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(args.TOTPCode)) != 1 {
+			continue
+		}
+		if !used.use(args.TOTPClient, step, current, args.connection) {
+			return "", fmt.Errorf("the TOTP code for %s has already been used", args.TOTPClient)
+		}
+		return args.TOTPClient, nil
+	}
+	failures.add(sources, now)
+	return "", fmt.Errorf("invalid TOTP code for %s", args.TOTPClient)
+}
+
+// failureSources returns the client and remote host that invalid codes in
+// the request are counted against.
+func failureSources(args SignArgs) []string {
+	sources := []string{"client " + args.TOTPClient}
+	if ip := clientIP(args.clientAddr); ip != nil {
+		sources = append(sources, "host "+ip.String())
+	}
+	return sources
+}
+
+// totpFailures counts the invalid TOTP codes recently sent by each client
+// and remote host, whichever tenant they were sent to.
+type totpFailures struct {
+	mu sync.Mutex
+	// times maps each source to the times of its failures within
+	// totpFailureWindow.
+	times map[string][]time.Time
+}
+
+func newTOTPFailures() *totpFailures {
+	return &totpFailures{times: map[string][]time.Time{}}
+}
+
+// locked reports whether any of the sources has reached maxTOTPFailures.
+func (f *totpFailures) locked(sources []string, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.forget(now)
+	for _, source := range sources {
+		if len(f.times[source]) >= maxTOTPFailures {
+			return true
+		}
+	}
+	return false
+}
+
+// add records a failure for each of the sources.
+func (f *totpFailures) add(sources []string, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, source := range sources {
+		f.times[source] = append(f.times[source], now)
+	}
+}
+
+// forget drops the failures that are older than totpFailureWindow. f.mu must
+// be held.
+func (f *totpFailures) forget(now time.Time) {
+	for source, times := range f.times {
+		recent := times[:0]
+		for _, t := range times {
+			if now.Sub(t) < totpFailureWindow {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(f.times, source)
+		} else {
+			f.times[source] = recent
+		}
+	}
+}
+
+// usedTOTPCodes remembers the codes that have been accepted, so that a code
+// that was seen on the network can't be used again (for any key, or with any
+// tenant) while it is still valid. A code authorises all the requests on the
+// connection that first used it, so that clients can sign several keys (e.g.
+// all the host keys) with one code.
+type usedTOTPCodes struct {
+	mu sync.Mutex
+	// codes maps each client and step to the code that was used.
+	codes map[string]usedTOTPCode
+}
+
+// usedTOTPCode is a code that has been accepted.
+type usedTOTPCode struct {
+	step       uint64
+	connection uint64
+}
+
+func newUsedTOTPCodes() *usedTOTPCodes {
+	return &usedTOTPCodes{codes: map[string]usedTOTPCode{}}
+}
+
+// use records a code of client from step, sent on connection. It returns
+// false if it was already used, unless it was on the same connection (other
+// than 0). Codes that can no longer be valid at the current step are
+// forgotten.
+func (u *usedTOTPCodes) use(client string, step uint64, current uint64, connection uint64) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, used := range u.codes {
+		if used.step+1 < current {
+			delete(u.codes, key)
+		}
+	}
+	key := fmt.Sprintf("%s %d", client, step)
+	if used, ok := u.codes[key]; ok {
+		return connection != 0 && used.connection == connection
+	}
+	u.codes[key] = usedTOTPCode{step: step, connection: connection}
+	return true
+}
@@ -0,0 +1,114 @@
+package ca
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rfc6238Secret is the SHA-1 secret of the RFC 6238 test vectors.
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestGenerateTOTP(t *testing.T) {
+	// The RFC test vectors have 8 digits, of which the last 6 are the codes
+	assert.Equal(t, "287082", GenerateTOTP(rfc6238Secret, time.Unix(59, 0)))
+	assert.Equal(t, "081804", GenerateTOTP(rfc6238Secret, time.Unix(1111111109, 0)))
+	assert.Equal(t, "050471", GenerateTOTP(rfc6238Secret, time.Unix(1111111111, 0)))
+}
+
+func TestTOTPSecretEncoding(t *testing.T) {
+	encoded := EncodeTOTPSecret(rfc6238Secret)
+	assert.Equal(t, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", encoded)
+	decoded, err := DecodeTOTPSecret("gezd gnbv gy3t qojq gezd gnbv gy3t qojq")
+	assert.Nil(t, err)
+	assert.Equal(t, rfc6238Secret, decoded)
+	_, err = DecodeTOTPSecret("not base32!")
+	assert.Error(t, err)
+}
+
+func TestTOTPPolicyCheck(t *testing.T) {
+	policy := TOTPPolicy{Secrets: map[string][]byte{"ci": rfc6238Secret}}
+	now := time.Unix(1111111109, 0)
+	args := func(client string, code string) SignArgs {
+		return SignArgs{PublicKey: testPublicKey, TOTPClient: client, TOTPCode: code}
+	}
+
+	_, err := TOTPPolicy{}.check(args("", ""), newUsedTOTPCodes(), newTOTPFailures(), now)
+	assert.Nil(t, err, "codes aren't required without secrets")
+	_, err = policy.check(args("", ""), newUsedTOTPCodes(), newTOTPFailures(), now)
+	assert.Error(t, err)
+	_, err = policy.check(args("other", "081804"), newUsedTOTPCodes(), newTOTPFailures(), now)
+	assert.Error(t, err)
+	_, err = policy.check(args("ci", "123456"), newUsedTOTPCodes(), newTOTPFailures(), now)
+	assert.Error(t, err)
+
+	used := newUsedTOTPCodes()
+	client, err := policy.check(args("ci", "081804"), used, newTOTPFailures(), now)
+	assert.Nil(t, err)
+	assert.Equal(t, "ci", client)
+	_, err = policy.check(args("ci", "081804"), used, newTOTPFailures(), now)
+	assert.Error(t, err, "codes can't be used again for the same key")
+
+	_, err = policy.check(args("ci", GenerateTOTP(rfc6238Secret, now.Add(-TOTPStep))), newUsedTOTPCodes(), newTOTPFailures(), now)
+	assert.Nil(t, err, "the previous code is accepted for clock skew")
+	_, err = policy.check(args("ci", GenerateTOTP(rfc6238Secret, now.Add(-3*TOTPStep))), newUsedTOTPCodes(), newTOTPFailures(), now)
+	assert.Error(t, err)
+}
+
+func TestTOTPPolicyCheckRejectsReplayForOtherKey(t *testing.T) {
+	policy := TOTPPolicy{Secrets: map[string][]byte{"ci": rfc6238Secret}}
+	now := time.Unix(1111111109, 0)
+	used := newUsedTOTPCodes()
+	_, err := policy.check(SignArgs{PublicKey: testPublicKey, TOTPClient: "ci", TOTPCode: "081804"}, used, newTOTPFailures(), now)
+	assert.Nil(t, err)
+
+	// A captured code can't be used to sign another key
+	other := SignArgs{PublicKey: mustNewPublicKey(t, "./testdata/ca.pub"), TOTPClient: "ci", TOTPCode: "081804"}
+	_, err = policy.check(other, used, newTOTPFailures(), now)
+	assert.EqualError(t, err, "the TOTP code for ci has already been used")
+}
+
+func TestTOTPPolicyCheckLimitsFailures(t *testing.T) {
+	policy := TOTPPolicy{Secrets: map[string][]byte{"ci": rfc6238Secret, "laptop": rfc6238Secret}}
+	now := time.Unix(1111111109, 0)
+	attacker := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	failures := newTOTPFailures()
+	for i := 0; i < maxTOTPFailures; i++ {
+		_, err := policy.check(SignArgs{TOTPClient: "ci", TOTPCode: "123456", clientAddr: attacker}, newUsedTOTPCodes(), failures, now)
+		assert.EqualError(t, err, "invalid TOTP code for ci")
+	}
+
+	// Even the right code is rejected for the client, and from the host
+	_, err := policy.check(SignArgs{TOTPClient: "ci", TOTPCode: "081804"}, newUsedTOTPCodes(), failures, now)
+	assert.EqualError(t, err, "too many invalid TOTP codes for ci, try again later")
+	_, err = policy.check(SignArgs{TOTPClient: "laptop", TOTPCode: "081804", clientAddr: attacker}, newUsedTOTPCodes(), failures, now)
+	assert.EqualError(t, err, "too many invalid TOTP codes for laptop, try again later")
+	other := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 22}
+	_, err = policy.check(SignArgs{TOTPClient: "laptop", TOTPCode: "081804", clientAddr: other}, newUsedTOTPCodes(), failures, now)
+	assert.Nil(t, err)
+
+	// Failures are forgotten after the window
+	later := now.Add(totpFailureWindow)
+	_, err = policy.check(SignArgs{TOTPClient: "ci", TOTPCode: GenerateTOTP(rfc6238Secret, later), clientAddr: attacker}, newUsedTOTPCodes(), failures, later)
+	assert.Nil(t, err)
+}
+
+func TestTOTPPolicyCheckAllowsReuseOnSameConnection(t *testing.T) {
+	policy := TOTPPolicy{Secrets: map[string][]byte{"ci": rfc6238Secret}}
+	now := time.Unix(1111111109, 0)
+	used := newUsedTOTPCodes()
+	failures := newTOTPFailures()
+	_, err := policy.check(SignArgs{PublicKey: testPublicKey, TOTPClient: "ci", TOTPCode: "081804", connection: 1}, used, failures, now)
+	assert.Nil(t, err)
+
+	// The other host keys of sign_host are signed on the same connection
+	other := SignArgs{PublicKey: mustNewPublicKey(t, "./testdata/ca.pub"), TOTPClient: "ci", TOTPCode: "081804", connection: 1}
+	_, err = policy.check(other, used, failures, now)
+	assert.Nil(t, err)
+
+	other.connection = 2
+	_, err = policy.check(other, used, failures, now)
+	assert.EqualError(t, err, "the TOTP code for ci has already been used")
+}
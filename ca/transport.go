@@ -0,0 +1,181 @@
+package ca
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport connects a Client to a server. The transport of a remote is
+// selected by the scheme of its URL, e.g. unix:///run/sshca.sock; remotes
+// without a scheme use TCP.
+type Transport interface {
+	// Dial connects to the server at addr, which is the remote without its
+	// scheme.
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+}
+
+// TransportFunc adapts a function to a Transport.
+type TransportFunc func(addr string, timeout time.Duration) (net.Conn, error)
+
+// Dial implementation for Transport
+func (f TransportFunc) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return f(addr, timeout)
+}
+
+// DefaultScheme is the scheme of remotes that don't have one.
+const DefaultScheme = "tcp"
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]Transport{
+		"tcp":  TransportFunc(dialTCP),
+		"tls":  TransportFunc(dialTLS),
+		"unix": TransportFunc(dialUnix),
+		"ssh":  SSHTransport{SSHPath: "ssh"},
+	}
+)
+
+// RegisterTransport makes a transport available for remotes with the URL
+// scheme, replacing any transport that the scheme already had.
+func RegisterTransport(scheme string, transport Transport) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[scheme] = transport
+}
+
+// lookupTransport returns the transport registered for scheme.
+func lookupTransport(scheme string) (Transport, bool) {
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	transport, ok := transports[scheme]
+	return transport, ok
+}
+
+// SplitRemote splits a remote into the scheme of its transport and the address
+// that the transport dials. Remotes without a scheme use DefaultScheme.
+func SplitRemote(remote string) (string, string) {
+	if i := strings.Index(remote, "://"); i != -1 {
+		return remote[:i], remote[i+len("://"):]
+	}
+	return DefaultScheme, remote
+}
+
+// CheckRemote returns an error if the scheme of remote has no transport.
+func CheckRemote(remote string) error {
+	scheme, _ := SplitRemote(remote)
+	if _, ok := lookupTransport(scheme); !ok {
+		return fmt.Errorf("unknown transport %q in %s", scheme, remote)
+	}
+	return nil
+}
+
+// dialRemote connects to remote with the transport of its scheme.
+func dialRemote(remote string, timeout time.Duration) (net.Conn, error) {
+	scheme, addr := SplitRemote(remote)
+	transport, ok := lookupTransport(scheme)
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q", scheme)
+	}
+	return transport.Dial(addr, timeout)
+}
+
+// dialTCP connects to a host:port address.
+func dialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// dialTLS connects to a host:port address with TLS, verifying the certificate
+// of the server against the system roots. The server itself doesn't speak
+// TLS, so this is for servers behind a TLS-terminating proxy.
+func dialTLS(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{})
+}
+
+// dialUnix connects to the Unix socket at the path addr.
+func dialUnix(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("unix", addr, timeout)
+}
+
+// SSHTransport tunnels the connection over SSH with ssh -W, so a server that
+// only listens on the loopback interface of another host can be used without
+// setting up port forwarding. Its addresses are [user@]host[:port]/target,
+// where target is the address of the server as seen from host (e.g.
+// ssh://admin@ca.example.com/localhost:5000).
+type SSHTransport struct {
+	// SSHPath is the ssh command.
+	SSHPath string
+}
+
+// Dial implementation for Transport
+func (t SSHTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	i := strings.Index(addr, "/")
+	if i == -1 || addr[i+1:] == "" {
+		return nil, fmt.Errorf("ssh remotes must be [user@]host[:port]/target, e.g. ssh://ca.example.com/localhost:5000")
+	}
+	destination, target := addr[:i], addr[i+1:]
+	args := []string{"-W", target, "-o", "BatchMode=yes"}
+	if timeout > 0 {
+		args = append(args, "-o", fmt.Sprintf("ConnectTimeout=%d", int((timeout+time.Second-1)/time.Second)))
+	}
+	// ssh only accepts a port in ssh:// destinations
+	args = append(args, "ssh://"+destination)
+
+	cmd := exec.Command(t.SSHPath, args...)
+	// Connection errors are only printed by ssh
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ssh: %w", err)
+	}
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout, addr: commandAddr("ssh://" + addr)}, nil
+}
+
+// commandConn is a connection over the stdin and stdout of a command.
+// Deadlines aren't supported, and are ignored.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	addr   net.Addr
+	once   sync.Once
+}
+
+func (c *commandConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *commandConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+// Close stops the command.
+func (c *commandConn) Close() error {
+	c.once.Do(func() {
+		c.stdin.Close()
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr                { return commandAddr("") }
+func (c *commandConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// commandAddr is the address of a commandConn.
+type commandAddr string
+
+func (a commandAddr) Network() string { return "command" }
+func (a commandAddr) String() string  { return string(a) }
@@ -0,0 +1,71 @@
+package ca
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitRemote(t *testing.T) {
+	for remote, want := range map[string][2]string{
+		"ca.example.com:5000":                {"tcp", "ca.example.com:5000"},
+		"tcp://ca.example.com:5000":          {"tcp", "ca.example.com:5000"},
+		"unix:///run/sshca.sock":             {"unix", "/run/sshca.sock"},
+		"ssh://admin@bastion/localhost:5000": {"ssh", "admin@bastion/localhost:5000"},
+		"tls://ca.example.com:5000":          {"tls", "ca.example.com:5000"},
+	} {
+		scheme, addr := SplitRemote(remote)
+		assert.Equal(t, want, [2]string{scheme, addr}, remote)
+	}
+}
+
+func TestDialUnixSocket(t *testing.T) {
+	caServer, err := NewServer("./testdata/test", "", true)
+	assert.Nil(t, err)
+	path := filepath.Join(t.TempDir(), "sshca.sock")
+	listener, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	defer listener.Close()
+	go caServer.Accept(listener)
+
+	client, err := Dial([]string{"unix://" + path}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+	reply, err := client.GetCAPublicKey()
+	assert.Nil(t, err)
+	assert.Equal(t, testPublicKey.Data, reply.CAPublicKey.Data)
+}
+
+func TestRegisterTransport(t *testing.T) {
+	addr := startTestServer(t)
+	var dialed string
+	RegisterTransport("test", TransportFunc(func(name string, timeout time.Duration) (net.Conn, error) {
+		dialed = name
+		return net.DialTimeout("tcp", addr, timeout)
+	}))
+
+	addrs, err := ResolveAddresses("test://ca")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test://ca"}, addrs)
+	client, err := Dial(addrs, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+	assert.Equal(t, "ca", dialed)
+	_, err = client.GetCAPublicKey()
+	assert.Nil(t, err)
+}
+
+func TestUnknownTransport(t *testing.T) {
+	_, err := ResolveAddresses("carrier-pigeon://ca")
+	assert.Error(t, err)
+	_, err = Dial([]string{"carrier-pigeon://ca"}, time.Second)
+	assert.Error(t, err)
+}
+
+func TestSSHTransportRequiresTarget(t *testing.T) {
+	_, err := SSHTransport{SSHPath: "ssh"}.Dial("bastion.example.com", time.Second)
+	assert.Error(t, err)
+}
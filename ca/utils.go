@@ -1,19 +1,63 @@
 package ca
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/ratorx/sshca/executor"
+	"github.com/ratorx/sshca/openssh"
 )
 
-func runSSHKeygen(args []string) error {
-	cmd := exec.Command("ssh-keygen", args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// SSHKeygen is the ssh-keygen binary used to sign certificates.
+type SSHKeygen struct {
+	// Path to ssh-keygen. It is looked up in PATH if it is not a path.
+	Path string
+	// Version is used to adapt the generated arguments to the features that
+	// ssh-keygen supports. If it is unknown, all features are assumed to be
+	// supported.
+	Version openssh.Version
+	// NonInteractive runs ssh-keygen without access to the terminal, for servers
+	// that run as a daemon. Its output is captured and included in the error if
+	// it fails, and it fails instead of prompting for input.
+	NonInteractive bool
+	// Passphrase for the CA private key. It is only used in non-interactive
+	// mode, where it is passed to ssh-keygen through SSH_ASKPASS.
+	Passphrase string
+	// Executor runs ssh-keygen. If it is nil, executor.Default is used.
+	Executor executor.Executor
+	// TempDir is where the files passed to ssh-keygen are written, e.g. a
+	// tmpfs so that they never reach the disk. The default temporary directory
+	// is used if it is empty.
+	TempDir string
+}
+
+// DetectSSHKeygen detects the version of the ssh-keygen at path. If detection
+// fails, the returned SSHKeygen is still usable (with an unknown version)
+// alongside the error.
+func DetectSSHKeygen(path string) (SSHKeygen, error) {
+	version, err := openssh.DetectSSHKeygenVersion(path)
+	if err != nil {
+		return SSHKeygen{Path: path}, fmt.Errorf("failed to detect ssh-keygen version: %w", err)
+	}
+	return SSHKeygen{Path: path, Version: version}, nil
+}
+
+// run runs ssh-keygen with args, reporting its output to reporter. In
+// interactive mode, ssh-keygen needs the terminal to prompt for the passphrase,
+// so its output goes directly to the terminal.
+func (k SSHKeygen) run(args []string, reporter Reporter) error {
+	if k.NonInteractive {
+		return k.runNonInteractive(args, reporter)
+	}
+
+	cmd := executor.Command{Path: k.Path, Args: args, Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
 
-	fmt.Printf("ssh-keygen output:\n")
-	if err := cmd.Run(); err != nil {
+	reporter.Report("ssh-keygen output:")
+	if err := executor.OrDefault(k.Executor).Run(cmd); err != nil {
 		// Unwrapping the error is possibly dangerous (might expect to keep using
 		// stderr outside the critical section). Explicitly convert to string before
 		// returning. May not be strictly necessary, but I CBA to test and find out.
@@ -21,3 +65,77 @@ func runSSHKeygen(args []string) error {
 	}
 	return nil
 }
+
+// askpassScript prints the passphrase from the environment, so that it never
+// appears in the script or on the command line.
+const askpassScript = "#!/bin/sh\nprintf '%s\\n' \"$SSHCA_ASKPASS_PASSPHRASE\"\n"
+
+// runNonInteractive runs ssh-keygen with no standard input and captured
+// output. ssh-keygen only reads passphrases from a terminal or SSH_ASKPASS, so
+// without a terminal it either gets the passphrase from the askpass script or
+// fails immediately.
+func (k SSHKeygen) runNonInteractive(args []string, reporter Reporter) error {
+	var output bytes.Buffer
+	cmd := executor.Command{Path: k.Path, Args: args, Stdout: &output, Stderr: &output}
+	cmd.Env = []string{"SSH_ASKPASS_REQUIRE=never"}
+
+	if k.Passphrase != "" {
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("passing a CA key passphrase to ssh-keygen is not supported on Windows")
+		}
+		askpassDir, err := newTempDir(k.TempDir)
+		if err != nil {
+			return err
+		}
+		defer askpassDir.remove()
+		askpassPath, err := askpassDir.writeFile("askpass", []byte(askpassScript), 0o700)
+		if err != nil {
+			return fmt.Errorf("failed to write askpass script: %w", err)
+		}
+		// DISPLAY is needed by versions of ssh-keygen that predate
+		// SSH_ASKPASS_REQUIRE
+		cmd.Env = []string{
+			"SSH_ASKPASS=" + askpassPath,
+			"SSH_ASKPASS_REQUIRE=force",
+			"DISPLAY=sshca:0",
+			"SSHCA_ASKPASS_PASSPHRASE=" + k.Passphrase,
+		}
+	}
+
+	if err := executor.OrDefault(k.Executor).Run(cmd); err != nil {
+		return fmt.Errorf("ssh-keygen failed: %s: %s", err.Error(), strings.TrimSpace(output.String()))
+	}
+	message := "ssh-keygen output:"
+	if output.Len() != 0 {
+		message += "\n" + strings.TrimSuffix(output.String(), "\n")
+	}
+	reporter.Report(message)
+	return nil
+}
+
+// isRevoked checks whether the key or certificate is in the KRL at krlPath
+// with ssh-keygen -Q.
+func (k SSHKeygen) isRevoked(krlPath string, key []byte) (bool, error) {
+	tempDir, err := newTempDir(k.TempDir)
+	if err != nil {
+		return false, err
+	}
+	defer tempDir.remove()
+	keyPath, err := tempDir.writeFile("key.pub", key, 0o600)
+	if err != nil {
+		return false, fmt.Errorf("failed to write key to disk: %w", err)
+	}
+
+	var output bytes.Buffer
+	cmd := executor.Command{Path: k.Path, Args: []string{"-Q", "-f", krlPath, keyPath}, Stdout: &output, Stderr: &output}
+	err = executor.OrDefault(k.Executor).Run(cmd)
+	if err == nil {
+		return false, nil
+	}
+	// ssh-keygen exits with 1 for revoked keys, and 255 for errors
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return true, nil
+	}
+	return false, fmt.Errorf("ssh-keygen failed: %s: %s", err.Error(), strings.TrimSpace(output.String()))
+}
@@ -0,0 +1,69 @@
+package ca
+
+import (
+	"fmt"
+	"time"
+)
+
+// ValidityPolicy controls the validity of the certificates issued by the
+// server for one certificate type.
+type ValidityPolicy struct {
+	// Default is used when the request doesn't specify a validity. Zero means
+	// the certificate is valid forever (unless limited by Max).
+	Default time.Duration
+	// Max is the longest validity that can be issued. Zero means unlimited.
+	Max time.Duration
+	// Clamp reduces requests exceeding Max to Max, instead of rejecting them.
+	Clamp bool
+}
+
+// Apply returns the validity that should be issued for a request. An error is
+// returned if the request exceeds the maximum and the policy doesn't clamp.
+func (p ValidityPolicy) Apply(requested time.Duration) (time.Duration, error) {
+	if requested < 0 {
+		return 0, fmt.Errorf("validity %s must not be negative", requested)
+	}
+
+	if requested == 0 {
+		// The server chooses the validity, so fit the default to the maximum
+		// instead of rejecting.
+		if p.Default == 0 || (p.Max != 0 && p.Default > p.Max) {
+			return p.Max, nil
+		}
+		return p.Default, nil
+	}
+
+	if p.Max != 0 && requested > p.Max {
+		if !p.Clamp {
+			return 0, fmt.Errorf("requested validity %s exceeds the maximum of %s", requested, p.Max)
+		}
+		return p.Max, nil
+	}
+
+	return requested, nil
+}
+
+// MaxBackdate is the longest that certificates can be backdated, so that a
+// misconfiguration can't make certificates valid long before they were issued.
+const MaxBackdate = time.Hour
+
+// sshKeygenTimeFormat is the absolute time format accepted by ssh-keygen -V.
+const sshKeygenTimeFormat = "20060102150405"
+
+// validityArgs converts a validity into ssh-keygen args. Zero validity (valid
+// forever) needs no args. The start of the validity interval is moved backdate
+// into the past, without changing the end. If relative is false, the validity
+// interval is given as absolute times relative to now, for ssh-keygen versions
+// that don't support relative times.
+func validityArgs(validity time.Duration, backdate time.Duration, relative bool, now time.Time) []string {
+	if validity == 0 {
+		return []string{}
+	}
+	if !relative {
+		return []string{"-V", fmt.Sprintf("%s:%s", now.Add(-backdate).Format(sshKeygenTimeFormat), now.Add(validity).Format(sshKeygenTimeFormat))}
+	}
+	if backdate != 0 {
+		return []string{"-V", fmt.Sprintf("-%ds:+%ds", int64(backdate/time.Second), int64(validity/time.Second))}
+	}
+	return []string{"-V", fmt.Sprintf("+%ds", int64(validity/time.Second))}
+}
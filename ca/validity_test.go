@@ -0,0 +1,68 @@
+package ca
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidityPolicyApplyDefault(t *testing.T) {
+	p := ValidityPolicy{Default: time.Hour, Max: 24 * time.Hour}
+	validity, err := p.Apply(0)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, validity)
+}
+
+func TestValidityPolicyApplyDefaultForeverWithMax(t *testing.T) {
+	p := ValidityPolicy{Max: 24 * time.Hour}
+	validity, err := p.Apply(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 24*time.Hour, validity)
+}
+
+func TestValidityPolicyApplyUnlimited(t *testing.T) {
+	validity, err := ValidityPolicy{}.Apply(0)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), validity)
+}
+
+func TestValidityPolicyApplyRequested(t *testing.T) {
+	p := ValidityPolicy{Default: time.Hour, Max: 24 * time.Hour}
+	validity, err := p.Apply(2 * time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*time.Hour, validity)
+}
+
+func TestValidityPolicyApplyExceedingMaxRejected(t *testing.T) {
+	p := ValidityPolicy{Max: time.Hour}
+	_, err := p.Apply(2 * time.Hour)
+	assert.Error(t, err)
+}
+
+func TestValidityPolicyApplyExceedingMaxClamped(t *testing.T) {
+	p := ValidityPolicy{Max: time.Hour, Clamp: true}
+	validity, err := p.Apply(2 * time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, validity)
+}
+
+func TestValidityPolicyApplyNegative(t *testing.T) {
+	_, err := ValidityPolicy{}.Apply(-time.Hour)
+	assert.Error(t, err)
+}
+
+func TestValidityArgs(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, []string{}, validityArgs(0, 0, true, now))
+	assert.Equal(t, []string{"-V", "+5400s"}, validityArgs(90*time.Minute, 0, true, now))
+	assert.Equal(t, []string{}, validityArgs(0, 5*time.Minute, true, now))
+	assert.Equal(t, []string{"-V", "-300s:+5400s"}, validityArgs(90*time.Minute, 5*time.Minute, true, now))
+}
+
+func TestValidityArgsAbsolute(t *testing.T) {
+	now := time.Date(2020, 12, 21, 10, 30, 0, 0, time.Local)
+	assert.Equal(t, []string{}, validityArgs(0, 0, false, now))
+	assert.Equal(t, []string{"-V", "20201221103000:20201221120000"}, validityArgs(90*time.Minute, 0, false, now))
+	assert.Equal(t, []string{"-V", "20201221102500:20201221120000"}, validityArgs(90*time.Minute, 5*time.Minute, false, now))
+}
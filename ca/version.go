@@ -0,0 +1,59 @@
+package ca
+
+import (
+	"fmt"
+	"time"
+)
+
+// Version is the version of sshca. It is set at build time with
+// -ldflags "-X github.com/ratorx/sshca/ca.Version=...".
+var Version = "dev"
+
+// ProtocolVersion is incremented when the RPCs change in a way that older
+// clients or servers can't handle. gob ignores fields that only one side
+// knows about, so adding optional fields doesn't need a new version.
+const ProtocolVersion = 1
+
+// MinProtocolVersion is the oldest protocol version of the other side that
+// this version still works with.
+const MinProtocolVersion = 1
+
+// VersionReply represents the reply from the Version RPC.
+type VersionReply struct {
+	Version            string
+	ProtocolVersion    int
+	MinProtocolVersion int
+	// Time is the time on the server when it replied. It is zero for servers
+	// that don't report it.
+	Time time.Time
+}
+
+// CheckCompatible returns an error if a client at this version can't use a
+// server that replied with v.
+func (v VersionReply) CheckCompatible() error {
+	if ProtocolVersion < v.MinProtocolVersion {
+		return fmt.Errorf("the server (version %s, protocol %d) is too new for this client (version %s, protocol %d); upgrade the client", v.Version, v.ProtocolVersion, Version, ProtocolVersion)
+	}
+	if v.ProtocolVersion < MinProtocolVersion {
+		return fmt.Errorf("the server (version %s, protocol %d) is too old for this client (version %s, protocol %d); upgrade the server", v.Version, v.ProtocolVersion, Version, ProtocolVersion)
+	}
+	return nil
+}
+
+// ClockSkew estimates how far the clock of the server is ahead of the local
+// clock, from the local times that the request was sent and the reply was
+// received. It returns false if the server didn't report its time.
+func (v VersionReply) ClockSkew(sent, received time.Time) (time.Duration, bool) {
+	if v.Time.IsZero() {
+		return 0, false
+	}
+	// Assume that the server replied halfway through the round trip
+	local := sent.Add(received.Sub(sent) / 2)
+	return v.Time.Sub(local), true
+}
+
+// Version returns the version of the server.
+func (ca Server) Version(args struct{}, reply *VersionReply) error {
+	*reply = VersionReply{Version: Version, ProtocolVersion: ProtocolVersion, MinProtocolVersion: MinProtocolVersion, Time: time.Now()}
+	return nil
+}
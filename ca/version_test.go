@@ -0,0 +1,48 @@
+package ca
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientVersion(t *testing.T) {
+	client, err := Dial([]string{startTestServer(t)}, time.Second)
+	assert.Nil(t, err)
+	defer client.Close()
+	sent := time.Now()
+	reply, err := client.Version()
+	received := time.Now()
+	assert.Nil(t, err)
+	assert.Equal(t, VersionReply{Version: Version, ProtocolVersion: ProtocolVersion, MinProtocolVersion: MinProtocolVersion}, VersionReply{Version: reply.Version, ProtocolVersion: reply.ProtocolVersion, MinProtocolVersion: reply.MinProtocolVersion})
+	skew, ok := reply.ClockSkew(sent, received)
+	assert.True(t, ok)
+	assert.True(t, skew > -time.Second && skew < time.Second)
+	assert.Nil(t, reply.CheckCompatible())
+}
+
+func TestVersionReplyCheckCompatible(t *testing.T) {
+	tooNew := VersionReply{Version: "x", ProtocolVersion: ProtocolVersion + 2, MinProtocolVersion: ProtocolVersion + 1}
+	assert.Error(t, tooNew.CheckCompatible())
+	tooOld := VersionReply{Version: "x", ProtocolVersion: MinProtocolVersion - 1}
+	assert.Error(t, tooOld.CheckCompatible())
+	newer := VersionReply{Version: "x", ProtocolVersion: ProtocolVersion + 1, MinProtocolVersion: ProtocolVersion}
+	assert.Nil(t, newer.CheckCompatible())
+}
+
+func TestVersionReplyClockSkew(t *testing.T) {
+	sent := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	received := sent.Add(2 * time.Second)
+
+	_, ok := VersionReply{}.ClockSkew(sent, received)
+	assert.False(t, ok)
+
+	skew, ok := VersionReply{Time: sent.Add(time.Minute)}.ClockSkew(sent, received)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute-time.Second, skew)
+
+	skew, ok = VersionReply{Time: sent.Add(-time.Hour)}.ClockSkew(sent, received)
+	assert.True(t, ok)
+	assert.Equal(t, -time.Hour-time.Second, skew)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/openssh"
+	"github.com/ratorx/sshca/sshd"
+)
+
+// keepCASignatureAlgorithms is the --ca-signature-algorithms value that never
+// changes CASignatureAlgorithms.
+const keepCASignatureAlgorithms = "keep"
+
+// CASignatureFlags control the CASignatureAlgorithms of sshd, which decides
+// the CA signatures that it accepts on user certificates. sshd 8.2+ rejects
+// ssh-rsa (SHA-1) signatures by default, which older ssh-keygen versions make
+// with RSA CA keys.
+type CASignatureFlags struct {
+	CASignatureAlgorithms string `arg:"--ca-signature-algorithms" placeholder:"ALGORITHMS" help:"set CASignatureAlgorithms in sshd_config to these (comma-separated), or keep to never change it (default: add the signature algorithm of the CA if sshd doesn't accept it)"`
+}
+
+// caSignatureAlgorithms returns the algorithms that the trusted CAs from
+// trustedCAs sign with: the one the server reports for its own key, and the
+// one of the key type for sub-CAs. The algorithms of RSA sub-CAs, and of the
+// server if it is too old to report it, are unknown (empty).
+func caSignatureAlgorithms(client *ca.Client, publicKeys []*ca.PublicKey) []string {
+	algorithms := make([]string, 0, len(publicKeys))
+	for _, publicKey := range publicKeys {
+		algorithms = append(algorithms, ca.KeySignatureAlgorithm(publicKey.Type()))
+	}
+	if reply, err := client.GetCAPublicKey(); err == nil && reply.SignatureAlgorithm != "" {
+		algorithms[0] = reply.SignatureAlgorithm
+	}
+	return algorithms
+}
+
+// Validate checks the algorithms of the flags.
+func (f CASignatureFlags) Validate() error {
+	if f.CASignatureAlgorithms == "" || f.CASignatureAlgorithms == keepCASignatureAlgorithms {
+		return nil
+	}
+	for _, algorithm := range strings.Split(f.CASignatureAlgorithms, ",") {
+		if algorithm == "" || strings.ContainsAny(algorithm, " \t\n") {
+			return fmt.Errorf("invalid --ca-signature-algorithms algorithm %q", algorithm)
+		}
+	}
+	return nil
+}
+
+// apply queues the change of CASignatureAlgorithms that makes the sshd at
+// sshdPath, with the effective config sshdConfig, accept user certificates
+// signed with algorithms. Unknown algorithms are empty, and are skipped.
+// sshdConfig is only used if the algorithms aren't given by the flags.
+func (f CASignatureFlags) apply(modifier *sshd.Modifier, sshdPath string, sshdConfig func() (*sshd.EffectiveConfig, error), algorithms []string) error {
+	switch f.CASignatureAlgorithms {
+	case keepCASignatureAlgorithms:
+		return nil
+	case "":
+	default:
+		modifier.SetUnique("CASignatureAlgorithms", f.CASignatureAlgorithms)
+		return nil
+	}
+
+	if len(algorithms) == 0 {
+		return nil
+	}
+	version, err := openssh.DetectSSHDVersion(sshdPath)
+	if err != nil {
+		// useSSHD has already warned about it
+		return nil
+	}
+	var missing []string
+	for _, algorithm := range algorithms {
+		if algorithm == "" {
+			out.detail("the signature algorithm of the CA is unknown, so CASignatureAlgorithms isn't checked for it")
+			continue
+		}
+		if strings.HasPrefix(algorithm, "rsa-sha2-") && !version.Supports(openssh.RSASHA2Signatures) {
+			out.warning(fmt.Sprintf("%s can't verify certificates signed with %s (needs %s); upgrade sshd, or make the CA sign with ssh-rsa", version, algorithm, openssh.RSASHA2Signatures.Since))
+			continue
+		}
+		if !containsString(missing, algorithm) {
+			missing = append(missing, algorithm)
+		}
+	}
+	// Older versions accept every algorithm that they can verify
+	if len(missing) == 0 || !version.Supports(openssh.CASignatureAlgorithms) {
+		return nil
+	}
+
+	config, err := sshdConfig()
+	if err != nil {
+		return fmt.Errorf("failed to read CASignatureAlgorithms: %w", err)
+	}
+	var accepted []string
+	for _, value := range config.Lookup("CASignatureAlgorithms") {
+		accepted = append(accepted, strings.Split(value, ",")...)
+	}
+	if len(accepted) == 0 {
+		return nil
+	}
+	added := []string{}
+	for _, algorithm := range missing {
+		if !containsString(accepted, algorithm) {
+			added = append(added, algorithm)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	out.progress("%s doesn't accept CA signatures made with %s, adding to CASignatureAlgorithms (pass --ca-signature-algorithms keep to leave it)", version, strings.Join(added, ", "))
+	modifier.SetUnique("CASignatureAlgorithms", strings.Join(append(accepted, added...), ","))
+	return nil
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/user"
-	"path"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"time"
+	"unicode"
 
+	"github.com/Showmax/go-fqdn"
 	"github.com/ratorx/sshca/ca"
 )
 
@@ -22,7 +27,7 @@ var (
 // E.g. id_rsa.pub can be well-identified as rsa, but gcloud.pub can't, even if
 // the underlying key is rsa.
 func keyIDFromPath(keyPath string) string {
-	keyFile := path.Base(keyPath)
+	keyFile := filepath.Base(keyPath)
 
 	// Identify common key types by filename and return that
 	// Assumption is that there is only 1 default key of a given type and default
@@ -37,73 +42,217 @@ func keyIDFromPath(keyPath string) string {
 	return strings.TrimSuffix(keyFile, ".pub")
 }
 
-// getCertificateIdentity generates the identity of the certificate based on the
-// host (and user, depending on the certificate) making the request.
-func getCertificateIdentity(keyPath string, certType ca.CertificateType) (string, error) {
-	certIdentityComponents := make([]string, 0, 3)
+// keyIDFromType derives a key ID from the algorithm of the key, for keys that
+// don't have a path (e.g. read from stdin).
+func keyIDFromType(publicKey *ca.PublicKey) string {
+	return strings.TrimPrefix(publicKey.Type(), "ssh-")
+}
+
+// certRequest describes the certificate to request for a public key.
+type certRequest struct {
+	principals []string
+	certType   ca.CertificateType
+	flags      SignFlags
+	// options are passed to ssh-keygen -O on the server.
+	options []string
+	// username is the user that a user certificate is for. It is ignored for
+	// host certificates.
+	username string
+	// identity replaces the generated certificate identity, if it's set.
+	identity string
+	// overrideToken skips the server's host principal DNS check.
+	overrideToken string
+	// prove answers a challenge from the server with the private key, to prove
+	// possession of it.
+	prove bool
+}
+
+// getCertificateIdentity generates the identity of the certificate from the
+// identity template, based on the host (and user, depending on the
+// certificate) making the request, unless the request sets one.
+func getCertificateIdentity(publicKey *ca.PublicKey, keyID string, req certRequest) (string, error) {
+	if req.identity != "" {
+		return req.identity, ca.ValidateIdentity(req.identity)
+	}
+
+	text := req.flags.identityTemplate()
+	if text == "" && !req.certType {
+		text = defaultUserIdentityTemplate
+	} else if text == "" {
+		text = defaultHostIdentityTemplate
+	}
 
 	hostname, err := os.Hostname()
 	if err != nil {
 		return "", fmt.Errorf("failed to get system hostname: %w", err)
 	}
-	// Use short hostname for identity
-	// On OpenBSD os.Hostname returns the long hostname
-	hostname = strings.Split(hostname, ".")[0]
-	certIdentityComponents = append(certIdentityComponents, hostname)
-
-	// Append username if it's a user certificate
-	if !certType {
-		userStruct, err := user.Current()
-		if err != nil {
-			return "", fmt.Errorf("failed to get name of current user: %w", err)
+	now := time.Now().UTC()
+	fields := identityFields{
+		// Use short hostname for identity
+		// On OpenBSD os.Hostname returns the long hostname
+		Hostname:  strings.Split(hostname, ".")[0],
+		FQDN:      hostname,
+		Type:      "host",
+		KeyID:     keyID,
+		KeyType:   keyTypeName(publicKey),
+		Date:      now.Format("2006-01-02"),
+		Timestamp: now.Format("20060102T150405Z"),
+	}
+	// Only look up the FQDN if it's used, since it can need DNS
+	if strings.Contains(text, ".FQDN") {
+		if name, err := fqdn.FqdnHostname(); err == nil {
+			fields.FQDN = name
 		}
-		certIdentityComponents = append(certIdentityComponents, userStruct.Username)
-	} else {
-		certIdentityComponents = append(certIdentityComponents, "host")
+	}
+	if !req.certType {
+		fields.Type = "user"
+		fields.Username = req.username
+	}
+	identity, err := renderIdentity(text, fields)
+	if err != nil {
+		return "", err
 	}
 
-	certIdentityComponents = append(certIdentityComponents, keyIDFromPath(keyPath))
+	// Usernames (e.g. on Windows) and key file names can contain spaces
+	identity = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return '-'
+		}
+		return r
+	}, identity)
+	return identity, ca.ValidateIdentity(identity)
+}
 
-	return strings.Join(certIdentityComponents, "_"), nil
+// validatePrincipals rejects principals that the server would refuse anyway,
+// before anything is sent.
+func validatePrincipals(principals []string) error {
+	for _, principal := range principals {
+		if err := ca.ValidatePrincipal(principal); err != nil {
+			return fmt.Errorf("invalid principal %q: %w", principal, err)
+		}
+	}
+	return nil
 }
 
 func getCertificatePath(keyPath string) string {
 	return fmt.Sprintf("%s-cert.pub", strings.TrimSuffix(keyPath, ".pub"))
 }
 
-// generateCertificate creates a certificate for the public key at publicKeyPath
-// and writes it to the expected place (key.pub generates key-cert.pub). Returns
-// the path that the certificate was written at.
-func generateCertificate(client *ca.Client, publicKeyPath string, principals []string, certType ca.CertificateType, printRequest bool) (string, error) {
+// newSignArgs builds the signing request for the public key at publicKeyPath.
+func newSignArgs(publicKeyPath string, req certRequest) (ca.SignArgs, error) {
+	publicKey, err := ca.NewPublicKey(publicKeyPath)
+	if err != nil {
+		return ca.SignArgs{}, err
+	}
+
+	return newSignArgsForKey(publicKey, keyIDFromPath(publicKeyPath), req)
+}
+
+// newSignArgsForKey builds the signing request for publicKey, using keyID to
+// identify the key in the certificate identity.
+func newSignArgsForKey(publicKey *ca.PublicKey, keyID string, req certRequest) (ca.SignArgs, error) {
+	if err := validatePrincipals(req.principals); err != nil {
+		return ca.SignArgs{}, err
+	}
 	var err error
-	args := ca.SignArgs{CertificateType: certType, Principals: principals}
+	args := ca.SignArgs{CertificateType: req.certType, Principals: req.principals, PublicKey: publicKey, Options: req.options, OverrideToken: req.overrideToken}
+	if err := req.flags.apply(&args); err != nil {
+		return ca.SignArgs{}, err
+	}
+
+	args.Identity, err = getCertificateIdentity(publicKey, keyID, req)
+	if err != nil {
+		return ca.SignArgs{}, fmt.Errorf("failed to generate certificate identity: %w", err)
+	}
+	args.RequestUUID, err = ca.NewRequestUUID()
+	if err != nil {
+		return ca.SignArgs{}, err
+	}
+	args.Requester = currentRequester()
+
+	return args, nil
+}
+
+// currentRequester describes the user and host running the client for the
+// server operator. Anything that can't be determined is left empty.
+func currentRequester() ca.Requester {
+	requester := ca.Requester{OS: runtime.GOOS, ClientVersion: ca.Version}
+	if u, err := user.Current(); err == nil {
+		requester.Username = usernameOf(u)
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		requester.Hostname = hostname
+	}
+	return requester
+}
 
-	args.Identity, err = getCertificateIdentity(publicKeyPath, certType)
+// writeCertificate writes certificate next to the public key at publicKeyPath
+// (key.pub generates key-cert.pub) with the given permissions, ownership and
+// format. Formats other than OpenSSH replace the .pub extension of the
+// certificate. Returns the path that the certificate was written at.
+func writeCertificate(certificate *ca.PublicKey, publicKeyPath string, options fileOptions) (string, error) {
+	certPath := strings.TrimSuffix(getCertificatePath(publicKeyPath), ".pub") + options.format.Extension()
+	out.progress("writing certificate to %s", certPath)
+
+	data, err := certificate.Encode(options.format)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate certificate identity: %w", err)
+		return "", fmt.Errorf("failed to encode certificate: %w", err)
+	}
+	err = ioutil.WriteFile(certPath, data, options.mode)
+	if err != nil {
+		return "", fmt.Errorf("failed to write certificate to disk: %w", err)
 	}
 
-	args.PublicKey, err = ca.NewPublicKey(publicKeyPath)
+	return certPath, options.apply(certPath)
+}
+
+// generateCertificate creates a certificate for the public key at publicKeyPath
+// and writes it to the expected place (key.pub generates key-cert.pub). Returns
+// the certificate and the path that it was written at.
+func generateCertificate(client *ca.Client, publicKeyPath string, req certRequest, options fileOptions, printRequest bool) (*ca.PublicKey, string, error) {
+	args, err := newSignArgs(publicKeyPath, req)
 	if err != nil {
-		return "", fmt.Errorf("failed to read public key at %s: %w", publicKeyPath, err)
+		return nil, "", err
+	}
+	if req.prove {
+		if err := addProof(client, &args, privateKeyPath(publicKeyPath)); err != nil {
+			return nil, "", err
+		}
 	}
 
 	if printRequest {
-		fmt.Println(args)
+		out.progress("%s", args)
 	}
 
-	reply, err := client.SignPublicKey(args)
+	certificate, err := signPublicKey(client, args)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate certificate: %w", err)
+		return nil, "", err
 	}
 
-	certPath := getCertificatePath(publicKeyPath)
-	fmt.Printf("writing certificate to %s\n", certPath)
+	certPath, err := writeCertificate(certificate, publicKeyPath, options)
+	return certificate, certPath, err
+}
 
-	err = reply.Certificate.WriteFile(certPath, 0o600)
+// addProof adds a proof of possession of the private key to args. Servers that
+// don't support proofs are warned about, rather than failing the request.
+func addProof(client *ca.Client, args *ca.SignArgs, privateKeyPath string) error {
+	proof, err := proveKey(client, args.PublicKey, privateKeyPath)
+	if err != nil && isUnsupportedRPC(err) {
+		out.warning("the server does not support proof of possession")
+		return nil
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to write certificate to disk: %w", err)
+		return fmt.Errorf("failed to prove possession of the private key: %w", err)
 	}
+	args.Proof = proof
+	return nil
+}
 
-	return certPath, err
+// signPublicKey requests a certificate for the signing request.
+func signPublicKey(client *ca.Client, args ca.SignArgs) (*ca.PublicKey, error) {
+	reply, err := client.SignPublicKey(args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate certificate: %w", err)
+	}
+	return reply.Certificate, nil
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ratorx/sshca/ca"
+	"gopkg.in/yaml.v2"
+)
+
+// systemConfigPath is the client config used when there is no per-user config.
+const systemConfigPath = "/etc/sshca/config.yaml"
+
+// ClientConfig is the optional client configuration file.
+type ClientConfig struct {
+	// Remotes maps aliases that can be passed to --remote to one or more server
+	// addresses.
+	Remotes map[string]remoteList `yaml:"remotes"`
+	// Profiles are named sets of sign_user options, selected with --profile.
+	Profiles map[string]requestProfile `yaml:"profiles"`
+	// PostSignHooks are run after every certificate that sign_user and sign_host
+	// get, before the --post-sign-hook commands.
+	PostSignHooks []string `yaml:"post_sign_hooks"`
+	// PrincipalDomain adds username@PrincipalDomain to the principals that
+	// sign_user requests by default (the username).
+	PrincipalDomain string `yaml:"principal_domain"`
+	// AccountHosts are hosts (ssh destinations) that the principals of
+	// sign_user should be accounts on. Principals that aren't are warned
+	// about.
+	AccountHosts []string `yaml:"account_hosts"`
+	// IdentityTemplate is used if --identity-template is not set.
+	IdentityTemplate string `yaml:"identity_template"`
+	// SSHConfig is the host topology that sign_user --ssh-config writes an
+	// ssh_config snippet for.
+	SSHConfig sshConfigTopology `yaml:"ssh_config"`
+}
+
+// requestProfile is a named set of options for a user certificate request.
+type requestProfile struct {
+	Principals []string `yaml:"principals"`
+	Validity   duration `yaml:"validity"`
+	// Extensions limits the certificate to the listed extensions (e.g.
+	// permit-pty). If it is omitted, the certificate has all of them.
+	Extensions *[]string `yaml:"extensions"`
+	// CriticalOptions restrict the certificate (e.g. force-command or
+	// source-address). Options without a value (e.g. verify-required) are
+	// given an empty value.
+	CriticalOptions map[string]string `yaml:"critical_options"`
+}
+
+// options converts the extensions and critical options of the profile to
+// ssh-keygen -O options.
+func (p requestProfile) options() ([]string, error) {
+	var options []string
+	if p.Extensions != nil {
+		extensionOptions, err := ca.ExtensionOptions(*p.Extensions)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, extensionOptions...)
+	}
+
+	names := make([]string, 0, len(p.CriticalOptions))
+	for name := range p.CriticalOptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value := p.CriticalOptions[name]; value != "" {
+			options = append(options, name+"="+value)
+		} else {
+			options = append(options, name)
+		}
+	}
+	return options, nil
+}
+
+// remoteList is a list of servers in the config, which can be written as a
+// single string or a list of strings.
+type remoteList []string
+
+// UnmarshalYAML implementation for yaml.Unmarshaler
+func (r *remoteList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		*r = remoteList{single}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*r = list
+	return nil
+}
+
+// config is the client config loaded in main.
+var config ClientConfig
+
+// defaultConfigPath returns the first client config that exists, preferring
+// the per-user config. It returns the empty string if there is none.
+func defaultConfigPath() string {
+	candidates := []string{}
+	if dir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "sshca", "config.yaml"))
+	}
+	candidates = append(candidates, systemConfigPath)
+
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// loadConfig reads the client config at path. An empty path uses the default
+// config if it exists.
+func loadConfig(path string) (ClientConfig, error) {
+	if path == "" {
+		path = defaultConfigPath()
+		if path == "" {
+			return ClientConfig{}, nil
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ClientConfig{}, fmt.Errorf("failed to read config at %s: %w", path, err)
+	}
+	var cfg ClientConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return ClientConfig{}, fmt.Errorf("failed to parse config at %s: %w", path, err)
+	}
+	if cfg.PrincipalDomain != "" {
+		if err := ca.ValidatePrincipal("user@" + cfg.PrincipalDomain); err != nil {
+			return ClientConfig{}, fmt.Errorf("invalid principal_domain in config at %s: %w", path, err)
+		}
+	}
+	if err := validateIdentityTemplate(cfg.IdentityTemplate); err != nil {
+		return ClientConfig{}, fmt.Errorf("invalid identity_template in config at %s: %w", path, err)
+	}
+	if err := cfg.SSHConfig.validate(); err != nil {
+		return ClientConfig{}, fmt.Errorf("invalid ssh_config in config at %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// resolveRemote splits a comma-separated --remote and expands the aliases from
+// the config. Other values are returned unchanged.
+func (c ClientConfig) resolveRemote(remote string) []string {
+	var remotes []string
+	for _, r := range strings.Split(remote, ",") {
+		if aliased, ok := c.Remotes[r]; ok {
+			remotes = append(remotes, aliased...)
+		} else {
+			remotes = append(remotes, r)
+		}
+	}
+	return remotes
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"time"
+)
+
+// startTime is when the process started, for the uptime in the runtime stats.
+var startTime = time.Now()
+
+// runtimeStats is the body of /debug/runtime.
+type runtimeStats struct {
+	GoVersion     string  `json:"go_version"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	NumCPU        int     `json:"num_cpu"`
+	Goroutines    int     `json:"goroutines"`
+	OpenFiles     int     `json:"open_files,omitempty"`
+	HeapAlloc     uint64  `json:"heap_alloc_bytes"`
+	HeapObjects   uint64  `json:"heap_objects"`
+	Sys           uint64  `json:"sys_bytes"`
+	NumGC         uint32  `json:"num_gc"`
+	PauseTotal    float64 `json:"gc_pause_total_seconds"`
+}
+
+// readRuntimeStats returns the current runtime stats of the process.
+func readRuntimeStats() runtimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := runtimeStats{
+		GoVersion:     runtime.Version(),
+		UptimeSeconds: time.Since(startTime).Seconds(),
+		NumCPU:        runtime.NumCPU(),
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapObjects:   mem.HeapObjects,
+		Sys:           mem.Sys,
+		NumGC:         mem.NumGC,
+		PauseTotal:    time.Duration(mem.PauseTotalNs).Seconds(),
+	}
+	// Only available on Linux, where leaked connections show up as open files
+	if dir, err := os.Open("/proc/self/fd"); err == nil {
+		fds, _ := dir.Readdirnames(-1)
+		dir.Close()
+		// The directory itself is one of them
+		stats.OpenFiles = len(fds) - 1
+	}
+	return stats
+}
+
+// debugHandler serves the pprof profiles under /debug/pprof/ and the runtime
+// stats at /debug/runtime.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(readRuntimeStats())
+	})
+	return mux
+}
+
+// serveDebug serves debugHandler on addr in the background. The profiles show
+// the command line and memory of the server, so it warns if addr isn't only
+// reachable from this machine.
+func serveDebug(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for debugging on %s: %w", addr, err)
+	}
+	if host, _, err := net.SplitHostPort(listener.Addr().String()); err == nil {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			out.warning(fmt.Sprintf("the debug endpoint on %s is reachable from other machines, and shows the server's command line and memory", addr))
+		}
+	}
+	go http.Serve(listener, debugHandler())
+	return nil
+}
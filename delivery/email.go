@@ -0,0 +1,119 @@
+// Package delivery sends issued certificates to their owners out-of-band.
+package delivery
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ratorx/sshca/ca"
+)
+
+// sendMailFunc matches the signature of smtp.SendMail so tests can replace it.
+type sendMailFunc func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+
+// EmailDeliverer emails certificates to the addresses associated with the
+// principals in the signing request. Principals without an address are
+// ignored.
+type EmailDeliverer struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+	// From is the sender address.
+	From string
+	// Auth is used to authenticate to the SMTP server. It may be nil.
+	Auth smtp.Auth
+	// Addresses maps principals to email addresses.
+	Addresses map[string]string
+	sendMail  sendMailFunc
+}
+
+// NewEmailDeliverer constructs an EmailDeliverer that reads the principal to
+// address mapping from addressesPath.
+func NewEmailDeliverer(addr, from string, auth smtp.Auth, addressesPath string) (*EmailDeliverer, error) {
+	addresses, err := LoadAddresses(addressesPath)
+	if err != nil {
+		return nil, err
+	}
+	return &EmailDeliverer{addr, from, auth, addresses, smtp.SendMail}, nil
+}
+
+// LoadAddresses reads a file containing one "principal address" pair per line.
+// Blank lines and lines starting with # are ignored.
+func LoadAddresses(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open email addresses at %s: %w", path, err)
+	}
+	defer f.Close()
+
+	addresses := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"principal address\"", path, lineNo)
+		}
+		addresses[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read email addresses at %s: %w", path, err)
+	}
+
+	return addresses, nil
+}
+
+// recipients returns the unique addresses for the requested principals.
+func (e EmailDeliverer) recipients(principals []string) []string {
+	unique := make(map[string]bool, len(principals))
+	for _, principal := range principals {
+		if address, ok := e.Addresses[principal]; ok {
+			unique[address] = true
+		}
+	}
+	ret := make([]string, 0, len(unique))
+	for address := range unique {
+		ret = append(ret, address)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// message builds the email containing the certificate and instructions for
+// installing it.
+func (e EmailDeliverer) message(to []string, args ca.SignArgs, certificate *ca.PublicKey) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", e.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&b, "Subject: SSH %s certificate %s\r\n", args.CertificateType, args.Identity)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "A %s certificate has been issued for %s.\r\n\r\n", args.CertificateType, strings.Join(args.Principals, ", "))
+	b.WriteString("To install it, save the line below next to the private key, replacing\r\n")
+	b.WriteString("the .pub suffix of the public key with -cert.pub (e.g. ~/.ssh/id_ed25519-cert.pub).\r\n")
+	b.WriteString("ssh picks up the certificate automatically when the key is used.\r\n\r\n")
+	b.WriteString(strings.TrimSpace(certificate.String()))
+	b.WriteString("\r\n")
+	return b.Bytes()
+}
+
+// Deliver implementation for ca.Deliverer
+func (e EmailDeliverer) Deliver(args ca.SignArgs, certificate *ca.PublicKey) error {
+	to := e.recipients(args.Principals)
+	if len(to) == 0 {
+		return nil
+	}
+
+	err := e.sendMail(e.Addr, e.Auth, e.From, to, e.message(to, args, certificate))
+	if err != nil {
+		return fmt.Errorf("failed to email certificate to %s: %w", strings.Join(to, ", "), err)
+	}
+	return nil
+}
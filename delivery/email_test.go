@@ -0,0 +1,88 @@
+package delivery
+
+import (
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/stretchr/testify/assert"
+)
+
+type sentMail struct {
+	addr string
+	from string
+	to   []string
+	msg  []byte
+}
+
+func newTestDeliverer(t *testing.T, sent *[]sentMail) *EmailDeliverer {
+	t.Helper()
+	d, err := NewEmailDeliverer("localhost:25", "ca@example.com", nil, "testdata/addresses")
+	assert.Nil(t, err)
+	d.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		*sent = append(*sent, sentMail{addr, from, to, msg})
+		return nil
+	}
+	return d
+}
+
+func mustPublicKey(t *testing.T) *ca.PublicKey {
+	t.Helper()
+	key, err := ca.NewPublicKey("../ca/testdata/test.pub")
+	assert.Nil(t, err)
+	return key
+}
+
+func TestLoadAddresses(t *testing.T) {
+	addresses, err := LoadAddresses("testdata/addresses")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"alice": "alice@example.com",
+		"bob":   "bob@example.com",
+		"admin": "alice@example.com",
+	}, addresses)
+}
+
+func TestLoadAddressesInvalid(t *testing.T) {
+	_, err := LoadAddresses("testdata/invalid")
+	assert.Error(t, err)
+}
+
+func TestLoadAddressesNonexistent(t *testing.T) {
+	_, err := LoadAddresses("testdata/nonexistent")
+	assert.Error(t, err)
+}
+
+func TestEmailDelivererDeliver(t *testing.T) {
+	var sent []sentMail
+	d := newTestDeliverer(t, &sent)
+	key := mustPublicKey(t)
+	args := ca.SignArgs{Identity: "laptop_alice_ed25519", Principals: []string{"alice", "admin", "bob"}, PublicKey: key}
+	assert.Nil(t, d.Deliver(args, key))
+	assert.Len(t, sent, 1)
+	assert.Equal(t, "localhost:25", sent[0].addr)
+	assert.Equal(t, "ca@example.com", sent[0].from)
+	assert.Equal(t, []string{"alice@example.com", "bob@example.com"}, sent[0].to)
+	assert.Contains(t, string(sent[0].msg), "Subject: SSH user certificate laptop_alice_ed25519\r\n")
+	assert.Contains(t, string(sent[0].msg), strings.TrimSpace(key.String()))
+}
+
+func TestEmailDelivererDeliverWithUnknownPrincipal(t *testing.T) {
+	var sent []sentMail
+	d := newTestDeliverer(t, &sent)
+	key := mustPublicKey(t)
+	args := ca.SignArgs{Principals: []string{"mallory"}, PublicKey: key}
+	assert.Nil(t, d.Deliver(args, key))
+	assert.Empty(t, sent)
+}
+
+func TestEmailDelivererDeliverFailure(t *testing.T) {
+	d, err := NewEmailDeliverer("localhost:25", "ca@example.com", nil, "testdata/addresses")
+	assert.Nil(t, err)
+	d.sendMail = func(string, smtp.Auth, string, []string, []byte) error {
+		return assert.AnError
+	}
+	key := mustPublicKey(t)
+	assert.Error(t, d.Deliver(ca.SignArgs{Principals: []string{"alice"}, PublicKey: key}, key))
+}
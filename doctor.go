@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/openssh"
+	"github.com/ratorx/sshca/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+// DoctorCmd is the command that checks whether the other commands can work on
+// this machine, and explains how to fix the problems that it finds.
+type DoctorCmd struct {
+	Remote         string        `arg:"-r" help:"remote server to check (optional); like --remote for the other commands"`
+	Tenant         string        `arg:"--tenant,env:SSHCA_TENANT" placeholder:"NAME" help:"tenant of the remote server to check the trust state of"`
+	ConnectTimeout time.Duration `arg:"--connect-timeout" default:"10s" placeholder:"DURATION" help:"timeout for connecting to each remote server"`
+	SSHKeygenPath  string        `arg:"--ssh-keygen" default:"ssh-keygen" placeholder:"PATH" help:"path to ssh-keygen"`
+	SSHDPath       string        `arg:"--sshd" default:"sshd" placeholder:"PATH" help:"path to sshd"`
+	SSHDConfigPath string        `arg:"--sshd-config" default:"/etc/ssh/sshd_config" placeholder:"PATH" help:"sshd config file to check"`
+	AsUser         string        `arg:"--as-user" placeholder:"USER" help:"user whose ~/.ssh to check (default: the invoking user under sudo, otherwise the current user)"`
+	MaxClockSkew   time.Duration `arg:"--max-clock-skew" default:"1m" placeholder:"DURATION" help:"largest acceptable difference between the clocks of this machine and the server"`
+}
+
+// doctorReport prints the result of each check and counts the failures.
+type doctorReport struct {
+	failures int
+}
+
+func (r *doctorReport) ok(check, detail string) {
+	fmt.Printf("%s    %s: %s\n", out.label(colorGreen, "ok"), check, detail)
+}
+
+func (r *doctorReport) skip(check, reason string) {
+	fmt.Printf("%s  %s: %s\n", out.label(colorYellow, "skip"), check, reason)
+}
+
+// fail reports a failed check with the remediation for it.
+func (r *doctorReport) fail(check string, problem error, fix string) {
+	r.failures++
+	fmt.Printf("%s  %s: %s\n      fix: %s\n", out.label(colorRed, "FAIL"), check, strings.TrimSpace(problem.Error()), fix)
+}
+
+// Validate implementation for Command
+func (d DoctorCmd) Validate() error {
+	if d.Tenant != "" && d.Remote == "" {
+		return fmt.Errorf("--tenant requires --remote")
+	}
+	if d.MaxClockSkew <= 0 {
+		return fmt.Errorf("--max-clock-skew must be positive")
+	}
+	return nil
+}
+
+// Run implementation for Command
+func (d DoctorCmd) Run() error {
+	var report doctorReport
+	d.checkTools(&report)
+	d.checkFiles(&report)
+
+	var caKey *ca.PublicKey
+	if d.Remote == "" {
+		report.skip("remote server", "no --remote given")
+	} else {
+		caKey = d.checkRemote(&report)
+	}
+	if caKey == nil {
+		report.skip("CA trust", "needs the CA public key from a reachable --remote")
+	} else {
+		d.checkTrust(&report, caKey)
+	}
+
+	if report.failures != 0 {
+		return fmt.Errorf("checks failed: %d", report.failures)
+	}
+	return nil
+}
+
+// checkTools checks that the OpenSSH binaries that sshca runs are available.
+func (d DoctorCmd) checkTools(report *doctorReport) {
+	if version, err := openssh.DetectSSHKeygenVersion(d.SSHKeygenPath); err != nil {
+		report.fail("ssh-keygen", err, "install the OpenSSH client, or pass --ssh-keygen with its path")
+	} else {
+		report.ok("ssh-keygen", fmt.Sprintf("%s at %s", version, d.SSHKeygenPath))
+	}
+
+	if version, err := openssh.DetectSSHDVersion(d.SSHDPath); err != nil {
+		report.fail("sshd", err, "install the OpenSSH server, or pass --sshd with its path (only trust, sign_host and sync_krl need it)")
+	} else {
+		report.ok("sshd", fmt.Sprintf("%s at %s", version, d.SSHDPath))
+	}
+}
+
+// checkFiles checks that the files that the other commands change can be
+// written by the current user.
+func (d DoctorCmd) checkFiles(report *doctorReport) {
+	for _, path := range []string{d.SSHDConfigPath, trustedCAsPath, knownHostsPath} {
+		if err := checkWritable(path); err != nil {
+			report.fail(path, err, "run sshca as root (e.g. with sudo), which trust, sign_host and sync_krl need")
+		} else {
+			report.ok(path, "writable")
+		}
+	}
+
+	u, err := targetUser(d.AsUser)
+	if err != nil {
+		report.fail("~/.ssh", err, "pass --as-user with an existing user")
+		return
+	}
+	sshDir, err := userSSHDir(u)
+	if err != nil {
+		report.fail("~/.ssh", err, "pass --as-user with a user that has a home directory")
+		return
+	}
+	if err := checkWritableDir(sshDir); err != nil {
+		report.fail(sshDir, err, fmt.Sprintf("make sure that %s is owned by %s and has mode 0700, or run sign_user as %s", sshDir, usernameOf(u), usernameOf(u)))
+	} else {
+		report.ok(sshDir, "writable")
+	}
+}
+
+// checkRemote checks that the server is reachable and compatible, and that
+// the clocks agree. It returns the CA public key of the server, or nil if it
+// couldn't be fetched.
+func (d DoctorCmd) checkRemote(report *doctorReport) *ca.PublicKey {
+	client, err := RPCFlags{Remote: d.Remote, Tenant: d.Tenant, ConnectTimeout: d.ConnectTimeout}.dialRemote()
+	if err != nil {
+		report.fail("remote server", err, fmt.Sprintf("check that the server is running and that %s is reachable from here (firewall, SSH tunnel), or increase --connect-timeout", d.Remote))
+		return nil
+	}
+	defer client.Close()
+	report.ok("remote server", fmt.Sprintf("connected to %s", client.Addr))
+
+	sent := time.Now()
+	reply, err := client.Version()
+	received := time.Now()
+	switch {
+	case err != nil && isUnsupportedRPC(err):
+		report.fail("server version", fmt.Errorf("the server is older than this client"), "upgrade the server")
+	case err != nil:
+		report.fail("server version", err, "check the server output for errors")
+	default:
+		if err := reply.CheckCompatible(); err != nil {
+			report.fail("server version", err, "use the same version of sshca on the client and server")
+		} else {
+			report.ok("server version", fmt.Sprintf("sshca %s (protocol %d)", reply.Version, reply.ProtocolVersion))
+		}
+		d.checkClockSkew(report, *reply, sent, received)
+	}
+
+	caKey, err := client.GetCAPublicKey()
+	if err != nil {
+		report.fail("CA public key", err, "check the --tenant name and the server output for errors")
+		return nil
+	}
+	report.ok("CA public key", caKey.CAPublicKey.Fingerprint())
+	return caKey.CAPublicKey
+}
+
+// checkClockSkew checks that the clock of the server agrees with the local
+// clock, because certificates are only valid from the time on the server.
+func (d DoctorCmd) checkClockSkew(report *doctorReport, reply ca.VersionReply, sent, received time.Time) {
+	skew, ok := reply.ClockSkew(sent, received)
+	if !ok {
+		report.skip("clock skew", "the server doesn't report its time")
+		return
+	}
+	if err := checkClockSkew(skew, d.MaxClockSkew); err != nil {
+		report.fail("clock skew", err, "synchronise the clocks of this machine and the server with NTP (e.g. timedatectl set-ntp true)")
+		return
+	}
+	report.ok("clock skew", describeClockSkew(skew))
+}
+
+// checkTrust checks whether this machine already trusts the CA for user and
+// host authentication.
+func (d DoctorCmd) checkTrust(report *doctorReport, caKey *ca.PublicKey) {
+	trustCommand := fmt.Sprintf("run sshca trust -r %s", d.Remote)
+
+	contents, _ := ioutil.ReadFile(trustedCAsPath)
+	switch {
+	case !containsKey(contents, caKey):
+		report.fail("user CA trust", fmt.Errorf("the CA is not in %s", trustedCAsPath), trustCommand+" (or trust --authorized-keys for a single user)")
+	case !d.sshdUsesTrustedCAs():
+		report.fail("user CA trust", fmt.Errorf("sshd doesn't use %s as TrustedUserCAKeys", trustedCAsPath), trustCommand)
+	default:
+		report.ok("user CA trust", fmt.Sprintf("trusted in %s", trustedCAsPath))
+	}
+
+	contents, _ = ioutil.ReadFile(knownHostsPath)
+	trusted := false
+	for _, line := range bytes.SplitAfter(contents, []byte("\n")) {
+		if _, ok := managedCertAuthority(line, caKey); ok {
+			trusted = true
+		}
+	}
+	if !trusted {
+		report.fail("host CA trust", fmt.Errorf("the CA has no @cert-authority line in %s", knownHostsPath), trustCommand)
+	} else {
+		report.ok("host CA trust", fmt.Sprintf("trusted in %s", knownHostsPath))
+	}
+}
+
+// sshdUsesTrustedCAs reports whether the effective sshd config uses the
+// trusted CAs file.
+func (d DoctorCmd) sshdUsesTrustedCAs() bool {
+	sshd.Binary = d.SSHDPath
+	values, err := sshd.Lookup(d.SSHDConfigPath, "TrustedUserCAKeys")
+	if err != nil {
+		return false
+	}
+	for _, value := range values {
+		if value == trustedCAsPath {
+			return true
+		}
+	}
+	return false
+}
+
+// containsKey reports whether a file with one public key per line contains
+// key.
+func containsKey(contents []byte, key *ca.PublicKey) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey(scanner.Bytes())
+		if err == nil && key.Matches(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWritable returns an error if path can't be written, or created if it
+// doesn't exist. Nothing is modified.
+func checkWritable(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err == nil {
+		return f.Close()
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if err := checkWritableDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("%s doesn't exist and can't be created: %w", path, err)
+	}
+	return nil
+}
+
+// checkWritableDir returns an error if files can't be created in dir, or dir
+// can't be created if it doesn't exist. A temporary file is created and
+// removed to check.
+func checkWritableDir(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		return checkWritableDir(parent)
+	}
+	f, err := ioutil.TempFile(dir, ".sshca.")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,135 @@
+// Package executor runs external commands (ssh-keygen, sshd etc.) through an
+// interface, so that tests can replace them with fakes and so that wrappers
+// (timeouts, logging, sandboxing) can be applied to every command uniformly.
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Command describes a command to run.
+type Command struct {
+	// Path of the binary. It is looked up in PATH if it is not a path.
+	Path string
+	Args []string
+	// Env is added to the environment of the current process. Later entries
+	// override earlier ones.
+	Env []string
+	// Stdin, Stdout and Stderr are connected to the null device if they are
+	// nil.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// String returns a human-readable representation of the command line.
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Path}, c.Args...), " ")
+}
+
+// Executor runs commands. Run returns an error that implements
+// ExitCode() int if the command ran, but exited unsuccessfully.
+type Executor interface {
+	Run(cmd Command) error
+}
+
+// Default is the Executor used when none is given explicitly.
+var Default Executor = OS{}
+
+// OrDefault returns e, or Default if e is nil.
+func OrDefault(e Executor) Executor {
+	if e == nil {
+		return Default
+	}
+	return e
+}
+
+// OS runs commands as child processes.
+type OS struct {
+	// Timeout kills the command if it runs for longer. Zero disables the
+	// timeout.
+	Timeout time.Duration
+}
+
+// Run implementation for Executor.
+func (o OS) Run(c Command) error {
+	ctx := context.Background()
+	if o.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, c.Path, c.Args...)
+	if len(c.Env) != 0 {
+		cmd.Env = append(os.Environ(), c.Env...)
+	}
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = c.Stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timed out after %s", c.Path, o.Timeout)
+	}
+	return err
+}
+
+// ExitError is returned by fake executors to report an unsuccessful exit.
+type ExitError struct {
+	Code int
+}
+
+// Error implementation for error.
+func (e ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// ExitCode returns the exit code of the command.
+func (e ExitError) ExitCode() int {
+	return e.Code
+}
+
+// Func adapts a function to the Executor interface.
+type Func func(cmd Command) error
+
+// Run implementation for Executor.
+func (f Func) Run(cmd Command) error {
+	return f(cmd)
+}
+
+// Logged prints each command to Log before running it with Executor.
+type Logged struct {
+	Executor Executor
+	Log      io.Writer
+}
+
+// Run implementation for Executor.
+func (l Logged) Run(cmd Command) error {
+	fmt.Fprintf(l.Log, "running %s\n", cmd)
+	return OrDefault(l.Executor).Run(cmd)
+}
+
+// Wrapped runs each command as arguments to Prefix, e.g. to run it in a
+// sandbox with bwrap or with a different user with sudo.
+type Wrapped struct {
+	Executor Executor
+	// Prefix is the wrapper command line. The first element is the binary.
+	Prefix []string
+}
+
+// Run implementation for Executor.
+func (w Wrapped) Run(cmd Command) error {
+	if len(w.Prefix) == 0 {
+		return OrDefault(w.Executor).Run(cmd)
+	}
+	wrapped := cmd
+	wrapped.Path = w.Prefix[0]
+	wrapped.Args = append(append(append([]string{}, w.Prefix[1:]...), cmd.Path), cmd.Args...)
+	return OrDefault(w.Executor).Run(wrapped)
+}
@@ -0,0 +1,65 @@
+package executor
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func requireSh(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+}
+
+func TestCommandString(t *testing.T) {
+	assert.Equal(t, "sshd -T -f config", Command{Path: "sshd", Args: []string{"-T", "-f", "config"}}.String())
+}
+
+func TestOSRun(t *testing.T) {
+	requireSh(t)
+	var stdout bytes.Buffer
+	err := OS{}.Run(Command{Path: "sh", Args: []string{"-c", "echo $GREETING"}, Env: []string{"GREETING=hello"}, Stdout: &stdout})
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", stdout.String())
+}
+
+func TestOSRunWithExitCode(t *testing.T) {
+	requireSh(t)
+	err := OS{}.Run(Command{Path: "sh", Args: []string{"-c", "exit 3"}})
+	var exitErr interface{ ExitCode() int }
+	assert.True(t, errors.As(err, &exitErr))
+	assert.Equal(t, 3, exitErr.ExitCode())
+}
+
+func TestOSRunWithTimeout(t *testing.T) {
+	requireSh(t)
+	err := OS{Timeout: 10 * time.Millisecond}.Run(Command{Path: "sh", Args: []string{"-c", "sleep 5"}})
+	assert.EqualError(t, err, "sh timed out after 10ms")
+}
+
+func TestLogged(t *testing.T) {
+	var log bytes.Buffer
+	var ran Command
+	executor := Logged{Func(func(cmd Command) error { ran = cmd; return nil }), &log}
+	assert.Nil(t, executor.Run(Command{Path: "ssh-keygen", Args: []string{"-s", "ca"}}))
+	assert.Equal(t, "running ssh-keygen -s ca\n", log.String())
+	assert.Equal(t, "ssh-keygen", ran.Path)
+}
+
+func TestWrapped(t *testing.T) {
+	var ran Command
+	executor := Wrapped{Func(func(cmd Command) error { ran = cmd; return nil }), []string{"bwrap", "--ro-bind", "/", "/", "--"}}
+	assert.Nil(t, executor.Run(Command{Path: "sshd", Args: []string{"-t"}}))
+	assert.Equal(t, "bwrap --ro-bind / / -- sshd -t", ran.String())
+}
+
+func TestExitError(t *testing.T) {
+	assert.EqualError(t, ExitError{2}, "exit status 2")
+	assert.Equal(t, 2, ExitError{2}.ExitCode())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ratorx/sshca/ca"
+	"golang.org/x/crypto/ssh"
+)
+
+// exportFormats describes where each export format is used, which is printed
+// to stderr so that the key itself can be piped or pasted as is.
+var exportFormats = map[string]string{
+	"openssh": "",
+	"github":  "add it under Settings > Authentication security > SSH certificate authorities of the organisation, and sign keys with sign_user --github-user USERNAME",
+	"gitlab":  "add it as a group SSH certificate (Settings > SSH certificates, or the group ssh_certificates API), and sign keys with sign_user --gitlab-user USERNAME",
+}
+
+// ExportCmd is the command that prints the CA public key in the form that
+// other systems expect.
+type ExportCmd struct {
+	RPCFlags
+	Format string `arg:"--format" default:"openssh" placeholder:"FORMAT" help:"format of the key: openssh, github or gitlab"`
+	Output string `arg:"-o,--output" placeholder:"PATH" help:"file to write the key to (default: stdout)"`
+}
+
+// Validate implementation for Command
+func (e ExportCmd) Validate() error {
+	if _, ok := exportFormats[e.Format]; !ok {
+		return fmt.Errorf("unknown format %q (must be openssh, github or gitlab)", e.Format)
+	}
+	return e.RPCFlags.Validate()
+}
+
+// exportKey formats the CA key. GitHub and GitLab expect the key without a
+// comment.
+func (e ExportCmd) exportKey(key *ca.PublicKey) ([]byte, error) {
+	if e.Format == "openssh" {
+		return []byte(strings.TrimSpace(key.String()) + "\n"), nil
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(key.Marshal())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA public key: %w", err)
+	}
+	return ssh.MarshalAuthorizedKey(parsed), nil
+}
+
+// Run implementation for Command
+func (e ExportCmd) Run() error {
+	client, err := e.RPCFlags.MakeClient()
+	if err != nil {
+		return err
+	}
+	reply, err := client.GetCAPublicKey()
+	if err != nil {
+		return fmt.Errorf("failed to fetch public key from server: %w", err)
+	}
+	exported, err := e.exportKey(reply.CAPublicKey)
+	if err != nil {
+		return err
+	}
+
+	if e.Output == "" {
+		useStderrForMessages()
+		os.Stdout.Write(exported)
+	} else if err := writeFile(e.Output, exported, fileOptions{mode: 0o644}); err != nil {
+		return err
+	}
+	if hint := exportFormats[e.Format]; hint != "" {
+		out.progress("%s: %s", e.Format, hint)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"golang.org/x/crypto/ssh"
+)
+
+// FetchCmd is the command that fetches the certificate for a request made with
+// sign_user --async.
+type FetchCmd struct {
+	CertFileFlags
+	Remote        string        `arg:"-r,required" help:"remote server the request was submitted to"`
+	Tenant        string        `arg:"--tenant,env:SSHCA_TENANT" placeholder:"NAME" help:"tenant the request was submitted to"`
+	RequestID     string        `arg:"positional,required" placeholder:"REQUEST_ID" help:"ID printed when the request was submitted"`
+	PublicKeyPath string        `arg:"positional,required" help:"path to the SSH public key that was submitted"`
+	Wait          bool          `arg:"-w" help:"wait for the request to be approved instead of failing if it is still pending"`
+	PollInterval  time.Duration `default:"5s" help:"how often to check the request status when --wait is set"`
+}
+
+// Validate implementation for Command
+func (f FetchCmd) Validate() error {
+	if f.PollInterval <= 0 {
+		return fmt.Errorf("--pollinterval must be positive")
+	}
+	return nil
+}
+
+// Run implementation for Command
+func (f FetchCmd) Run() error {
+	publicKey, err := ca.NewPublicKey(f.PublicKeyPath)
+	if err != nil {
+		return err
+	}
+	client, err := RPCFlags{Remote: f.Remote, Tenant: f.Tenant}.MakeClient()
+	if err != nil {
+		return err
+	}
+
+	var certificate *ca.PublicKey
+	if f.Wait {
+		reply, err := client.WaitForSignResult(f.RequestID, f.PollInterval)
+		if err != nil {
+			return fmt.Errorf("request %s failed: %w", f.RequestID, err)
+		}
+		certificate = reply.Certificate
+	} else {
+		result, err := client.GetSignResult(f.RequestID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch request %s: %w", f.RequestID, err)
+		}
+		switch result.Status {
+		case ca.RequestPending:
+			return fmt.Errorf("request %s is still pending", f.RequestID)
+		case ca.RequestFailed:
+			return fmt.Errorf("request %s failed: %s", f.RequestID, result.Error)
+		}
+		certificate = result.Certificate
+	}
+
+	// Only the request ID ties the certificate to the key, so check that it
+	// certifies the key before replacing the key's certificate
+	if err := checkCertifies(certificate, publicKey, f.PublicKeyPath); err != nil {
+		return fmt.Errorf("request %s: %w", f.RequestID, err)
+	}
+
+	// Async requests are only made by sign_user, so the certificate belongs to
+	// the same user
+	u, err := targetUser("")
+	if err != nil {
+		return err
+	}
+	_, err = writeCertificate(certificate, f.PublicKeyPath, f.CertFileFlags.options(ownerOf(u)))
+	return err
+}
+
+// checkCertifies checks that certificate is a certificate for publicKey, which
+// was read from keyPath.
+func checkCertifies(certificate *ca.PublicKey, publicKey *ca.PublicKey, keyPath string) error {
+	if certificate == nil {
+		return fmt.Errorf("the server returned no certificate")
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(certificate.Marshal())
+	if err != nil {
+		return fmt.Errorf("failed to parse the certificate: %w", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("the server returned a key instead of a certificate")
+	}
+	if !publicKey.Matches(cert.Key) {
+		return fmt.Errorf("the certificate is not for the key at %s", keyPath)
+	}
+	return nil
+}
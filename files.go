@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/ratorx/sshca/ca"
+)
+
+// fileMode is a file permission passed on the command line in octal.
+type fileMode os.FileMode
+
+// UnmarshalText converts an octal permission (e.g. 0644) into a fileMode
+func (m *fileMode) UnmarshalText(b []byte) error {
+	mode, err := strconv.ParseUint(string(b), 8, 32)
+	if err != nil || mode > 0o777 {
+		return fmt.Errorf("invalid file mode %q, expected octal permissions like 0644", b)
+	}
+	*m = fileMode(mode)
+	return nil
+}
+
+// fileOwner is the owner of a file passed on the command line as user[:group].
+// The zero value leaves the ownership unchanged.
+type fileOwner struct {
+	set bool
+	uid int
+	gid int
+}
+
+// UnmarshalText converts user[:group] (names or numeric IDs) into a fileOwner.
+// Without a group, the primary group of the user is used.
+func (o *fileOwner) UnmarshalText(b []byte) error {
+	parts := strings.SplitN(string(b), ":", 2)
+	u, err := lookupUser(parts[0])
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s has non-numeric uid %s", parts[0], u.Uid)
+	}
+
+	group := u.Gid
+	if len(parts) == 2 {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			g, err = user.LookupGroupId(parts[1])
+		}
+		if err != nil {
+			return fmt.Errorf("unknown group %s", parts[1])
+		}
+		group = g.Gid
+	}
+	gid, err := strconv.Atoi(group)
+	if err != nil {
+		return fmt.Errorf("group %s has non-numeric gid", group)
+	}
+
+	*o = fileOwner{true, uid, gid}
+	return nil
+}
+
+// lookupUser finds a user by name or numeric ID.
+func lookupUser(nameOrID string) (*user.User, error) {
+	u, err := user.Lookup(nameOrID)
+	if err != nil {
+		u, err = user.LookupId(nameOrID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unknown user %s", nameOrID)
+	}
+	return u, nil
+}
+
+// fileOptions are the permissions and ownership of a written file.
+type fileOptions struct {
+	mode  os.FileMode
+	owner fileOwner
+	// format is the encoding of certificates written with the options.
+	format ca.CertificateFormat
+}
+
+// apply sets the permissions and ownership of the file at path. The mode is
+// set explicitly, so it isn't affected by the umask or an existing file.
+func (o fileOptions) apply(path string) error {
+	if err := os.Chmod(path, o.mode); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", path, err)
+	}
+	if o.owner.set {
+		if err := os.Chown(path, o.owner.uid, o.owner.gid); err != nil {
+			return fmt.Errorf("failed to set owner of %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// CertFileFlags control the permissions and ownership of written
+// certificates.
+type CertFileFlags struct {
+	CertMode     fileMode             `arg:"--cert-mode" default:"0600" placeholder:"MODE" help:"permissions of the written certificate"`
+	CertOwner    fileOwner            `arg:"--cert-owner" placeholder:"USER[:GROUP]" help:"owner of the written certificate (default: the user the certificate is for)"`
+	OutputFormat ca.CertificateFormat `arg:"--output-format" default:"openssh" placeholder:"FORMAT" help:"encoding of the written certificate: openssh, pem, base64 or json (with the decoded fields); formats other than openssh are written to key-cert.pem, .b64 or .json, since ssh can't read them"`
+}
+
+// options returns the file options for certificates. defaultOwner is used if
+// no owner is given.
+func (f CertFileFlags) options(defaultOwner fileOwner) fileOptions {
+	owner := f.CertOwner
+	if !owner.set {
+		owner = defaultOwner
+	}
+	return fileOptions{mode: os.FileMode(f.CertMode), owner: owner, format: f.OutputFormat}
+}
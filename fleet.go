@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/ratorx/sshca/executor"
+)
+
+// FleetCmd is the command that runs a command (usually sshca itself) on many
+// hosts over SSH. Progress is saved to a state file, so an interrupted run can
+// be resumed.
+type FleetCmd struct {
+	HostsFile   string   `arg:"-f,--hosts-file,required" placeholder:"PATH" help:"file with one host to run the command on per line"`
+	StateFile   string   `arg:"--state-file" placeholder:"PATH" help:"file to record progress in; hosts that already succeeded are skipped when it is reused"`
+	MaxFailures int      `arg:"--max-failures" placeholder:"N" help:"stop starting new hosts once this many have failed (default: never stop)"`
+	Parallel    int      `arg:"-j,--parallel" default:"1" placeholder:"N" help:"number of hosts to run the command on at the same time"`
+	ForwardPort int      `arg:"--forward-port" placeholder:"PORT" help:"forward PORT on each host to the same port on this host (ssh -R), so a local CA server can be used with -r localhost:PORT"`
+	SSHPath     string   `arg:"--ssh" default:"ssh" placeholder:"PATH" help:"path to ssh"`
+	Command     []string `arg:"positional,required" help:"command to run on each host (after --, e.g. -- sudo sshca sign_host -r localhost:5000)"`
+}
+
+// Validate implementation for Command
+func (f FleetCmd) Validate() error {
+	if f.Parallel < 1 {
+		return fmt.Errorf("--parallel must be at least 1")
+	}
+	if f.MaxFailures < 0 {
+		return fmt.Errorf("--max-failures must not be negative")
+	}
+	if f.ForwardPort < 0 || f.ForwardPort > 65535 {
+		return fmt.Errorf("--forward-port must be a valid port")
+	}
+	return nil
+}
+
+// fleetHostState is the outcome of the command on a host.
+type fleetHostState struct {
+	Succeeded bool   `json:"succeeded"`
+	Error     string `json:"error,omitempty"`
+}
+
+// fleetState is the progress of a fleet run, as saved in the state file.
+type fleetState struct {
+	Command []string                  `json:"command"`
+	Hosts   map[string]fleetHostState `json:"hosts"`
+}
+
+// loadFleetState reads the state file at path, or returns an empty state for
+// command if it doesn't exist. A state file for a different command is an
+// error, because its progress doesn't apply.
+func loadFleetState(path string, command []string) (*fleetState, error) {
+	state := &fleetState{Command: command, Hosts: make(map[string]fleetHostState)}
+	if path == "" {
+		return state, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	if !reflect.DeepEqual(state.Command, command) {
+		return nil, fmt.Errorf("state file %s is for a different command (%s), remove it to start a new run", path, strings.Join(state.Command, " "))
+	}
+	if state.Hosts == nil {
+		state.Hosts = make(map[string]fleetHostState)
+	}
+	return state, nil
+}
+
+// save writes the state to path, replacing the old file atomically so an
+// interruption can't leave it truncated.
+func (s *fleetState) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), ".sshca-fleet.")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// readHosts reads the hosts file. Blank lines and lines starting with # are
+// ignored.
+func readHosts(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hosts file: %w", err)
+	}
+	defer file.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read hosts file: %w", err)
+	}
+	return hosts, nil
+}
+
+// runOnHost runs the command on host and returns its combined output.
+func (f FleetCmd) runOnHost(host string) ([]byte, error) {
+	args := []string{"-o", "BatchMode=yes"}
+	if f.ForwardPort != 0 {
+		args = append(args, "-R", fmt.Sprintf("%d:localhost:%d", f.ForwardPort, f.ForwardPort))
+	}
+	// -- stops ssh from parsing options in the command
+	args = append(append(args, "--", host), f.Command...)
+
+	var output bytes.Buffer
+	err := executor.Default.Run(executor.Command{Path: f.SSHPath, Args: args, Stdout: &output, Stderr: &output})
+	return output.Bytes(), err
+}
+
+// Run implementation for Command
+func (f FleetCmd) Run() error {
+	hosts, err := readHosts(f.HostsFile)
+	if err != nil {
+		return err
+	}
+	state, err := loadFleetState(f.StateFile, f.Command)
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		failures int
+		skipped  int
+		saveErr  error
+	)
+	slots := make(chan struct{}, f.Parallel)
+	aborted := false
+	for _, host := range hosts {
+		if state.Hosts[host].Succeeded {
+			skipped++
+			continue
+		}
+
+		slots <- struct{}{}
+		mu.Lock()
+		aborted = f.MaxFailures != 0 && failures >= f.MaxFailures
+		mu.Unlock()
+		if aborted {
+			<-slots
+			break
+		}
+
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			output, runErr := f.runOnHost(host)
+
+			mu.Lock()
+			defer mu.Unlock()
+			result := fleetHostState{Succeeded: runErr == nil}
+			if runErr != nil {
+				failures++
+				result.Error = runErr.Error()
+				fmt.Printf("=== %s: %s\n", host, out.label(colorRed, "failed: "+runErr.Error()))
+			} else {
+				fmt.Printf("=== %s: %s\n", host, out.label(colorGreen, "succeeded"))
+			}
+			os.Stdout.Write(output)
+			state.Hosts[host] = result
+			if err := state.save(f.StateFile); err != nil && saveErr == nil {
+				saveErr = err
+			}
+		}(host)
+	}
+	wg.Wait()
+
+	if saveErr != nil {
+		return saveErr
+	}
+	if skipped != 0 {
+		out.progress("skipped %d hosts that already succeeded", skipped)
+	}
+	if aborted {
+		return fmt.Errorf("stopped after %d failures, rerun with the same --state-file to resume", failures)
+	}
+	if failures != 0 {
+		return fmt.Errorf("command failed on %d hosts", failures)
+	}
+	return nil
+}
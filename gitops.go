@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/executor"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// GitOpsCmd is the command that reconciles the certificates described in a
+// git repository: it issues the certificates that are missing, outdated or
+// due for renewal, revokes the certificates of removed entries in a KRL, and
+// commits the certificates and the KRL back to the repository.
+type GitOpsCmd struct {
+	RPCFlags
+	SignFlags
+	Repo        string        `arg:"--repo,required" placeholder:"DIR" help:"working tree of the git repository, which is pulled before and pushed after each reconciliation"`
+	StatePath   string        `arg:"--state" default:"certificates.yaml" placeholder:"PATH" help:"file in the repository that describes the certificates"`
+	IssuedDir   string        `arg:"--issued-dir" default:"issued" placeholder:"DIR" help:"directory in the repository that the certificates are written to, as NAME-cert.pub"`
+	KRLPath     string        `arg:"--krl" default:"revoked.krl" placeholder:"PATH" help:"key revocation list in the repository that the certificates of removed or changed entries are added to (e.g. for the server's --krl)"`
+	RenewBefore time.Duration `arg:"--renew-before" placeholder:"DURATION" help:"renew certificates that expire within this time (default: when a third of their validity is left)"`
+	Interval    time.Duration `arg:"--interval" placeholder:"DURATION" help:"reconcile again after this long, until stopped (default: reconcile once)"`
+	DryRun      bool          `arg:"--dry-run" help:"print what would be issued and revoked, without changing anything"`
+	NoPush      bool          `arg:"--no-push" help:"commit the changes, but don't push them"`
+	GitPath     string        `arg:"--git" default:"git" placeholder:"PATH" help:"path to git"`
+}
+
+// gitOpsState is the format of the file that describes the certificates.
+type gitOpsState struct {
+	// Certificates are keyed by name, which names their file in the issued
+	// directory.
+	Certificates map[string]gitOpsCertificate `yaml:"certificates"`
+}
+
+// gitOpsCertificate is a certificate that should exist.
+type gitOpsCertificate struct {
+	// Type is user (the default) or host.
+	Type string `yaml:"type"`
+	// Key is the public key, or KeyFile the file in the repository with it.
+	Key        string   `yaml:"key"`
+	KeyFile    string   `yaml:"key_file"`
+	Principals []string `yaml:"principals"`
+	// Validity is requested from the server, which applies its own default
+	// and maximum.
+	Validity duration `yaml:"validity"`
+}
+
+// gitOpsNameRegexp matches the names of certificates, which are used in file
+// names.
+var gitOpsNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]*$`)
+
+// Validate implementation for Command
+func (g GitOpsCmd) Validate() error {
+	if g.Interval < 0 || g.RenewBefore < 0 {
+		return fmt.Errorf("--interval and --renew-before must not be negative")
+	}
+	for _, path := range []string{g.StatePath, g.IssuedDir, g.KRLPath} {
+		if !inRepository(path) {
+			return fmt.Errorf("%s must be a path in the repository", path)
+		}
+	}
+	if err := g.SignFlags.Validate(); err != nil {
+		return err
+	}
+	if g.BreakGlass != "" {
+		return fmt.Errorf("--break-glass can't be used with gitops, since break-glass certificates are for a person in an emergency")
+	}
+	return g.RPCFlags.Validate()
+}
+
+// Run implementation for Command
+func (g GitOpsCmd) Run() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	pool := ca.NewPool(g.RPCFlags.MakeClient)
+	defer pool.Close()
+	for {
+		err := g.reconcile(pool, time.Now())
+		if g.Interval == 0 {
+			return err
+		}
+		if err != nil {
+			out.error(err)
+		}
+		select {
+		case <-time.After(g.Interval):
+		case sig := <-signals:
+			out.progress("stopped by %s", sig)
+			return nil
+		}
+	}
+}
+
+// inRepository reports whether path is a relative path that stays in the
+// repository.
+func inRepository(path string) bool {
+	clean := filepath.Clean(path)
+	return !filepath.IsAbs(path) && clean != ".." && !strings.HasPrefix(clean, ".."+string(filepath.Separator))
+}
+
+// path returns the path of a file in the repository.
+func (g GitOpsCmd) path(path string) string {
+	return filepath.Join(g.Repo, path)
+}
+
+// git runs git in the repository.
+func (g GitOpsCmd) git(args ...string) error {
+	var stderr bytes.Buffer
+	cmd := executor.Command{Path: g.GitPath, Args: append([]string{"-C", g.Repo}, args...), Stderr: &stderr}
+	if err := executor.OrDefault(nil).Run(cmd); err != nil {
+		return fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// reconcile brings the issued certificates in the repository in line with the
+// state file.
+func (g GitOpsCmd) reconcile(pool *ca.Pool, now time.Time) error {
+	if !g.DryRun {
+		if err := g.git("pull", "--ff-only"); err != nil {
+			return err
+		}
+	}
+	state, err := g.loadState()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(g.path(g.IssuedDir), 0o755); err != nil {
+		return err
+	}
+
+	var result error
+	var issued, revoked []string
+	names := make([]string, 0, len(state.Certificates))
+	for name := range state.Certificates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := state.Certificates[name]
+		var superseded *ssh.Certificate
+		publicKey, err := entry.publicKey(g.Repo)
+		if err == nil {
+			var reason string
+			reason, superseded = entry.renewalReason(publicKey, g.certPath(name), g.RenewBefore, now)
+			if reason == "" {
+				continue
+			}
+			if superseded != nil {
+				reason += ", revoking it"
+			}
+			out.progress("%s: %s", name, reason)
+			if g.DryRun {
+				continue
+			}
+			err = pool.Do(func(client *ca.Client) error {
+				return g.issue(client, name, entry, publicKey, superseded)
+			})
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", name, err)
+			out.error(err)
+			result = multierror.Append(result, err)
+			continue
+		}
+		issued = append(issued, name)
+		if superseded != nil {
+			revoked = append(revoked, name)
+		}
+	}
+
+	removed, err := g.removedCertificates(state)
+	if err != nil {
+		return multierror.Append(result, err)
+	}
+	for _, name := range removed {
+		out.progress("%s: removed from %s, revoking", name, g.StatePath)
+		if g.DryRun {
+			continue
+		}
+		if err := g.revoke(name); err != nil {
+			err = fmt.Errorf("%s: %w", name, err)
+			out.error(err)
+			result = multierror.Append(result, err)
+			continue
+		}
+		revoked = append(revoked, name)
+	}
+
+	if g.DryRun || len(issued)+len(revoked) == 0 {
+		return result
+	}
+	if err := g.commit(issued, revoked); err != nil {
+		return multierror.Append(result, err)
+	}
+	return result
+}
+
+// loadState reads the state file from the repository.
+func (g GitOpsCmd) loadState() (gitOpsState, error) {
+	data, err := ioutil.ReadFile(g.path(g.StatePath))
+	if err != nil {
+		return gitOpsState{}, fmt.Errorf("failed to read %s: %w", g.StatePath, err)
+	}
+	var state gitOpsState
+	if err := yaml.UnmarshalStrict(data, &state); err != nil {
+		return gitOpsState{}, fmt.Errorf("failed to parse %s: %w", g.StatePath, err)
+	}
+	for name, entry := range state.Certificates {
+		if !gitOpsNameRegexp.MatchString(name) {
+			return gitOpsState{}, fmt.Errorf("invalid certificate name %q in %s", name, g.StatePath)
+		}
+		if err := entry.validate(); err != nil {
+			return gitOpsState{}, fmt.Errorf("certificate %s in %s: %w", name, g.StatePath, err)
+		}
+	}
+	return state, nil
+}
+
+// validate checks the entry, apart from its key.
+func (c gitOpsCertificate) validate() error {
+	if c.Type != "" && c.Type != "user" && c.Type != "host" {
+		return fmt.Errorf("invalid type %q (expected user or host)", c.Type)
+	}
+	if (c.Key == "") == (c.KeyFile == "") {
+		return fmt.Errorf("exactly one of key and key_file is required")
+	}
+	if c.KeyFile != "" && !inRepository(c.KeyFile) {
+		return fmt.Errorf("key_file %s must be a path in the repository", c.KeyFile)
+	}
+	if len(c.Principals) == 0 {
+		return fmt.Errorf("no principals")
+	}
+	return validatePrincipals(c.Principals)
+}
+
+// certType returns the type of certificate of the entry.
+func (c gitOpsCertificate) certType() ca.CertificateType {
+	if c.Type == "host" {
+		return ca.HostCertificate
+	}
+	return ca.UserCertificate
+}
+
+// publicKey returns the key of the entry, reading key_file from repo.
+func (c gitOpsCertificate) publicKey(repo string) (*ca.PublicKey, error) {
+	if c.KeyFile != "" {
+		// validate only checks the path, which could still lead out of the
+		// repository through a symlink
+		root, err := filepath.EvalSymlinks(repo)
+		if err != nil {
+			return nil, err
+		}
+		path, err := filepath.EvalSymlinks(filepath.Join(root, c.KeyFile))
+		if err != nil {
+			return nil, err
+		}
+		if rel, err := filepath.Rel(root, path); err != nil || !inRepository(rel) {
+			return nil, fmt.Errorf("key_file %s is outside of the repository", c.KeyFile)
+		}
+		return ca.NewPublicKey(path)
+	}
+	return ca.ParsePublicKey([]byte(strings.TrimSpace(c.Key) + "\n"))
+}
+
+// renewalReason returns why the certificate at certPath has to be issued
+// again for the entry, or "" if it doesn't. It also returns the certificate if
+// the entry no longer allows it (e.g. a principal was removed), so it has to
+// be revoked rather than just replaced.
+func (c gitOpsCertificate) renewalReason(publicKey *ca.PublicKey, certPath string, renewBefore time.Duration, now time.Time) (string, *ssh.Certificate) {
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		return "there is no certificate", nil
+	}
+	cert, err := readCertificate(certPath)
+	if err != nil {
+		return err.Error(), nil
+	}
+	if (cert.CertType == ssh.HostCert) != bool(c.certType()) {
+		return fmt.Sprintf("the certificate is not a %s certificate", c.certType()), cert
+	}
+	if !publicKey.Matches(cert.Key) {
+		return "the certificate is for another key", cert
+	}
+	principals := append([]string{}, c.Principals...)
+	sort.Strings(principals)
+	certPrincipals := append([]string{}, cert.ValidPrincipals...)
+	sort.Strings(certPrincipals)
+	if strings.Join(principals, ",") != strings.Join(certPrincipals, ",") {
+		return fmt.Sprintf("the certificate has the principals %s, not %s", strings.Join(certPrincipals, ","), strings.Join(principals, ",")), cert
+	}
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return "", nil
+	}
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	validBefore := time.Unix(int64(cert.ValidBefore), 0)
+	if renewBefore == 0 {
+		renewBefore = validBefore.Sub(validAfter) / 3
+	}
+	if !now.Before(validBefore.Add(-renewBefore)) {
+		return fmt.Sprintf("the certificate expires at %s", validBefore.UTC().Format(time.RFC3339)), nil
+	}
+	return "", nil
+}
+
+// certPath returns the path of the certificate called name.
+func (g GitOpsCmd) certPath(name string) string {
+	return filepath.Join(g.path(g.IssuedDir), name+"-cert.pub")
+}
+
+// issue signs the key of an entry and writes the certificate to the issued
+// directory. The superseded certificate, if any, is added to the KRL before
+// it's replaced.
+func (g GitOpsCmd) issue(client *ca.Client, name string, entry gitOpsCertificate, publicKey *ca.PublicKey, superseded *ssh.Certificate) error {
+	flags := g.SignFlags
+	if entry.Validity != 0 {
+		flags.Validity = time.Duration(entry.Validity)
+	}
+	req := certRequest{principals: entry.Principals, certType: entry.certType(), flags: flags, username: entry.Principals[0]}
+	if superseded != nil && superseded.Serial == 0 {
+		// Certificates without a serial can only be revoked by their identity,
+		// which would revoke the new certificate too
+		identity, err := getCertificateIdentity(publicKey, name, req)
+		if err != nil {
+			return err
+		}
+		req.identity = identity + "_" + time.Now().UTC().Format("20060102T150405Z")
+	}
+	args, err := newSignArgsForKey(publicKey, name, req)
+	if err != nil {
+		return err
+	}
+	if !g.RPCFlags.Local {
+		out.progress("%s", args)
+	}
+	certificate, err := signPublicKey(client, args)
+	if err != nil {
+		return err
+	}
+	if superseded != nil {
+		if err := g.addToKRL(g.certPath(name)); err != nil {
+			return err
+		}
+		out.success("revoked the superseded certificate of %s in %s", name, g.KRLPath)
+	}
+	// The certificates are public, and are read by whoever deploys them
+	options := fileOptions{mode: 0o644, format: ca.OpenSSHFormat}
+	certPath, err := writeCertificate(certificate, filepath.Join(g.path(g.IssuedDir), name+".pub"), options)
+	if err != nil {
+		return err
+	}
+	return g.afterSign(signedCertificate{"gitops", certificate, "", certPath})
+}
+
+// removedCertificates returns the names of the certificates in the issued
+// directory that are no longer in the state.
+func (g GitOpsCmd) removedCertificates(state gitOpsState) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(g.path(g.IssuedDir), "*-cert.pub"))
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), "-cert.pub")
+		if _, ok := state.Certificates[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	return removed, nil
+}
+
+// revoke adds the certificate called name to the KRL, and removes it from the
+// issued directory.
+func (g GitOpsCmd) revoke(name string) error {
+	certPath := g.certPath(name)
+	if err := g.addToKRL(certPath); err != nil {
+		return err
+	}
+	if err := os.Remove(certPath); err != nil {
+		return err
+	}
+	out.success("revoked %s in %s", name, g.KRLPath)
+	return nil
+}
+
+// addToKRL adds the certificate at certPath to the KRL, creating it if needed.
+// ssh-keygen revokes certificates by serial, or by identity if they don't have
+// one.
+func (g GitOpsCmd) addToKRL(certPath string) error {
+	krlPath := g.path(g.KRLPath)
+	args := []string{"-k", "-f", krlPath}
+	if _, err := os.Stat(krlPath); err == nil {
+		args = append(args, "-u")
+	}
+	var stderr bytes.Buffer
+	cmd := executor.Command{Path: g.SSHKeygenPath, Args: append(args, certPath), Stderr: &stderr}
+	if err := executor.OrDefault(nil).Run(cmd); err != nil {
+		return fmt.Errorf("failed to add the certificate to %s: %w: %s", g.KRLPath, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// commit commits the issued and revoked certificates, and pushes them unless
+// --no-push is set.
+func (g GitOpsCmd) commit(issued []string, revoked []string) error {
+	paths := []string{g.IssuedDir}
+	if len(revoked) != 0 {
+		paths = append(paths, g.KRLPath)
+	}
+	if err := g.git(append([]string{"add", "--all", "--"}, paths...)...); err != nil {
+		return err
+	}
+	var summary []string
+	if len(issued) != 0 {
+		summary = append(summary, "issue "+strings.Join(issued, ", "))
+	}
+	if len(revoked) != 0 {
+		summary = append(summary, "revoke "+strings.Join(revoked, ", "))
+	}
+	message := "sshca gitops: " + strings.Join(summary, "; ")
+	if err := g.git("commit", "--message", message); err != nil {
+		return err
+	}
+	out.success("committed %q", message)
+	if g.NoPush {
+		return nil
+	}
+	if err := g.git("push"); err != nil {
+		return err
+	}
+	out.success("pushed the changes")
+	return nil
+}
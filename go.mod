@@ -6,6 +6,8 @@ require (
 	github.com/Showmax/go-fqdn v1.0.0
 	github.com/alexflint/go-arg v1.3.0
 	github.com/hashicorp/go-multierror v1.1.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/stretchr/testify v1.2.2
 	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ratorx/sshca/ca"
+	"gopkg.in/yaml.v2"
+)
+
+// groupsFile is the format of the file passed to server --groups.
+type groupsFile struct {
+	Groups ca.Groups `yaml:"groups"`
+}
+
+// loadGroups reads the groups file at path.
+func loadGroups(path string) (ca.Groups, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read groups at %s: %w", path, err)
+	}
+	var file groupsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse groups at %s: %w", path, err)
+	}
+	if err := file.Groups.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid groups at %s: %w", path, err)
+	}
+	return file.Groups, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/executor"
+	"golang.org/x/crypto/ssh"
+)
+
+// signedCertificate describes a certificate that was just issued, for the
+// post-sign hooks.
+type signedCertificate struct {
+	// command is the command that requested it (e.g. sign_user or sign_host).
+	command     string
+	certificate *ca.PublicKey
+	// keyPath and certPath are empty if the key was read from stdin or the
+	// certificate wasn't written.
+	keyPath  string
+	certPath string
+}
+
+// parse returns the parsed certificate.
+func (s signedCertificate) parse() (*ssh.Certificate, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey(s.certificate.Marshal())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("the server returned a public key instead of a certificate")
+	}
+	return cert, nil
+}
+
+// certificateType returns the type of cert.
+func certificateType(cert *ssh.Certificate) ca.CertificateType {
+	if cert.CertType == ssh.HostCert {
+		return ca.HostCertificate
+	}
+	return ca.UserCertificate
+}
+
+// env returns the environment variables that describe the certificate to the
+// hooks.
+func (s signedCertificate) env() ([]string, error) {
+	cert, err := s.parse()
+	if err != nil {
+		return nil, err
+	}
+	// Unbounded validity is left empty
+	validAfter, validBefore := "", ""
+	if cert.ValidAfter != 0 {
+		validAfter = time.Unix(int64(cert.ValidAfter), 0).UTC().Format(time.RFC3339)
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		validBefore = time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339)
+	}
+	return []string{
+		"SSHCA_COMMAND=" + s.command,
+		"SSHCA_KEY_PATH=" + s.keyPath,
+		"SSHCA_CERT_PATH=" + s.certPath,
+		"SSHCA_CERT_TYPE=" + certificateType(cert).String(),
+		"SSHCA_KEY_ID=" + cert.KeyId,
+		"SSHCA_SERIAL=" + strconv.FormatUint(cert.Serial, 10),
+		"SSHCA_PRINCIPALS=" + strings.Join(cert.ValidPrincipals, ","),
+		"SSHCA_VALID_AFTER=" + validAfter,
+		"SSHCA_VALID_BEFORE=" + validBefore,
+		"SSHCA_FINGERPRINT=" + ssh.FingerprintSHA256(cert.Key),
+		"SSHCA_CA_FINGERPRINT=" + ssh.FingerprintSHA256(cert.SignatureKey),
+	}, nil
+}
+
+// afterSign runs the post-sign hooks and pushes the certificate to the store,
+// if one was given. Both are done even if the other fails.
+func (f SignFlags) afterSign(signed signedCertificate) error {
+	hookErr := runPostSignHooks(f.postSignHooks(), signed)
+	if f.Store == "" {
+		return hookErr
+	}
+	// Validate already checked the store
+	store, _ := parseCertificateStore(f.Store)
+	storeErr := store.push(signed)
+	if hookErr != nil && storeErr != nil {
+		return multierror.Append(hookErr, storeErr)
+	} else if hookErr != nil {
+		return hookErr
+	}
+	return storeErr
+}
+
+// postSignHooks returns the hooks to run after signing: the ones from the
+// config, followed by the ones from the flags.
+func (f SignFlags) postSignHooks() []string {
+	return append(append([]string{}, config.PostSignHooks...), f.PostSignHooks...)
+}
+
+// runPostSignHooks runs each hook with the details of the certificate in the
+// environment (SSHCA_*) and the certificate on stdin. The output of the hooks
+// goes to stderr, so that it doesn't mix with a certificate printed to stdout.
+// Every hook is run, even if an earlier one fails.
+func runPostSignHooks(hooks []string, signed signedCertificate) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	env, err := signed.env()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, hook := range hooks {
+		command := strings.Fields(hook)
+		if len(command) == 0 {
+			continue
+		}
+		cmd := executor.Command{
+			Path:   command[0],
+			Args:   command[1:],
+			Env:    env,
+			Stdin:  bytes.NewReader(signed.certificate.Marshal()),
+			Stdout: os.Stderr,
+			Stderr: os.Stderr,
+		}
+		if err := executor.OrDefault(nil).Run(cmd); err != nil {
+			failed++
+			out.warning(fmt.Sprintf("post-sign hook %q failed: %s", hook, err))
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%d of %d post-sign hooks failed", failed, len(hooks))
+	}
+	return nil
+}
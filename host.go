@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ratorx/sshca/openssh"
+	"github.com/ratorx/sshca/sshd"
+)
+
+// Helpers for host operations (trust and sign_host). User certificate
+// operations must not use these, because they need to work on machines
+// without sshd (e.g. Windows and macOS clients).
+
+func appendIfNotPresent(filename string, toAppend []byte, options fileOptions) error {
+	contents, _ := ioutil.ReadFile(filename)
+
+	if bytes.Contains(contents, toAppend) {
+		return nil
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, options.mode)
+	if err != nil {
+		return fmt.Errorf("unable to open %s for appending: %w", filename, err)
+	}
+	defer f.Close()
+
+	_, err = f.Write(toAppend)
+	if err != nil {
+		return fmt.Errorf("failed to append to %s: %w", filename, err)
+	}
+
+	return options.apply(filename)
+}
+
+// writeFile replaces the contents of filename, creating it with the given
+// permissions if it doesn't exist.
+func writeFile(filename string, contents []byte, options fileOptions) error {
+	err := ioutil.WriteFile(filename, contents, options.mode)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", filename, err)
+	}
+	return options.apply(filename)
+}
+
+// replaceFile replaces the contents of filename atomically, so that readers
+// never see a partially written file.
+func replaceFile(filename string, contents []byte, options fileOptions) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(filename), ".sshca.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(contents)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := options.apply(tempFile.Name()); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), filename)
+}
+
+// useSSHD configures the sshd binary at path for the sshd package, and warns
+// about features it doesn't support.
+func useSSHD(path string) {
+	sshd.Binary = path
+	version, err := openssh.DetectSSHDVersion(path)
+	if err != nil {
+		out.warning(fmt.Sprintf("failed to detect sshd version: %s", err))
+		return
+	}
+	for _, warning := range version.Warnings(openssh.SSHDFeatures) {
+		out.warning(warning)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultHostConfigPath is the per-host config read by sign_host.
+const defaultHostConfigPath = "/etc/sshca/host.yaml"
+
+// defaultSSHDConfigPath is the sshd_config used if neither the flags nor the
+// host config set one.
+const defaultSSHDConfigPath = "/etc/ssh/sshd_config"
+
+// hostConfig holds the settings of a particular host, so that the same
+// sign_host command can be run on every host in a fleet.
+type hostConfig struct {
+	// Principals are added to the principals from the hostname and the flags.
+	Principals []string `yaml:"principals"`
+	// Validity is used if --validity is not set.
+	Validity duration `yaml:"validity"`
+	// SSHDConfig is used if --sshdconfigpath is not set.
+	SSHDConfig string `yaml:"sshd_config"`
+	// ReloadCommand is used if --reload-command is not set.
+	ReloadCommand string `yaml:"reload_command"`
+	// KeyTypes is used if --key-types is not set.
+	KeyTypes []string `yaml:"key_types"`
+	// IdentityTemplate is used if --identity-template is not set, in place of
+	// the one from the client config.
+	IdentityTemplate string `yaml:"identity_template"`
+}
+
+// loadHostConfig reads the host config at path. An empty path reads the
+// default host config if it exists.
+func loadHostConfig(path string) (hostConfig, error) {
+	explicit := path != ""
+	if !explicit {
+		path = defaultHostConfigPath
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if !explicit && errors.Is(err, os.ErrNotExist) {
+		return hostConfig{}, nil
+	}
+	if err != nil {
+		return hostConfig{}, fmt.Errorf("failed to read host config at %s: %w", path, err)
+	}
+	var cfg hostConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return hostConfig{}, fmt.Errorf("failed to parse host config at %s: %w", path, err)
+	}
+	if err := validateHostKeyTypes(cfg.KeyTypes); err != nil {
+		return hostConfig{}, fmt.Errorf("invalid key_types in host config at %s: %w", path, err)
+	}
+	if err := validateIdentityTemplate(cfg.IdentityTemplate); err != nil {
+		return hostConfig{}, fmt.Errorf("invalid identity_template in host config at %s: %w", path, err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/executor"
+	"github.com/ratorx/sshca/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+// usesHostKeyAgent returns whether sshd gets its private host keys from an
+// agent (HostKeyAgent), in which case the HostKey files can be public keys.
+func usesHostKeyAgent(sshdConfig *sshd.EffectiveConfig) bool {
+	agents := sshdConfig.Lookup("HostKeyAgent")
+	return len(agents) != 0 && agents[0] != "none"
+}
+
+// derivePublicKey returns the public key of the private key at path. Keys that
+// can't be parsed natively (e.g. security keys) are read with ssh-keygen -y. The public key of encrypted keys can only
+// be read if the key file includes it (the OpenSSH format does).
+func derivePublicKey(path string, sshKeygenPath string) (ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err == nil {
+		return signer.PublicKey(), nil
+	}
+	var missingErr *ssh.PassphraseMissingError
+	if errors.As(err, &missingErr) {
+		if missingErr.PublicKey == nil {
+			return nil, fmt.Errorf("%s is encrypted and doesn't include its public key", path)
+		}
+		return missingErr.PublicKey, nil
+	}
+
+	// An empty passphrase stops ssh-keygen from prompting
+	var stdout, stderr bytes.Buffer
+	cmd := executor.Command{Path: sshKeygenPath, Args: []string{"-y", "-P", "", "-f", path}, Stdout: &stdout, Stderr: &stderr}
+	if runErr := executor.OrDefault(nil).Run(cmd); runErr != nil {
+		return nil, fmt.Errorf("failed to read private key %s: %v (and ssh-keygen -y failed: %s)", path, err, strings.TrimSpace(stderr.String()))
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the public key of %s from ssh-keygen -y: %w", path, err)
+	}
+	return publicKey, nil
+}
+
+// checkPrivateKey returns an error unless the public key at publicKeyPath has
+// a readable private key that matches it. Certificates for orphaned public
+// keys are useless, since sshd fails to load them ("No matching private key
+// for certificate").
+func checkPrivateKey(publicKeyPath string, sshKeygenPath string) error {
+	publicKey, err := ca.NewPublicKey(publicKeyPath)
+	if err != nil {
+		return err
+	}
+	path := privateKeyPath(publicKeyPath)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("there is no private key at %s; remove the HostKey from sshd_config or restore the key", path)
+	}
+	derived, err := derivePublicKey(path, sshKeygenPath)
+	if err != nil {
+		return err
+	}
+	if !publicKey.Matches(derived) {
+		return fmt.Errorf("%s doesn't match the private key %s; regenerate it with ssh-keygen -y -f %s", publicKeyPath, path, path)
+	}
+	return nil
+}
+
+// ensurePublicKey writes the public key at publicKeyPath from its private key
+// if it is missing, since sshd only needs the private key. It returns whether
+// the public key was written.
+func ensurePublicKey(publicKeyPath string, sshKeygenPath string) (bool, error) {
+	if _, err := os.Stat(publicKeyPath); !os.IsNotExist(err) {
+		return false, nil
+	}
+	path := privateKeyPath(publicKeyPath)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, fmt.Errorf("there is no private key at %s; remove the HostKey from sshd_config or restore the key", path)
+	}
+	publicKey, err := derivePublicKey(path, sshKeygenPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to derive missing public key %s: %w", publicKeyPath, err)
+	}
+	if err := writeFile(publicKeyPath, ssh.MarshalAuthorizedKey(publicKey), fileOptions{mode: 0o644}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hostKeyTypes are the names that --key-types accepts for each key algorithm,
+// which match the names in the default host key files (ssh_host_TYPE_key).
+var hostKeyTypes = map[string]string{
+	ssh.KeyAlgoRSA:        "rsa",
+	ssh.KeyAlgoDSA:        "dsa",
+	ssh.KeyAlgoECDSA256:   "ecdsa",
+	ssh.KeyAlgoECDSA384:   "ecdsa",
+	ssh.KeyAlgoECDSA521:   "ecdsa",
+	ssh.KeyAlgoED25519:    "ed25519",
+	ssh.KeyAlgoSKECDSA256: "sk-ecdsa",
+	ssh.KeyAlgoSKED25519:  "sk-ed25519",
+}
+
+// validHostKeyType returns whether name is one of the names in hostKeyTypes.
+func validHostKeyType(name string) bool {
+	for _, known := range hostKeyTypes {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+// validateHostKeyTypes returns an error if any of names isn't in
+// hostKeyTypes.
+func validateHostKeyTypes(names []string) error {
+	for _, name := range names {
+		if !validHostKeyType(name) {
+			return fmt.Errorf("unknown key type %q (must be rsa, ecdsa, ed25519, dsa, sk-ecdsa or sk-ed25519)", name)
+		}
+	}
+	return nil
+}
+
+// hostKeyType returns the name of the type of the host key at publicKeyPath
+// (see hostKeyTypes). The type is read from the private key if the public key
+// is missing.
+func hostKeyType(publicKeyPath string, sshKeygenPath string) (string, error) {
+	var keyType string
+	if publicKey, err := ca.NewPublicKey(publicKeyPath); err == nil {
+		keyType = publicKey.Type()
+	} else {
+		derived, derivedErr := derivePublicKey(privateKeyPath(publicKeyPath), sshKeygenPath)
+		if derivedErr != nil {
+			return "", err
+		}
+		keyType = derived.Type()
+	}
+	if name, ok := hostKeyTypes[keyType]; ok {
+		return name, nil
+	}
+	return keyType, nil
+}
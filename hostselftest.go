@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/executor"
+	"github.com/ratorx/sshca/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+// selfTest checks that sshd presents a valid certificate from the CA for each
+// of the host keys at publicKeyPaths, like clients will see it.
+func (s SignHostCmd) selfTest(client *ca.Client, sshdConfig *sshd.EffectiveConfig, publicKeyPaths []string) error {
+	if s.ReloadCommand == "" {
+		out.warning("sshd wasn't reloaded, so the self-test may see the old certificates")
+	}
+	caKey, err := client.GetCAPublicKey()
+	if err != nil {
+		return fmt.Errorf("self-test failed: failed to fetch the CA public key: %w", err)
+	}
+	port := "22"
+	if ports := sshdConfig.Lookup("Port"); len(ports) != 0 {
+		port = ports[0]
+	}
+	presented, err := scanHostCertificates(s.SSHKeyscanPath, s.SelfTestHost, port)
+	if err != nil {
+		return fmt.Errorf("self-test failed: %w", err)
+	}
+
+	failures := 0
+	for _, publicKeyPath := range publicKeyPaths {
+		key, err := ca.NewPublicKey(publicKeyPath)
+		if err == nil {
+			err = checkPresentedCertificate(presented, key, caKey.CAPublicKey, time.Now())
+		}
+		if err != nil {
+			failures++
+			fmt.Printf("self-test %s %s: %s\n", out.label(colorRed, "FAIL"), publicKeyPath, err)
+			continue
+		}
+		fmt.Printf("self-test %s %s: sshd on %s:%s presents a certificate signed by the CA\n", out.label(colorGreen, "pass"), publicKeyPath, s.SelfTestHost, port)
+	}
+	if failures != 0 {
+		return fmt.Errorf("self-test failed for %d of %d host keys", failures, len(publicKeyPaths))
+	}
+	return nil
+}
+
+// scanHostCertificates returns the host certificates that the SSH server at
+// host:port presents, with ssh-keyscan -c.
+func scanHostCertificates(keyscan, host, port string) ([]*ssh.Certificate, error) {
+	var stdout bytes.Buffer
+	cmd := executor.Command{Path: keyscan, Args: []string{"-c", "-p", port, host}, Stdout: &stdout, Stderr: os.Stderr}
+	if err := executor.OrDefault(nil).Run(cmd); err != nil {
+		return nil, fmt.Errorf("failed to run %s: %w", cmd, err)
+	}
+
+	var certificates []*ssh.Certificate
+	rest := stdout.Bytes()
+	for len(rest) != 0 {
+		var key ssh.PublicKey
+		var err error
+		_, _, key, _, rest, err = ssh.ParseKnownHosts(rest)
+		if err != nil {
+			break
+		}
+		if cert, ok := key.(*ssh.Certificate); ok {
+			certificates = append(certificates, cert)
+		}
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("sshd on %s:%s presents no host certificates", host, port)
+	}
+	return certificates, nil
+}
+
+// checkPresentedCertificate returns an error unless one of the presented
+// certificates is a host certificate for key, signed by caKey and valid at now.
+func checkPresentedCertificate(presented []*ssh.Certificate, key, caKey *ca.PublicKey, now time.Time) error {
+	for _, cert := range presented {
+		if !key.Matches(cert.Key) {
+			continue
+		}
+		switch {
+		case cert.CertType != ssh.HostCert:
+			return fmt.Errorf("the certificate presented for the key is not a host certificate")
+		case !caKey.Matches(cert.SignatureKey):
+			return fmt.Errorf("the certificate presented for the key is signed by %s, not the CA (%s)", ssh.FingerprintSHA256(cert.SignatureKey), caKey.Fingerprint())
+		case !certificateValidAt(cert, now):
+			return fmt.Errorf("the certificate presented for the key is not valid now")
+		}
+		return nil
+	}
+	return fmt.Errorf("sshd doesn't present a certificate for the key (fingerprint %s)", key.Fingerprint())
+}
+
+// certificateValidAt reports whether the validity period of cert includes t.
+func certificateValidAt(cert *ssh.Certificate, t time.Time) bool {
+	unix := uint64(t.Unix())
+	return cert.ValidAfter <= unix && (cert.ValidBefore == ssh.CertTimeInfinity || unix < cert.ValidBefore)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/ratorx/sshca/ca"
+)
+
+// The identity templates that reproduce the default certificate identities,
+// e.g. laptop_alice_ed25519 and web1_host_rsa.
+const (
+	defaultUserIdentityTemplate = "{{.Hostname}}_{{.Username}}_{{.KeyID}}"
+	defaultHostIdentityTemplate = "{{.Hostname}}_host_{{.KeyID}}"
+)
+
+// identityFields are the fields that an identity template (--identity-template)
+// can use.
+type identityFields struct {
+	// Hostname is the short hostname of the machine making the request.
+	Hostname string
+	// FQDN is the fully qualified hostname of the machine making the request.
+	FQDN string
+	// Username is the user that a user certificate is for. It is empty for
+	// host certificates.
+	Username string
+	// Type is user or host.
+	Type string
+	// KeyID identifies the key by its file name (e.g. rsa for id_rsa.pub).
+	KeyID string
+	// KeyType is the algorithm of the key (e.g. rsa, ecdsa or ed25519).
+	KeyType string
+	// Date is the UTC date of the request (e.g. 2006-01-02).
+	Date string
+	// Timestamp is the UTC time of the request (e.g. 20060102T150405Z).
+	Timestamp string
+}
+
+// parseIdentityTemplate parses an identity template and checks that it only
+// uses the fields of identityFields.
+func parseIdentityTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("identity").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(&bytes.Buffer{}, identityFields{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// validateIdentityTemplate returns an error if text is set and isn't a valid
+// identity template.
+func validateIdentityTemplate(text string) error {
+	if text == "" {
+		return nil
+	}
+	_, err := parseIdentityTemplate(text)
+	return err
+}
+
+// keyTypeName returns the short name of the algorithm of publicKey, e.g.
+// ecdsa for all the ECDSA curves.
+func keyTypeName(publicKey *ca.PublicKey) string {
+	if name, ok := hostKeyTypes[publicKey.Type()]; ok {
+		return name
+	}
+	return keyIDFromType(publicKey)
+}
+
+// renderIdentity executes the identity template text with fields.
+func renderIdentity(text string, fields identityFields) (string, error) {
+	tmpl, err := parseIdentityTemplate(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid identity template: %w", err)
+	}
+	var identity strings.Builder
+	if err := tmpl.Execute(&identity, fields); err != nil {
+		return "", fmt.Errorf("invalid identity template: %w", err)
+	}
+	return identity.String(), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+)
+
+// IssuedCmd is the command that inspects the certificate registry of a server
+// on the CA machine.
+type IssuedCmd struct {
+	Show *IssuedShowCmd `arg:"subcommand:show" help:"show how a certificate was issued: when, by which backend and tenant, under which policy rules and who approved it"`
+}
+
+// command returns the selected subcommand.
+func (i IssuedCmd) command() (Command, error) {
+	if i.Show != nil {
+		return i.Show, nil
+	}
+	return nil, fmt.Errorf("issued needs a subcommand: show")
+}
+
+// Validate implementation for Command
+func (i IssuedCmd) Validate() error {
+	cmd, err := i.command()
+	if err != nil {
+		return err
+	}
+	return cmd.Validate()
+}
+
+// Run implementation for Command
+func (i IssuedCmd) Run() error {
+	cmd, err := i.command()
+	if err != nil {
+		return err
+	}
+	return cmd.Run()
+}
+
+// IssuedShowCmd is the command that shows the record of a certificate in the
+// registry, with its issuance metadata.
+type IssuedShowCmd struct {
+	CertRegistry string `arg:"--cert-registry,required" placeholder:"PATH" help:"certificate registry of the server (see server --cert-registry)"`
+	CertificateSelector
+	CAPublicKey string `arg:"--ca-public-key" placeholder:"PATH" help:"CA public key to verify the signature of the issuance metadata with (see server --sign-cert-registry)"`
+	JSON        bool   `arg:"--json" help:"print the record as JSON"`
+}
+
+// Validate implementation for Command
+func (i IssuedShowCmd) Validate() error {
+	return i.CertificateSelector.Validate()
+}
+
+// Run implementation for Command
+func (i IssuedShowCmd) Run() error {
+	args, err := i.checkArgs()
+	if err != nil {
+		return err
+	}
+	registry, err := ca.LoadCertificateRegistry(i.CertRegistry)
+	if err != nil {
+		return err
+	}
+	issued, ok := registry.Find(args)
+	if !ok {
+		return fmt.Errorf("the certificate is not in %s", i.CertRegistry)
+	}
+
+	// Verify before printing anything, so that tampered metadata is never
+	// shown as if it could be trusted
+	signature := "none (the server didn't sign it)"
+	if issued.Issuance != nil && issued.Issuance.Signature != "" {
+		signature = "not verified (pass --ca-public-key)"
+		if i.CAPublicKey != "" {
+			caKey, err := ca.NewPublicKey(i.CAPublicKey)
+			if err != nil {
+				return err
+			}
+			if err := issued.Verify(caKey); err != nil {
+				return err
+			}
+			signature = "verified with " + caKey.Fingerprint()
+		}
+	} else if i.CAPublicKey != "" {
+		return fmt.Errorf("the issuance metadata of certificate %d is not signed, so it can't be verified", issued.Serial)
+	}
+
+	if i.JSON {
+		data, err := json.MarshalIndent(issued, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	fmt.Printf("serial: %d\n", issued.Serial)
+	fmt.Printf("identity: %s\n", issued.Identity)
+	fmt.Printf("fingerprint: %s\n", issued.Fingerprint)
+	if issued.Requester != nil {
+		fmt.Printf("requester: %s\n", issued.Requester)
+	}
+	fmt.Printf("issued: %s\n", formatStatusTime(issued.IssuedAt))
+	fmt.Printf("expires: %s\n", formatStatusTime(issued.ValidBefore))
+	if !issued.RevokedAt.IsZero() {
+		fmt.Printf("revoked: %s\n", formatStatusTime(issued.RevokedAt))
+	}
+	if issued.Issuance == nil {
+		fmt.Println("issuance: unknown (recorded by an older server)")
+		return nil
+	}
+	issuance := issued.Issuance
+	fmt.Printf("signed at: %s\n", issuance.SignedAt.Local().Format(time.RFC3339Nano))
+	fmt.Printf("backend: %s\n", issuance.Backend)
+	fmt.Printf("CA key: %s\n", issuance.CAKey)
+	if issuance.Tenant != "" {
+		fmt.Printf("tenant: %s\n", issuance.Tenant)
+	}
+	fmt.Printf("approver: %s\n", issuance.Approver)
+	fmt.Println("policy rules:")
+	for _, rule := range issuance.PolicyRules {
+		fmt.Printf("  %s\n", rule)
+	}
+	fmt.Printf("signature: %s\n", signature)
+	return nil
+}
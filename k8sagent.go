@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/executor"
+	"github.com/ratorx/sshca/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+// Node annotations that report the state of the host certificates.
+const (
+	annotationStatus  = "sshca/status"
+	annotationExpires = "sshca/expires"
+	annotationRenewed = "sshca/renewed"
+	annotationMessage = "sshca/message"
+)
+
+// K8sAgentCmd is the command that keeps the host certificates of a Kubernetes
+// node signed. It is meant to run in a DaemonSet with the node's /etc/ssh
+// mounted at the same path: every --interval it signs the host keys (like
+// sign_host) if any certificate is missing, for another key or due for
+// renewal, and reports the outcome in annotations on the node.
+type K8sAgentCmd struct {
+	SignHostCmd
+	Node        string        `arg:"--node,env:NODE_NAME" placeholder:"NAME" help:"name of the node to annotate, usually from the downward API"`
+	Interval    time.Duration `arg:"--interval" default:"1h" placeholder:"DURATION" help:"how often to check the certificates"`
+	RenewBefore time.Duration `arg:"--renew-before" placeholder:"DURATION" help:"renew certificates that expire within this time (default: when a third of their validity is left)"`
+	Once        bool          `arg:"--once" help:"check and renew once, instead of running until stopped"`
+	KubectlPath string        `arg:"--kubectl" default:"kubectl" placeholder:"PATH" help:"path to kubectl, which uses the pod's service account to annotate the node"`
+}
+
+// Validate implementation for Command
+func (k K8sAgentCmd) Validate() error {
+	if k.Node == "" {
+		return fmt.Errorf("--node (or NODE_NAME) is required")
+	}
+	if k.Interval <= 0 {
+		return fmt.Errorf("--interval must be positive")
+	}
+	if k.RenewBefore < 0 {
+		return fmt.Errorf("--renew-before must not be negative")
+	}
+	return k.SignHostCmd.Validate()
+}
+
+// Run implementation for Command
+func (k K8sAgentCmd) Run() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	// The connection is reused between checks while the server keeps it open
+	pool := ca.NewPool(k.RPCFlags.MakeClient)
+	defer pool.Close()
+	for {
+		err := k.check(pool, time.Now())
+		if k.Once {
+			return err
+		}
+		if err != nil {
+			out.error(err)
+		}
+		select {
+		case <-time.After(k.Interval):
+		case sig := <-signals:
+			out.progress("stopped by %s", sig)
+			return nil
+		}
+	}
+}
+
+// check renews the certificates if needed and annotates the node with the
+// outcome.
+func (k K8sAgentCmd) check(pool *ca.Pool, now time.Time) error {
+	status, checkErr := k.renew(pool, now)
+	if checkErr != nil {
+		status.status = "error"
+		status.message = annotationValue(checkErr)
+	}
+	if err := k.annotate(status); err != nil {
+		if checkErr != nil {
+			return fmt.Errorf("%v (and %w)", checkErr, err)
+		}
+		return err
+	}
+	return checkErr
+}
+
+// annotationValue formats err on a single line, so that it is readable in
+// kubectl describe node.
+func annotationValue(err error) string {
+	var errs *multierror.Error
+	if errors.As(err, &errs) {
+		messages := make([]string, 0, len(errs.Errors))
+		for _, err := range errs.Errors {
+			messages = append(messages, annotationValue(err))
+		}
+		return strings.Join(messages, "; ")
+	}
+	return strings.Join(strings.Fields(err.Error()), " ")
+}
+
+// nodeStatus is what the annotations on the node report.
+type nodeStatus struct {
+	status  string
+	expires time.Time
+	renewed time.Time
+	message string
+}
+
+// renew signs the host keys with a client from pool if any of their
+// certificates needs renewing, and returns the status of the certificates
+// afterwards.
+func (k K8sAgentCmd) renew(pool *ca.Pool, now time.Time) (nodeStatus, error) {
+	signHost, err := k.SignHostCmd.withHostConfig()
+	if err != nil {
+		return nodeStatus{}, err
+	}
+	useSSHD(signHost.SSHDPath)
+	sshdConfig, err := sshd.LoadEffectiveConfig(signHost.SSHDConfigPath)
+	if err != nil {
+		return nodeStatus{}, fmt.Errorf("failed to find host keys: %w", err)
+	}
+	publicKeyPaths := findPublicKeys(sshdConfig)
+	if len(publicKeyPaths) == 0 {
+		return nodeStatus{}, fmt.Errorf("no HostKey in %s", signHost.SSHDConfigPath)
+	}
+	// Keys of other types are never signed, so they can't need renewing
+	publicKeyPaths = signHost.selectKeys(publicKeyPaths)
+
+	status := nodeStatus{status: "ok"}
+	reasons := k.renewalReasons(publicKeyPaths, now)
+	if len(reasons) != 0 {
+		for _, reason := range reasons {
+			out.progress("%s", reason)
+		}
+		if err := k.SignHostCmd.run(pool); err != nil {
+			return nodeStatus{}, err
+		}
+		status.renewed = now
+		// Certificates that still need renewing weren't signed properly
+		if reasons := k.renewalReasons(publicKeyPaths, now); len(reasons) != 0 {
+			return nodeStatus{}, fmt.Errorf("certificates are still not valid after signing: %s", strings.Join(reasons, "; "))
+		}
+	}
+	status.expires = earliestExpiry(publicKeyPaths)
+	return status, nil
+}
+
+// renewalReasons returns why the certificates of the host keys at
+// publicKeyPaths need to be renewed, or nothing if none of them do.
+func (k K8sAgentCmd) renewalReasons(publicKeyPaths []string, now time.Time) []string {
+	var reasons []string
+	for _, keyPath := range publicKeyPaths {
+		if reason := renewalReason(keyPath, hostCertificateWants{renewBefore: k.RenewBefore}, now); reason != "" {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", keyPath, reason))
+		}
+	}
+	return reasons
+}
+
+// hostCertificateWants is what a host certificate should be like to not need
+// renewing. Unset fields aren't checked.
+type hostCertificateWants struct {
+	// principals that the certificate must include
+	principals []string
+	// caKey that must have signed the certificate
+	caKey *ca.PublicKey
+	// renewBefore is how long before it expires the certificate is renewed
+	// (default: when a third of its validity is left)
+	renewBefore time.Duration
+}
+
+// renewalReason returns why the certificate of the host key at keyPath needs to
+// be renewed, or "" if it doesn't.
+func renewalReason(keyPath string, wants hostCertificateWants, now time.Time) string {
+	publicKey, err := ca.NewPublicKey(keyPath)
+	if err != nil {
+		return err.Error()
+	}
+	certPath := getCertificatePath(keyPath)
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		return "there is no certificate"
+	}
+	cert, err := readCertificate(certPath)
+	if err != nil {
+		return err.Error()
+	}
+	if cert.CertType != ssh.HostCert {
+		return "the certificate is not a host certificate"
+	}
+	if !publicKey.Matches(cert.Key) {
+		return "the certificate is for another key"
+	}
+	if wants.caKey != nil && !wants.caKey.Matches(cert.SignatureKey) {
+		return "the certificate is signed by another CA"
+	}
+	for _, principal := range wants.principals {
+		if !hasPrincipal(cert, principal) {
+			return fmt.Sprintf("the certificate doesn't have the principal %s", principal)
+		}
+	}
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return ""
+	}
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	validBefore := time.Unix(int64(cert.ValidBefore), 0)
+	renewBefore := wants.renewBefore
+	if renewBefore == 0 {
+		renewBefore = validBefore.Sub(validAfter) / 3
+	}
+	if !now.Before(validBefore.Add(-renewBefore)) {
+		return fmt.Sprintf("the certificate expires at %s", validBefore.UTC().Format(time.RFC3339))
+	}
+	return ""
+}
+
+// earliestExpiry returns when the first of the certificates of the host keys
+// expires, or the zero time if none do.
+func earliestExpiry(publicKeyPaths []string) time.Time {
+	var earliest time.Time
+	for _, keyPath := range publicKeyPaths {
+		cert, err := readCertificate(getCertificatePath(keyPath))
+		if err != nil || cert.ValidBefore == ssh.CertTimeInfinity {
+			continue
+		}
+		validBefore := time.Unix(int64(cert.ValidBefore), 0)
+		if earliest.IsZero() || validBefore.Before(earliest) {
+			earliest = validBefore
+		}
+	}
+	return earliest
+}
+
+// annotate sets the annotations on the node that report status. The message
+// is removed once the certificates are fine again, and the expiry is kept when
+// there is an error, since the certificates haven't changed.
+func (k K8sAgentCmd) annotate(status nodeStatus) error {
+	args := []string{"annotate", "node", k.Node, "--overwrite", annotationStatus + "=" + status.status}
+	if status.message != "" {
+		args = append(args, annotationMessage+"="+status.message)
+	} else {
+		args = append(args, annotationMessage+"-")
+	}
+	if !status.expires.IsZero() {
+		args = append(args, annotationExpires+"="+status.expires.UTC().Format(time.RFC3339))
+	} else if status.message == "" {
+		// The certificates don't expire
+		args = append(args, annotationExpires+"-")
+	}
+	if !status.renewed.IsZero() {
+		args = append(args, annotationRenewed+"="+status.renewed.UTC().Format(time.RFC3339))
+	}
+
+	cmd := executor.Command{Path: k.KubectlPath, Args: args, Stdout: os.Stdout, Stderr: os.Stderr}
+	if err := executor.OrDefault(nil).Run(cmd); err != nil {
+		return fmt.Errorf("failed to annotate node %s: %w", k.Node, err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/ratorx/sshca/ca"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Helpers for known_hosts entries, including hostnames hashed like ssh does
+// with HashKnownHosts (|1|base64(salt)|base64(HMAC-SHA1(salt, hostname))).
+
+const certAuthorityMarker = "@cert-authority"
+
+// isWildcardPattern reports whether a known_hosts pattern matches more than one
+// literal hostname. These can't be hashed, because the hash only matches the
+// exact string.
+func isWildcardPattern(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?!")
+}
+
+// isHashed reports whether the known_hosts host entry is hashed.
+func isHashed(host string) bool {
+	return strings.HasPrefix(host, "|1|")
+}
+
+// hashedMatches reports whether the hashed host entry is the hash of pattern.
+func hashedMatches(hashed, pattern string) bool {
+	components := strings.Split(hashed, "|")
+	if len(components) != 4 || components[1] != "1" {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(components[2])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(components[3])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(pattern))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// hostEntryMatches reports whether the host entry of a known_hosts line is the
+// pattern, either literally or hashed.
+func hostEntryMatches(host, pattern string) bool {
+	if isHashed(host) {
+		return hashedMatches(host, pattern)
+	}
+	return host == pattern
+}
+
+// knownHostsLines calls fn with each entry in a known_hosts file. Lines that
+// can't be parsed are skipped.
+func knownHostsLines(contents []byte, fn func(marker string, hosts []string, key ssh.PublicKey)) {
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		marker, hosts, key, _, _, err := ssh.ParseKnownHosts(scanner.Bytes())
+		if err != nil {
+			continue
+		}
+		fn(marker, hosts, key)
+	}
+}
+
+// usesHashedHosts reports whether the known_hosts file already has hashed
+// entries, which means the environment expects new entries to be hashed too.
+func usesHashedHosts(contents []byte) bool {
+	hashed := false
+	knownHostsLines(contents, func(marker string, hosts []string, key ssh.PublicKey) {
+		for _, host := range hosts {
+			hashed = hashed || isHashed(host)
+		}
+	})
+	return hashed
+}
+
+// certAuthorityLine returns a known_hosts line that trusts key as a CA for the
+// patterns. If hash is set, patterns without wildcards are hashed.
+func certAuthorityLine(patterns []string, key *ca.PublicKey, hash bool) []byte {
+	hosts := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if hash && !isWildcardPattern(pattern) {
+			pattern = knownhosts.HashHostname(pattern)
+		}
+		hosts = append(hosts, pattern)
+	}
+	return []byte(fmt.Sprintf("%s %s %s\n", certAuthorityMarker, strings.Join(hosts, ","), strings.TrimSpace(key.String())))
+}
+
+// managedCertAuthority reports whether a known_hosts line is a @cert-authority
+// line for key, which sshca manages. It returns the host entries of the line.
+func managedCertAuthority(line []byte, key *ca.PublicKey) ([]string, bool) {
+	marker, hosts, lineKey, _, _, err := ssh.ParseKnownHosts(line)
+	if err != nil || marker != "cert-authority" || !key.Matches(lineKey) {
+		return nil, false
+	}
+	return hosts, true
+}
+
+// updateCertAuthorities rewrites the @cert-authority lines for key in a
+// known_hosts file, so that there is exactly one line per pattern. Existing
+// lines for a pattern are kept unchanged (including their hashing), lines for
+// other patterns are removed and missing patterns are added where the first
+// existing line was (or at the end). Other lines are not modified. It returns
+// whether the contents changed.
+func updateCertAuthorities(contents []byte, patterns []string, key *ca.PublicKey, hash bool) ([]byte, bool) {
+	var before, after [][]byte
+	existing := make(map[string][]byte, len(patterns))
+	seenManaged, changed := false, false
+	for _, line := range bytes.SplitAfter(contents, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		hosts, ok := managedCertAuthority(line, key)
+		if !ok {
+			if seenManaged {
+				after = append(after, line)
+			} else {
+				before = append(before, line)
+			}
+			continue
+		}
+
+		seenManaged = true
+		kept := false
+		for _, pattern := range patterns {
+			if _, ok := existing[pattern]; !ok && len(hosts) == 1 && hostEntryMatches(hosts[0], pattern) {
+				existing[pattern] = line
+				kept = true
+				break
+			}
+		}
+		changed = changed || !kept
+	}
+
+	var managed [][]byte
+	for _, pattern := range patterns {
+		line, ok := existing[pattern]
+		if !ok {
+			line = certAuthorityLine([]string{pattern}, key, hash)
+			changed = true
+		}
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			line = append(line, '\n')
+		}
+		managed = append(managed, line)
+	}
+	if !changed {
+		return contents, false
+	}
+
+	// Make sure the new lines don't get joined to an unterminated last line
+	if n := len(before); n != 0 && !bytes.HasSuffix(before[n-1], []byte("\n")) {
+		before[n-1] = append(before[n-1], '\n')
+	}
+	lines := append(append(before, managed...), after...)
+	return bytes.Join(lines, nil), true
+}
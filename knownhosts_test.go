@@ -0,0 +1,166 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testKeyLine returns the public key in ca/testdata/name, without the trailing
+// newline.
+func testKeyLine(t *testing.T, name string) (*ca.PublicKey, string) {
+	t.Helper()
+	key, err := ca.NewPublicKey("ca/testdata/" + name)
+	assert.Nil(t, err)
+	return key, strings.TrimSpace(key.String())
+}
+
+func TestHashedMatches(t *testing.T) {
+	hashed := knownhosts.HashHostname("web.example.com")
+	assert.True(t, isHashed(hashed))
+	assert.True(t, hashedMatches(hashed, "web.example.com"))
+	assert.False(t, hashedMatches(hashed, "db.example.com"))
+	assert.False(t, hashedMatches("|1|not base64|abc", "web.example.com"))
+	assert.False(t, hashedMatches("|2|c2FsdA==|aGFzaA==", "web.example.com"))
+
+	assert.True(t, hostEntryMatches(hashed, "web.example.com"))
+	assert.True(t, hostEntryMatches("web.example.com", "web.example.com"))
+	assert.False(t, hostEntryMatches("*.example.com", "web.example.com"))
+}
+
+func TestUsesHashedHosts(t *testing.T) {
+	_, hostKey := testKeyLine(t, "ecdsa.pub")
+	assert.False(t, usesHashedHosts(nil))
+	assert.False(t, usesHashedHosts([]byte("web.example.com "+hostKey+"\n")))
+	assert.True(t, usesHashedHosts([]byte("web.example.com "+hostKey+"\n"+knownhosts.HashHostname("db.example.com")+" "+hostKey+"\n")))
+	assert.False(t, usesHashedHosts([]byte("# |1|comment\n")))
+}
+
+func TestCertAuthorityLine(t *testing.T) {
+	caKey, caLine := testKeyLine(t, "test.pub")
+	assert.Equal(t, "@cert-authority *.example.com,web.example.org "+caLine+"\n", string(certAuthorityLine([]string{"*.example.com", "web.example.org"}, caKey, false)))
+
+	// Wildcards can't be hashed
+	line := string(certAuthorityLine([]string{"*.example.com", "web.example.org"}, caKey, true))
+	fields := strings.Fields(line)
+	assert.Equal(t, "@cert-authority", fields[0])
+	hosts := strings.Split(fields[1], ",")
+	assert.Equal(t, "*.example.com", hosts[0])
+	assert.True(t, hashedMatches(hosts[1], "web.example.org"))
+	_, ok := managedCertAuthority([]byte(line), caKey)
+	assert.True(t, ok)
+}
+
+func TestUpdateCertAuthorities(t *testing.T) {
+	caKey, caLine := testKeyLine(t, "test.pub")
+	_, otherCALine := testKeyLine(t, "ca.pub")
+	_, hostKey := testKeyLine(t, "ecdsa.pub")
+	hashedWeb := knownhosts.HashHostname("web.example.org")
+
+	tests := []struct {
+		name     string
+		contents string
+		patterns []string
+		want     string
+		changed  bool
+	}{
+		{
+			name:     "empty",
+			patterns: []string{"*.example.com"},
+			want:     "@cert-authority *.example.com " + caLine + "\n",
+			changed:  true,
+		},
+		{
+			name:     "already trusted",
+			contents: "web.example.com " + hostKey + "\n@cert-authority *.example.com " + caLine + "\n",
+			patterns: []string{"*.example.com"},
+			want:     "web.example.com " + hostKey + "\n@cert-authority *.example.com " + caLine + "\n",
+		},
+		{
+			name:     "already trusted without trailing newline",
+			contents: "@cert-authority *.example.com " + caLine,
+			patterns: []string{"*.example.com"},
+			want:     "@cert-authority *.example.com " + caLine,
+		},
+		{
+			name:     "hashed entry kept",
+			contents: "@cert-authority " + hashedWeb + " " + caLine + "\n",
+			patterns: []string{"web.example.org"},
+			want:     "@cert-authority " + hashedWeb + " " + caLine + "\n",
+		},
+		{
+			name:     "hashed entry replaced",
+			contents: "@cert-authority " + hashedWeb + " " + caLine + "\n",
+			patterns: []string{"*.example.org"},
+			want:     "@cert-authority *.example.org " + caLine + "\n",
+			changed:  true,
+		},
+		{
+			name:     "pattern replaced in place",
+			contents: "# CAs\n@cert-authority *.example.org " + caLine + "\nweb.example.com " + hostKey + "\n",
+			patterns: []string{"*.example.com"},
+			want:     "# CAs\n@cert-authority *.example.com " + caLine + "\nweb.example.com " + hostKey + "\n",
+			changed:  true,
+		},
+		{
+			name:     "pattern added next to existing",
+			contents: "@cert-authority *.example.org " + caLine + "\nweb.example.com " + hostKey + "\n",
+			patterns: []string{"*.example.org", "*.example.com"},
+			want:     "@cert-authority *.example.org " + caLine + "\n@cert-authority *.example.com " + caLine + "\nweb.example.com " + hostKey + "\n",
+			changed:  true,
+		},
+		{
+			name:     "line with several patterns split",
+			contents: "@cert-authority *.example.org,*.example.com " + caLine + "\n",
+			patterns: []string{"*.example.org", "*.example.com"},
+			want:     "@cert-authority *.example.org " + caLine + "\n@cert-authority *.example.com " + caLine + "\n",
+			changed:  true,
+		},
+		{
+			name:     "duplicates removed",
+			contents: "@cert-authority *.example.com " + caLine + "\n@cert-authority *.example.com " + caLine + "\n",
+			patterns: []string{"*.example.com"},
+			want:     "@cert-authority *.example.com " + caLine + "\n",
+			changed:  true,
+		},
+		{
+			name:     "other CAs and host keys untouched",
+			contents: "@cert-authority *.example.com " + otherCALine + "\nweb.example.com " + hostKey,
+			patterns: []string{"*.example.com"},
+			want:     "@cert-authority *.example.com " + otherCALine + "\nweb.example.com " + hostKey + "\n@cert-authority *.example.com " + caLine + "\n",
+			changed:  true,
+		},
+		{
+			name:     "revoked line untouched",
+			contents: "@revoked * " + caLine + "\n",
+			patterns: []string{"*.example.com"},
+			want:     "@revoked * " + caLine + "\n@cert-authority *.example.com " + caLine + "\n",
+			changed:  true,
+		},
+	}
+
+	for _, test := range tests {
+		updated, changed := updateCertAuthorities([]byte(test.contents), test.patterns, caKey, false)
+		assert.Equal(t, test.want, string(updated), test.name)
+		assert.Equal(t, test.changed, changed, test.name)
+		// Updating again doesn't change anything
+		again, changed := updateCertAuthorities(updated, test.patterns, caKey, false)
+		assert.Equal(t, string(updated), string(again), test.name)
+		assert.False(t, changed, test.name)
+	}
+}
+
+func TestUpdateCertAuthoritiesHashesNewEntries(t *testing.T) {
+	caKey, caLine := testKeyLine(t, "test.pub")
+	updated, changed := updateCertAuthorities(nil, []string{"web.example.org", "*.example.com"}, caKey, true)
+	assert.True(t, changed)
+	lines := strings.Split(strings.TrimSuffix(string(updated), "\n"), "\n")
+	assert.Len(t, lines, 2)
+	fields := strings.Fields(lines[0])
+	assert.True(t, hashedMatches(fields[1], "web.example.org"))
+	assert.Equal(t, caLine, strings.Join(fields[2:], " "))
+	assert.Equal(t, "@cert-authority *.example.com "+caLine, lines[1])
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"os"
 
 	"github.com/alexflint/go-arg"
 )
@@ -15,10 +15,40 @@ type Command interface {
 }
 
 type args struct {
-	Trust    *TrustCmd    `arg:"subcommand:trust" help:"trust the remote CA for user and host authentication"`
-	SignUser *SignUserCmd `arg:"subcommand:sign_user" help:"generate a user certficate for a public key"`
-	SignHost *SignHostCmd `arg:"subcommand:sign_host" help:"generate and configure certificates for all the host keys"`
-	Server   *ServerCmd   `arg:"subcommand:server" help:"run as the SSH CA RPC server"`
+	Config       string           `arg:"--config" placeholder:"PATH" help:"client config file (default: ~/.config/sshca/config.yaml or /etc/sshca/config.yaml), or the server config for server"`
+	Quiet        bool             `arg:"--quiet" help:"only print errors, warnings and the results of commands (e.g. certificates)"`
+	Verbose      bool             `arg:"--verbose" help:"also print details that help with debugging"`
+	Color        string           `arg:"--color" default:"auto" placeholder:"WHEN" help:"color messages: auto (on terminals, unless NO_COLOR is set), always or never"`
+	Trust        *TrustCmd        `arg:"subcommand:trust" help:"trust the remote CA for user and host authentication"`
+	SignUser     *SignUserCmd     `arg:"subcommand:sign_user" help:"generate a user certficate for a public key"`
+	SignUsers    *SignUsersCmd    `arg:"subcommand:sign_users" help:"sign many user keys from an authorized_keys file or a directory, e.g. to migrate to certificates"`
+	SignHost     *SignHostCmd     `arg:"subcommand:sign_host" help:"generate and configure certificates for all the host keys"`
+	K8sAgent     *K8sAgentCmd     `arg:"subcommand:k8s_agent" help:"keep the host certificates of a Kubernetes node signed, as a DaemonSet"`
+	GitOps       *GitOpsCmd       `arg:"subcommand:gitops" help:"issue and revoke the certificates described in a git repository, and commit them back to it"`
+	Plan         *PlanCmd         `arg:"subcommand:plan" help:"print the actions that apply would take to reach a desired state, as JSON"`
+	Apply        *ApplyCmd        `arg:"subcommand:apply" help:"take the actions that reach a desired state (optionally only if they match a saved plan)"`
+	SSHFP        *SSHFPCmd        `arg:"subcommand:sshfp" help:"print (and optionally publish) SSHFP DNS records for the host keys"`
+	SSHDConfig   *SSHDConfigCmd   `arg:"subcommand:sshd_config" help:"inspect the effective sshd config"`
+	Principals   *PrincipalsCmd   `arg:"subcommand:principals" help:"suggest principals for sign_user from the local accounts and groups, or check them against the account_hosts from the config"`
+	TestLogin    *TestLoginCmd    `arg:"subcommand:test_login" help:"check that a host accepts a user certificate by logging in with it"`
+	Fetch        *FetchCmd        `arg:"subcommand:fetch" help:"fetch the certificate for a request made with sign_user --async"`
+	Fleet        *FleetCmd        `arg:"subcommand:fleet" help:"run a command (e.g. sshca sign_host) on many hosts over SSH"`
+	CrossCertify *CrossCertifyCmd `arg:"subcommand:cross_certify" help:"endorse another CA key as a sub-CA of the remote CA"`
+	Bundle       *BundleCmd       `arg:"subcommand:bundle" help:"print the CA key and the keys of its endorsed sub-CAs"`
+	Export       *ExportCmd       `arg:"subcommand:export" help:"print the CA public key in the format of another system (e.g. GitHub or GitLab)"`
+	Token        *TokenCmd        `arg:"subcommand:token" help:"make a short-lived bearer token from a user certificate, for services that accept certificates over HTTPS"`
+	VerifyToken  *VerifyTokenCmd  `arg:"subcommand:verify_token" help:"verify a token made with the token command against the CA keys and KRL"`
+	Status       *StatusCmd       `arg:"subcommand:status" help:"check whether a certificate is valid, expired or revoked with the CA"`
+	Report       *ReportCmd       `arg:"subcommand:report" help:"summarise the certificates issued by the server from its certificate registry"`
+	Issued       *IssuedCmd       `arg:"subcommand:issued" help:"show how a certificate was issued, from the certificate registry of the server"`
+	SyncKRL      *SyncKRLCmd      `arg:"subcommand:sync_krl" help:"download the key revocation list of the CA and configure sshd to use it"`
+	Doctor       *DoctorCmd       `arg:"subcommand:doctor" help:"check connectivity, tools, file permissions, CA trust and clock skew, and explain how to fix problems"`
+	Version      *VersionCmd      `arg:"subcommand:version" help:"print the version of sshca and optionally of a server"`
+	Request      *RequestCmd      `arg:"subcommand:request" help:"bundle signing requests for an offline CA, and import its certificates"`
+	SignBundle   *SignBundleCmd   `arg:"subcommand:sign_bundle" help:"sign the requests in a bundle on an offline CA"`
+	Replay       *ReplayCmd       `arg:"subcommand:replay" help:"send the RPC calls recorded with --record to a server again"`
+	TOTPSecret   *TOTPSecretCmd   `arg:"subcommand:totp_secret" help:"generate the TOTP secret of a client for a server started with --totp-secrets"`
+	Server       *ServerCmd       `arg:"subcommand:server" help:"run as the SSH CA RPC server"`
 }
 
 func (args) Description() string {
@@ -32,10 +62,62 @@ func main() {
 	switch {
 	case args.Trust != nil:
 		cmd = args.Trust
+	case args.SignUsers != nil:
+		cmd = args.SignUsers
 	case args.SignUser != nil:
 		cmd = args.SignUser
 	case args.SignHost != nil:
 		cmd = args.SignHost
+	case args.K8sAgent != nil:
+		cmd = args.K8sAgent
+	case args.GitOps != nil:
+		cmd = args.GitOps
+	case args.Plan != nil:
+		cmd = args.Plan
+	case args.Apply != nil:
+		cmd = args.Apply
+	case args.SSHFP != nil:
+		cmd = args.SSHFP
+	case args.SSHDConfig != nil:
+		cmd = args.SSHDConfig
+	case args.Principals != nil:
+		cmd = args.Principals
+	case args.TestLogin != nil:
+		cmd = args.TestLogin
+	case args.Fetch != nil:
+		cmd = args.Fetch
+	case args.Fleet != nil:
+		cmd = args.Fleet
+	case args.CrossCertify != nil:
+		cmd = args.CrossCertify
+	case args.Bundle != nil:
+		cmd = args.Bundle
+	case args.Export != nil:
+		cmd = args.Export
+	case args.Token != nil:
+		cmd = args.Token
+	case args.VerifyToken != nil:
+		cmd = args.VerifyToken
+	case args.Status != nil:
+		cmd = args.Status
+	case args.Report != nil:
+		cmd = args.Report
+	case args.Issued != nil:
+		cmd = args.Issued
+	case args.SyncKRL != nil:
+		cmd = args.SyncKRL
+	case args.Doctor != nil:
+		cmd = args.Doctor
+	case args.Version != nil:
+		cmd = args.Version
+	case args.Request != nil:
+		cmd = args.Request
+	case args.SignBundle != nil:
+		cmd = args.SignBundle
+	case args.Replay != nil:
+		cmd = args.Replay
+	case args.TOTPSecret != nil:
+		cmd = args.TOTPSecret
 	case args.Server != nil:
 		cmd = args.Server
 	default:
@@ -43,14 +125,33 @@ func main() {
 	}
 
 	// Handle flag validation
+	if args.Quiet && args.Verbose {
+		p.Fail("--quiet and --verbose cannot be used together")
+	}
+	if args.Color != colorAuto && args.Color != colorAlways && args.Color != colorNever {
+		p.Fail("--color must be auto, always or never")
+	}
+	configureOutput(args.Quiet, args.Verbose, args.Color)
+	if args.Server != nil {
+		args.Server.ConfigPath = args.Config
+	}
+
 	err := cmd.Validate()
 	if err != nil {
 		p.Fail(err.Error())
 	}
 
+	// The server has its own config
+	if args.Server == nil {
+		config, err = loadConfig(args.Config)
+		if err != nil {
+			p.Fail(err.Error())
+		}
+	}
+
 	err = cmd.Run()
 	if err != nil {
-		// TODO: Generate a nice error message
-		fmt.Println(err)
+		out.error(err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,24 @@
+package notify
+
+import (
+	"github.com/ratorx/sshca/ca"
+)
+
+// BreakGlassAlert is the body of the break-glass alerts posted to webhooks,
+// with the fields of the audit event of the request.
+type BreakGlassAlert struct {
+	Event   string `json:"event"`
+	Message string `json:"message"`
+	ca.AuditEvent
+}
+
+// NewAlertForwarder starts a forwarder that posts a BreakGlassAlert for each
+// event to webhook, e.g. the approval webhook, so that the people who would
+// have approved the request find out about it. It can be used as
+// ca.Server.Alerts.
+func NewAlertForwarder(webhook Webhook, onError func(err error)) *AuditForwarder {
+	send := func(event ca.AuditEvent) error {
+		return webhook.Post(BreakGlassAlert{"break_glass", auditMessage(event), event})
+	}
+	return NewAuditForwarder("alert webhook "+webhook.URL, send, onError)
+}
@@ -0,0 +1,33 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertForwarder(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert map[string]interface{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&alert))
+		received <- alert
+	}))
+	defer server.Close()
+
+	event := testAuditEvent
+	event.BreakGlass = "INC-42: approvers unreachable"
+	forwarder := NewAlertForwarder(NewWebhook(server.URL, time.Second), func(err error) { t.Error(err) })
+	assert.Nil(t, forwarder.Record(event))
+	forwarder.Close()
+
+	alert := <-received
+	assert.Equal(t, "break_glass", alert["event"])
+	assert.Equal(t, `issued user certificate "alice" for alice,admin requested by alice@laptop (break-glass: INC-42: approvers unreachable)`, alert["message"])
+	assert.Equal(t, "INC-42: approvers unreachable", alert["break_glass"])
+	assert.Equal(t, "alice", alert["identity"])
+}
@@ -0,0 +1,247 @@
+package notify
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+)
+
+// ApprovalPath is the path that WebhookApprover receives callbacks on,
+// followed by the ID of the request.
+const ApprovalPath = "/approvals/"
+
+// Decisions of an ApprovalResponse.
+const (
+	Approve = "approve"
+	Deny    = "deny"
+	// Pending means that the request will be decided by a callback or a later
+	// poll. An empty decision is also pending.
+	Pending = "pending"
+)
+
+// ApprovalRequest is posted to the approval webhook for every signing
+// request.
+type ApprovalRequest struct {
+	Event string `json:"event"`
+	// ID is a short number for the request, for commands such as
+	// "/approve 42".
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	// CallbackURL is where the decision can be posted as an
+	// ApprovalResponse. It is empty if callbacks aren't enabled.
+	CallbackURL string     `json:"callback_url,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+// ApprovalResponse is the decision on a request, returned by the webhook, by
+// polling PollURL or posted to the callback URL.
+type ApprovalResponse struct {
+	Decision string `json:"decision"`
+	// Reason is shown to the operator and returned to the client for denied
+	// requests.
+	Reason string `json:"reason,omitempty"`
+	// Approver identifies who decided (e.g. the chat user), and is recorded
+	// in the certificate registry for approved requests.
+	Approver string `json:"approver,omitempty"`
+	// PollURL is polled with GET until it returns a decision. It is only read
+	// from the webhook response.
+	PollURL string `json:"poll_url,omitempty"`
+}
+
+// WebhookApprover asks an external service (e.g. a chat bot) to approve
+// signing requests, instead of the operator on the terminal. It implements
+// ca.Interactor, and receives callbacks as an http.Handler.
+type WebhookApprover struct {
+	webhook Webhook
+	// callbackURL is the URL that the service reaches the handler at, without
+	// ApprovalPath. Empty disables callbacks.
+	callbackURL string
+	// token must be sent as a bearer token with callbacks.
+	token        string
+	pollInterval time.Duration
+	reporter     ca.Reporter
+
+	mu      sync.Mutex
+	next    int
+	pending map[string]chan ApprovalResponse
+}
+
+// NewWebhookApprover creates an approver that posts requests to webhookURL.
+// Callbacks to callbackURL must send token; an empty callbackURL only uses
+// the webhook responses and polling. Requests sent for approval are shown on
+// reporter.
+func NewWebhookApprover(webhookURL string, callbackURL string, token string, pollInterval time.Duration, reporter ca.Reporter) *WebhookApprover {
+	return &WebhookApprover{
+		webhook:      NewWebhook(webhookURL, 10*time.Second),
+		callbackURL:  strings.TrimSuffix(callbackURL, "/"),
+		token:        token,
+		pollInterval: pollInterval,
+		reporter:     reporter,
+		next:         1,
+		pending:      map[string]chan ApprovalResponse{},
+	}
+}
+
+// Confirm implementation for ca.Interactor. It posts the request to the
+// webhook, and waits for a decision in the response, from a callback or from
+// polling.
+func (a *WebhookApprover) Confirm(description string, timeout time.Duration) (ca.Approval, error) {
+	id, decisions := a.register()
+	defer a.unregister(id)
+
+	request := ApprovalRequest{Event: "approval_request", ID: id, Description: description}
+	if a.callbackURL != "" {
+		request.CallbackURL = a.callbackURL + ApprovalPath + id
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expires := time.Now().Add(timeout).UTC()
+		request.ExpiresAt = &expires
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	a.reporter.Report(fmt.Sprintf("[%s] %s\nsent for approval to %s", id, description, a.webhook.URL))
+
+	var response ApprovalResponse
+	if err := a.webhook.Call(request, &response); err != nil {
+		return ca.Approval{}, fmt.Errorf("failed to request approval: %w", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	if response.PollURL != "" && !decided(response) {
+		go a.poll(response.PollURL, decisions, stop)
+	}
+
+	for !decided(response) {
+		select {
+		case response = <-decisions:
+		case <-expired:
+			a.reporter.Report(fmt.Sprintf("[%s] not approved within %s", id, timeout))
+			return ca.Approval{}, fmt.Errorf("not approved within %s", timeout)
+		}
+	}
+	if response.Decision == Deny {
+		err := fmt.Errorf("denied")
+		if response.Reason != "" {
+			err = fmt.Errorf("denied: %s", response.Reason)
+		}
+		a.reporter.Report(fmt.Sprintf("[%s] %s", id, err))
+		return ca.Approval{}, err
+	}
+	approver := "webhook"
+	if response.Approver != "" {
+		approver += ":" + response.Approver
+		a.reporter.Report(fmt.Sprintf("[%s] approved by %s", id, response.Approver))
+	} else {
+		a.reporter.Report(fmt.Sprintf("[%s] approved", id))
+	}
+	return ca.Approval{Approver: approver, Done: func() {}}, nil
+}
+
+// decided returns whether response approves or denies the request.
+func decided(response ApprovalResponse) bool {
+	return response.Decision == Approve || response.Decision == Deny
+}
+
+// register assigns the next ID to a request, and returns the channel that
+// its callbacks are sent on.
+func (a *WebhookApprover) register() (string, chan ApprovalResponse) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := strconv.Itoa(a.next)
+	a.next++
+	decisions := make(chan ApprovalResponse, 1)
+	a.pending[id] = decisions
+	return id, decisions
+}
+
+// unregister stops accepting callbacks for the request with id.
+func (a *WebhookApprover) unregister(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.pending, id)
+}
+
+// poll sends the decision from url to decisions once there is one, checking
+// every pollInterval until stop is closed. Errors are reported, and polling
+// continues.
+func (a *WebhookApprover) poll(url string, decisions chan<- ApprovalResponse, stop <-chan struct{}) {
+	ticker := time.NewTicker(a.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		response, err := a.get(url)
+		if err != nil {
+			a.reporter.Report(fmt.Sprintf("failed to poll %s for approval: %s", url, err))
+			continue
+		}
+		if decided(response) {
+			select {
+			case decisions <- response:
+			default:
+				// A callback already decided the request
+			}
+			return
+		}
+	}
+}
+
+// get fetches the decision at url.
+func (a *WebhookApprover) get(url string) (ApprovalResponse, error) {
+	var response ApprovalResponse
+	resp, err := a.webhook.Client.Get(url)
+	if err != nil {
+		return response, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return response, fmt.Errorf("responded with %s", resp.Status)
+	}
+	return response, decodeReply(resp.Body, &response)
+}
+
+// ServeHTTP receives the decision for a request as an ApprovalResponse posted
+// to ApprovalPath followed by its ID, with the token as a bearer token.
+func (a *WebhookApprover) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	var response ApprovalResponse
+	if err := json.NewDecoder(r.Body).Decode(&response); err != nil || !decided(response) {
+		http.Error(w, fmt.Sprintf("the body must be JSON with a decision of %s or %s", Approve, Deny), http.StatusBadRequest)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, ApprovalPath)
+	a.mu.Lock()
+	decisions, ok := a.pending[id]
+	a.mu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no request %s is waiting for approval", id), http.StatusNotFound)
+		return
+	}
+	select {
+	case decisions <- response:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, fmt.Sprintf("request %s has already been decided", id), http.StatusConflict)
+	}
+}
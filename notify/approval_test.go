@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/stretchr/testify/assert"
+)
+
+// respond returns a webhook that responds to every request with response, and
+// sends the requests it gets to requests.
+func respond(t *testing.T, response ApprovalResponse, requests chan<- ApprovalRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request ApprovalRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&request))
+		if requests != nil {
+			requests <- request
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+}
+
+func TestWebhookApproverResponse(t *testing.T) {
+	requests := make(chan ApprovalRequest, 1)
+	webhook := respond(t, ApprovalResponse{Decision: Approve}, requests)
+	defer webhook.Close()
+
+	approver := NewWebhookApprover(webhook.URL, "", "", time.Second, ca.NewWriterReporter(ioutil.Discard))
+	approval, err := approver.Confirm("sign alice", time.Minute)
+	assert.Nil(t, err)
+	approval.Done()
+	assert.Equal(t, "webhook", approval.Approver)
+	request := <-requests
+	assert.Equal(t, "1", request.ID)
+	assert.Equal(t, "sign alice", request.Description)
+	assert.NotNil(t, request.ExpiresAt)
+}
+
+func TestWebhookApproverRecordsApprover(t *testing.T) {
+	webhook := respond(t, ApprovalResponse{Decision: Approve, Approver: "alice"}, make(chan ApprovalRequest, 1))
+	defer webhook.Close()
+
+	approver := NewWebhookApprover(webhook.URL, "", "", time.Second, ca.NewWriterReporter(ioutil.Discard))
+	approval, err := approver.Confirm("sign bob", time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, "webhook:alice", approval.Approver)
+}
+
+func TestWebhookApproverDenied(t *testing.T) {
+	webhook := respond(t, ApprovalResponse{Decision: Deny, Reason: "not on call"}, nil)
+	defer webhook.Close()
+
+	approver := NewWebhookApprover(webhook.URL, "", "", time.Second, ca.NewWriterReporter(ioutil.Discard))
+	_, err := approver.Confirm("sign alice", 0)
+	assert.EqualError(t, err, "denied: not on call")
+}
+
+func TestWebhookApproverCallback(t *testing.T) {
+	requests := make(chan ApprovalRequest, 1)
+	webhook := respond(t, ApprovalResponse{Decision: Pending}, requests)
+	defer webhook.Close()
+	approver := NewWebhookApprover(webhook.URL, "http://ca.example.com/", "secret", time.Second, ca.NewWriterReporter(ioutil.Discard))
+	callbacks := httptest.NewServer(approver)
+	defer callbacks.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := approver.Confirm("sign alice", time.Minute)
+		result <- err
+	}()
+	request := <-requests
+	assert.Equal(t, "http://ca.example.com/approvals/1", request.CallbackURL)
+	callback := func(token string, body string) int {
+		req, err := http.NewRequest(http.MethodPost, callbacks.URL+ApprovalPath+request.ID, strings.NewReader(body))
+		assert.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, callback("wrong", `{"decision": "approve"}`))
+	assert.Equal(t, http.StatusBadRequest, callback("secret", `{"decision": "maybe"}`))
+	assert.Equal(t, http.StatusNoContent, callback("secret", `{"decision": "approve"}`))
+	assert.Nil(t, <-result)
+	assert.Equal(t, http.StatusNotFound, callback("secret", `{"decision": "deny"}`), "decided requests are forgotten")
+}
+
+func TestWebhookApproverPoll(t *testing.T) {
+	polls := 0
+	poll := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls < 2 {
+			w.Write([]byte(`{"decision": "pending"}`))
+			return
+		}
+		w.Write([]byte(`{"decision": "deny"}`))
+	}))
+	defer poll.Close()
+	webhook := respond(t, ApprovalResponse{PollURL: poll.URL}, nil)
+	defer webhook.Close()
+
+	approver := NewWebhookApprover(webhook.URL, "", "", 10*time.Millisecond, ca.NewWriterReporter(ioutil.Discard))
+	_, err := approver.Confirm("sign alice", time.Minute)
+	assert.EqualError(t, err, "denied")
+	assert.Equal(t, 2, polls)
+}
+
+func TestWebhookApproverTimeout(t *testing.T) {
+	webhook := respond(t, ApprovalResponse{}, nil)
+	defer webhook.Close()
+
+	var reported bytes.Buffer
+	approver := NewWebhookApprover(webhook.URL, "", "", time.Second, ca.NewWriterReporter(&reported))
+	_, err := approver.Confirm("sign alice", 10*time.Millisecond)
+	assert.EqualError(t, err, "not approved within 10ms")
+	assert.Contains(t, reported.String(), "[1] not approved within 10ms")
+}
+
+func TestWebhookApproverUnreachable(t *testing.T) {
+	webhook := httptest.NewServer(http.NotFoundHandler())
+	url := webhook.URL
+	webhook.Close()
+
+	approver := NewWebhookApprover(url, "", "", time.Second, ca.NewWriterReporter(ioutil.Discard))
+	_, err := approver.Confirm("sign alice", time.Minute)
+	assert.Error(t, err)
+}
@@ -0,0 +1,296 @@
+package notify
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+)
+
+// auditQueueSize is the number of audit events that a forwarder holds while
+// its service is slow or unreachable, after which events are dropped.
+const auditQueueSize = 1024
+
+// AuditForwarder streams audit events to an external service (e.g. a SIEM)
+// in the background, so that a slow or unreachable service doesn't hold up
+// signing. It implements ca.AuditSink.
+type AuditForwarder struct {
+	name    string
+	send    func(event ca.AuditEvent) error
+	onError func(err error)
+	events  chan ca.AuditEvent
+	done    chan struct{}
+}
+
+// NewAuditForwarder starts a forwarder that sends each event with send, and
+// passes the errors of send to onError. name describes the service in errors.
+func NewAuditForwarder(name string, send func(event ca.AuditEvent) error, onError func(err error)) *AuditForwarder {
+	f := &AuditForwarder{
+		name:    name,
+		send:    send,
+		onError: onError,
+		events:  make(chan ca.AuditEvent, auditQueueSize),
+		done:    make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+// run sends the queued events until Close.
+func (f *AuditForwarder) run() {
+	defer close(f.done)
+	for event := range f.events {
+		if err := f.send(event); err != nil {
+			f.onError(fmt.Errorf("failed to forward audit event %s to %s: %w", event.RequestUUID, f.name, err))
+		}
+	}
+}
+
+// Record queues event to be forwarded. It only fails if the queue is full.
+func (f *AuditForwarder) Record(event ca.AuditEvent) error {
+	select {
+	case f.events <- event:
+		return nil
+	default:
+		return fmt.Errorf("dropped audit event %s: the queue for %s is full", event.RequestUUID, f.name)
+	}
+}
+
+// Close sends the queued events and stops the forwarder.
+func (f *AuditForwarder) Close() {
+	close(f.events)
+	<-f.done
+}
+
+// streamConn is a TCP connection to a log collector that is made when it is
+// first needed, and remade after it breaks.
+type streamConn struct {
+	addr    string
+	timeout time.Duration
+	mu      sync.Mutex
+	conn    net.Conn
+}
+
+// write sends msg, reconnecting once if the connection broke since the last
+// message.
+func (s *streamConn) write(msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if s.conn, err = net.DialTimeout("tcp", s.addr, s.timeout); err != nil {
+				return err
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+		if _, err = s.conn.Write(msg); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// outcome describes whether the certificate of an event was issued.
+func outcome(event ca.AuditEvent) string {
+	if event.Error == "" {
+		return "issued"
+	}
+	return "denied"
+}
+
+// requesterName returns the requester of an event as user@host, or "" if
+// the client didn't say.
+func requesterName(event ca.AuditEvent) string {
+	if event.Requester == nil || event.Requester.Username == "" {
+		return ""
+	}
+	if event.Requester.Hostname == "" {
+		return event.Requester.Username
+	}
+	return event.Requester.Username + "@" + event.Requester.Hostname
+}
+
+// auditMessage describes an event for people.
+func auditMessage(event ca.AuditEvent) string {
+	message := fmt.Sprintf("%s %s certificate %q for %s", outcome(event), event.CertificateType, event.Identity, strings.Join(event.Principals, ","))
+	if requester := requesterName(event); requester != "" {
+		message += " requested by " + requester
+	}
+	if event.BreakGlass != "" {
+		message += fmt.Sprintf(" (break-glass: %s)", event.BreakGlass)
+	}
+	if event.Error != "" {
+		message += ": " + event.Error
+	}
+	return message
+}
+
+// Syslog facility and severities of audit events.
+const (
+	syslogAuthPriv = 10
+	syslogAlert    = 1
+	syslogWarning  = 4
+	syslogNotice   = 5
+)
+
+// syslogSDID identifies the structured data of audit events. 32473 is the
+// private enterprise number reserved for documentation (RFC 5612), as sshca
+// has none of its own.
+const syslogSDID = "sshca@32473"
+
+// syslogParamEscaper escapes the characters that RFC 5424 requires to be
+// escaped in structured data parameter values.
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// FormatSyslog formats event as an RFC 5424 syslog message from hostname and
+// process pid, with the fields of the event as structured data.
+func FormatSyslog(event ca.AuditEvent, hostname string, pid int) string {
+	severity := syslogNotice
+	if event.BreakGlass != "" {
+		severity = syslogAlert
+	} else if event.Error != "" {
+		severity = syslogWarning
+	}
+	var sd strings.Builder
+	sd.WriteString("[" + syslogSDID)
+	for _, param := range [][2]string{
+		{"request_uuid", event.RequestUUID},
+		{"tenant", event.Tenant},
+		{"type", event.CertificateType},
+		{"identity", event.Identity},
+		{"principals", strings.Join(event.Principals, ",")},
+		{"fingerprint", event.Fingerprint},
+		{"validity", event.Validity},
+		{"requester", requesterName(event)},
+		{"client", event.Client},
+		{"break_glass", event.BreakGlass},
+	} {
+		if param[1] != "" {
+			fmt.Fprintf(&sd, ` %s="%s"`, param[0], syslogParamEscaper.Replace(param[1]))
+		}
+	}
+	sd.WriteString("]")
+	if hostname == "" {
+		hostname = "-"
+	}
+	return fmt.Sprintf("<%d>1 %s %s sshca %d %s %s %s", syslogAuthPriv*8+severity, event.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), hostname, pid, outcome(event), sd.String(), auditMessage(event))
+}
+
+// SyslogSender sends audit events to a syslog collector as RFC 5424
+// messages.
+type SyslogSender struct {
+	// Network is udp (one datagram per message) or tcp (with octet counting
+	// framing, RFC 6587).
+	Network  string
+	Hostname string
+	PID      int
+	stream   streamConn
+}
+
+// NewSyslogSender creates a SyslogSender for the collector at addr on
+// network, identifying this host by hostname.
+func NewSyslogSender(network string, addr string, hostname string, pid int, timeout time.Duration) (*SyslogSender, error) {
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("unsupported syslog network %q (must be udp or tcp)", network)
+	}
+	return &SyslogSender{Network: network, Hostname: hostname, PID: pid, stream: streamConn{addr: addr, timeout: timeout}}, nil
+}
+
+// Send sends event to the collector.
+func (s *SyslogSender) Send(event ca.AuditEvent) error {
+	msg := FormatSyslog(event, s.Hostname, s.PID)
+	if s.Network == "tcp" {
+		return s.stream.write([]byte(strconv.Itoa(len(msg)) + " " + msg))
+	}
+	conn, err := net.DialTimeout("udp", s.stream.addr, s.stream.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(msg))
+	return err
+}
+
+var (
+	// cefHeaderEscaper escapes the characters of CEF header fields.
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	// cefValueEscaper escapes the characters of CEF extension values.
+	cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// FormatCEF formats event as an ArcSight Common Event Format line.
+func FormatCEF(event ca.AuditEvent) string {
+	signature, name, severity := "certificate-issued", "Certificate issued", 3
+	switch {
+	case event.BreakGlass != "" && event.Error == "":
+		signature, name, severity = "certificate-break-glass", "Break-glass certificate issued", 10
+	case event.BreakGlass != "":
+		signature, name, severity = "certificate-break-glass-denied", "Break-glass certificate request denied", 8
+	case event.Error != "":
+		signature, name, severity = "certificate-denied", "Certificate request denied", 6
+	}
+	header := []string{"CEF:0", "ratorx", "sshca", ca.Version, signature, name, strconv.Itoa(severity)}
+	for i, field := range header[1:] {
+		header[i+1] = cefHeaderEscaper.Replace(field)
+	}
+
+	extensions := [][2]string{{"rt", strconv.FormatInt(event.Time.UnixNano()/int64(time.Millisecond), 10)}}
+	if event.Requester != nil {
+		extensions = append(extensions, [2]string{"suser", event.Requester.Username}, [2]string{"shost", event.Requester.Hostname})
+	}
+	if host, _, err := net.SplitHostPort(event.Client); err == nil {
+		extensions = append(extensions, [2]string{"src", host})
+	}
+	outcomeName := "success"
+	if event.Error != "" {
+		outcomeName = "failure"
+	}
+	extensions = append(extensions,
+		[2]string{"outcome", outcomeName},
+		[2]string{"reason", event.Error},
+		[2]string{"msg", event.BreakGlass},
+	)
+	// The fields without a CEF key are custom strings, labelled only if set
+	for i, custom := range [][2]string{
+		{"identity", event.Identity},
+		{"principals", strings.Join(event.Principals, ",")},
+		{"fingerprint", event.Fingerprint},
+		{"requestUUID", event.RequestUUID},
+		{"tenant", event.Tenant},
+		{"certificateType", event.CertificateType},
+	} {
+		if custom[1] != "" {
+			key := fmt.Sprintf("cs%d", i+1)
+			extensions = append(extensions, [2]string{key + "Label", custom[0]}, [2]string{key, custom[1]})
+		}
+	}
+	var ext []string
+	for _, extension := range extensions {
+		if extension[1] != "" {
+			ext = append(ext, extension[0]+"="+cefValueEscaper.Replace(extension[1]))
+		}
+	}
+	return strings.Join(header, "|") + "|" + strings.Join(ext, " ")
+}
+
+// CEFSender sends audit events to a collector as CEF lines over TCP.
+type CEFSender struct {
+	stream streamConn
+}
+
+// NewCEFSender creates a CEFSender for the collector at addr.
+func NewCEFSender(addr string, timeout time.Duration) *CEFSender {
+	return &CEFSender{stream: streamConn{addr: addr, timeout: timeout}}
+}
+
+// Send sends event to the collector.
+func (s *CEFSender) Send(event ca.AuditEvent) error {
+	return s.stream.write([]byte(FormatCEF(event) + "\n"))
+}
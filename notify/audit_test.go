@@ -0,0 +1,211 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/stretchr/testify/assert"
+)
+
+var testAuditEvent = ca.AuditEvent{
+	Time:            time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC),
+	RequestUUID:     "1f2e3d4c-5b6a-4978-8a9b-0c1d2e3f4a5b",
+	Client:          "192.0.2.1:50000",
+	Requester:       &ca.Requester{Username: "alice", Hostname: "laptop"},
+	CertificateType: "user",
+	Identity:        "alice",
+	Principals:      []string{"alice", "admin"},
+	Fingerprint:     "SHA256:abc",
+}
+
+func TestFormatSyslog(t *testing.T) {
+	msg := FormatSyslog(testAuditEvent, "ca.example.com", 42)
+	assert.Equal(t, `<85>1 2021-03-10T12:00:00.000000Z ca.example.com sshca 42 issued [sshca@32473 request_uuid="1f2e3d4c-5b6a-4978-8a9b-0c1d2e3f4a5b" type="user" identity="alice" principals="alice,admin" fingerprint="SHA256:abc" requester="alice@laptop" client="192.0.2.1:50000"] issued user certificate "alice" for alice,admin requested by alice@laptop`, msg)
+}
+
+func TestFormatSyslogDenied(t *testing.T) {
+	event := testAuditEvent
+	event.Identity = `a"b]c\d`
+	event.Error = "denied by the operator"
+	msg := FormatSyslog(event, "", 42)
+	assert.Contains(t, msg, `<84>1 2021-03-10T12:00:00.000000Z - sshca 42 denied `)
+	assert.Contains(t, msg, ` identity="a\"b\]c\\d" `)
+	assert.Contains(t, msg, `: denied by the operator`)
+}
+
+func TestFormatCEF(t *testing.T) {
+	event := testAuditEvent
+	event.Tenant = "prod"
+	msg := FormatCEF(event)
+	assert.Equal(t, "CEF:0|ratorx|sshca|"+ca.Version+"|certificate-issued|Certificate issued|3|rt=1615377600000 suser=alice shost=laptop src=192.0.2.1 outcome=success cs1Label=identity cs1=alice cs2Label=principals cs2=alice,admin cs3Label=fingerprint cs3=SHA256:abc cs4Label=requestUUID cs4=1f2e3d4c-5b6a-4978-8a9b-0c1d2e3f4a5b cs5Label=tenant cs5=prod cs6Label=certificateType cs6=user", msg)
+}
+
+func TestFormatCEFDenied(t *testing.T) {
+	event := testAuditEvent
+	event.Error = "key=weak\nsee policy"
+	msg := FormatCEF(event)
+	assert.Contains(t, msg, "|certificate-denied|Certificate request denied|6|")
+	assert.Contains(t, msg, ` outcome=failure reason=key\=weak\nsee policy `)
+}
+
+func TestFormatSyslogBreakGlass(t *testing.T) {
+	event := testAuditEvent
+	event.BreakGlass = "INC-42"
+	msg := FormatSyslog(event, "ca.example.com", 42)
+	assert.Contains(t, msg, `<81>1 2021-03-10T12:00:00.000000Z ca.example.com sshca 42 issued `)
+	assert.Contains(t, msg, ` break_glass="INC-42"]`)
+	assert.Contains(t, msg, `(break-glass: INC-42)`)
+}
+
+func TestFormatCEFBreakGlass(t *testing.T) {
+	event := testAuditEvent
+	event.BreakGlass = "INC-42"
+	assert.Contains(t, FormatCEF(event), "|certificate-break-glass|Break-glass certificate issued|10|")
+	assert.Contains(t, FormatCEF(event), " msg=INC-42 ")
+	event.Error = "invalid break-glass token"
+	assert.Contains(t, FormatCEF(event), "|certificate-break-glass-denied|Break-glass certificate request denied|8|")
+}
+
+func TestCEFSenderReconnects(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	lines := make(chan string)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(conn)
+			scanner.Scan()
+			lines <- scanner.Text()
+			// Close the connection after each line, so that the sender has to
+			// reconnect
+			conn.Close()
+		}
+	}()
+
+	sender := NewCEFSender(listener.Addr().String(), time.Second)
+	for i := 0; i < 2; i++ {
+		// Writing to a connection that was closed by the collector may only
+		// fail on the next write, so retry until the line arrives
+		var line string
+		for line == "" {
+			assert.Nil(t, sender.Send(testAuditEvent))
+			select {
+			case line = <-lines:
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		assert.Equal(t, FormatCEF(testAuditEvent), line)
+	}
+}
+
+func TestSyslogSenderTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 4096)
+		n, _ := conn.Read(buf)
+		received <- string(buf[:n])
+	}()
+
+	sender, err := NewSyslogSender("tcp", listener.Addr().String(), "ca", 1, time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, sender.Send(testAuditEvent))
+	msg := FormatSyslog(testAuditEvent, "ca", 1)
+	// Messages are framed by octet counting
+	assert.Equal(t, strconv.Itoa(len(msg))+" "+msg, <-received)
+}
+
+func TestSyslogSenderUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	sender, err := NewSyslogSender("udp", conn.LocalAddr().String(), "ca", 1, time.Second)
+	assert.Nil(t, err)
+	assert.Nil(t, sender.Send(testAuditEvent))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, FormatSyslog(testAuditEvent, "ca", 1), string(buf[:n]))
+}
+
+func TestNewSyslogSenderUnknownNetwork(t *testing.T) {
+	_, err := NewSyslogSender("unix", "/dev/log", "ca", 1, time.Second)
+	assert.Error(t, err)
+}
+
+func TestAuditForwarderWebhook(t *testing.T) {
+	received := make(chan ca.AuditEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event ca.AuditEvent
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&event))
+		received <- event
+	}))
+	defer server.Close()
+
+	webhook := NewWebhook(server.URL, time.Second)
+	send := func(event ca.AuditEvent) error {
+		return webhook.Post(event)
+	}
+	forwarder := NewAuditForwarder("webhook", send, func(err error) { t.Error(err) })
+	assert.Nil(t, forwarder.Record(testAuditEvent))
+	forwarder.Close()
+	assert.Equal(t, testAuditEvent, <-received)
+}
+
+func TestAuditForwarderReportsErrors(t *testing.T) {
+	var errs []error
+	send := func(event ca.AuditEvent) error {
+		return errors.New("unreachable")
+	}
+	forwarder := NewAuditForwarder("collector", send, func(err error) { errs = append(errs, err) })
+	assert.Nil(t, forwarder.Record(testAuditEvent))
+	forwarder.Close()
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "collector: unreachable")
+}
+
+func TestAuditForwarderDropsWhenFull(t *testing.T) {
+	block := make(chan struct{})
+	send := func(event ca.AuditEvent) error {
+		<-block
+		return nil
+	}
+	forwarder := NewAuditForwarder("collector", send, func(err error) { t.Error(err) })
+	var dropped int
+	// One event is being sent, and the rest fill the queue
+	for i := 0; i < auditQueueSize+2; i++ {
+		if forwarder.Record(testAuditEvent) != nil {
+			dropped++
+		}
+	}
+	close(block)
+	forwarder.Close()
+	assert.True(t, dropped >= 1)
+}
+
+func TestFormatCEFWithoutTenant(t *testing.T) {
+	msg := FormatCEF(testAuditEvent)
+	assert.NotContains(t, msg, "cs5")
+	assert.Contains(t, msg, " cs6Label=certificateType cs6=user")
+}
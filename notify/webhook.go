@@ -0,0 +1,65 @@
+// Package notify sends server events to external services.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Webhook posts events as JSON to a URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhook constructs a Webhook with a client that times out after timeout.
+func NewWebhook(url string, timeout time.Duration) Webhook {
+	return Webhook{url, &http.Client{Timeout: timeout}}
+}
+
+// Post sends event to the webhook as JSON. Any non-2xx response is an error.
+func (w Webhook) Post(event interface{}) error {
+	return w.Call(event, nil)
+}
+
+// Call sends event to the webhook as JSON, and decodes a JSON response into
+// reply unless it is nil. An empty response leaves reply unchanged. Any
+// non-2xx response is an error.
+func (w Webhook) Call(event interface{}, reply interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode webhook event: %w", err)
+	}
+
+	resp, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post to webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Drain the body so the connection can be reused
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return decodeReply(resp.Body, reply)
+}
+
+// decodeReply decodes the JSON in body into reply, unless reply is nil or
+// body is empty. The rest of body is drained, so the connection can be
+// reused.
+func decodeReply(body io.Reader, reply interface{}) error {
+	defer io.Copy(ioutil.Discard, body)
+	if reply == nil {
+		return nil
+	}
+	err := json.NewDecoder(body).Decode(reply)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to decode webhook response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookPost(t *testing.T) {
+	var received map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer server.Close()
+
+	err := NewWebhook(server.URL, time.Second).Post(map[string]string{"event": "test"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"event": "test"}, received)
+}
+
+func TestWebhookPostErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	assert.Error(t, NewWebhook(server.URL, time.Second).Post("test"))
+}
+
+func TestWebhookPostUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	assert.Error(t, NewWebhook(url, time.Second).Post("test"))
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/ssh"
+)
+
+// qrPartSize is the most characters in each QR code of a bundle, which keeps
+// the codes small enough to show on a terminal and scan from it.
+const qrPartSize = 400
+
+// BundleFormatFlags are the flags for the format that a bundle is written in.
+type BundleFormatFlags struct {
+	Format string `arg:"--format" default:"json" placeholder:"FORMAT" help:"format of the bundle: json, qr (QR codes to scan on the other machine) or words (to type on the other machine)"`
+}
+
+// Validate implementation for Command
+func (b BundleFormatFlags) Validate() error {
+	switch b.Format {
+	case "json", "qr", "words":
+		return nil
+	}
+	return fmt.Errorf("unknown format %q (must be json, qr or words)", b.Format)
+}
+
+// encode returns bundle in the format. QR codes are drawn with text, for a
+// terminal.
+func (b BundleFormatFlags) encode(bundle interface{}) ([]byte, error) {
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	switch b.Format {
+	case "qr":
+		parts, err := ca.EncodeBundleQR(data, qrPartSize)
+		if err != nil {
+			return nil, err
+		}
+		var text strings.Builder
+		for i, part := range parts {
+			code, err := qrcode.New(part, qrcode.Medium)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&text, "QR code %d of %d:\n%s\n", i+1, len(parts), code.ToSmallString(false))
+		}
+		return []byte(text.String()), nil
+	case "words":
+		words, err := ca.EncodeBundleWords(data)
+		return []byte(words), err
+	}
+	data, err = json.MarshalIndent(bundle, "", "  ")
+	return append(data, '\n'), err
+}
+
+// write writes bundle to path in the format, or to stdout if path is -.
+func (b BundleFormatFlags) write(bundle interface{}, path string) error {
+	data, err := b.encode(bundle)
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return replaceFile(path, data, fileOptions{mode: 0o644})
+}
+
+// hint returns how to carry a bundle in the format to the other machine.
+func (b BundleFormatFlags) hint() string {
+	switch b.Format {
+	case "qr":
+		return "; scan the QR codes, and save their text (one per line, in any order) in a file on the other machine"
+	case "words":
+		return "; type the lines into a file on the other machine"
+	}
+	return ""
+}
+
+// readBundle reads a bundle from path into v. The bundle can also be the text
+// of its QR codes or words.
+func readBundle(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if data, err = ca.DecodeBundle(data); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// RequestCmd is the command that carries signing requests to an offline CA
+// (see SignBundleCmd) and back.
+type RequestCmd struct {
+	Bundle *RequestBundleCmd `arg:"subcommand:bundle" help:"write signing requests for public keys to a bundle for an offline CA"`
+	Import *RequestImportCmd `arg:"subcommand:import" help:"write the certificates from the response bundle of an offline CA next to their keys"`
+}
+
+// command returns the selected subcommand.
+func (r RequestCmd) command() (Command, error) {
+	switch {
+	case r.Bundle != nil:
+		return r.Bundle, nil
+	case r.Import != nil:
+		return r.Import, nil
+	}
+	return nil, fmt.Errorf("request needs a subcommand: bundle or import")
+}
+
+// Validate implementation for Command
+func (r RequestCmd) Validate() error {
+	cmd, err := r.command()
+	if err != nil {
+		return err
+	}
+	return cmd.Validate()
+}
+
+// Run implementation for Command
+func (r RequestCmd) Run() error {
+	cmd, err := r.command()
+	if err != nil {
+		return err
+	}
+	return cmd.Run()
+}
+
+// RequestBundleCmd is the command that writes a bundle of signing requests.
+type RequestBundleCmd struct {
+	PublicKeyPaths   []string           `arg:"positional,required" placeholder:"PUBLIC_KEY" help:"public keys to request certificates for"`
+	Output           string             `arg:"-o,--output,required" placeholder:"PATH" help:"file to write the request bundle to (- for stdout)"`
+	Host             bool               `arg:"--host" help:"request host certificates, with the hostname as a principal, instead of user certificates"`
+	Principals       CommaSeparatedList `arg:"-n" help:"principals to authorise the keys for (comma-separated); defaults like sign_user, and are added to the hostname with --host"`
+	Validity         time.Duration      `arg:"-V" help:"how long the certificates should be valid for (e.g. 24h); the CA default is used if unset"`
+	Options          []string           `arg:"-O,--option,separate" placeholder:"OPTION" help:"restrict user certificates like ssh-keygen -O; can be repeated"`
+	IdentityTemplate string             `arg:"--identity-template" placeholder:"TEMPLATE" help:"Go template for the certificate identity (see sign_user)"`
+	NoProof          bool               `arg:"--no-proof" help:"don't sign the requests with the private keys (e.g. for keys on a smartcard)"`
+	BundleFormatFlags
+}
+
+// Validate implementation for Command
+func (r RequestBundleCmd) Validate() error {
+	if r.Validity < 0 {
+		return fmt.Errorf("--validity must not be negative")
+	}
+	if r.Host && len(r.Options) != 0 {
+		return fmt.Errorf("-O only applies to user certificates")
+	}
+	if err := validateIdentityTemplate(r.IdentityTemplate); err != nil {
+		return fmt.Errorf("invalid --identity-template: %w", err)
+	}
+	if err := r.BundleFormatFlags.Validate(); err != nil {
+		return err
+	}
+	return validatePrincipals(r.Principals.Items)
+}
+
+// certRequest returns the certificate to request for each key.
+func (r RequestBundleCmd) certRequest() (certRequest, error) {
+	req := certRequest{
+		principals: r.Principals.Items,
+		flags:      SignFlags{Validity: r.Validity, IdentityTemplate: r.IdentityTemplate},
+		options:    r.Options,
+	}
+	if r.Host {
+		req.certType = ca.HostCertificate
+		principals, err := SignHostCmd{Principals: r.Principals}.getPrincipals()
+		if err != nil {
+			return certRequest{}, fmt.Errorf("failed to get principals: %w", err)
+		}
+		req.principals = principals
+		return req, nil
+	}
+
+	u, err := targetUser("")
+	if err != nil {
+		return certRequest{}, err
+	}
+	req.certType = ca.UserCertificate
+	req.username = usernameOf(u)
+	if len(req.principals) == 0 {
+		req.principals = defaultPrincipals(u)
+	}
+	return req, nil
+}
+
+// prove signs the request with the private key of its public key, from
+// ssh-agent or the key file next to the public key.
+func prove(args ca.SignArgs, publicKeyPath string) (ca.SignArgs, error) {
+	signer, closeAgent := agentSigner(args.PublicKey)
+	defer closeAgent()
+	if signer == nil {
+		var err error
+		signer, err = fileSigner(privateKeyPath(publicKeyPath), args.PublicKey)
+		if err != nil {
+			return args, fmt.Errorf("failed to sign the request for %s (pass --no-proof to skip): %w", publicKeyPath, err)
+		}
+	}
+	return ca.ProveBundledRequest(args, signer)
+}
+
+// Run implementation for Command
+func (r RequestBundleCmd) Run() error {
+	if r.Output == "-" {
+		useStderrForMessages()
+	}
+	req, err := r.certRequest()
+	if err != nil {
+		return err
+	}
+	bundle := ca.RequestBundle{Version: ca.BundleVersion, Created: time.Now().UTC()}
+	for _, path := range r.PublicKeyPaths {
+		// The certificates are imported from wherever the response is
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		args, err := newSignArgs(path, req)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if !r.NoProof {
+			if args, err = prove(args, path); err != nil {
+				return err
+			}
+		}
+		out.progress("%s", args)
+		bundle.Requests = append(bundle.Requests, ca.BundledRequest{KeyPath: path, Args: args})
+	}
+
+	if err := r.BundleFormatFlags.write(bundle, r.Output); err != nil {
+		return fmt.Errorf("failed to write request bundle: %w", err)
+	}
+	out.success("wrote %d requests to %s; sign them with sshca sign_bundle on the CA%s", len(bundle.Requests), r.Output, r.BundleFormatFlags.hint())
+	return nil
+}
+
+// RequestImportCmd is the command that writes the certificates from a
+// response bundle.
+type RequestImportCmd struct {
+	CertFileFlags
+	Response        string `arg:"positional,required" placeholder:"RESPONSE" help:"response bundle written by sign_bundle, or the text of its QR codes or words"`
+	CAPublicKeyPath string `arg:"-p,--ca-public" placeholder:"PUBLIC_KEY_PATH" help:"CA public key that the certificates must be signed with (recommended; otherwise the key in the response is used)"`
+}
+
+// Validate implementation for Command
+func (r RequestImportCmd) Validate() error {
+	return nil
+}
+
+// checkBundledCertificate returns an error unless the certificate in a
+// response is for the public key at its key path and signed by caKey.
+func checkBundledCertificate(response ca.BundledResponse, caKey *ca.PublicKey) error {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(response.Certificate.Marshal())
+	if err != nil {
+		return fmt.Errorf("invalid certificate: %w", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("not a certificate")
+	}
+	publicKey, err := ca.NewPublicKey(response.KeyPath)
+	if err != nil {
+		return err
+	}
+	if !publicKey.Matches(cert.Key) {
+		return fmt.Errorf("the certificate is for another key")
+	}
+	if !caKey.Matches(cert.SignatureKey) {
+		return fmt.Errorf("the certificate is signed by another CA")
+	}
+
+	// The validity and principals were decided by the CA, so only the
+	// signature is checked
+	checker := ssh.CertChecker{
+		SupportedCriticalOptions: make([]string, 0, len(cert.CriticalOptions)),
+		Clock: func() time.Time {
+			return time.Unix(int64(cert.ValidAfter), 0)
+		},
+	}
+	for option := range cert.CriticalOptions {
+		checker.SupportedCriticalOptions = append(checker.SupportedCriticalOptions, option)
+	}
+	principal := ""
+	if len(cert.ValidPrincipals) != 0 {
+		principal = cert.ValidPrincipals[0]
+	}
+	return checker.CheckCert(principal, cert)
+}
+
+// Run implementation for Command
+func (r RequestImportCmd) Run() error {
+	var bundle ca.ResponseBundle
+	if err := readBundle(r.Response, &bundle); err != nil {
+		return fmt.Errorf("failed to read response bundle: %w", err)
+	}
+	if bundle.Version != ca.BundleVersion {
+		return fmt.Errorf("unsupported response bundle version %d", bundle.Version)
+	}
+
+	caKey := bundle.CAPublicKey
+	if r.CAPublicKeyPath != "" {
+		var err error
+		if caKey, err = ca.NewPublicKey(r.CAPublicKeyPath); err != nil {
+			return err
+		}
+	} else if caKey == nil {
+		return fmt.Errorf("the response bundle has no CA public key")
+	} else {
+		out.warning(fmt.Sprintf("trusting the CA key in the response (%s); pass --ca-public to check it", strings.TrimSpace(string(caKey.Data))))
+	}
+
+	imported := 0
+	for _, response := range bundle.Responses {
+		if response.Error != "" {
+			out.error(fmt.Errorf("request for %s was refused: %s", response.KeyPath, response.Error))
+			continue
+		}
+		if response.Certificate == nil {
+			out.error(fmt.Errorf("response for %s has no certificate", response.KeyPath))
+			continue
+		}
+		if err := checkBundledCertificate(response, caKey); err != nil {
+			out.error(fmt.Errorf("not importing the certificate for %s: %w", response.KeyPath, err))
+			continue
+		}
+		if _, err := writeCertificate(response.Certificate, response.KeyPath, r.CertFileFlags.options(fileOwner{})); err != nil {
+			out.error(err)
+			continue
+		}
+		imported++
+	}
+	if imported != len(bundle.Responses) {
+		return fmt.Errorf("imported %d of %d certificates", imported, len(bundle.Responses))
+	}
+	out.success("imported %d certificates", imported)
+	return nil
+}
+
+// SignBundleCmd is the command that signs a request bundle on an offline CA
+// and writes the response bundle.
+type SignBundleCmd struct {
+	Request          string `arg:"positional,required" placeholder:"REQUEST" help:"request bundle written by request bundle, or the text of its QR codes or words"`
+	Output           string `arg:"-o,--output,required" placeholder:"PATH" help:"file to write the response bundle to (- for stdout)"`
+	PrivateKeyPath   string `arg:"-s,--private,required" placeholder:"PRIVATE_KEY_PATH" help:"SSH CA private key path"`
+	PublicKeyPath    string `arg:"-p,--public" placeholder:"PUBLIC_KEY_PATH" help:"SSH CA public key path (optional, inferred from private key path)"`
+	SkipConfirmation bool   `arg:"--skip-confirmation,-q" help:"sign every request without confirming it"`
+	SSHKeygenPath    string `arg:"--ssh-keygen" default:"ssh-keygen" placeholder:"PATH" help:"path to ssh-keygen"`
+	ValidityFlags
+	AlgorithmFlags
+	ProofFlags
+	PrincipalFlags
+	ExtensionFlags
+	BundleFormatFlags
+}
+
+// Validate implementation for Command
+func (s SignBundleCmd) Validate() error {
+	if s.Output == s.Request {
+		return fmt.Errorf("--output must not be the request bundle")
+	}
+	if err := s.ValidityFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.BundleFormatFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.ExtensionFlags.Validate(); err != nil {
+		return err
+	}
+	return s.AlgorithmFlags.Validate()
+}
+
+// Run implementation for Command
+func (s SignBundleCmd) Run() error {
+	var bundle ca.RequestBundle
+	if err := readBundle(s.Request, &bundle); err != nil {
+		return fmt.Errorf("failed to read request bundle: %w", err)
+	}
+
+	server, err := ca.NewServer(s.PrivateKeyPath, s.PublicKeyPath, s.SkipConfirmation)
+	if err != nil {
+		return fmt.Errorf("failed to initialize SSH CA: %w", err)
+	}
+	s.ValidityFlags.apply(server.Policy)
+	server.RequireProof = s.ProofFlags.policy()
+	server.Principals = s.PrincipalFlags.policy()
+	server.Extensions = s.ExtensionFlags.policy()
+	server.SSHKeygen = detectSSHKeygen(s.SSHKeygenPath)
+	if s.Output == "-" {
+		// Keep the bundle on stdout by itself
+		useStderrForMessages()
+		server.Reporter = ca.NewWriterReporter(os.Stderr)
+		server.Interactor = ca.NewTerminalInteractor(os.Stdin, os.Stderr)
+	}
+	if err := server.SetAlgorithmPolicy(s.AlgorithmFlags.policy()); err != nil {
+		return fmt.Errorf("invalid algorithm policy: %w", err)
+	}
+
+	response, err := server.SignBundle(bundle)
+	if err != nil {
+		return err
+	}
+	if err := s.BundleFormatFlags.write(response, s.Output); err != nil {
+		return fmt.Errorf("failed to write response bundle: %w", err)
+	}
+
+	signed := 0
+	for _, outcome := range response.Responses {
+		if outcome.Error == "" {
+			signed++
+		}
+	}
+	out.success("signed %d of %d requests; wrote the response to %s for sshca request import%s", signed, len(response.Responses), s.Output, s.BundleFormatFlags.hint())
+	return nil
+}
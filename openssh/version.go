@@ -0,0 +1,153 @@
+// Package openssh detects the version of the installed OpenSSH tools and the
+// features they support.
+package openssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/ratorx/sshca/executor"
+)
+
+var versionRegexp = regexp.MustCompile(`OpenSSH_(\d+)\.(\d+)`)
+
+// Version is an OpenSSH release version. The zero value represents an unknown
+// version, which is assumed to support every feature.
+type Version struct {
+	Major int
+	Minor int
+}
+
+// ParseVersion finds the OpenSSH version in the output of one of the OpenSSH
+// binaries (e.g. "OpenSSH_8.4p1 Debian-3, OpenSSL 1.1.1i").
+func ParseVersion(out []byte) (Version, error) {
+	matches := versionRegexp.FindSubmatch(out)
+	if matches == nil {
+		return Version{}, fmt.Errorf("no OpenSSH version found in %q", bytes.TrimSpace(out))
+	}
+	// The regexp guarantees that the matches are integers
+	major, _ := strconv.Atoi(string(matches[1]))
+	minor, _ := strconv.Atoi(string(matches[2]))
+	return Version{major, minor}, nil
+}
+
+// Unknown is true iff the version could not be detected.
+func (v Version) Unknown() bool {
+	return v == Version{}
+}
+
+// AtLeast is true iff v is the same as or newer than other. Unknown versions
+// are considered to be the newest.
+func (v Version) AtLeast(other Version) bool {
+	if v.Unknown() {
+		return true
+	}
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+	return v.Minor >= other.Minor
+}
+
+// String implementation for Stringer.
+func (v Version) String() string {
+	if v.Unknown() {
+		return "unknown"
+	}
+	return fmt.Sprintf("OpenSSH_%d.%d", v.Major, v.Minor)
+}
+
+// Feature is a capability of the OpenSSH tools that only exists from a certain
+// version.
+type Feature struct {
+	Description string
+	Since       Version
+}
+
+var (
+	// RelativeValidity is support for relative times (e.g. +1h) in
+	// ssh-keygen -V.
+	RelativeValidity = Feature{"relative certificate validity times (ssh-keygen -V +1h)", Version{5, 6}}
+	// AgentCAKey is support for signing with a CA key held in ssh-agent
+	// (ssh-keygen -Us).
+	AgentCAKey = Feature{"signing with a CA key in ssh-agent (ssh-keygen -Us)", Version{7, 2}}
+	// CertSignatureAlgorithm is support for choosing the signature algorithm
+	// of an RSA CA (ssh-keygen -s -t rsa-sha2-512). It is only needed by
+	// algorithm policies, which check for it themselves, so it is not part of
+	// SSHKeygenFeatures.
+	CertSignatureAlgorithm = Feature{"choosing the CA signature algorithm (ssh-keygen -s -t)", Version{8, 2}}
+	// SignData is support for signing arbitrary data (ssh-keygen -Y sign). It
+	// is only needed to cross-certify sub-CAs, which checks for it itself.
+	SignData = Feature{"signing data (ssh-keygen -Y sign)", Version{8, 1}}
+	// SSHKeygenFeatures are the features used by the CA with ssh-keygen.
+	SSHKeygenFeatures = []Feature{RelativeValidity, AgentCAKey}
+
+	// Certificates is support for HostCertificate and TrustedUserCAKeys in
+	// sshd.
+	Certificates = Feature{"certificates (HostCertificate and TrustedUserCAKeys)", Version{5, 4}}
+	// ConfigTest is support for printing the effective config with sshd -T.
+	ConfigTest = Feature{"printing the effective configuration (sshd -T)", Version{5, 1}}
+	// RSASHA2Signatures is support for verifying RSA signatures with SHA-2,
+	// which CAs make with rsa-sha2-256 or rsa-sha2-512. It is only needed for
+	// RSA CA keys, so it is not part of SSHDFeatures.
+	RSASHA2Signatures = Feature{"RSA signatures with SHA-2 (rsa-sha2-256 and rsa-sha2-512)", Version{7, 2}}
+	// CASignatureAlgorithms is support for restricting the algorithms of CA
+	// signatures with CASignatureAlgorithms. From 8.2, the default no longer
+	// includes ssh-rsa (SHA-1). It is only needed when the CA signs with an
+	// algorithm that isn't allowed by default, so it is not part of
+	// SSHDFeatures.
+	CASignatureAlgorithms = Feature{"CASignatureAlgorithms", Version{7, 9}}
+	// SSHDFeatures are the features used when configuring sshd.
+	SSHDFeatures = []Feature{Certificates, ConfigTest}
+)
+
+// Supports is true iff the version supports the feature.
+func (v Version) Supports(f Feature) bool {
+	return v.AtLeast(f.Since)
+}
+
+// Warnings returns a warning for each feature that the version does not
+// support.
+func (v Version) Warnings(features []Feature) []string {
+	var warnings []string
+	for _, f := range features {
+		if !v.Supports(f) {
+			warnings = append(warnings, fmt.Sprintf("%s does not support %s (needs %s)", v, f.Description, f.Since))
+		}
+	}
+	return warnings
+}
+
+// DetectVersion runs the binary at path with args and parses the version from
+// its combined output, using executor.Default. The exit code is ignored,
+// because several OpenSSH binaries only print their version as part of the
+// usage message.
+func DetectVersion(path string, args ...string) (Version, error) {
+	var out bytes.Buffer
+	err := executor.Default.Run(executor.Command{Path: path, Args: args, Stdout: &out, Stderr: &out})
+	var exitErr interface{ ExitCode() int }
+	if err != nil && !errors.As(err, &exitErr) {
+		return Version{}, fmt.Errorf("failed to execute %s: %w", path, err)
+	}
+	return ParseVersion(out.Bytes())
+}
+
+// DetectSSHKeygenVersion detects the version of ssh-keygen. ssh-keygen can't
+// report its own version, so it runs the ssh client installed next to it.
+func DetectSSHKeygenVersion(sshKeygenPath string) (Version, error) {
+	resolved, err := exec.LookPath(sshKeygenPath)
+	if err != nil {
+		return Version{}, fmt.Errorf("failed to find %s: %w", sshKeygenPath, err)
+	}
+	return DetectVersion(filepath.Join(filepath.Dir(resolved), "ssh"), "-V")
+}
+
+// DetectSSHDVersion detects the version of sshd. Older versions don't
+// recognise -V, but print the version in the usage message instead.
+func DetectSSHDVersion(sshdPath string) (Version, error) {
+	return DetectVersion(sshdPath, "-V")
+}
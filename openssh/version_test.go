@@ -0,0 +1,61 @@
+package openssh
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVersion(t *testing.T) {
+	v, err := ParseVersion([]byte("OpenSSH_8.4p1 Debian-3, OpenSSL 1.1.1i  8 Dec 2020\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, Version{8, 4}, v)
+}
+
+func TestParseVersionFromUsage(t *testing.T) {
+	v, err := ParseVersion([]byte("unknown option -- V\nOpenSSH_7.4p1, OpenSSL 1.0.2k-fips  26 Jan 2017\nusage: sshd [-46DdeiqTt]\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, Version{7, 4}, v)
+}
+
+func TestParseVersionInvalid(t *testing.T) {
+	_, err := ParseVersion([]byte("usage: ssh-keygen"))
+	assert.Error(t, err)
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	assert.True(t, Version{8, 4}.AtLeast(Version{8, 4}))
+	assert.True(t, Version{8, 4}.AtLeast(Version{7, 9}))
+	assert.False(t, Version{8, 4}.AtLeast(Version{8, 5}))
+	assert.False(t, Version{7, 9}.AtLeast(Version{8, 0}))
+	assert.True(t, Version{}.AtLeast(Version{99, 0}))
+}
+
+func TestVersionString(t *testing.T) {
+	assert.Equal(t, "OpenSSH_8.4", Version{8, 4}.String())
+	assert.Equal(t, "unknown", Version{}.String())
+}
+
+func TestVersionWarnings(t *testing.T) {
+	assert.Empty(t, Version{8, 4}.Warnings(SSHKeygenFeatures))
+	assert.Empty(t, Version{}.Warnings(SSHKeygenFeatures))
+	warnings := Version{6, 0}.Warnings(SSHKeygenFeatures)
+	assert.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "ssh-keygen -Us")
+}
+
+func TestDetectSSHKeygenVersion(t *testing.T) {
+	_, err := exec.LookPath("ssh")
+	if err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	v, err := DetectSSHKeygenVersion("ssh-keygen")
+	assert.Nil(t, err)
+	assert.False(t, v.Unknown())
+}
+
+func TestDetectSSHKeygenVersionNonexistent(t *testing.T) {
+	_, err := DetectSSHKeygenVersion("./testdata/nonexistent")
+	assert.Error(t, err)
+}
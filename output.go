@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Colors of the messages on terminals (SGR codes).
+const (
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+)
+
+// Values of the --color flag.
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// output prints the messages of the commands, as opposed to their results
+// (certificates, records, reports), which are printed as they are:
+//   - progress describes what the command is doing; --quiet hides it
+//   - success reports what the command did; --quiet hides it
+//   - detail is only printed with --verbose
+//   - warnings and errors are always printed, on stderr
+//
+// Messages are colored on terminals, unless NO_COLOR is set.
+type output struct {
+	// messages is where progress, success and detail messages go: stdout,
+	// unless the results of the command are printed there.
+	messages      io.Writer
+	errors        io.Writer
+	quiet         bool
+	verbose       bool
+	colorMessages bool
+	colorErrors   bool
+}
+
+// out is the output of the command that is running.
+var out = output{messages: os.Stdout, errors: os.Stderr}
+
+// configureOutput applies the output flags. Color is used on terminals with
+// --color auto, unless the NO_COLOR environment variable is set or the
+// terminal is dumb.
+func configureOutput(quiet bool, verbose bool, color string) {
+	out.quiet = quiet
+	out.verbose = verbose
+	switch color {
+	case colorAlways:
+		out.colorMessages, out.colorErrors = true, true
+	case colorNever:
+	default:
+		if _, noColor := os.LookupEnv("NO_COLOR"); noColor || os.Getenv("TERM") == "dumb" {
+			return
+		}
+		out.colorMessages = isTerminal(os.Stdout)
+		out.colorErrors = isTerminal(os.Stderr)
+	}
+}
+
+// isTerminal returns whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	return terminal.IsTerminal(int(f.Fd()))
+}
+
+// useStderrForMessages prints the messages on stderr, for commands that print
+// their results on stdout (e.g. sign_user reading the key from stdin).
+func useStderrForMessages() {
+	out.messages = os.Stderr
+	out.colorMessages = out.colorErrors
+}
+
+// paint colors s if enabled is set.
+func paint(enabled bool, color string, s string) string {
+	if !enabled {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// label colors a label at the start of a result line (e.g. "ok" or "FAIL") if
+// stdout is a terminal.
+func (o output) label(color string, s string) string {
+	return paint(o.colorMessages && o.messages == os.Stdout, color, s)
+}
+
+// progress prints what the command is doing.
+func (o output) progress(format string, a ...interface{}) {
+	if o.quiet {
+		return
+	}
+	fmt.Fprintf(o.messages, format+"\n", a...)
+}
+
+// success prints what the command did.
+func (o output) success(format string, a ...interface{}) {
+	if o.quiet {
+		return
+	}
+	fmt.Fprintln(o.messages, paint(o.colorMessages, colorGreen, fmt.Sprintf(format, a...)))
+}
+
+// detail prints information that is only useful when debugging.
+func (o output) detail(format string, a ...interface{}) {
+	if !o.verbose {
+		return
+	}
+	fmt.Fprintf(o.messages, format+"\n", a...)
+}
+
+// warning prints a problem that doesn't stop the command from running.
+func (o output) warning(warning string) {
+	fmt.Fprintf(o.errors, "%s %s\n", paint(o.colorErrors, colorYellow, "warning:"), warning)
+}
+
+// error prints an error. Commands that carry on after an error print it with
+// this as well as returning it.
+func (o output) error(err error) {
+	fmt.Fprintf(o.errors, "%s %s\n", paint(o.colorErrors, colorRed, "error:"), err)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/executor"
+)
+
+// pkcs11Providers are the usual locations of the OpenSC PKCS#11 module, which
+// supports PIV smartcards (including YubiKeys).
+var pkcs11Providers = []string{
+	"/usr/lib/x86_64-linux-gnu/opensc-pkcs11.so",
+	"/usr/lib/aarch64-linux-gnu/opensc-pkcs11.so",
+	"/usr/lib64/opensc-pkcs11.so",
+	"/usr/lib/opensc-pkcs11.so",
+	"/usr/local/lib/opensc-pkcs11.so",
+	"/opt/homebrew/lib/opensc-pkcs11.so",
+	"/Library/OpenSC/lib/opensc-pkcs11.so",
+}
+
+// pivAuthLabel is in the comment that ssh-keygen -D gives the key in the PIV
+// Authentication slot (9a), which is the slot meant for logging in.
+const pivAuthLabel = "PIV AUTH"
+
+// pivPublicKeyName is the file in ~/.ssh that the smartcard public key is
+// written to, so that the certificate can be written next to it.
+const pivPublicKeyName = "id_piv.pub"
+
+// pkcs11Provider returns the PKCS#11 module to read the smartcard with.
+func (s SignUserCmd) pkcs11Provider() (string, error) {
+	if s.PKCS11Provider != "" {
+		return s.PKCS11Provider, nil
+	}
+	for _, provider := range pkcs11Providers {
+		if _, err := os.Stat(provider); err == nil {
+			return provider, nil
+		}
+	}
+	return "", fmt.Errorf("OpenSC PKCS#11 module not found; install OpenSC or pass --pkcs11-provider")
+}
+
+// readPIVKeys returns the public keys on the smartcard, in the format of
+// ssh-keygen -D. With a public key path, the keys are read from it instead
+// (e.g. the saved output of ssh-keygen -D, for a machine without the reader).
+func (s SignUserCmd) readPIVKeys(provider string) ([]byte, error) {
+	if s.PublicKeyPath != "" {
+		data, err := ioutil.ReadFile(s.PublicKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read smartcard keys: %w", err)
+		}
+		return data, nil
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := executor.Command{Path: s.SSHKeygenPath, Args: []string{"-D", provider}, Stdout: &stdout, Stderr: &stderr}
+	if err := executor.OrDefault(nil).Run(cmd); err != nil {
+		return nil, fmt.Errorf("failed to read keys from the smartcard with %s -D %s (is the card inserted?): %w: %s", s.SSHKeygenPath, provider, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// choosePIVKey returns the key to sign from the ssh-keygen -D output: the only
+// key, or the key in the PIV Authentication slot.
+func choosePIVKey(output []byte) (*ca.PublicKey, error) {
+	var keys, auth []*ca.PublicKey
+	var comments []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		key, err := ca.ParsePublicKey([]byte(line + "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse smartcard key: %w", err)
+		}
+		keys = append(keys, key)
+		fields := strings.SplitN(line, " ", 3)
+		comment := ""
+		if len(fields) == 3 {
+			comment = fields[2]
+		}
+		comments = append(comments, fmt.Sprintf("%q", comment))
+		if strings.Contains(comment, pivAuthLabel) {
+			auth = append(auth, key)
+		}
+	}
+	switch {
+	case len(keys) == 0:
+		return nil, fmt.Errorf("the smartcard has no keys")
+	case len(keys) == 1:
+		return keys[0], nil
+	case len(auth) == 1:
+		return auth[0], nil
+	}
+	return nil, fmt.Errorf("the smartcard has %d keys (%s) and none is the only %s key; save the one to sign from ssh-keygen -D and pass it as the public key", len(keys), strings.Join(comments, ", "), pivAuthLabel)
+}
+
+// signPIV signs the public key on a PIV smartcard. The key is written to
+// ~/.ssh/id_piv.pub, so that the certificate is written next to it, and the
+// private key stays on the card.
+func (s SignUserCmd) signPIV(u *user.User) error {
+	// The module is only needed for the card itself, not its saved keys
+	provider, err := s.pkcs11Provider()
+	if err != nil && (s.PublicKeyPath == "" || s.AddToAgent) {
+		return err
+	}
+	output, err := s.readPIVKeys(provider)
+	if err != nil {
+		return err
+	}
+	publicKey, err := choosePIVKey(output)
+	if err != nil {
+		return err
+	}
+
+	sshDir, err := userSSHDir(u)
+	if err != nil {
+		return err
+	}
+	publicKeyPath := filepath.Join(sshDir, pivPublicKeyName)
+	if err := writeFile(publicKeyPath, publicKey.Data, fileOptions{mode: 0o644, owner: ownerOf(u)}); err != nil {
+		return err
+	}
+	out.success("wrote smartcard public key (fingerprint %s) to %s", publicKey.Fingerprint(), publicKeyPath)
+
+	client, err := s.RPCFlags.MakeClient()
+	if err != nil {
+		return err
+	}
+	certificate, certPath, err := generateCertificate(client, publicKeyPath, s.certRequest(u), s.CertFileFlags.options(ownerOf(u)), !s.RPCFlags.Local)
+	if err != nil {
+		return err
+	}
+	if err := s.afterSign(signedCertificate{"sign_user", certificate, publicKeyPath, certPath}); err != nil {
+		return err
+	}
+
+	if s.AddToAgent {
+		// ssh-add asks for the PIN of the card
+		cmd := executor.Command{Path: "ssh-add", Args: []string{"-s", provider}, Stdin: os.Stdin, Stdout: os.Stdout, Stderr: os.Stderr}
+		if err := executor.OrDefault(nil).Run(cmd); err != nil {
+			return fmt.Errorf("failed to add the smartcard to ssh-agent: %w", err)
+		}
+	}
+	printPIVInstructions(provider, certPath, s.AddToAgent)
+	return nil
+}
+
+// printPIVInstructions explains how to use the smartcard with the certificate.
+// ssh pairs a CertificateFile with the matching key from the card or agent.
+func printPIVInstructions(provider string, certPath string, inAgent bool) {
+	if provider == "" {
+		provider = "/path/to/opensc-pkcs11.so"
+	}
+	out.progress("to log in with the smartcard and the certificate, add to ~/.ssh/config:")
+	if !inAgent {
+		out.progress("  PKCS11Provider %s", provider)
+	}
+	out.progress("  CertificateFile %s", certPath)
+	if !inAgent {
+		out.progress("or load the card into ssh-agent with 'ssh-add -s %s' and only add the CertificateFile line", provider)
+	}
+}
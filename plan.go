@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/sshd"
+	"gopkg.in/yaml.v2"
+)
+
+// planFormatVersion is the version of the JSON plan format. It changes when
+// tools that read plans would misunderstand the new format.
+const planFormatVersion = 1
+
+// The actions in a plan, in the order that apply runs them.
+const (
+	actionTrustHostCA      = "trust_host_ca"
+	actionTrustUserCA      = "trust_user_ca"
+	actionSignHostKey      = "sign_host_key"
+	actionUpdateSSHDConfig = "update_sshd_config"
+	actionReloadSSHD       = "reload_sshd"
+)
+
+// desiredState is how the CA should be set up on this machine, for plan and
+// apply. Sections that are left out aren't managed.
+type desiredState struct {
+	// CAFingerprint pins the CA: planning fails if the server's CA key has
+	// another fingerprint.
+	CAFingerprint string        `yaml:"ca_fingerprint"`
+	Trust         *desiredTrust `yaml:"trust"`
+	Hosts         *desiredHosts `yaml:"hosts"`
+}
+
+// desiredTrust is what the CA should be trusted for, like trust.
+type desiredTrust struct {
+	// HostsPatterns are the known hosts patterns of the hosts to trust the CA
+	// for. The CA isn't trusted for host authentication if there are none.
+	HostsPatterns []string `yaml:"hosts_patterns"`
+	// Users trusts the CA for user authentication in sshd_config.
+	Users bool `yaml:"users"`
+}
+
+// desiredHosts is what the host certificates should be like, like sign_host.
+type desiredHosts struct {
+	// Principals are added to the principals from the hostname.
+	Principals    []string `yaml:"principals"`
+	Validity      duration `yaml:"validity"`
+	RenewBefore   duration `yaml:"renew_before"`
+	SSHDConfig    string   `yaml:"sshd_config"`
+	ReloadCommand string   `yaml:"reload_command"`
+}
+
+// loadDesiredState reads the desired state at path.
+func loadDesiredState(path string) (desiredState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return desiredState{}, fmt.Errorf("failed to read desired state at %s: %w", path, err)
+	}
+	var state desiredState
+	if err := yaml.UnmarshalStrict(data, &state); err != nil {
+		return desiredState{}, fmt.Errorf("failed to parse desired state at %s: %w", path, err)
+	}
+	if state.Trust == nil && state.Hosts == nil {
+		return desiredState{}, fmt.Errorf("desired state at %s has neither trust nor hosts", path)
+	}
+	if state.Trust != nil {
+		for _, pattern := range state.Trust.HostsPatterns {
+			if pattern == "" || strings.ContainsAny(pattern, " \t,") {
+				return desiredState{}, fmt.Errorf("invalid hosts pattern %q in %s: patterns can't be empty or contain whitespace or commas", pattern, path)
+			}
+		}
+	}
+	return state, nil
+}
+
+// plan is the machine-readable list of the actions that apply takes to reach
+// the desired state.
+type plan struct {
+	FormatVersion int          `json:"format_version"`
+	CAFingerprint string       `json:"ca_fingerprint"`
+	Actions       []planAction `json:"actions"`
+}
+
+// planAction is one step of a plan. Only the fields that apply to the action
+// are set.
+type planAction struct {
+	Action     string   `json:"action"`
+	Path       string   `json:"path,omitempty"`
+	Reason     string   `json:"reason,omitempty"`
+	Patterns   []string `json:"patterns,omitempty"`
+	Principals []string `json:"principals,omitempty"`
+	Changes    []string `json:"changes,omitempty"`
+	Command    string   `json:"command,omitempty"`
+}
+
+// PlanFlags are the flags that are common to plan and apply.
+type PlanFlags struct {
+	RPCFlags
+	StatePath string `arg:"positional,required" placeholder:"STATE" help:"YAML file with the desired state"`
+	SSHDPath  string `arg:"--sshd" default:"sshd" placeholder:"PATH" help:"path to sshd"`
+}
+
+// Validate implementation for Command
+func (f PlanFlags) Validate() error {
+	return f.RPCFlags.Validate()
+}
+
+// planner works out the plan for a desired state, and has what apply needs to
+// run it.
+type planner struct {
+	state          desiredState
+	caKey          *ca.PublicKey
+	caAlgorithm    string
+	trust          TrustCmd
+	signHost       SignHostCmd
+	sshdConfig     *sshd.EffectiveConfig
+	principals     []string
+	publicKeyPaths []string
+}
+
+// newPlanner loads the desired state and the current state of the CA and sshd.
+func (f PlanFlags) newPlanner(client *ca.Client) (*planner, error) {
+	state, err := loadDesiredState(f.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := client.GetCAPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch public key from server: %w", err)
+	}
+	if state.CAFingerprint != "" && reply.CAPublicKey.Fingerprint() != state.CAFingerprint {
+		return nil, fmt.Errorf("the CA key has fingerprint %s, not %s as in the desired state", reply.CAPublicKey.Fingerprint(), state.CAFingerprint)
+	}
+
+	caAlgorithm := reply.SignatureAlgorithm
+	if caAlgorithm == "" {
+		// Older servers don't report it
+		caAlgorithm = ca.KeySignatureAlgorithm(reply.CAPublicKey.Type())
+	}
+
+	p := &planner{
+		state:       state,
+		caKey:       reply.CAPublicKey,
+		caAlgorithm: caAlgorithm,
+		trust:       TrustCmd{RPCFlags: f.RPCFlags, SSHDPath: f.SSHDPath, FileMode: 0o644},
+		signHost: SignHostCmd{
+			RPCFlags:       f.RPCFlags,
+			SSHDConfigPath: defaultSSHDConfigPath,
+			CertFileFlags:  CertFileFlags{CertMode: 0o600},
+		},
+	}
+	if state.Trust != nil {
+		p.trust.HostsPatterns = state.Trust.HostsPatterns
+	}
+	if hosts := state.Hosts; hosts != nil {
+		p.signHost.Principals.Items = hosts.Principals
+		p.signHost.Validity = time.Duration(hosts.Validity)
+		p.signHost.ReloadCommand = hosts.ReloadCommand
+		if hosts.SSHDConfig != "" {
+			p.signHost.SSHDConfigPath = hosts.SSHDConfig
+		}
+		if p.principals, err = p.signHost.getPrincipals(); err != nil {
+			return nil, fmt.Errorf("failed to get principals: %w", err)
+		}
+		sort.Strings(p.principals)
+	}
+
+	useSSHD(f.SSHDPath)
+	if p.sshdConfig, err = sshd.LoadEffectiveConfig(p.signHost.SSHDConfigPath); err != nil {
+		return nil, err
+	}
+	p.publicKeyPaths = findPublicKeys(p.sshdConfig)
+	return p, nil
+}
+
+// plan returns the actions that reach the desired state.
+func (p *planner) plan(now time.Time) plan {
+	result := plan{FormatVersion: planFormatVersion, CAFingerprint: p.caKey.Fingerprint(), Actions: []planAction{}}
+	if trust := p.state.Trust; trust != nil {
+		if len(trust.HostsPatterns) != 0 {
+			contents, _ := ioutil.ReadFile(p.trust.path(knownHostsPath))
+			if _, changed := updateCertAuthorities(contents, trust.HostsPatterns, p.caKey, usesHashedHosts(contents)); changed {
+				result.Actions = append(result.Actions, planAction{Action: actionTrustHostCA, Path: knownHostsPath, Patterns: trust.HostsPatterns, Reason: "the @cert-authority lines for the CA don't match the patterns"})
+			}
+		}
+		if trust.Users {
+			if reason := p.userTrustReason(); reason != "" {
+				result.Actions = append(result.Actions, planAction{Action: actionTrustUserCA, Path: trustedCAsPath, Reason: reason})
+			}
+		}
+	}
+	if p.state.Hosts != nil {
+		result.Actions = append(result.Actions, p.hostActions(now)...)
+	}
+	return result
+}
+
+// userTrustReason returns why the CA isn't trusted for user authentication, or
+// "" if it is.
+func (p *planner) userTrustReason() string {
+	contents, _ := ioutil.ReadFile(p.trust.path(trustedCAsPath))
+	if !bytes.Contains(contents, p.caKey.Marshal()) {
+		return fmt.Sprintf("%s doesn't have the CA key", trustedCAsPath)
+	}
+	for _, path := range p.sshdConfig.Lookup("TrustedUserCAKeys") {
+		if path == trustedCAsPath {
+			return ""
+		}
+	}
+	return fmt.Sprintf("sshd_config doesn't use %s for TrustedUserCAKeys", trustedCAsPath)
+}
+
+// hostActions returns the actions that sign the host keys that need it and
+// configure sshd to use the certificates.
+func (p *planner) hostActions(now time.Time) []planAction {
+	wants := hostCertificateWants{principals: p.principals, caKey: p.caKey, renewBefore: time.Duration(p.state.Hosts.RenewBefore)}
+	configured := make(map[string]bool)
+	for _, certPath := range p.sshdConfig.Lookup("HostCertificate") {
+		configured[certPath] = true
+	}
+
+	var actions []planAction
+	signing := false
+	sshdModifier := sshd.Modifier{ConfigPath: p.signHost.SSHDConfigPath}
+	removeStaleCertificates(&sshdModifier, p.sshdConfig, p.publicKeyPaths)
+	for _, keyPath := range p.publicKeyPaths {
+		certPath := getCertificatePath(keyPath)
+		reason := renewalReason(keyPath, wants, now)
+		if reason == "" && !configured[certPath] {
+			reason = "sshd_config doesn't use the certificate"
+		}
+		if reason == "" {
+			continue
+		}
+		actions = append(actions, planAction{Action: actionSignHostKey, Path: keyPath, Principals: p.principals, Reason: reason})
+		signing = true
+		if !configured[certPath] {
+			sshdModifier.Set("HostCertificate", certPath)
+		}
+	}
+
+	if changes := sshdModifier.Pending(); len(changes) != 0 {
+		action := planAction{Action: actionUpdateSSHDConfig, Path: p.signHost.SSHDConfigPath}
+		for _, change := range changes {
+			action.Changes = append(action.Changes, change.String())
+		}
+		actions = append(actions, action)
+	}
+	if signing {
+		action := planAction{Action: actionReloadSSHD, Command: p.signHost.ReloadCommand}
+		if action.Command == "" {
+			action.Reason = "there is no reload_command, so sshd has to be reloaded separately"
+		}
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// apply runs the actions of the plan.
+func (p *planner) apply(client *ca.Client, actions []planAction) error {
+	var result error
+	var toSign []string
+	updateSSHD := false
+	for _, action := range actions {
+		var err error
+		switch action.Action {
+		case actionTrustHostCA:
+			err = p.trust.trustAsHostCA(p.caKey)
+		case actionTrustUserCA:
+			err = p.trust.trustAsUserCA(p.caKey, p.caAlgorithm)
+		case actionSignHostKey:
+			toSign = append(toSign, action.Path)
+		case actionUpdateSSHDConfig:
+			updateSSHD = true
+		}
+		if err != nil {
+			out.error(err)
+			result = multierror.Append(result, err)
+		}
+	}
+	// Signing updates sshd_config and reloads sshd too
+	if len(toSign) != 0 || updateSSHD {
+		if err := p.signHost.sign(client, p.sshdConfig, p.principals, p.publicKeyPaths, toSign); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result
+}
+
+// PlanCmd is the command that prints the actions that apply would take to
+// reach a desired state, without taking them, so that they can be reviewed.
+type PlanCmd struct {
+	PlanFlags
+	Output string `arg:"-o,--output" placeholder:"PATH" help:"file to write the JSON plan to, for apply --plan (default: stdout)"`
+}
+
+// Run implementation for Command
+func (c PlanCmd) Run() error {
+	client, err := c.RPCFlags.MakeClient()
+	if err != nil {
+		return err
+	}
+	p, err := c.newPlanner(client)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.MarshalIndent(p.plan(time.Now()), "", "  ")
+	if err != nil {
+		return err
+	}
+	encoded = append(encoded, '\n')
+	if c.Output == "" {
+		os.Stdout.Write(encoded)
+		return nil
+	}
+	return writeFile(c.Output, encoded, fileOptions{mode: 0o644})
+}
+
+// ApplyCmd is the command that takes the actions that reach a desired state.
+// With a saved plan, it only runs if the plan is still what it would do.
+type ApplyCmd struct {
+	PlanFlags
+	PlanPath string `arg:"--plan" placeholder:"PATH" help:"plan saved by plan -o, which is refused if the current plan differs (e.g. because it was reviewed before something else changed)"`
+}
+
+// Run implementation for Command
+func (c ApplyCmd) Run() error {
+	client, err := c.RPCFlags.MakeClient()
+	if err != nil {
+		return err
+	}
+	p, err := c.newPlanner(client)
+	if err != nil {
+		return err
+	}
+	current := p.plan(time.Now())
+	if c.PlanPath != "" {
+		if err := checkSavedPlan(c.PlanPath, current); err != nil {
+			return err
+		}
+	}
+	if len(current.Actions) == 0 {
+		out.success("nothing to do")
+		return nil
+	}
+	for _, action := range current.Actions {
+		out.progress("%s %s", action.Action, strings.TrimSpace(action.Path+" "+action.Reason))
+	}
+	return p.apply(client, current.Actions)
+}
+
+// checkSavedPlan returns an error if the plan saved at path isn't current.
+func checkSavedPlan(path string, current plan) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read plan: %w", err)
+	}
+	var saved plan
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse plan at %s: %w", path, err)
+	}
+	if saved.FormatVersion != planFormatVersion {
+		return fmt.Errorf("plan at %s has format version %d, but this version of sshca uses %d", path, saved.FormatVersion, planFormatVersion)
+	}
+	savedJSON, _ := json.Marshal(saved)
+	currentJSON, _ := json.Marshal(current)
+	if !bytes.Equal(savedJSON, currentJSON) {
+		return fmt.Errorf("plan at %s is out of date, so it wasn't applied; run plan again and review the new plan", path)
+	}
+	return nil
+}
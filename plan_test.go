@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/executor"
+	"github.com/ratorx/sshca/sshd"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSSHD replaces sshd for the duration of the test: sshd -T prints the
+// options in the config given with -f, without defaults or Match blocks, and
+// sshd -t accepts any config.
+func fakeSSHD(t *testing.T) {
+	t.Helper()
+	original := sshd.Executor
+	sshd.Executor = executor.Func(func(cmd executor.Command) error {
+		if len(cmd.Args) < 3 || cmd.Args[0] != "-T" || cmd.Args[1] != "-f" {
+			return nil
+		}
+		data, err := ioutil.ReadFile(cmd.Args[2])
+		if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			fmt.Fprintf(cmd.Stdout, "%s %s\n", strings.ToLower(fields[0]), strings.Join(fields[1:], " "))
+		}
+		return nil
+	})
+	t.Cleanup(func() { sshd.Executor = original })
+}
+
+// testCAKey returns the public key of the CA in ca/testdata/test.
+func testCAKey(t *testing.T) *ca.PublicKey {
+	t.Helper()
+	key, err := ca.NewPublicKey("ca/testdata/test.pub")
+	assert.Nil(t, err)
+	return key
+}
+
+// writeTestHostKey writes a new host public key at path.
+func writeTestHostKey(t *testing.T, path string) ssh.PublicKey {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	key, err := ssh.NewPublicKey(public)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(path, ssh.MarshalAuthorizedKey(key), 0o644))
+	return key
+}
+
+// writeTestHostCertificate writes a certificate for key, signed by the CA in
+// ca/testdata/test, next to the public key at keyPath.
+func writeTestHostCertificate(t *testing.T, keyPath string, key ssh.PublicKey, principals []string, validBefore time.Time) {
+	t.Helper()
+	data, err := ioutil.ReadFile("ca/testdata/test")
+	assert.Nil(t, err)
+	signer, err := ssh.ParsePrivateKey(data)
+	assert.Nil(t, err)
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.HostCert,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(validBefore.Add(-30 * 24 * time.Hour).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	assert.Nil(t, cert.SignCert(rand.Reader, signer))
+	assert.Nil(t, ioutil.WriteFile(getCertificatePath(keyPath), ssh.MarshalAuthorizedKey(cert), 0o644))
+}
+
+func TestLoadDesiredState(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+		valid bool
+	}{
+		{"trust", "trust:\n  hosts_patterns: ['*.example.com']\n  users: true\n", true},
+		{"hosts", "ca_fingerprint: SHA256:abc\nhosts:\n  principals: [web]\n  validity: 720h\n", true},
+		{"empty", "ca_fingerprint: SHA256:abc\n", false},
+		{"unknown field", "trust:\n  users: true\nusers: true\n", false},
+		{"empty pattern", "trust:\n  hosts_patterns: ['']\n", false},
+		{"pattern with comma", "trust:\n  hosts_patterns: ['a,b']\n", false},
+		{"pattern with space", "trust:\n  hosts_patterns: ['a b']\n", false},
+	}
+
+	dir := t.TempDir()
+	for _, test := range tests {
+		path := filepath.Join(dir, "state.yaml")
+		assert.Nil(t, ioutil.WriteFile(path, []byte(test.state), 0o644))
+		_, err := loadDesiredState(path)
+		if test.valid {
+			assert.Nil(t, err, test.name)
+		} else {
+			assert.Error(t, err, test.name)
+		}
+	}
+}
+
+func TestPlannerPlan(t *testing.T) {
+	fakeSSHD(t)
+	caKey := testCAKey(t)
+	now := time.Now()
+	principals := []string{"web", "web.example.com"}
+	hosts := &desiredHosts{Principals: principals}
+
+	tests := []struct {
+		name  string
+		state desiredState
+		// setup prepares the files under the root directory dir, and returns
+		// the contents of sshd_config
+		setup   func(t *testing.T, dir string) string
+		actions []string
+	}{
+		{
+			name:    "host CA not trusted",
+			state:   desiredState{Trust: &desiredTrust{HostsPatterns: []string{"*.example.com"}}},
+			actions: []string{actionTrustHostCA},
+		},
+		{
+			name:  "host CA trusted",
+			state: desiredState{Trust: &desiredTrust{HostsPatterns: []string{"*.example.com"}}},
+			setup: func(t *testing.T, dir string) string {
+				contents, _ := updateCertAuthorities(nil, []string{"*.example.com"}, caKey, false)
+				assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, knownHostsPath), contents, 0o644))
+				return ""
+			},
+			actions: []string{},
+		},
+		{
+			name:  "host CA trusted for other hosts",
+			state: desiredState{Trust: &desiredTrust{HostsPatterns: []string{"*.example.com"}}},
+			setup: func(t *testing.T, dir string) string {
+				contents, _ := updateCertAuthorities(nil, []string{"*.example.org"}, caKey, false)
+				assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, knownHostsPath), contents, 0o644))
+				return ""
+			},
+			actions: []string{actionTrustHostCA},
+		},
+		{
+			name:    "user CA not trusted",
+			state:   desiredState{Trust: &desiredTrust{Users: true}},
+			actions: []string{actionTrustUserCA},
+		},
+		{
+			name:  "user CA not in sshd_config",
+			state: desiredState{Trust: &desiredTrust{Users: true}},
+			setup: func(t *testing.T, dir string) string {
+				assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, trustedCAsPath), caKey.Marshal(), 0o644))
+				return ""
+			},
+			actions: []string{actionTrustUserCA},
+		},
+		{
+			name:  "user CA trusted",
+			state: desiredState{Trust: &desiredTrust{Users: true}},
+			setup: func(t *testing.T, dir string) string {
+				assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, trustedCAsPath), caKey.Marshal(), 0o644))
+				return "TrustedUserCAKeys " + trustedCAsPath + "\n"
+			},
+			actions: []string{},
+		},
+		{
+			name:  "host key not signed",
+			state: desiredState{Hosts: hosts},
+			setup: func(t *testing.T, dir string) string {
+				keyPath := filepath.Join(dir, "ssh_host_ed25519_key")
+				writeTestHostKey(t, keyPath+".pub")
+				return "HostKey " + keyPath + "\n"
+			},
+			actions: []string{actionSignHostKey, actionUpdateSSHDConfig, actionReloadSSHD},
+		},
+		{
+			name:  "host key signed and used",
+			state: desiredState{Hosts: hosts},
+			setup: func(t *testing.T, dir string) string {
+				keyPath := filepath.Join(dir, "ssh_host_ed25519_key")
+				key := writeTestHostKey(t, keyPath+".pub")
+				writeTestHostCertificate(t, keyPath+".pub", key, principals, now.Add(29*24*time.Hour))
+				return "HostKey " + keyPath + "\nHostCertificate " + keyPath + "-cert.pub\n"
+			},
+			actions: []string{},
+		},
+		{
+			name:  "host certificate not used",
+			state: desiredState{Hosts: hosts},
+			setup: func(t *testing.T, dir string) string {
+				keyPath := filepath.Join(dir, "ssh_host_ed25519_key")
+				key := writeTestHostKey(t, keyPath+".pub")
+				writeTestHostCertificate(t, keyPath+".pub", key, principals, now.Add(29*24*time.Hour))
+				return "HostKey " + keyPath + "\n"
+			},
+			actions: []string{actionSignHostKey, actionUpdateSSHDConfig, actionReloadSSHD},
+		},
+		{
+			name:  "host certificate expiring",
+			state: desiredState{Hosts: hosts},
+			setup: func(t *testing.T, dir string) string {
+				keyPath := filepath.Join(dir, "ssh_host_ed25519_key")
+				key := writeTestHostKey(t, keyPath+".pub")
+				writeTestHostCertificate(t, keyPath+".pub", key, principals, now.Add(time.Hour))
+				return "HostKey " + keyPath + "\nHostCertificate " + keyPath + "-cert.pub\n"
+			},
+			actions: []string{actionSignHostKey, actionReloadSSHD},
+		},
+		{
+			name:  "host certificate without a principal",
+			state: desiredState{Hosts: hosts},
+			setup: func(t *testing.T, dir string) string {
+				keyPath := filepath.Join(dir, "ssh_host_ed25519_key")
+				key := writeTestHostKey(t, keyPath+".pub")
+				writeTestHostCertificate(t, keyPath+".pub", key, principals[:1], now.Add(29*24*time.Hour))
+				return "HostKey " + keyPath + "\nHostCertificate " + keyPath + "-cert.pub\n"
+			},
+			actions: []string{actionSignHostKey, actionReloadSSHD},
+		},
+		{
+			name:  "stale host certificate",
+			state: desiredState{Hosts: hosts},
+			setup: func(t *testing.T, dir string) string {
+				return "HostCertificate " + filepath.Join(dir, "removed-cert.pub") + "\n"
+			},
+			actions: []string{actionUpdateSSHDConfig},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			assert.Nil(t, os.MkdirAll(filepath.Join(dir, "etc/ssh"), 0o755))
+			config := ""
+			if test.setup != nil {
+				config = test.setup(t, dir)
+			}
+			configPath := filepath.Join(dir, "sshd_config")
+			assert.Nil(t, ioutil.WriteFile(configPath, []byte(config), 0o644))
+			sshdConfig, err := sshd.LoadEffectiveConfig(configPath)
+			assert.Nil(t, err)
+
+			p := &planner{
+				state:          test.state,
+				caKey:          caKey,
+				trust:          TrustCmd{OutputDir: dir},
+				signHost:       SignHostCmd{SSHDConfigPath: configPath},
+				sshdConfig:     sshdConfig,
+				principals:     principals,
+				publicKeyPaths: findPublicKeys(sshdConfig),
+			}
+			result := p.plan(now)
+			assert.Equal(t, planFormatVersion, result.FormatVersion)
+			assert.Equal(t, caKey.Fingerprint(), result.CAFingerprint)
+			actions := []string{}
+			for _, action := range result.Actions {
+				actions = append(actions, action.Action)
+			}
+			assert.Equal(t, test.actions, actions)
+		})
+	}
+}
+
+func TestCheckSavedPlan(t *testing.T) {
+	current := plan{FormatVersion: planFormatVersion, CAFingerprint: "SHA256:abc", Actions: []planAction{{Action: actionReloadSSHD}}}
+	path := filepath.Join(t.TempDir(), "plan.json")
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"format_version": 1, "ca_fingerprint": "SHA256:abc", "actions": [{"action": "reload_sshd"}]}`), 0o644))
+	assert.Nil(t, checkSavedPlan(path, current))
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"format_version": 1, "ca_fingerprint": "SHA256:abc", "actions": []}`), 0o644))
+	assert.Error(t, checkSavedPlan(path, current))
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"format_version": 2, "ca_fingerprint": "SHA256:abc", "actions": [{"action": "reload_sshd"}]}`), 0o644))
+	assert.Error(t, checkSavedPlan(path, current))
+}
+
+func TestApplyCmdIsIdempotent(t *testing.T) {
+	sshKeygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skipf("CLI dependency not found: %s", err)
+	}
+	fakeSSHD(t)
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "ssh_host_ed25519_key")
+	assert.Nil(t, exec.Command(sshKeygen, "-q", "-t", "ed25519", "-N", "", "-f", keyPath).Run())
+	configPath := filepath.Join(dir, "sshd_config")
+	assert.Nil(t, ioutil.WriteFile(configPath, []byte("HostKey "+keyPath+"\n"), 0o644))
+	statePath := filepath.Join(dir, "state.yaml")
+	state := fmt.Sprintf("hosts:\n  principals: [web.example.com]\n  sshd_config: %s\n  reload_command: 'true'\n", configPath)
+	assert.Nil(t, ioutil.WriteFile(statePath, []byte(state), 0o644))
+
+	apply := ApplyCmd{PlanFlags: PlanFlags{
+		RPCFlags:  RPCFlags{Local: true, CAPrivateKeyPath: "ca/testdata/test", SSHKeygenPath: sshKeygen},
+		StatePath: statePath,
+		SSHDPath:  "sshd",
+	}}
+	assert.Nil(t, apply.Run())
+	cert, err := ioutil.ReadFile(keyPath + "-cert.pub")
+	assert.Nil(t, err)
+	config, err := ioutil.ReadFile(configPath)
+	assert.Nil(t, err)
+	assert.Contains(t, string(config), "HostCertificate "+keyPath+"-cert.pub")
+
+	// Once the desired state is reached, there is nothing left to do
+	client, err := apply.RPCFlags.MakeClient()
+	assert.Nil(t, err)
+	p, err := apply.newPlanner(client)
+	assert.Nil(t, err)
+	assert.Empty(t, p.plan(time.Now()).Actions)
+	assert.Nil(t, apply.Run())
+	after, err := ioutil.ReadFile(keyPath + "-cert.pub")
+	assert.Nil(t, err)
+	assert.Equal(t, cert, after)
+	afterConfig, err := ioutil.ReadFile(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, config, afterConfig)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ratorx/sshca/ca"
+	"golang.org/x/crypto/ssh"
+)
+
+// agentSigner returns a signer for publicKey from ssh-agent, or nil if the
+// agent isn't running or doesn't hold the key. The returned function closes the
+// connection to the agent.
+func agentSigner(publicKey *ca.PublicKey) (ssh.Signer, func()) {
+	agentClient, conn, err := dialAgent()
+	if err != nil {
+		return nil, func() {}
+	}
+	signers, err := agentClient.Signers()
+	if err != nil {
+		conn.Close()
+		return nil, func() {}
+	}
+	for _, signer := range signers {
+		if publicKey.Matches(signer.PublicKey()) {
+			return signer, func() { conn.Close() }
+		}
+	}
+	conn.Close()
+	return nil, func() {}
+}
+
+// fileSigner returns a signer for the private key at path, which must match
+// publicKey.
+func fileSigner(path string, publicKey *ca.PublicKey) (ssh.Signer, error) {
+	privateKey, err := readPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key at %s: %w", path, err)
+	}
+	if !publicKey.Matches(signer.PublicKey()) {
+		return nil, fmt.Errorf("private key at %s does not match the public key", path)
+	}
+	return signer, nil
+}
+
+// proveKey answers a challenge from the server to prove possession of the
+// private key for publicKey. The key is used from ssh-agent if it is there, and
+// otherwise read from privateKeyPath (which may be empty if there is no file).
+func proveKey(client *ca.Client, publicKey *ca.PublicKey, privateKeyPath string) (*ca.Proof, error) {
+	challenge, err := client.GetChallenge()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get challenge: %w", err)
+	}
+
+	signer, closeAgent := agentSigner(publicKey)
+	defer closeAgent()
+	if signer == nil {
+		if privateKeyPath == "" {
+			return nil, fmt.Errorf("key is not in ssh-agent")
+		}
+		signer, err = fileSigner(privateKeyPath, publicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ca.SignProof(signer, challenge.Nonce)
+}
+
+// isUnsupportedRPC reports whether err is because the server is too old to
+// have the RPC.
+func isUnsupportedRPC(err error) bool {
+	return strings.Contains(err.Error(), "rpc: can't find method")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/ratorx/sshca/ca"
+)
+
+// reloadOnSignal reloads the policy of server and its tenants whenever the
+// server gets SIGHUP. flags are the options from the command line, which
+// still override the server config, and approval are the approval options
+// that the server was started with.
+func reloadOnSignal(flags ServerCmd, approval ApprovalFlags, server *ca.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := reloadPolicy(flags, approval, server); err != nil {
+			out.error(fmt.Errorf("failed to reload the policy: %w", err))
+			continue
+		}
+		out.success("reloaded the policy")
+	}
+}
+
+// reloadPolicy reads the server config and the groups and tenants files again,
+// and replaces the policy of server and its tenants. Settings outside of the
+// policy (e.g. the listen address, CA keys or approval webhook) need a
+// restart to change.
+func reloadPolicy(flags ServerCmd, approval ApprovalFlags, server *ca.Server) error {
+	s, err := flags.withServerConfig()
+	if err != nil {
+		return err
+	}
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if err := s.ApprovalFlags.checkReload(approval, server.Interactor); err != nil {
+		return err
+	}
+	policy, err := s.policy()
+	if err != nil {
+		return err
+	}
+	tenants := map[string]tenantConfig{}
+	if s.TenantsFile != "" {
+		if tenants, err = loadTenants(s.TenantsFile); err != nil {
+			return err
+		}
+	}
+
+	// Check every policy before replacing any, so that a mistake for one
+	// tenant doesn't leave the others reloaded and it unchanged
+	algorithms := s.AlgorithmFlags.policy()
+	rootPolicy, err := server.PreparePolicy(policy, algorithms)
+	if err != nil {
+		return fmt.Errorf("invalid algorithm policy: %w", err)
+	}
+	names := make([]string, 0, len(server.Tenants))
+	for name := range server.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tenantPolicies := make(map[string]ca.Policy, len(names))
+	for _, name := range names {
+		tenantPolicy := policy
+		if err := tenants[name].applyPolicy(&tenantPolicy, server.Interactor); err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+		prepared, err := server.Tenants[name].PreparePolicy(tenantPolicy, algorithms)
+		if err != nil {
+			return fmt.Errorf("tenant %s: invalid algorithm policy: %w", name, err)
+		}
+		tenantPolicies[name] = prepared
+	}
+
+	server.SetPolicy(rootPolicy)
+	for name, tenantPolicy := range tenantPolicies {
+		server.Tenants[name].SetPolicy(tenantPolicy)
+	}
+	for name := range tenants {
+		if server.Tenants[name] == nil {
+			out.warning(fmt.Sprintf("tenant %s is new, so it is only served after a restart", name))
+		}
+	}
+	return nil
+}
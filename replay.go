@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/ratorx/sshca/ca"
+)
+
+// ReplayCmd is the command that sends the calls recorded with --record to a
+// server again, e.g. to reproduce a bug report against a test server.
+type ReplayCmd struct {
+	RPCFlags
+	Recording     string `arg:"positional,required" placeholder:"RECORDING" help:"file written by --record"`
+	PublicKeyPath string `arg:"--public-key" placeholder:"PATH" help:"public key to sign in place of keys that were redacted from the recording"`
+	Output        string `arg:"-o,--output" placeholder:"PATH" help:"file to write the replayed calls to, in the format of --record"`
+}
+
+// Validate implementation for Command
+func (r ReplayCmd) Validate() error {
+	if r.Output != "" && r.Output == r.Recording {
+		return fmt.Errorf("--output must not be the recording that is replayed")
+	}
+	return r.RPCFlags.Validate()
+}
+
+// fill sets the public keys that were redacted from the arguments of a call.
+func (r ReplayCmd) fill(publicKey *ca.PublicKey) func(args interface{}) error {
+	return func(args interface{}) error {
+		var key **ca.PublicKey
+		switch args := args.(type) {
+		case *ca.SignArgs:
+			key = &args.PublicKey
+		case *ca.CrossCertifyArgs:
+			key = &args.PublicKey
+		default:
+			return nil
+		}
+		if *key != nil {
+			return nil
+		}
+		if publicKey == nil {
+			return fmt.Errorf("the public key was redacted from the recording; pass --public-key to sign another one")
+		}
+		*key = publicKey
+		return nil
+	}
+}
+
+// describeOutcome describes the outcome of a call on one line.
+func describeOutcome(call ca.RecordedCall) string {
+	if call.Error != "" {
+		return "error: " + call.Error
+	}
+	return "ok"
+}
+
+// Run implementation for Command
+func (r ReplayCmd) Run() error {
+	file, err := os.Open(r.Recording)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %w", err)
+	}
+	calls, err := ca.ReadRecording(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read recording %s: %w", r.Recording, err)
+	}
+	var publicKey *ca.PublicKey
+	if r.PublicKeyPath != "" {
+		if publicKey, err = ca.NewPublicKey(r.PublicKeyPath); err != nil {
+			return err
+		}
+	}
+
+	client, err := r.RPCFlags.MakeClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var output bytes.Buffer
+	differences := 0
+	for i, call := range calls {
+		fmt.Printf("%d %s (recorded at %s)\n", i+1, call.Method, call.Time.Format("2006-01-02 15:04:05 MST"))
+		replayed, err := client.Replay(call, r.fill(publicKey))
+		if err != nil {
+			fmt.Printf("  not replayed: %s\n", err)
+			differences++
+			continue
+		}
+		fmt.Printf("  recorded: %s\n", describeOutcome(call))
+		fmt.Printf("  replayed: %s\n", describeOutcome(replayed))
+		switch {
+		case (call.Error == "") != (replayed.Error == ""):
+			differences++
+		case call.Error == "" && !bytes.Equal(call.Reply, replayed.Reply):
+			// Certificates differ in their validity and signature anyway
+			fmt.Println("  the reply differs")
+		}
+		line, err := json.Marshal(replayed)
+		if err != nil {
+			return err
+		}
+		output.Write(append(line, '\n'))
+	}
+	fmt.Printf("replayed %d calls, %d with a different outcome\n", len(calls), differences)
+
+	if r.Output != "" {
+		if err := replaceFile(r.Output, output.Bytes(), fileOptions{mode: 0o600}); err != nil {
+			return fmt.Errorf("failed to write replayed calls: %w", err)
+		}
+	}
+	return nil
+}
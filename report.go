@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+)
+
+// ReportCmd is the command that summarises the certificates in the registry
+// of a server.
+type ReportCmd struct {
+	CertRegistry   string        `arg:"--cert-registry,required" placeholder:"PATH" help:"certificate registry of the server (see server --cert-registry)"`
+	Since          time.Duration `arg:"--since" placeholder:"DURATION" help:"only count the certificates issued (and revocations seen) in this period, e.g. 720h (default: all)"`
+	ExpiringWithin time.Duration `arg:"--expiring-within" default:"168h" placeholder:"DURATION" help:"list the valid certificates that expire within this time"`
+	Top            int           `arg:"--top" default:"10" placeholder:"N" help:"number of top requesters to list (0 for all)"`
+	KRLPath        string        `arg:"--krl" placeholder:"PATH" help:"key revocation list to check the certificates against (default: only revocations found by status checks)"`
+	SSHKeygenPath  string        `arg:"--ssh-keygen" default:"ssh-keygen" placeholder:"PATH" help:"path to ssh-keygen"`
+	Format         string        `arg:"--format" default:"text" placeholder:"FORMAT" help:"format of the report: text, json or csv"`
+	Output         string        `arg:"-o,--output" placeholder:"PATH" help:"file to write the report to (default: stdout)"`
+}
+
+// Validate implementation for Command
+func (r ReportCmd) Validate() error {
+	switch r.Format {
+	case "text", "json", "csv":
+	default:
+		return fmt.Errorf("unknown format %q (must be text, json or csv)", r.Format)
+	}
+	if r.Since < 0 || r.ExpiringWithin < 0 {
+		return fmt.Errorf("--since and --expiring-within must not be negative")
+	}
+	if r.Top < 0 {
+		return fmt.Errorf("--top must not be negative")
+	}
+	return nil
+}
+
+// reportTime formats a time in a report. The zero time is never.
+func reportTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// formatText formats the report for reading.
+func (r ReportCmd) formatText(report ca.IssuanceReport) []byte {
+	var buf bytes.Buffer
+	period := "in total"
+	if !report.Since.IsZero() {
+		period = "since " + reportTime(report.Since)
+	}
+	fmt.Fprintf(&buf, "certificates issued %s: %d\n", period, report.Issued)
+
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	for _, section := range []struct {
+		title  string
+		counts []ca.ReportCount
+	}{
+		{"by day (UTC)", report.ByDay},
+		{"by type", report.ByType},
+		{"by principal", report.ByPrincipal},
+		{"top requesters", report.TopRequesters},
+	} {
+		if len(section.counts) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s:\n", section.title)
+		for _, count := range section.counts {
+			fmt.Fprintf(w, "  %s\t%d\n", count.Key, count.Count)
+		}
+	}
+	w.Flush()
+
+	fmt.Fprintf(&buf, "\nexpiring within %s: %d\n", r.ExpiringWithin, len(report.Expiring))
+	for _, cert := range report.Expiring {
+		fmt.Fprintf(&buf, "  serial %d (%s, %s certificate for %s) expires %s\n", cert.Serial, cert.Identity, cert.Type, strings.Join(cert.Principals, ","), reportTime(cert.ValidBefore))
+	}
+	fmt.Fprintf(&buf, "\nrevoked: %d\n", len(report.Revoked))
+	for _, cert := range report.Revoked {
+		revoked := "found in the KRL"
+		if !cert.RevokedAt.IsZero() {
+			revoked = "revoked " + reportTime(cert.RevokedAt)
+		}
+		fmt.Fprintf(&buf, "  serial %d (%s, %s certificate for %s) %s\n", cert.Serial, cert.Identity, cert.Type, strings.Join(cert.Principals, ","), revoked)
+	}
+	return buf.Bytes()
+}
+
+// formatCSV formats the report as one table, where each row is a count or a
+// certificate of a section.
+func formatCSV(report ca.IssuanceReport) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"section", "key", "count", "serial", "identity", "type", "principals", "issued_at", "valid_before", "revoked_at"})
+	w.Write([]string{"issued", "", strconv.Itoa(report.Issued)})
+	for _, section := range []struct {
+		name   string
+		counts []ca.ReportCount
+	}{
+		{"by_day", report.ByDay},
+		{"by_type", report.ByType},
+		{"by_principal", report.ByPrincipal},
+		{"top_requesters", report.TopRequesters},
+	} {
+		for _, count := range section.counts {
+			w.Write([]string{section.name, count.Key, strconv.Itoa(count.Count)})
+		}
+	}
+	for _, section := range []struct {
+		name         string
+		certificates []ca.ReportCertificate
+	}{
+		{"expiring", report.Expiring},
+		{"revoked", report.Revoked},
+	} {
+		for _, cert := range section.certificates {
+			revokedAt := ""
+			if !cert.RevokedAt.IsZero() {
+				revokedAt = reportTime(cert.RevokedAt)
+			}
+			w.Write([]string{section.name, "", "", strconv.FormatUint(cert.Serial, 10), cert.Identity, cert.Type, strings.Join(cert.Principals, ","), reportTime(cert.IssuedAt), reportTime(cert.ValidBefore), revokedAt})
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// Run implementation for Command
+func (r ReportCmd) Run() error {
+	registry, err := ca.LoadCertificateRegistry(r.CertRegistry)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	options := ca.ReportOptions{
+		Now:            now,
+		ExpiringWithin: r.ExpiringWithin,
+		TopRequesters:  r.Top,
+		KRLPath:        r.KRLPath,
+	}
+	if r.KRLPath != "" {
+		options.SSHKeygen = detectSSHKeygen(r.SSHKeygenPath)
+	}
+	if r.Since != 0 {
+		options.Since = now.Add(-r.Since)
+	}
+	report, err := registry.Report(options)
+	if err != nil {
+		return fmt.Errorf("failed to generate report: %w", err)
+	}
+
+	var data []byte
+	switch r.Format {
+	case "json":
+		data, err = json.MarshalIndent(report, "", "  ")
+		data = append(data, '\n')
+	case "csv":
+		data, err = formatCSV(report)
+	default:
+		data = r.formatText(report)
+	}
+	if err != nil {
+		return err
+	}
+
+	if r.Output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := writeFile(r.Output, data, fileOptions{mode: 0o644}); err != nil {
+		return err
+	}
+	out.success("wrote the report to %s", r.Output)
+	return nil
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"fmt"
-	"net"
-	"net/rpc"
+	"os"
+	"time"
 
 	"github.com/ratorx/sshca/ca"
 )
@@ -11,12 +11,24 @@ import (
 // RPCFlags are the flags required for RPC that are common across multiple
 // commands.
 type RPCFlags struct {
-	Local            bool   `arg:"-l" help:"run SSH CA operations on the client (exclusive with --remote)"`
-	CAPrivateKeyPath string `arg:"-s,--ca-private" placeholder:"PRIVATE_KEY_PATH" help:"SSH CA private key path (only required when --local is set)"`
-	CAPublicKeyPath  string `arg:"-p,--ca-public" placeholder:"PUBLIC_KEY_PATH" help:"SSH CA public key path (optional, only used when --local is set)"`
-	Remote           string `arg:"-r" help:"remote server for SSH CA operations (exclusive with --local)"`
+	Local            bool               `arg:"-l" help:"run SSH CA operations on the client (exclusive with --remote)"`
+	CAPrivateKeyPath string             `arg:"-s,--ca-private" placeholder:"PRIVATE_KEY_PATH" help:"SSH CA private key path (only required when --local is set)"`
+	CAPublicKeyPath  string             `arg:"-p,--ca-public" placeholder:"PUBLIC_KEY_PATH" help:"SSH CA public key path (optional, only used when --local is set)"`
+	Remote           string             `arg:"-r" help:"remote server for SSH CA operations (exclusive with --local); host:port, a name with an _sshca._tcp SRV record, an alias from the config, or a URL selecting the transport (tcp://HOST:PORT, tls://HOST:PORT, unix://PATH or ssh://[USER@]HOST[:PORT]/TARGET). Multiple comma-separated servers are tried in order"`
+	Fastest          bool               `help:"use the remote server that accepts the connection first, instead of trying them in order"`
+	ConnectTimeout   time.Duration      `arg:"--connect-timeout" default:"10s" placeholder:"DURATION" help:"timeout for connecting to each remote server"`
+	SSHKeygenPath    string             `arg:"--ssh-keygen" default:"ssh-keygen" placeholder:"PATH" help:"path to ssh-keygen (used when --local is set, and to read host keys that sshca can't parse)"`
+	Tenant           string             `arg:"--tenant,env:SSHCA_TENANT" placeholder:"NAME" help:"tenant of the remote server to use (default: the server's own CA)"`
+	MaxClockSkew     time.Duration      `arg:"--max-clock-skew" placeholder:"DURATION" help:"warn if the clocks of this machine and the remote server differ by more than this (default: 1m)"`
+	Strict           bool               `arg:"--strict" help:"refuse to use a remote server whose clock differs by more than --max-clock-skew, instead of warning"`
+	Record           string             `arg:"--record" placeholder:"PATH" help:"append the RPC requests and responses to this file as JSON lines, e.g. for a bug report (see replay)"`
+	RecordRedact     CommaSeparatedList `arg:"--record-redact" placeholder:"FIELDS" help:"comma-separated fields to leave out of the recording, e.g. PublicKey,Certificate (tokens are always left out)"`
 }
 
+// defaultMaxClockSkew is the largest difference between the clocks of the
+// client and server that is accepted without a warning.
+const defaultMaxClockSkew = time.Minute
+
 // Validate the flags and arguments that were passed into the command line.
 // Ensures that either local or remote operation is selected, and the
 // appropriate required flags for each are set.
@@ -29,16 +41,28 @@ func (r RPCFlags) Validate() error {
 		return fmt.Errorf("one of --local or --remote must be used")
 	}
 
+	if r.Local && r.Tenant != "" {
+		return fmt.Errorf("--tenant cannot be used with --local")
+	}
+
+	if r.MaxClockSkew < 0 {
+		return fmt.Errorf("--max-clock-skew must not be negative")
+	}
+
 	if r.Local && r.CAPrivateKeyPath == "" {
 		return fmt.Errorf("--privatekeypath must be set when --local is used")
 	}
 
+	if len(r.RecordRedact.Items) != 0 && r.Record == "" {
+		return fmt.Errorf("--record-redact requires --record")
+	}
+
 	return nil
 }
 
 // MakeClient creates a new ca.Client based on the RPC Flags. It either returns
-// a local client (where the server is run in a goroutine), or a remote
-// client that is connected to a TCP RPC server.
+// a local client (which calls an in-process server directly), or a remote
+// client that is connected to an RPC server.
 func (r RPCFlags) MakeClient() (*ca.Client, error) {
 	err := r.Validate()
 	if err != nil {
@@ -53,24 +77,133 @@ func (r RPCFlags) MakeClient() (*ca.Client, error) {
 }
 
 func (r RPCFlags) makeLocalClient() (*ca.Client, error) {
-	left, right := net.Pipe()
-
 	caRPCServer, err := ca.NewServer(r.CAPrivateKeyPath, r.CAPublicKeyPath, true)
 	if err != nil {
 		return nil, fmt.Errorf("failed to local SSH CA RPC server: %w", err)
 	}
+	caRPCServer.SSHKeygen = detectSSHKeygen(r.SSHKeygenPath)
 
-	server := rpc.NewServer()
-	server.RegisterName(ca.ServerName, &caRPCServer)
-	go server.ServeConn(left)
-
-	return &ca.Client{Client: rpc.NewClient(right)}, nil
+	client := ca.NewInProcessClient(&caRPCServer)
+	client.Recorder, err = r.recorder()
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
 }
 
 func (r RPCFlags) makeRemoteClient() (*ca.Client, error) {
-	client, err := rpc.Dial("tcp", r.Remote)
+	client, err := r.dialRemote()
+	if err != nil {
+		return nil, err
+	}
+	// The version check is recorded too, since it identifies the server
+	client.Recorder, err = r.recorder()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	if err := r.checkServer(client); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// recorder returns the recorder for --record, or nil if it isn't set. The file
+// is appended to, so that the calls of several commands can be recorded.
+func (r RPCFlags) recorder() (*ca.Recorder, error) {
+	if r.Record == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(r.Record, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	return ca.NewRecorder(file, r.RecordRedact.Items), nil
+}
+
+// checkServer warns if the server uses an RPC protocol version that this
+// client can't use, which would otherwise fail with confusing decoding
+// errors, or if the clocks of the client and server differ, which makes new
+// certificates look not yet valid (or expire early). With --strict, clock
+// skew is an error.
+func (r RPCFlags) checkServer(client *ca.Client) error {
+	sent := time.Now()
+	reply, err := client.Version()
+	received := time.Now()
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to server at %s: %w", r.Remote, err)
+		if isUnsupportedRPC(err) {
+			out.warning("the server is older than this client; upgrade it if requests fail")
+		}
+		return nil
+	}
+	out.detail("connected to %s: sshca %s (protocol %d)", client.Addr, reply.Version, reply.ProtocolVersion)
+	if err := reply.CheckCompatible(); err != nil {
+		out.warning(err.Error())
+	}
+
+	skew, ok := reply.ClockSkew(sent, received)
+	if !ok {
+		return nil
+	}
+	maxSkew := r.MaxClockSkew
+	if maxSkew == 0 {
+		maxSkew = defaultMaxClockSkew
+	}
+	if err := checkClockSkew(skew, maxSkew); err != nil {
+		err = fmt.Errorf("%w; synchronise the clocks with NTP", err)
+		if r.Strict {
+			return err
+		}
+		out.warning(err.Error())
+	}
+	return nil
+}
+
+// describeClockSkew describes how far the clock of the server is from the
+// local clock.
+func describeClockSkew(skew time.Duration) string {
+	if skew < 0 {
+		return fmt.Sprintf("the server clock is %s behind this machine", (-skew).Round(time.Second))
+	}
+	return fmt.Sprintf("the server clock is %s ahead of this machine", skew.Round(time.Second))
+}
+
+// checkClockSkew returns an error if the clocks of the server and this machine
+// differ by more than maxSkew.
+func checkClockSkew(skew, maxSkew time.Duration) error {
+	if skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("%s, so new certificates may not be valid yet or expire early", describeClockSkew(skew))
+	}
+	return nil
+}
+
+// dialRemote connects to the first available remote server.
+func (r RPCFlags) dialRemote() (*ca.Client, error) {
+	var addrs []string
+	for _, remote := range config.resolveRemote(r.Remote) {
+		resolved, err := ca.ResolveAddresses(remote)
+		if err != nil {
+			// Other servers might still be reachable
+			out.warning(fmt.Sprintf("failed to resolve remote server: %s", err))
+			continue
+		}
+		addrs = append(addrs, resolved...)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("failed to resolve any remote servers from %s", r.Remote)
+	}
+
+	dial := ca.Dial
+	if r.Fastest {
+		dial = ca.DialFastest
+	}
+	client, err := dial(addrs, r.ConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if r.Tenant != "" {
+		client.Service = ca.TenantService(r.Tenant)
 	}
-	return &ca.Client{Client: client}, nil
+	return client, nil
 }
@@ -2,41 +2,305 @@ package main
 
 import (
 	"fmt"
-	"net"
-	"net/rpc"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/notify"
+	"github.com/ratorx/sshca/openssh"
 )
 
 // ServerCmd is the command that starts a RPC server for CA operations
 // on a TCP Address.
 type ServerCmd struct {
 	// TODO: Work out nice way to validate the address
-	Addr             string `arg:"positional,required" help:"TCP address to listen on"`
-	PrivateKeyPath   string `arg:"-s,--private,required" placeholder:"PRIVATE_KEY_PATH" help:"SSH CA private key path"`
-	PublicKeyPath    string `arg:"-p,--public" placeholder:"PUBLIC_KEY_PATH" help:"SSH CA public key path (optional, inferred from private key path)"`
-	SkipConfirmation bool   `arg:"--skip-confirmation,-q" help:"Skip confirmation for public key signing requests"`
+	Addr                string        `arg:"positional" help:"TCP address to listen on, or unix://PATH for a Unix socket (required, unless listen is set in the server config)"`
+	PrivateKeyPath      string        `arg:"-s,--private" placeholder:"PRIVATE_KEY_PATH" help:"SSH CA private key path (required, unless keys.private is set in the server config)"`
+	PublicKeyPath       string        `arg:"-p,--public" placeholder:"PUBLIC_KEY_PATH" help:"SSH CA public key path (optional, inferred from private key path)"`
+	SkipConfirmation    bool          `arg:"--skip-confirmation,-q" help:"Skip confirmation for public key signing requests"`
+	ConfirmationTimeout time.Duration `arg:"--confirmation-timeout" placeholder:"DURATION" help:"deny requests that aren't confirmed within this time (default: wait forever)"`
+	SSHKeygenPath       string        `arg:"--ssh-keygen" placeholder:"PATH" help:"path to ssh-keygen (default: ssh-keygen)"`
+	SubCARegistry       string        `arg:"--sub-ca-registry" placeholder:"PATH" help:"file to store the sub-CAs endorsed with cross_certify in (enables cross_certify)"`
+	KRLPath             string        `arg:"--krl" placeholder:"PATH" help:"key revocation list to publish to sync_krl (e.g. maintained with ssh-keygen -k)"`
+	CertRegistry        string        `arg:"--cert-registry" placeholder:"PATH" help:"file to record issued certificates in, which assigns serial numbers and enables status checks"`
+	SignCertRegistry    bool          `arg:"--sign-cert-registry" help:"sign the issuance metadata (time, approver, policy rules) recorded in the cert registry with the CA key, so that changes to it can be detected (needs ssh-keygen 8.1+)"`
+	NonInteractive      bool          `arg:"--non-interactive" help:"run ssh-keygen without a terminal (e.g. under systemd), failing instead of prompting (requires --skip-confirmation)"`
+	PassphraseFile      string        `arg:"--passphrase-file" placeholder:"PATH" help:"file containing the CA private key passphrase (requires --non-interactive)"`
+	TempDir             string        `arg:"--temp-dir" placeholder:"PATH" help:"directory for the files passed to ssh-keygen, e.g. a tmpfs like /dev/shm (default: the system temporary directory)"`
+	GroupsFile          string        `arg:"--groups" placeholder:"PATH" help:"YAML file of principal groups, which clients request as @name (e.g. sign_user -n @developers)"`
+	TOTPSecrets         string        `arg:"--totp-secrets" placeholder:"PATH" help:"YAML file of client TOTP secrets (see totp_secret); requests must then carry a valid code from --totp-client"`
+	ValidateConfig      bool          `arg:"--validate-config" help:"check the server config and flags, and the files they refer to, then exit without starting the server"`
+	// ConfigPath is the server config, which is passed with the global
+	// --config, so that flags override its settings.
+	ConfigPath string `arg:"-"`
+	ValidityFlags
+	EmailFlags
+	MonitoringFlags
+	AlgorithmFlags
+	HostDNSFlags
+	ProofFlags
+	PrincipalFlags
+	ExtensionFlags
+	ConnectionFlags
+	TenantFlags
+	RetentionFlags
+	AuditForwardingFlags
+	ApprovalFlags
+	BreakGlassFlags
 }
 
 // Validate implementation for Command
 func (s ServerCmd) Validate() error {
-	return nil
+	s, err := s.withServerConfig()
+	if err != nil {
+		return err
+	}
+	return s.validate()
+}
+
+// validate checks the options once the server config is filled in.
+func (s ServerCmd) validate() error {
+	if s.Addr == "" {
+		return fmt.Errorf("the address to listen on must be passed, or set as listen in the server config")
+	}
+	if s.PrivateKeyPath == "" {
+		return fmt.Errorf("--private must be passed, or keys.private set in the server config")
+	}
+	if s.NonInteractive && !s.SkipConfirmation && s.ApprovalWebhook == "" {
+		return fmt.Errorf("--non-interactive requires --skip-confirmation or --approval-webhook, because requests are confirmed on the terminal")
+	}
+	if s.SkipConfirmation && s.ApprovalWebhook != "" {
+		return fmt.Errorf("--approval-webhook can't be used with --skip-confirmation")
+	}
+	if s.ConfirmationTimeout < 0 {
+		return fmt.Errorf("--confirmation-timeout must not be negative")
+	}
+	if s.PassphraseFile != "" && !s.NonInteractive {
+		return fmt.Errorf("--passphrase-file requires --non-interactive")
+	}
+	if s.SignCertRegistry && s.CertRegistry == "" && s.TenantsFile == "" {
+		return fmt.Errorf("--sign-cert-registry requires --cert-registry")
+	}
+	if s.BreakGlassToken != "" && len(s.alertWebhooks()) == 0 && s.AuditLog == "" && s.AuditSyslog == "" && s.AuditCEF == "" && s.AuditWebhook == "" {
+		return fmt.Errorf("--break-glass-token requires an audit log, audit forwarding or an approval or slow approval webhook, so that break-glass certificates don't go unnoticed")
+	}
+	if s.BreakGlassToken != "" && s.BreakGlassToken == s.DNSOverrideToken {
+		return fmt.Errorf("--break-glass-token must be different from --dns-override-token")
+	}
+	if err := s.ValidityFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.MonitoringFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.AlgorithmFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.HostDNSFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.PrincipalFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.ExtensionFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.ConnectionFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.RetentionFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.AuditForwardingFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.ApprovalFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.BreakGlassFlags.Validate(); err != nil {
+		return err
+	}
+	return s.EmailFlags.Validate()
 }
 
 // Run implementation for Command
 func (s ServerCmd) Run() error {
+	flags := s
+	s, err := s.withServerConfig()
+	if err != nil {
+		return err
+	}
+	if s.ValidateConfig {
+		return s.checkFiles()
+	}
 	caRPCServer, err := ca.NewServer(s.PrivateKeyPath, s.PublicKeyPath, s.SkipConfirmation)
 	if err != nil {
 		return fmt.Errorf("failed to initialize SSH CA RPC server: %w", err)
 	}
+	caRPCServer.ConfirmationTimeout = s.ConfirmationTimeout
+	policy, err := s.policy()
+	if err != nil {
+		return err
+	}
+	s.ConnectionFlags.apply(&caRPCServer)
+	caRPCServer.KRLPath = s.KRLPath
+	if s.CertRegistry != "" {
+		caRPCServer.Issued, err = s.RetentionFlags.loadRegistry(s.CertRegistry)
+		if err != nil {
+			return err
+		}
+	}
+	if s.SubCARegistry != "" {
+		caRPCServer.SubCAs, err = ca.LoadSubCARegistry(s.SubCARegistry)
+		if err != nil {
+			return err
+		}
+	}
+	caRPCServer.SSHKeygen = detectSSHKeygen(s.SSHKeygenPath)
+	caRPCServer.SSHKeygen.NonInteractive = s.NonInteractive
+	if s.TempDir != "" {
+		if info, err := os.Stat(s.TempDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("--temp-dir %s is not a directory", s.TempDir)
+		}
+		caRPCServer.SSHKeygen.TempDir = s.TempDir
+	}
+	if s.PassphraseFile != "" {
+		passphrase, err := ioutil.ReadFile(s.PassphraseFile)
+		if err != nil {
+			return fmt.Errorf("failed to read passphrase: %w", err)
+		}
+		caRPCServer.SSHKeygen.Passphrase = strings.TrimRight(string(passphrase), "\r\n")
+	}
+	if s.SignCertRegistry {
+		if version := caRPCServer.SSHKeygen.Version; !version.Supports(openssh.SignData) {
+			return fmt.Errorf("--sign-cert-registry needs %s, which %s does not support (needs %s)", openssh.SignData.Description, version, openssh.SignData.Since)
+		}
+		caRPCServer.SignIssuances = true
+	}
+	err = caRPCServer.Reload(policy, s.AlgorithmFlags.policy())
+	if err != nil {
+		return fmt.Errorf("invalid algorithm policy: %w", err)
+	}
+
+	deliverer, err := s.EmailFlags.MakeDeliverer()
+	if err != nil {
+		return fmt.Errorf("failed to initialize email delivery: %w", err)
+	}
+	if deliverer != nil {
+		caRPCServer.Delivery = deliverer
+	}
+	forward, err := s.AuditForwardingFlags.forwarders()
+	if err != nil {
+		return err
+	}
+	if err := s.ApprovalFlags.apply(&caRPCServer); err != nil {
+		return err
+	}
+	if webhooks := s.alertWebhooks(); len(webhooks) != 0 {
+		alerts := ca.AuditSinks{}
+		for _, url := range webhooks {
+			webhook := notify.NewWebhook(url, auditForwardTimeout)
+			alerts = append(alerts, notify.NewAlertForwarder(webhook, func(err error) { out.warning(err.Error()) }))
+		}
+		caRPCServer.Alerts = alerts
+	}
+	if err := s.TenantFlags.apply(&caRPCServer, s.RetentionFlags, forward); err != nil {
+		return fmt.Errorf("failed to initialize tenants: %w", err)
+	}
 
-	server := rpc.NewServer()
-	server.RegisterName(ca.ServerName, &caRPCServer)
+	err = s.MonitoringFlags.start(&caRPCServer)
+	if err != nil {
+		return err
+	}
 
-	listener, err := net.Listen("tcp", s.Addr)
+	listener, err := s.ConnectionFlags.listen(s.Addr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %w", s.Addr, err)
 	}
-	server.Accept(listener)
+	go removeTempDirsOnSignal()
+	go reloadOnSignal(flags, s.ApprovalFlags, &caRPCServer)
+	return caRPCServer.Accept(listener)
+}
+
+// policy returns the policy selected by the flags, with the groups from the
+// groups file. The algorithm policy is set separately, since it depends on
+// the CA key.
+func (s ServerCmd) policy() (ca.Policy, error) {
+	var policy ca.Policy
+	s.ValidityFlags.apply(&policy)
+	policy.HostDNS = s.HostDNSFlags.policy()
+	policy.RequireProof = s.ProofFlags.policy()
+	policy.Principals = s.PrincipalFlags.policy()
+	policy.Extensions = s.ExtensionFlags.policy()
+	policy.Quorum = s.ApprovalFlags.policy()
+	policy.BreakGlass = s.BreakGlassFlags.policy()
+	if s.GroupsFile != "" {
+		groups, err := loadGroups(s.GroupsFile)
+		if err != nil {
+			return ca.Policy{}, err
+		}
+		policy.Groups = groups
+	}
+	if s.TOTPSecrets != "" {
+		secrets, err := loadTOTPSecrets(s.TOTPSecrets)
+		if err != nil {
+			return ca.Policy{}, err
+		}
+		policy.TOTP = ca.TOTPPolicy{Secrets: secrets}
+	}
+	return policy, nil
+}
+
+// alertWebhooks returns the webhooks that are alerted about break-glass
+// requests, in addition to the audit logs and forwarding: the people who would
+// have approved the request, or been told that it was slow, should know.
+func (s ServerCmd) alertWebhooks() []string {
+	var webhooks []string
+	for _, url := range []string{s.ApprovalWebhook, s.SlowApprovalWebhook} {
+		if url != "" {
+			webhooks = append(webhooks, url)
+		}
+	}
+	return webhooks
+}
+
+// checkFiles reads the CA key and the YAML files of the server, to catch
+// mistakes in them before the server is started.
+func (s ServerCmd) checkFiles() error {
+	if _, err := ca.NewServer(s.PrivateKeyPath, s.PublicKeyPath, s.SkipConfirmation); err != nil {
+		return err
+	}
+	if s.GroupsFile != "" {
+		if _, err := loadGroups(s.GroupsFile); err != nil {
+			return err
+		}
+	}
+	if s.TenantsFile != "" {
+		if _, err := loadTenants(s.TenantsFile); err != nil {
+			return err
+		}
+	}
+	if s.TOTPSecrets != "" {
+		if _, err := loadTOTPSecrets(s.TOTPSecrets); err != nil {
+			return err
+		}
+	}
+	out.success("the server config is valid")
 	return nil
 }
+
+// removeTempDirsOnSignal removes the temporary files of the requests in
+// progress when the server is stopped (e.g. with Ctrl-C while ssh-keygen asks
+// for the CA key passphrase), which would otherwise be left behind.
+func removeTempDirsOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	ca.RemoveTempDirs()
+	fmt.Fprintf(os.Stderr, "stopped by %s\n", sig)
+	os.Exit(1)
+}
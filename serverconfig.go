@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultSSHKeygenPath is the ssh-keygen used by the server if neither the
+// flags nor the server config set one.
+const defaultSSHKeygenPath = "ssh-keygen"
+
+// serverConfig is the server config passed to server --config. Every setting
+// has a flag, which overrides it.
+type serverConfig struct {
+	// Listen is the address to listen on, if it isn't passed on the command
+	// line.
+	Listen       string                 `yaml:"listen"`
+	Keys         serverKeysConfig       `yaml:"keys"`
+	SSHKeygen    serverSSHKeygenConfig  `yaml:"ssh_keygen"`
+	Confirmation serverConfirmConfig    `yaml:"confirmation"`
+	Approval     serverApprovalConfig   `yaml:"approval"`
+	Files        serverFilesConfig      `yaml:"files"`
+	Validity     serverValidityConfig   `yaml:"validity"`
+	Policy       serverPolicyConfig     `yaml:"policy"`
+	Limits       serverLimitsConfig     `yaml:"limits"`
+	Audit        serverAuditConfig      `yaml:"audit"`
+	Email        serverEmailConfig      `yaml:"email"`
+	Monitoring   serverMonitoringConfig `yaml:"monitoring"`
+}
+
+// serverKeysConfig is the CA key of the default tenant.
+type serverKeysConfig struct {
+	Private        string `yaml:"private"`
+	Public         string `yaml:"public"`
+	PassphraseFile string `yaml:"passphrase_file"`
+}
+
+// serverSSHKeygenConfig controls how ssh-keygen is run.
+type serverSSHKeygenConfig struct {
+	Path           string `yaml:"path"`
+	NonInteractive bool   `yaml:"non_interactive"`
+	TempDir        string `yaml:"temp_dir"`
+}
+
+// serverConfirmConfig controls the confirmation of signing requests.
+type serverConfirmConfig struct {
+	Skip    bool     `yaml:"skip"`
+	Timeout duration `yaml:"timeout"`
+}
+
+// serverApprovalConfig configures approvals through a webhook, and the quorum
+// of approvals for sensitive requests.
+type serverApprovalConfig struct {
+	Webhook             string   `yaml:"webhook"`
+	CallbackAddr        string   `yaml:"callback_addr"`
+	CallbackURL         string   `yaml:"callback_url"`
+	Token               string   `yaml:"token"`
+	PollInterval        duration `yaml:"poll_interval"`
+	Quorum              int      `yaml:"quorum"`
+	Approvers           []string `yaml:"approvers"`
+	SensitivePrincipals []string `yaml:"sensitive_principals"`
+	SensitiveValidity   duration `yaml:"sensitive_validity"`
+}
+
+// serverFilesConfig are the registries and lists that the server reads or
+// maintains.
+type serverFilesConfig struct {
+	CertRegistry     string `yaml:"cert_registry"`
+	SignCertRegistry bool   `yaml:"sign_cert_registry"`
+	SubCARegistry    string `yaml:"sub_ca_registry"`
+	KRL              string `yaml:"krl"`
+	Groups           string `yaml:"groups"`
+	Tenants          string `yaml:"tenants"`
+	TOTPSecrets      string `yaml:"totp_secrets"`
+}
+
+// serverValidityConfig is the validity policy of certificates.
+type serverValidityConfig struct {
+	UserDefault duration `yaml:"user_default"`
+	UserMax     duration `yaml:"user_max"`
+	HostDefault duration `yaml:"host_default"`
+	HostMax     duration `yaml:"host_max"`
+	Clamp       bool     `yaml:"clamp"`
+	Backdate    duration `yaml:"backdate"`
+}
+
+// serverPolicyConfig restricts the requests that are signed and what the
+// certificates contain.
+type serverPolicyConfig struct {
+	FIPS                        bool     `yaml:"fips"`
+	AllowedKeyTypes             []string `yaml:"allowed_key_types"`
+	AllowedSignatureAlgorithms  []string `yaml:"allowed_signature_algorithms"`
+	MinRSABits                  int      `yaml:"min_rsa_bits"`
+	VerifyHostDNS               bool     `yaml:"verify_host_dns"`
+	DNSOverrideToken            string   `yaml:"dns_override_token"`
+	AllowHostWildcardPrincipals bool     `yaml:"allow_host_wildcard_principals"`
+	AllowUserWildcardPrincipals bool     `yaml:"allow_user_wildcard_principals"`
+	DeniedPrincipals            []string `yaml:"denied_principals"`
+	RequireHostProof            bool     `yaml:"require_host_proof"`
+	RequireUserProof            bool     `yaml:"require_user_proof"`
+	UserCertOptions             []string `yaml:"user_cert_options"`
+	HostCertOptions             []string `yaml:"host_cert_options"`
+	AllowedUserExtensions       []string `yaml:"allowed_user_extensions"`
+	BreakGlassToken             string   `yaml:"break_glass_token"`
+	BreakGlassValidity          duration `yaml:"break_glass_validity"`
+}
+
+// serverLimitsConfig limits the connections of clients. TCPKeepAlive can't be
+// negative here, so keepalives can only be disabled with the flag.
+type serverLimitsConfig struct {
+	MaxRequestSize int64    `yaml:"max_request_size"`
+	RequestTimeout duration `yaml:"request_timeout"`
+	IdleTimeout    duration `yaml:"idle_timeout"`
+	WriteTimeout   duration `yaml:"write_timeout"`
+	TCPKeepAlive   duration `yaml:"tcp_keepalive"`
+	MaxConcurrent  int      `yaml:"max_concurrent_requests"`
+}
+
+// serverAuditConfig is where audit events go and how long they are kept.
+type serverAuditConfig struct {
+	Log               string   `yaml:"log"`
+	LogMaxSize        int64    `yaml:"log_max_size"`
+	LogMaxAge         duration `yaml:"log_max_age"`
+	LogRetention      duration `yaml:"log_retention"`
+	LogCompress       bool     `yaml:"log_compress"`
+	PruneExpiredAfter duration `yaml:"prune_expired_after"`
+	Syslog            string   `yaml:"syslog"`
+	CEF               string   `yaml:"cef"`
+	Webhook           string   `yaml:"webhook"`
+}
+
+// serverEmailConfig configures the email delivery of certificates.
+type serverEmailConfig struct {
+	SMTPServer   string `yaml:"smtp_server"`
+	SMTPFrom     string `yaml:"smtp_from"`
+	SMTPUser     string `yaml:"smtp_user"`
+	SMTPPassword string `yaml:"smtp_password"`
+	EmailMap     string `yaml:"email_map"`
+}
+
+// serverMonitoringConfig configures metrics, alerts and debugging endpoints.
+type serverMonitoringConfig struct {
+	MetricsAddr         string   `yaml:"metrics_addr"`
+	SlowApprovalAfter   duration `yaml:"slow_approval_after"`
+	SlowApprovalWebhook string   `yaml:"slow_approval_webhook"`
+	DebugAddr           string   `yaml:"debug_addr"`
+}
+
+// loadServerConfig reads the server config at path. Unknown settings and
+// values of the wrong type are errors, so that typos aren't silently ignored.
+func loadServerConfig(path string) (serverConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return serverConfig{}, fmt.Errorf("failed to read server config at %s: %w", path, err)
+	}
+	var cfg serverConfig
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return serverConfig{}, fmt.Errorf("failed to parse server config at %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// fillString sets *flag to value if the flag wasn't set.
+func fillString(flag *string, value string) {
+	if *flag == "" {
+		*flag = value
+	}
+}
+
+// fillDuration sets *flag to value if the flag wasn't set.
+func fillDuration(flag *time.Duration, value duration) {
+	if *flag == 0 {
+		*flag = time.Duration(value)
+	}
+}
+
+// fillInt64 sets *flag to value if the flag wasn't set.
+func fillInt64(flag *int64, value int64) {
+	if *flag == 0 {
+		*flag = value
+	}
+}
+
+// fillList sets *flag to value if the flag wasn't set.
+func fillList(flag *[]string, value []string) {
+	if len(*flag) == 0 {
+		*flag = value
+	}
+}
+
+// withServerConfig fills in the options that weren't set on the command line
+// from the server config. Boolean settings are enabled by either.
+func (s ServerCmd) withServerConfig() (ServerCmd, error) {
+	if s.ConfigPath != "" {
+		cfg, err := loadServerConfig(s.ConfigPath)
+		if err != nil {
+			return s, err
+		}
+		s.fill(cfg)
+	}
+	fillString(&s.SSHKeygenPath, defaultSSHKeygenPath)
+	return s, nil
+}
+
+// fill sets the options that weren't set on the command line from cfg.
+func (s *ServerCmd) fill(cfg serverConfig) {
+	fillString(&s.Addr, cfg.Listen)
+	fillString(&s.PrivateKeyPath, cfg.Keys.Private)
+	fillString(&s.PublicKeyPath, cfg.Keys.Public)
+	fillString(&s.PassphraseFile, cfg.Keys.PassphraseFile)
+
+	fillString(&s.SSHKeygenPath, cfg.SSHKeygen.Path)
+	s.NonInteractive = s.NonInteractive || cfg.SSHKeygen.NonInteractive
+	fillString(&s.TempDir, cfg.SSHKeygen.TempDir)
+
+	s.SkipConfirmation = s.SkipConfirmation || cfg.Confirmation.Skip
+	fillDuration(&s.ConfirmationTimeout, cfg.Confirmation.Timeout)
+
+	fillString(&s.ApprovalWebhook, cfg.Approval.Webhook)
+	fillString(&s.ApprovalCallbackAddr, cfg.Approval.CallbackAddr)
+	fillString(&s.ApprovalCallbackURL, cfg.Approval.CallbackURL)
+	fillString(&s.ApprovalToken, cfg.Approval.Token)
+	fillDuration(&s.ApprovalPollInterval, cfg.Approval.PollInterval)
+	if s.ApprovalQuorum == 0 {
+		s.ApprovalQuorum = cfg.Approval.Quorum
+	}
+	fillList(&s.Approvers.Items, cfg.Approval.Approvers)
+	fillList(&s.SensitivePrincipals.Items, cfg.Approval.SensitivePrincipals)
+	fillDuration(&s.SensitiveValidity, cfg.Approval.SensitiveValidity)
+
+	fillString(&s.CertRegistry, cfg.Files.CertRegistry)
+	s.SignCertRegistry = s.SignCertRegistry || cfg.Files.SignCertRegistry
+	fillString(&s.SubCARegistry, cfg.Files.SubCARegistry)
+	fillString(&s.KRLPath, cfg.Files.KRL)
+	fillString(&s.GroupsFile, cfg.Files.Groups)
+	fillString(&s.TenantsFile, cfg.Files.Tenants)
+	fillString(&s.TOTPSecrets, cfg.Files.TOTPSecrets)
+
+	fillDuration(&s.UserDefaultValidity, cfg.Validity.UserDefault)
+	fillDuration(&s.UserMaxValidity, cfg.Validity.UserMax)
+	fillDuration(&s.HostDefaultValidity, cfg.Validity.HostDefault)
+	fillDuration(&s.HostMaxValidity, cfg.Validity.HostMax)
+	s.ClampValidity = s.ClampValidity || cfg.Validity.Clamp
+	fillDuration(&s.Backdate, cfg.Validity.Backdate)
+
+	s.FIPS = s.FIPS || cfg.Policy.FIPS
+	fillList(&s.AllowedKeyTypes.Items, cfg.Policy.AllowedKeyTypes)
+	fillList(&s.AllowedSignatureAlgorithms.Items, cfg.Policy.AllowedSignatureAlgorithms)
+	if s.MinRSABits == 0 {
+		s.MinRSABits = cfg.Policy.MinRSABits
+	}
+	s.VerifyHostDNS = s.VerifyHostDNS || cfg.Policy.VerifyHostDNS
+	fillString(&s.DNSOverrideToken, cfg.Policy.DNSOverrideToken)
+	s.AllowHostWildcards = s.AllowHostWildcards || cfg.Policy.AllowHostWildcardPrincipals
+	s.AllowUserWildcards = s.AllowUserWildcards || cfg.Policy.AllowUserWildcardPrincipals
+	fillList(&s.DeniedPrincipals.Items, cfg.Policy.DeniedPrincipals)
+	s.RequireHostProof = s.RequireHostProof || cfg.Policy.RequireHostProof
+	s.RequireUserProof = s.RequireUserProof || cfg.Policy.RequireUserProof
+	fillList(&s.UserCertOptions, cfg.Policy.UserCertOptions)
+	fillList(&s.HostCertOptions, cfg.Policy.HostCertOptions)
+	fillList(&s.AllowedUserExtensions.Items, cfg.Policy.AllowedUserExtensions)
+	fillString(&s.BreakGlassToken, cfg.Policy.BreakGlassToken)
+	fillDuration(&s.BreakGlassValidity, cfg.Policy.BreakGlassValidity)
+
+	fillInt64(&s.MaxRequestSize, cfg.Limits.MaxRequestSize)
+	fillDuration(&s.RequestTimeout, cfg.Limits.RequestTimeout)
+	fillDuration(&s.IdleTimeout, cfg.Limits.IdleTimeout)
+	fillDuration(&s.WriteTimeout, cfg.Limits.WriteTimeout)
+	fillDuration(&s.TCPKeepAlive, cfg.Limits.TCPKeepAlive)
+	if s.MaxConcurrent == 0 {
+		s.MaxConcurrent = cfg.Limits.MaxConcurrent
+	}
+
+	fillString(&s.AuditLog, cfg.Audit.Log)
+	fillInt64(&s.AuditLogMaxSize, cfg.Audit.LogMaxSize)
+	fillDuration(&s.AuditLogMaxAge, cfg.Audit.LogMaxAge)
+	fillDuration(&s.AuditLogRetention, cfg.Audit.LogRetention)
+	s.AuditLogCompress = s.AuditLogCompress || cfg.Audit.LogCompress
+	fillDuration(&s.PruneExpiredAfter, cfg.Audit.PruneExpiredAfter)
+	fillString(&s.AuditSyslog, cfg.Audit.Syslog)
+	fillString(&s.AuditCEF, cfg.Audit.CEF)
+	fillString(&s.AuditWebhook, cfg.Audit.Webhook)
+
+	fillString(&s.SMTPServer, cfg.Email.SMTPServer)
+	fillString(&s.SMTPFrom, cfg.Email.SMTPFrom)
+	fillString(&s.SMTPUser, cfg.Email.SMTPUser)
+	fillString(&s.SMTPPassword, cfg.Email.SMTPPassword)
+	fillString(&s.EmailMap, cfg.Email.EmailMap)
+
+	fillString(&s.MetricsAddr, cfg.Monitoring.MetricsAddr)
+	fillDuration(&s.SlowApprovalAfter, cfg.Monitoring.SlowApprovalAfter)
+	fillString(&s.SlowApprovalWebhook, cfg.Monitoring.SlowApprovalWebhook)
+	fillString(&s.DebugAddr, cfg.Monitoring.DebugAddr)
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/delivery"
+	"github.com/ratorx/sshca/notify"
+)
+
+// ValidityFlags configure the validity of the certificates issued by the
+// server.
+type ValidityFlags struct {
+	UserDefaultValidity time.Duration `arg:"--user-default-validity" placeholder:"DURATION" help:"validity of user certificates when the request doesn't specify one (default: forever)"`
+	UserMaxValidity     time.Duration `arg:"--user-max-validity" placeholder:"DURATION" help:"maximum validity of user certificates (default: unlimited)"`
+	HostDefaultValidity time.Duration `arg:"--host-default-validity" placeholder:"DURATION" help:"validity of host certificates when the request doesn't specify one (default: forever)"`
+	HostMaxValidity     time.Duration `arg:"--host-max-validity" placeholder:"DURATION" help:"maximum validity of host certificates (default: unlimited)"`
+	ClampValidity       bool          `arg:"--clamp-validity" help:"issue the maximum validity for requests that exceed it, instead of rejecting them"`
+	Backdate            time.Duration `arg:"--backdate" placeholder:"DURATION" help:"start the validity of certificates this long before they are signed, so that machines with slightly slow clocks accept them (at most 1h)"`
+}
+
+// Validate checks that the validity durations are not negative, and that the
+// backdate is within the cap.
+func (v ValidityFlags) Validate() error {
+	for _, d := range []time.Duration{v.UserDefaultValidity, v.UserMaxValidity, v.HostDefaultValidity, v.HostMaxValidity} {
+		if d < 0 {
+			return fmt.Errorf("validity durations must not be negative")
+		}
+	}
+	if v.Backdate < 0 || v.Backdate > ca.MaxBackdate {
+		return fmt.Errorf("--backdate must be between 0 and %s", ca.MaxBackdate)
+	}
+	return nil
+}
+
+// apply sets the validity policies in the server policy.
+func (v ValidityFlags) apply(policy *ca.Policy) {
+	policy.UserValidity = ca.ValidityPolicy{Default: v.UserDefaultValidity, Max: v.UserMaxValidity, Clamp: v.ClampValidity}
+	policy.HostValidity = ca.ValidityPolicy{Default: v.HostDefaultValidity, Max: v.HostMaxValidity, Clamp: v.ClampValidity}
+	policy.Backdate = v.Backdate
+}
+
+// EmailFlags configure optional email delivery of issued certificates.
+type EmailFlags struct {
+	SMTPServer   string `arg:"--smtp-server" placeholder:"HOST:PORT" help:"SMTP server used to email issued certificates (enables email delivery)"`
+	SMTPFrom     string `arg:"--smtp-from" placeholder:"ADDRESS" help:"sender address for certificate emails"`
+	SMTPUser     string `arg:"--smtp-user" placeholder:"USER" help:"username for SMTP authentication (optional)"`
+	SMTPPassword string `arg:"--smtp-password,env:SSHCA_SMTP_PASSWORD" placeholder:"PASSWORD" help:"password for SMTP authentication"`
+	EmailMap     string `arg:"--email-map" placeholder:"PATH" help:"file mapping principals to email addresses (one \"principal address\" pair per line)"`
+}
+
+// Validate checks that the flags required for email delivery are set
+// together.
+func (e EmailFlags) Validate() error {
+	if e.SMTPServer == "" {
+		return nil
+	}
+	if e.SMTPFrom == "" || e.EmailMap == "" {
+		return fmt.Errorf("--smtp-from and --email-map must be set when --smtp-server is used")
+	}
+	return nil
+}
+
+// MakeDeliverer creates the email deliverer, or returns nil if email delivery
+// is not enabled.
+func (e EmailFlags) MakeDeliverer() (ca.Deliverer, error) {
+	if e.SMTPServer == "" {
+		return nil, nil
+	}
+
+	host, _, err := net.SplitHostPort(e.SMTPServer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP server address %s: %w", e.SMTPServer, err)
+	}
+	var auth smtp.Auth
+	if e.SMTPUser != "" {
+		auth = smtp.PlainAuth("", e.SMTPUser, e.SMTPPassword, host)
+	}
+
+	return delivery.NewEmailDeliverer(e.SMTPServer, e.SMTPFrom, auth, e.EmailMap)
+}
+
+// MonitoringFlags configure the metrics endpoint and alerts for the signing
+// queue, and the debugging endpoint of the server process.
+type MonitoringFlags struct {
+	MetricsAddr         string        `arg:"--metrics-addr" placeholder:"ADDR" help:"TCP address to serve Prometheus metrics for the signing queue on (disabled if unset)"`
+	SlowApprovalAfter   time.Duration `arg:"--slow-approval-after" placeholder:"DURATION" help:"alert when a request waits longer than this for approval (requires --slow-approval-webhook)"`
+	SlowApprovalWebhook string        `arg:"--slow-approval-webhook" placeholder:"URL" help:"URL to POST slow approval alerts to"`
+	DebugAddr           string        `arg:"--debug-addr" placeholder:"ADDR" help:"TCP address to serve pprof profiles (/debug/pprof/) and runtime stats (/debug/runtime) on, e.g. localhost:6060 (disabled if unset)"`
+}
+
+// slowApprovalEvent is the body of the slow approval webhook.
+type slowApprovalEvent struct {
+	Event          string  `json:"event"`
+	Request        string  `json:"request"`
+	WaitingSeconds float64 `json:"waiting_seconds"`
+}
+
+// Validate checks that alerting is fully configured if it is enabled.
+func (m MonitoringFlags) Validate() error {
+	if (m.SlowApprovalAfter > 0) != (m.SlowApprovalWebhook != "") {
+		return fmt.Errorf("--slow-approval-after and --slow-approval-webhook must be used together")
+	}
+	if m.SlowApprovalAfter < 0 {
+		return fmt.Errorf("--slow-approval-after must not be negative")
+	}
+	return nil
+}
+
+// start serves the metrics and debugging endpoints and watches for slow
+// requests in the background.
+func (m MonitoringFlags) start(server *ca.Server) error {
+	if m.DebugAddr != "" {
+		if err := serveDebug(m.DebugAddr); err != nil {
+			return err
+		}
+	}
+
+	if m.MetricsAddr != "" {
+		listener, err := net.Listen("tcp", m.MetricsAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for metrics on %s: %w", m.MetricsAddr, err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", server.MetricsHandler())
+		go http.Serve(listener, mux)
+	}
+
+	if m.SlowApprovalWebhook != "" {
+		webhook := notify.NewWebhook(m.SlowApprovalWebhook, 10*time.Second)
+		alert := func(request ca.SlowRequest) {
+			err := webhook.Post(slowApprovalEvent{"slow_approval", request.Description, request.Waiting.Seconds()})
+			if err != nil {
+				out.warning(fmt.Sprintf("failed to send slow approval alert: %s", err))
+			}
+		}
+		// Check often enough that alerts are not much later than the threshold
+		interval := m.SlowApprovalAfter / 10
+		if interval < time.Second {
+			interval = time.Second
+		}
+		go server.WatchSlowRequests(m.SlowApprovalAfter, interval, alert, nil)
+	}
+
+	return nil
+}
+
+// AlgorithmFlags restrict the algorithms that the server signs and signs
+// with.
+type AlgorithmFlags struct {
+	FIPS                       bool               `arg:"--fips" help:"only allow FIPS approved algorithms (RSA with SHA-2 and ECDSA on NIST curves)"`
+	AllowedKeyTypes            CommaSeparatedList `arg:"--allowed-key-types" placeholder:"TYPES" help:"comma-separated key types that are allowed to be signed, and for the CA key (default: all)"`
+	AllowedSignatureAlgorithms CommaSeparatedList `arg:"--allowed-signature-algorithms" placeholder:"ALGORITHMS" help:"comma-separated signature algorithms the CA is allowed to sign with (default: all)"`
+	MinRSABits                 int                `arg:"--min-rsa-bits" placeholder:"BITS" help:"minimum size of RSA keys that are allowed to be signed"`
+}
+
+// Validate checks that the FIPS preset is not combined with explicit lists.
+func (a AlgorithmFlags) Validate() error {
+	if a.FIPS && (len(a.AllowedKeyTypes.Items) != 0 || len(a.AllowedSignatureAlgorithms.Items) != 0 || a.MinRSABits != 0) {
+		return fmt.Errorf("--fips can't be used with --allowed-key-types, --allowed-signature-algorithms or --min-rsa-bits")
+	}
+	if a.MinRSABits < 0 {
+		return fmt.Errorf("--min-rsa-bits must not be negative")
+	}
+	return nil
+}
+
+// policy returns the algorithm policy selected by the flags.
+func (a AlgorithmFlags) policy() ca.AlgorithmPolicy {
+	if a.FIPS {
+		return ca.FIPSAlgorithmPolicy
+	}
+	return ca.AlgorithmPolicy{
+		KeyTypes:            a.AllowedKeyTypes.Items,
+		SignatureAlgorithms: a.AllowedSignatureAlgorithms.Items,
+		MinRSABits:          a.MinRSABits,
+	}
+}
+
+// HostDNSFlags configure the DNS check of host certificate principals.
+type HostDNSFlags struct {
+	VerifyHostDNS    bool   `arg:"--verify-host-dns" help:"reject host certificate requests unless every principal resolves to the requesting IP address"`
+	DNSOverrideToken string `arg:"--dns-override-token,env:SSHCA_DNS_OVERRIDE_TOKEN" placeholder:"TOKEN" help:"token that lets sign_host --override-token skip the DNS check"`
+}
+
+// Validate checks that the override token is only set with the check.
+func (h HostDNSFlags) Validate() error {
+	if h.DNSOverrideToken != "" && !h.VerifyHostDNS {
+		return fmt.Errorf("--dns-override-token requires --verify-host-dns")
+	}
+	return nil
+}
+
+// policy returns the host DNS policy selected by the flags.
+func (h HostDNSFlags) policy() ca.HostDNSPolicy {
+	return ca.HostDNSPolicy{Verify: h.VerifyHostDNS, OverrideToken: h.DNSOverrideToken}
+}
+
+// PrincipalFlags configure which certificates can have wildcard principals,
+// and which principals are never issued.
+type PrincipalFlags struct {
+	AllowHostWildcards bool               `arg:"--allow-host-wildcard-principals" help:"allow host certificate principals with * or ? (e.g. *.example.com), which ssh matches as patterns"`
+	AllowUserWildcards bool               `arg:"--allow-user-wildcard-principals" help:"allow user certificate principals with * or ? (sshd compares them literally)"`
+	DeniedPrincipals   CommaSeparatedList `arg:"--denied-principals" placeholder:"PRINCIPALS" help:"comma-separated principals or patterns with * and ? (e.g. root,admin-*) that are never issued, even to approved or break-glass requests"`
+}
+
+// Validate implementation for Command
+func (p PrincipalFlags) Validate() error {
+	return p.policy().Validate()
+}
+
+// policy returns the principal policy selected by the flags.
+func (p PrincipalFlags) policy() ca.PrincipalPolicy {
+	return ca.PrincipalPolicy{HostWildcards: p.AllowHostWildcards, UserWildcards: p.AllowUserWildcards, Denied: p.DeniedPrincipals.Items}
+}
+
+// ExtensionFlags configure the critical options and extensions of issued
+// certificates.
+type ExtensionFlags struct {
+	UserCertOptions       []string           `arg:"--user-cert-option,separate" placeholder:"OPTION" help:"add an ssh-keygen -O option to every user certificate, e.g. extension:team@example.com=infra or source-address=10.0.0.0/8; can be repeated"`
+	HostCertOptions       []string           `arg:"--host-cert-option,separate" placeholder:"OPTION" help:"add a custom extension:NAME=VALUE or critical:NAME=VALUE option to every host certificate (needs a recent ssh-keygen); can be repeated"`
+	AllowedUserExtensions CommaSeparatedList `arg:"--allowed-user-extensions" placeholder:"EXTENSIONS" help:"comma-separated extensions that user certificates may have (e.g. permit-pty,permit-port-forwarding), stripping the others that clients request or get by default (default: all)"`
+}
+
+// policy returns the extension policy selected by the flags.
+func (e ExtensionFlags) policy() ca.ExtensionPolicy {
+	return ca.ExtensionPolicy{
+		UserOptions:           e.UserCertOptions,
+		HostOptions:           e.HostCertOptions,
+		AllowedUserExtensions: e.AllowedUserExtensions.Items,
+	}
+}
+
+// Validate implementation for Command
+func (e ExtensionFlags) Validate() error {
+	return e.policy().Validate()
+}
+
+// ProofFlags configure which requests must prove possession of the private
+// key.
+type ProofFlags struct {
+	RequireHostProof bool `arg:"--require-host-proof" help:"reject host certificate requests that don't prove possession of the host private key"`
+	RequireUserProof bool `arg:"--require-user-proof" help:"reject user certificate requests that don't prove possession of the private key (sign_user --prove)"`
+}
+
+// policy returns the proof policy selected by the flags.
+func (p ProofFlags) policy() ca.ProofPolicy {
+	return ca.ProofPolicy{Hosts: p.RequireHostProof, Users: p.RequireUserProof}
+}
+
+// ConnectionFlags limit what a client connection can make the server read, so
+// that oversized or trickled requests can't exhaust its memory, and how long
+// connections are kept, so that dead clients don't hold on to goroutines and
+// file descriptors.
+type ConnectionFlags struct {
+	MaxRequestSize int64         `arg:"--max-request-size" placeholder:"BYTES" help:"close connections that send a request larger than this (default: 65536)"`
+	RequestTimeout time.Duration `arg:"--request-timeout" placeholder:"DURATION" help:"close connections that take longer than this to send a request once it has started (default: 30s)"`
+	IdleTimeout    time.Duration `arg:"--idle-timeout" placeholder:"DURATION" help:"close connections that send no requests for this long, unless a request is waiting to be signed (default: 5m)"`
+	WriteTimeout   time.Duration `arg:"--write-timeout" placeholder:"DURATION" help:"close connections that don't accept a response within this time (default: 30s)"`
+	MaxConcurrent  int           `arg:"--max-concurrent-requests" placeholder:"N" help:"handle at most this many requests at once on each connection, and read the next one once a response is sent (default: 16)"`
+	TCPKeepAlive   time.Duration `arg:"--tcp-keepalive" placeholder:"DURATION" help:"interval of TCP keepalive probes, which detect clients that went away without closing the connection (default: 15s, negative disables)"`
+}
+
+// Validate implementation for Command
+func (c ConnectionFlags) Validate() error {
+	if c.MaxRequestSize < 0 {
+		return fmt.Errorf("--max-request-size must not be negative")
+	}
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("--request-timeout must not be negative")
+	}
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("--idle-timeout must not be negative")
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("--write-timeout must not be negative")
+	}
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("--max-concurrent-requests must not be negative")
+	}
+	return nil
+}
+
+// apply sets the connection limits on server, keeping its defaults for the
+// flags that aren't set.
+func (c ConnectionFlags) apply(server *ca.Server) {
+	if c.MaxRequestSize != 0 {
+		server.MaxRequestSize = c.MaxRequestSize
+	}
+	if c.RequestTimeout != 0 {
+		server.RequestTimeout = c.RequestTimeout
+	}
+	if c.IdleTimeout != 0 {
+		server.IdleTimeout = c.IdleTimeout
+	}
+	if c.WriteTimeout != 0 {
+		server.WriteTimeout = c.WriteTimeout
+	}
+	if c.MaxConcurrent != 0 {
+		server.MaxConcurrentRequests = c.MaxConcurrent
+	}
+}
+
+// listen listens on addr, with TCP keepalives on the accepted connections.
+// unix://PATH listens on a Unix socket instead, replacing a stale socket left
+// by a previous server.
+func (c ConnectionFlags) listen(addr string) (net.Listener, error) {
+	config := net.ListenConfig{KeepAlive: c.TCPKeepAlive}
+	scheme, addr := ca.SplitRemote(addr)
+	switch scheme {
+	case "tcp":
+		return config.Listen(context.Background(), "tcp", addr)
+	case "unix":
+		if info, err := os.Lstat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(addr); err != nil {
+				return nil, err
+			}
+		}
+		return config.Listen(context.Background(), "unix", addr)
+	default:
+		return nil, fmt.Errorf("the server can only listen on tcp:// or unix:// addresses")
+	}
+}
+
+// RetentionFlags are the flags that keep the audit logs and certificate
+// registries of the server and its tenants from growing forever.
+type RetentionFlags struct {
+	AuditLogMaxSize   int64         `arg:"--audit-log-max-size" placeholder:"BYTES" help:"rotate audit logs before they grow beyond this size (default: no limit)"`
+	AuditLogMaxAge    time.Duration `arg:"--audit-log-max-age" placeholder:"DURATION" help:"rotate audit logs once their first entry is this old, e.g. 24h (default: no limit)"`
+	AuditLogRetention time.Duration `arg:"--audit-log-retention" placeholder:"DURATION" help:"delete rotated audit logs this long after they were rotated (default: keep them)"`
+	AuditLogCompress  bool          `arg:"--audit-log-compress" help:"compress rotated audit logs with gzip"`
+	PruneExpiredAfter time.Duration `arg:"--prune-expired-after" placeholder:"DURATION" help:"remove certificates from certificate registries once they have been expired for this long (default: keep them)"`
+}
+
+// Validate implementation for Command
+func (r RetentionFlags) Validate() error {
+	if r.AuditLogMaxSize < 0 {
+		return fmt.Errorf("--audit-log-max-size must not be negative")
+	}
+	if r.AuditLogMaxAge < 0 || r.AuditLogRetention < 0 {
+		return fmt.Errorf("--audit-log-max-age and --audit-log-retention must not be negative")
+	}
+	if r.PruneExpiredAfter < 0 {
+		return fmt.Errorf("--prune-expired-after must not be negative")
+	}
+	return nil
+}
+
+// rotation returns the rotation policy of the audit logs.
+func (r RetentionFlags) rotation() ca.RotationPolicy {
+	return ca.RotationPolicy{
+		MaxSize:   r.AuditLogMaxSize,
+		MaxAge:    r.AuditLogMaxAge,
+		Retention: r.AuditLogRetention,
+		Compress:  r.AuditLogCompress,
+	}
+}
+
+// loadRegistry loads the certificate registry at path, and prunes it.
+func (r RetentionFlags) loadRegistry(path string) (*ca.CertificateRegistry, error) {
+	registry, err := ca.LoadCertificateRegistry(path)
+	if err != nil {
+		return nil, err
+	}
+	registry.PruneExpiredAfter = r.PruneExpiredAfter
+	pruned, err := registry.Prune(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if pruned != 0 {
+		out.progress("pruned %d expired certificates from %s", pruned, path)
+	}
+	return registry, nil
+}
+
+// ApprovalFlags let an external service (e.g. a chat bot) approve signing
+// requests through a webhook, instead of the operator on the terminal.
+type ApprovalFlags struct {
+	ApprovalWebhook      string             `arg:"--approval-webhook" placeholder:"URL" help:"URL to POST signing requests to for approval by an external service, instead of confirming them on the terminal"`
+	ApprovalCallbackAddr string             `arg:"--approval-callback-addr" placeholder:"ADDR" help:"TCP address to receive approve and deny callbacks on (at /approvals/ID)"`
+	ApprovalCallbackURL  string             `arg:"--approval-callback-url" placeholder:"URL" help:"URL that the service reaches --approval-callback-addr at (default: http://ADDR)"`
+	ApprovalToken        string             `arg:"--approval-token,env:SSHCA_APPROVAL_TOKEN" placeholder:"TOKEN" help:"bearer token that approval callbacks must send"`
+	ApprovalPollInterval time.Duration      `arg:"--approval-poll-interval" placeholder:"DURATION" help:"how often to poll the poll_url returned by the approval webhook (default: 5s)"`
+	ApprovalQuorum       int                `arg:"--approval-quorum" placeholder:"N" help:"number of different approvers that must approve sensitive requests (see --sensitive-principals and --sensitive-validity); other requests need one approval"`
+	Approvers            CommaSeparatedList `arg:"--approvers" placeholder:"APPROVERS" help:"comma-separated approvers whose approvals count towards the quorum, as reported by the approval webhook (e.g. webhook:alice,webhook:bob) (default: any)"`
+	SensitivePrincipals  CommaSeparatedList `arg:"--sensitive-principals" placeholder:"PRINCIPALS" help:"comma-separated principals (e.g. root) whose requests need --approval-quorum approvals"`
+	SensitiveValidity    time.Duration      `arg:"--sensitive-validity" placeholder:"DURATION" help:"requests valid for longer than this (or forever) need --approval-quorum approvals"`
+}
+
+// defaultApprovalTimeout denies requests that the approval webhook doesn't
+// decide in time, if --confirmation-timeout isn't set.
+const defaultApprovalTimeout = 15 * time.Minute
+
+// defaultApprovalPollInterval is used if --approval-poll-interval isn't set.
+const defaultApprovalPollInterval = 5 * time.Second
+
+// Validate checks that the callback options are only used with the webhook,
+// and that callbacks are authenticated.
+func (a ApprovalFlags) Validate() error {
+	if a.ApprovalWebhook == "" && (a.ApprovalCallbackAddr != "" || a.ApprovalCallbackURL != "" || a.ApprovalPollInterval != 0) {
+		return fmt.Errorf("the approval options require --approval-webhook")
+	}
+	if a.ApprovalCallbackAddr == "" && a.ApprovalCallbackURL != "" {
+		return fmt.Errorf("--approval-callback-url requires --approval-callback-addr")
+	}
+	if a.ApprovalCallbackAddr != "" && a.ApprovalToken == "" {
+		return fmt.Errorf("--approval-callback-addr requires --approval-token, so that only the approval service can approve requests")
+	}
+	if a.ApprovalPollInterval < 0 {
+		return fmt.Errorf("--approval-poll-interval must not be negative")
+	}
+	if a.ApprovalQuorum > 1 && a.ApprovalWebhook == "" {
+		return fmt.Errorf("--approval-quorum requires --approval-webhook, since the terminal only gives a single approval")
+	}
+	if err := a.policy().Validate(); err != nil {
+		return fmt.Errorf("invalid approval quorum: %w", err)
+	}
+	return nil
+}
+
+// policy returns the quorum policy selected by the flags.
+func (a ApprovalFlags) policy() ca.QuorumPolicy {
+	return ca.QuorumPolicy{
+		Approvals:  a.ApprovalQuorum,
+		Approvers:  a.Approvers.Items,
+		Principals: a.SensitivePrincipals.Items,
+		Validity:   a.SensitiveValidity,
+	}
+}
+
+// approvalBackend are the approval options that are only applied when the
+// server starts.
+type approvalBackend struct {
+	webhook, callbackAddr, callbackURL, token string
+	pollInterval                              time.Duration
+}
+
+// backend returns the approval options that need a restart to change.
+func (a ApprovalFlags) backend() approvalBackend {
+	return approvalBackend{a.ApprovalWebhook, a.ApprovalCallbackAddr, a.ApprovalCallbackURL, a.ApprovalToken, a.ApprovalPollInterval}
+}
+
+// checkReload checks that the flags can replace running, which the server was
+// started with, on a reload: the approval backend can't change, and a quorum
+// needs interactor to be the approval webhook, since the terminal only gives a
+// single approval.
+func (a ApprovalFlags) checkReload(running ApprovalFlags, interactor ca.Interactor) error {
+	if a.backend() != running.backend() {
+		return fmt.Errorf("the approval webhook and callback options can only be changed by a restart")
+	}
+	if _, ok := interactor.(*notify.WebhookApprover); a.ApprovalQuorum > 1 && !ok {
+		return fmt.Errorf("--approval-quorum requires the approval webhook to be running, which needs a restart")
+	}
+	return nil
+}
+
+// apply makes the server ask the approval webhook to confirm requests, and
+// starts receiving callbacks.
+func (a ApprovalFlags) apply(server *ca.Server) error {
+	if a.ApprovalWebhook == "" {
+		return nil
+	}
+	if server.ConfirmationTimeout == 0 {
+		server.ConfirmationTimeout = defaultApprovalTimeout
+	}
+	pollInterval := a.ApprovalPollInterval
+	if pollInterval == 0 {
+		pollInterval = defaultApprovalPollInterval
+	}
+	callbackURL := a.ApprovalCallbackURL
+	if callbackURL == "" && a.ApprovalCallbackAddr != "" {
+		callbackURL = "http://" + a.ApprovalCallbackAddr
+	}
+	approver := notify.NewWebhookApprover(a.ApprovalWebhook, callbackURL, a.ApprovalToken, pollInterval, server.Reporter)
+	server.Interactor = approver
+
+	if a.ApprovalCallbackAddr != "" {
+		listener, err := net.Listen("tcp", a.ApprovalCallbackAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen for approval callbacks on %s: %w", a.ApprovalCallbackAddr, err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle(notify.ApprovalPath, approver)
+		go http.Serve(listener, mux)
+	}
+	return nil
+}
+
+// BreakGlassFlags configure emergency requests that bypass the normal policy.
+type BreakGlassFlags struct {
+	BreakGlassToken    string        `arg:"--break-glass-token,env:SSHCA_BREAK_GLASS_TOKEN" placeholder:"TOKEN" help:"credential that lets sign_user and sign_host --break-glass REASON skip confirmation, TOTP codes, proof of possession and the DNS check in an emergency (disabled if unset)"`
+	BreakGlassValidity time.Duration `arg:"--break-glass-validity" placeholder:"DURATION" help:"longest validity of break-glass certificates (default: 1h)"`
+}
+
+// Validate checks that the break-glass validity is only set with the token.
+func (b BreakGlassFlags) Validate() error {
+	if b.BreakGlassValidity < 0 {
+		return fmt.Errorf("--break-glass-validity must not be negative")
+	}
+	if b.BreakGlassValidity != 0 && b.BreakGlassToken == "" {
+		return fmt.Errorf("--break-glass-validity requires --break-glass-token")
+	}
+	return nil
+}
+
+// policy returns the break-glass policy selected by the flags.
+func (b BreakGlassFlags) policy() ca.BreakGlassPolicy {
+	return ca.BreakGlassPolicy{Token: b.BreakGlassToken, Validity: b.BreakGlassValidity}
+}
+
+// AuditForwardingFlags forward the audit events of the server and its tenants
+// to external security monitoring, in addition to the audit logs.
+type AuditForwardingFlags struct {
+	AuditSyslog  string `arg:"--audit-syslog" placeholder:"ADDR" help:"syslog collector to send audit events to as RFC 5424 messages, as udp://HOST:PORT or tcp://HOST:PORT (default scheme: udp)"`
+	AuditCEF     string `arg:"--audit-cef" placeholder:"HOST:PORT" help:"collector to send audit events to as CEF lines over TCP"`
+	AuditWebhook string `arg:"--audit-webhook" placeholder:"URL" help:"URL to POST every audit event to as JSON"`
+}
+
+// auditForwardTimeout limits how long sending an audit event may take.
+const auditForwardTimeout = 10 * time.Second
+
+// Validate implementation for Command
+func (a AuditForwardingFlags) Validate() error {
+	if a.AuditSyslog != "" {
+		if _, _, err := splitSyslogAddr(a.AuditSyslog); err != nil {
+			return err
+		}
+	}
+	if a.AuditCEF != "" {
+		if _, _, err := net.SplitHostPort(a.AuditCEF); err != nil {
+			return fmt.Errorf("invalid --audit-cef address: %w", err)
+		}
+	}
+	return nil
+}
+
+// splitSyslogAddr splits a --audit-syslog address into its network and
+// address.
+func splitSyslogAddr(addr string) (string, string, error) {
+	network := "udp"
+	if i := strings.Index(addr, "://"); i != -1 {
+		network, addr = addr[:i], addr[i+len("://"):]
+	}
+	if network != "udp" && network != "tcp" {
+		return "", "", fmt.Errorf("--audit-syslog must be a udp:// or tcp:// address")
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("invalid --audit-syslog address: %w", err)
+	}
+	return network, addr, nil
+}
+
+// forwarders starts forwarding audit events to the configured services.
+// Failures to forward are reported as warnings, since the events are still in
+// the audit logs (if any).
+func (a AuditForwardingFlags) forwarders() (ca.AuditSinks, error) {
+	warn := func(err error) {
+		out.warning(err.Error())
+	}
+	var sinks ca.AuditSinks
+	if a.AuditSyslog != "" {
+		network, addr, err := splitSyslogAddr(a.AuditSyslog)
+		if err != nil {
+			return nil, err
+		}
+		hostname, _ := os.Hostname()
+		sender, err := notify.NewSyslogSender(network, addr, hostname, os.Getpid(), auditForwardTimeout)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, notify.NewAuditForwarder("syslog "+a.AuditSyslog, sender.Send, warn))
+	}
+	if a.AuditCEF != "" {
+		sender := notify.NewCEFSender(a.AuditCEF, auditForwardTimeout)
+		sinks = append(sinks, notify.NewAuditForwarder("CEF collector "+a.AuditCEF, sender.Send, warn))
+	}
+	if a.AuditWebhook != "" {
+		webhook := notify.NewWebhook(a.AuditWebhook, auditForwardTimeout)
+		send := func(event ca.AuditEvent) error {
+			return webhook.Post(event)
+		}
+		sinks = append(sinks, notify.NewAuditForwarder("webhook "+a.AuditWebhook, send, warn))
+	}
+	return sinks, nil
+}
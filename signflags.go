@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+)
+
+// SignFlags are the certificate options that are common across the sign
+// commands.
+type SignFlags struct {
+	Validity         time.Duration `arg:"-V" help:"how long the certificate should be valid for (e.g. 24h); the server default is used if unset"`
+	Store            string        `arg:"--store" placeholder:"STORE" help:"also push each certificate to a secrets store: vault:PATH, ssm:NAME or k8s:NAMESPACE/NAME, where {key_id} and {type} are replaced (e.g. vault:secret/ssh/{key_id})"`
+	IdentityTemplate string        `arg:"--identity-template" placeholder:"TEMPLATE" help:"Go template for the certificate identity, with the fields .Hostname, .FQDN, .Username, .Type, .KeyID, .KeyType, .Date and .Timestamp (e.g. {{.FQDN}}:{{.KeyType}}:{{.Date}}); defaults to identity_template from the config"`
+	PostSignHooks    []string      `arg:"--post-sign-hook,separate" placeholder:"COMMAND" help:"command to run after each certificate is issued, with its details in SSHCA_* environment variables and the certificate on stdin; can be repeated, and runs after the post_sign_hooks from the config"`
+	TOTPFlags
+	BreakGlass      string `arg:"--break-glass" placeholder:"REASON" help:"in an emergency, bypass the server's confirmation and checks with --break-glass-token, giving the reason (e.g. an incident number); the certificate is short-lived and the server alerts about it"`
+	BreakGlassToken string `arg:"--break-glass-token,env:SSHCA_BREAK_GLASS_TOKEN" placeholder:"TOKEN" help:"break-glass credential of the server (see server --break-glass-token)"`
+}
+
+// Validate the certificate options.
+func (f SignFlags) Validate() error {
+	if f.Validity < 0 {
+		return fmt.Errorf("--validity must not be negative")
+	}
+	if err := validateIdentityTemplate(f.IdentityTemplate); err != nil {
+		return fmt.Errorf("invalid --identity-template: %w", err)
+	}
+	if err := f.TOTPFlags.Validate(); err != nil {
+		return err
+	}
+	if (f.BreakGlass != "") != (f.BreakGlassToken != "") {
+		return fmt.Errorf("--break-glass and --break-glass-token must be used together")
+	}
+	if f.BreakGlass != "" {
+		if err := ca.ValidateBreakGlassReason(f.BreakGlass); err != nil {
+			return fmt.Errorf("invalid --break-glass: %w", err)
+		}
+	}
+	if f.Store != "" {
+		if _, err := parseCertificateStore(f.Store); err != nil {
+			return fmt.Errorf("invalid --store: %w", err)
+		}
+	}
+	return nil
+}
+
+// apply sets the certificate options, the TOTP code and the break-glass
+// credential on a signing request.
+func (f SignFlags) apply(args *ca.SignArgs) error {
+	args.Validity = f.Validity
+	args.BreakGlassReason = f.BreakGlass
+	args.BreakGlassToken = f.BreakGlassToken
+	var err error
+	args.TOTPClient = f.TOTPClient
+	args.TOTPCode, err = f.TOTPFlags.code()
+	return err
+}
+
+// TOTPFlags authenticate requests to servers that require TOTP codes.
+type TOTPFlags struct {
+	TOTPClient     string `arg:"--totp-client" placeholder:"NAME" help:"name of this client, for servers that require TOTP codes"`
+	TOTPCode       string `arg:"--totp-code,env:SSHCA_TOTP_CODE" placeholder:"CODE" help:"current TOTP code of --totp-client"`
+	TOTPSecretFile string `arg:"--totp-secret-file" placeholder:"PATH" help:"file with the base32 TOTP secret of --totp-client, to generate the codes without an authenticator app (e.g. for unattended clients)"`
+}
+
+// Validate checks that the client is given with a single source of codes.
+func (f TOTPFlags) Validate() error {
+	if (f.TOTPCode != "" || f.TOTPSecretFile != "") != (f.TOTPClient != "") {
+		return fmt.Errorf("--totp-client must be used with --totp-code or --totp-secret-file")
+	}
+	if f.TOTPCode != "" && f.TOTPSecretFile != "" {
+		return fmt.Errorf("--totp-code and --totp-secret-file can't be used together")
+	}
+	return nil
+}
+
+// code returns the TOTP code to send, generating it from --totp-secret-file
+// if it is set.
+func (f TOTPFlags) code() (string, error) {
+	if f.TOTPSecretFile == "" {
+		return f.TOTPCode, nil
+	}
+	secret, err := readTOTPSecret(f.TOTPSecretFile)
+	if err != nil {
+		return "", err
+	}
+	return ca.GenerateTOTP(secret, time.Now()), nil
+}
+
+// identityTemplate returns the template for the certificate identity, or the
+// empty string to use the default identity.
+func (f SignFlags) identityTemplate() string {
+	if f.IdentityTemplate != "" {
+		return f.IdentityTemplate
+	}
+	return config.IdentityTemplate
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Showmax/go-fqdn"
+	"github.com/hashicorp/go-multierror"
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/executor"
+	"github.com/ratorx/sshca/sshd"
+)
+
+// SignHostCmd represents the command that signs all the host keys for the
+// current host. It uses the hostname (short and long) as the default
+// principals.
+type SignHostCmd struct {
+	RPCFlags
+	SignFlags
+	CertFileFlags
+	CASignatureFlags
+	SSHDConfigPath string             `help:"path to the sshd_config (default: from the host config, or /etc/ssh/sshd_config)"`
+	HostConfigPath string             `arg:"--host-config" placeholder:"PATH" help:"per-host config with extra principals, validity and the sshd_config path (default: /etc/sshca/host.yaml, if it exists)"`
+	SSHDPath       string             `arg:"--sshd" default:"sshd" placeholder:"PATH" help:"path to sshd"`
+	Principals     CommaSeparatedList `arg:"-n" help:"extra principals for the host keys (comma-separated)"`
+	OverrideToken  string             `arg:"--override-token,env:SSHCA_OVERRIDE_TOKEN" placeholder:"TOKEN" help:"token to skip the server's check that the principals resolve to this host"`
+	NoProof        bool               `arg:"--no-proof" help:"don't prove possession of the host private keys to the server"`
+	ReloadCommand  string             `arg:"--reload-command" placeholder:"COMMAND" help:"command that reloads sshd after the certificates are installed, e.g. 'systemctl reload sshd' (default: from the host config)"`
+	SelfTest       bool               `arg:"--self-test" help:"check with ssh-keyscan that sshd presents the new certificates afterwards"`
+	SelfTestHost   string             `arg:"--self-test-host" default:"localhost" placeholder:"HOST" help:"host to connect to for --self-test (the port is the first Port in sshd_config)"`
+	SSHKeyscanPath string             `arg:"--ssh-keyscan" default:"ssh-keyscan" placeholder:"PATH" help:"path to ssh-keyscan, for --self-test"`
+	KeyTypes       CommaSeparatedList `arg:"--key-types" placeholder:"TYPES" help:"only sign host keys of these types (comma-separated rsa, ecdsa, ed25519, dsa, sk-ecdsa or sk-ed25519; default: from the host config, or all)"`
+}
+
+// findPublicKeys returns the public keys of the HostKey entries in the
+// effective sshd config.
+func findPublicKeys(sshdConfig *sshd.EffectiveConfig) []string {
+	privateKeys := sshdConfig.Lookup("HostKey")
+	publicKeys := make([]string, 0, len(privateKeys))
+	for _, privateKey := range privateKeys {
+		publicKeys = append(publicKeys, privateKey+".pub")
+	}
+
+	return publicKeys
+}
+
+// removeStaleCertificates queues the removal of the HostCertificate entries
+// that don't belong to any of the current host keys (e.g. because a key was
+// removed or renamed), which would make sshd warn or fail to start.
+func removeStaleCertificates(sshdModifier *sshd.Modifier, sshdConfig *sshd.EffectiveConfig, publicKeyPaths []string) {
+	current := make(map[string]bool, len(publicKeyPaths))
+	for _, keyPath := range publicKeyPaths {
+		current[getCertificatePath(keyPath)] = true
+	}
+	for _, certificate := range sshdConfig.Lookup("HostCertificate") {
+		if !current[certificate] {
+			sshdModifier.Remove("HostCertificate", certificate)
+		}
+	}
+}
+
+func (s SignHostCmd) getPrincipals() ([]string, error) {
+	hostname, err := fqdn.FqdnHostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname: %w", err)
+	}
+
+	// Use a map to put unique principals into the final slice
+	principals := make(map[string]bool, 2+len(s.Principals.Items))
+	principals[hostname] = true
+	principals[strings.Split(hostname, ".")[0]] = true
+	for _, principal := range s.Principals.Items {
+		principals[principal] = true
+	}
+	principalsSlice := make([]string, 0, len(principals))
+	for principal := range principals {
+		principalsSlice = append(principalsSlice, principal)
+	}
+
+	return principalsSlice, nil
+}
+
+// Validate implementation for Command
+func (s SignHostCmd) Validate() error {
+	if err := validatePrincipals(s.Principals.Items); err != nil {
+		return err
+	}
+	if err := validateHostKeyTypes(s.KeyTypes.Items); err != nil {
+		return fmt.Errorf("invalid --key-types: %w", err)
+	}
+	if s.OutputFormat != "" && s.OutputFormat != ca.OpenSSHFormat {
+		return fmt.Errorf("--output-format must be %s for host certificates, since sshd can't read other formats", ca.OpenSSHFormat)
+	}
+	if err := s.SignFlags.Validate(); err != nil {
+		return err
+	}
+	if err := s.CASignatureFlags.Validate(); err != nil {
+		return err
+	}
+	return s.RPCFlags.Validate()
+}
+
+// withHostConfig fills in the options that weren't set on the command line
+// from the host config. Principals from both are used.
+func (s SignHostCmd) withHostConfig() (SignHostCmd, error) {
+	cfg, err := loadHostConfig(s.HostConfigPath)
+	if err != nil {
+		return s, err
+	}
+	s.Principals.Items = append(append([]string{}, s.Principals.Items...), cfg.Principals...)
+	if s.Validity == 0 {
+		s.Validity = time.Duration(cfg.Validity)
+	}
+	if s.SSHDConfigPath == "" {
+		s.SSHDConfigPath = cfg.SSHDConfig
+	}
+	if s.SSHDConfigPath == "" {
+		s.SSHDConfigPath = defaultSSHDConfigPath
+	}
+	if s.ReloadCommand == "" {
+		s.ReloadCommand = cfg.ReloadCommand
+	}
+	if len(s.KeyTypes.Items) == 0 {
+		s.KeyTypes.Items = cfg.KeyTypes
+	}
+	if s.IdentityTemplate == "" {
+		s.IdentityTemplate = cfg.IdentityTemplate
+	}
+	return s, nil
+}
+
+// Run implementation for Command
+func (s SignHostCmd) Run() error {
+	pool := ca.NewPool(s.RPCFlags.MakeClient)
+	defer pool.Close()
+	return s.run(pool)
+}
+
+// run signs the host keys with a client from pool, which the k8s agent keeps
+// between runs.
+func (s SignHostCmd) run(pool *ca.Pool) error {
+	s, err := s.withHostConfig()
+	if err != nil {
+		return err
+	}
+	useSSHD(s.SSHDPath)
+
+	principals, err := s.getPrincipals()
+	if err != nil {
+		return fmt.Errorf("failed to get principals: %w", err)
+	}
+
+	sshdConfig, err := sshd.LoadEffectiveConfig(s.SSHDConfigPath)
+	if err != nil {
+		return fmt.Errorf("failed to find host keys: %w", err)
+	}
+	publicKeyPaths := findPublicKeys(sshdConfig)
+	out.progress("found %v host keys", len(publicKeyPaths))
+	for _, publicKeyPath := range publicKeyPaths {
+		out.detail("  %s", publicKeyPath)
+	}
+	toSign := s.selectKeys(publicKeyPaths)
+	return pool.Do(func(client *ca.Client) error {
+		return s.sign(client, sshdConfig, principals, publicKeyPaths, toSign)
+	})
+}
+
+// selectKeys returns the host keys at publicKeyPaths that are of the types
+// in --key-types. Keys whose type can't be read are kept, so that signing
+// reports the problem.
+func (s SignHostCmd) selectKeys(publicKeyPaths []string) []string {
+	if len(s.KeyTypes.Items) == 0 {
+		return publicKeyPaths
+	}
+	wanted := make(map[string]bool, len(s.KeyTypes.Items))
+	for _, keyType := range s.KeyTypes.Items {
+		wanted[keyType] = true
+	}
+	selected := make([]string, 0, len(publicKeyPaths))
+	for _, keyPath := range publicKeyPaths {
+		keyType, err := hostKeyType(keyPath, s.SSHKeygenPath)
+		if err == nil && !wanted[keyType] {
+			out.progress("skipping %s key %s", keyType, keyPath)
+			continue
+		}
+		selected = append(selected, keyPath)
+	}
+	return selected
+}
+
+// sign signs the host keys at toSign, which are some of the host keys in
+// sshd_config (publicKeyPaths), configures sshd to use the certificates and
+// reloads it. s must already have the settings of the host config.
+func (s SignHostCmd) sign(client *ca.Client, sshdConfig *sshd.EffectiveConfig, principals []string, publicKeyPaths []string, toSign []string) error {
+	req := certRequest{
+		principals:    principals,
+		certType:      ca.HostCertificate,
+		flags:         s.SignFlags,
+		overrideToken: s.OverrideToken,
+		// The in-process server has the same access to the keys
+		prove: !s.NoProof && !s.RPCFlags.Local,
+	}
+	sshdModifier := sshd.Modifier{ConfigPath: s.SSHDConfigPath}
+	removeStaleCertificates(&sshdModifier, sshdConfig, publicKeyPaths)
+
+	// Each step is reported on its own, so that a failure in one doesn't hide
+	// the outcome of the others
+	var result error
+	var signed []string
+	// The CA signs user certificates with the same algorithm
+	var algorithms []string
+	checkKeys := !usesHostKeyAgent(sshdConfig)
+	for _, keyPath := range toSign {
+		if checkKeys {
+			derived, err := ensurePublicKey(keyPath, s.SSHKeygenPath)
+			if derived {
+				out.progress("wrote missing public key %s from the private key", keyPath)
+			}
+			if err == nil {
+				err = checkPrivateKey(keyPath, s.SSHKeygenPath)
+			}
+			if err != nil {
+				err = fmt.Errorf("not signing %s: %w", keyPath, err)
+				out.error(err)
+				result = multierror.Append(result, err)
+				continue
+			}
+		}
+		certificate, certPath, certErr := generateCertificate(client, keyPath, req, s.CertFileFlags.options(fileOwner{}), !s.RPCFlags.Local)
+		if certErr != nil {
+			certErr = fmt.Errorf("failed to sign %s: %w", keyPath, certErr)
+			out.error(certErr)
+			result = multierror.Append(result, certErr)
+			continue
+		}
+		signed = append(signed, keyPath)
+		if algorithm, err := certificate.CertSignatureAlgorithm(); err == nil {
+			algorithms = append(algorithms, algorithm)
+		}
+		sshdModifier.Set("HostCertificate", certPath)
+		if err := s.afterSign(signedCertificate{"sign_host", certificate, keyPath, certPath}); err != nil {
+			err = fmt.Errorf("%s: %w", keyPath, err)
+			out.error(err)
+			result = multierror.Append(result, err)
+		}
+	}
+	out.success("signed %d of %d host keys", len(signed), len(toSign))
+	loadConfig := func() (*sshd.EffectiveConfig, error) { return sshdConfig, nil }
+	if err := s.CASignatureFlags.apply(&sshdModifier, s.SSHDPath, loadConfig, algorithms); err != nil {
+		out.error(err)
+		result = multierror.Append(result, err)
+	}
+
+	for _, change := range sshdModifier.Pending() {
+		out.progress("%s in %s", change, s.SSHDConfigPath)
+	}
+	if err := sshdModifier.Commit(); err != nil {
+		err = fmt.Errorf("failed to update %s, so sshd won't use the new certificates: %w", s.SSHDConfigPath, err)
+		out.error(err)
+		return multierror.Append(result, err)
+	}
+
+	if len(signed) == 0 {
+		return result
+	}
+	if err := s.reloadSSHD(); err != nil {
+		out.error(err)
+		return multierror.Append(result, err)
+	}
+	if s.SelfTest {
+		if err := s.selfTest(client, sshdConfig, signed); err != nil {
+			out.error(err)
+			result = multierror.Append(result, err)
+		}
+	}
+	return result
+}
+
+// reloadSSHD runs the reload command, so that sshd uses the new certificates.
+func (s SignHostCmd) reloadSSHD() error {
+	command := strings.Fields(s.ReloadCommand)
+	if len(command) == 0 {
+		out.progress("reload sshd to use the new certificates (or pass --reload-command)")
+		return nil
+	}
+	cmd := executor.Command{Path: command[0], Args: command[1:], Stdout: os.Stdout, Stderr: os.Stderr}
+	if err := executor.OrDefault(nil).Run(cmd); err != nil {
+		return fmt.Errorf("certificates installed, but failed to reload sshd with %q: %w", s.ReloadCommand, err)
+	}
+	out.success("reloaded sshd with %q", s.ReloadCommand)
+	return nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ratorx/sshca/ca"
+)
+
+// SignUserCmd is the command to generate a SSH user certficate for the provided
+// public key.
+type SignUserCmd struct {
+	RPCFlags
+	SignFlags
+	CertFileFlags
+	Principals    CommaSeparatedList `arg:"-n" help:"principals to authorise the key for (comma-separated); defaults to the principals of --profile, or the username (and username@principal_domain from the config)"`
+	Profile       string             `arg:"--profile" placeholder:"NAME" help:"use the principals, validity and options of a profile from the config (flags take precedence)"`
+	Options       []string           `arg:"-O,--option,separate" placeholder:"OPTION" help:"restrict the certificate like ssh-keygen -O (e.g. clear, permit-pty, force-command=CMD or source-address=CIDRS); can be repeated"`
+	PublicKeyPath string             `arg:"positional" help:"path to the SSH public key (bare filenames are also looked up in ~/.ssh); if omitted, choose from the id_*.pub keys in ~/.ssh; - reads the key from stdin and writes the certificate to stdout"`
+	All           bool               `arg:"-a" help:"sign all the id_*.pub keys in ~/.ssh"`
+	AddToAgent    bool               `arg:"--add-to-agent" help:"add the key and certificate to ssh-agent (reads the private key)"`
+	NoWrite       bool               `arg:"--no-write" help:"don't write the certificate to disk (requires --add-to-agent)"`
+	Async         bool               `help:"submit the request and print its ID instead of waiting for the certificate (requires --remote)"`
+	Prove         bool               `help:"prove possession of the private key to the server (signs a challenge with ssh-agent, or reads the private key)"`
+	AsUser        string             `arg:"--as-user" placeholder:"USER" help:"user the certificate is for, which determines the identity, ~/.ssh and certificate owner (default: the invoking user under sudo, otherwise the current user)"`
+	GitHubUser    string             `arg:"--github-user" placeholder:"USERNAME" help:"GitHub account to add as the login@github.com extension, for organisations that trust the CA"`
+	GitLabUser    string             `arg:"--gitlab-user" placeholder:"USERNAME" help:"GitLab username to use as the certificate identity, for groups that trust the CA"`
+	SSHConfig     string             `arg:"--ssh-config" placeholder:"PATH" help:"write an ssh_config snippet (IdentityFile, CertificateFile, ProxyJump and CASignatureAlgorithms) for the hosts in the ssh_config section of the config, to include from ~/.ssh/config; relative paths are in ~/.ssh, and - prints it"`
+	// The private key of a smartcard never leaves it, so the public key is
+	// read from the card
+	PIV            bool   `arg:"--piv" help:"sign the key of a PIV smartcard (e.g. a YubiKey), read with ssh-keygen -D; the public key path is then the saved output of ssh-keygen -D, if the reader isn't on this machine"`
+	PKCS11Provider string `arg:"--pkcs11-provider" placeholder:"PATH" help:"PKCS#11 module for --piv (default: the OpenSC module)"`
+}
+
+// Validate implementation for Command
+func (s SignUserCmd) Validate() error {
+	if err := validatePrincipals(s.Principals.Items); err != nil {
+		return err
+	}
+	if s.GitLabUser != "" {
+		if err := ca.ValidateIdentity(s.GitLabUser); err != nil {
+			return fmt.Errorf("invalid --gitlab-user: %w", err)
+		}
+	}
+	if s.All && s.PublicKeyPath != "" {
+		return fmt.Errorf("--all cannot be used with a public key path")
+	}
+	if s.NoWrite && !s.AddToAgent {
+		return fmt.Errorf("--no-write requires --add-to-agent")
+	}
+	if s.AddToAgent && (s.Async || s.PublicKeyPath == stdinPath) {
+		return fmt.Errorf("--add-to-agent needs the private key, so it can't be used with --async or a key from stdin")
+	}
+	if s.PublicKeyPath == stdinPath && (s.Async || s.RPCFlags.Local) {
+		// Local signing shares stdout with ssh-keygen, which would corrupt the
+		// certificate output
+		return fmt.Errorf("reading the key from stdin requires --remote without --async")
+	}
+	if s.Async && s.RPCFlags.Local {
+		return fmt.Errorf("--async cannot be used with --local")
+	}
+	if s.Prove && s.RPCFlags.Local {
+		return fmt.Errorf("--prove cannot be used with --local")
+	}
+	if s.PIV && (s.All || s.Async || s.Prove || s.NoWrite || s.PublicKeyPath == stdinPath) {
+		return fmt.Errorf("--piv cannot be used with --all, --async, --prove, --no-write or a key from stdin")
+	}
+	if s.SSHConfig != "" && (s.PIV || s.Async || s.NoWrite || s.PublicKeyPath == stdinPath) {
+		return fmt.Errorf("--ssh-config needs the certificates on disk, so it can't be used with --piv, --async, --no-write or a key from stdin")
+	}
+	if s.SSHConfig != "" && s.OutputFormat != ca.OpenSSHFormat {
+		return fmt.Errorf("--ssh-config needs certificates in the openssh --output-format, which ssh can read")
+	}
+	if s.PKCS11Provider != "" && !s.PIV {
+		return fmt.Errorf("--pkcs11-provider requires --piv")
+	}
+	if s.GitHubUser != "" {
+		if _, err := ca.GitHubLoginOption(s.GitHubUser); err != nil {
+			return err
+		}
+	}
+	if err := s.SignFlags.Validate(); err != nil {
+		return err
+	}
+	return s.RPCFlags.Validate()
+}
+
+// stdinPath is the public key path that reads the key from stdin.
+const stdinPath = "-"
+
+// Run implementation for Command
+func (s SignUserCmd) Run() error {
+	s, err := s.withProfile()
+	if err != nil {
+		return err
+	}
+	u, err := targetUser(s.AsUser)
+	if err != nil {
+		return err
+	}
+	if s.PublicKeyPath == stdinPath {
+		// The certificate is printed to stdout
+		useStderrForMessages()
+	}
+	if len(s.Principals.Items) == 0 {
+		s.Principals.Items = defaultPrincipals(u)
+		out.progress("no principals given, requesting %s", strings.Join(s.Principals.Items, ","))
+	}
+	warnMissingAccounts(s.Principals.Items)
+
+	if s.PublicKeyPath == stdinPath {
+		return s.signStdin(u)
+	}
+	if s.PIV {
+		return s.signPIV(u)
+	}
+
+	publicKeyPaths, err := s.publicKeyPaths(u)
+	if err != nil {
+		return err
+	}
+
+	// A connection that breaks while signing several keys is replaced for the
+	// rest of them
+	pool := ca.NewPool(s.RPCFlags.MakeClient)
+	defer pool.Close()
+	if _, err := pool.Get(); err != nil {
+		return err
+	}
+
+	var signed []string
+	for _, publicKeyPath := range publicKeyPaths {
+		signErr := pool.Do(func(client *ca.Client) error {
+			if s.Async {
+				return s.submit(client, publicKeyPath, u)
+			}
+			return s.sign(client, publicKeyPath, u)
+		})
+		if signErr != nil {
+			if len(publicKeyPaths) == 1 {
+				return signErr
+			}
+			out.error(signErr)
+			err = multierror.Append(err, signErr)
+			continue
+		}
+		signed = append(signed, publicKeyPath)
+	}
+
+	if s.SSHConfig != "" && len(signed) > 0 {
+		if configErr := s.writeSSHConfig(signed, u); configErr != nil {
+			err = multierror.Append(err, configErr)
+		}
+	}
+	return err
+}
+
+// withProfile fills in the options that weren't set on the command line from
+// the profile in the config, if one was selected.
+func (s SignUserCmd) withProfile() (SignUserCmd, error) {
+	if s.Profile == "" {
+		return s, nil
+	}
+	profile, ok := config.Profiles[s.Profile]
+	if !ok {
+		return s, fmt.Errorf("unknown profile %q", s.Profile)
+	}
+
+	if len(s.Principals.Items) == 0 {
+		s.Principals.Items = profile.Principals
+	}
+	if s.Validity == 0 {
+		s.Validity = time.Duration(profile.Validity)
+	}
+	if len(s.Options) == 0 {
+		options, err := profile.options()
+		if err != nil {
+			return s, fmt.Errorf("invalid profile %q: %w", s.Profile, err)
+		}
+		s.Options = options
+	}
+	return s, nil
+}
+
+// defaultPrincipals returns the principals requested for u if there are none
+// from the flags or profile: the username, and username@domain if the config
+// sets principal_domain.
+func defaultPrincipals(u *user.User) []string {
+	username := usernameOf(u)
+	principals := []string{username}
+	if config.PrincipalDomain != "" {
+		principals = append(principals, username+"@"+config.PrincipalDomain)
+	}
+	return principals
+}
+
+// certRequest returns the certificate to request for u.
+func (s SignUserCmd) certRequest(u *user.User) certRequest {
+	options := s.Options
+	if s.GitHubUser != "" {
+		// Validate already checked the username
+		login, _ := ca.GitHubLoginOption(s.GitHubUser)
+		options = append(append([]string{}, options...), login)
+	}
+	return certRequest{principals: s.Principals.Items, certType: ca.UserCertificate, flags: s.SignFlags, options: options, username: usernameOf(u), identity: s.GitLabUser, prove: s.Prove}
+}
+
+// sign requests a certificate for the public key at publicKeyPath, and writes
+// it next to the key and/or adds it to ssh-agent.
+func (s SignUserCmd) sign(client *ca.Client, publicKeyPath string, u *user.User) error {
+	options := s.CertFileFlags.options(ownerOf(u))
+	req := s.certRequest(u)
+	if !s.AddToAgent {
+		certificate, certPath, err := generateCertificate(client, publicKeyPath, req, options, !s.RPCFlags.Local)
+		if err != nil {
+			return err
+		}
+		return s.afterSign(signedCertificate{"sign_user", certificate, publicKeyPath, certPath})
+	}
+
+	args, err := newSignArgs(publicKeyPath, req)
+	if err != nil {
+		return err
+	}
+	if req.prove {
+		if err := addProof(client, &args, privateKeyPath(publicKeyPath)); err != nil {
+			return err
+		}
+	}
+	if !s.RPCFlags.Local {
+		out.progress("%s", args)
+	}
+
+	certificate, err := signPublicKey(client, args)
+	if err != nil {
+		return err
+	}
+
+	certPath := ""
+	if !s.NoWrite {
+		if certPath, err = writeCertificate(certificate, publicKeyPath, options); err != nil {
+			return err
+		}
+	}
+	if err := addToAgent(publicKeyPath, certificate); err != nil {
+		return err
+	}
+	return s.afterSign(signedCertificate{"sign_user", certificate, publicKeyPath, certPath})
+}
+
+// signStdin signs the public key on stdin and prints the certificate to
+// stdout. Everything else must be printed to stderr, so the output can be
+// piped.
+func (s SignUserCmd) signStdin(u *user.User) error {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read public key from stdin: %w", err)
+	}
+	publicKey, err := ca.ParsePublicKey(data)
+	if err != nil {
+		return fmt.Errorf("failed to read public key from stdin: %w", err)
+	}
+
+	client, err := s.RPCFlags.MakeClient()
+	if err != nil {
+		return err
+	}
+
+	args, err := newSignArgsForKey(publicKey, keyIDFromType(publicKey), s.certRequest(u))
+	if err != nil {
+		return err
+	}
+	if s.Prove {
+		// There is no private key file for a key from stdin
+		if err := addProof(client, &args, ""); err != nil {
+			return err
+		}
+	}
+	out.progress("%s", args)
+
+	certificate, err := signPublicKey(client, args)
+	if err != nil {
+		return err
+	}
+	fmt.Print(certificate)
+	return s.afterSign(signedCertificate{command: "sign_user", certificate: certificate})
+}
+
+// publicKeyPaths returns the keys to sign. Without an explicit path, the
+// default keys of u are discovered and either all used (--all) or chosen from.
+func (s SignUserCmd) publicKeyPaths(u *user.User) ([]string, error) {
+	if s.PublicKeyPath != "" {
+		publicKeyPath, err := resolvePublicKeyPath(s.PublicKeyPath, u)
+		if err != nil {
+			return nil, err
+		}
+		return []string{publicKeyPath}, nil
+	}
+
+	keys, err := discoverUserKeys(u)
+	if err != nil {
+		return nil, err
+	}
+	if s.All || len(keys) == 1 {
+		return keys, nil
+	}
+
+	key, err := chooseKey(keys, os.Stdin, os.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	return []string{key}, nil
+}
+
+// submit queues the signing request on the server and prints the ID needed to
+// fetch the certificate later.
+func (s SignUserCmd) submit(client *ca.Client, publicKeyPath string, u *user.User) error {
+	args, err := newSignArgs(publicKeyPath, s.certRequest(u))
+	if err != nil {
+		return err
+	}
+	if s.Prove {
+		if err := addProof(client, &args, privateKeyPath(publicKeyPath)); err != nil {
+			return err
+		}
+	}
+	out.progress("%s", args)
+
+	reply, err := client.SubmitSignRequest(args)
+	if err != nil {
+		return fmt.Errorf("failed to submit signing request: %w", err)
+	}
+
+	out.success("submitted request %s", reply.RequestID)
+	// The request only exists on the server that accepted it
+	out.progress("run 'sshca fetch -r %s %s %s' to fetch the certificate", client.Addr, reply.RequestID, publicKeyPath)
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ratorx/sshca/ca"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// SignUsersCmd is the command that signs many user keys at once, e.g. to
+// migrate a fleet that logs in with authorized_keys to certificates.
+type SignUsersCmd struct {
+	RPCFlags
+	SignFlags
+	CertFileFlags
+	FromFile     string   `arg:"--from-file" placeholder:"PATH" help:"authorized_keys file with the keys to sign, one per line"`
+	FromDir      string   `arg:"--from-dir" placeholder:"DIR" help:"directory with the keys to sign, in .pub files"`
+	PrincipalMap string   `arg:"--principal-map" placeholder:"PATH" help:"YAML file mapping key comments or fingerprints to principals (default: the part of the comment before @, e.g. alice for alice@laptop)"`
+	OutputDir    string   `arg:"--output-dir,required" placeholder:"DIR" help:"directory to write each key and its certificate to (NAME.pub and NAME-cert.pub)"`
+	Options      []string `arg:"-O,--option,separate" placeholder:"OPTION" help:"restrict the certificates like ssh-keygen -O (e.g. clear, permit-pty, force-command=CMD or source-address=CIDRS); can be repeated"`
+}
+
+// principalMapFile is the format of the file passed to --principal-map.
+type principalMapFile struct {
+	// Keys maps key comments and fingerprints (SHA256:...) to principals.
+	// Fingerprints take precedence, and an empty list skips the key.
+	Keys map[string][]string `yaml:"keys"`
+}
+
+// bulkKey is a key to sign with sign_users.
+type bulkKey struct {
+	publicKey *ca.PublicKey
+	comment   string
+	// source is where the key came from, for messages.
+	source string
+	// name is the file name of the key in the output directory, without .pub.
+	name string
+}
+
+// Validate implementation for Command
+func (s SignUsersCmd) Validate() error {
+	if (s.FromFile == "") == (s.FromDir == "") {
+		return fmt.Errorf("exactly one of --from-file and --from-dir is required")
+	}
+	if s.OutputFormat != ca.OpenSSHFormat {
+		// The certificates are written next to the keys, for ssh to find
+		return fmt.Errorf("sign_users only writes certificates in the openssh --output-format")
+	}
+	if err := s.SignFlags.Validate(); err != nil {
+		return err
+	}
+	return s.RPCFlags.Validate()
+}
+
+// Run implementation for Command
+func (s SignUsersCmd) Run() error {
+	var principalMap map[string][]string
+	if s.PrincipalMap != "" {
+		var err error
+		if principalMap, err = loadPrincipalMap(s.PrincipalMap); err != nil {
+			return err
+		}
+	}
+	keys, err := s.readKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys to sign")
+	}
+	if err := os.MkdirAll(s.OutputDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", s.OutputDir, err)
+	}
+
+	pool := ca.NewPool(s.RPCFlags.MakeClient)
+	defer pool.Close()
+	if _, err := pool.Get(); err != nil {
+		return err
+	}
+
+	var result error
+	signed := 0
+	// authorized_keys files often have the same key more than once
+	seen := map[string]string{}
+	for _, key := range keys {
+		if first, ok := seen[key.publicKey.Fingerprint()]; ok {
+			out.progress("skipping %s: the same key as %s", key.source, first)
+			continue
+		}
+		seen[key.publicKey.Fingerprint()] = key.source
+		principals, err := key.principals(principalMap)
+		if err == nil && len(principals) == 0 {
+			out.progress("skipping %s: the principal map has no principals for it", key.source)
+			continue
+		}
+		if err == nil {
+			err = pool.Do(func(client *ca.Client) error {
+				return s.sign(client, key, principals)
+			})
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %w", key.source, err)
+			out.error(err)
+			result = multierror.Append(result, err)
+			continue
+		}
+		signed++
+	}
+	out.success("signed %d of %d keys into %s", signed, len(keys), s.OutputDir)
+	return result
+}
+
+// sign signs key for principals, and writes it and its certificate to the
+// output directory.
+func (s SignUsersCmd) sign(client *ca.Client, key bulkKey, principals []string) error {
+	publicKeyPath := filepath.Join(s.OutputDir, key.name+".pub")
+	req := certRequest{principals: principals, certType: ca.UserCertificate, flags: s.SignFlags, options: s.Options, username: principals[0]}
+	args, err := newSignArgsForKey(key.publicKey, key.name, req)
+	if err != nil {
+		return err
+	}
+	if !s.RPCFlags.Local {
+		out.progress("%s", args)
+	}
+	certificate, err := signPublicKey(client, args)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFile(publicKeyPath, key.publicKey.Data, fileOptions{mode: 0o644, owner: s.CertOwner}); err != nil {
+		return err
+	}
+	certPath, err := writeCertificate(certificate, publicKeyPath, s.CertFileFlags.options(fileOwner{}))
+	if err != nil {
+		return err
+	}
+	return s.afterSign(signedCertificate{"sign_users", certificate, publicKeyPath, certPath})
+}
+
+// principals returns the principals to sign the key for: from the principal
+// map if it has the key, otherwise the user of the comment.
+func (k bulkKey) principals(principalMap map[string][]string) ([]string, error) {
+	if principals, ok := principalMap[k.publicKey.Fingerprint()]; ok {
+		return principals, nil
+	}
+	if principals, ok := principalMap[k.comment]; ok && k.comment != "" {
+		return principals, nil
+	}
+	user := strings.SplitN(k.comment, "@", 2)[0]
+	if user == "" {
+		return nil, fmt.Errorf("no principals: the key has no comment and isn't in the principal map")
+	}
+	if err := ca.ValidatePrincipal(user); err != nil {
+		return nil, fmt.Errorf("no principals: %q from the comment is not a valid principal (%s), and the key isn't in the principal map", user, err)
+	}
+	return []string{user}, nil
+}
+
+// loadPrincipalMap reads the principal map at path.
+func loadPrincipalMap(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read principal map at %s: %w", path, err)
+	}
+	var file principalMapFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse principal map at %s: %w", path, err)
+	}
+	for key, principals := range file.Keys {
+		if err := validatePrincipals(principals); err != nil {
+			return nil, fmt.Errorf("invalid principals for %s in %s: %w", key, path, err)
+		}
+	}
+	return file.Keys, nil
+}
+
+// readKeys reads the keys from --from-file or --from-dir.
+func (s SignUsersCmd) readKeys() ([]bulkKey, error) {
+	names := map[string]bool{}
+	if s.FromFile != "" {
+		data, err := ioutil.ReadFile(s.FromFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keys: %w", err)
+		}
+		return parseBulkKeys(data, s.FromFile, "", names), nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(s.FromDir, "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []bulkKey
+	for _, path := range paths {
+		if strings.HasSuffix(path, "-cert.pub") {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keys: %w", err)
+		}
+		keys = append(keys, parseBulkKeys(data, path, strings.TrimSuffix(filepath.Base(path), ".pub"), names)...)
+	}
+	return keys, nil
+}
+
+// parseBulkKeys parses the keys in authorized_keys format from source. Keys
+// are named after name if it is set, otherwise their comment, and the names
+// already taken in names get a numeric suffix. Lines that aren't plain keys
+// (e.g. cert-authority lines) are skipped with a warning.
+func parseBulkKeys(data []byte, source string, name string, names map[string]bool) []bulkKey {
+	var keys []bulkKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		where := fmt.Sprintf("%s:%d", source, lineNumber)
+		key, comment, options, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			out.warning(fmt.Sprintf("skipping %s: %s", where, err))
+			continue
+		}
+		if containsString(options, "cert-authority") {
+			out.warning(fmt.Sprintf("skipping %s: it trusts a CA rather than a user key", where))
+			continue
+		}
+		// The options of authorized_keys only apply to the key itself, so
+		// they are dropped
+		publicKey, err := ca.ParsePublicKey([]byte(strings.TrimSpace(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))+" "+comment) + "\n"))
+		if err != nil {
+			out.warning(fmt.Sprintf("skipping %s: %s", where, err))
+			continue
+		}
+		keyName := name
+		if keyName == "" {
+			keyName = bulkKeyName(comment, lineNumber)
+		}
+		keyName = uniqueName(keyName, names)
+		keys = append(keys, bulkKey{publicKey: publicKey, comment: comment, source: where, name: keyName})
+	}
+	return keys
+}
+
+// bulkKeyName returns a file name for a key from its comment, or its line
+// number if the comment has nothing usable.
+func bulkKeyName(comment string, lineNumber int) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' || r == '@' {
+			return r
+		}
+		return '_'
+	}, comment)
+	name = strings.Trim(name, "._")
+	if name == "" {
+		return fmt.Sprintf("key%d", lineNumber)
+	}
+	return name
+}
+
+// uniqueName returns name, or name with a numeric suffix if it is already
+// taken in names, and marks it as taken.
+func uniqueName(name string, names map[string]bool) string {
+	unique := name
+	for i := 2; names[unique]; i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	names[unique] = true
+	return unique
+}
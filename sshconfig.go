@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// sshConfigTopology describes the hosts of the organisation, which sign_user
+// --ssh-config writes an ssh_config snippet for, so that the signed keys work
+// without editing ~/.ssh/config by hand.
+type sshConfigTopology struct {
+	// CASignatureAlgorithms are the algorithms that ssh accepts for the CA
+	// signatures of host certificates (ssh_config CASignatureAlgorithms).
+	// Empty leaves the ssh default.
+	CASignatureAlgorithms []string `yaml:"ca_signature_algorithms"`
+	// Hosts are written in order, so more specific patterns should come first.
+	Hosts []sshConfigHost `yaml:"hosts"`
+}
+
+// sshConfigHost is a Host block of the snippet.
+type sshConfigHost struct {
+	// Host is the ssh_config Host pattern (e.g. *.internal.example.com).
+	Host string `yaml:"host"`
+	// ProxyJump is the bastion that the hosts are reached through, if any.
+	ProxyJump string `yaml:"proxy_jump"`
+	// User is the login user, if it isn't the local username.
+	User string `yaml:"user"`
+}
+
+// validate checks that the topology can be written as ssh_config.
+func (t sshConfigTopology) validate() error {
+	for i, host := range t.Hosts {
+		if host.Host == "" {
+			return fmt.Errorf("host %d has no host pattern", i+1)
+		}
+		for _, value := range []string{host.Host, host.ProxyJump, host.User} {
+			if strings.ContainsAny(value, "\"\n") {
+				return fmt.Errorf("host %s: invalid value %q", host.Host, value)
+			}
+		}
+	}
+	for _, algorithm := range t.CASignatureAlgorithms {
+		if algorithm == "" || strings.ContainsAny(algorithm, ", \t\n") {
+			return fmt.Errorf("invalid CA signature algorithm %q", algorithm)
+		}
+	}
+	return nil
+}
+
+// quoteSSHConfig quotes an ssh_config argument that contains spaces.
+func quoteSSHConfig(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// snippet returns the ssh_config snippet that uses the keys at
+// publicKeyPaths, with their certificates, for each host.
+func (t sshConfigTopology) snippet(publicKeyPaths []string) string {
+	var b strings.Builder
+	b.WriteString("# Written by sshca sign_user --ssh-config; changes are overwritten.\n")
+	for _, host := range t.Hosts {
+		fmt.Fprintf(&b, "\nHost %s\n", host.Host)
+		if host.User != "" {
+			fmt.Fprintf(&b, "    User %s\n", quoteSSHConfig(host.User))
+		}
+		if host.ProxyJump != "" {
+			fmt.Fprintf(&b, "    ProxyJump %s\n", quoteSSHConfig(host.ProxyJump))
+		}
+		for _, publicKeyPath := range publicKeyPaths {
+			fmt.Fprintf(&b, "    IdentityFile %s\n", quoteSSHConfig(privateKeyPath(publicKeyPath)))
+			fmt.Fprintf(&b, "    CertificateFile %s\n", quoteSSHConfig(getCertificatePath(publicKeyPath)))
+		}
+		if len(t.CASignatureAlgorithms) > 0 {
+			fmt.Fprintf(&b, "    CASignatureAlgorithms %s\n", strings.Join(t.CASignatureAlgorithms, ","))
+		}
+	}
+	return b.String()
+}
+
+// writeSSHConfig writes the ssh_config snippet for the signed keys to
+// s.SSHConfig, or prints it for -. Relative paths are in the ~/.ssh of u,
+// next to the config that includes them.
+func (s SignUserCmd) writeSSHConfig(publicKeyPaths []string, u *user.User) error {
+	if len(config.SSHConfig.Hosts) == 0 {
+		return fmt.Errorf("--ssh-config needs hosts in the ssh_config section of the config")
+	}
+	for i, publicKeyPath := range publicKeyPaths {
+		// The paths must not depend on the directory that ssh is run in
+		if absolute, err := filepath.Abs(publicKeyPath); err == nil {
+			publicKeyPaths[i] = absolute
+		}
+	}
+	snippet := config.SSHConfig.snippet(publicKeyPaths)
+	if s.SSHConfig == "-" {
+		fmt.Print(snippet)
+		return nil
+	}
+
+	path := s.SSHConfig
+	if !filepath.IsAbs(path) {
+		sshDir, err := userSSHDir(u)
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(sshDir, path)
+	}
+	if err := writeFile(path, []byte(snippet), fileOptions{mode: 0o644, owner: ownerOf(u)}); err != nil {
+		return err
+	}
+	out.success("wrote ssh config for %d hosts to %s", len(config.SSHConfig.Hosts), path)
+	out.progress("to use it, add 'Include %s' at the top of ~/.ssh/config (needs OpenSSH 7.3+)", path)
+	return nil
+}
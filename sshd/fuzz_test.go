@@ -0,0 +1,101 @@
+//go:build go1.18
+// +build go1.18
+
+package sshd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// fuzzConfigSeeds are the configs in testdata that seed the corpus.
+var fuzzConfigSeeds = []string{
+	"testdata/sshd_config",
+	"testdata/modifier_sshd_config",
+	"testdata/invalid",
+	"testdata/unknown_hostkey",
+}
+
+func addConfigSeeds(f *testing.F, add func(config []byte)) {
+	for _, path := range fuzzConfigSeeds {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatalf("failed to read seed %s: %s", path, err)
+		}
+		add(contents)
+	}
+}
+
+// validValue reports whether s can be used as a value. Values come from sshca
+// itself, so they are always single line UTF-8.
+func validValue(s string) bool {
+	return utf8.ValidString(s) && !strings.ContainsAny(s, "\r\n")
+}
+
+// validKey reports whether s can be used as a key, which is an sshd keyword.
+func validKey(s string) bool {
+	return s != "" && validValue(s) && !strings.ContainsAny(s, " \t\f\v#=")
+}
+
+// FuzzModificationApply checks that the modifications made by Set and
+// SetUnique always leave the key value pair on a line of its own (possibly
+// indented), and that applying them again changes nothing.
+func FuzzModificationApply(f *testing.F) {
+	addConfigSeeds(f, func(config []byte) {
+		f.Add(config, "Port", "23", true)
+		f.Add(config, "AcceptEnv", "EXAMPLE1", false)
+		f.Add(config, "ListenAddress", "0.0.0.1:22", false)
+		f.Add(config, "Ciphers", "+aes256-gcm@openssh.com", true)
+	})
+	f.Add([]byte("#Port 22\r\nPort 22 # comment\n\n\n"), "Port", "22", false)
+	f.Add([]byte("port=22\nMatch User alice\n\tPORT = 23\n"), "Port", "22", true)
+
+	f.Fuzz(func(t *testing.T, config []byte, key, value string, unique bool) {
+		if !validKey(key) || !validValue(value) {
+			t.Skip()
+		}
+		var m Modifier
+		if unique {
+			m.SetUnique(key, value)
+		} else {
+			m.Set(key, value)
+		}
+		modification := m.modifications[0]
+
+		applied := modification.Apply(config)
+		setting := key + " " + value
+		found := false
+		for _, line := range bytes.Split(applied, []byte("\n")) {
+			if string(bytes.TrimLeft(line, " \t")) == setting {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("no %q line in:\n%s", setting, applied)
+		}
+		if reapplied := modification.Apply(applied); !bytes.Equal(reapplied, applied) {
+			t.Fatalf("applying %q again changed\n%q\nto\n%q", setting, applied, reapplied)
+		}
+	})
+}
+
+// FuzzParseEffectiveConfig checks that values found in sshd -T output are
+// always single lines.
+func FuzzParseEffectiveConfig(f *testing.F) {
+	addConfigSeeds(f, func(config []byte) {
+		f.Add(config, "port")
+		f.Add(config, "HostKey")
+	})
+	f.Add([]byte("port 22\nhostkey /etc/ssh/ssh_host_rsa_key\nhostkey /etc/ssh/ssh_host_ed25519_key\n"), "hostkey")
+
+	f.Fuzz(func(t *testing.T, out []byte, key string) {
+		for _, value := range parseEffectiveConfig(out).Lookup(key) {
+			if strings.Contains(value, "\n") {
+				t.Fatalf("value %q of %q spans lines", value, key)
+			}
+		}
+	})
+}
@@ -1,29 +1,117 @@
 package sshd
 
 import (
+	"bytes"
 	"fmt"
-	"os/exec"
-	"regexp"
+	"sort"
 	"strings"
 )
 
-// Lookup key in the effective SSHD config. This doesn't search the config path.
-// Instead it uses sshd -T to get the values of default parameters too.
-func Lookup(configPath string, key string) ([]string, error) {
-	out, _, err := checkedRun(exec.Command("sshd", "-T", "-f", configPath))
+// EffectiveConfig is the effective SSHD config, including the values of
+// default parameters, as printed by sshd -T. It is read once, so any number of
+// lookups only run sshd once.
+type EffectiveConfig struct {
+	values map[string][]string
+}
+
+// ConnectionSpec describes a connection to evaluate the Match blocks of the
+// config for (sshd -C). Empty fields are left out, although older versions of
+// sshd require User, Host and Addr.
+type ConnectionSpec struct {
+	User      string
+	Host      string
+	Addr      string
+	LocalAddr string
+}
+
+// args returns the sshd arguments for the connection spec.
+func (c ConnectionSpec) args() ([]string, error) {
+	var fields []string
+	for _, field := range []struct{ keyword, value string }{
+		{"user", c.User},
+		{"host", c.Host},
+		{"addr", c.Addr},
+		{"laddr", c.LocalAddr},
+	} {
+		if field.value == "" {
+			continue
+		}
+		if strings.ContainsAny(field.value, ",= \t\n") {
+			return nil, fmt.Errorf("invalid %s %q in connection spec", field.keyword, field.value)
+		}
+		fields = append(fields, field.keyword+"="+field.value)
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return []string{"-C", strings.Join(fields, ",")}, nil
+}
+
+// LoadEffectiveConfig runs sshd -T for the config at configPath and parses its
+// output. Match blocks are not applied.
+func LoadEffectiveConfig(configPath string) (*EffectiveConfig, error) {
+	return LoadEffectiveConfigFor(configPath, ConnectionSpec{})
+}
+
+// LoadEffectiveConfigFor is LoadEffectiveConfig for a connection, so that the
+// Match blocks that apply to it are included.
+func LoadEffectiveConfigFor(configPath string, spec ConnectionSpec) (*EffectiveConfig, error) {
+	specArgs, err := spec.args()
+	if err != nil {
+		return nil, err
+	}
+	out, _, err := checkedRun(sshdCommand(append([]string{"-T", "-f", configPath}, specArgs...)...))
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch effective config: %w", err)
 	}
+	return parseEffectiveConfig(out), nil
+}
 
+// parseEffectiveConfig parses the output of sshd -T, which has one "key value"
+// line for each value.
+func parseEffectiveConfig(out []byte) *EffectiveConfig {
+	values := make(map[string][]string)
+	for _, line := range bytes.Split(out, []byte("\n")) {
+		space := bytes.IndexByte(line, ' ')
+		if space == -1 {
+			continue
+		}
+		key := string(line[:space])
+		values[key] = append(values[key], string(line[space+1:]))
+	}
+	return &EffectiveConfig{values}
+}
+
+// Lookup returns the values of key, which is case insensitive.
+func (c *EffectiveConfig) Lookup(key string) []string {
 	// sshd -T prints out lowercase options
-	key = strings.ToLower(key)
+	values := c.values[strings.ToLower(key)]
+	return append(make([]string, 0, len(values)), values...)
+}
 
-	lineRegexp := regexp.MustCompile(fmt.Sprintf("(?m)^%s (.*)$", regexp.QuoteMeta(key)))
-	values := lineRegexp.FindAllSubmatch(out, -1)
-	ret := make([]string, 0, len(values))
-	for _, value := range values {
-		ret = append(ret, string(value[1]))
+// Keys returns the keys in the config, in sorted order.
+func (c *EffectiveConfig) Keys() []string {
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+	return keys
+}
 
-	return ret, nil
+// Lookup key in the effective SSHD config. This doesn't search the config path.
+// Instead it uses sshd -T to get the values of default parameters too. Use
+// LoadEffectiveConfig to look up several keys.
+func Lookup(configPath string, key string) ([]string, error) {
+	return LookupFor(configPath, ConnectionSpec{}, key)
+}
+
+// LookupFor is Lookup for a connection, so that the Match blocks that apply to
+// it are included.
+func LookupFor(configPath string, spec ConnectionSpec, key string) ([]string, error) {
+	config, err := LoadEffectiveConfigFor(configPath, spec)
+	if err != nil {
+		return nil, err
+	}
+	return config.Lookup(key), nil
 }
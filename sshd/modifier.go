@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
-	"os/exec"
 	"regexp"
+	"strings"
 )
 
 // Represents a SSHD config modification. Replaces all matches of LineRegexp
@@ -15,74 +15,215 @@ type modification struct {
 	LineRegexp *regexp.Regexp
 	Key        string
 	Value      string
+	// prefix is a literal that every line matching LineRegexp starts with (after
+	// indentation and an optional #, ignoring case), which avoids running the
+	// regexp on most lines.
+	prefix string
+	// unique is set for modifications made by SetUnique.
+	unique bool
+	// remove is set for modifications made by Remove, which delete the lines
+	// that they match instead of replacing them.
+	remove bool
+}
+
+// matches reports whether the modification replaces line.
+func (m modification) matches(line []byte) bool {
+	unindented := bytes.TrimLeft(line, " \t")
+	if !hasPrefixFold(unindented, m.prefix) && !hasPrefixFold(bytes.TrimPrefix(unindented, []byte("#")), m.prefix) {
+		return false
+	}
+	return m.LineRegexp.Match(line)
+}
+
+// hasPrefixFold is bytes.HasPrefix, ignoring case.
+func hasPrefixFold(b []byte, prefix string) bool {
+	return len(b) >= len(prefix) && strings.EqualFold(string(b[:len(prefix)]), prefix)
+}
+
+// setting returns the config line for the key value pair.
+func (m modification) setting() []byte {
+	return []byte(m.Key + " " + m.Value)
 }
 
 // Apply a modification to a byte array.
 func (m modification) Apply(b []byte) []byte {
-	toAppend := bytes.Join([][]byte{[]byte(m.Key), []byte(m.Value)}, []byte(" "))
-	if m.LineRegexp.Match(b) {
-		return m.LineRegexp.ReplaceAllLiteral(b, toAppend)
+	return apply(b, []modification{m})
+}
+
+// apply applies the modifications to config in a single pass over its lines.
+// Each line is replaced (or removed) by the last modification that matches it,
+// so lines written by one modification are never rewritten by the next.
+// Modifications that match no line are appended, unless a later modification
+// matches the appended line (e.g. SetUnique after Set of the same key).
+func apply(config []byte, modifications []modification) []byte {
+	matched := make([]bool, len(modifications))
+	var b bytes.Buffer
+	b.Grow(len(config))
+	first := true
+	for _, line := range bytes.Split(config, []byte("\n")) {
+		replacement := -1
+		for j, m := range modifications {
+			if m.matches(line) {
+				matched[j] = true
+				replacement = j
+			}
+		}
+		if replacement != -1 && modifications[replacement].remove {
+			continue
+		}
+
+		if !first {
+			b.WriteByte('\n')
+		}
+		first = false
+		if replacement == -1 {
+			b.Write(line)
+		} else {
+			// Keep the indentation (e.g. in a Match block)
+			b.Write(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+			b.Write(modifications[replacement].setting())
+		}
+	}
+
+	var appended [][]byte
+	for j, m := range modifications {
+		if !matched[j] && !m.remove && !supersededBy(m.setting(), modifications[j+1:]) {
+			appended = append(appended, m.setting())
+		}
+	}
+	if len(appended) == 0 {
+		return b.Bytes()
 	}
+	return bytes.Join(append([][]byte{bytes.TrimRight(b.Bytes(), "\n")}, appended...), []byte("\n"))
+}
 
-	return bytes.Join([][]byte{bytes.TrimRight(b, "\n"), toAppend}, []byte("\n"))
+// supersededBy reports whether any of the modifications would replace line.
+func supersededBy(line []byte, modifications []modification) bool {
+	for _, m := range modifications {
+		if m.matches(line) {
+			return true
+		}
+	}
+	return false
 }
 
 // Modifier provides a safe wrapper to modify SSHD configuration. Changes are
 // verified before being commited. If verification fails, the original file is
 // restored.
+//
+// Like sshd, existing lines are matched regardless of the case of the keyword,
+// indentation and whether it is separated from the value by whitespace or =.
+// Replaced lines keep their indentation.
 type Modifier struct {
-	ConfigPath    string
+	ConfigPath string
+	// Tester verifies the modified config. If it is nil, SSHDTester is used.
+	Tester        ConfigTester
 	modifications []modification
 }
 
 func (s Modifier) testConfig() error {
-	cmd := exec.Command("sshd", "-t", "-f", s.ConfigPath)
-	_, stderr, err := checkedRun(cmd)
-	if err != nil {
-		return err
+	tester := s.Tester
+	if tester == nil {
+		tester = SSHDTester{}
+	}
+	return tester.TestConfig(s.ConfigPath)
+}
+
+// Change is a queued modification of the SSHD config.
+type Change struct {
+	Key   string
+	Value string
+	// Unique is set if the change replaces every other use of Key.
+	Unique bool
+	// Remove is set if the change removes the key value pair.
+	Remove bool
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Remove:
+		return fmt.Sprintf("remove %s %s", c.Key, c.Value)
+	case c.Unique:
+		return fmt.Sprintf("set %s %s (replacing any other %s)", c.Key, c.Value, c.Key)
+	default:
+		return fmt.Sprintf("set %s %s", c.Key, c.Value)
 	}
-	// Output on stderr indicates error, even when sshd -t returns 0
-	if len(stderr) != 0 {
-		return fmt.Errorf("warning from sshd -t:\n%s", stderr)
+}
+
+// Pending returns the changes that Commit will make, in order.
+func (s Modifier) Pending() []Change {
+	changes := make([]Change, 0, len(s.modifications))
+	for _, m := range s.modifications {
+		changes = append(changes, Change{m.Key, m.Value, m.unique, m.remove})
 	}
-	return nil
+	return changes
+}
+
+// queue adds m to the modifications, replacing the queued modifications that
+// it conflicts with, so that the last call for a key wins:
+//   - SetUnique replaces everything queued for the key.
+//   - Set replaces a queued SetUnique of the key (the key is no longer unique).
+//   - Set and Remove replace anything queued for the same key value pair.
+//
+// sshd keywords are case insensitive, so keys are compared without case.
+func (s *Modifier) queue(m modification) {
+	kept := s.modifications[:0]
+	for _, queued := range s.modifications {
+		sameKey := strings.EqualFold(queued.Key, m.Key)
+		if sameKey && (m.unique || queued.Value == m.Value || (queued.unique && !m.remove)) {
+			continue
+		}
+		kept = append(kept, queued)
+	}
+	s.modifications = append(kept, m)
 }
 
 // Set adds a key value pair to the SSHD config. It will leave other config
-// lines with the same key and only replace a line if it is exactly the same.
+// lines with the same key and only replace a line if it is exactly the same
+// (apart from a trailing comment). It replaces a queued SetUnique of the key.
 // Calling this function does not apply the change until Commit is called.
 func (s *Modifier) Set(key, value string) {
+	s.queue(modification{LineRegexp: pairRegexp(key, value), Key: key, Value: value, prefix: key})
+}
+
+// Remove removes the lines with the key value pair (like the lines that Set
+// replaces) from the SSHD config. Other lines with the same key are left. It
+// replaces a queued Set of the same key value pair. Calling this function does
+// not apply the change until Commit is called.
+func (s *Modifier) Remove(key, value string) {
+	s.queue(modification{LineRegexp: pairRegexp(key, value), Key: key, Value: value, prefix: key, remove: true})
+}
+
+// pairRegexp returns the regexp for the lines with the key value pair.
+func pairRegexp(key, value string) *regexp.Regexp {
 	// Use MustCompile because a failure here indicates a programming error rather
 	// than input error
-	lineRegexp := regexp.MustCompile(fmt.Sprintf("(?m)^#?%s %s.*$", regexp.QuoteMeta(key), regexp.QuoteMeta(value)))
-	s.modifications = append(s.modifications, modification{lineRegexp, key, value})
+	return regexp.MustCompile(fmt.Sprintf(`(?m)^[ \t]*#?(?i:%s)(\s*=\s*|\s+)%s(\s.*)?$`, regexp.QuoteMeta(key), regexp.QuoteMeta(value)))
 }
 
 // SetUnique sets a unique key in the SSHD config. This means that any other
 // use of the key, even with a different value will be replaced. SetUnique
 // expects that there is at most 1 use of the key in the SSHD config (i.e. the
-// key is unique in the existing SSHD config). Calling this function does not
-// apply the change until Commit is called.
+// key is unique in the existing SSHD config). It replaces anything queued for
+// the key, so the last value wins. Calling this function does not apply the
+// change until Commit is called.
 func (s *Modifier) SetUnique(key, value string) {
 	// Use MustCompile because a failure here indicates a programming error rather
 	// than input error
-	lineRegexp := regexp.MustCompile(fmt.Sprintf("(?m)^#?%s.*$", regexp.QuoteMeta(key)))
-	s.modifications = append(s.modifications, modification{lineRegexp, key, value})
+	lineRegexp := regexp.MustCompile(fmt.Sprintf(`(?m)^[ \t]*#?(?i:%s)(\s*=.*|\s.*)?$`, regexp.QuoteMeta(key)))
+	s.queue(modification{LineRegexp: lineRegexp, Key: key, Value: value, prefix: key, unique: true})
 }
 
 // Commit is a function to apply the SSHD config modifications made by Set to
 // config file and test whether the resulting file is valid. The check is
-// performed with 'sshd -t'. If the check fails, then the file is reverted to
-// the original before returning the error.
+// performed by Tester ('sshd -t' by default). If the check fails, then the
+// file is reverted to the original before returning the error.
 func (s *Modifier) Commit() error {
 	original, err := ioutil.ReadFile(s.ConfigPath)
 	if err != nil {
 		return fmt.Errorf("failed to read SSHD config at %s: %w", s.ConfigPath, err)
 	}
-	final := original
-	for _, m := range s.modifications {
-		final = m.Apply(final)
-	}
+	final := apply(original, s.modifications)
 
 	if bytes.Equal(final, original) {
 		return nil
@@ -30,6 +30,159 @@ func TestModificationApplyWhichAppends(t *testing.T) {
 	assert.Equal(t, "ky old_value\nkey value", string(m.Apply([]byte("ky old_value\n"))))
 }
 
+func TestApplyUsesLastMatchingModification(t *testing.T) {
+	var m Modifier
+	m.SetUnique("Port", "23")
+	m.SetUnique("Port", "21")
+	assert.Equal(t, "UsePAM yes\nPort 21\n", string(apply([]byte("UsePAM yes\n#Port 22\n"), m.modifications)))
+}
+
+func TestApplyDoesNotRewriteOutputOfEarlierModifications(t *testing.T) {
+	var m Modifier
+	m.Set("AcceptEnv", "LANG_X")
+	m.Set("AcceptEnv", "LANG")
+	assert.Equal(t, "AcceptEnv EXAMPLE\nAcceptEnv LANG_X\nAcceptEnv LANG", string(apply([]byte("AcceptEnv EXAMPLE\n"), m.modifications)))
+}
+
+func TestApplyDropsSupersededAppends(t *testing.T) {
+	var m Modifier
+	m.Set("Port", "23")
+	m.SetUnique("Port", "21")
+	m.Set("AcceptEnv", "LANG")
+	m.Set("AcceptEnv", "LANG")
+	assert.Equal(t, "UsePAM yes\nPort 21\nAcceptEnv LANG", string(apply([]byte("UsePAM yes\n"), m.modifications)))
+}
+
+func TestSetUniqueOnlyMatchesWholeKey(t *testing.T) {
+	var m Modifier
+	m.SetUnique("HostKey", "/etc/ssh/key")
+	assert.Equal(t, "HostKeyAlgorithms ssh-ed25519\nHostKey /etc/ssh/key\n", string(apply([]byte("HostKeyAlgorithms ssh-ed25519\nHostKey /etc/ssh/old\n"), m.modifications)))
+}
+
+func TestSetKeepsTrailingComment(t *testing.T) {
+	var m Modifier
+	m.Set("AcceptEnv", "LANG")
+	config := []byte("AcceptEnv LANG # locale\nAcceptEnv LANGUAGE\n")
+	assert.Equal(t, "AcceptEnv LANG\nAcceptEnv LANGUAGE\n", string(apply(config, m.modifications)))
+}
+
+func TestSetUniqueMatchesLikeSSHD(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected string
+	}{
+		{"port 22\n", "Port 2222\n"},
+		{"PORT=22\n", "Port 2222\n"},
+		{"Port = 22\n", "Port 2222\n"},
+		{"\t#Port\t22\n", "\tPort 2222\n"},
+		{"Match User alice\n    Port 22\n", "Match User alice\n    Port 2222\n"},
+		{"PortForwarding yes\n", "PortForwarding yes\nPort 2222"},
+	}
+
+	for _, test := range tests {
+		var m Modifier
+		m.SetUnique("Port", "2222")
+		assert.Equal(t, test.expected, string(apply([]byte(test.config), m.modifications)), "config %q", test.config)
+	}
+}
+
+func TestSetMatchesLikeSSHD(t *testing.T) {
+	var m Modifier
+	m.Set("AcceptEnv", "LANG")
+	config := []byte("acceptenv=LANG\n  ACCEPTENV  LANG # locale\nAcceptEnv lang\n")
+	assert.Equal(t, "AcceptEnv LANG\n  AcceptEnv LANG\nAcceptEnv lang\n", string(apply(config, m.modifications)))
+}
+
+func TestModifierPending(t *testing.T) {
+	var m Modifier
+	assert.Empty(t, m.Pending())
+	m.Set("HostCertificate", "/etc/ssh/ssh_host_rsa_key-cert.pub")
+	m.SetUnique("Port", "22")
+	assert.Equal(t, []Change{
+		{Key: "HostCertificate", Value: "/etc/ssh/ssh_host_rsa_key-cert.pub"},
+		{Key: "Port", Value: "22", Unique: true},
+	}, m.Pending())
+	assert.Equal(t, "set Port 22 (replacing any other Port)", m.Pending()[1].String())
+}
+
+func TestModifierConflictingChangesLastWins(t *testing.T) {
+	var m Modifier
+	m.SetUnique("Port", "22")
+	m.Set("AcceptEnv", "LANG")
+	m.SetUnique("port", "23")
+	m.Set("AcceptEnv", "LC_ALL")
+	m.Set("AcceptEnv", "LANG")
+	assert.Equal(t, []Change{
+		{Key: "port", Value: "23", Unique: true},
+		{Key: "AcceptEnv", Value: "LC_ALL"},
+		{Key: "AcceptEnv", Value: "LANG"},
+	}, m.Pending())
+
+	m.Set("Port", "24")
+	m.SetUnique("AcceptEnv", "TZ")
+	assert.Equal(t, []Change{
+		{Key: "Port", Value: "24"},
+		{Key: "AcceptEnv", Value: "TZ", Unique: true},
+	}, m.Pending())
+}
+
+func TestModifierRemove(t *testing.T) {
+	var m Modifier
+	m.Remove("HostCertificate", "/etc/ssh/old-cert.pub")
+	m.Set("HostCertificate", "/etc/ssh/new-cert.pub")
+	config := []byte("HostCertificate /etc/ssh/old-cert.pub\nHostCertificate /etc/ssh/other-cert.pub\n\thostcertificate=/etc/ssh/old-cert.pub\n")
+	assert.Equal(t, "HostCertificate /etc/ssh/other-cert.pub\nHostCertificate /etc/ssh/new-cert.pub", string(apply(config, m.modifications)))
+	assert.Equal(t, "remove HostCertificate /etc/ssh/old-cert.pub", m.Pending()[0].String())
+
+	// Removing a missing line changes nothing
+	var missing Modifier
+	missing.Remove("HostCertificate", "/etc/ssh/old-cert.pub")
+	assert.Equal(t, "Port 22\n", string(apply([]byte("Port 22\n"), missing.modifications)))
+}
+
+func TestModifierRemoveConflicts(t *testing.T) {
+	var m Modifier
+	m.SetUnique("Port", "22")
+	m.Remove("Port", "23")
+	m.Set("AcceptEnv", "LANG")
+	m.Remove("AcceptEnv", "LANG")
+	assert.Equal(t, []Change{
+		{Key: "Port", Value: "22", Unique: true},
+		{Key: "Port", Value: "23", Remove: true},
+		{Key: "AcceptEnv", Value: "LANG", Remove: true},
+	}, m.Pending())
+
+	m.Set("AcceptEnv", "LANG")
+	m.SetUnique("Port", "24")
+	assert.Equal(t, []Change{
+		{Key: "AcceptEnv", Value: "LANG"},
+		{Key: "Port", Value: "24", Unique: true},
+	}, m.Pending())
+}
+
+// benchmarkApply applies modifications of n keys to a config with lines lines.
+func benchmarkApply(b *testing.B, lines, n int) {
+	var config bytes.Buffer
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&config, "#Option%d value%d\n", i, i)
+	}
+	var m Modifier
+	for i := 0; i < n; i++ {
+		m.SetUnique(fmt.Sprintf("Option%d", i*lines/n), "new")
+		m.Set("AcceptEnv", fmt.Sprintf("EXAMPLE%d", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		apply(config.Bytes(), m.modifications)
+	}
+}
+
+func BenchmarkApplySmall(b *testing.B) { benchmarkApply(b, 100, 5) }
+
+func BenchmarkApplyLarge(b *testing.B) { benchmarkApply(b, 5000, 50) }
+
 func TestModifierTestConfig(t *testing.T) {
 	m := Modifier{ConfigPath: "testdata/sshd_config"}
 	assert.Nil(t, m.testConfig())
@@ -194,6 +347,58 @@ func TestModifierCommitWithInvalidFinalConfig(t *testing.T) {
 	)
 }
 
+// writeTempConfig writes contents to an sshd_config in a temporary directory,
+// which is removed when the test ends.
+func writeTempConfig(t *testing.T, contents string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "sshca-*")
+	if err != nil {
+		t.Skip("unable to create temporary directory for test")
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "sshd_config")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(contents), 0o644))
+	return path
+}
+
+func TestModifierCommitWithTester(t *testing.T) {
+	configPath := writeTempConfig(t, "Port 22\n")
+	var tested []string
+	m := Modifier{ConfigPath: configPath, Tester: ConfigTesterFunc(func(path string) error {
+		// The candidate config is in place when it is tested
+		contents, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		tested = append(tested, string(contents))
+		return nil
+	})}
+	m.SetUnique("Port", "2222")
+	assert.Nil(t, m.Commit())
+	assert.Equal(t, []string{"Port 2222\n"}, tested)
+	assert.Empty(t, m.Pending())
+}
+
+func TestModifierCommitRevertsWhenTesterFails(t *testing.T) {
+	configPath := writeTempConfig(t, "Port 22\n")
+	m := Modifier{ConfigPath: configPath, Tester: ConfigTesterFunc(func(string) error {
+		return fmt.Errorf("Bad configuration option")
+	})}
+	m.SetUnique("Port", "2222")
+	err := m.Commit()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Bad configuration option")
+	assert.Equal(t, "Port 22\n", string(mustReadFixture(t, configPath)))
+}
+
+func TestModifierCommitSkipsTesterWithoutChanges(t *testing.T) {
+	configPath := writeTempConfig(t, "Port 22\n")
+	m := Modifier{ConfigPath: configPath, Tester: ConfigTesterFunc(func(string) error {
+		t.Error("tester called without changes")
+		return nil
+	})}
+	m.SetUnique("Port", "22")
+	assert.Nil(t, m.Commit())
+}
+
 // Run Set and SetUnique multiple times in one modification and verify the
 // result
 func TestModifierEndToEnd(t *testing.T) {
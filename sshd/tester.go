@@ -0,0 +1,35 @@
+package sshd
+
+import "fmt"
+
+// ConfigTester checks that a modified SSHD config is valid before Modifier
+// keeps it.
+type ConfigTester interface {
+	// TestConfig returns an error if the config file at path is invalid.
+	TestConfig(path string) error
+}
+
+// ConfigTesterFunc adapts a function to ConfigTester.
+type ConfigTesterFunc func(path string) error
+
+// TestConfig implementation for ConfigTester
+func (f ConfigTesterFunc) TestConfig(path string) error {
+	return f(path)
+}
+
+// SSHDTester tests configs with 'sshd -t -f'. It has no fields: the package
+// variables Binary and Executor choose the sshd binary and how it is run.
+type SSHDTester struct{}
+
+// TestConfig implementation for ConfigTester
+func (SSHDTester) TestConfig(path string) error {
+	_, stderr, err := checkedRun(sshdCommand("-t", "-f", path))
+	if err != nil {
+		return err
+	}
+	// Output on stderr indicates error, even when sshd -t returns 0
+	if len(stderr) != 0 {
+		return fmt.Errorf("warning from sshd -t:\n%s", stderr)
+	}
+	return nil
+}
@@ -2,13 +2,22 @@ package sshd
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"os/exec"
+
+	"github.com/ratorx/sshca/executor"
 )
 
-// checkedRun is a wrapper around exec.Cmd.Run which captures both Stdout and
-// Stderr and possibly returns them based on the exit code.
-func checkedRun(cmd *exec.Cmd) ([]byte, []byte, error) {
+// Binary is the sshd binary used to validate and query the configuration. It is
+// looked up in PATH if it is not a path.
+var Binary = "sshd"
+
+// Executor runs sshd. If it is nil, executor.Default is used.
+var Executor executor.Executor
+
+// checkedRun runs cmd with Executor, capturing both Stdout and Stderr and
+// possibly returning them based on the exit code.
+func checkedRun(cmd executor.Command) ([]byte, []byte, error) {
 	if cmd.Stdout != nil {
 		return nil, nil, fmt.Errorf("Stdout can't be set")
 	}
@@ -23,15 +32,19 @@ func checkedRun(cmd *exec.Cmd) ([]byte, []byte, error) {
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	err := cmd.Run()
+	err := executor.OrDefault(Executor).Run(cmd)
 	if err == nil {
 		return stdout.Bytes(), stderr.Bytes(), nil
 	}
 
-	switch err := err.(type) {
-	case *exec.ExitError:
-		return stdout.Bytes(), stderr.Bytes(), fmt.Errorf("command %q failed with exit code %v - stderr:\n%s", cmd, err.ExitCode(), stderr.Bytes())
-	default:
-		return stdout.Bytes(), stderr.Bytes(), fmt.Errorf("failed to execute %q: %w", cmd, err)
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		return stdout.Bytes(), stderr.Bytes(), fmt.Errorf("command %q failed with exit code %v - stderr:\n%s", cmd, exitErr.ExitCode(), stderr.Bytes())
 	}
+	return stdout.Bytes(), stderr.Bytes(), fmt.Errorf("failed to execute %q: %w", cmd, err)
+}
+
+// sshdCommand returns the command to run Binary with args.
+func sshdCommand(args ...string) executor.Command {
+	return executor.Command{Path: Binary, Args: args}
 }
@@ -0,0 +1,90 @@
+package sshd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ratorx/sshca/executor"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSSHD replaces Executor with a fake sshd for the duration of the test.
+func fakeSSHD(t *testing.T, run func(cmd executor.Command) error) {
+	t.Helper()
+	original := Executor
+	Executor = executor.Func(run)
+	t.Cleanup(func() { Executor = original })
+}
+
+func TestLookupWithFakeSSHD(t *testing.T) {
+	fakeSSHD(t, func(cmd executor.Command) error {
+		assert.Equal(t, "sshd -T -f config", cmd.String())
+		fmt.Fprint(cmd.Stdout, "port 22\nhostkey /a\nhostkey /b\n")
+		return nil
+	})
+	vals, err := Lookup("config", "HostKey")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/a", "/b"}, vals)
+}
+
+func TestEffectiveConfigRunsSSHDOnce(t *testing.T) {
+	runs := 0
+	fakeSSHD(t, func(cmd executor.Command) error {
+		runs++
+		fmt.Fprint(cmd.Stdout, "port 22\nhostkey /a\nhostkey /b\nhostcertificate /a-cert.pub\n")
+		return nil
+	})
+	config, err := LoadEffectiveConfig("config")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/a", "/b"}, config.Lookup("HostKey"))
+	assert.Equal(t, []string{"/a-cert.pub"}, config.Lookup("hostcertificate"))
+	assert.Equal(t, []string{}, config.Lookup("TrustedUserCAKeys"))
+	assert.Equal(t, []string{"hostcertificate", "hostkey", "port"}, config.Keys())
+	assert.Equal(t, 1, runs)
+}
+
+func TestLookupForConnection(t *testing.T) {
+	fakeSSHD(t, func(cmd executor.Command) error {
+		assert.Equal(t, "sshd -T -f config -C user=alice,host=laptop.example.com,addr=192.0.2.1", cmd.String())
+		fmt.Fprint(cmd.Stdout, "passwordauthentication no\n")
+		return nil
+	})
+	vals, err := LookupFor("config", ConnectionSpec{User: "alice", Host: "laptop.example.com", Addr: "192.0.2.1"}, "PasswordAuthentication")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"no"}, vals)
+}
+
+func TestLookupForInvalidConnection(t *testing.T) {
+	fakeSSHD(t, func(cmd executor.Command) error {
+		t.Error("sshd run with an invalid connection spec")
+		return nil
+	})
+	_, err := LookupFor("config", ConnectionSpec{User: "alice,addr=10.0.0.1"}, "port")
+	assert.EqualError(t, err, `invalid user "alice,addr=10.0.0.1" in connection spec`)
+}
+
+func TestLookupWithFailingFakeSSHD(t *testing.T) {
+	fakeSSHD(t, func(cmd executor.Command) error {
+		fmt.Fprint(cmd.Stderr, "bad config")
+		return executor.ExitError{Code: 255}
+	})
+	_, err := Lookup("config", "hostkey")
+	assert.EqualError(t, err, "failed to fetch effective config: command \"sshd -T -f config\" failed with exit code 255 - stderr:\nbad config")
+}
+
+func TestModifierTestConfigWithFakeSSHDWarning(t *testing.T) {
+	fakeSSHD(t, func(cmd executor.Command) error {
+		fmt.Fprint(cmd.Stderr, "unknown option")
+		return nil
+	})
+	m := Modifier{ConfigPath: "config"}
+	assert.EqualError(t, m.testConfig(), "warning from sshd -t:\nunknown option")
+}
+
+func TestCheckedRunWithExecutionFailure(t *testing.T) {
+	fakeSSHD(t, func(cmd executor.Command) error {
+		return fmt.Errorf("not found")
+	})
+	_, _, err := checkedRun(sshdCommand("-t"))
+	assert.EqualError(t, err, "failed to execute \"sshd -t\": not found")
+}
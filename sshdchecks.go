@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ratorx/sshca/sshd"
+)
+
+// permitRootLoginValues are the values of PermitRootLogin that
+// --permit-root-login accepts.
+var permitRootLoginValues = []string{"yes", "prohibit-password", "without-password", "forced-commands-only", "no"}
+
+// sshdDirectives are the sshd_config directives that decide whether
+// certificate logins work once the CA is trusted.
+var sshdDirectives = []string{"PubkeyAuthentication", "AuthorizedPrincipalsFile", "AuthorizedPrincipalsCommand", "PermitRootLogin"}
+
+// certificateLoginWarnings returns a warning for each setting in the
+// effective sshd config that stops user certificates from logging in, or only
+// lets them log in under extra conditions.
+func certificateLoginWarnings(config *sshd.EffectiveConfig) []string {
+	value := func(key string) string {
+		if values := config.Lookup(key); len(values) != 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	var warnings []string
+	if value("PubkeyAuthentication") == "no" {
+		warnings = append(warnings, "sshd has PubkeyAuthentication no, so certificates can't log in at all; pass --enable-pubkey-authentication to enable it")
+	}
+	principalsFile := value("AuthorizedPrincipalsFile")
+	principalsCommand := value("AuthorizedPrincipalsCommand")
+	for _, setting := range []struct{ key, value string }{{"AuthorizedPrincipalsFile", principalsFile}, {"AuthorizedPrincipalsCommand", principalsCommand}} {
+		if setting.value != "" && setting.value != "none" {
+			warnings = append(warnings, fmt.Sprintf("sshd has %s %s, so certificates can only log in as users whose principals it lists, not as the principals of the certificate; make sure it lists them for every user, including root", setting.key, setting.value))
+		}
+	}
+	switch value("PermitRootLogin") {
+	case "no":
+		warnings = append(warnings, "sshd has PermitRootLogin no, so certificates for root can't log in; pass --permit-root-login prohibit-password to allow them")
+	case "forced-commands-only":
+		warnings = append(warnings, "sshd has PermitRootLogin forced-commands-only, so certificates for root can only log in with a force-command option")
+	}
+	return warnings
+}
+
+// validateSSHDFixes checks the flags that change sshd settings.
+func (t TrustCmd) validateSSHDFixes() error {
+	if t.PermitRootLogin != "" && !containsString(permitRootLoginValues, t.PermitRootLogin) {
+		return fmt.Errorf("invalid --permit-root-login %q (expected one of %s)", t.PermitRootLogin, strings.Join(permitRootLoginValues, ", "))
+	}
+	if t.AuthorizedKeys && (t.EnablePubkeyAuthentication || t.PermitRootLogin != "") {
+		return fmt.Errorf("--enable-pubkey-authentication and --permit-root-login can't be used with --authorized-keys, which doesn't change sshd_config")
+	}
+	return nil
+}
+
+// fixSSHD queues the changes of the sshd settings that were asked for with
+// flags.
+func (t TrustCmd) fixSSHD(modifier *sshd.Modifier) {
+	if t.EnablePubkeyAuthentication {
+		modifier.SetUnique("PubkeyAuthentication", "yes")
+	}
+	if t.PermitRootLogin != "" {
+		modifier.SetUnique("PermitRootLogin", t.PermitRootLogin)
+	}
+}
+
+// checkSSHD warns about the settings of the live sshd that stop the trusted
+// CAs from being used for certificate logins.
+func (t TrustCmd) checkSSHD() {
+	config, err := sshd.LoadEffectiveConfig(defaultSSHDConfigPath)
+	if err != nil {
+		out.warning(fmt.Sprintf("failed to check sshd for settings that stop certificate logins: %s", err))
+		return
+	}
+	for _, key := range sshdDirectives {
+		out.detail("  %s %s", key, strings.Join(config.Lookup(key), " "))
+	}
+	for _, warning := range certificateLoginWarnings(config) {
+		out.warning(warning)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ratorx/sshca/sshd"
+)
+
+// SSHDConfigCmd groups the commands that inspect the sshd config.
+type SSHDConfigCmd struct {
+	Dump *SSHDConfigDumpCmd `arg:"subcommand:dump" help:"print the effective sshd config"`
+}
+
+// Validate implementation for Command
+func (s SSHDConfigCmd) Validate() error {
+	if s.Dump == nil {
+		return fmt.Errorf("subcommand is required (dump)")
+	}
+	return s.Dump.Validate()
+}
+
+// Run implementation for Command
+func (s SSHDConfigCmd) Run() error {
+	return s.Dump.Run()
+}
+
+// SSHDConfigDumpCmd is the command that prints the effective sshd config (as
+// sshd -T does), e.g. to find out why sshd doesn't accept certificates.
+type SSHDConfigDumpCmd struct {
+	SSHDConfigPath string   `arg:"--sshd-config" placeholder:"PATH" help:"sshd_config to read (default: from the host config, or /etc/ssh/sshd_config)"`
+	HostConfigPath string   `arg:"--host-config" placeholder:"PATH" help:"per-host config with the sshd_config path (default: /etc/sshca/host.yaml, if it exists)"`
+	SSHDPath       string   `arg:"--sshd" default:"sshd" placeholder:"PATH" help:"path to sshd"`
+	JSON           bool     `arg:"--json" help:"print a JSON object of the values of each key"`
+	User           string   `arg:"--user" placeholder:"USER" help:"apply the Match blocks for connections as this user"`
+	Host           string   `arg:"--host" placeholder:"HOST" help:"apply the Match blocks for connections from this host name"`
+	Addr           string   `arg:"--addr" placeholder:"ADDRESS" help:"apply the Match blocks for connections from this address"`
+	LocalAddr      string   `arg:"--laddr" placeholder:"ADDRESS" help:"apply the Match blocks for connections to this local address"`
+	Keys           []string `arg:"positional" placeholder:"KEY" help:"keys to print (default: all)"`
+}
+
+// Validate implementation for Command
+func (s SSHDConfigDumpCmd) Validate() error {
+	return nil
+}
+
+// Run implementation for Command
+func (s SSHDConfigDumpCmd) Run() error {
+	signHost, err := SignHostCmd{SSHDConfigPath: s.SSHDConfigPath, HostConfigPath: s.HostConfigPath}.withHostConfig()
+	if err != nil {
+		return err
+	}
+	useSSHD(s.SSHDPath)
+	spec := sshd.ConnectionSpec{User: s.User, Host: s.Host, Addr: s.Addr, LocalAddr: s.LocalAddr}
+	config, err := sshd.LoadEffectiveConfigFor(signHost.SSHDConfigPath, spec)
+	if err != nil {
+		return err
+	}
+
+	keys := config.Keys()
+	if len(s.Keys) != 0 {
+		keys = make([]string, 0, len(s.Keys))
+		for _, key := range s.Keys {
+			// sshd -T prints out lowercase options
+			key = strings.ToLower(key)
+			if len(config.Lookup(key)) == 0 {
+				out.warning(fmt.Sprintf("%s is not set in the effective config", key))
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	if s.JSON {
+		values := make(map[string][]string, len(keys))
+		for _, key := range keys {
+			values[key] = config.Lookup(key)
+		}
+		data, err := json.MarshalIndent(values, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	for _, key := range keys {
+		for _, value := range config.Lookup(key) {
+			fmt.Printf("%s %s\n", key, value)
+		}
+	}
+	return nil
+}
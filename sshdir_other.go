@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"path/filepath"
+)
+
+// userSSHDir returns the directory containing the SSH keys of u. OpenSSH uses
+// the home directory from the user database rather than $HOME, which also
+// means that the right directory is found under sudo.
+func userSSHDir(u *user.User) (string, error) {
+	if u.HomeDir == "" {
+		return "", fmt.Errorf("user %s has no home directory", u.Username)
+	}
+	return filepath.Join(u.HomeDir, ".ssh"), nil
+}
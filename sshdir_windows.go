@@ -0,0 +1,22 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+// userSSHDir returns the directory containing the SSH keys of u. The Windows
+// port of OpenSSH uses .ssh in the user profile directory.
+func userSSHDir(u *user.User) (string, error) {
+	profile := u.HomeDir
+	if profile == "" {
+		var err error
+		profile, err = os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to find user profile directory: %w", err)
+		}
+	}
+	return filepath.Join(profile, ".ssh"), nil
+}
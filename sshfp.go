@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Showmax/go-fqdn"
+	"github.com/ratorx/sshca/executor"
+	"github.com/ratorx/sshca/sshd"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHFP algorithm numbers for each key type (RFC 4255, 6594, 7479 and 8709).
+var sshfpAlgorithms = map[string]int{
+	ssh.KeyAlgoRSA:      1,
+	ssh.KeyAlgoDSA:      2,
+	ssh.KeyAlgoECDSA256: 3,
+	ssh.KeyAlgoECDSA384: 3,
+	ssh.KeyAlgoECDSA521: 3,
+	ssh.KeyAlgoED25519:  4,
+}
+
+// SSHFP fingerprint types.
+const (
+	sshfpSHA1   = 1
+	sshfpSHA256 = 2
+)
+
+// SSHFPCmd is the command that prints SSHFP DNS records for the host keys, so
+// that clients using VerifyHostKeyDNS can check the keys that sign_host
+// certified. Certificates are accepted in place of keys, and the records are
+// for the certified key (SSHFP records can't describe certificates).
+type SSHFPCmd struct {
+	SSHDConfigPath string   `arg:"--sshd-config" placeholder:"PATH" help:"sshd_config to find the host keys in (default: from the host config, or /etc/ssh/sshd_config)"`
+	HostConfigPath string   `arg:"--host-config" placeholder:"PATH" help:"per-host config with the sshd_config path (default: /etc/sshca/host.yaml, if it exists)"`
+	SSHDPath       string   `arg:"--sshd" default:"sshd" placeholder:"PATH" help:"path to sshd"`
+	Hostname       string   `arg:"-n,--hostname" placeholder:"NAME" help:"owner name of the records (default: the fully qualified hostname)"`
+	SHA1           bool     `arg:"--sha1" help:"also print SHA-1 records, for resolvers that don't support SHA-256"`
+	Output         string   `arg:"-o,--output" placeholder:"PATH" help:"file to write the records to (default: stdout)"`
+	Push           string   `arg:"--push" placeholder:"COMMAND" help:"command that publishes the records with a DNS provider; it is run with the owner name as its argument and the records on stdin"`
+	Keys           []string `arg:"positional" placeholder:"KEY" help:"public keys or certificates to print records for (default: the host keys in sshd_config)"`
+}
+
+// Validate implementation for Command
+func (s SSHFPCmd) Validate() error {
+	if len(s.Keys) != 0 && (s.SSHDConfigPath != "" || s.HostConfigPath != "") {
+		return fmt.Errorf("--sshd-config and --host-config can't be used with explicit keys")
+	}
+	return nil
+}
+
+// keyPaths returns the paths of the keys to print records for.
+func (s SSHFPCmd) keyPaths() ([]string, error) {
+	if len(s.Keys) != 0 {
+		return s.Keys, nil
+	}
+	signHost, err := SignHostCmd{SSHDConfigPath: s.SSHDConfigPath, HostConfigPath: s.HostConfigPath}.withHostConfig()
+	if err != nil {
+		return nil, err
+	}
+	useSSHD(s.SSHDPath)
+	sshdConfig, err := sshd.LoadEffectiveConfig(signHost.SSHDConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	return findPublicKeys(sshdConfig), nil
+}
+
+// ownerName returns the owner name of the records. The default hostname is
+// made absolute, so that the records can be pasted into any zone file.
+func (s SSHFPCmd) ownerName() (string, error) {
+	if s.Hostname != "" {
+		return s.Hostname, nil
+	}
+	hostname, err := fqdn.FqdnHostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to get hostname: %w", err)
+	}
+	return strings.TrimSuffix(hostname, ".") + ".", nil
+}
+
+// Run implementation for Command
+func (s SSHFPCmd) Run() error {
+	if s.Output == "" {
+		useStderrForMessages()
+	}
+	name, err := s.ownerName()
+	if err != nil {
+		return err
+	}
+	keyPaths, err := s.keyPaths()
+	if err != nil {
+		return fmt.Errorf("failed to find host keys: %w", err)
+	}
+
+	var records bytes.Buffer
+	for _, keyPath := range keyPaths {
+		keyRecords, err := sshfpRecordsForFile(name, keyPath, s.SHA1)
+		if err != nil {
+			out.warning(err.Error())
+			continue
+		}
+		records.Write(keyRecords)
+	}
+	if records.Len() == 0 {
+		return fmt.Errorf("no SSHFP records for any of the %d keys", len(keyPaths))
+	}
+
+	if s.Output == "" {
+		os.Stdout.Write(records.Bytes())
+	} else if err := replaceFile(s.Output, records.Bytes(), fileOptions{mode: 0o644}); err != nil {
+		return fmt.Errorf("failed to write SSHFP records: %w", err)
+	}
+
+	if s.Push != "" {
+		cmd := executor.Command{Path: s.Push, Args: []string{name}, Stdin: &records, Stdout: os.Stderr, Stderr: os.Stderr}
+		if err := executor.OrDefault(nil).Run(cmd); err != nil {
+			return fmt.Errorf("failed to push SSHFP records with %s: %w", s.Push, err)
+		}
+		out.success("pushed SSHFP records for %s with %s", name, s.Push)
+	}
+	return nil
+}
+
+// sshfpRecordsForFile returns the SSHFP records for the public key or
+// certificate at path.
+func sshfpRecordsForFile(name string, path string, includeSHA1 bool) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	records, err := sshfpRecords(name, key, includeSHA1)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return records, nil
+}
+
+// sshfpRecords returns the zone file lines of the SSHFP records for key, like
+// ssh-keygen -r. Certificates get the records of the certified key.
+func sshfpRecords(name string, key ssh.PublicKey, includeSHA1 bool) ([]byte, error) {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	algorithm, ok := sshfpAlgorithms[key.Type()]
+	if !ok {
+		return nil, fmt.Errorf("SSHFP records don't support %s keys", key.Type())
+	}
+
+	var records bytes.Buffer
+	if includeSHA1 {
+		fmt.Fprintf(&records, "%s IN SSHFP %d %d %x\n", name, algorithm, sshfpSHA1, sha1.Sum(key.Marshal()))
+	}
+	fmt.Fprintf(&records, "%s IN SSHFP %d %d %x\n", name, algorithm, sshfpSHA256, sha256.Sum256(key.Marshal()))
+	return records.Bytes(), nil
+}
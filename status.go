@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"golang.org/x/crypto/ssh"
+)
+
+// StatusCmd is the command that checks the status of a certificate with the
+// CA.
+type StatusCmd struct {
+	Remote string `arg:"-r,required" help:"remote server that issued the certificate"`
+	Tenant string `arg:"--tenant,env:SSHCA_TENANT" placeholder:"NAME" help:"tenant of the remote server to use (default: the server's own CA)"`
+	CertificateSelector
+}
+
+// CertificateSelector are the flags that select a certificate issued by the
+// CA.
+type CertificateSelector struct {
+	Serial      uint64 `arg:"--serial" placeholder:"SERIAL" help:"serial number of the certificate"`
+	Fingerprint string `arg:"--fingerprint" placeholder:"SHA256:..." help:"fingerprint of the certified key, which selects its most recent certificate"`
+	CertPath    string `arg:"positional" placeholder:"CERTIFICATE" help:"path to the certificate (instead of --serial or --fingerprint)"`
+}
+
+// Validate implementation for Command
+func (s StatusCmd) Validate() error {
+	return s.CertificateSelector.Validate()
+}
+
+// Validate checks that exactly one certificate is selected.
+func (s CertificateSelector) Validate() error {
+	set := 0
+	for _, isSet := range []bool{s.Serial != 0, s.Fingerprint != "", s.CertPath != ""} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of --serial, --fingerprint or CERTIFICATE must be used")
+	}
+	return nil
+}
+
+// checkArgs identifies the selected certificate.
+func (s CertificateSelector) checkArgs() (ca.CheckStatusArgs, error) {
+	if s.CertPath == "" {
+		return ca.CheckStatusArgs{Serial: s.Serial, Fingerprint: s.Fingerprint}, nil
+	}
+	certificate, err := ca.NewPublicKey(s.CertPath)
+	if err != nil {
+		return ca.CheckStatusArgs{}, err
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(certificate.Data)
+	if err != nil {
+		return ca.CheckStatusArgs{}, fmt.Errorf("failed to parse %s: %w", s.CertPath, err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return ca.CheckStatusArgs{}, fmt.Errorf("%s is not a certificate", s.CertPath)
+	}
+	if cert.Serial == 0 {
+		return ca.CheckStatusArgs{}, fmt.Errorf("%s has no serial number", s.CertPath)
+	}
+	return ca.CheckStatusArgs{Serial: cert.Serial}, nil
+}
+
+// Run implementation for Command
+func (s StatusCmd) Run() error {
+	args, err := s.checkArgs()
+	if err != nil {
+		return err
+	}
+	client, err := RPCFlags{Remote: s.Remote, Tenant: s.Tenant}.MakeClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	reply, err := client.CheckStatus(args)
+	if err != nil {
+		return fmt.Errorf("failed to check certificate status: %w", err)
+	}
+	fmt.Printf("status: %s\n", reply.Status)
+	if reply.Status != ca.StatusUnknown {
+		fmt.Printf("serial: %d\n", reply.Serial)
+		fmt.Printf("identity: %s\n", reply.Identity)
+		fmt.Printf("issued: %s\n", formatStatusTime(reply.IssuedAt))
+		fmt.Printf("expires: %s\n", formatStatusTime(reply.ValidBefore))
+		if !reply.RevokedAt.IsZero() {
+			fmt.Printf("revoked: %s\n", formatStatusTime(reply.RevokedAt))
+		}
+	}
+	fmt.Printf("checked: %s\n", formatStatusTime(reply.CheckedAt))
+	return nil
+}
+
+// formatStatusTime formats t for StatusCmd. The zero time is never.
+func formatStatusTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format(time.RFC3339)
+}
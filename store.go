@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/ratorx/sshca/executor"
+)
+
+// The secrets stores that --store can push certificates to. Each is written to
+// with its official CLI, so that the usual login and environment (VAULT_ADDR,
+// AWS_PROFILE, KUBECONFIG, ...) applies.
+const (
+	storeVault      = "vault"
+	storeSSM        = "ssm"
+	storeKubernetes = "k8s"
+)
+
+// kubernetesName matches the names that Kubernetes accepts for namespaces and
+// secrets (DNS subdomains).
+var kubernetesName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// kubernetesInvalid matches the characters of key IDs that can't be used in
+// Kubernetes names.
+var kubernetesInvalid = regexp.MustCompile(`[^-a-z0-9.]+`)
+
+// placeholders replaces the placeholders in store locations with a valid
+// name, to check the rest of the location.
+var placeholders = strings.NewReplacer("{key_id}", "x", "{type}", "x")
+
+// certificateStore is a place in a secrets store to push issued certificates
+// to, for teams that distribute credentials centrally.
+type certificateStore struct {
+	kind string
+	// location is the Vault KV path, the SSM parameter name or the
+	// NAMESPACE/NAME of the Kubernetes secret. It can contain {key_id} and
+	// {type}, which are replaced for each certificate.
+	location string
+}
+
+// parseCertificateStore parses the --store flag: vault:PATH, ssm:NAME or
+// k8s:NAMESPACE/NAME.
+func parseCertificateStore(spec string) (certificateStore, error) {
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return certificateStore{}, fmt.Errorf("%q must be vault:PATH, ssm:NAME or k8s:NAMESPACE/NAME", spec)
+	}
+	store := certificateStore{spec[:i], spec[i+1:]}
+	if store.location == "" {
+		return certificateStore{}, fmt.Errorf("%q has no location", spec)
+	}
+	switch store.kind {
+	case storeVault:
+	case storeSSM:
+		if !strings.HasPrefix(store.location, "/") && strings.Contains(store.location, "/") {
+			return certificateStore{}, fmt.Errorf("SSM parameter names with a path must start with /")
+		}
+	case storeKubernetes:
+		parts := strings.Split(store.location, "/")
+		if len(parts) != 2 || !kubernetesName.MatchString(placeholders.Replace(parts[0])) || !kubernetesName.MatchString(placeholders.Replace(parts[1])) {
+			return certificateStore{}, fmt.Errorf("%q must be k8s:NAMESPACE/NAME with lowercase names", spec)
+		}
+	default:
+		return certificateStore{}, fmt.Errorf("unknown store %q (must be vault, ssm or k8s)", store.kind)
+	}
+	return store, nil
+}
+
+// expand returns the location with the placeholders replaced. For Kubernetes,
+// key IDs are lowercased and other invalid characters are replaced with "-".
+func (s certificateStore) expand(keyID string, certType string) string {
+	if s.kind == storeKubernetes {
+		keyID = strings.Trim(kubernetesInvalid.ReplaceAllString(strings.ToLower(keyID), "-"), "-.")
+	}
+	return strings.NewReplacer("{key_id}", keyID, "{type}", certType).Replace(s.location)
+}
+
+// command returns the command that writes the certificate to location.
+func (s certificateStore) command(location string, signed signedCertificate, keyID string) (executor.Command, error) {
+	certificate := signed.certificate.String()
+	switch s.kind {
+	case storeVault:
+		// The certificate is read from stdin, so that it isn't in the
+		// arguments of the process
+		return executor.Command{
+			Path:  "vault",
+			Args:  []string{"kv", "put", location, "certificate=-"},
+			Stdin: strings.NewReader(certificate),
+		}, nil
+	case storeSSM:
+		return executor.Command{
+			Path: "aws",
+			Args: []string{"ssm", "put-parameter", "--name", location, "--type", "String", "--overwrite", "--value", strings.TrimSpace(certificate)},
+		}, nil
+	default:
+		parts := strings.SplitN(location, "/", 2)
+		manifest, err := kubernetesSecret(parts[0], parts[1], keyID, certificate)
+		if err != nil {
+			return executor.Command{}, err
+		}
+		return executor.Command{
+			Path:  "kubectl",
+			Args:  []string{"apply", "-f", "-"},
+			Stdin: bytes.NewReader(manifest),
+		}, nil
+	}
+}
+
+// kubernetesSecret returns the manifest of the secret that holds certificate.
+func kubernetesSecret(namespace string, name string, keyID string, certificate string) ([]byte, error) {
+	secret := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"type":       "Opaque",
+		"metadata": map[string]interface{}{
+			"namespace":   namespace,
+			"name":        name,
+			"labels":      map[string]string{"app.kubernetes.io/managed-by": "sshca"},
+			"annotations": map[string]string{"sshca/key-id": keyID},
+		},
+		"stringData": map[string]string{"certificate": certificate},
+	}
+	return json.MarshalIndent(secret, "", "  ")
+}
+
+// push writes the certificate to the store.
+func (s certificateStore) push(signed signedCertificate) error {
+	cert, err := signed.parse()
+	if err != nil {
+		return err
+	}
+	location := s.expand(cert.KeyId, certificateType(cert).String())
+	cmd, err := s.command(location, signed, cert.KeyId)
+	if err != nil {
+		return fmt.Errorf("failed to push certificate to %s:%s: %w", s.kind, location, err)
+	}
+	// The CLIs print what they wrote on stdout, which is kept off stdout so
+	// that sign_user --stdin still prints only the certificate
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := executor.OrDefault(nil).Run(cmd); err != nil {
+		return fmt.Errorf("failed to push certificate to %s:%s: %w", s.kind, location, err)
+	}
+	out.success("pushed certificate to %s:%s", s.kind, location)
+	return nil
+}
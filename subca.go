@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+)
+
+// CrossCertifyCmd is the command that asks the root CA server to endorse
+// another CA key (usually the key of another sshca server) as a sub-CA.
+type CrossCertifyCmd struct {
+	RPCFlags
+	Name          string        `arg:"--name,required" help:"name of the sub-CA (endorsing a new key with an existing name rotates it)"`
+	PublicKeyPath string        `arg:"positional,required" placeholder:"SUB_CA_PUBLIC_KEY" help:"path to the sub-CA public key"`
+	Validity      time.Duration `arg:"-V,--validity" placeholder:"DURATION" help:"how long the endorsement is valid for (default: forever)"`
+	TOTPFlags
+}
+
+// Validate implementation for Command
+func (c CrossCertifyCmd) Validate() error {
+	if c.Validity < 0 {
+		return fmt.Errorf("--validity must not be negative")
+	}
+	if err := c.TOTPFlags.Validate(); err != nil {
+		return err
+	}
+	return c.RPCFlags.Validate()
+}
+
+// Run implementation for Command
+func (c CrossCertifyCmd) Run() error {
+	publicKey, err := ca.NewPublicKey(c.PublicKeyPath)
+	if err != nil {
+		return err
+	}
+	client, err := c.RPCFlags.MakeClient()
+	if err != nil {
+		return err
+	}
+
+	code, err := c.TOTPFlags.code()
+	if err != nil {
+		return err
+	}
+	args := ca.CrossCertifyArgs{Name: c.Name, PublicKey: publicKey, Validity: c.Validity, TOTPClient: c.TOTPClient, TOTPCode: code}
+	if !c.RPCFlags.Local {
+		out.progress("%s", args)
+	}
+	reply, err := client.CrossCertify(args)
+	if err != nil {
+		return fmt.Errorf("failed to cross-certify sub-CA: %w", err)
+	}
+
+	if reply.Endorsement.NotAfter.IsZero() {
+		out.success("endorsed sub-CA %s", c.Name)
+	} else {
+		out.success("endorsed sub-CA %s until %s", c.Name, reply.Endorsement.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// trustedCAs returns the CA public key of the server, followed by the keys of
+// the sub-CAs with valid endorsements if includeSubCAs is set. Invalid
+// endorsements are skipped with a warning.
+func trustedCAs(client *ca.Client, includeSubCAs bool) ([]*ca.PublicKey, error) {
+	if !includeSubCAs {
+		reply, err := client.GetCAPublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch public key from server: %w", err)
+		}
+		return []*ca.PublicKey{reply.CAPublicKey}, nil
+	}
+
+	bundle, err := client.GetTrustBundle()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch trust bundle from server: %w", err)
+	}
+	keys := []*ca.PublicKey{bundle.CAPublicKey}
+	for _, endorsement := range bundle.SubCAs {
+		if err := endorsement.Verify(bundle.CAPublicKey, time.Now()); err != nil {
+			out.warning(fmt.Sprintf("not trusting sub-CA: %s", err))
+			continue
+		}
+		keys = append(keys, endorsement.PublicKey)
+	}
+	return keys, nil
+}
+
+// BundleCmd is the command that prints the trust bundle of a CA server: its
+// own key and the keys of its sub-CAs, after verifying their endorsements.
+type BundleCmd struct {
+	RPCFlags
+	KnownHosts bool   `arg:"--known-hosts" help:"print @cert-authority lines for a known hosts file instead of a TrustedUserCAKeys file"`
+	Output     string `arg:"-o,--output" placeholder:"PATH" help:"file to write the bundle to (default: stdout)"`
+}
+
+// Validate implementation for Command
+func (b BundleCmd) Validate() error {
+	return b.RPCFlags.Validate()
+}
+
+// Run implementation for Command
+func (b BundleCmd) Run() error {
+	client, err := b.RPCFlags.MakeClient()
+	if err != nil {
+		return err
+	}
+	keys, err := trustedCAs(client, true)
+	if err != nil {
+		return err
+	}
+
+	var bundle strings.Builder
+	for _, key := range keys {
+		if b.KnownHosts {
+			bundle.Write(certAuthorityLine([]string{"*"}, key, false))
+		} else {
+			bundle.WriteString(strings.TrimSpace(key.String()) + "\n")
+		}
+	}
+
+	if b.Output == "" {
+		fmt.Print(bundle.String())
+		return nil
+	}
+	return writeFile(b.Output, []byte(bundle.String()), fileOptions{mode: 0o644})
+}
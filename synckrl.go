@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/sshd"
+)
+
+// SyncKRLCmd is the command that downloads the key revocation list of the CA
+// and configures sshd to use it.
+type SyncKRLCmd struct {
+	Remote   string        `arg:"-r,required" help:"remote server to download the KRL from"`
+	Tenant   string        `arg:"--tenant,env:SSHCA_TENANT" placeholder:"NAME" help:"tenant of the remote server to use (default: the server's own CA)"`
+	Output   string        `arg:"-o,--output" default:"/etc/ssh/revoked_keys" placeholder:"PATH" help:"file to write the KRL to"`
+	SSHDPath string        `arg:"--sshd" default:"sshd" placeholder:"PATH" help:"path to sshd"`
+	Interval time.Duration `arg:"--interval" placeholder:"DURATION" help:"keep running and check for a new KRL at this interval (default: sync once, e.g. from cron)"`
+}
+
+// Validate implementation for Command
+func (s SyncKRLCmd) Validate() error {
+	if s.Interval < 0 {
+		return fmt.Errorf("--interval must not be negative")
+	}
+	return nil
+}
+
+// Run implementation for Command
+func (s SyncKRLCmd) Run() error {
+	useSSHD(s.SSHDPath)
+	// sshd refuses all keys if RevokedKeys can't be read, so only configure it
+	// once the KRL has been written
+	if err := s.sync(); err != nil {
+		return err
+	}
+	sshdConfig := sshd.Modifier{ConfigPath: "/etc/ssh/sshd_config"}
+	sshdConfig.SetUnique("RevokedKeys", s.Output)
+	if err := sshdConfig.Commit(); err != nil {
+		return fmt.Errorf("unable to set RevokedKeys: %w", err)
+	}
+
+	if s.Interval == 0 {
+		return nil
+	}
+	for {
+		time.Sleep(s.Interval)
+		// The server might be temporarily unavailable, and the current KRL stays
+		// in effect until the next sync
+		if err := s.sync(); err != nil {
+			out.warning(err.Error())
+		}
+	}
+}
+
+// sync downloads the KRL if it differs from the one at s.Output.
+func (s SyncKRLCmd) sync() error {
+	client, err := RPCFlags{Remote: s.Remote, Tenant: s.Tenant}.MakeClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var etag string
+	if current, err := ioutil.ReadFile(s.Output); err == nil {
+		etag = ca.KRLETag(current)
+	}
+	reply, err := client.GetKRL(etag)
+	if err != nil {
+		return fmt.Errorf("failed to get KRL: %w", err)
+	}
+	if reply.NotModified {
+		out.success("KRL is up to date")
+		return nil
+	}
+	if ca.KRLETag(reply.KRL) != reply.ETag {
+		return fmt.Errorf("downloaded KRL doesn't match its ETag")
+	}
+
+	if err := replaceFile(s.Output, reply.KRL, fileOptions{mode: 0o644}); err != nil {
+		return fmt.Errorf("failed to write KRL: %w", err)
+	}
+	out.success("updated KRL at %s", s.Output)
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/notify"
+	"gopkg.in/yaml.v2"
+)
+
+// TenantFlags configure the additional tenants served by the server and the
+// audit log of the default tenant.
+type TenantFlags struct {
+	TenantsFile string `arg:"--tenants" placeholder:"PATH" help:"YAML file of additional tenants, each with its own CA key, validity policy and audit log (selected by clients with --tenant)"`
+	AuditLog    string `arg:"--audit-log" placeholder:"PATH" help:"file to append a JSON line to for every signing request"`
+}
+
+// duration is a time.Duration that is written as a string (e.g. 12h) in YAML.
+type duration time.Duration
+
+// UnmarshalYAML implementation for yaml.Unmarshaler
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if parsed < 0 {
+		return fmt.Errorf("validity durations must not be negative")
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// tenantConfig configures a single tenant. Settings that aren't listed are
+// inherited from the server flags. The policy settings replace the server's
+// (e.g. denied_principals replaces the server's list rather than adding to
+// it), except for the allowed algorithms, the DNS check, the groups and
+// break-glass requests, which are always the server's.
+type tenantConfig struct {
+	PrivateKey          string    `yaml:"private_key"`
+	PublicKey           string    `yaml:"public_key"`
+	PassphraseFile      string    `yaml:"passphrase_file"`
+	UserDefaultValidity *duration `yaml:"user_default_validity"`
+	UserMaxValidity     *duration `yaml:"user_max_validity"`
+	HostDefaultValidity *duration `yaml:"host_default_validity"`
+	HostMaxValidity     *duration `yaml:"host_max_validity"`
+	ClampValidity       *bool     `yaml:"clamp_validity"`
+	AuditLog            string    `yaml:"audit_log"`
+	KRL                 string    `yaml:"krl"`
+	CertRegistry        string    `yaml:"cert_registry"`
+
+	RequireHostProof            *bool     `yaml:"require_host_proof"`
+	RequireUserProof            *bool     `yaml:"require_user_proof"`
+	AllowHostWildcardPrincipals *bool     `yaml:"allow_host_wildcard_principals"`
+	AllowUserWildcardPrincipals *bool     `yaml:"allow_user_wildcard_principals"`
+	DeniedPrincipals            *[]string `yaml:"denied_principals"`
+	UserCertOptions             *[]string `yaml:"user_cert_options"`
+	HostCertOptions             *[]string `yaml:"host_cert_options"`
+	AllowedUserExtensions       *[]string `yaml:"allowed_user_extensions"`
+	ApprovalQuorum              *int      `yaml:"approval_quorum"`
+	Approvers                   *[]string `yaml:"approvers"`
+	SensitivePrincipals         *[]string `yaml:"sensitive_principals"`
+	SensitiveValidity           *duration `yaml:"sensitive_validity"`
+	TOTPSecrets                 string    `yaml:"totp_secrets"`
+}
+
+// tenantsFile is the format of the file passed to --tenants.
+type tenantsFile struct {
+	Tenants map[string]tenantConfig `yaml:"tenants"`
+}
+
+// loadTenants reads the tenants file at path.
+func loadTenants(path string) (map[string]tenantConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenants at %s: %w", path, err)
+	}
+	var file tenantsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse tenants at %s: %w", path, err)
+	}
+	for name, tenant := range file.Tenants {
+		if tenant.PrivateKey == "" {
+			return nil, fmt.Errorf("tenant %s: private_key must be set", name)
+		}
+	}
+	return file.Tenants, nil
+}
+
+// apply opens the audit log for the server and adds the tenants. It must be
+// called once the server is otherwise configured, because tenants inherit its
+// settings. The audit logs and certificate registries of all the tenants are
+// kept by retention, and their audit events are also sent to forward.
+func (f TenantFlags) apply(server *ca.Server, retention RetentionFlags, forward ca.AuditSinks) error {
+	audit, err := openAuditSink(f.AuditLog, retention, forward)
+	if err != nil {
+		return err
+	}
+	server.Audit = audit
+	if f.TenantsFile == "" {
+		return nil
+	}
+
+	configs, err := loadTenants(f.TenantsFile)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := addTenant(server, name, configs[name], retention, forward); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTenant adds the tenant configured by config to server.
+func addTenant(server *ca.Server, name string, config tenantConfig, retention RetentionFlags, forward ca.AuditSinks) error {
+	tenant, err := server.NewTenant(name, config.PrivateKey, config.PublicKey)
+	if err != nil {
+		return err
+	}
+	if config.PassphraseFile != "" {
+		passphrase, err := ioutil.ReadFile(config.PassphraseFile)
+		if err != nil {
+			return fmt.Errorf("tenant %s: failed to read passphrase: %w", name, err)
+		}
+		tenant.SSHKeygen.Passphrase = strings.TrimRight(string(passphrase), "\r\n")
+	}
+	if err := config.applyPolicy(tenant.Policy, server.Interactor); err != nil {
+		return fmt.Errorf("tenant %s: %w", name, err)
+	}
+	tenant.KRLPath = config.KRL
+	if config.CertRegistry != "" {
+		tenant.Issued, err = retention.loadRegistry(config.CertRegistry)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+	}
+	tenant.Audit, err = openAuditSink(config.AuditLog, retention, forward)
+	if err != nil {
+		return fmt.Errorf("tenant %s: %w", name, err)
+	}
+	return nil
+}
+
+// applyPolicy overrides the parts of the policy inherited from the server
+// that the tenant sets, and checks the result. interactor confirms the
+// requests of the server, which must be the approval webhook for a quorum.
+func (config tenantConfig) applyPolicy(policy *ca.Policy, interactor ca.Interactor) error {
+	config.applyValidity(policy)
+	setBool(&policy.RequireProof.Hosts, config.RequireHostProof)
+	setBool(&policy.RequireProof.Users, config.RequireUserProof)
+	setBool(&policy.Principals.HostWildcards, config.AllowHostWildcardPrincipals)
+	setBool(&policy.Principals.UserWildcards, config.AllowUserWildcardPrincipals)
+	setList(&policy.Principals.Denied, config.DeniedPrincipals)
+	setList(&policy.Extensions.UserOptions, config.UserCertOptions)
+	setList(&policy.Extensions.HostOptions, config.HostCertOptions)
+	setList(&policy.Extensions.AllowedUserExtensions, config.AllowedUserExtensions)
+	if config.ApprovalQuorum != nil {
+		policy.Quorum.Approvals = *config.ApprovalQuorum
+	}
+	setList(&policy.Quorum.Approvers, config.Approvers)
+	setList(&policy.Quorum.Principals, config.SensitivePrincipals)
+	setDuration(&policy.Quorum.Validity, config.SensitiveValidity)
+	if config.TOTPSecrets != "" {
+		secrets, err := loadTOTPSecrets(config.TOTPSecrets)
+		if err != nil {
+			return err
+		}
+		policy.TOTP = ca.TOTPPolicy{Secrets: secrets}
+	}
+
+	if err := policy.Principals.Validate(); err != nil {
+		return err
+	}
+	if err := policy.Extensions.Validate(); err != nil {
+		return err
+	}
+	if err := policy.Quorum.Validate(); err != nil {
+		return fmt.Errorf("invalid approval quorum: %w", err)
+	}
+	if _, ok := interactor.(*notify.WebhookApprover); policy.Quorum.Approvals > 1 && !ok {
+		return fmt.Errorf("approval_quorum requires --approval-webhook, since the terminal only gives a single approval")
+	}
+	return nil
+}
+
+// applyValidity overrides the validity policies that the tenant inherits from
+// the server.
+func (config tenantConfig) applyValidity(policy *ca.Policy) {
+	setDuration(&policy.UserValidity.Default, config.UserDefaultValidity)
+	setDuration(&policy.UserValidity.Max, config.UserMaxValidity)
+	setDuration(&policy.HostValidity.Default, config.HostDefaultValidity)
+	setDuration(&policy.HostValidity.Max, config.HostMaxValidity)
+	if config.ClampValidity != nil {
+		policy.UserValidity.Clamp = *config.ClampValidity
+		policy.HostValidity.Clamp = *config.ClampValidity
+	}
+}
+
+// openAuditSink opens the audit log at path (if any), and combines it with
+// forward. It returns nil if there is nowhere to record audit events.
+func openAuditSink(path string, retention RetentionFlags, forward ca.AuditSinks) (ca.AuditSink, error) {
+	sinks := append(ca.AuditSinks(nil), forward...)
+	if path != "" {
+		log, err := ca.OpenAuditLog(path, retention.rotation())
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(ca.AuditSinks{log}, sinks...)
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return sinks, nil
+}
+
+// setDuration overrides dst if d is set.
+func setDuration(dst *time.Duration, d *duration) {
+	if d != nil {
+		*dst = time.Duration(*d)
+	}
+}
+
+// setBool overrides dst if b is set.
+func setBool(dst *bool, b *bool) {
+	if b != nil {
+		*dst = *b
+	}
+}
+
+// setList overrides dst if list is set, even to an empty list.
+func setList(dst *[]string, list *[]string) {
+	if list != nil {
+		*dst = *list
+	}
+}
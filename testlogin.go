@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// TestLoginCmd is the command that checks that a host accepts a user
+// certificate, by authenticating with it over SSH. No session is opened, so
+// nothing runs on the host.
+type TestLoginCmd struct {
+	Target                string        `arg:"--target,required" placeholder:"[USER@]HOST[:PORT]" help:"host to log in to (default user: the current user)"`
+	Key                   string        `arg:"positional" placeholder:"PUBLIC_KEY" help:"public key whose certificate to test; a bare filename is looked up in ~/.ssh (default: choose from the keys in ~/.ssh with certificates)"`
+	Certificate           string        `arg:"--cert" placeholder:"PATH" help:"certificate to test (default: the -cert.pub file of the key)"`
+	ConnectTimeout        time.Duration `arg:"--connect-timeout" default:"10s" placeholder:"DURATION" help:"timeout for connecting to the host"`
+	InsecureIgnoreHostKey bool          `arg:"--insecure-ignore-host-key" help:"don't verify the host key (by default it is checked against ~/.ssh/known_hosts and /etc/ssh/ssh_known_hosts)"`
+}
+
+// Validate implementation for Command
+func (t TestLoginCmd) Validate() error {
+	_, _, err := t.target()
+	return err
+}
+
+// target returns the user and address to log in to.
+func (t TestLoginCmd) target() (string, string, error) {
+	username, hostPort := "", t.Target
+	if at := strings.LastIndex(hostPort, "@"); at != -1 {
+		username, hostPort = hostPort[:at], hostPort[at+1:]
+	}
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(strings.Trim(hostPort, "[]"), "22")
+	}
+	if hostPort == ":22" {
+		return "", "", fmt.Errorf("--target must include a host")
+	}
+	return username, hostPort, nil
+}
+
+// Run implementation for Command
+func (t TestLoginCmd) Run() error {
+	username, addr, _ := t.target()
+	u, err := targetUser("")
+	if err != nil {
+		return err
+	}
+	if username == "" {
+		username = usernameOf(u)
+	}
+	keyPath, err := certifiedKeyPath(t.Key, u)
+	if err != nil {
+		return err
+	}
+	certPath := t.Certificate
+	if certPath == "" {
+		certPath = getCertificatePath(keyPath)
+	}
+
+	publicKey, err := ca.NewPublicKey(keyPath)
+	if err != nil {
+		return err
+	}
+	cert, err := readCertificate(certPath)
+	if err != nil {
+		return err
+	}
+	for _, problem := range certificateProblems(cert, publicKey, username, time.Now()) {
+		out.warning(problem)
+	}
+
+	signer, closeAgent := agentSigner(publicKey)
+	defer closeAgent()
+	if signer == nil {
+		signer, err = fileSigner(privateKeyPath(keyPath), publicKey)
+		if err != nil {
+			return err
+		}
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return fmt.Errorf("failed to use %s with its key: %w", certPath, err)
+	}
+	hostKeyCallback, err := t.hostKeyCallback(u)
+	if err != nil {
+		return err
+	}
+
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(certSigner)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         t.ConnectTimeout,
+	})
+	if err != nil {
+		fmt.Printf("%s  login as %s to %s with %s: %s\n", out.label(colorRed, "FAIL"), username, addr, certPath, err)
+		for _, hint := range loginFailureHints(err, username, addr) {
+			fmt.Printf("      %s\n", hint)
+		}
+		return fmt.Errorf("test login failed")
+	}
+	conn.Close()
+	fmt.Printf("%s    login as %s to %s with %s (key ID %q)\n", out.label(colorGreen, "ok"), username, addr, certPath, cert.KeyId)
+	return nil
+}
+
+// hostKeyCallback verifies the host key with the user's and the system's known
+// hosts, which includes host certificates from trusted CAs.
+func (t TestLoginCmd) hostKeyCallback(u *user.User) (ssh.HostKeyCallback, error) {
+	if t.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	var files []string
+	candidates := []string{knownHostsPath}
+	if dir, err := userSSHDir(u); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "known_hosts"))
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no known hosts files to verify the host key with (run sshca trust, or pass --insecure-ignore-host-key)")
+	}
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+	return callback, nil
+}
+
+// readCertificate reads the certificate at path.
+func readCertificate(path string) (*ssh.Certificate, error) {
+	certificate, err := ca.NewPublicKey(path)
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(certificate.Marshal())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate at %s: %w", path, err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", path)
+	}
+	return cert, nil
+}
+
+// certificateProblems returns the reasons that sshd will reject cert for
+// logging in as username, which can be found without connecting.
+func certificateProblems(cert *ssh.Certificate, publicKey *ca.PublicKey, username string, now time.Time) []string {
+	var problems []string
+	if cert.CertType != ssh.UserCert {
+		problems = append(problems, "the certificate is not a user certificate")
+	}
+	if !publicKey.Matches(cert.Key) {
+		problems = append(problems, "the certificate is not for the key")
+	}
+	if !certificateValidAt(cert, now) {
+		problems = append(problems, "the certificate is not valid now (sign the key again)")
+	}
+	if len(cert.ValidPrincipals) != 0 && !hasPrincipal(cert, username) {
+		problems = append(problems, fmt.Sprintf("the certificate principals (%s) don't include %s (sign it with -n %s)", strings.Join(cert.ValidPrincipals, ","), username, username))
+	}
+	return problems
+}
+
+// loginFailureHints explains what to look for when the login failed with err.
+func loginFailureHints(err error, username, addr string) []string {
+	var keyErr *knownhosts.KeyError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &keyErr) && len(keyErr.Want) == 0:
+		return []string{"the host key is unknown: trust the CA for host keys (sshca trust) and sign the host keys (sshca sign_host), or add the host to known_hosts"}
+	case errors.As(err, &keyErr):
+		return []string{"the host key doesn't match known_hosts: check for a reinstalled host or a man-in-the-middle before updating known_hosts"}
+	case errors.As(err, &netErr), strings.Contains(err.Error(), "connect"):
+		return []string{fmt.Sprintf("check that sshd is running on %s and that it is reachable from here", addr)}
+	case strings.Contains(err.Error(), "unable to authenticate"):
+		return []string{
+			"sshd rejected the certificate; the reason is in its auth log (journalctl -u ssh -u sshd, or /var/log/auth.log):",
+			"  a message about the CA of the certificate: the host doesn't trust the CA (run sshca trust on it)",
+			fmt.Sprintf("  \"name is not a listed principal\": the certificate isn't valid for %s (sign it with -n %s)", username, username),
+			"  \"expired\" or \"not yet valid\": sign the key again, or check that the clocks agree",
+			"  \"AuthorizedPrincipalsFile\" or \"not from a permitted host\": the principals file or from= option of the host doesn't allow this login",
+		}
+	default:
+		return nil
+	}
+}
+
+// hasPrincipal reports whether principal is one of the principals of cert.
+func hasPrincipal(cert *ssh.Certificate, principal string) bool {
+	for _, p := range cert.ValidPrincipals {
+		if p == principal {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/verify"
+	"golang.org/x/crypto/ssh"
+)
+
+// TokenCmd is the command that makes a bearer token from a user certificate,
+// for services that verify certificates with the verify package (or sshca
+// verify_token).
+type TokenCmd struct {
+	Key         string `arg:"positional" placeholder:"PUBLIC_KEY" help:"public key whose certificate to use; a bare filename is looked up in ~/.ssh (default: choose from the keys in ~/.ssh with certificates)"`
+	Certificate string `arg:"--cert" placeholder:"PATH" help:"certificate to use (default: the -cert.pub file of the key)"`
+	Audience    string `arg:"--audience" placeholder:"AUDIENCE" help:"service that the token is for (e.g. its URL), which must match the audience it verifies tokens with"`
+}
+
+// Validate implementation for Command
+func (t TokenCmd) Validate() error {
+	return nil
+}
+
+// Run implementation for Command
+func (t TokenCmd) Run() error {
+	u, err := targetUser("")
+	if err != nil {
+		return err
+	}
+	keyPath, err := certifiedKeyPath(t.Key, u)
+	if err != nil {
+		return err
+	}
+	certPath := t.Certificate
+	if certPath == "" {
+		certPath = getCertificatePath(keyPath)
+	}
+	publicKey, err := ca.NewPublicKey(keyPath)
+	if err != nil {
+		return err
+	}
+	cert, err := readCertificate(certPath)
+	if err != nil {
+		return err
+	}
+	if !publicKey.Matches(cert.Key) {
+		return fmt.Errorf("the certificate at %s is not for the key at %s", certPath, keyPath)
+	}
+
+	// The token is only valid for a few minutes, so warn about the
+	// certificate instead of the token expiring
+	if cert.ValidBefore != ssh.CertTimeInfinity && time.Now().Unix() >= int64(cert.ValidBefore) {
+		out.warning(fmt.Sprintf("the certificate at %s has expired (renew it with sign_user)", certPath))
+	}
+
+	signer, closeAgent := agentSigner(publicKey)
+	defer closeAgent()
+	if signer == nil {
+		if signer, err = fileSigner(privateKeyPath(keyPath), publicKey); err != nil {
+			return err
+		}
+	}
+	token, err := verify.NewToken(signer, cert, t.Audience, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
+// VerifyTokenCmd is the command that verifies a token made with sshca token,
+// as a service would with the verify package.
+type VerifyTokenCmd struct {
+	Token         string        `arg:"positional" placeholder:"TOKEN" help:"token to verify, optionally prefixed with \"Bearer \" (default: read from stdin)"`
+	CAKeys        string        `arg:"--ca-keys,required" placeholder:"PATH" help:"file with the trusted CA keys, like sshd TrustedUserCAKeys (e.g. from sshca export)"`
+	KRL           string        `arg:"--krl" placeholder:"PATH" help:"key revocation list of the CA (e.g. from sshca sync_krl)"`
+	Principal     string        `arg:"--principal" placeholder:"PRINCIPAL" help:"principal that the certificate must be valid for"`
+	Audience      string        `arg:"--audience" placeholder:"AUDIENCE" help:"audience that the token must be for"`
+	MaxAge        time.Duration `arg:"--max-age" default:"5m" placeholder:"DURATION" help:"how long a token can be used for after it is made"`
+	SourceAddress string        `arg:"--source-address" placeholder:"IP" help:"address of the client that presented the token, for certificates restricted with source-address"`
+}
+
+// Validate implementation for Command
+func (v VerifyTokenCmd) Validate() error {
+	if v.SourceAddress != "" && net.ParseIP(v.SourceAddress) == nil {
+		return fmt.Errorf("invalid --source-address %q", v.SourceAddress)
+	}
+	if v.MaxAge <= 0 {
+		return fmt.Errorf("--max-age must be positive")
+	}
+	return nil
+}
+
+// Run implementation for Command
+func (v VerifyTokenCmd) Run() error {
+	verifier := verify.Verifier{Audience: v.Audience, MaxTokenAge: v.MaxAge}
+	var err error
+	if verifier.CAKeys, err = verify.LoadCAKeys(v.CAKeys); err != nil {
+		return err
+	}
+	if v.KRL != "" {
+		if verifier.KRL, err = verify.LoadKRL(v.KRL); err != nil {
+			return err
+		}
+	}
+
+	token := v.Token
+	if token == "" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read token: %w", err)
+		}
+		token = string(data)
+	}
+	cert, err := verifier.VerifyToken(token, v.Principal, net.ParseIP(v.SourceAddress))
+	if err != nil {
+		return fmt.Errorf("token is invalid: %w", err)
+	}
+
+	out.success("token is valid")
+	fmt.Printf("key ID:     %s\n", cert.KeyId)
+	fmt.Printf("serial:     %d\n", cert.Serial)
+	fmt.Printf("principals: %s\n", strings.Join(cert.ValidPrincipals, ","))
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		fmt.Printf("expires:    never\n")
+	} else {
+		fmt.Printf("expires:    %s\n", time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+	"gopkg.in/yaml.v2"
+)
+
+// totpSecretsFile is the format of the file passed to server --totp-secrets.
+type totpSecretsFile struct {
+	// Clients maps client names to their base32 secrets.
+	Clients map[string]string `yaml:"clients"`
+}
+
+// loadTOTPSecrets reads the client secrets file at path.
+func loadTOTPSecrets(path string) (map[string][]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TOTP secrets at %s: %w", path, err)
+	}
+	var file totpSecretsFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse TOTP secrets at %s: %w", path, err)
+	}
+	if len(file.Clients) == 0 {
+		return nil, fmt.Errorf("no clients in TOTP secrets at %s", path)
+	}
+	secrets := make(map[string][]byte, len(file.Clients))
+	for client, encoded := range file.Clients {
+		secret, err := ca.DecodeTOTPSecret(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("client %s in %s: %w", client, path, err)
+		}
+		secrets[client] = secret
+	}
+	return secrets, nil
+}
+
+// readTOTPSecret reads a base32 secret from the file at path.
+func readTOTPSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TOTP secret: %w", err)
+	}
+	return ca.DecodeTOTPSecret(string(data))
+}
+
+// TOTPSecretCmd is the command that generates the shared secret of a client
+// for a server started with --totp-secrets.
+type TOTPSecretCmd struct {
+	Client string `arg:"positional,required" help:"name of the client, which it passes to --totp-client"`
+	Issuer string `arg:"--issuer" default:"sshca" help:"issuer shown by authenticator apps"`
+}
+
+// Validate implementation for Command
+func (t TOTPSecretCmd) Validate() error {
+	if t.Client == "" || strings.ContainsAny(t.Client, ": \t\n") {
+		return fmt.Errorf("invalid client name %q", t.Client)
+	}
+	return nil
+}
+
+// Run implementation for Command
+func (t TOTPSecretCmd) Run() error {
+	secret, err := ca.NewTOTPSecret()
+	if err != nil {
+		return err
+	}
+	encoded := ca.EncodeTOTPSecret(secret)
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + t.Issuer + ":" + t.Client,
+		RawQuery: url.Values{"secret": {encoded}, "issuer": {t.Issuer}, "period": {fmt.Sprint(int(ca.TOTPStep / time.Second))}}.Encode(),
+	}
+	out.progress("add this line under clients: in the server's --totp-secrets file")
+	fmt.Printf("  %s: %s\n", t.Client, encoded)
+	out.progress("and give the client the secret (for --totp-secret-file) or this URI for an authenticator app")
+	fmt.Println(uri.String())
+	return nil
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/ratorx/sshca/ca"
 	"github.com/ratorx/sshca/sshd"
@@ -11,56 +15,228 @@ import (
 // user and host authentication.
 type TrustCmd struct {
 	RPCFlags
+	CASignatureFlags
+	SSHDPath      string    `arg:"--sshd" default:"sshd" placeholder:"PATH" help:"path to sshd"`
+	FileMode      fileMode  `arg:"--file-mode" default:"0644" placeholder:"MODE" help:"permissions of the trusted CA and known hosts files"`
+	FileOwner     fileOwner `arg:"--file-owner" placeholder:"USER[:GROUP]" help:"owner of the trusted CA and known hosts files"`
+	HostsPatterns []string  `arg:"--hosts-pattern,separate" placeholder:"PATTERN" help:"known hosts pattern of the hosts to trust the CA for, can be repeated for one @cert-authority line each (default: *)"`
+	SubCAs        bool      `arg:"--sub-cas" help:"also trust the sub-CAs endorsed by the CA (see cross_certify)"`
+	HashHosts     bool      `arg:"--hash-known-hosts" help:"hash the hostnames in known hosts entries like HashKnownHosts (automatic if the file already has hashed entries; wildcard patterns are never hashed)"`
+	// Trusting the CA in authorized_keys works without root, for hosts where
+	// sshd_config can't be changed
+	AuthorizedKeys       bool               `arg:"--authorized-keys" help:"only trust the CA for user authentication as one user, with a cert-authority line in their ~/.ssh/authorized_keys instead of sshd_config"`
+	AsUser               string             `arg:"--as-user" placeholder:"USER" help:"user whose authorized_keys to change (default: the invoking user under sudo, otherwise the current user)"`
+	AuthorizedPrincipals CommaSeparatedList `arg:"--authorized-principals" placeholder:"PRINCIPALS" help:"only accept certificates for these principals (comma-separated; default: the user name)"`
+	From                 string             `arg:"--from" placeholder:"PATTERNS" help:"only accept certificates from these hosts (comma-separated patterns, like from= in authorized_keys)"`
+	// Writing into a root directory instead of / bakes the trust into
+	// container or VM images
+	OutputDir string `arg:"--output-dir" placeholder:"DIR" help:"write the trust files under this root directory (e.g. an image being built) instead of the live filesystem; sshd isn't run"`
+	// Settings that stop certificate logins are only warned about, unless
+	// the flags ask to change them
+	EnablePubkeyAuthentication bool   `arg:"--enable-pubkey-authentication" help:"set PubkeyAuthentication yes in sshd_config, without which certificates can't log in"`
+	PermitRootLogin            string `arg:"--permit-root-login" placeholder:"VALUE" help:"set PermitRootLogin in sshd_config (e.g. prohibit-password, which lets root log in with certificates but not passwords)"`
 }
 
-func (t TrustCmd) trustAsUserCA(publicKey *ca.PublicKey) error {
-	err := appendIfNotPresent("/etc/ssh/trusted_cas", publicKey.Marshal())
+// knownHostsPath is the system-wide known hosts file.
+const knownHostsPath = "/etc/ssh/ssh_known_hosts"
+
+// trustedCAsPath is the TrustedUserCAKeys file of the trusted user CAs.
+const trustedCAsPath = "/etc/ssh/trusted_cas"
+
+// sshdSnippetPath is the sshd_config snippet that --output-dir writes when the
+// root directory has no sshd_config of its own.
+const sshdSnippetPath = "/etc/ssh/sshd_config.d/50-sshca.conf"
+
+// path returns where to write the file at the absolute path p: under
+// --output-dir if it is set. The files themselves always refer to each other
+// by their paths in the live filesystem, since that is where they end up.
+func (t TrustCmd) path(p string) string {
+	if t.OutputDir == "" {
+		return p
+	}
+	return filepath.Join(t.OutputDir, p)
+}
+
+func (t TrustCmd) fileOptions() fileOptions {
+	return fileOptions{mode: os.FileMode(t.FileMode), owner: t.FileOwner}
+}
+
+// trustAsUserCA trusts publicKey, which signs with algorithm (empty if it is
+// unknown), for user authentication.
+func (t TrustCmd) trustAsUserCA(publicKey *ca.PublicKey, algorithm string) error {
+	err := appendIfNotPresent(t.path(trustedCAsPath), publicKey.Marshal(), t.fileOptions())
 	if err != nil {
 		return fmt.Errorf("failed to add key to trusted CAs: %w", err)
 	}
 
-	sshdConfig := sshd.Modifier{ConfigPath: "/etc/ssh/sshd_config"}
-	sshdConfig.SetUnique("TrustedUserCAKeys", "/etc/ssh/trusted_cas")
-	sshdConfig.Commit()
-	if err != nil {
+	if err := t.setTrustedUserCAKeys(algorithm); err != nil {
 		return fmt.Errorf("unable set TrustedUserCAKeys: %w", err)
 	}
 
-	fmt.Printf("trusted public key (fingerprint %s) as authority for user authentication\n", publicKey.Fingerprint())
+	out.success("trusted public key (fingerprint %s) as authority for user authentication", publicKey.Fingerprint())
+	return nil
+}
+
+// setTrustedUserCAKeys points sshd at the trusted CAs file, and makes it
+// accept the signatures of a CA that signs with algorithm. Under --output-dir,
+// the sshd_config of the root directory is changed without testing it (its
+// sshd isn't the one on this machine, so only --ca-signature-algorithms is
+// set), or a snippet is written for an sshd_config that includes
+// sshd_config.d if there isn't one.
+func (t TrustCmd) setTrustedUserCAKeys(algorithm string) error {
+	sshdConfig := sshd.Modifier{ConfigPath: t.path(defaultSSHDConfigPath)}
+	algorithms := []string{algorithm}
+	if t.OutputDir != "" {
+		if _, err := os.Stat(sshdConfig.ConfigPath); os.IsNotExist(err) {
+			return t.writeSSHDSnippet()
+		}
+		sshdConfig.Tester = sshd.ConfigTesterFunc(func(string) error { return nil })
+		algorithms = nil
+	}
+	sshdConfig.SetUnique("TrustedUserCAKeys", trustedCAsPath)
+	t.fixSSHD(&sshdConfig)
+	loadConfig := func() (*sshd.EffectiveConfig, error) { return sshd.LoadEffectiveConfig(sshdConfig.ConfigPath) }
+	if err := t.CASignatureFlags.apply(&sshdConfig, t.SSHDPath, loadConfig, algorithms); err != nil {
+		return err
+	}
+	return sshdConfig.Commit()
+}
+
+// writeSSHDSnippet writes the sshd_config snippet that sets TrustedUserCAKeys
+// under --output-dir.
+func (t TrustCmd) writeSSHDSnippet() error {
+	snippetPath := t.path(sshdSnippetPath)
+	if err := os.MkdirAll(filepath.Dir(snippetPath), 0o755); err != nil {
+		return err
+	}
+	snippet := fmt.Sprintf("# Written by sshca trust\nTrustedUserCAKeys %s\n", trustedCAsPath)
+	if algorithms := t.CASignatureAlgorithms; algorithms != "" && algorithms != keepCASignatureAlgorithms {
+		snippet += fmt.Sprintf("CASignatureAlgorithms %s\n", algorithms)
+	}
+	if t.EnablePubkeyAuthentication {
+		snippet += "PubkeyAuthentication yes\n"
+	}
+	if t.PermitRootLogin != "" {
+		snippet += fmt.Sprintf("PermitRootLogin %s\n", t.PermitRootLogin)
+	}
+	if err := writeFile(snippetPath, []byte(snippet), t.fileOptions()); err != nil {
+		return err
+	}
+	out.success("wrote %s, which is only used if sshd_config has 'Include %s'", snippetPath, filepath.Join(filepath.Dir(sshdSnippetPath), "*.conf"))
 	return nil
 }
 
 func (t TrustCmd) trustAsHostCA(publicKey *ca.PublicKey) error {
-	err := appendIfNotPresent("/etc/ssh/ssh_known_hosts", []byte(fmt.Sprintf("@cert-authority * %s", publicKey)))
-	if err != nil {
-		return fmt.Errorf("failed to add key to SSH known hosts: %w", err)
+	patterns := t.HostsPatterns
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+	contents, _ := ioutil.ReadFile(t.path(knownHostsPath))
+	hash := t.HashHosts || usesHashedHosts(contents)
+	updated, changed := updateCertAuthorities(contents, patterns, publicKey, hash)
+	if changed {
+		err := writeFile(t.path(knownHostsPath), updated, t.fileOptions())
+		if err != nil {
+			return fmt.Errorf("failed to add key to SSH known hosts: %w", err)
+		}
 	}
 
-	fmt.Printf("trusted public key (fingerprint %s) as authority for host authentication\n", publicKey.Fingerprint())
+	out.success("trusted public key (fingerprint %s) as authority for host authentication of %s", publicKey.Fingerprint(), strings.Join(patterns, ", "))
 	return nil
 }
 
 // Validate implementation for Command
 func (t TrustCmd) Validate() error {
+	if !t.AuthorizedKeys && (t.AsUser != "" || len(t.AuthorizedPrincipals.Items) != 0 || t.From != "") {
+		return fmt.Errorf("--as-user, --authorized-principals and --from require --authorized-keys")
+	}
+	for _, value := range append([]string{t.From}, t.AuthorizedPrincipals.Items...) {
+		if strings.ContainsAny(value, "\"\n\\ ") {
+			return fmt.Errorf("invalid authorized_keys option value %q", value)
+		}
+	}
+	if t.AuthorizedKeys && t.CASignatureAlgorithms != "" {
+		return fmt.Errorf("--ca-signature-algorithms can't be used with --authorized-keys, which doesn't change sshd_config")
+	}
+	if err := t.CASignatureFlags.Validate(); err != nil {
+		return err
+	}
+	if err := t.validateSSHDFixes(); err != nil {
+		return err
+	}
+	if t.OutputDir != "" {
+		if t.AuthorizedKeys {
+			return fmt.Errorf("--output-dir can't be used with --authorized-keys")
+		}
+		if info, err := os.Stat(t.OutputDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("--output-dir %s is not a directory", t.OutputDir)
+		}
+	}
+	for _, pattern := range t.HostsPatterns {
+		if pattern == "" || strings.ContainsAny(pattern, " \t,") {
+			return fmt.Errorf("invalid --hosts-pattern %q: patterns can't be empty or contain whitespace or commas", pattern)
+		}
+	}
 	return t.RPCFlags.Validate()
 }
 
 // Run implementation for Command
 func (t TrustCmd) Run() error {
+	if t.AuthorizedKeys {
+		return t.runAuthorizedKeys()
+	}
+	if t.OutputDir == "" {
+		useSSHD(t.SSHDPath)
+	} else if err := os.MkdirAll(t.path("/etc/ssh"), 0o755); err != nil {
+		return err
+	}
 	client, err := t.RPCFlags.MakeClient()
 	if err != nil {
 		return err
 	}
 
-	publicKeyReply, err := client.GetCAPublicKey()
+	publicKeys, err := trustedCAs(client, t.SubCAs)
 	if err != nil {
-		return fmt.Errorf("failed to fetch public key from server: %w", err)
+		return err
 	}
+	algorithms := caSignatureAlgorithms(client, publicKeys)
+
+	for i, publicKey := range publicKeys {
+		err = t.trustAsHostCA(publicKey)
+		if err != nil {
+			return err
+		}
 
-	err = t.trustAsHostCA(publicKeyReply.CAPublicKey)
+		err = t.trustAsUserCA(publicKey, algorithms[i])
+		if err != nil {
+			return err
+		}
+	}
+	if t.OutputDir == "" {
+		t.checkSSHD()
+	}
+	return nil
+}
+
+// runAuthorizedKeys trusts the CAs for user authentication as a single user.
+func (t TrustCmd) runAuthorizedKeys() error {
+	u, err := targetUser(t.AsUser)
+	if err != nil {
+		return err
+	}
+	client, err := t.RPCFlags.MakeClient()
 	if err != nil {
 		return err
 	}
 
-	return t.trustAsUserCA(publicKeyReply.CAPublicKey)
+	publicKeys, err := trustedCAs(client, t.SubCAs)
+	if err != nil {
+		return err
+	}
+	for _, publicKey := range publicKeys {
+		if err := t.trustInAuthorizedKeys(publicKey, u); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Helpers for user certificate operations. These must work on any client OS,
+// so they never depend on sshd.
+
+// targetUser returns the user that user certificates are for. Under sudo, this
+// is the user that invoked sudo rather than root. A non-empty asUser
+// overrides the detection.
+func targetUser(asUser string) (*user.User, error) {
+	if asUser != "" {
+		return lookupUser(asUser)
+	}
+
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" && os.Geteuid() == 0 {
+		if u, err := user.Lookup(sudoUser); err == nil {
+			return u, nil
+		}
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current user: %w", err)
+	}
+	return u, nil
+}
+
+// usernameOf returns the name of the user, without the domain that Windows
+// prefixes (DOMAIN\user).
+func usernameOf(u *user.User) string {
+	username := u.Username
+	if i := strings.LastIndex(username, `\`); i != -1 {
+		username = username[i+1:]
+	}
+	return username
+}
+
+// ownerOf returns the file owner for files written on behalf of u. Files for
+// the current user keep the default ownership.
+func ownerOf(u *user.User) fileOwner {
+	if current, err := user.Current(); err == nil && current.Uid == u.Uid {
+		return fileOwner{}
+	}
+	uid, uidErr := strconv.Atoi(u.Uid)
+	gid, gidErr := strconv.Atoi(u.Gid)
+	if uidErr != nil || gidErr != nil {
+		// Windows SIDs can't be used for ownership
+		return fileOwner{}
+	}
+	return fileOwner{true, uid, gid}
+}
+
+// resolvePublicKeyPath finds the public key at keyPath. A bare filename that
+// doesn't exist in the working directory is looked up in the SSH directory of
+// u, so "id_ed25519.pub" finds ~/.ssh/id_ed25519.pub.
+func resolvePublicKeyPath(keyPath string, u *user.User) (string, error) {
+	if _, err := os.Stat(keyPath); err == nil || filepath.Base(keyPath) != keyPath {
+		return keyPath, nil
+	}
+
+	dir, err := userSSHDir(u)
+	if err != nil {
+		return "", err
+	}
+	candidate := filepath.Join(dir, keyPath)
+	if _, err := os.Stat(candidate); err != nil {
+		return "", fmt.Errorf("public key %s not found in the working directory or %s", keyPath, dir)
+	}
+	return candidate, nil
+}
+
+// discoverUserKeys finds the default user public keys (id_*.pub) in the SSH
+// directory of u.
+func discoverUserKeys(u *user.User) ([]string, error) {
+	dir, err := userSSHDir(u)
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "id_*.pub"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to search for keys in %s: %w", dir, err)
+	}
+	keys := make([]string, 0, len(matches))
+	for _, match := range matches {
+		// id_*.pub also matches certificates from previous runs
+		if !strings.HasSuffix(match, "-cert.pub") {
+			keys = append(keys, match)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no id_*.pub keys found in %s", dir)
+	}
+	return keys, nil
+}
+
+// certifiedKeyPath returns the path of the public key key, or if it is empty,
+// the default key of u that has a certificate (asking which if there are
+// several).
+func certifiedKeyPath(key string, u *user.User) (string, error) {
+	if key != "" {
+		return resolvePublicKeyPath(key, u)
+	}
+	keys, err := discoverUserKeys(u)
+	if err != nil {
+		return "", err
+	}
+	var certified []string
+	for _, key := range keys {
+		if _, err := os.Stat(getCertificatePath(key)); err == nil {
+			certified = append(certified, key)
+		}
+	}
+	switch len(certified) {
+	case 0:
+		return "", fmt.Errorf("none of the keys in %s has a certificate (sign one with sign_user)", filepath.Dir(keys[0]))
+	case 1:
+		return certified[0], nil
+	default:
+		return chooseKey(certified, os.Stdin, os.Stderr)
+	}
+}
+
+// chooseKey asks the user to choose one of keys by number.
+func chooseKey(keys []string, in io.Reader, out io.Writer) (string, error) {
+	fmt.Fprintln(out, "found multiple keys (use --all to sign all of them):")
+	for i, key := range keys {
+		fmt.Fprintf(out, "  %d) %s\n", i+1, key)
+	}
+	fmt.Fprintf(out, "choose a key to sign [1-%d]: ", len(keys))
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read key choice: %w", err)
+	}
+	choice, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || choice < 1 || choice > len(keys) {
+		return "", fmt.Errorf("invalid key choice %q", strings.TrimSpace(line))
+	}
+	return keys[choice-1], nil
+}
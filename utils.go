@@ -1,11 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
-	"io/ioutil"
-	"os"
 	"strings"
+
+	"github.com/ratorx/sshca/ca"
+	"github.com/ratorx/sshca/openssh"
 )
 
 // CommaSeparatedList represents a comma-separated list passed into the command
@@ -21,22 +20,26 @@ func (csl *CommaSeparatedList) UnmarshalText(b []byte) error {
 	return nil
 }
 
-func appendIfNotPresent(filename string, toAppend []byte) error {
-	contents, _ := ioutil.ReadFile(filename)
-
-	if bytes.Contains(contents, toAppend) {
-		return nil
-	}
-
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+// detectSSHKeygen detects the version of the ssh-keygen at path, and warns
+// about features it doesn't support.
+func detectSSHKeygen(path string) ca.SSHKeygen {
+	sshKeygen, err := ca.DetectSSHKeygen(path)
 	if err != nil {
-		return fmt.Errorf("unable to open %s for appending: %w", filename, err)
+		out.warning(err.Error())
+		return sshKeygen
 	}
-
-	_, err = f.Write(toAppend)
-	if err != nil {
-		return fmt.Errorf("failed to append to %s: %w", filename, err)
+	for _, warning := range sshKeygen.Version.Warnings(openssh.SSHKeygenFeatures) {
+		out.warning(warning)
 	}
+	return sshKeygen
+}
 
-	return nil
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
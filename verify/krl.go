@@ -0,0 +1,268 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Parsing of OpenSSH key revocation lists (as written by ssh-keygen -k), in the
+// format described by PROTOCOL.krl in the OpenSSH source.
+
+const krlMagic = "SSHKRL\n\x00"
+
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+)
+
+const (
+	krlCertSerialList   = 0x20
+	krlCertSerialRange  = 0x21
+	krlCertSerialBitmap = 0x22
+	krlCertKeyID        = 0x23
+)
+
+// KRL is a parsed key revocation list.
+type KRL struct {
+	// Version is the version number of the KRL, which ssh-keygen increments
+	// each time it is updated.
+	Version uint64
+	// certificates are the revoked certificates, keyed by the wire format of
+	// the CA key, or "" for certificates of any CA.
+	certificates map[string]*revokedCertificates
+	keys         map[string]bool
+	sha1         map[string]bool
+	sha256       map[string]bool
+}
+
+// revokedCertificates are the certificates of a CA that are revoked.
+type revokedCertificates struct {
+	serials []serialRange
+	keyIDs  map[string]bool
+}
+
+// serialRange is an inclusive range of serial numbers.
+type serialRange struct {
+	min, max uint64
+}
+
+// LoadKRL reads and parses the KRL at path.
+func LoadKRL(path string) (*KRL, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read KRL at %s: %w", path, err)
+	}
+	krl, err := ParseKRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse KRL at %s: %w", path, err)
+	}
+	return krl, nil
+}
+
+// ParseKRL parses a KRL in the binary format of ssh-keygen -k. Signatures on
+// the KRL are not verified.
+func ParseKRL(data []byte) (*KRL, error) {
+	if !bytes.HasPrefix(data, []byte(krlMagic)) {
+		return nil, fmt.Errorf("not a KRL")
+	}
+	r := &krlReader{data: data[len(krlMagic):]}
+	if formatVersion := r.uint32(); r.err == nil && formatVersion != 1 {
+		return nil, fmt.Errorf("unsupported KRL format version %d", formatVersion)
+	}
+	krl := &KRL{
+		Version:      r.uint64(),
+		certificates: make(map[string]*revokedCertificates),
+		keys:         make(map[string]bool),
+		sha1:         make(map[string]bool),
+		sha256:       make(map[string]bool),
+	}
+	r.uint64() // generated date
+	r.uint64() // flags
+	r.string() // reserved
+	r.string() // comment
+
+	for r.err == nil && len(r.data) > 0 {
+		sectionType := r.byte()
+		section := &krlReader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+		switch sectionType {
+		case krlSectionCertificates:
+			if err := krl.parseCertificates(section); err != nil {
+				return nil, err
+			}
+		case krlSectionExplicitKey:
+			for section.err == nil && len(section.data) > 0 {
+				krl.keys[string(section.string())] = true
+			}
+		case krlSectionFingerprintSHA1:
+			for section.err == nil && len(section.data) > 0 {
+				krl.sha1[string(section.string())] = true
+			}
+		case krlSectionFingerprintSHA256:
+			for section.err == nil && len(section.data) > 0 {
+				krl.sha256[string(section.string())] = true
+			}
+		case krlSectionSignature:
+			// Signatures come last, and cover everything before them
+			return krl, nil
+		default:
+			return nil, fmt.Errorf("unsupported KRL section type %d", sectionType)
+		}
+		if section.err != nil {
+			return nil, section.err
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return krl, nil
+}
+
+// parseCertificates parses a section of revoked certificates.
+func (k *KRL) parseCertificates(r *krlReader) error {
+	caKey := string(r.string())
+	r.string() // reserved
+	revoked := k.certificates[caKey]
+	if revoked == nil {
+		revoked = &revokedCertificates{keyIDs: make(map[string]bool)}
+		k.certificates[caKey] = revoked
+	}
+
+	for r.err == nil && len(r.data) > 0 {
+		subsectionType := r.byte()
+		subsection := &krlReader{data: r.string()}
+		if r.err != nil {
+			break
+		}
+		switch subsectionType {
+		case krlCertSerialList:
+			for subsection.err == nil && len(subsection.data) > 0 {
+				serial := subsection.uint64()
+				revoked.serials = append(revoked.serials, serialRange{serial, serial})
+			}
+		case krlCertSerialRange:
+			revoked.serials = append(revoked.serials, serialRange{subsection.uint64(), subsection.uint64()})
+		case krlCertSerialBitmap:
+			offset := subsection.uint64()
+			bitmap := new(big.Int).SetBytes(subsection.string())
+			for i := 0; i < bitmap.BitLen(); i++ {
+				if bitmap.Bit(i) == 1 {
+					serial := offset + uint64(i)
+					revoked.serials = append(revoked.serials, serialRange{serial, serial})
+				}
+			}
+		case krlCertKeyID:
+			for subsection.err == nil && len(subsection.data) > 0 {
+				revoked.keyIDs[string(subsection.string())] = true
+			}
+		default:
+			return fmt.Errorf("unsupported KRL certificate section type %d", subsectionType)
+		}
+		if subsection.err != nil {
+			return subsection.err
+		}
+	}
+	return r.err
+}
+
+// IsRevoked reports whether the certificate, its key or the key of its CA is
+// revoked, as sshd would check with RevokedKeys.
+func (k *KRL) IsRevoked(cert *ssh.Certificate) bool {
+	if k.isKeyRevoked(cert.Key) || k.isKeyRevoked(cert.SignatureKey) {
+		return true
+	}
+	for _, caKey := range []string{string(cert.SignatureKey.Marshal()), ""} {
+		revoked := k.certificates[caKey]
+		if revoked == nil {
+			continue
+		}
+		if revoked.keyIDs[cert.KeyId] {
+			return true
+		}
+		// Serial 0 means that the certificate has no serial, so it can only
+		// be revoked by key ID
+		if cert.Serial == 0 {
+			continue
+		}
+		for _, serials := range revoked.serials {
+			if cert.Serial >= serials.min && cert.Serial <= serials.max {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isKeyRevoked reports whether the plain key is revoked, explicitly or by
+// fingerprint.
+func (k *KRL) isKeyRevoked(key ssh.PublicKey) bool {
+	blob := key.Marshal()
+	sha1Sum := sha1.Sum(blob)
+	sha256Sum := sha256.Sum256(blob)
+	return k.keys[string(blob)] || k.sha1[string(sha1Sum[:])] || k.sha256[string(sha256Sum[:])]
+}
+
+// krlReader reads the SSH wire format encoding of a KRL. The first error is
+// kept in err, after which reads return zero values.
+type krlReader struct {
+	data []byte
+	err  error
+}
+
+func (r *krlReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data) < n {
+		r.err = fmt.Errorf("truncated KRL")
+		return nil
+	}
+	next := r.data[:n]
+	r.data = r.data[n:]
+	return next
+}
+
+func (r *krlReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *krlReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *krlReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *krlReader) string() []byte {
+	length := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(length) > uint64(len(r.data)) {
+		r.err = fmt.Errorf("truncated KRL")
+		return nil
+	}
+	return r.next(int(length))
+}
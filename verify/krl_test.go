@@ -0,0 +1,62 @@
+package verify
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testdata/krl was made with ssh-keygen -k -s testdata/ca.pub from a spec that
+// revokes serials 2-3, 10 and every other serial from 200 to 240, the key ID
+// revoked-id, testdata/revoked.pub and the fingerprint of
+// testdata/fingerprint.pub.
+
+func TestKRLRevokedSerials(t *testing.T) {
+	krl, err := LoadKRL("./testdata/krl")
+	assert.Nil(t, err)
+	key := newKey(t).PublicKey()
+	for serial, revoked := range map[uint64]bool{0: false, 1: false, 2: true, 3: true, 4: false, 10: true, 199: false, 200: true, 201: false, 240: true, 242: false} {
+		cert := newCert(t, key, func(cert *ssh.Certificate) { cert.Serial = serial })
+		assert.Equal(t, revoked, krl.IsRevoked(cert), "serial %d", serial)
+	}
+}
+
+func TestKRLRevokedKeyID(t *testing.T) {
+	krl, err := LoadKRL("./testdata/krl")
+	assert.Nil(t, err)
+	cert := newCert(t, newKey(t).PublicKey(), func(cert *ssh.Certificate) {
+		cert.Serial = 0
+		cert.KeyId = "revoked-id"
+	})
+	assert.True(t, krl.IsRevoked(cert))
+}
+
+func TestKRLRevokedKeys(t *testing.T) {
+	krl, err := LoadKRL("./testdata/krl")
+	assert.Nil(t, err)
+	assert.True(t, krl.IsRevoked(newCert(t, mustPublicKey(t, "./testdata/revoked.pub"), nil)))
+	assert.True(t, krl.IsRevoked(newCert(t, mustPublicKey(t, "./testdata/fingerprint.pub"), nil)))
+}
+
+func TestKRLOtherCA(t *testing.T) {
+	krl, err := LoadKRL("./testdata/krl")
+	assert.Nil(t, err)
+	cert := newCert(t, newKey(t).PublicKey(), func(cert *ssh.Certificate) { cert.Serial = 2 })
+	assert.Nil(t, cert.SignCert(rand.Reader, newKey(t)))
+	assert.False(t, krl.IsRevoked(cert))
+}
+
+func TestParseKRLInvalid(t *testing.T) {
+	_, err := ParseKRL([]byte("not a krl"))
+	assert.Error(t, err)
+
+	data, err := ioutil.ReadFile("./testdata/krl")
+	assert.Nil(t, err)
+	for _, length := range []int{len(krlMagic) + 2, len(krlMagic) + 30, len(data) - 1} {
+		_, err := ParseKRL(data[:length])
+		assert.Error(t, err, "truncated to %d bytes", length)
+	}
+}
@@ -0,0 +1,178 @@
+package verify
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A token is a certificate with a signature by its private key, which shows
+// that whoever presents the certificate holds the key. Certificates are public,
+// so they can't be used as bearer credentials on their own. Tokens are
+// encoded as
+//
+//	sshca1.CERTIFICATE.PAYLOAD.SIGNATURE
+//
+// with each part in unpadded base64url. The payload holds the audience and the
+// time the token was made, and the signature is of tokenContext, the
+// certificate and the payload.
+
+const tokenPrefix = "sshca1"
+
+// tokenContext is prepended to the data that is signed, so that a token can't
+// be confused with a signature made for any other purpose.
+const tokenContext = "sshca-token@ratorx.github.io\x00"
+
+// DefaultMaxTokenAge is how long a token can be used for by default.
+const DefaultMaxTokenAge = 5 * time.Minute
+
+// maxClockSkew is how far in the future a token can be made, to allow for the
+// clocks of the client and the verifier being different.
+const maxClockSkew = time.Minute
+
+// tokenPayload is the signed payload of a token.
+type tokenPayload struct {
+	Audience string
+	IssuedAt uint64
+}
+
+// Token is a parsed token. It has not been verified.
+type Token struct {
+	Certificate *ssh.Certificate
+	Audience    string
+	IssuedAt    time.Time
+	payload     []byte
+	signature   *ssh.Signature
+}
+
+// NewToken makes a token for cert, which is used with audience, at now.
+// signer must be the private key of the certificate.
+func NewToken(signer ssh.Signer, cert *ssh.Certificate, audience string, now time.Time) (string, error) {
+	if string(signer.PublicKey().Marshal()) != string(cert.Key.Marshal()) {
+		return "", fmt.Errorf("the private key does not match the certificate")
+	}
+	payload := ssh.Marshal(tokenPayload{audience, uint64(now.Unix())})
+	data := tokenData(cert.Marshal(), payload)
+
+	var signature *ssh.Signature
+	var err error
+	if algorithmSigner, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// ssh-rsa signatures use SHA-1
+		signature, err = algorithmSigner.SignWithAlgorithm(rand.Reader, data, ssh.SigAlgoRSASHA2256)
+	} else {
+		signature, err = signer.Sign(rand.Reader, data)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	parts := []string{tokenPrefix}
+	for _, part := range [][]byte{cert.Marshal(), payload, ssh.Marshal(signature)} {
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(part))
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// ParseToken parses a token, with or without a "Bearer " prefix (as in an
+// HTTP Authorization header).
+func ParseToken(token string) (*Token, error) {
+	token = strings.TrimSpace(token)
+	if len(token) > len("Bearer ") && strings.EqualFold(token[:len("Bearer ")], "Bearer ") {
+		token = strings.TrimSpace(token[len("Bearer "):])
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 || parts[0] != tokenPrefix {
+		return nil, fmt.Errorf("not an sshca token")
+	}
+	var decoded [][]byte
+	for _, part := range parts[1:] {
+		data, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token encoding: %w", err)
+		}
+		decoded = append(decoded, data)
+	}
+
+	key, err := ssh.ParsePublicKey(decoded[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token certificate: %w", err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("token has a key rather than a certificate")
+	}
+	var payload tokenPayload
+	if err := ssh.Unmarshal(decoded[1], &payload); err != nil {
+		return nil, fmt.Errorf("invalid token payload: %w", err)
+	}
+	var signature ssh.Signature
+	if err := ssh.Unmarshal(decoded[2], &signature); err != nil {
+		return nil, fmt.Errorf("invalid token signature: %w", err)
+	}
+	return &Token{
+		Certificate: cert,
+		Audience:    payload.Audience,
+		IssuedAt:    time.Unix(int64(payload.IssuedAt), 0),
+		payload:     decoded[1],
+		signature:   &signature,
+	}, nil
+}
+
+// VerifyToken parses and verifies a token, and returns its certificate. The
+// token must be for the audience of the verifier, recent, and signed by the
+// key of the certificate, and the certificate must pass Verify.
+func (v Verifier) VerifyToken(token string, principal string, addr net.IP) (*ssh.Certificate, error) {
+	parsed, err := ParseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Audience != v.Audience {
+		return nil, fmt.Errorf("token is for audience %q, not %q", parsed.Audience, v.Audience)
+	}
+	maxAge := v.MaxTokenAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxTokenAge
+	}
+	now := v.now()
+	if parsed.IssuedAt.After(now.Add(maxClockSkew)) {
+		return nil, fmt.Errorf("token was made in the future (at %s)", parsed.IssuedAt.Format(time.RFC3339))
+	}
+	if now.Sub(parsed.IssuedAt) > maxAge {
+		return nil, fmt.Errorf("token has expired (made at %s)", parsed.IssuedAt.Format(time.RFC3339))
+	}
+	cert := parsed.Certificate
+	if parsed.signature.Format == ssh.KeyAlgoRSA {
+		return nil, fmt.Errorf("token signature uses SHA-1")
+	}
+	if err := cert.Key.Verify(tokenData(cert.Marshal(), parsed.payload), parsed.signature); err != nil {
+		return nil, fmt.Errorf("token signature does not match the certificate")
+	}
+	if err := v.Verify(cert, principal, addr); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// tokenData returns the data that is signed for a token.
+func tokenData(cert []byte, payload []byte) []byte {
+	data := []byte(tokenContext)
+	data = append(data, ssh.Marshal(struct{ Certificate []byte }{cert})...)
+	return append(data, payload...)
+}
+
+// decodeBase64 decodes standard or URL base64, with or without padding. It
+// returns nil if s isn't base64.
+func decodeBase64(s string) []byte {
+	s = strings.TrimRight(s, "=")
+	for _, encoding := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+		if data, err := encoding.DecodeString(s); err == nil {
+			return data
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package verify
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestToken(t *testing.T, audience string, issuedAt time.Time) (string, *ssh.Certificate) {
+	t.Helper()
+	key := newKey(t)
+	cert := newCert(t, key.PublicKey(), nil)
+	token, err := NewToken(key, cert, audience, issuedAt)
+	assert.Nil(t, err)
+	return token, cert
+}
+
+func TestVerifyToken(t *testing.T) {
+	token, cert := newTestToken(t, "https://api.example.com", testNow)
+	verifier := newTestVerifier(t)
+	verifier.Audience = "https://api.example.com"
+	verified, err := verifier.VerifyToken(token, "alice", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, cert.Marshal(), verified.Marshal())
+
+	_, err = verifier.VerifyToken("Bearer "+token, "alice", nil)
+	assert.Nil(t, err)
+	_, err = verifier.VerifyToken(token, "bob", nil)
+	assert.Error(t, err)
+}
+
+func TestVerifyTokenAudience(t *testing.T) {
+	token, _ := newTestToken(t, "https://other.example.com", testNow)
+	verifier := newTestVerifier(t)
+	verifier.Audience = "https://api.example.com"
+	_, err := verifier.VerifyToken(token, "alice", nil)
+	assert.Error(t, err)
+}
+
+func TestVerifyTokenAge(t *testing.T) {
+	verifier := newTestVerifier(t)
+	token, _ := newTestToken(t, "", testNow.Add(-DefaultMaxTokenAge-time.Second))
+	_, err := verifier.VerifyToken(token, "alice", nil)
+	assert.Error(t, err)
+
+	verifier.MaxTokenAge = time.Hour
+	_, err = verifier.VerifyToken(token, "alice", nil)
+	assert.Nil(t, err)
+
+	token, _ = newTestToken(t, "", testNow.Add(2*maxClockSkew))
+	_, err = verifier.VerifyToken(token, "alice", nil)
+	assert.Error(t, err)
+}
+
+func TestVerifyTokenWrongKey(t *testing.T) {
+	cert := newCert(t, newKey(t).PublicKey(), nil)
+	_, err := NewToken(newKey(t), cert, "", testNow)
+	assert.Error(t, err)
+}
+
+func TestVerifyTokenTampered(t *testing.T) {
+	token, _ := newTestToken(t, "a", testNow)
+	other, _ := newTestToken(t, "b", testNow)
+	parts := strings.Split(token, ".")
+	parts[2] = strings.Split(other, ".")[2]
+	verifier := newTestVerifier(t)
+	verifier.Audience = "b"
+	_, err := verifier.VerifyToken(strings.Join(parts, "."), "alice", nil)
+	assert.Error(t, err)
+}
+
+func TestVerifyTokenRSA(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	key, err := ssh.NewSignerFromKey(privateKey)
+	assert.Nil(t, err)
+	cert := newCert(t, key.PublicKey(), nil)
+	token, err := NewToken(key, cert, "", testNow)
+	assert.Nil(t, err)
+	parsed, err := ParseToken(token)
+	assert.Nil(t, err)
+	assert.Equal(t, ssh.SigAlgoRSASHA2256, parsed.signature.Format)
+	_, err = newTestVerifier(t).VerifyToken(token, "alice", nil)
+	assert.Nil(t, err)
+}
+
+func TestParseTokenInvalid(t *testing.T) {
+	for _, token := range []string{"", "sshca1", "sshca1.a.b", "jwt.a.b.c", "sshca1.!.b.c"} {
+		_, err := ParseToken(token)
+		assert.Error(t, err, token)
+	}
+}
@@ -0,0 +1,193 @@
+// Package verify validates OpenSSH certificates issued by an sshca CA outside
+// of SSH, so that other services (e.g. HTTPS APIs) can accept them as
+// credentials. It only depends on golang.org/x/crypto/ssh.
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Verifier checks certificates against the keys of the CA and a KRL.
+type Verifier struct {
+	// CAKeys are the trusted CA keys. A certificate must be signed by one of
+	// them.
+	CAKeys []ssh.PublicKey
+	// KRL is the key revocation list of the CA, if any.
+	KRL *KRL
+	// CertType is the type of certificate to accept (ssh.UserCert or
+	// ssh.HostCert). Zero accepts user certificates.
+	CertType uint32
+	// Audience is the audience that tokens must be for. Tokens for any other
+	// audience are rejected, so that a token for one service can't be replayed
+	// to another.
+	Audience string
+	// MaxTokenAge is how long a token can be used for after it is made. Zero
+	// means DefaultMaxTokenAge.
+	MaxTokenAge time.Duration
+	// Clock returns the current time. Nil means time.Now.
+	Clock func() time.Time
+}
+
+// LoadCAKeys reads the CA keys at path, in the format of sshd
+// TrustedUserCAKeys or authorized_keys (e.g. from sshca export).
+func LoadCAKeys(path string) ([]ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA keys at %s: %w", path, err)
+	}
+	keys, err := ParseCAKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CA keys at %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// ParseCAKeys parses CA keys, one per line. Empty lines and comments are
+// skipped.
+func ParseCAKeys(data []byte) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if _, ok := key.(*ssh.Certificate); ok {
+			return nil, fmt.Errorf("line %d: a certificate can't be a CA key", lineNumber)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no CA keys")
+	}
+	return keys, nil
+}
+
+// ParseCertificate parses a certificate in the format of a -cert.pub file, or
+// its bare base64 encoding.
+func ParseCertificate(data []byte) (*ssh.Certificate, error) {
+	data = bytes.TrimSpace(data)
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		// Without the type prefix
+		key, err = ssh.ParsePublicKey(decodeBase64(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("not a certificate")
+	}
+	return cert, nil
+}
+
+func (v Verifier) now() time.Time {
+	if v.Clock == nil {
+		return time.Now()
+	}
+	return v.Clock()
+}
+
+// Verify checks that cert was signed by one of the CA keys, is valid now, is
+// not revoked, and is valid for principal (if it isn't empty). addr is the
+// address of the client presenting the certificate, which is checked against
+// the source-address of the certificate; certificates with a source-address
+// are rejected if it is nil. Certificates with any other critical option (e.g.
+// force-command) are rejected, since they can't be enforced outside of SSH.
+func (v Verifier) Verify(cert *ssh.Certificate, principal string, addr net.IP) error {
+	certType := v.CertType
+	if certType == 0 {
+		certType = ssh.UserCert
+	}
+	if cert.CertType != certType {
+		return fmt.Errorf("certificate is not a %s certificate", certTypeString(certType))
+	}
+	if !v.isAuthority(cert.SignatureKey) {
+		return fmt.Errorf("certificate is not signed by a trusted CA")
+	}
+	if principal != "" && !containsString(cert.ValidPrincipals, principal) {
+		return fmt.Errorf("certificate is not valid for principal %q", principal)
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return fmt.Errorf("certificate has no principals")
+	}
+	if sourceAddress, ok := cert.CriticalOptions["source-address"]; ok {
+		if err := checkSourceAddress(sourceAddress, addr); err != nil {
+			return err
+		}
+	}
+
+	checker := ssh.CertChecker{Clock: v.now}
+	// CheckCert always checks a principal, which was checked above
+	if err := checker.CheckCert(cert.ValidPrincipals[0], cert); err != nil {
+		return fmt.Errorf("invalid certificate: %s", strings.TrimPrefix(err.Error(), "ssh: "))
+	}
+	if v.KRL != nil && v.KRL.IsRevoked(cert) {
+		return fmt.Errorf("certificate is revoked")
+	}
+	return nil
+}
+
+// isAuthority reports whether key is one of the CA keys.
+func (v Verifier) isAuthority(key ssh.PublicKey) bool {
+	for _, caKey := range v.CAKeys {
+		if bytes.Equal(caKey.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSourceAddress checks that addr is in the comma-separated list of
+// addresses and CIDRs of a source-address option.
+func checkSourceAddress(sourceAddress string, addr net.IP) error {
+	if addr == nil {
+		return fmt.Errorf("certificate is restricted to source addresses %s, and the client address is unknown", sourceAddress)
+	}
+	for _, allowed := range strings.Split(sourceAddress, ",") {
+		if ip := net.ParseIP(allowed); ip != nil {
+			if ip.Equal(addr) {
+				return nil
+			}
+			continue
+		}
+		_, network, err := net.ParseCIDR(allowed)
+		if err != nil {
+			return fmt.Errorf("certificate has an invalid source-address %q", sourceAddress)
+		}
+		if network.Contains(addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("certificate is not valid from %s (source-address %s)", addr, sourceAddress)
+}
+
+func certTypeString(certType uint32) string {
+	if certType == ssh.HostCert {
+		return "host"
+	}
+	return "user"
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package verify
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func mustSigner(t *testing.T, path string) ssh.Signer {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	signer, err := ssh.ParsePrivateKey(data)
+	assert.Nil(t, err)
+	return signer
+}
+
+func mustPublicKey(t *testing.T, path string) ssh.PublicKey {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	assert.Nil(t, err)
+	return key
+}
+
+func newKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	assert.Nil(t, err)
+	return signer
+}
+
+// newCert returns a certificate for key, signed by the test CA, which is valid
+// for an hour around testNow. modify can change it before it is signed.
+func newCert(t *testing.T, key ssh.PublicKey, modify func(*ssh.Certificate)) *ssh.Certificate {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          1,
+		CertType:        ssh.UserCert,
+		KeyId:           "alice@laptop",
+		ValidPrincipals: []string{"alice"},
+		ValidAfter:      uint64(testNow.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(testNow.Add(time.Hour).Unix()),
+		Permissions:     ssh.Permissions{CriticalOptions: map[string]string{}},
+	}
+	if modify != nil {
+		modify(cert)
+	}
+	assert.Nil(t, cert.SignCert(rand.Reader, mustSigner(t, "./testdata/ca")))
+	return cert
+}
+
+var testNow = time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestVerifier(t *testing.T) Verifier {
+	t.Helper()
+	return Verifier{
+		CAKeys: []ssh.PublicKey{mustPublicKey(t, "./testdata/ca.pub")},
+		Clock:  func() time.Time { return testNow },
+	}
+}
+
+func TestVerify(t *testing.T) {
+	cert := newCert(t, newKey(t).PublicKey(), nil)
+	verifier := newTestVerifier(t)
+	assert.Nil(t, verifier.Verify(cert, "alice", nil))
+	assert.Nil(t, verifier.Verify(cert, "", nil))
+	assert.Error(t, verifier.Verify(cert, "bob", nil))
+}
+
+func TestVerifyUntrustedCA(t *testing.T) {
+	cert := newCert(t, newKey(t).PublicKey(), nil)
+	verifier := newTestVerifier(t)
+	verifier.CAKeys = []ssh.PublicKey{newKey(t).PublicKey()}
+	assert.Error(t, verifier.Verify(cert, "alice", nil))
+}
+
+func TestVerifyValidity(t *testing.T) {
+	cert := newCert(t, newKey(t).PublicKey(), nil)
+	verifier := newTestVerifier(t)
+	verifier.Clock = func() time.Time { return testNow.Add(2 * time.Hour) }
+	assert.Error(t, verifier.Verify(cert, "alice", nil))
+	verifier.Clock = func() time.Time { return testNow.Add(-2 * time.Hour) }
+	assert.Error(t, verifier.Verify(cert, "alice", nil))
+}
+
+func TestVerifyCertType(t *testing.T) {
+	cert := newCert(t, newKey(t).PublicKey(), func(cert *ssh.Certificate) { cert.CertType = ssh.HostCert })
+	verifier := newTestVerifier(t)
+	assert.Error(t, verifier.Verify(cert, "alice", nil))
+	verifier.CertType = ssh.HostCert
+	assert.Nil(t, verifier.Verify(cert, "alice", nil))
+}
+
+func TestVerifyNoPrincipals(t *testing.T) {
+	cert := newCert(t, newKey(t).PublicKey(), func(cert *ssh.Certificate) { cert.ValidPrincipals = nil })
+	assert.Error(t, newTestVerifier(t).Verify(cert, "", nil))
+}
+
+func TestVerifyTamperedCertificate(t *testing.T) {
+	cert := newCert(t, newKey(t).PublicKey(), nil)
+	cert.ValidPrincipals = []string{"root"}
+	assert.Error(t, newTestVerifier(t).Verify(cert, "root", nil))
+}
+
+func TestVerifyCriticalOptions(t *testing.T) {
+	cert := newCert(t, newKey(t).PublicKey(), func(cert *ssh.Certificate) {
+		cert.CriticalOptions["force-command"] = "true"
+	})
+	assert.Error(t, newTestVerifier(t).Verify(cert, "alice", nil))
+}
+
+func TestVerifySourceAddress(t *testing.T) {
+	cert := newCert(t, newKey(t).PublicKey(), func(cert *ssh.Certificate) {
+		cert.CriticalOptions["source-address"] = "192.0.2.1,10.0.0.0/8"
+	})
+	verifier := newTestVerifier(t)
+	assert.Nil(t, verifier.Verify(cert, "alice", net.ParseIP("192.0.2.1")))
+	assert.Nil(t, verifier.Verify(cert, "alice", net.ParseIP("10.1.2.3")))
+	assert.Error(t, verifier.Verify(cert, "alice", net.ParseIP("192.0.2.2")))
+	assert.Error(t, verifier.Verify(cert, "alice", nil))
+}
+
+func TestVerifyRevoked(t *testing.T) {
+	verifier := newTestVerifier(t)
+	krl, err := LoadKRL("./testdata/krl")
+	assert.Nil(t, err)
+	verifier.KRL = krl
+	assert.Nil(t, verifier.Verify(newCert(t, newKey(t).PublicKey(), nil), "alice", nil))
+	revoked := newCert(t, newKey(t).PublicKey(), func(cert *ssh.Certificate) { cert.Serial = 2 })
+	assert.Error(t, verifier.Verify(revoked, "alice", nil))
+}
+
+func TestParseCAKeys(t *testing.T) {
+	keys, err := ParseCAKeys([]byte("# CA keys\n\n" + string(ssh.MarshalAuthorizedKey(newKey(t).PublicKey())) + "cert-authority " + string(ssh.MarshalAuthorizedKey(newKey(t).PublicKey()))))
+	assert.Nil(t, err)
+	assert.Len(t, keys, 2)
+
+	_, err = ParseCAKeys([]byte("# no keys\n"))
+	assert.Error(t, err)
+	_, err = ParseCAKeys(ssh.MarshalAuthorizedKey(newCert(t, newKey(t).PublicKey(), nil)))
+	assert.Error(t, err)
+}
+
+func TestLoadCAKeys(t *testing.T) {
+	keys, err := LoadCAKeys("./testdata/ca.pub")
+	assert.Nil(t, err)
+	assert.Len(t, keys, 1)
+	_, err = LoadCAKeys("./testdata/missing.pub")
+	assert.Error(t, err)
+}
+
+func TestParseCertificate(t *testing.T) {
+	cert := newCert(t, newKey(t).PublicKey(), nil)
+	parsed, err := ParseCertificate(ssh.MarshalAuthorizedKey(cert))
+	assert.Nil(t, err)
+	assert.Equal(t, cert.Marshal(), parsed.Marshal())
+
+	bare := bytes.Fields(ssh.MarshalAuthorizedKey(cert))[1]
+	parsed, err = ParseCertificate(bare)
+	assert.Nil(t, err)
+	assert.Equal(t, cert.Marshal(), parsed.Marshal())
+
+	_, err = ParseCertificate(ssh.MarshalAuthorizedKey(newKey(t).PublicKey()))
+	assert.Error(t, err)
+}
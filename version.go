@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ratorx/sshca/ca"
+)
+
+// VersionCmd is the command that prints the version, and optionally compares
+// it with a server.
+type VersionCmd struct {
+	CheckRemote string `arg:"--check-remote" placeholder:"REMOTE" help:"also print the version of the remote server, and check that it is compatible"`
+}
+
+// Validate implementation for Command
+func (v VersionCmd) Validate() error {
+	return nil
+}
+
+// Run implementation for Command
+func (v VersionCmd) Run() error {
+	fmt.Printf("client: sshca %s (protocol %d)\n", ca.Version, ca.ProtocolVersion)
+	if v.CheckRemote == "" {
+		return nil
+	}
+
+	client, err := RPCFlags{Remote: v.CheckRemote, ConnectTimeout: 10 * time.Second}.dialRemote()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	reply, err := client.Version()
+	if err != nil {
+		if isUnsupportedRPC(err) {
+			return fmt.Errorf("server: unknown version (older than this client)")
+		}
+		return fmt.Errorf("failed to get server version: %w", err)
+	}
+	fmt.Printf("server: sshca %s (protocol %d, compatible with protocol %d and later)\n", reply.Version, reply.ProtocolVersion, reply.MinProtocolVersion)
+	return reply.CheckCompatible()
+}